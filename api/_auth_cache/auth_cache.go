@@ -94,7 +94,7 @@ func GetUserId(ctx rcontext.RequestContext, accessToken string, appserviceUserId
 		if token.err != nil {
 			return "", token.err
 		}
-		ctx.Log.Debugf("Access token belongs to %s", token.userId)
+		ctx.Log.WithField("userId", token.userId).Debug("Access token belongs to user")
 		return token.userId, nil
 	}
 
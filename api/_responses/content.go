@@ -1,6 +1,11 @@
 package _responses
 
-import "io"
+import (
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/audit"
+	"github.com/t2bot/matrix-media-repo/util"
+)
 
 type EmptyResponse struct{}
 
@@ -14,6 +19,34 @@ type DownloadResponse struct {
 	SizeBytes         int64
 	Data              io.ReadCloser
 	TargetDisposition string
+
+	// ContentRange is set when Data is already limited to a byte range, rather than being the whole file.
+	ContentRange *util.ContentRange
+
+	// ServerTiming is called once Data has been sent, and the result sent as the Server-Timing trailer, if set.
+	// This lets it include time spent producing Data as it is read, such as encoding a thumbnail.
+	ServerTiming func() string
+
+	// ThumbnailWidth and ThumbnailHeight are the dimensions a thumbnail was generated for, after adjusting the
+	// request to fit the configured sizes. Sent as the X-Thumbnail-Width and X-Thumbnail-Height headers, if set.
+	ThumbnailWidth  int
+	ThumbnailHeight int
+
+	// ThumbnailOutputWidth and ThumbnailOutputHeight are the dimensions of the thumbnail itself, which can differ
+	// from the above to keep the source's aspect ratio. Sent as the X-Thumbnail-Output-Width and
+	// X-Thumbnail-Output-Height headers, if known.
+	ThumbnailOutputWidth  int
+	ThumbnailOutputHeight int
+
+	// Audit is completed with what was actually served and written to the audit log, if set.
+	Audit *audit.Record
+}
+
+// EventStreamResponse is sent as server-sent events. Each value received from Events is sent as a JSON event
+// until the channel is closed or the client goes away, after which Close is called.
+type EventStreamResponse struct {
+	Events <-chan interface{}
+	Close  func()
 }
 
 type StreamDataResponse struct {
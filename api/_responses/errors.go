@@ -1,6 +1,10 @@
 package _responses
 
-import "github.com/t2bot/matrix-media-repo/common"
+import (
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common"
+)
 
 type ErrorResponse struct {
 	Code         string `json:"errcode"`
@@ -24,10 +28,62 @@ func RateLimitReached() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeRateLimitExceeded, "Rate Limited", common.ErrCodeRateLimitExceeded}
 }
 
+// RateLimitedResponse is a rate limit error which says when the request can be made again.
+type RateLimitedResponse struct {
+	ErrorResponse
+	RetryAfterMs int64 `json:"retry_after_ms"`
+}
+
+func RateLimitedFor(retryAfter time.Duration) *RateLimitedResponse {
+	return &RateLimitedResponse{
+		ErrorResponse: *RateLimitReached(),
+		RetryAfterMs:  retryAfter.Milliseconds(),
+	}
+}
+
+func TooManyUploads() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeRateLimitExceeded, "Too many concurrent uploads", common.ErrCodeRateLimitExceeded}
+}
+
+func RequestTimedOut() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnknown, "Request timed out", common.ErrCodeTimedOut}
+}
+
+func ReadOnly() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnavailable, "The media repo is read-only for maintenance", common.ErrCodeUnavailable}
+}
+
+func ServerBusy() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnavailable, "The media repo is too busy, please try again later", common.ErrCodeServerBusy}
+}
+
+func OriginRateLimited() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnavailable, "The previewed site is rate limiting requests, please try again later", common.ErrCodeOriginRateLimited}
+}
+
+func RangeNotSatisfiable() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnknown, "out of range", common.ErrCodeRangeNotSatisfiable}
+}
+
 func NotFoundError() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeNotFound, "Not found", common.ErrCodeNotFound}
 }
 
+func RemoteFetchDisabled() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeNotFound, "Remote media is not cached, and allow_remote is false", common.ErrCodeRemoteFetchDisabled}
+}
+
+func RemoteFetchFailed() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnknown, "Unable to fetch remote media", common.ErrCodeRemoteFetchFailed}
+}
+
+func UploadQuarantined(errcode string) *ErrorResponse {
+	if errcode == "" {
+		errcode = common.ErrCodeMediaMalicious
+	}
+	return &ErrorResponse{errcode, "This media has been quarantined", common.ErrCodeMediaMalicious}
+}
+
 func RequestTooLarge() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeTooLarge, "Too Large", common.ErrCodeMediaTooLarge}
 }
@@ -56,6 +112,10 @@ func QuotaExceeded() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeForbidden, "Quota Exceeded", common.ErrCodeQuotaExceeded}
 }
 
+func CodecUnavailable() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnknown, "Thumbnails of this format are supported, but not by this server's build", common.ErrCodeCodecUnavailable}
+}
+
 func NotYetUploaded() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeNotYetUploaded, "Media not yet uploaded", common.ErrCodeNotYetUploaded}
 }
@@ -3,3 +3,10 @@ package _responses
 type DoNotCacheResponse struct {
 	Payload interface{}
 }
+
+// NegotiatedResponse is a response which was picked using the named request headers (such as Accept-Language).
+// They are listed in the Vary header so caches keep a copy for each value.
+type NegotiatedResponse struct {
+	Vary    []string
+	Payload interface{}
+}
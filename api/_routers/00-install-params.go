@@ -30,11 +30,12 @@ func GetParam(name string, r *http.Request) string {
 }
 
 func ForceSetParam(name string, val string, r *http.Request) *http.Request {
-	params := httprouter.ParamsFromContext(r.Context())
+	// Copy the params so the request we were given doesn't change underneath its other users
+	params := append(httprouter.Params{}, httprouter.ParamsFromContext(r.Context())...)
 	wasSet := false
-	for _, p := range params {
+	for i, p := range params {
 		if p.Key == name {
-			p.Value = val
+			params[i].Value = val
 			wasSet = true
 			break
 		}
@@ -0,0 +1,99 @@
+package _routers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+)
+
+// NewTimeoutRouter limits the total time a request may take, including reading the request body. Requests
+// which take too long receive an error response. The response is buffered, so this should not be used on
+// routes which stream large amounts of data. A zero or negative timeout disables the limit.
+func NewTimeoutRouter(timeout time.Duration, next http.Handler) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	b, _ := json.Marshal(_responses.RequestTimedOut())
+	th := http.TimeoutHandler(next, timeout, string(b))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		defer resetDeadlines(rc)
+		applyBodyDeadline(r, rc, timeout, false)
+
+		w.Header().Set("Content-Type", "application/json") // for the timeout response - replaced by real responses
+		th.ServeHTTP(w, r)
+	})
+}
+
+// NewIdleTimeoutRouter limits how long a request may go without making progress. The deadline is extended
+// each time request body data is read or response data is written, so slow transfers are not interrupted
+// while data is still flowing. A zero or negative timeout disables the limit.
+func NewIdleTimeoutRouter(timeout time.Duration, next http.Handler) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		defer resetDeadlines(rc)
+		applyBodyDeadline(r, rc, timeout, true)
+		next.ServeHTTP(&idleResponseWriter{ResponseWriter: w, rc: rc, idle: timeout}, r)
+	})
+}
+
+func applyBodyDeadline(r *http.Request, rc *http.ResponseController, timeout time.Duration, idle bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		// Without a body the server is already waiting on the connection in the background, and would cancel
+		// the request when the deadline passes.
+		return
+	}
+	_ = rc.SetReadDeadline(time.Now().Add(timeout))
+	body := &deadlineBody{ReadCloser: r.Body, rc: rc}
+	if idle {
+		body.idle = timeout
+	}
+	r.Body = body
+}
+
+func resetDeadlines(rc *http.ResponseController) {
+	// Connections are reused, and the server won't reset these for the next request by itself
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+}
+
+type deadlineBody struct {
+	io.ReadCloser
+	rc   *http.ResponseController
+	idle time.Duration
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	if b.idle > 0 {
+		_ = b.rc.SetReadDeadline(time.Now().Add(b.idle))
+	}
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		// The server reads from the connection in the background once the body is done, and would cancel
+		// the request if the deadline passed while the handler is still working.
+		_ = b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+type idleResponseWriter struct {
+	http.ResponseWriter
+	rc   *http.ResponseController
+	idle time.Duration
+}
+
+func (w *idleResponseWriter) Write(p []byte) (int, error) {
+	_ = w.rc.SetWriteDeadline(time.Now().Add(w.idle))
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *idleResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,86 @@
+package _routers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+// GetForwardedHost returns the host the request was originally made to, as reported by a reverse proxy through
+// the configured header (X-Forwarded-Host or Forwarded). An empty string is returned if the header is not present,
+// or the request did not come from a trusted proxy.
+func GetForwardedHost(r *http.Request) string {
+	return ResolveForwardedHost(r, config.Get().General)
+}
+
+// ResolveForwardedHost is GetForwardedHost with the given configuration. Only the configured header is read, so a
+// client can't use the other one to get around the proxy, and nothing is trusted until proxies are configured.
+func ResolveForwardedHost(r *http.Request, general config.GeneralConfig) string {
+	if !general.UseForwardedHost {
+		return ""
+	}
+
+	headerName := general.ForwardedHostHeader
+	if headerName == "" {
+		headerName = "X-Forwarded-Host"
+	}
+	header := r.Header.Values(headerName)
+	if len(header) == 0 {
+		return ""
+	}
+	if !isTrustedProxy(r.RemoteAddr, general.TrustedProxies) {
+		if logger := GetLogger(r); logger != nil {
+			logger.Debugf("Ignoring %s header from untrusted address %s", headerName, r.RemoteAddr)
+		}
+		return ""
+	}
+
+	// When a request passes through several proxies, the last value is the one set by the proxy closest to us.
+	if strings.EqualFold(headerName, "Forwarded") {
+		elements := strings.Split(header[len(header)-1], ",")
+		for _, pair := range strings.Split(elements[len(elements)-1], ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(k, "host") {
+				return strings.Trim(v, "\"")
+			}
+		}
+		return ""
+	}
+	values := strings.Split(header[len(header)-1], ",")
+	return strings.TrimSpace(values[len(values)-1])
+}
+
+func isTrustedProxy(remoteAddr string, cidrs []string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if net.ParseIP(cidr).Equal(ip) {
+				return true
+			}
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logrus.Warn("Error parsing trusted proxy range: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
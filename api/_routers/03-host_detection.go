@@ -28,10 +28,16 @@ func NewHostRouter(next http.Handler) *HostRouter {
 }
 
 func (h *HostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Header.Get("X-Forwarded-Host") != "" && config.Get().General.UseForwardedHost {
-		r.Host = r.Header.Get("X-Forwarded-Host")
+	if forwardedHost := GetForwardedHost(r); forwardedHost != "" {
+		r.Host = forwardedHost
 	}
 	r.Host = strings.Split(r.Host, ":")[0]
+	r.Host = util.CanonicalServerName(r.Host)
+
+	// Media is stored and looked up with the canonical server name, so make sure routes see that one
+	if server := GetParam("server", r); server != "" {
+		r = ForceSetParam("server", util.CanonicalServerName(server), r)
+	}
 
 	var raddr string
 	if config.Get().General.TrustAnyForward {
@@ -70,7 +76,7 @@ func (h *HostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return // don't call next handler
 	}
 
-	cfg := config.GetDomain(r.Host)
+	cfg := util.GetDomainConfig(r.Host)
 	if ignoreHost {
 		dc := config.DomainConfigFrom(*config.Get())
 		cfg = &dc
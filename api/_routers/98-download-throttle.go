@@ -0,0 +1,64 @@
+package _routers
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"golang.org/x/time/rate"
+)
+
+// throttledWriter writes no faster than its token bucket allows, so one download can't use all of the bandwidth.
+// Writes are split into pieces no larger than the bucket, as larger ones could never be allowed.
+type throttledWriter struct {
+	w       io.Writer
+	ctx     context.Context
+	limiter *rate.Limiter
+	waited  bool
+}
+
+// newThrottledWriter limits writes to w per the config. If the config doesn't limit downloads, w is returned as-is
+// so it can still use any optimizations (like sendfile) it has.
+func newThrottledWriter(ctx context.Context, w io.Writer, conf config.DownloadThrottle) io.Writer {
+	if conf.BytesPerSecond <= 0 {
+		return w
+	}
+	burst := conf.BurstBytes
+	if burst <= 0 {
+		burst = conf.BytesPerSecond
+	}
+	return &throttledWriter{
+		w:       w,
+		ctx:     ctx,
+		limiter: rate.NewLimiter(rate.Limit(conf.BytesPerSecond), int(burst)),
+	}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), t.limiter.Burst())
+
+		start := time.Now()
+		if err := t.limiter.WaitN(t.ctx, n); err != nil {
+			return written, err
+		}
+		if waited := time.Since(start); waited >= time.Millisecond {
+			if !t.waited {
+				t.waited = true
+				metrics.DownloadsThrottled.Inc()
+			}
+			metrics.DownloadThrottleWaitSeconds.Add(waited.Seconds())
+		}
+
+		m, err := t.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -7,17 +7,20 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"mime"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/alioygur/is"
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/gotd-contrib/http_range"
 	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/audit"
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/logging"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/util"
 	"github.com/t2bot/matrix-media-repo/util/readers"
@@ -55,14 +58,25 @@ func (c *RContextRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		res = &_responses.EmptyResponse{}
 	}
 
+	headers := w.Header()
+
 	shouldCache := true
-	wrappedRes, isNoCache := res.(*_responses.DoNotCacheResponse)
-	if isNoCache {
-		shouldCache = false
-		res = wrappedRes.Payload
+	vary := make([]string, 0)
+	for unwrapped := false; !unwrapped; {
+		switch wrappedRes := res.(type) {
+		case *_responses.DoNotCacheResponse:
+			shouldCache = false
+			res = wrappedRes.Payload
+		case *_responses.NegotiatedResponse:
+			vary = append(vary, wrappedRes.Vary...)
+			res = wrappedRes.Payload
+		default:
+			unwrapped = true
+		}
+	}
+	if len(vary) > 0 {
+		headers.Set("Vary", strings.Join(vary, ", "))
 	}
-
-	headers := w.Header()
 
 	// Check for redirection early
 	if redirect, isRedirect := res.(*_responses.RedirectResponse); isRedirect {
@@ -93,15 +107,34 @@ func (c *RContextRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return // don't continue
 	}
 
+	// Event streams are written as they happen rather than all at once
+	if eventsRes, isEvents := res.(*_responses.EventStreamResponse); isEvents {
+		log.Infof("Replying with result: %T", res)
+		defer eventsRes.Close()
+
+		headers.Set("Content-Type", "text/event-stream")
+		headers.Set("Cache-Control", "no-cache")
+		r = writeStatusCode(w, r, http.StatusOK)
+		writeEventStream(w, r, eventsRes.Events)
+		return // don't continue
+	}
+
 	// Next try handling the response as a download, which might turn into an error
 	proposedStatusCode := http.StatusOK
 	var stream io.ReadCloser
 	expectedBytes := int64(0)
 	var contentType string
+	var auditRecord *audit.Record
+	var serverTiming func() string
+	throttle := false
 beforeParseDownload:
-	log.Infof("Replying with result: %T %+v", res, res)
+	log.Infof("Replying with result: %T %+v", res, loggableResult(res))
 	if downloadRes, isDownload := res.(*_responses.DownloadResponse); isDownload {
-		ranges, err := http_range.ParseRange(r.Header.Get("Range"), downloadRes.SizeBytes, rctx.Config.Downloads.DefaultRangeChunkSizeBytes)
+		var ranges []http_range.Range
+		var err error
+		if downloadRes.ContentRange == nil && downloadRes.SizeBytes >= 0 {
+			ranges, err = http_range.ParseRange(r.Header.Get("Range"), downloadRes.SizeBytes, rctx.Config.Downloads.DefaultRangeChunkSizeBytes)
+		}
 		if errors.Is(err, http_range.ErrInvalid) {
 			proposedStatusCode = http.StatusRequestedRangeNotSatisfiable
 			res = _responses.BadRequest("invalid range header")
@@ -119,6 +152,7 @@ beforeParseDownload:
 
 		contentType = downloadRes.ContentType
 		expectedBytes = downloadRes.SizeBytes
+		auditRecord = downloadRes.Audit
 
 		if contentType == "" {
 			contentType = "application/octet-stream"
@@ -128,7 +162,27 @@ beforeParseDownload:
 			headers.Set("Cache-Control", "private, max-age=259200") // 3 days
 		}
 
-		if downloadRes.SizeBytes > 0 {
+		if downloadRes.ServerTiming != nil {
+			headers.Set("Trailer", "Server-Timing")
+			serverTiming = downloadRes.ServerTiming
+		}
+
+		exposed := make([]string, 0)
+		if downloadRes.ThumbnailWidth > 0 && downloadRes.ThumbnailHeight > 0 {
+			headers.Set("X-Thumbnail-Width", strconv.Itoa(downloadRes.ThumbnailWidth))
+			headers.Set("X-Thumbnail-Height", strconv.Itoa(downloadRes.ThumbnailHeight))
+			exposed = append(exposed, "X-Thumbnail-Width", "X-Thumbnail-Height")
+		}
+		if downloadRes.ThumbnailOutputWidth > 0 && downloadRes.ThumbnailOutputHeight > 0 {
+			headers.Set("X-Thumbnail-Output-Width", strconv.Itoa(downloadRes.ThumbnailOutputWidth))
+			headers.Set("X-Thumbnail-Output-Height", strconv.Itoa(downloadRes.ThumbnailOutputHeight))
+			exposed = append(exposed, "X-Thumbnail-Output-Width", "X-Thumbnail-Output-Height")
+		}
+		if len(exposed) > 0 {
+			headers.Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+		}
+
+		if downloadRes.SizeBytes > 0 || downloadRes.ContentRange != nil {
 			headers.Set("Accept-Ranges", "bytes")
 		}
 
@@ -154,16 +208,18 @@ beforeParseDownload:
 			if exts != nil && len(exts) > 0 {
 				ext = exts[0]
 			}
-			fname = "file" + ext
-		}
-		if is.ASCII(fname) {
-			headers.Set("Content-Disposition", disposition+"; filename="+url.QueryEscape(fname))
-		} else {
-			headers.Set("Content-Disposition", disposition+"; filename*=utf-8''"+url.QueryEscape(fname))
+			fname = util.PickFilename(rctx.Config.Downloads.DefaultFilename, "file") + ext
 		}
+		headers.Set("Content-Disposition", disposition+"; "+util.ContentDispositionFilename(fname))
 
 		stream = downloadRes.Data
-		if len(ranges) > 0 {
+		throttle = true
+		if downloadRes.ContentRange != nil {
+			// The stream is already limited to the range, such as when the origin server handled it for us
+			headers.Set("Content-Range", downloadRes.ContentRange.String())
+			proposedStatusCode = http.StatusPartialContent
+			expectedBytes = downloadRes.ContentRange.Length()
+		} else if len(ranges) > 0 {
 			if rsc, ok := stream.(io.ReadSeekCloser); ok {
 				target := ranges[0] // we only use the first range (validated up above)
 				if _, err = rsc.Seek(target.Start, io.SeekStart); err != nil {
@@ -181,6 +237,12 @@ beforeParseDownload:
 		}
 	}
 
+	// Rate limit errors also say when to try again
+	if limited, isLimited := res.(*_responses.RateLimitedResponse); isLimited && proposedStatusCode == http.StatusOK {
+		proposedStatusCode = http.StatusTooManyRequests
+		headers.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(float64(limited.RetryAfterMs)/1000)), 10))
+	}
+
 	// Try to find a suitable error code, if one is needed
 	if errRes, isError := res.(_responses.ErrorResponse); isError {
 		res = &errRes // just fix it
@@ -196,6 +258,12 @@ beforeParseDownload:
 		case common.ErrCodeNotFound:
 			proposedStatusCode = http.StatusNotFound
 			break
+		case common.ErrCodeRemoteFetchDisabled:
+			proposedStatusCode = http.StatusNotFound
+			break
+		case common.ErrCodeRemoteFetchFailed:
+			proposedStatusCode = http.StatusBadGateway
+			break
 		case common.ErrCodeMediaTooLarge:
 			proposedStatusCode = http.StatusRequestEntityTooLarge
 			break
@@ -208,12 +276,39 @@ beforeParseDownload:
 		case common.ErrCodeForbidden:
 			proposedStatusCode = http.StatusForbidden
 			break
+		case common.ErrCodeMediaMalicious:
+			proposedStatusCode = http.StatusForbidden
+			break
 		case common.ErrCodeCannotOverwrite:
 			proposedStatusCode = http.StatusConflict
 			break
 		case common.ErrCodeNotYetUploaded:
 			proposedStatusCode = http.StatusGatewayTimeout
 			break
+		case common.ErrCodeRateLimitExceeded:
+			proposedStatusCode = http.StatusTooManyRequests
+			break
+		case common.ErrCodeRangeNotSatisfiable:
+			proposedStatusCode = http.StatusRequestedRangeNotSatisfiable
+			break
+		case common.ErrCodeUnavailable:
+			proposedStatusCode = http.StatusServiceUnavailable
+			if retryAfter := config.Get().ReadOnly.RetryAfterSeconds; retryAfter > 0 {
+				headers.Set("Retry-After", strconv.Itoa(retryAfter))
+			}
+			break
+		case common.ErrCodeOriginRateLimited:
+			proposedStatusCode = http.StatusServiceUnavailable
+			break
+		case common.ErrCodeCodecUnavailable:
+			proposedStatusCode = http.StatusNotImplemented
+			break
+		case common.ErrCodeServerBusy:
+			proposedStatusCode = http.StatusServiceUnavailable
+			if retryAfter := config.Get().MemoryBudget.RetryAfterSeconds; retryAfter > 0 {
+				headers.Set("Retry-After", strconv.Itoa(retryAfter))
+			}
+			break
 		default: // Treat as unknown (a generic server error)
 			proposedStatusCode = http.StatusInternalServerError
 			break
@@ -251,13 +346,72 @@ beforeParseDownload:
 	r = writeStatusCode(w, r, proposedStatusCode)
 
 	defer stream.Close()
-	written, err := io.Copy(w, stream)
+	var out io.Writer = w
+	if throttle {
+		out = newThrottledWriter(r.Context(), w, rctx.Config.Downloads.Throttle)
+	}
+	written, err := io.Copy(out, stream)
 	if err != nil {
 		panic(err) // blow up this request
 	}
 	if expectedBytes > 0 && written != expectedBytes {
 		panic(errors.New(fmt.Sprintf("mismatch transfer size: %d expected, %d sent", expectedBytes, written)))
 	}
+	if serverTiming != nil {
+		if val := serverTiming(); val != "" {
+			headers.Set("Server-Timing", val)
+		}
+	}
+
+	if auditRecord != nil {
+		auditRecord.BytesServed = written
+		auditRecord.Range = headers.Get("Content-Range")
+		audit.Log(auditRecord)
+	}
+}
+
+// loggableResult returns the response with the file name redacted, if log redaction is enabled.
+func loggableResult(res interface{}) interface{} {
+	if downloadRes, isDownload := res.(*_responses.DownloadResponse); isDownload && logging.RedactionEnabled() {
+		redacted := *downloadRes
+		redacted.Filename = logging.Redact(redacted.Filename)
+		return &redacted
+	}
+	return res
+}
+
+// eventStreamKeepaliveInterval is how often a comment is sent on quiet event streams, so proxies and idle
+// timeouts don't close them.
+const eventStreamKeepaliveInterval = 15 * time.Second
+
+func writeEventStream(w http.ResponseWriter, r *http.Request, events <-chan interface{}) {
+	rc := http.NewResponseController(w)
+	_ = rc.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			_, err = w.Write([]byte(": keepalive\n\n"))
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			b, err2 := json.Marshal(ev)
+			if err2 != nil {
+				panic(err2) // blow up this request
+			}
+			_, err = w.Write([]byte("data: " + string(b) + "\n\n"))
+		}
+		if err != nil {
+			return // the client went away
+		}
+		_ = rc.Flush()
+	}
 }
 
 func GetStatusCode(r *http.Request) int {
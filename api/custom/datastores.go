@@ -77,7 +77,7 @@ func MigrateBetweenDatastores(r *http.Request, rctx rcontext.RequestContext, use
 		return _responses.InternalServerError("Unexpected error getting storage estimate")
 	}
 
-	rctx.Log.Infof("User %s has started a datastore media transfer", user.UserId)
+	rctx.Log.WithField("userId", user.UserId).Info("User has started a datastore media transfer")
 	task, err := tasks.RunDatastoreMigration(rctx, sourceDsId, targetDsId, beforeTs)
 	if err != nil {
 		rctx.Log.Error(err)
@@ -0,0 +1,136 @@
+package custom
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type MediaDatastoreInfo struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+	Uri  string `json:"uri"`
+}
+
+type AdminMediaInfo struct {
+	MxcUri      string `json:"mxc_uri"`
+	ContentType string `json:"content_type"`
+	Sha256Hash  string `json:"sha256_hash"`
+	SizeBytes   int64  `json:"size_bytes"`
+	Quarantined bool   `json:"quarantined"`
+
+	// Datastore is nil when the media's datastore is no longer configured
+	Datastore *MediaDatastoreInfo `json:"datastore"`
+	Location  string              `json:"location"`
+	// StoredSizeBytes is the size of the file in the datastore, or nil if it couldn't be found
+	StoredSizeBytes *int64 `json:"stored_size_bytes"`
+	// Compression is how the file is compressed in the datastore, if it is
+	Compression string `json:"compression,omitempty"`
+	// EncryptionKeyId is the ID of the key the file is encrypted with in the datastore, if it is
+	EncryptionKeyId string `json:"encryption_key_id,omitempty"`
+
+	SharedWith     []string `json:"shared_with"`
+	ThumbnailCount int      `json:"thumbnail_count"`
+}
+
+// NewAdminMediaInfo describes where the media is stored. sameHash is every media record with the media's hash,
+// which may include the media itself, and thumbnails are the media's thumbnails.
+func NewAdminMediaInfo(ctx rcontext.RequestContext, record *database.DbMedia, sameHash []*database.DbMedia, thumbnails []*database.DbThumbnail) (*AdminMediaInfo, error) {
+	info := &AdminMediaInfo{
+		MxcUri:          util.MxcUri(record.Origin, record.MediaId),
+		ContentType:     record.ContentType,
+		Sha256Hash:      record.Sha256Hash,
+		SizeBytes:       record.SizeBytes,
+		Quarantined:     record.Quarantined,
+		Location:        record.Location,
+		Compression:     datastores.Compression(record.Location),
+		EncryptionKeyId: datastores.EncryptionKeyId(record.Location),
+		SharedWith:      make([]string, 0),
+		ThumbnailCount:  len(thumbnails),
+	}
+	for _, m := range sameHash {
+		if m.Origin == record.Origin && m.MediaId == record.MediaId {
+			continue
+		}
+		info.SharedWith = append(info.SharedWith, util.MxcUri(m.Origin, m.MediaId))
+	}
+
+	ds, ok := datastores.Get(ctx, record.DatastoreId)
+	if !ok {
+		ctx.Log.Warnf("Datastore %s for media is not configured", record.DatastoreId)
+		return info, nil
+	}
+	uri, err := datastores.GetUri(ds)
+	if err != nil {
+		return nil, err
+	}
+	info.Datastore = &MediaDatastoreInfo{
+		Id:   ds.Id,
+		Type: ds.Type,
+		Uri:  uri,
+	}
+
+	size, err := datastores.StoredSize(ctx, ds, record.Location)
+	if err != nil && !errors.Is(err, datastores.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		info.StoredSizeBytes = &size
+	}
+
+	return info, nil
+}
+
+func GetAdminMediaInfo(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	origin := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+
+	if !_routers.ServerNameRegex.MatchString(origin) {
+		return _responses.BadRequest("invalid origin")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin":  origin,
+		"mediaId": mediaId,
+	})
+
+	record, err := database.GetInstance().Media.Prepare(rctx).GetById(origin, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get media record")
+	}
+	if record == nil {
+		return _responses.NotFoundError()
+	}
+
+	sameHash, err := database.GetInstance().Media.Prepare(rctx).GetByHash(record.Sha256Hash)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get media with the same hash")
+	}
+	thumbnails, err := database.GetInstance().Thumbnails.Prepare(rctx).GetForMedia(origin, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get thumbnails")
+	}
+
+	info, err := NewAdminMediaInfo(rctx, record, sameHash, thumbnails)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get storage information")
+	}
+	return &_responses.DoNotCacheResponse{Payload: info}
+}
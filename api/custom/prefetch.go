@@ -0,0 +1,71 @@
+package custom
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_prefetch"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// maxPrefetchPerRequest limits how much media can be queued in a single request
+const maxPrefetchPerRequest = 100
+
+type prefetchRequest struct {
+	MxcUris []string `json:"mxc_uris"`
+}
+
+type PrefetchResponse struct {
+	Queued   []string          `json:"queued"`
+	Rejected map[string]string `json:"rejected"`
+}
+
+// PrefetchRemoteMedia queues remote media (typically referenced by federation events the homeserver has seen)
+// to be downloaded ahead of any client asking for it.
+func PrefetchRemoteMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	if !config.Get().Downloads.Prefetch.Enabled {
+		return _responses.NotFoundError()
+	}
+
+	defer r.Body.Close()
+	req := &prefetchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return _responses.BadRequest("Error parsing request body: " + err.Error())
+	}
+	if len(req.MxcUris) > maxPrefetchPerRequest {
+		return _responses.BadRequest("Too many MXC URIs")
+	}
+
+	resp := &PrefetchResponse{
+		Queued:   make([]string, 0),
+		Rejected: make(map[string]string),
+	}
+	for _, mxc := range req.MxcUris {
+		origin, mediaId, err := util.SplitMxc(mxc)
+		if err != nil {
+			resp.Rejected[mxc] = "invalid MXC URI"
+			continue
+		}
+		err = pipeline_prefetch.Execute(rctx, origin, mediaId)
+		if err == nil {
+			resp.Queued = append(resp.Queued, mxc)
+		} else if errors.Is(err, common.ErrHostNotAllowed) {
+			resp.Rejected[mxc] = "origin not allowed"
+		} else if errors.Is(err, common.ErrPrefetchQueueFull) {
+			resp.Rejected[mxc] = "queue full"
+		} else {
+			rctx.Log.Error("Unexpected error queueing media for prefetch: ", err)
+			sentry.CaptureException(err)
+			resp.Rejected[mxc] = "unexpected error"
+		}
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: resp}
+}
@@ -194,7 +194,7 @@ func PurgeUserMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta
 
 	_, userDomain, err := util.SplitUserId(userId)
 	if err != nil {
-		rctx.Log.Error("Error parsing user ID ("+userId+"): ", err)
+		rctx.Log.Error("Error parsing user ID: ", err)
 		sentry.CaptureException(err)
 		return _responses.InternalServerError("error parsing user ID")
 	}
@@ -0,0 +1,46 @@
+package custom
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type ReadOnlyState struct {
+	ReadOnly   bool `json:"read_only"`
+	Overridden bool `json:"overridden"`
+}
+
+type readOnlyRequest struct {
+	ReadOnly *bool `json:"read_only"`
+}
+
+func GetReadOnly(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	return &_responses.DoNotCacheResponse{Payload: &ReadOnlyState{
+		ReadOnly:   config.IsReadOnly(),
+		Overridden: config.HasReadOnlyOverride(),
+	}}
+}
+
+// SetReadOnly overrides the configured read-only state for this process. A null value goes back to using the
+// config file.
+func SetReadOnly(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	defer r.Body.Close()
+	req := &readOnlyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return _responses.BadRequest("Error parsing request body: " + err.Error())
+	}
+
+	config.SetReadOnlyOverride(req.ReadOnly)
+	if req.ReadOnly == nil {
+		rctx.Log.Warn("Read-only override cleared - using the config file's value")
+	} else {
+		rctx.Log.Warnf("Read-only mode set to %t by admin", *req.ReadOnly)
+	}
+
+	return GetReadOnly(r, rctx, user)
+}
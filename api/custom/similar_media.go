@@ -0,0 +1,127 @@
+package custom
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// maxSimilarDistance is the largest Hamming distance which can be searched for. Unrelated images are around 32
+// bits apart, so anything close to that would return arbitrary media.
+const maxSimilarDistance = 24
+
+type SimilarMediaEntry struct {
+	MxcUri         string `json:"mxc_uri"`
+	Distance       int    `json:"distance"`
+	PerceptualHash string `json:"perceptual_hash"`
+	SizeBytes      int64  `json:"size_bytes"`
+	UploadedBy     string `json:"uploaded_by"`
+	Sha256Hash     string `json:"sha256_hash"`
+	Quarantined    bool   `json:"quarantined"`
+	UploadName     string `json:"upload_name"`
+	ContentType    string `json:"content_type"`
+	CreatedTs      int64  `json:"created_ts"`
+}
+
+type SimilarMediaResponse struct {
+	PerceptualHash string               `json:"perceptual_hash"`
+	Similar        []*SimilarMediaEntry `json:"similar"`
+}
+
+// GetSimilarMedia finds media which looks like the given media, using the perceptual hashes calculated when
+// uploads.perceptualHashes is enabled. The given media itself is not included.
+func GetSimilarMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	origin := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+
+	if !_routers.ServerNameRegex.MatchString(origin) {
+		return _responses.BadRequest("invalid origin")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin":  origin,
+		"mediaId": mediaId,
+	})
+
+	qs := r.URL.Query()
+	var err error
+	maxDistance := 10
+	if len(qs["max_distance"]) > 0 {
+		maxDistance, err = strconv.Atoi(qs.Get("max_distance"))
+		if err != nil || maxDistance < 0 || maxDistance > maxSimilarDistance {
+			return _responses.BadRequest(fmt.Sprintf("Query parameter 'max_distance' must be an integer between 0 and %d", maxSimilarDistance))
+		}
+	}
+	limit := 100
+	if len(qs["limit"]) > 0 {
+		limit, err = strconv.Atoi(qs.Get("limit"))
+		if err != nil || limit < 0 {
+			return _responses.BadRequest("Query parameter 'limit' must be a non-negative integer")
+		}
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+
+	mediaDb := database.GetInstance().Media.Prepare(rctx)
+	record, err := mediaDb.GetById(origin, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get media record")
+	}
+	if record == nil {
+		return _responses.NotFoundError()
+	}
+	phash, err := mediaDb.GetPerceptualHash(record.Sha256Hash)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get perceptual hash")
+	}
+	if phash == nil {
+		return _responses.BadRequest("Media does not have a perceptual hash")
+	}
+
+	// Ask for one more, as the media itself will be in the results
+	records, err := mediaDb.GetByPerceptualHash(*phash, maxDistance, limit+1)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to search perceptual hashes")
+	}
+
+	resp := &SimilarMediaResponse{
+		PerceptualHash: fmt.Sprintf("%016x", *phash),
+		Similar:        make([]*SimilarMediaEntry, 0),
+	}
+	for _, m := range records {
+		if (m.Origin == origin && m.MediaId == mediaId) || len(resp.Similar) >= limit {
+			continue
+		}
+		resp.Similar = append(resp.Similar, &SimilarMediaEntry{
+			MxcUri:         util.MxcUri(m.Origin, m.MediaId),
+			Distance:       u.HammingDistance(*phash, m.PerceptualHash),
+			PerceptualHash: fmt.Sprintf("%016x", m.PerceptualHash),
+			SizeBytes:      m.SizeBytes,
+			UploadedBy:     m.UserId,
+			Sha256Hash:     m.Sha256Hash,
+			Quarantined:    m.Quarantined,
+			UploadName:     m.UploadName,
+			ContentType:    m.ContentType,
+			CreatedTs:      m.CreationTs,
+		})
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: resp}
+}
@@ -0,0 +1,61 @@
+package custom
+
+import (
+	"net/http"
+
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/i"
+)
+
+const (
+	GeneratorStatusOk        = "ok"
+	GeneratorStatusFailed    = "failed"
+	GeneratorStatusNoFixture = "no_fixture"
+)
+
+type GeneratorDiagnosis struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Disabled bool   `json:"disabled"`
+	Error    string `json:"error,omitempty"`
+
+	FixtureContentType   string `json:"fixture_content_type,omitempty"`
+	Width                int    `json:"width,omitempty"`
+	Height               int    `json:"height,omitempty"`
+	ThumbnailContentType string `json:"thumbnail_content_type,omitempty"`
+	ThumbnailSizeBytes   int64  `json:"thumbnail_size_bytes,omitempty"`
+}
+
+type ThumbnailDiagnostics struct {
+	Generators []*GeneratorDiagnosis `json:"generators"`
+}
+
+func GetThumbnailDiagnostics(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	results := i.DiagnoseGenerators(32, 32, "crop", rctx)
+
+	diagnostics := &ThumbnailDiagnostics{Generators: make([]*GeneratorDiagnosis, 0, len(results))}
+	for _, res := range results {
+		d := &GeneratorDiagnosis{
+			Name:                 res.Name,
+			Status:               GeneratorStatusOk,
+			Disabled:             res.Disabled,
+			FixtureContentType:   res.FixtureContentType,
+			Width:                res.Width,
+			Height:               res.Height,
+			ThumbnailContentType: res.ThumbnailContentType,
+			ThumbnailSizeBytes:   res.ThumbnailBytes,
+		}
+		if !res.HasFixture() {
+			d.Status = GeneratorStatusNoFixture
+		} else if res.Error != nil {
+			d.Status = GeneratorStatusFailed
+			d.Error = res.Error.Error()
+			rctx.Log.Warnf("Generator %s failed to thumbnail its fixture: %s", res.Name, d.Error)
+		}
+		diagnostics.Generators = append(diagnostics.Generators, d)
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: diagnostics}
+}
@@ -9,9 +9,13 @@ import (
 	"github.com/t2bot/matrix-media-repo/api/_apimeta"
 	"github.com/t2bot/matrix-media-repo/api/_responses"
 	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/audit"
 	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
+	"github.com/t2bot/matrix-media-repo/pool"
 	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/readers"
 
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/common"
@@ -70,11 +74,17 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.
 		FetchRemoteIfNeeded: downloadRemote,
 		BlockForReadUntil:   blockFor,
 		CanRedirect:         canRedirect,
+		Range:               download.ParseRemoteRange(r.Header.Get("Range"), rctx.Config.Downloads.DefaultRangeChunkSizeBytes),
 	})
 	if err != nil {
 		var redirect datastores.RedirectError
 		if errors.Is(err, common.ErrMediaNotFound) {
 			return _responses.NotFoundError()
+		} else if errors.Is(err, common.ErrRemoteFetchDisabled) {
+			return _responses.RemoteFetchDisabled()
+		} else if errors.Is(err, common.ErrRemoteFetchFailed) {
+			rctx.Log.Warn("Error fetching remote media: ", err)
+			return _responses.RemoteFetchFailed()
 		} else if errors.Is(err, common.ErrMediaTooLarge) {
 			return _responses.RequestTooLarge()
 		} else if errors.Is(err, common.ErrMediaQuarantined) {
@@ -86,6 +96,11 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.
 			}
 		} else if errors.Is(err, common.ErrMediaNotYetUploaded) {
 			return _responses.NotYetUploaded()
+		} else if errors.Is(err, common.ErrRangeNotSatisfiable) {
+			return _responses.RangeNotSatisfiable()
+		} else if errors.Is(err, common.ErrOriginRangeMismatch) {
+			rctx.Log.Warn("Origin returned an unexpected range: ", err)
+			return _responses.BadGatewayError("Origin returned an unexpected range")
 		} else if errors.As(err, &redirect) {
 			return _responses.Redirect(redirect.RedirectUrl)
 		}
@@ -94,15 +109,47 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.
 		return _responses.InternalServerError("Unexpected Error")
 	}
 
-	if filename == "" {
-		filename = media.UploadName
+	// For remote media, the upload name is the filename the origin gave us when we downloaded it
+	filename = util.PickFilename(filename, media.UploadName)
+
+	sizeBytes := media.SizeBytes
+	if r.Header.Get("Range") == "" && download.ShouldStripMetadata(rctx, media) {
+		stream, sizeBytes, err = download.StripMetadata(rctx, media, stream)
+		if err != nil {
+			rctx.Log.Error("Unexpected error stripping metadata: ", err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("Unexpected Error")
+		}
+	}
+
+	var contentRange *util.ContentRange
+	reserveBytes := sizeBytes
+	if ranged, ok := stream.(*download.RangedStream); ok {
+		contentRange = ranged.Range
+		reserveBytes = contentRange.Length()
+	}
+
+	// The reservation is held until the stream is closed, after the response is sent
+	releaseMemory, err := pool.ReserveMemory(rctx, reserveBytes)
+	if err != nil {
+		rctx.Log.Debug("Memory budget exhausted")
+		stream.Close()
+		return _responses.ServerBusy()
 	}
+	stream = readers.NewCancelCloser(stream, releaseMemory)
 
 	return &_responses.DownloadResponse{
 		ContentType:       media.ContentType,
 		Filename:          filename,
-		SizeBytes:         media.SizeBytes,
+		SizeBytes:         sizeBytes,
 		Data:              stream,
 		TargetDisposition: "infer",
+		ContentRange:      contentRange,
+		Audit: &audit.Record{
+			Action:  audit.ActionDownload,
+			UserId:  user.UserId,
+			Origin:  server,
+			MediaId: mediaId,
+		},
 	}
 }
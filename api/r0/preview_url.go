@@ -2,6 +2,7 @@ package r0
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -9,7 +10,9 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/api/_apimeta"
 	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_preview"
+	"github.com/t2bot/matrix-media-repo/url_previewing/m"
 
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
@@ -27,6 +30,24 @@ type MatrixOpenGraph struct {
 	ImageSize   int64  `json:"matrix:image:size,omitempty"`
 	ImageWidth  int    `json:"og:image:width,omitempty"`
 	ImageHeight int    `json:"og:image:height,omitempty"`
+
+	// Only populated when the URL points directly at a file
+	FileType string `json:"matrix:file:type,omitempty"`
+	FileSize int64  `json:"matrix:file:size,omitempty"`
+
+	// Only populated when galleries are enabled
+	Gallery []*MatrixOpenGraphImage `json:"matrix:image:gallery,omitempty"`
+
+	// Parts of the preview which couldn't be generated, such as an image which failed to download
+	Warnings []string `json:"matrix:warnings,omitempty"`
+}
+
+type MatrixOpenGraphImage struct {
+	ImageMxc    string `json:"og:image"`
+	ImageType   string `json:"og:image:type,omitempty"`
+	ImageSize   int64  `json:"matrix:image:size,omitempty"`
+	ImageWidth  int    `json:"og:image:width,omitempty"`
+	ImageHeight int    `json:"og:image:height,omitempty"`
 }
 
 func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
@@ -48,6 +69,13 @@ func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user _apimeta.Use
 			return _responses.BadRequest(err.Error())
 		}
 	}
+	onlyIfCached := false
+	if onlyIfCachedStr := params.Get("only_if_cached"); onlyIfCachedStr != "" {
+		onlyIfCached, err = strconv.ParseBool(onlyIfCachedStr)
+		if err != nil {
+			return _responses.BadRequest("only_if_cached flag does not appear to be a boolean")
+		}
+	}
 
 	// Validate the URL
 	if urlStr == "" {
@@ -58,6 +86,39 @@ func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user _apimeta.Use
 		return _responses.BadRequest("Scheme not accepted")
 	}
 
+	if languagesStr := params.Get("languages"); languagesStr != "" {
+		languages := parseLanguages(languagesStr)
+		if len(languages) == 0 {
+			return _responses.BadRequest("No languages provided")
+		}
+		if len(languages) > rctx.Config.UrlPreviews.MaxLanguages {
+			return _responses.BadRequest(fmt.Sprintf("Too many languages requested (maximum %d)", rctx.Config.UrlPreviews.MaxLanguages))
+		}
+
+		// Languages are fetched one at a time so the remote server isn't hit with several requests at once, and are
+		// each cached separately. Languages which fail are left out, unless they all fail.
+		previews := make(map[string]*MatrixOpenGraph)
+		var firstErr interface{}
+		for _, language := range languages {
+			preview, err := pipeline_preview.Execute(rctx, r.Host, urlStr, user.UserId, pipeline_preview.PreviewOpts{
+				Timestamp:      ts,
+				LanguageHeader: language,
+				OnlyIfCached:   onlyIfCached,
+				IpAddr:         r.RemoteAddr,
+			})
+			res := previewResponse(rctx, preview, err)
+			if og, ok := res.(*MatrixOpenGraph); ok {
+				previews[language] = og
+			} else if firstErr == nil {
+				firstErr = res
+			}
+		}
+		if len(previews) == 0 {
+			return firstErr
+		}
+		return previews
+	}
+
 	languageHeader := rctx.Config.UrlPreviews.DefaultLanguage
 	if r.Header.Get("Accept-Language") != "" {
 		languageHeader = r.Header.Get("Accept-Language")
@@ -66,27 +127,82 @@ func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user _apimeta.Use
 	preview, err := pipeline_preview.Execute(rctx, r.Host, urlStr, user.UserId, pipeline_preview.PreviewOpts{
 		Timestamp:      ts,
 		LanguageHeader: languageHeader,
+		OnlyIfCached:   onlyIfCached,
+		IpAddr:         r.RemoteAddr,
 	})
+
+	// The preview depends on the Accept-Language header (even when it's missing), so caches need to know
+	return &_responses.NegotiatedResponse{
+		Vary:    []string{"Accept-Language"},
+		Payload: previewResponse(rctx, preview, err),
+	}
+}
+
+// parseLanguages splits a comma-separated list of languages, dropping blanks and duplicates.
+func parseLanguages(languagesStr string) []string {
+	languages := make([]string, 0)
+	for _, language := range strings.Split(languagesStr, ",") {
+		language = strings.TrimSpace(language)
+		if language != "" && !util.ArrayContains(languages, language) {
+			languages = append(languages, language)
+		}
+	}
+	return languages
+}
+
+// previewResponse converts the result of the preview pipeline into a MatrixOpenGraph or error response.
+func previewResponse(rctx rcontext.RequestContext, preview *database.DbUrlPreview, err error) interface{} {
 	if err == nil && preview != nil && preview.ErrorCode != "" {
 		if preview.ErrorCode == common.ErrCodeInvalidHost {
 			err = common.ErrInvalidHost
 		} else if preview.ErrorCode == common.ErrCodeNotFound {
 			err = common.ErrMediaNotFound
+		} else if preview.ErrorCode == common.ErrCodeOriginRateLimited {
+			err = m.ErrOriginRateLimited
+		} else if preview.ErrorCode == common.ErrCodeRemoteFetchFailed {
+			err = m.ErrTransferFailed
 		} else {
 			err = errors.New("url previews: unknown error code: " + preview.ErrorCode)
 		}
 	}
 	if err != nil {
-		if errors.Is(err, common.ErrMediaNotFound) || errors.Is(err, common.ErrHostNotFound) {
+		var limited *common.RateLimitedError
+		if errors.As(err, &limited) {
+			rctx.Log.Debug("Preview not generated: ", err)
+			return _responses.RateLimitedFor(limited.RetryAfter)
+		} else if errors.Is(err, common.ErrMediaNotFound) || errors.Is(err, common.ErrHostNotFound) {
 			return _responses.NotFoundError()
-		} else if errors.Is(err, common.ErrInvalidHost) || errors.Is(err, common.ErrHostNotAllowed) {
+		} else if errors.Is(err, common.ErrInvalidHost) || errors.Is(err, common.ErrHostNotAllowed) || errors.Is(err, common.ErrPortNotAllowed) {
 			return _responses.BadRequest(err.Error())
+		} else if errors.Is(err, m.ErrCrossSchemeRedirect) {
+			rctx.Log.Debug("Preview failed: ", err)
+			return _responses.BadRequest(m.ErrCrossSchemeRedirect.Error())
+		} else if errors.Is(err, m.ErrOriginRateLimited) {
+			rctx.Log.Debug("Preview failed: ", err)
+			return _responses.OriginRateLimited()
+		} else if errors.Is(err, m.ErrTransferFailed) {
+			rctx.Log.Debug("Preview failed: ", err)
+			return _responses.RemoteFetchFailed()
 		} else {
 			sentry.CaptureException(err)
 			return _responses.InternalServerError("Unexpected Error")
 		}
 	}
 
+	var gallery []*MatrixOpenGraphImage
+	if rctx.Config.UrlPreviews.Gallery.Enabled && preview.Gallery != nil {
+		gallery = make([]*MatrixOpenGraphImage, 0, len(preview.Gallery))
+		for _, img := range preview.Gallery {
+			gallery = append(gallery, &MatrixOpenGraphImage{
+				ImageMxc:    img.Mxc,
+				ImageType:   img.Type,
+				ImageSize:   img.Size,
+				ImageWidth:  img.Width,
+				ImageHeight: img.Height,
+			})
+		}
+	}
+
 	return &MatrixOpenGraph{
 		Url:         preview.SiteUrl,
 		SiteName:    preview.SiteName,
@@ -98,5 +214,9 @@ func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user _apimeta.Use
 		ImageSize:   preview.ImageSize,
 		ImageWidth:  preview.ImageWidth,
 		ImageHeight: preview.ImageHeight,
+		FileType:    preview.FileType,
+		FileSize:    preview.FileSize,
+		Gallery:     gallery,
+		Warnings:    preview.Warnings,
 	}
 }
@@ -2,17 +2,23 @@ package r0
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/api/_apimeta"
 	"github.com/t2bot/matrix-media-repo/api/_responses"
 	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/audit"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_thumbnail"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
 	"github.com/t2bot/matrix-media-repo/util"
 
 	"github.com/sirupsen/logrus"
@@ -73,8 +79,13 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta
 	if animatedStr == "" {
 		animatedStr = r.URL.Query().Get("org.matrix.msc2705.animated")
 	}
+	subImageStr := r.URL.Query().Get("sub_image")
+	dprStr := r.URL.Query().Get("dpr")
+	anchor := r.URL.Query().Get("anchor")
 
-	if widthStr == "" || heightStr == "" {
+	// With autoAspect, one of the dimensions can be left out and is worked out from the media's aspect ratio
+	autoAspect := rctx.Config.Thumbnails.AutoAspect
+	if (widthStr == "" && heightStr == "") || (!autoAspect && (widthStr == "" || heightStr == "")) {
 		return _responses.BadRequest("Width and height are required")
 	}
 
@@ -103,21 +114,68 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta
 		}
 		animated = parsedFlag
 	}
+	var subImage *int
+	if subImageStr != "" {
+		parsedIndex, err := strconv.Atoi(subImageStr)
+		if err != nil || parsedIndex < 0 {
+			return _responses.BadRequest("sub_image does not appear to be a non-negative integer")
+		}
+		subImage = &parsedIndex
+	}
 	if method == "" {
 		method = "scale"
 	}
+	if strings.Contains(method, ":") {
+		return _responses.BadRequest("method must be crop or scale") // anchors are picked with their own parameter
+	}
+	if anchor != "" {
+		if anchor == u.SmartAnchor {
+			if !rctx.Config.Thumbnails.SmartCrop.Enabled {
+				return _responses.BadRequest("smart anchors are not enabled on this server")
+			}
+		} else if _, ok := u.Anchors[anchor]; !ok {
+			return _responses.BadRequest("anchor must be one of center, top, bottom, left, right, top_left, top_right, bottom_left, bottom_right, or smart")
+		}
+		if method == "crop" {
+			method = u.CropMethod(anchor)
+		}
+	}
 
 	rctx = rctx.LogWithFields(logrus.Fields{
 		"requestedWidth":    width,
 		"requestedHeight":   height,
 		"requestedMethod":   method,
 		"requestedAnimated": animated,
+		"requestedSubImage": subImageStr,
+		"requestedDpr":      dprStr,
+		"requestedAnchor":   anchor,
 	})
 
-	if width <= 0 || height <= 0 {
+	if autoAspect {
+		if width < 0 || height < 0 || (width == 0 && height == 0) {
+			return _responses.BadRequest("Width or height must be greater than zero, and neither can be negative")
+		}
+	} else if width <= 0 || height <= 0 {
 		return _responses.BadRequest("Width and height must be greater than zero")
 	}
 
+	if dprStr != "" {
+		dpr, err := strconv.ParseFloat(dprStr, 64)
+		if err != nil {
+			return _responses.BadRequest("dpr does not appear to be a number")
+		}
+		width, height, err = thumbnails.ApplyDevicePixelRatio(rctx, width, height, dpr)
+		if err != nil {
+			return _responses.BadRequest(fmt.Sprintf("dpr must be between %g and %g", thumbnails.MinDevicePixelRatio, thumbnails.MaxDevicePixelRatio))
+		}
+	}
+
+	var timings *u.Timings
+	if rctx.Config.Thumbnails.ServerTiming {
+		timings = &u.Timings{}
+		rctx = u.WithTimings(rctx, timings)
+	}
+
 	thumbnail, stream, err := pipeline_thumbnail.Execute(rctx, server, mediaId, pipeline_thumbnail.ThumbnailOpts{
 		DownloadOpts: pipeline_download.DownloadOpts{
 			FetchRemoteIfNeeded: downloadRemote,
@@ -129,11 +187,17 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta
 		Height:   height,
 		Method:   method,
 		Animated: animated,
+		SubImage: subImage,
 	})
 	if err != nil {
 		var redirect datastores.RedirectError
 		if errors.Is(err, common.ErrMediaNotFound) {
 			return _responses.NotFoundError()
+		} else if errors.Is(err, common.ErrRemoteFetchDisabled) {
+			return _responses.RemoteFetchDisabled()
+		} else if errors.Is(err, common.ErrRemoteFetchFailed) {
+			rctx.Log.Warn("Error fetching remote media: ", err)
+			return _responses.RemoteFetchFailed()
 		} else if errors.Is(err, common.ErrMediaTooLarge) {
 			return _responses.RequestTooLarge()
 		} else if errors.Is(err, common.ErrMediaQuarantined) {
@@ -145,6 +209,9 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta
 			}
 		} else if errors.Is(err, common.ErrMediaNotYetUploaded) {
 			return _responses.NotYetUploaded()
+		} else if errors.Is(err, thumbnailing.ErrCodecUnavailable) {
+			rctx.Log.Warn("Unable to thumbnail media: ", err)
+			return _responses.CodecUnavailable()
 		} else if errors.Is(err, common.ErrMediaDimensionsTooSmall) {
 			if stream == nil {
 				return _responses.NotFoundError() // something went wrong so just 404 the thumbnail
@@ -164,8 +231,36 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta
 					SizeBytes:         record.SizeBytes,
 					Data:              stream,
 					TargetDisposition: "infer",
+					Audit: &audit.Record{
+						Action:  audit.ActionThumbnail,
+						UserId:  user.UserId,
+						Origin:  server,
+						MediaId: mediaId,
+					},
 				}
 			}
+		} else if errors.Is(err, thumbnailing.ErrUnsupported) {
+			if stream == nil {
+				return _responses.NotFoundError() // no placeholder for the content type
+			}
+			outputWidth, outputHeight, stream := thumbnailing.OutputDimensions(stream)
+			return &_responses.DownloadResponse{
+				ContentType:           "image/png",
+				Filename:              "thumbnail.png",
+				SizeBytes:             -1,
+				Data:                  stream,
+				TargetDisposition:     "inline",
+				ThumbnailWidth:        width,
+				ThumbnailHeight:       height,
+				ThumbnailOutputWidth:  outputWidth,
+				ThumbnailOutputHeight: outputHeight,
+				Audit: &audit.Record{
+					Action:  audit.ActionThumbnail,
+					UserId:  user.UserId,
+					Origin:  server,
+					MediaId: mediaId,
+				},
+			}
 		} else if errors.As(err, &redirect) {
 			return _responses.Redirect(redirect.RedirectUrl)
 		}
@@ -174,11 +269,26 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta
 		return _responses.InternalServerError("Unexpected Error")
 	}
 
-	return &_responses.DownloadResponse{
-		ContentType:       thumbnail.ContentType,
-		Filename:          "thumbnail" + util.ExtensionForContentType(thumbnail.ContentType),
-		SizeBytes:         thumbnail.SizeBytes,
-		Data:              stream,
-		TargetDisposition: "infer",
+	res := &_responses.DownloadResponse{
+		ContentType:           thumbnail.ContentType,
+		Filename:              "thumbnail" + util.ExtensionForContentType(thumbnail.ContentType),
+		SizeBytes:             thumbnail.SizeBytes,
+		Data:                  stream,
+		TargetDisposition:     "infer",
+		ThumbnailWidth:        thumbnail.Width,
+		ThumbnailHeight:       thumbnail.Height,
+		ThumbnailOutputWidth:  thumbnail.OutputWidth,
+		ThumbnailOutputHeight: thumbnail.OutputHeight,
+		Audit: &audit.Record{
+			Action:  audit.ActionThumbnail,
+			UserId:  user.UserId,
+			Origin:  server,
+			MediaId: mediaId,
+		},
+	}
+	if timings != nil {
+		// Sent after the thumbnail, as it is encoded while being sent
+		res.ServerTiming = timings.ServerTiming
 	}
+	return res
 }
@@ -12,7 +12,9 @@ import (
 	"github.com/t2bot/matrix-media-repo/api/_routers"
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
+	"github.com/t2bot/matrix-media-repo/pool"
 )
 
 func UploadMediaAsync(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
@@ -34,6 +36,13 @@ func UploadMediaAsync(r *http.Request, rctx rcontext.RequestContext, user _apime
 		}
 	}
 
+	releaseSlot, err := upload.AcquireUploadSlot(rctx, user.UserId, r.RemoteAddr)
+	if err != nil {
+		rctx.Log.Debug("Too many concurrent uploads")
+		return _responses.TooManyUploads()
+	}
+	defer releaseSlot()
+
 	contentType := r.Header.Get("Content-Type")
 	if contentType == "" {
 		contentType = "application/octet-stream" // binary
@@ -44,12 +53,27 @@ func UploadMediaAsync(r *http.Request, rctx rcontext.RequestContext, user _apime
 		return sizeRes
 	}
 
+	releaseMemory, err := pool.ReserveMemory(rctx, uploadReservationSize(rctx, r))
+	if err != nil {
+		rctx.Log.Debug("Memory budget exhausted")
+		return _responses.ServerBusy()
+	}
+	defer releaseMemory()
+
 	// Actually upload
-	_, err := pipeline_upload.ExecutePut(rctx, server, mediaId, r.Body, contentType, filename, user.UserId)
+	media, err := pipeline_upload.ExecutePut(rctx, server, mediaId, r.Body, contentType, filename, user.UserId)
 	if err != nil {
 		if errors.Is(err, common.ErrQuotaExceeded) {
 			return _responses.QuotaExceeded()
-		} else if errors.Is(err, common.ErrAlreadyUploaded) {
+		} else if errors.Is(err, common.ErrReadOnly) {
+			return _responses.ReadOnly()
+		} else if errors.Is(err, common.ErrFileNameTooLong) {
+			return _responses.BadRequest("File name is too long")
+		} else if errors.Is(err, common.ErrMediaQuarantined) {
+			return _responses.UploadQuarantined(rctx.Config.Quarantine.UploadErrorCode)
+		} else if sizeRes := uploadErrorResponse(rctx, r, err); sizeRes != nil {
+			return sizeRes
+		} else if errors.Is(err, common.ErrAlreadyUploaded) || errors.Is(err, common.ErrMediaIdCollision) {
 			return &_responses.ErrorResponse{
 				Code:         common.ErrCodeCannotOverwrite,
 				Message:      "This media has already been uploaded.",
@@ -73,6 +97,8 @@ func UploadMediaAsync(r *http.Request, rctx rcontext.RequestContext, user _apime
 		return _responses.InternalServerError("Unexpected Error")
 	}
 
+	logContentLengthMismatch(rctx, r, media.SizeBytes)
+
 	return &MediaUploadedResponse{
 		//ContentUri: util.MxcUri(media.Origin, media.MediaId), // This endpoint doesn't return a URI
 	}
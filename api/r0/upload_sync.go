@@ -2,9 +2,9 @@ package r0
 
 import (
 	"errors"
+	"io"
 	"net/http"
 	"path/filepath"
-	"strconv"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/sirupsen/logrus"
@@ -13,7 +13,9 @@ import (
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
+	"github.com/t2bot/matrix-media-repo/pool"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
@@ -28,6 +30,13 @@ func UploadMediaSync(r *http.Request, rctx rcontext.RequestContext, user _apimet
 		"filename": filename,
 	})
 
+	releaseSlot, err := upload.AcquireUploadSlot(rctx, user.UserId, r.RemoteAddr)
+	if err != nil {
+		rctx.Log.Debug("Too many concurrent uploads")
+		return _responses.TooManyUploads()
+	}
+	defer releaseSlot()
+
 	contentType := r.Header.Get("Content-Type")
 	if contentType == "" {
 		contentType = "application/octet-stream" // binary
@@ -38,45 +47,92 @@ func UploadMediaSync(r *http.Request, rctx rcontext.RequestContext, user _apimet
 		return sizeRes
 	}
 
+	releaseMemory, err := pool.ReserveMemory(rctx, uploadReservationSize(rctx, r))
+	if err != nil {
+		rctx.Log.Debug("Memory budget exhausted")
+		return _responses.ServerBusy()
+	}
+	defer releaseMemory()
+
 	// Actually upload
 	media, err := pipeline_upload.Execute(rctx, r.Host, "", r.Body, contentType, filename, user.UserId, datastores.LocalMediaKind)
 	if err != nil {
 		if errors.Is(err, common.ErrQuotaExceeded) {
 			return _responses.QuotaExceeded()
+		} else if errors.Is(err, common.ErrReadOnly) {
+			return _responses.ReadOnly()
+		} else if errors.Is(err, common.ErrFileNameTooLong) {
+			return _responses.BadRequest("File name is too long")
+		} else if errors.Is(err, common.ErrMediaQuarantined) {
+			return _responses.UploadQuarantined(rctx.Config.Quarantine.UploadErrorCode)
+		} else if sizeRes := uploadErrorResponse(rctx, r, err); sizeRes != nil {
+			return sizeRes
 		}
 		rctx.Log.Error("Unexpected error uploading media: ", err)
 		sentry.CaptureException(err)
 		return _responses.InternalServerError("Unexpected Error")
 	}
 
+	logContentLengthMismatch(rctx, r, media.SizeBytes)
+
 	return &MediaUploadedResponse{
 		ContentUri: util.MxcUri(media.Origin, media.MediaId),
 	}
 }
 
+// uploadRequestSizeCheck rejects requests which claim to be too large or too small. The claim is only a hint
+// to avoid reading obviously bad uploads: the upload pipeline enforces the same limits on the bytes actually
+// received, which is what ultimately decides whether the upload is accepted.
 func uploadRequestSizeCheck(rctx rcontext.RequestContext, r *http.Request) *_responses.ErrorResponse {
+	// A missing, negative, or otherwise unparsable Content-Length leaves this as -1 (or 0 for an empty body).
+	// Such requests are not trusted here, and are left to the streaming limits instead.
+	if r.ContentLength <= 0 {
+		return nil
+	}
+
 	maxSize := rctx.Config.Uploads.MaxSizeBytes
 	minSize := rctx.Config.Uploads.MinSizeBytes
-	if maxSize > 0 || minSize > 0 {
+	if maxSize > 0 && maxSize < r.ContentLength {
+		return _responses.RequestTooLarge()
+	}
+	if minSize > 0 && minSize > r.ContentLength {
+		return _responses.RequestTooSmall()
+	}
+	return nil
+}
+
+// uploadReservationSize is the number of bytes to reserve from the memory budget for the upload. Requests
+// without a usable Content-Length reserve the maximum upload size instead.
+func uploadReservationSize(rctx rcontext.RequestContext, r *http.Request) int64 {
+	if r.ContentLength > 0 {
+		return r.ContentLength
+	}
+	return rctx.Config.Uploads.MaxSizeBytes
+}
+
+// uploadErrorResponse converts size-related upload errors into responses, logging if the request's declared
+// Content-Length disagreed with what was actually received. Returns nil for all other errors.
+func uploadErrorResponse(rctx rcontext.RequestContext, r *http.Request, err error) *_responses.ErrorResponse {
+	if errors.Is(err, common.ErrMediaTooLarge) {
 		if r.ContentLength > 0 {
-			if maxSize > 0 && maxSize < r.ContentLength {
-				return _responses.RequestTooLarge()
-			}
-			if minSize > 0 && minSize > r.ContentLength {
-				return _responses.RequestTooSmall()
-			}
-		} else {
-			header := r.Header.Get("Content-Length")
-			if header != "" {
-				parsed, _ := strconv.ParseInt(header, 10, 64)
-				if maxSize > 0 && maxSize < parsed {
-					return _responses.RequestTooLarge()
-				}
-				if minSize > 0 && minSize > parsed {
-					return _responses.RequestTooSmall()
-				}
-			}
+			rctx.Log.Warnf("Content-Length header declared %d bytes, but the upload exceeded the maximum size", r.ContentLength)
 		}
+		return _responses.RequestTooLarge()
+	} else if errors.Is(err, common.ErrMediaTooSmall) {
+		if r.ContentLength > 0 {
+			rctx.Log.Warnf("Content-Length header declared %d bytes, but the upload was below the minimum size", r.ContentLength)
+		}
+		return _responses.RequestTooSmall()
+	} else if errors.Is(err, io.ErrUnexpectedEOF) {
+		rctx.Log.Warnf("Content-Length header declared %d bytes, but the upload ended early", r.ContentLength)
+		return _responses.BadRequest("Upload ended before the declared Content-Length")
 	}
 	return nil
 }
+
+// logContentLengthMismatch logs when the request's declared Content-Length differs from the bytes received.
+func logContentLengthMismatch(rctx rcontext.RequestContext, r *http.Request, received int64) {
+	if r.ContentLength >= 0 && r.ContentLength != received {
+		rctx.Log.Warnf("Content-Length header declared %d bytes, but %d bytes were received", r.ContentLength, received)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
@@ -13,6 +15,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/api/r0"
 	"github.com/t2bot/matrix-media-repo/api/unstable"
 	v1 "github.com/t2bot/matrix-media-repo/api/v1"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/homeserver_interop/synapse"
 )
 
@@ -46,6 +49,10 @@ func buildRoutes() http.Handler {
 	// Custom features
 	register([]string{"GET"}, PrefixMedia, "local_copy/:server/:mediaId", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.LocalCopy), "local_copy", counter))
 	register([]string{"GET"}, PrefixMedia, "info/:server/:mediaId", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.MediaInfo), "info", counter))
+	register([]string{"GET"}, PrefixMedia, "thumbnail_set/:server/:mediaId", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(unstable.ThumbnailSet), "thumbnail_set", counter))
+	register([]string{"GET"}, PrefixMedia, "default_avatar/*seed", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(unstable.DefaultAvatar), "default_avatar", counter))
+	register([]string{"GET"}, PrefixMedia, "upload/:server/:mediaId/progress", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.UploadProgress), "upload_progress", counter))
+	register([]string{"POST"}, PrefixMedia, "bulk_download", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.BulkDownload), "bulk_download", counter))
 	purgeOneRoute := makeRoute(_routers.RequireAccessToken(custom.PurgeIndividualRecord), "purge_individual_media", counter)
 	register([]string{"DELETE"}, PrefixMedia, "download/:server/:mediaId", mxUnstable, router, purgeOneRoute)
 	register([]string{"GET"}, PrefixMedia, "usage", msc4034, router, makeRoute(_routers.RequireAccessToken(unstable.PublicUsage), "usage", counter))
@@ -86,7 +93,11 @@ func buildRoutes() http.Handler {
 	register([]string{"GET"}, PrefixMedia, "admin/datastores/:datastoreId/size_estimate", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDatastoreStorageEstimate), "get_storage_estimate", counter))
 	register([]string{"POST"}, PrefixMedia, "admin/datastores/:sourceDsId/transfer_to/:targetDsId", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.MigrateBetweenDatastores), "datastore_transfer", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/datastores", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDatastores), "list_datastores", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/read_only", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetReadOnly), "get_read_only", counter))
+	register([]string{"PUT"}, PrefixMedia, "admin/read_only", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.SetReadOnly), "set_read_only", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/federation/test/:serverName", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetFederationInfo), "federation_test", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/diagnostics/thumbnails", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetThumbnailDiagnostics), "thumbnail_diagnostics", counter))
+	register([]string{"POST"}, PrefixMedia, "admin/federation/prefetch", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.PrefetchRemoteMedia), "prefetch_remote_media", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/usage/:serverName", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDomainUsage), "domain_usage", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/usage/:serverName/users", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetUserUsage), "user_usage", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/usage/:serverName/users-stats", mxUnstable, router, synUserStatsRoute)
@@ -108,6 +119,8 @@ func buildRoutes() http.Handler {
 	register([]string{"POST"}, PrefixMedia, "admin/import/:importId/close", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.StopImport), "stop_import", counter))
 	register([]string{"GET"}, PrefixMedia, "admin/media/:server/:mediaId/attributes", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.GetAttributes), "get_media_attributes", counter))
 	register([]string{"POST"}, PrefixMedia, "admin/media/:server/:mediaId/attributes", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.SetAttributes), "set_media_attributes", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/media/:server/:mediaId/info", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetAdminMediaInfo), "get_admin_media_info", counter))
+	register([]string{"GET"}, PrefixMedia, "admin/media/:server/:mediaId/similar", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetSimilarMedia), "get_similar_media", counter))
 
 	return router
 }
@@ -136,8 +149,30 @@ var (
 	mxV3                 matrixVersions = []string{"v3"}
 )
 
+// withTimeout applies the configured request timeout for the kind of route. Routes which move media around
+// use an idle timeout so slow but working transfers aren't cut off, while everything else fails fast.
+func withTimeout(method string, postfix string, handler http.Handler) http.Handler {
+	conf := config.Get().RequestTimeouts
+	seconds := func(s int) time.Duration {
+		return time.Duration(s) * time.Second
+	}
+	isTransfer := strings.HasPrefix(postfix, "download/") || strings.HasPrefix(postfix, "thumbnail/") || strings.HasPrefix(postfix, "local_copy/") || strings.HasSuffix(postfix, "/part/:partId") || strings.HasSuffix(postfix, "/progress")
+	if (method == "POST" || method == "PUT") && (strings.HasPrefix(postfix, "upload") || strings.HasSuffix(postfix, "/part")) {
+		return _routers.NewIdleTimeoutRouter(seconds(conf.UploadIdleSeconds), handler)
+	} else if (method == "GET" && isTransfer) || postfix == "bulk_download" {
+		return _routers.NewIdleTimeoutRouter(seconds(conf.DownloadIdleSeconds), handler)
+	} else if postfix == "preview_url" {
+		return _routers.NewTimeoutRouter(seconds(conf.PreviewSeconds), handler)
+	} else if strings.HasPrefix(postfix, "admin/") || strings.HasPrefix(postfix, "statistics/") {
+		return _routers.NewTimeoutRouter(seconds(conf.AdminSeconds), handler)
+	} else {
+		return _routers.NewTimeoutRouter(seconds(conf.DefaultSeconds), handler)
+	}
+}
+
 func register(methods []string, prefix string, postfix string, versions matrixVersions, router *httprouter.Router, handler http.Handler) {
 	for _, method := range methods {
+		handler := withTimeout(method, postfix, handler)
 		for _, version := range versions {
 			path := fmt.Sprintf("%s/%s/%s", prefix, version, postfix)
 			router.Handler(method, path, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
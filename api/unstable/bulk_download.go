@@ -0,0 +1,81 @@
+package unstable
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_bulk_download"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type bulkDownloadRequest struct {
+	MxcUris []string `json:"mxc_uris"`
+}
+
+// BulkDownload sends several pieces of media at once as a ZIP file.
+func BulkDownload(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	if !rctx.Config.Downloads.Bulk.Enabled {
+		return _responses.NotFoundError()
+	}
+
+	defer r.Body.Close()
+	req := &bulkDownloadRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return _responses.BadRequest("Error parsing request body: " + err.Error())
+	}
+	if len(req.MxcUris) == 0 {
+		return _responses.BadRequest("No MXC URIs")
+	}
+	if rctx.Config.Downloads.Bulk.MaxItems > 0 && len(req.MxcUris) > rctx.Config.Downloads.Bulk.MaxItems {
+		return _responses.BadRequest("Too many MXC URIs")
+	}
+
+	ids := make([]pipeline_bulk_download.MediaId, 0, len(req.MxcUris))
+	for _, mxc := range req.MxcUris {
+		origin, mediaId, err := util.SplitMxc(mxc)
+		if err != nil || !_routers.ServerNameRegex.MatchString(origin) {
+			return _responses.BadRequest("Invalid MXC URI: " + mxc)
+		}
+		if !util.IsGlobalAdmin(user.UserId) && util.IsHostIgnored(origin) {
+			rctx.Log.Warn("Request blocked due to domain being ignored.")
+			return _responses.MediaBlocked()
+		}
+		ids = append(ids, pipeline_bulk_download.MediaId{Origin: origin, MediaId: mediaId})
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"numMedia": len(ids),
+	})
+
+	stream, err := pipeline_bulk_download.Execute(rctx, ids)
+	if err != nil {
+		if errors.Is(err, common.ErrMediaNotFound) {
+			rctx.Log.Debug(err)
+			return _responses.NotFoundError()
+		} else if errors.Is(err, common.ErrMediaQuarantined) {
+			rctx.Log.Debug(err)
+			return _responses.MediaBlocked()
+		} else if errors.Is(err, common.ErrMediaTooLarge) {
+			return _responses.RequestTooLarge()
+		}
+		rctx.Log.Error("Unexpected error preparing bulk download: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+
+	return &_responses.DownloadResponse{
+		ContentType:       "application/zip",
+		Filename:          "media.zip",
+		SizeBytes:         -1, // unknown until it's generated
+		Data:              stream,
+		TargetDisposition: "attachment",
+	}
+}
@@ -0,0 +1,72 @@
+package unstable
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+)
+
+func DefaultAvatar(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	if !rctx.Config.DefaultAvatars.Enabled {
+		return _responses.NotFoundError()
+	}
+
+	seed := strings.TrimPrefix(_routers.GetParam("seed", r), "/")
+	name := r.URL.Query().Get("name")
+
+	var err error
+	width := 96
+	height := 96
+
+	widthStr := r.URL.Query().Get("width")
+	heightStr := r.URL.Query().Get("height")
+	if widthStr != "" {
+		width, err = strconv.Atoi(widthStr)
+		if err != nil {
+			return _responses.BadRequest("Error parsing width: " + err.Error())
+		}
+		height = width
+	}
+	if heightStr != "" {
+		height, err = strconv.Atoi(heightStr)
+		if err != nil {
+			return _responses.BadRequest("Error parsing height: " + err.Error())
+		}
+	}
+
+	clamp := func(v int) int {
+		return min(max(v, 32), 512)
+	}
+	width = clamp(width)
+	height = clamp(height)
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"avatarWidth":  width,
+		"avatarHeight": height,
+		"avatarSeed":   seed,
+	})
+
+	rctx.Log.Info("Generating default avatar")
+	avatar, err := thumbnailing.GenerateDefaultAvatar(seed, name, width, height, rctx)
+	if err != nil {
+		rctx.Log.Error("Unexpected error generating default avatar: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+
+	return &_responses.DownloadResponse{
+		ContentType:       avatar.ContentType,
+		Filename:          "avatar.png",
+		SizeBytes:         0,
+		Data:              avatar.Reader,
+		TargetDisposition: "inline",
+	}
+}
@@ -2,6 +2,7 @@ package unstable
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -19,11 +20,13 @@ import (
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
 	"github.com/t2bot/matrix-media-repo/thumbnailing"
 	"github.com/t2bot/matrix-media-repo/thumbnailing/i"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
 type mediaInfoHashes struct {
-	Sha256 string `json:"sha256"`
+	Sha256     string `json:"sha256"`
+	Perceptual string `json:"perceptual,omitempty"`
 }
 
 type mediaInfoThumbnail struct {
@@ -34,6 +37,17 @@ type mediaInfoThumbnail struct {
 	SizeBytes   int64  `json:"size,omitempty"`
 }
 
+type mediaInfoExif struct {
+	CameraMake   string  `json:"camera_make,omitempty"`
+	CameraModel  string  `json:"camera_model,omitempty"`
+	LensModel    string  `json:"lens_model,omitempty"`
+	FocalLength  float64 `json:"focal_length,omitempty"`
+	ExposureTime string  `json:"exposure_time,omitempty"`
+	FNumber      float64 `json:"f_number,omitempty"`
+	Iso          int     `json:"iso,omitempty"`
+	DateTaken    string  `json:"date_taken,omitempty"`
+}
+
 type MediaInfoResponse struct {
 	ContentUri      string                `json:"content_uri"`
 	ContentType     string                `json:"content_type"`
@@ -46,6 +60,9 @@ type MediaInfoResponse struct {
 	NumTotalSamples int                   `json:"num_total_samples,omitempty"`
 	KeySamples      [][2]float64          `json:"key_samples,omitempty"`
 	NumChannels     int                   `json:"num_channels,omitempty"`
+	DominantColor   string                `json:"dominant_color,omitempty"`
+	OriginalUri     string                `json:"original_content_uri,omitempty"`
+	Exif            *mediaInfoExif        `json:"exif,omitempty"`
 }
 
 func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
@@ -86,6 +103,11 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user _apimeta.User
 	if err != nil {
 		if errors.Is(err, common.ErrMediaNotFound) {
 			return _responses.NotFoundError()
+		} else if errors.Is(err, common.ErrRemoteFetchDisabled) {
+			return _responses.RemoteFetchDisabled()
+		} else if errors.Is(err, common.ErrRemoteFetchFailed) {
+			rctx.Log.Warn("Error fetching remote media: ", err)
+			return _responses.RemoteFetchFailed()
 		} else if errors.Is(err, common.ErrMediaTooLarge) {
 			return _responses.RequestTooLarge()
 		} else if errors.Is(err, common.ErrMediaQuarantined) {
@@ -112,14 +134,75 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user _apimeta.User
 		},
 	}
 
+	original, err := database.GetInstance().MediaAlternates.Prepare(rctx).Get(record.Origin, record.MediaId, database.OriginalAlternateReason)
+	if err != nil {
+		rctx.Log.Warn("Non-fatal error looking up original media: ", err)
+		sentry.CaptureException(err)
+	} else if original != nil {
+		response.OriginalUri = util.MxcUri(original.AlternateOrigin, original.AlternateMediaId)
+	}
+
 	if strings.HasPrefix(response.ContentType, "image/") {
+		mediaDb := database.GetInstance().Media.Prepare(rctx)
+		response.DominantColor, err = mediaDb.GetDominantColor(record.Origin, record.MediaId)
+		if err != nil {
+			rctx.Log.Warn("Non-fatal error looking up dominant color: ", err)
+			sentry.CaptureException(err)
+		}
+
+		if rctx.Config.Uploads.ExtractExifMetadata {
+			exif, err := database.GetInstance().MediaExif.Prepare(rctx).Get(record.Sha256Hash)
+			if err != nil {
+				rctx.Log.Warn("Non-fatal error looking up EXIF data: ", err)
+				sentry.CaptureException(err)
+			} else if exif != nil {
+				response.Exif = &mediaInfoExif{
+					CameraMake:   exif.CameraMake,
+					CameraModel:  exif.CameraModel,
+					LensModel:    exif.LensModel,
+					FocalLength:  exif.FocalLength,
+					ExposureTime: exif.ExposureTime,
+					FNumber:      exif.FNumber,
+					Iso:          exif.Iso,
+					DateTaken:    exif.DateTaken,
+				}
+			}
+		}
+
 		img, err := imaging.Decode(stream)
 		if err == nil {
 			response.Width = img.Bounds().Max.X
 			response.Height = img.Bounds().Max.Y
+
+			if response.DominantColor == "" {
+				response.DominantColor = u.DominantColor(img)
+				if response.DominantColor != "" {
+					if err = mediaDb.SetDominantColor(record.Sha256Hash, response.DominantColor); err != nil {
+						rctx.Log.Warn("Non-fatal error while storing dominant color: ", err)
+						sentry.CaptureException(err)
+					}
+				}
+			}
+
+			// Fill in perceptual hashes for older uploads while we have the image decoded anyways
+			if rctx.Config.Uploads.PerceptualHashes {
+				phash, err := mediaDb.GetPerceptualHash(record.Sha256Hash)
+				if err == nil && phash == nil {
+					calculated := u.PerceptualHash(img)
+					phash = &calculated
+					err = mediaDb.SetPerceptualHash(record.Sha256Hash, calculated)
+				}
+				if err != nil {
+					rctx.Log.Warn("Non-fatal error while storing perceptual hash: ", err)
+					sentry.CaptureException(err)
+				}
+				if phash != nil {
+					response.Hashes.Perceptual = fmt.Sprintf("%016x", *phash)
+				}
+			}
 		}
 	} else if strings.HasPrefix(response.ContentType, "audio/") {
-		generator, reconstructed, err := thumbnailing.GetGenerator(stream, response.ContentType, false)
+		generator, reconstructed, err := thumbnailing.GetGenerator(stream, response.ContentType, false, rctx)
 		if err == nil {
 			if audiogenerator, ok := generator.(i.AudioGenerator); ok {
 				audioInfo, err := audiogenerator.GetAudioData(reconstructed, 768, rctx)
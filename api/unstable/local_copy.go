@@ -66,6 +66,11 @@ func LocalCopy(r *http.Request, rctx rcontext.RequestContext, user _apimeta.User
 	if err != nil {
 		if errors.Is(err, common.ErrMediaNotFound) {
 			return _responses.NotFoundError()
+		} else if errors.Is(err, common.ErrRemoteFetchDisabled) {
+			return _responses.RemoteFetchDisabled()
+		} else if errors.Is(err, common.ErrRemoteFetchFailed) {
+			rctx.Log.Warn("Error fetching remote media: ", err)
+			return _responses.RemoteFetchFailed()
 		} else if errors.Is(err, common.ErrMediaTooLarge) {
 			return _responses.RequestTooLarge()
 		} else if errors.Is(err, common.ErrMediaQuarantined) {
@@ -88,6 +93,14 @@ func LocalCopy(r *http.Request, rctx rcontext.RequestContext, user _apimeta.User
 	if err != nil {
 		if errors.Is(err, common.ErrQuotaExceeded) {
 			return _responses.QuotaExceeded()
+		} else if errors.Is(err, common.ErrReadOnly) {
+			return _responses.ReadOnly()
+		} else if errors.Is(err, common.ErrMediaIdCollision) {
+			return &_responses.ErrorResponse{
+				Code:         common.ErrCodeCannotOverwrite,
+				Message:      "This media ID is already used for different media.",
+				InternalCode: common.ErrCodeCannotOverwrite,
+			}
 		}
 		rctx.Log.Error("Unexpected error uploading media: ", err)
 		sentry.CaptureException(err)
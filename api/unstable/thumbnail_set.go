@@ -0,0 +1,211 @@
+package unstable
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_thumbnail"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// MaxThumbnailSetSizes is the maximum number of sizes which can be requested at once.
+const MaxThumbnailSetSizes = 8
+
+type ThumbnailSetEntry struct {
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Method      string `json:"method"`
+	Animated    bool   `json:"animated"`
+	ContentType string `json:"content_type"`
+	SizeBytes   int64  `json:"size"`
+	Url         string `json:"url"`
+}
+
+type ThumbnailSetResponse struct {
+	ContentUri string               `json:"content_uri"`
+	Thumbnails []*ThumbnailSetEntry `json:"thumbnails"`
+	SrcSet     string               `json:"srcset"`
+}
+
+type thumbnailSetResult struct {
+	record *database.DbThumbnail
+	err    error
+}
+
+func ThumbnailSet(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	server := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+	allowRemote := r.URL.Query().Get("allow_remote")
+	timeoutMs := r.URL.Query().Get("timeout_ms")
+
+	if !_routers.ServerNameRegex.MatchString(server) {
+		return _responses.BadRequest("invalid server ID")
+	}
+
+	downloadRemote := true
+	if allowRemote != "" {
+		parsedFlag, err := strconv.ParseBool(allowRemote)
+		if err != nil {
+			return _responses.BadRequest("allow_remote flag does not appear to be a boolean")
+		}
+		downloadRemote = parsedFlag
+	}
+
+	blockFor, err := util.CalcBlockForDuration(timeoutMs)
+	if err != nil {
+		return _responses.BadRequest("timeout_ms does not appear to be an integer")
+	}
+
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		method = "scale"
+	}
+	animated := rctx.Config.Thumbnails.AllowAnimated && rctx.Config.Thumbnails.DefaultAnimated
+	if animatedStr := r.URL.Query().Get("animated"); animatedStr != "" {
+		parsedFlag, err := strconv.ParseBool(animatedStr)
+		if err != nil {
+			return _responses.BadRequest("Animated flag does not appear to be a boolean")
+		}
+		animated = parsedFlag
+	}
+
+	sizesStr := r.URL.Query().Get("sizes")
+	if sizesStr == "" {
+		return _responses.BadRequest("sizes is required")
+	}
+	sizes := strings.Split(sizesStr, ",")
+	if len(sizes) > MaxThumbnailSetSizes {
+		return _responses.BadRequest(fmt.Sprintf("Too many sizes requested (maximum %d)", MaxThumbnailSetSizes))
+	}
+	dimensions := make([][2]int, 0, len(sizes))
+	for _, size := range sizes {
+		wStr, hStr, ok := strings.Cut(strings.TrimSpace(size), "x")
+		if !ok {
+			return _responses.BadRequest("Sizes must be in the form WIDTHxHEIGHT")
+		}
+		width, err := strconv.Atoi(wStr)
+		if err != nil {
+			return _responses.BadRequest("Width does not appear to be an integer")
+		}
+		height, err := strconv.Atoi(hStr)
+		if err != nil {
+			return _responses.BadRequest("Height does not appear to be an integer")
+		}
+		if width <= 0 || height <= 0 {
+			return _responses.BadRequest("Width and height must be greater than zero")
+		}
+		dimensions = append(dimensions, [2]int{width, height})
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"mediaId":           mediaId,
+		"server":            server,
+		"allowRemote":       downloadRemote,
+		"requestedSizes":    sizesStr,
+		"requestedMethod":   method,
+		"requestedAnimated": animated,
+	})
+
+	if !util.IsGlobalAdmin(user.UserId) && util.IsHostIgnored(server) {
+		rctx.Log.Warn("Request blocked due to domain being ignored.")
+		return _responses.MediaBlocked()
+	}
+
+	// Generate everything at once. The thumbnail pipeline takes care of deduplicating work and limiting how
+	// many thumbnails are generated at a time.
+	results := make([]thumbnailSetResult, len(dimensions))
+	wg := &sync.WaitGroup{}
+	for idx, dim := range dimensions {
+		wg.Add(1)
+		go func(idx int, width int, height int) {
+			defer wg.Done()
+			// Only the records are needed, which are returned once the thumbnails are stored
+			record, _, err := pipeline_thumbnail.Execute(rctx, server, mediaId, pipeline_thumbnail.ThumbnailOpts{
+				DownloadOpts: pipeline_download.DownloadOpts{
+					FetchRemoteIfNeeded: downloadRemote,
+					BlockForReadUntil:   blockFor,
+					RecordOnly:          true,
+				},
+				Width:    width,
+				Height:   height,
+				Method:   method,
+				Animated: animated,
+			})
+			results[idx] = thumbnailSetResult{record: record, err: err}
+		}(idx, dim[0], dim[1])
+	}
+	wg.Wait()
+
+	response := &ThumbnailSetResponse{
+		ContentUri: util.MxcUri(server, mediaId),
+		Thumbnails: make([]*ThumbnailSetEntry, 0),
+	}
+	srcSet := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, res := range results {
+		if res.err != nil {
+			if errors.Is(res.err, common.ErrMediaDimensionsTooSmall) {
+				continue // the original is smaller than this size, so there is no thumbnail for it
+			} else if errors.Is(res.err, common.ErrMediaNotFound) {
+				return _responses.NotFoundError()
+			} else if errors.Is(res.err, common.ErrRemoteFetchDisabled) {
+				return _responses.RemoteFetchDisabled()
+			} else if errors.Is(res.err, common.ErrRemoteFetchFailed) {
+				rctx.Log.Warn("Error fetching remote media: ", res.err)
+				return _responses.RemoteFetchFailed()
+			} else if errors.Is(res.err, common.ErrMediaTooLarge) {
+				return _responses.RequestTooLarge()
+			} else if errors.Is(res.err, common.ErrMediaQuarantined) {
+				return _responses.NotFoundError() // We lie for security
+			} else if errors.Is(res.err, common.ErrMediaNotYetUploaded) {
+				return _responses.NotYetUploaded()
+			}
+			rctx.Log.Error("Unexpected error generating thumbnail set: ", res.err)
+			sentry.CaptureException(res.err)
+			return _responses.InternalServerError("Unexpected Error")
+		}
+
+		// Different requested sizes may resolve to the same thumbnail
+		thumb := res.record
+		key := fmt.Sprintf("%dx%d", thumb.Width, thumb.Height)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		qs := url.Values{
+			"width":    []string{strconv.Itoa(thumb.Width)},
+			"height":   []string{strconv.Itoa(thumb.Height)},
+			"method":   []string{thumb.Method},
+			"animated": []string{strconv.FormatBool(thumb.Animated)},
+		}
+		entry := &ThumbnailSetEntry{
+			Width:       thumb.Width,
+			Height:      thumb.Height,
+			Method:      thumb.Method,
+			Animated:    thumb.Animated,
+			ContentType: thumb.ContentType,
+			SizeBytes:   thumb.SizeBytes,
+			Url:         fmt.Sprintf("/_matrix/media/v3/thumbnail/%s/%s?%s", url.PathEscape(server), url.PathEscape(mediaId), qs.Encode()),
+		}
+		response.Thumbnails = append(response.Thumbnails, entry)
+		srcSet = append(srcSet, fmt.Sprintf("%s %dw", entry.Url, entry.Width))
+	}
+	response.SrcSet = strings.Join(srcSet, ", ")
+
+	return response
+}
@@ -0,0 +1,102 @@
+package unstable
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/notifier"
+)
+
+func UploadProgress(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	server := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"mediaId": mediaId,
+		"server":  server,
+	})
+
+	if !rctx.Config.Uploads.Progress.Enabled || r.Host != server {
+		return _responses.NotFoundError()
+	}
+
+	// Subscribe before checking the upload, so we can't miss it finishing in between
+	progress, unsubscribe, err := notifier.SubscribeToUploadProgress(server, mediaId, rctx.Config.Uploads.Progress.MaxSubscribers)
+	if err != nil {
+		if errors.Is(err, notifier.ErrTooManyProgressSubscribers) {
+			return _responses.RateLimitReached()
+		}
+		rctx.Log.Error("Unexpected error subscribing to upload progress: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+
+	mediaDb := database.GetInstance().Media.Prepare(rctx)
+	record, err := mediaDb.GetById(server, mediaId)
+	if err != nil {
+		unsubscribe()
+		rctx.Log.Error("Unexpected error looking up media: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+	if record != nil {
+		unsubscribe()
+		if record.UserId != user.UserId {
+			return _responses.NotFoundError()
+		}
+		// Already uploaded, so there's only one thing to say
+		events := make(chan interface{}, 1)
+		events <- notifier.UploadProgress{Stage: notifier.UploadStageDone, BytesReceived: record.SizeBytes}
+		close(events)
+		return &_responses.EventStreamResponse{Events: events, Close: func() {}}
+	}
+
+	expiringDb := database.GetInstance().ExpiringMedia.Prepare(rctx)
+	pending, err := expiringDb.Get(server, mediaId)
+	if err != nil {
+		unsubscribe()
+		rctx.Log.Error("Unexpected error looking up pending upload: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+	if pending == nil || pending.IsExpired() {
+		unsubscribe()
+		return _responses.NotFoundError()
+	}
+	if pending.UserId != user.UserId {
+		unsubscribe()
+		return &_responses.ErrorResponse{
+			Code:         common.ErrCodeForbidden,
+			Message:      "You do not have permission to watch this upload.",
+			InternalCode: common.ErrCodeForbidden,
+		}
+	}
+
+	events := make(chan interface{})
+	done := make(chan struct{})
+	go func() {
+		defer close(events)
+		for p := range progress {
+			select {
+			case events <- p:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return &_responses.EventStreamResponse{
+		Events: events,
+		Close: func() {
+			close(done)
+			unsubscribe()
+		},
+	}
+}
@@ -1,11 +1,13 @@
 package v1
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/api/_apimeta"
 	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_create"
 	"github.com/t2bot/matrix-media-repo/util"
@@ -19,6 +21,9 @@ type MediaCreatedResponse struct {
 func CreateMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
 	id, err := pipeline_create.Execute(rctx, r.Host, user.UserId, pipeline_create.DefaultExpirationTime)
 	if err != nil {
+		if errors.Is(err, common.ErrReadOnly) {
+			return _responses.ReadOnly()
+		}
 		rctx.Log.Error("Unexpected error creating media ID:", err)
 		sentry.CaptureException(err)
 		return _responses.InternalServerError("unexpected error")
@@ -276,8 +276,14 @@ func (r *ArchiveReader) importFileFromStream(fileName string, f io.ReadCloser, o
 			kind = datastores.RemoteMediaKind
 		}
 
+		// Archived media is imported as it was stored, even when the import runs in the main process (like it does
+		// for the admin API), so the upload conversions and transforms don't apply again
+		importCtx := r.ctx
+		importCtx.Config.Uploads.ConvertHeicToJpeg.Enabled = false
+		importCtx.Config.Uploads.Transforms = nil
+
 		r.ctx.Log.Debugf("Importing file %s as kind %s", mxc, kind)
-		if _, err = pipeline_upload.Execute(r.ctx, metadata.Origin, metadata.MediaId, f, metadata.ContentType, metadata.FileName, metadata.Uploader, kind); err != nil {
+		if _, err = pipeline_upload.Execute(importCtx, metadata.Origin, metadata.MediaId, f, metadata.ContentType, metadata.FileName, metadata.Uploader, kind); err != nil {
 			return err
 		}
 		r.uploaded[mxc] = true
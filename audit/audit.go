@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/logging"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const (
+	ActionDownload  = "download"
+	ActionThumbnail = "thumbnail"
+)
+
+// Record describes media which was served to a user or server.
+type Record struct {
+	Timestamp   int64  `json:"ts"`
+	Action      string `json:"action"`
+	UserId      string `json:"user_id,omitempty"`
+	Origin      string `json:"origin"`
+	MediaId     string `json:"media_id"`
+	BytesServed int64  `json:"bytes_served"`
+	Range       string `json:"range,omitempty"`
+}
+
+type sink interface {
+	Write(record *Record) error
+	Close() error
+}
+
+var lock = &sync.RWMutex{}
+var queue chan *Record
+var done chan struct{}
+
+// Init starts the audit log from the main config, if it is enabled.
+func Init() {
+	if err := Start(config.Get().AuditLog); err != nil {
+		sentry.CaptureException(err)
+		logrus.Error("Error starting audit log: ", err)
+	}
+}
+
+// Reload restarts the audit log with the current config.
+func Reload() {
+	Init()
+}
+
+// Start stops any running audit log, then starts a new one with the given config. Nothing is started if the
+// config is disabled.
+func Start(cfg config.AuditLogConfig) error {
+	Stop()
+	if !cfg.Enabled {
+		return nil
+	}
+
+	s, err := newSink(cfg)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	queue = make(chan *Record, max(cfg.QueueSize, 1))
+	done = make(chan struct{})
+	go writeRecords(queue, done, s)
+	return nil
+}
+
+// Stop writes any waiting records, then stops the audit log.
+func Stop() {
+	lock.Lock()
+	q, d := queue, done
+	queue = nil
+	done = nil
+	lock.Unlock()
+	if q == nil {
+		return
+	}
+
+	// Records sent before the swap are still written. New ones are dropped instead of waiting for a slow sink.
+	close(q)
+	<-d
+}
+
+// Log queues the record to be written, if the audit log is enabled. If too many records are already waiting,
+// the record is dropped rather than holding up the request.
+func Log(record *Record) {
+	lock.RLock()
+	defer lock.RUnlock()
+	if queue == nil {
+		return
+	}
+
+	if record.Timestamp == 0 {
+		record.Timestamp = util.NowMillis()
+	}
+	if logging.RedactionEnabled() {
+		record.UserId = logging.Redact(record.UserId)
+	}
+
+	select {
+	case queue <- record:
+	default:
+		logrus.Warnf("Audit log queue is full - dropping record for %s/%s", record.Origin, record.MediaId)
+	}
+}
+
+func writeRecords(records <-chan *Record, done chan<- struct{}, s sink) {
+	defer close(done)
+	for record := range records {
+		if err := s.Write(record); err != nil {
+			sentry.CaptureException(err)
+			logrus.Warn("Error writing audit record: ", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		logrus.Warn("Error closing audit log: ", err)
+	}
+}
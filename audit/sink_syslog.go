@@ -0,0 +1,32 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogSink(network string, address string) (*syslogSink, error) {
+	w, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, "matrix-media-repo")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: w}, nil
+}
+
+func (s *syslogSink) Write(record *Record) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.writer.Info(string(b))
+}
+
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+
+package audit
+
+import (
+	"errors"
+)
+
+func newSyslogSink(network string, address string) (sink, error) {
+	return nil, errors.New("syslog audit logs are not supported on this platform")
+}
@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+func newSink(cfg config.AuditLogConfig) (sink, error) {
+	switch cfg.Sink {
+	case "file":
+		return newFileSink(cfg.FilePath)
+	case "syslog":
+		return newSyslogSink(cfg.SyslogNetwork, cfg.SyslogAddress)
+	case "webhook":
+		return newWebhookSink(cfg.WebhookUrl)
+	default:
+		return nil, errors.New("unknown audit log sink: " + cfg.Sink)
+	}
+}
+
+type fileSink struct {
+	file *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	if path == "" {
+		return nil, errors.New("no audit log file path configured")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{file: f}, nil
+}
+
+func (s *fileSink) Write(record *Record) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(b, '\n'))
+	return err
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookSink(url string) (*webhookSink, error) {
+	if url == "" {
+		return nil, errors.New("no audit log webhook URL configured")
+	}
+	return &webhookSink{url: url, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (s *webhookSink) Write(record *Record) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	res, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("audit webhook returned status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
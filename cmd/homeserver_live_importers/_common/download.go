@@ -1,10 +1,13 @@
 package _common
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -17,6 +20,8 @@ import (
 	"github.com/t2bot/matrix-media-repo/datastores"
 	"github.com/t2bot/matrix-media-repo/homeserver_interop"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
+	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/readers"
 )
 
 type MediaMetadata struct {
@@ -25,6 +30,13 @@ type MediaMetadata struct {
 	FileName       string
 	UploaderUserId string
 	SizeBytes      int64
+
+	// If set, the media is read from this file instead of being downloaded from the homeserver
+	FilePath string
+
+	// If set, the hex-encoded SHA-256 hash of the media. Media the media repo already has is copied from the
+	// existing record instead of being downloaded again.
+	Sha256Hash string
 }
 
 func PsqlMatrixDownloadCopy[M homeserver_interop.ImportDbMedia](ctx rcontext.RequestContext, cfg *ImportOptsPsqlFlatFile, db homeserver_interop.ImportDb[M], extractFn func(record *M) (*MediaMetadata, error)) {
@@ -61,17 +73,24 @@ func PsqlMatrixDownloadCopy[M homeserver_interop.ImportDbMedia](ctx rcontext.Req
 		mu.Unlock()
 	}
 
-	for i := 0; i < len(records); i++ {
-		percent := int((float32(i+1) / float32(len(records))) * 100)
-		record := records[i]
-
+	metas := make([]*MediaMetadata, 0, len(records))
+	for _, record := range records {
 		meta, err := extractFn(record)
 		if err != nil {
 			panic(err)
 		}
+		metas = append(metas, meta)
+	}
 
+	known, err := findKnownHashes(ctx, metas, cfg.HashBatchSize)
+	if err != nil {
+		panic(err)
+	}
+
+	for i, meta := range metas {
+		percent := int((float32(i+1) / float32(len(records))) * 100)
 		ctx.Log.Debug(fmt.Sprintf("Queuing %s (%d/%d %d%%)", meta.MediaId, i+1, len(records), percent))
-		err = pool.Submit(doWork(ctx, meta, cfg.ServerName, cfg.ApiUrl, onComplete))
+		err = pool.Submit(doWork(ctx, meta, known[meta.Sha256Hash], cfg.ServerName, cfg.ApiUrl, onComplete))
 		if err != nil {
 			panic(err)
 		}
@@ -85,7 +104,36 @@ func PsqlMatrixDownloadCopy[M homeserver_interop.ImportDbMedia](ctx rcontext.Req
 	ctx.Log.Info("Import completed")
 }
 
-func doWork(ctx rcontext.RequestContext, record *MediaMetadata, serverName string, csApiUrl string, onComplete func()) func() {
+// findKnownHashes looks up the media repo's existing records for the media's hashes, batchSize hashes at a time.
+// Media without a hash is skipped.
+func findKnownHashes(ctx rcontext.RequestContext, metas []*MediaMetadata, batchSize int) (map[string][]*database.DbMedia, error) {
+	hashes := make([]string, 0)
+	for _, meta := range metas {
+		if meta.Sha256Hash != "" {
+			hashes = append(hashes, meta.Sha256Hash)
+		}
+	}
+	known := make(map[string][]*database.DbMedia)
+	if len(hashes) == 0 {
+		return known, nil
+	}
+
+	ctx.Log.Info(fmt.Sprintf("Checking %d hashes for media we already have", len(hashes)))
+	db := database.GetInstance().Media.Prepare(ctx)
+	for _, batch := range util.Chunk(hashes, batchSize) {
+		found, err := db.GetByHashes(batch)
+		if err != nil {
+			return nil, err
+		}
+		for hash, records := range found {
+			known[hash] = records
+		}
+	}
+	ctx.Log.Info(fmt.Sprintf("%d hashes are already stored and will be copied instead of downloaded", len(known)))
+	return known, nil
+}
+
+func doWork(ctx rcontext.RequestContext, record *MediaMetadata, existing []*database.DbMedia, serverName string, csApiUrl string, onComplete func()) func() {
 	return func() {
 		defer onComplete()
 
@@ -102,12 +150,32 @@ func doWork(ctx rcontext.RequestContext, record *MediaMetadata, serverName strin
 			return
 		}
 
-		body, err := downloadMedia(csApiUrl, serverName, record.MediaId)
+		if len(existing) > 0 {
+			copyExisting(ctx, record, existing, serverName)
+			return
+		}
+
+		var body io.ReadCloser
+		if record.FilePath != "" {
+			body, err = os.Open(record.FilePath)
+			if os.IsNotExist(err) {
+				ctx.Log.Warn("File does not appear to exist, skipping: " + record.FilePath)
+				return
+			}
+		} else {
+			body, err = downloadMedia(csApiUrl, serverName, record.MediaId)
+		}
 		if err != nil {
 			panic(err)
 		}
 
-		dbRecord, err = pipeline_upload.Execute(ctx, serverName, record.MediaId, body, record.ContentType, record.FileName, record.UploaderUserId, datastores.LocalMediaKind)
+		// Hash what we read so we can make sure it's what was stored
+		hasher := sha256.New()
+		tee := readers.NewCancelCloser(io.NopCloser(io.TeeReader(body, hasher)), func() {
+			body.Close()
+		})
+
+		dbRecord, err = pipeline_upload.Execute(ctx, serverName, record.MediaId, tee, record.ContentType, record.FileName, record.UploaderUserId, datastores.LocalMediaKind)
 		if err != nil {
 			panic(err)
 		}
@@ -115,6 +183,45 @@ func doWork(ctx rcontext.RequestContext, record *MediaMetadata, serverName strin
 		if dbRecord.SizeBytes != record.SizeBytes {
 			ctx.Log.Warnf("Size mismatch! Expected %d bytes but got %d", record.SizeBytes, dbRecord.SizeBytes)
 		}
+		if sha256hash := hex.EncodeToString(hasher.Sum(nil)); dbRecord.Sha256Hash != sha256hash {
+			panic(fmt.Sprintf("hash mismatch for %s: read %s but stored %s", record.MediaId, sha256hash, dbRecord.Sha256Hash))
+		}
+	}
+}
+
+// copyExisting imports the media as a new record pointing at the file of one we already have with the same hash.
+func copyExisting(ctx rcontext.RequestContext, record *MediaMetadata, existing []*database.DbMedia, serverName string) {
+	database.SortMediaByPreference(existing, serverName)
+	source := existing[0]
+	for _, r := range existing {
+		if r.Quarantined {
+			// Matches what the upload pipeline would do, without needing to download the media first
+			ctx.Log.Warn("Media matches quarantined media - skipping")
+			return
+		}
+	}
+	if source.SizeBytes != record.SizeBytes {
+		ctx.Log.Warnf("Size mismatch! Expected %d bytes but got %d", record.SizeBytes, source.SizeBytes)
+	}
+
+	ctx.Log.Debugf("Copying existing record %s/%s", source.Origin, source.MediaId)
+	err := database.GetInstance().Media.Prepare(ctx).Insert(&database.DbMedia{
+		Origin:      serverName,
+		MediaId:     record.MediaId,
+		UploadName:  record.FileName,
+		ContentType: record.ContentType,
+		UserId:      record.UploaderUserId,
+		SizeBytes:   source.SizeBytes,
+		CreationTs:  util.NowMillis(),
+		Quarantined: false,
+		Locatable: &database.Locatable{
+			Sha256Hash:  source.Sha256Hash,
+			DatastoreId: source.DatastoreId,
+			Location:    source.Location,
+		},
+	})
+	if err != nil {
+		panic(err)
 	}
 }
 
@@ -21,7 +21,18 @@ type ImportOptsPsqlFlatFile struct {
 	ServerName       string
 	ApiUrl           string
 	NumWorkers       int
+	HashBatchSize    int
 	ConnectionString string
+	MediaDirectory   string
+}
+
+// InitImportPsqlMediaStore is the same as InitImportPsqlMatrixDownload, but also accepts a directory to read
+// the homeserver's media files from instead of downloading them.
+func InitImportPsqlMediaStore(softwareName string, softwareConfigDir string) *ImportOptsPsqlFlatFile {
+	mediaDirectory := flag.String("mediaDirectory", "", fmt.Sprintf("The %s for %s. When set, media is read from this directory instead of being downloaded from the homeserver.", softwareConfigDir, softwareName))
+	cfg := InitImportPsqlMatrixDownload(softwareName)
+	cfg.MediaDirectory = *mediaDirectory
+	return cfg
 }
 
 func InitImportPsqlMatrixDownload(softwareName string) *ImportOptsPsqlFlatFile {
@@ -35,6 +46,7 @@ func InitImportPsqlMatrixDownload(softwareName string) *ImportOptsPsqlFlatFile {
 	configPath := flag.String("config", "media-repo.yaml", "The path to the media repo configuration (configured for the media repo's database).")
 	migrationsPath := flag.String("migrations", "./migrations", "The absolute path the media repo's migrations folder.")
 	numWorkers := flag.Int("workers", 10, "The number of workers to use when downloading media. Using multiple workers is recommended.")
+	hashBatchSize := flag.Int("hashBatchSize", 500, fmt.Sprintf("How many media hashes to look up at once, if %s records them. Media the media repo already has is copied instead of downloaded again.", softwareName))
 	flag.Parse()
 
 	// Override config path with config for Docker users
@@ -94,6 +106,7 @@ func InitImportPsqlMatrixDownload(softwareName string) *ImportOptsPsqlFlatFile {
 		ServerName:       *serverName,
 		ApiUrl:           csApiUrl,
 		NumWorkers:       *numWorkers,
+		HashBatchSize:    *hashBatchSize,
 		ConnectionString: connectionString,
 	}
 }
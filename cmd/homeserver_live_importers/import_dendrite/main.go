@@ -23,6 +23,7 @@ func main() {
 			FileName:       record.UploadName,
 			UploaderUserId: record.UserId,
 			SizeBytes:      record.FileSizeBytes,
+			Sha256Hash:     record.Sha256Hash(),
 		}, nil
 	})
 }
@@ -7,7 +7,7 @@ import (
 )
 
 func main() {
-	cfg := _common.InitImportPsqlMatrixDownload("Synapse")
+	cfg := _common.InitImportPsqlMediaStore("Synapse", "media_store_path")
 	ctx := rcontext.Initial()
 
 	ctx.Log.Debug("Connecting to homeserver database...")
@@ -17,12 +17,20 @@ func main() {
 	}
 
 	_common.PsqlMatrixDownloadCopy[synapse.LocalMedia](ctx, cfg, hsDb, func(record *synapse.LocalMedia) (*_common.MediaMetadata, error) {
+		filePath := ""
+		if cfg.MediaDirectory != "" {
+			var err error
+			if filePath, err = synapse.LocalMediaPath(cfg.MediaDirectory, record); err != nil {
+				return nil, err
+			}
+		}
 		return &_common.MediaMetadata{
 			MediaId:        record.MediaId,
 			ContentType:    record.ContentType,
 			FileName:       record.UploadName,
 			UploaderUserId: record.UserId,
 			SizeBytes:      record.SizeBytes,
+			FilePath:       filePath,
 		}, nil
 	})
 }
@@ -3,8 +3,6 @@ package main
 import (
 	"io"
 	"os"
-	"path"
-	"strings"
 
 	"github.com/t2bot/matrix-media-repo/archival/v2archive"
 	"github.com/t2bot/matrix-media-repo/cmd/homeserver_offline_importers/_common"
@@ -24,20 +22,13 @@ func main() {
 	}
 
 	_common.PsqlFlatFileArchive[synapse.LocalMedia](ctx, cfg, hsDb, func(r *synapse.LocalMedia) (v2archive.MediaInfo, io.ReadCloser, error) {
-		// For MediaID AABBCCDD :
-		// $importPath/local_content/AA/BB/CCDD
-		//
-		// For a URL MediaID 2020-08-17_AABBCCDD:
-		// $importPath/url_cache/2020-08-17/AABBCCDD
-
 		mxc := util.MxcUri(cfg.ServerName, r.MediaId)
 
 		ctx.Log.Info("Copying " + mxc)
 
-		filePath := path.Join(cfg.ImportPath, "local_content", r.MediaId[0:2], r.MediaId[2:4], r.MediaId[4:])
-		if r.UrlCache != "" {
-			dateParts := strings.Split(r.MediaId, "_")
-			filePath = path.Join(cfg.ImportPath, "url_cache", dateParts[0], strings.Join(dateParts[1:], "_"))
+		filePath, err := synapse.LocalMediaPath(cfg.ImportPath, r)
+		if err != nil {
+			return v2archive.MediaInfo{}, nil, err
 		}
 
 		f, err := os.Open(filePath)
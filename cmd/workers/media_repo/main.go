@@ -12,6 +12,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/api"
+	"github.com/t2bot/matrix-media-repo/audit"
 	"github.com/t2bot/matrix-media-repo/common/assets"
 	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/logging"
@@ -71,6 +72,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	logging.SetRedaction(config.Get().General.RedactLogs, config.Get().General.RedactLogsKey)
 
 	logrus.Info("Starting up...")
 	runtime.RunStartupSequence()
@@ -90,6 +92,7 @@ func main() {
 		pgo_internal.Enable(config.Get().PGO.SubmitUrl, config.Get().PGO.SubmitKey)
 	}
 	metrics.Init()
+	audit.Init()
 	web := api.Init()
 
 	// Set up a function to stop everything
@@ -102,6 +105,9 @@ func main() {
 
 		logrus.Info("Stopping recurring tasks...")
 		tasks.StopAll()
+
+		logrus.Info("Stopping audit log...")
+		audit.Stop()
 	}
 
 	// Set up a listener for SIGINT
@@ -4,6 +4,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/api"
 	"github.com/t2bot/matrix-media-repo/api/_auth_cache"
+	"github.com/t2bot/matrix-media-repo/audit"
 	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/globals"
 	"github.com/t2bot/matrix-media-repo/common/runtime"
@@ -11,6 +12,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/errcache"
 	"github.com/t2bot/matrix-media-repo/metrics"
 	"github.com/t2bot/matrix-media-repo/pgo_internal"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_prefetch"
 	"github.com/t2bot/matrix-media-repo/plugins"
 	"github.com/t2bot/matrix-media-repo/pool"
 	"github.com/t2bot/matrix-media-repo/redislib"
@@ -29,6 +31,7 @@ func setupReloads() {
 	reloadPoolOnChan(globals.PoolReloadChan)
 	reloadErrorCachesOnChan(globals.ErrorCacheReloadChan)
 	reloadPGOOnChan(globals.PGOReloadChan)
+	reloadAuditOnChan(globals.AuditReloadChan)
 }
 
 func stopReloads() {
@@ -55,6 +58,8 @@ func stopReloads() {
 	globals.ErrorCacheReloadChan <- false
 	logrus.Debug("Stopping PGOReloadChan")
 	globals.PGOReloadChan <- false
+	logrus.Debug("Stopping AuditReloadChan")
+	globals.AuditReloadChan <- false
 }
 
 func reloadWebOnChan(reloadChan chan bool) {
@@ -179,6 +184,8 @@ func reloadPoolOnChan(reloadChan chan bool) {
 		defer close(reloadChan)
 		for {
 			shouldReload := <-reloadChan
+			// The prefetch queue is rebuilt with the new config once it's next used
+			go pipeline_prefetch.Reset()
 			if shouldReload {
 				pool.AdjustSize()
 			} else {
@@ -220,3 +227,17 @@ func reloadPGOOnChan(reloadChan chan bool) {
 		}
 	}()
 }
+
+func reloadAuditOnChan(reloadChan chan bool) {
+	go func() {
+		defer close(reloadChan)
+		for {
+			shouldReload := <-reloadChan
+			if shouldReload {
+				audit.Reload()
+			} else {
+				return // received stop
+			}
+		}
+	}()
+}
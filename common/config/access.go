@@ -144,6 +144,8 @@ func reloadConfig() (*MainRepoConfig, map[string]*DomainRepoConfig, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	normalizeThumbnails(&c.Thumbnails.ThumbnailsConfig)
+	normalizeUrlPreviews(&c.UrlPreviews.UrlPreviewsConfig, "the main config")
 
 	// Start building domain configs
 	dMaps := make(map[string]map[string]interface{})
@@ -187,6 +189,9 @@ func reloadConfig() (*MainRepoConfig, map[string]*DomainRepoConfig, error) {
 			return nil, nil, err
 		}
 
+		normalizeThumbnails(&drc.Thumbnails)
+		normalizeUrlPreviews(&drc.UrlPreviews, hs)
+
 		// For good measure...
 		domainConfs[hs] = &drc
 		domainConfs[hs].Name = hs
@@ -229,6 +234,7 @@ func DomainConfigFrom(c MainRepoConfig) DomainRepoConfig {
 	dc.Archiving = c.Archiving
 	dc.Uploads = c.Uploads
 	dc.Identicons = c.Identicons
+	dc.DefaultAvatars = c.DefaultAvatars
 	dc.Quarantine = c.Quarantine
 	dc.TimeoutSeconds = c.TimeoutSeconds
 	dc.Downloads = c.Downloads.DownloadsConfig
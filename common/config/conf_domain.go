@@ -21,17 +21,44 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 			MaxSizeBytes:               104857600, // 100mb
 			FailureCacheMinutes:        15,
 			DefaultRangeChunkSizeBytes: 10485760, // 10mb
+			DefaultFilename:            "file",
+			StripMetadata: StripMetadataConfig{
+				Enabled:      false,
+				MaxSizeBytes: 10485760, // 10mb
+			},
+			OriginMaxSizeBytes: []OriginSizeLimit{},
+			Bulk: BulkDownloadConfig{
+				Enabled:      false,
+				MaxItems:     50,
+				MaxSizeBytes: 524288000, // 500mb
+				Quarantined:  "skip",
+			},
+			Throttle: DownloadThrottle{
+				BytesPerSecond: 0,
+				BurstBytes:     0,
+			},
 		},
 		UrlPreviews: UrlPreviewsConfig{
-			Enabled:          true,
-			NumWords:         50,
-			NumTitleWords:    30,
-			MaxLength:        200,
-			MaxTitleLength:   150,
-			MaxPageSizeBytes: 10485760, // 10mb
+			Enabled:           true,
+			NumWords:          50,
+			NumTitleWords:     30,
+			MaxLength:         200,
+			MaxTitleLength:    150,
+			NormalizeText:     true,
+			MaxPageSizeBytes:  10485760, // 10mb
+			AllowPartialPages: false,
 			FilePreviewTypes: []string{
 				"image/*",
 			},
+			UnsupportedFileLinks: false,
+			AllowedImageTypes: []string{
+				"image/png",
+				"image/jpeg",
+				"image/gif",
+				"image/webp",
+			},
+			SvgImages:        "skip",
+			SniffContentType: true,
 			DisallowedNetworks: []string{
 				"127.0.0.1/8",
 				"10.0.0.0/8",
@@ -46,9 +73,32 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 			AllowedNetworks: []string{
 				"0.0.0.0/0", // "Everything"
 			},
-			DefaultLanguage: "en-US,en",
-			UserAgent:       "matrix-media-repo",
-			OEmbed:          false,
+			AllowedPorts:             []int{80, 443},
+			AllowCrossSchemeRedirect: true,
+			Credentials:              []UrlPreviewCredentials{},
+			DnsServers:               []string{},
+			DefaultLanguage:          "en-US,en",
+			MaxLanguages:             4,
+			UserAgent:                "matrix-media-repo",
+			OEmbed:                   false,
+			PreferAmp:                false,
+			FaviconFallback:          false,
+			PreferredFaviconSize:     64,
+			ImageThumbnailSize:       ThumbnailSize{Width: 0, Height: 0},
+			Gallery: UrlPreviewGalleryConfig{
+				Enabled:   false,
+				MaxImages: 4,
+				MaxBytes:  10485760, // 10mb
+			},
+			RateLimitedOrigins: UrlPreviewBackoffConfig{
+				Enabled:        true,
+				DefaultSeconds: 60,
+				MaxSeconds:     3600, // 1 hour
+			},
+			RateLimit: UrlPreviewRateLimit{
+				PerUser: UrlPreviewRate{PerMinute: 30, Burst: 10},
+				PerIp:   UrlPreviewRate{PerMinute: 60, Burst: 20},
+			},
 		},
 		Thumbnails: ThumbnailsConfig{
 			MaxSourceBytes:      10485760, // 10mb
@@ -65,12 +115,47 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 				{800, 600},
 			},
 			DynamicSizing: false,
+			AutoAspect:    false,
 			Types: []string{
 				"image/jpeg",
 				"image/jpg",
 				"image/png",
 				"image/gif",
 			},
+			GeneratorOrder:      []string{},
+			DisabledGenerators:  []string{},
+			UnavailableCodecs:   "placeholder",
+			ServerTiming:        false,
+			AutoFormat:          false,
+			Sharpen:             false,
+			SharpenAmount:       0.5,
+			Trim:                false,
+			TrimTolerance:       10,
+			MinGeneratorVersion: 0,
+			GifTransparency:     true,
+			OutputDpi:           0,
+			ProgressiveJpeg:     false,
+			SmartCrop: SmartCropConfig{
+				Enabled:       false,
+				MaxConcurrent: 2,
+			},
+			SmallOriginals: SmallOriginalsConfig{
+				Enabled:  true,
+				MaxBytes: 0,
+			},
+			PngPalette: PngPaletteConfig{
+				Mode:          "off",
+				MaxAutoColors: 1024,
+			},
+			Retries: ThumbnailRetryConfig{
+				MaxRetries: 2,
+				BackoffMs:  100,
+			},
+			ExifOrientation: ExifOrientationConfig{
+				Enabled:         true,
+				IgnoreStale:     false,
+				DisabledOrigins: []string{},
+			},
 		},
 	}
 }
@@ -1,14 +1,15 @@
 package config
 
 type MinimumRepoConfig struct {
-	DataStores     []DatastoreConfig `yaml:"datastores"`
-	Archiving      ArchivingConfig   `yaml:"archiving"`
-	Uploads        UploadsConfig     `yaml:"uploads"`
-	Identicons     IdenticonsConfig  `yaml:"identicons"`
-	Quarantine     QuarantineConfig  `yaml:"quarantine"`
-	TimeoutSeconds TimeoutsConfig    `yaml:"timeouts"`
-	Features       FeatureConfig     `yaml:"featureSupport"`
-	AccessTokens   AccessTokenConfig `yaml:"accessTokens"`
+	DataStores     []DatastoreConfig    `yaml:"datastores"`
+	Archiving      ArchivingConfig      `yaml:"archiving"`
+	Uploads        UploadsConfig        `yaml:"uploads"`
+	Identicons     IdenticonsConfig     `yaml:"identicons"`
+	DefaultAvatars DefaultAvatarsConfig `yaml:"defaultAvatars"`
+	Quarantine     QuarantineConfig     `yaml:"quarantine"`
+	TimeoutSeconds TimeoutsConfig       `yaml:"timeouts"`
+	Features       FeatureConfig        `yaml:"featureSupport"`
+	AccessTokens   AccessTokenConfig    `yaml:"accessTokens"`
 }
 
 func NewDefaultMinimumRepoConfig() MinimumRepoConfig {
@@ -29,15 +30,44 @@ func NewDefaultMinimumRepoConfig() MinimumRepoConfig {
 				Enabled:    false,
 				UserQuotas: []QuotaUserConfig{},
 			},
+			MaxConcurrent: ConcurrentUploadsConfig{
+				PerUser: 0,
+				PerIp:   0,
+			},
+			ConvertHeicToJpeg: HeicConversionConfig{
+				Enabled:      false,
+				Quality:      90,
+				KeepOriginal: false,
+			},
+			MaxFilenameLength:   255,
+			RejectLongFilenames: false,
+			Progress: UploadProgressConfig{
+				Enabled:        false,
+				MaxSubscribers: 4,
+			},
+			MediaIdCollisions:   "reject",
+			ExtractExifMetadata: false,
+			PerceptualHashes:    false,
+			MetadataExtraction: MetadataExtractionConfig{
+				NumWorkers: 2,
+				MaxQueued:  100,
+			},
+			Transforms: []UploadTransformConfig{},
 		},
 		Identicons: IdenticonsConfig{
 			Enabled: true,
 		},
+		DefaultAvatars: DefaultAvatarsConfig{
+			Enabled:  false,
+			Colors:   []string{"#2d4fff", "#feb42c", "#e279ea", "#1eb3fd", "#e84d41", "#31cb73", "#8d45aa"},
+			FontPath: "",
+		},
 		Quarantine: QuarantineConfig{
 			ReplaceThumbnails: true,
 			ReplaceDownloads:  false,
 			ThumbnailPath:     "",
 			AllowLocalAdmins:  true,
+			UploadErrorCode:   "M_MEDIA_MALICIOUS",
 		},
 		TimeoutSeconds: TimeoutsConfig{
 			UrlPreviews:  10,
@@ -19,12 +19,52 @@ type QuotasConfig struct {
 }
 
 type UploadsConfig struct {
-	MaxSizeBytes         int64        `yaml:"maxBytes"`
-	MinSizeBytes         int64        `yaml:"minBytes"`
-	ReportedMaxSizeBytes int64        `yaml:"reportedMaxBytes"`
-	MaxPending           int64        `yaml:"maxPending"`
-	MaxAgeSeconds        int64        `yaml:"maxAgeSeconds"`
-	Quota                QuotasConfig `yaml:"quotas"`
+	MaxSizeBytes         int64                    `yaml:"maxBytes"`
+	MinSizeBytes         int64                    `yaml:"minBytes"`
+	ReportedMaxSizeBytes int64                    `yaml:"reportedMaxBytes"`
+	MaxPending           int64                    `yaml:"maxPending"`
+	MaxAgeSeconds        int64                    `yaml:"maxAgeSeconds"`
+	Quota                QuotasConfig             `yaml:"quotas"`
+	MaxConcurrent        ConcurrentUploadsConfig  `yaml:"maxConcurrent"`
+	ConvertHeicToJpeg    HeicConversionConfig     `yaml:"convertHeicToJpeg"`
+	MaxFilenameLength    int                      `yaml:"maxFilenameLength"`
+	RejectLongFilenames  bool                     `yaml:"rejectLongFilenames"`
+	Progress             UploadProgressConfig     `yaml:"progress"`
+	MediaIdCollisions    string                   `yaml:"mediaIdCollisions"`
+	ExtractExifMetadata  bool                     `yaml:"extractExifMetadata"`
+	PerceptualHashes     bool                     `yaml:"perceptualHashes"`
+	MetadataExtraction   MetadataExtractionConfig `yaml:"metadataExtraction"`
+	Transforms           []UploadTransformConfig  `yaml:"transforms"`
+}
+
+type UploadTransformConfig struct {
+	Name         string   `yaml:"name"`
+	ContentTypes []string `yaml:"contentTypes,flow"`
+	MaxWidth     int      `yaml:"maxWidth"`
+	MaxHeight    int      `yaml:"maxHeight"`
+	TargetType   string   `yaml:"targetType"`
+	Quality      int      `yaml:"quality"`
+}
+
+type ConcurrentUploadsConfig struct {
+	PerUser int `yaml:"perUser"`
+	PerIp   int `yaml:"perIp"`
+}
+
+type MetadataExtractionConfig struct {
+	NumWorkers int `yaml:"numWorkers"`
+	MaxQueued  int `yaml:"maxQueued"`
+}
+
+type UploadProgressConfig struct {
+	Enabled        bool `yaml:"enabled"`
+	MaxSubscribers int  `yaml:"maxSubscribers"`
+}
+
+type HeicConversionConfig struct {
+	Enabled      bool `yaml:"enabled"`
+	Quality      int  `yaml:"quality"`
+	KeepOriginal bool `yaml:"keepOriginal"`
 }
 
 type DatastoreConfig struct {
@@ -35,21 +75,99 @@ type DatastoreConfig struct {
 }
 
 type DownloadsConfig struct {
-	MaxSizeBytes               int64 `yaml:"maxBytes"`
-	FailureCacheMinutes        int   `yaml:"failureCacheMinutes"`
-	DefaultRangeChunkSizeBytes int64 `yaml:"defaultRangeChunkSizeBytes"`
+	MaxSizeBytes               int64               `yaml:"maxBytes"`
+	FailureCacheMinutes        int                 `yaml:"failureCacheMinutes"`
+	DefaultRangeChunkSizeBytes int64               `yaml:"defaultRangeChunkSizeBytes"`
+	DefaultFilename            string              `yaml:"defaultFilename"`
+	StripMetadata              StripMetadataConfig `yaml:"stripMetadata"`
+	OriginMaxSizeBytes         []OriginSizeLimit   `yaml:"originMaxBytes"`
+	Bulk                       BulkDownloadConfig  `yaml:"bulk"`
+	Throttle                   DownloadThrottle    `yaml:"throttle"`
+}
+
+type DownloadThrottle struct {
+	BytesPerSecond int64 `yaml:"bytesPerSecond"`
+	BurstBytes     int64 `yaml:"burstBytes"`
+}
+
+type BulkDownloadConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	MaxItems     int    `yaml:"maxItems"`
+	MaxSizeBytes int64  `yaml:"maxBytes"`
+	Quarantined  string `yaml:"quarantined"`
+}
+
+type OriginSizeLimit struct {
+	Origin       string `yaml:"origin"`
+	MaxSizeBytes int64  `yaml:"maxBytes"`
+}
+
+type StripMetadataConfig struct {
+	Enabled      bool  `yaml:"enabled"`
+	MaxSizeBytes int64 `yaml:"maxBytes"`
 }
 
 type ThumbnailsConfig struct {
-	MaxSourceBytes      int64           `yaml:"maxSourceBytes"`
-	MaxPixels           int             `yaml:"maxPixels"`
-	Types               []string        `yaml:"types,flow"`
-	MaxAnimateSizeBytes int64           `yaml:"maxAnimateSizeBytes"`
-	Sizes               []ThumbnailSize `yaml:"sizes,flow"`
-	DynamicSizing       bool            `yaml:"dynamicSizing"`
-	AllowAnimated       bool            `yaml:"allowAnimated"`
-	DefaultAnimated     bool            `yaml:"defaultAnimated"`
-	StillFrame          float32         `yaml:"stillFrame"`
+	MaxSourceBytes      int64                  `yaml:"maxSourceBytes"`
+	MaxPixels           int                    `yaml:"maxPixels"`
+	Types               []string               `yaml:"types,flow"`
+	MaxAnimateSizeBytes int64                  `yaml:"maxAnimateSizeBytes"`
+	Sizes               []ThumbnailSize        `yaml:"sizes,flow"`
+	DynamicSizing       bool                   `yaml:"dynamicSizing"`
+	AutoAspect          bool                   `yaml:"autoAspect"`
+	AllowAnimated       bool                   `yaml:"allowAnimated"`
+	DefaultAnimated     bool                   `yaml:"defaultAnimated"`
+	StillFrame          float32                `yaml:"stillFrame"`
+	GeneratorOrder      []string               `yaml:"generatorOrder,flow"`
+	DisabledGenerators  []string               `yaml:"disabledGenerators,flow"`
+	UnavailableCodecs   string                 `yaml:"unavailableCodecs"`
+	ServerTiming        bool                   `yaml:"serverTiming"`
+	AutoFormat          bool                   `yaml:"autoFormat"`
+	Sharpen             bool                   `yaml:"sharpen"`
+	SharpenAmount       float64                `yaml:"sharpenAmount"`
+	Trim                bool                   `yaml:"trim"`
+	TrimTolerance       int                    `yaml:"trimTolerance"`
+	MinGeneratorVersion int                    `yaml:"minGeneratorVersion"`
+	GifTransparency     bool                   `yaml:"preserveGifTransparency"`
+	OutputDpi           int                    `yaml:"outputDpi"`
+	ProgressiveJpeg     bool                   `yaml:"progressiveJpeg"`
+	SmartCrop           SmartCropConfig        `yaml:"smartCrop"`
+	SmallOriginals      SmallOriginalsConfig   `yaml:"serveSmallOriginals"`
+	PngPalette          PngPaletteConfig       `yaml:"pngPalette"`
+	Retries             ThumbnailRetryConfig   `yaml:"retries"`
+	Placeholders        []ThumbnailPlaceholder `yaml:"placeholders,flow"`
+	ExifOrientation     ExifOrientationConfig  `yaml:"exifOrientation"`
+}
+
+type ExifOrientationConfig struct {
+	Enabled         bool     `yaml:"enabled"`
+	IgnoreStale     bool     `yaml:"ignoreStale"`
+	DisabledOrigins []string `yaml:"disabledOrigins,flow"`
+}
+
+type ThumbnailPlaceholder struct {
+	ContentType string `yaml:"contentType"`
+	Path        string `yaml:"path"`
+}
+
+type ThumbnailRetryConfig struct {
+	MaxRetries int `yaml:"maxRetries"`
+	BackoffMs  int `yaml:"backoffMs"`
+}
+
+type PngPaletteConfig struct {
+	Mode          string `yaml:"mode"`
+	MaxAutoColors int    `yaml:"maxAutoColors"`
+}
+
+type SmallOriginalsConfig struct {
+	Enabled  bool  `yaml:"enabled"`
+	MaxBytes int64 `yaml:"maxBytes"`
+}
+
+type SmartCropConfig struct {
+	Enabled       bool `yaml:"enabled"`
+	MaxConcurrent int  `yaml:"maxConcurrent"`
 }
 
 type ThumbnailSize struct {
@@ -58,30 +176,87 @@ type ThumbnailSize struct {
 }
 
 type UrlPreviewsConfig struct {
-	Enabled            bool     `yaml:"enabled"`
-	NumWords           int      `yaml:"numWords"`
-	NumTitleWords      int      `yaml:"numTitleWords"`
-	MaxLength          int      `yaml:"maxLength"`
-	MaxTitleLength     int      `yaml:"maxTitleLength"`
-	MaxPageSizeBytes   int64    `yaml:"maxPageSizeBytes"`
-	FilePreviewTypes   []string `yaml:"filePreviewTypes,flow"`
-	DisallowedNetworks []string `yaml:"disallowedNetworks,flow"`
-	AllowedNetworks    []string `yaml:"allowedNetworks,flow"`
-	UnsafeCertificates bool     `yaml:"previewUnsafeCertificates"`
-	DefaultLanguage    string   `yaml:"defaultLanguage"`
-	UserAgent          string   `yaml:"userAgent"`
-	OEmbed             bool     `yaml:"oEmbed"`
+	Enabled                  bool                    `yaml:"enabled"`
+	NumWords                 int                     `yaml:"numWords"`
+	NumTitleWords            int                     `yaml:"numTitleWords"`
+	MaxLength                int                     `yaml:"maxLength"`
+	MaxTitleLength           int                     `yaml:"maxTitleLength"`
+	NormalizeText            bool                    `yaml:"normalizeText"`
+	MaxPageSizeBytes         int64                   `yaml:"maxPageSizeBytes"`
+	AllowPartialPages        bool                    `yaml:"allowPartialPages"`
+	FilePreviewTypes         []string                `yaml:"filePreviewTypes,flow"`
+	UnsupportedFileLinks     bool                    `yaml:"unsupportedFileLinks"`
+	AllowedImageTypes        []string                `yaml:"allowedImageTypes,flow"`
+	SvgImages                string                  `yaml:"svgImages"`
+	SniffContentType         bool                    `yaml:"sniffContentType"`
+	DisallowedNetworks       []string                `yaml:"disallowedNetworks,flow"`
+	AllowedNetworks          []string                `yaml:"allowedNetworks,flow"`
+	AllowedPorts             []int                   `yaml:"allowedPorts,flow"`
+	AllowCrossSchemeRedirect bool                    `yaml:"allowCrossSchemeRedirect"`
+	Credentials              []UrlPreviewCredentials `yaml:"credentials"`
+	DnsServers               []string                `yaml:"dnsServers,flow"`
+	UnsafeCertificates       bool                    `yaml:"previewUnsafeCertificates"`
+	DefaultLanguage          string                  `yaml:"defaultLanguage"`
+	MaxLanguages             int                     `yaml:"maxLanguages"`
+	UserAgent                string                  `yaml:"userAgent"`
+	Referer                  string                  `yaml:"referer"`
+	ExtraHeaders             map[string]string       `yaml:"extraHeaders"`
+	OEmbed                   bool                    `yaml:"oEmbed"`
+	PreferAmp                bool                    `yaml:"preferAmp"`
+	FaviconFallback          bool                    `yaml:"faviconFallback"`
+	PreferredFaviconSize     int                     `yaml:"preferredFaviconSize"`
+	ImageThumbnailSize       ThumbnailSize           `yaml:"imageThumbnailSize"`
+	Gallery                  UrlPreviewGalleryConfig `yaml:"gallery"`
+	RateLimitedOrigins       UrlPreviewBackoffConfig `yaml:"rateLimitedOrigins"`
+	RateLimit                UrlPreviewRateLimit     `yaml:"rateLimit"`
+}
+
+type UrlPreviewCredentials struct {
+	Scheme      string `yaml:"scheme"`
+	Host        string `yaml:"host"`
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	BearerToken string `yaml:"bearerToken"`
+}
+
+type UrlPreviewGalleryConfig struct {
+	Enabled   bool  `yaml:"enabled"`
+	MaxImages int   `yaml:"maxImages"`
+	MaxBytes  int64 `yaml:"maxBytes"`
+}
+
+type UrlPreviewBackoffConfig struct {
+	Enabled        bool `yaml:"enabled"`
+	DefaultSeconds int  `yaml:"defaultSeconds"`
+	MaxSeconds     int  `yaml:"maxSeconds"`
+}
+
+type UrlPreviewRateLimit struct {
+	PerUser UrlPreviewRate `yaml:"perUser"`
+	PerIp   UrlPreviewRate `yaml:"perIp"`
+}
+
+type UrlPreviewRate struct {
+	PerMinute float64 `yaml:"perMinute"`
+	Burst     int     `yaml:"burst"`
 }
 
 type IdenticonsConfig struct {
 	Enabled bool `yaml:"enabled"`
 }
 
+type DefaultAvatarsConfig struct {
+	Enabled  bool     `yaml:"enabled"`
+	Colors   []string `yaml:"colors,flow"`
+	FontPath string   `yaml:"fontPath"`
+}
+
 type QuarantineConfig struct {
 	ReplaceThumbnails bool   `yaml:"replaceThumbnails"`
 	ReplaceDownloads  bool   `yaml:"replaceDownloads"`
 	ThumbnailPath     string `yaml:"thumbnailPath"`
 	AllowLocalAdmins  bool   `yaml:"allowLocalAdmins"`
+	UploadErrorCode   string `yaml:"uploadErrorCode"`
 }
 
 type TimeoutsConfig struct {
@@ -1,14 +1,18 @@
 package config
 
 type GeneralConfig struct {
-	BindAddress      string `yaml:"bindAddress"`
-	Port             int    `yaml:"port"`
-	LogDirectory     string `yaml:"logDirectory"`
-	LogColors        bool   `yaml:"logColors"`
-	JsonLogs         bool   `yaml:"jsonLogs"`
-	LogLevel         string `yaml:"logLevel"`
-	TrustAnyForward  bool   `yaml:"trustAnyForwardedAddress"`
-	UseForwardedHost bool   `yaml:"useForwardedHost"`
+	BindAddress         string   `yaml:"bindAddress"`
+	Port                int      `yaml:"port"`
+	LogDirectory        string   `yaml:"logDirectory"`
+	LogColors           bool     `yaml:"logColors"`
+	JsonLogs            bool     `yaml:"jsonLogs"`
+	LogLevel            string   `yaml:"logLevel"`
+	RedactLogs          bool     `yaml:"redactLogs"`
+	RedactLogsKey       string   `yaml:"redactLogsKey"`
+	TrustAnyForward     bool     `yaml:"trustAnyForwardedAddress"`
+	UseForwardedHost    bool     `yaml:"useForwardedHost"`
+	ForwardedHostHeader string   `yaml:"forwardedHostHeader"`
+	TrustedProxies      []string `yaml:"trustedProxies"`
 }
 
 type HomeserverConfig struct {
@@ -30,8 +34,26 @@ type DbPoolConfig struct {
 
 type MainDownloadsConfig struct {
 	DownloadsConfig `yaml:",inline"`
-	NumWorkers      int `yaml:"numWorkers"`
-	ExpireDays      int `yaml:"expireAfterDays"`
+	NumWorkers      int               `yaml:"numWorkers"`
+	ExpireDays      int               `yaml:"expireAfterDays"`
+	Prefetch        PrefetchConfig    `yaml:"prefetch"`
+	MemoryCache     MemoryCacheConfig `yaml:"memoryCache"`
+}
+
+type MemoryCacheConfig struct {
+	Enabled           bool  `yaml:"enabled"`
+	MaxMediaSizeBytes int64 `yaml:"maxMediaSizeBytes"`
+	MaxTotalBytes     int64 `yaml:"maxTotalBytes"`
+	TtlSeconds        int   `yaml:"ttlSeconds"`
+}
+
+type PrefetchConfig struct {
+	Enabled          bool     `yaml:"enabled"`
+	QueueSize        int      `yaml:"queueSize"`
+	NumWorkers       int      `yaml:"numWorkers"`
+	MaxPerOrigin     int      `yaml:"maxPerOrigin"`
+	OriginIntervalMs int      `yaml:"originIntervalMs"`
+	AllowedOrigins   []string `yaml:"allowedOrigins,flow"`
 }
 
 type MainThumbnailsConfig struct {
@@ -44,6 +66,7 @@ type MainUrlPreviewsConfig struct {
 	UrlPreviewsConfig `yaml:",inline"`
 	NumWorkers        int `yaml:"numWorkers"`
 	ExpireDays        int `yaml:"expireAfterDays"`
+	ImageExpireDays   int `yaml:"imageExpireAfterDays"`
 }
 
 type RateLimitConfig struct {
@@ -64,8 +87,14 @@ type SharedSecretConfig struct {
 }
 
 type FederationConfig struct {
-	BackoffAt    int      `yaml:"backoffAt"`
-	IgnoredHosts []string `yaml:"ignoredHosts,flow"`
+	BackoffAt               int                           `yaml:"backoffAt"`
+	IgnoredHosts            []string                      `yaml:"ignoredHosts,flow"`
+	ServerNameNormalization ServerNameNormalizationConfig `yaml:"serverNameNormalization"`
+}
+
+type ServerNameNormalizationConfig struct {
+	Enabled    bool  `yaml:"enabled"`
+	StripPorts []int `yaml:"stripPorts,flow"`
 }
 
 type PluginConfig struct {
@@ -92,7 +121,45 @@ type RedisShardConfig struct {
 }
 
 type TasksConfig struct {
-	NumWorkers int `yaml:"numWorkers"`
+	NumWorkers int            `yaml:"numWorkers"`
+	Scrubber   ScrubberConfig `yaml:"scrubber"`
+}
+
+type ScrubberConfig struct {
+	Enabled           bool  `yaml:"enabled"`
+	RecheckDays       int   `yaml:"recheckDays"`
+	MaxBytesPerSecond int64 `yaml:"maxBytesPerSecond"`
+	QuarantineCorrupt bool  `yaml:"quarantineCorrupt"`
+}
+
+type RequestTimeoutsConfig struct {
+	HeaderSeconds       int `yaml:"headerSeconds"`
+	DefaultSeconds      int `yaml:"defaultSeconds"`
+	PreviewSeconds      int `yaml:"previewSeconds"`
+	AdminSeconds        int `yaml:"adminSeconds"`
+	UploadIdleSeconds   int `yaml:"uploadIdleSeconds"`
+	DownloadIdleSeconds int `yaml:"downloadIdleSeconds"`
+}
+
+type ReadOnlyConfig struct {
+	Enabled           bool `yaml:"enabled"`
+	RetryAfterSeconds int  `yaml:"retryAfterSeconds"`
+}
+
+type MemoryBudgetConfig struct {
+	MaxBytes          int64 `yaml:"maxBytes"`
+	QueueSeconds      int   `yaml:"queueSeconds"`
+	RetryAfterSeconds int   `yaml:"retryAfterSeconds"`
+}
+
+type AuditLogConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	Sink          string `yaml:"sink"`
+	FilePath      string `yaml:"filePath"`
+	SyslogNetwork string `yaml:"syslogNetwork"`
+	SyslogAddress string `yaml:"syslogAddress"`
+	WebhookUrl    string `yaml:"webhookUrl"`
+	QueueSize     int    `yaml:"queueSize"`
 }
 
 type PGOConfig struct {
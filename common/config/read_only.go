@@ -0,0 +1,31 @@
+package config
+
+import (
+	"sync/atomic"
+)
+
+var readOnlyOverride atomic.Pointer[bool]
+
+// IsReadOnly returns true if the media repo should not store any new media. The value set by
+// SetReadOnlyOverride takes precedence over the config file.
+func IsReadOnly() bool {
+	if v := readOnlyOverride.Load(); v != nil {
+		return *v
+	}
+	return Get().ReadOnly.Enabled
+}
+
+// SetReadOnlyOverride overrides the configured read-only state for this process until it is restarted. Pass
+// nil to go back to using the config file.
+func SetReadOnlyOverride(readOnly *bool) {
+	if readOnly != nil {
+		v := *readOnly // don't hold onto the caller's pointer
+		readOnly = &v
+	}
+	readOnlyOverride.Store(readOnly)
+}
+
+// HasReadOnlyOverride returns true if the read-only state has been set with SetReadOnlyOverride.
+func HasReadOnlyOverride() bool {
+	return readOnlyOverride.Load() != nil
+}
@@ -1,9 +1,41 @@
 package config
 
 import (
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
 
+// IsProtectedPreviewHeader returns true for headers which can't be set with urlPreviews.extraHeaders, as they either
+// have their own options or are set per request.
+func IsProtectedPreviewHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Host", "User-Agent", "Accept-Language", "Referer", "Authorization", "Proxy-Authorization", "Cookie", "Content-Length", "Transfer-Encoding", "Connection":
+		return true
+	default:
+		return false
+	}
+}
+
+// normalizeUrlPreviews removes any extra headers which the media repo sets itself, warning about each one.
+func normalizeUrlPreviews(c *UrlPreviewsConfig, source string) {
+	for name := range c.ExtraHeaders {
+		if IsProtectedPreviewHeader(name) {
+			logrus.Warnf("Ignoring urlPreviews.extraHeaders entry %s for %s: it is set by the media repo", name, source)
+			delete(c.ExtraHeaders, name)
+		}
+	}
+}
+
+// normalizeThumbnails lowercases the server name globs so they can be matched against lowercased origins.
+func normalizeThumbnails(c *ThumbnailsConfig) {
+	for i, pattern := range c.ExifOrientation.DisabledOrigins {
+		c.ExifOrientation.DisabledOrigins[i] = strings.ToLower(pattern)
+	}
+}
+
 func mapToObjYaml(input map[string]interface{}, ref interface{}) error {
 	encoded, err := yaml.Marshal(input)
 	if err != nil {
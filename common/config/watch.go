@@ -1,6 +1,7 @@
 package config
 
 import (
+	"slices"
 	"time"
 
 	"github.com/bep/debounce"
@@ -8,6 +9,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/common/globals"
+	"github.com/t2bot/matrix-media-repo/common/logging"
 )
 
 func Watch() *fsnotify.Watcher {
@@ -69,7 +71,8 @@ func onFileChanged() {
 	bindPortChange := configNew.General.Port != configNow.General.Port
 	forwardAddressChange := configNew.General.TrustAnyForward != configNow.General.TrustAnyForward
 	forwardedHostChange := configNew.General.UseForwardedHost != configNow.General.UseForwardedHost
-	if bindAddressChange || bindPortChange || forwardAddressChange || forwardedHostChange {
+	trustedProxiesChange := !slices.Equal(configNew.General.TrustedProxies, configNow.General.TrustedProxies)
+	if bindAddressChange || bindPortChange || forwardAddressChange || forwardedHostChange || trustedProxiesChange {
 		logrus.Warn("Webserver configuration changed - remounting")
 		globals.WebReloadChan <- true
 	}
@@ -95,6 +98,12 @@ func onFileChanged() {
 		logrus.Warn("Log configuration changed - restart the media repo to apply changes")
 	}
 
+	redactChange := configNew.General.RedactLogs != configNow.General.RedactLogs || configNew.General.RedactLogsKey != configNow.General.RedactLogsKey
+	if redactChange {
+		logrus.Warn("Log redaction changed - applying")
+		logging.SetRedaction(configNew.General.RedactLogs, configNew.General.RedactLogsKey)
+	}
+
 	redisEnabledChange := configNew.Redis.Enabled != configNow.Redis.Enabled
 	redisShardsChange := hasRedisShardConfigChanged(configNew, configNow)
 	if redisEnabledChange || redisShardsChange {
@@ -123,6 +132,11 @@ func onFileChanged() {
 		logrus.Warn("PGO config changed - reloading")
 		globals.PGOReloadChan <- true
 	}
+
+	if configNew.AuditLog != configNow.AuditLog {
+		logrus.Warn("Audit log config changed - reloading")
+		globals.AuditReloadChan <- true
+	}
 }
 
 func hasRedisShardConfigChanged(configNew *MainRepoConfig, configNow *MainRepoConfig) bool {
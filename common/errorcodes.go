@@ -16,3 +16,12 @@ const ErrCodeForbidden = "M_FORBIDDEN"
 const ErrCodeQuotaExceeded = "M_QUOTA_EXCEEDED"
 const ErrCodeCannotOverwrite = "M_CANNOT_OVERWRITE_MEDIA"
 const ErrCodeNotYetUploaded = "M_NOT_YET_UPLOADED"
+const ErrCodeTimedOut = "M_TIMED_OUT"
+const ErrCodeUnavailable = "M_UNAVAILABLE"
+const ErrCodeServerBusy = "M_SERVER_BUSY"
+const ErrCodeRangeNotSatisfiable = "M_RANGE_NOT_SATISFIABLE"
+const ErrCodeRemoteFetchDisabled = "M_REMOTE_FETCH_DISABLED"
+const ErrCodeRemoteFetchFailed = "M_REMOTE_FETCH_FAILED"
+const ErrCodeMediaMalicious = "M_MEDIA_MALICIOUS"
+const ErrCodeOriginRateLimited = "M_ORIGIN_RATE_LIMITED"
+const ErrCodeCodecUnavailable = "M_CODEC_UNAVAILABLE"
@@ -2,17 +2,41 @@ package common
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
 var ErrMediaNotFound = errors.New("media not found")
+var ErrRemoteFetchDisabled = errors.New("remote media not cached and fetching is disabled")
+var ErrRemoteFetchFailed = errors.New("failed to fetch remote media")
 var ErrMediaTooLarge = errors.New("media too large")
+var ErrMediaTooSmall = errors.New("media too small")
 var ErrInvalidHost = errors.New("invalid host")
 var ErrHostNotFound = errors.New("host not found")
 var ErrHostNotAllowed = errors.New("host not allowed")
+var ErrPortNotAllowed = errors.New("port not allowed")
 var ErrMediaQuarantined = errors.New("media quarantined")
 var ErrQuotaExceeded = errors.New("quota exceeded")
 var ErrWrongUser = errors.New("wrong user")
 var ErrExpired = errors.New("expired")
 var ErrAlreadyUploaded = errors.New("already uploaded")
+var ErrMediaIdCollision = errors.New("media ID already used for different content")
+var ErrReadOnly = errors.New("media repo is read-only")
 var ErrMediaNotYetUploaded = errors.New("media not yet uploaded")
 var ErrMediaDimensionsTooSmall = errors.New("media is too small dimensionally")
+var ErrTooManyUploads = errors.New("too many concurrent uploads")
+var ErrPrefetchQueueFull = errors.New("prefetch queue full")
+var ErrMemoryBudgetExceeded = errors.New("memory budget exceeded")
+var ErrFileNameTooLong = errors.New("file name too long")
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+var ErrOriginRangeMismatch = errors.New("origin returned a range which does not match the request")
+
+// RateLimitedError is returned when a user (or IP address) has made too many requests, and may try again after
+// RetryAfter.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited, try again in %s", e.RetryAfter.Round(time.Second))
+}
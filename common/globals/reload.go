@@ -11,3 +11,4 @@ var PluginReloadChan = make(chan bool)
 var PoolReloadChan = make(chan bool)
 var ErrorCacheReloadChan = make(chan bool)
 var PGOReloadChan = make(chan bool)
+var AuditReloadChan = make(chan bool)
@@ -16,6 +16,7 @@ type utcFormatter struct {
 }
 
 func (f utcFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	entry = redactEntry(entry)
 	entry.Time = entry.Time.UTC()
 	return f.Formatter.Format(entry)
 }
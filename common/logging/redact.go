@@ -0,0 +1,96 @@
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// redactedFields are the log fields which may contain user IDs or file names.
+var redactedFields = map[string]bool{
+	"userId":       true,
+	"authUserId":   true,
+	"exportUserId": true,
+	"filename":     true,
+	"search_term":  true,
+}
+
+var redactionEnabled atomic.Bool
+var redactionKey atomic.Pointer[[]byte]
+
+// processKey is used when no redaction key is configured. It changes on every restart.
+var processKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// SetRedaction enables or disables redaction of user IDs and file names in log fields. The key is used to
+// hash the values - if empty, a random key is used for the life of the process.
+func SetRedaction(enabled bool, key string) {
+	k := processKey
+	if key != "" {
+		k = []byte(key)
+	}
+	redactionKey.Store(&k)
+	redactionEnabled.Store(enabled)
+}
+
+// RedactionEnabled returns whether user IDs and file names are being redacted.
+func RedactionEnabled() bool {
+	return redactionEnabled.Load()
+}
+
+// Redact returns a keyed hash (HMAC-SHA256, truncated to 128 bits) of the value so log lines can still be
+// correlated without revealing the value itself. Empty values are returned as-is.
+func Redact(val string) string {
+	if val == "" {
+		return val
+	}
+	key := processKey
+	if k := redactionKey.Load(); k != nil {
+		key = *k
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(val))
+	return "redacted:" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func redactEntry(entry *logrus.Entry) *logrus.Entry {
+	if !redactionEnabled.Load() {
+		return entry
+	}
+
+	var data logrus.Fields
+	for k, v := range entry.Data {
+		if !redactedFields[k] {
+			continue
+		}
+		if data == nil {
+			// Copy the fields so we don't affect other formatters or hooks
+			data = make(logrus.Fields, len(entry.Data))
+			for k2, v2 := range entry.Data {
+				data[k2] = v2
+			}
+		}
+		if s, ok := v.(string); ok {
+			data[k] = Redact(s)
+		} else {
+			data[k] = Redact(fmt.Sprint(v))
+		}
+	}
+	if data == nil {
+		return entry
+	}
+
+	redacted := *entry
+	redacted.Data = data
+	return &redacted
+}
@@ -61,3 +61,14 @@ func (c RequestContext) ReplaceLogger(log *logrus.Entry) RequestContext {
 func (c RequestContext) LogWithFields(fields logrus.Fields) RequestContext {
 	return c.ReplaceLogger(c.Log.WithFields(fields))
 }
+
+// Detached returns a copy of the context which is not cancelled when the request finishes, for work which
+// carries on in the background afterwards.
+func (c RequestContext) Detached() RequestContext {
+	return RequestContext{
+		Context: context.WithoutCancel(c.Context),
+		Log:     c.Log,
+		Config:  c.Config,
+		Request: c.Request,
+	}
+}
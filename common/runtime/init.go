@@ -1,12 +1,15 @@
 package runtime
 
 import (
+	"strings"
+
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
 	"github.com/t2bot/matrix-media-repo/errcache"
 	"github.com/t2bot/matrix-media-repo/pool"
 	"github.com/t2bot/matrix-media-repo/redislib"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/i"
 	"github.com/t2bot/matrix-media-repo/util/ids"
 
 	"github.com/sirupsen/logrus"
@@ -24,6 +27,7 @@ func RunStartupSequence() {
 	LoadDatabase()
 	LoadDatastores()
 	plugins.ReloadPlugins()
+	CheckThumbnailGenerators()
 	pool.Init()
 	errcache.Init()
 	redislib.Reconnect()
@@ -76,3 +80,17 @@ func CheckIdGenerator() {
 	id := ids.GetMachineId()
 	logrus.Infof("Running as machine %d for ID generation. This ID must be unique within your cluster.", id)
 }
+
+func CheckThumbnailGenerators() {
+	logrus.Info("Checking thumbnail generators...")
+	unavailable := i.CheckCodecs()
+	available := make([]string, 0)
+	for _, name := range i.GetGeneratorNames() {
+		if err, ok := unavailable[name]; ok {
+			logrus.Warnf("Thumbnail generator %s is unavailable on this build: %v", name, err)
+		} else {
+			available = append(available, name)
+		}
+	}
+	logrus.Info("Available thumbnail generators: ", strings.Join(available, ", "))
+}
@@ -28,6 +28,9 @@ type Database struct {
 	Tasks           *tasksTableStatements
 	Exports         *exportsTableStatements
 	ExportParts     *exportPartsTableStatements
+	IntegrityChecks *integrityChecksTableStatements
+	MediaAlternates *mediaAlternatesTableStatements
+	MediaExif       *mediaExifTableStatements
 }
 
 var instance *Database
@@ -124,6 +127,15 @@ func openDatabase(connectionString string, maxConns int, maxIdleConns int) error
 	if d.ExportParts, err = prepareExportPartsTables(d.conn); err != nil {
 		return errors.New("failed to create export parts table accessor: " + err.Error())
 	}
+	if d.IntegrityChecks, err = prepareIntegrityChecksTables(d.conn); err != nil {
+		return errors.New("failed to create integrity checks table accessor: " + err.Error())
+	}
+	if d.MediaAlternates, err = prepareMediaAlternatesTables(d.conn); err != nil {
+		return errors.New("failed to create media alternates table accessor: " + err.Error())
+	}
+	if d.MediaExif, err = prepareMediaExifTables(d.conn); err != nil {
+		return errors.New("failed to create media exif table accessor: " + err.Error())
+	}
 
 	instance = d
 	return nil
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbIntegrityCheck struct {
+	*Locatable
+	SizeBytes int64
+	CheckedTs int64
+	Corrupt   bool
+}
+
+const selectMediaNeedingIntegrityCheck = "SELECT DISTINCT m.sha256_hash, m.datastore_id, m.location, m.size_bytes, COALESCE(c.checked_ts, 0), COALESCE(c.corrupt, FALSE) FROM media AS m LEFT JOIN integrity_checks AS c ON c.datastore_id = m.datastore_id AND c.location = m.location WHERE m.quarantined = FALSE AND m.creation_ts < $1 AND (c.checked_ts IS NULL OR c.checked_ts < $1) ORDER BY m.datastore_id, m.location LIMIT $2;"
+const upsertIntegrityCheck = "INSERT INTO integrity_checks (datastore_id, location, sha256_hash, checked_ts, corrupt) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (datastore_id, location) DO UPDATE SET sha256_hash = $3, checked_ts = $4, corrupt = $5;"
+
+type integrityChecksTableStatements struct {
+	selectMediaNeedingIntegrityCheck *sql.Stmt
+	upsertIntegrityCheck             *sql.Stmt
+}
+
+type integrityChecksTableWithContext struct {
+	statements *integrityChecksTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareIntegrityChecksTables(db *sql.DB) (*integrityChecksTableStatements, error) {
+	var err error
+	var stmts = &integrityChecksTableStatements{}
+
+	if stmts.selectMediaNeedingIntegrityCheck, err = db.Prepare(selectMediaNeedingIntegrityCheck); err != nil {
+		return nil, errors.New("error preparing selectMediaNeedingIntegrityCheck: " + err.Error())
+	}
+	if stmts.upsertIntegrityCheck, err = db.Prepare(upsertIntegrityCheck); err != nil {
+		return nil, errors.New("error preparing upsertIntegrityCheck: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *integrityChecksTableStatements) Prepare(ctx rcontext.RequestContext) *integrityChecksTableWithContext {
+	return &integrityChecksTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *integrityChecksTableWithContext) scanRows(rows *sql.Rows, err error) ([]*DbIntegrityCheck, error) {
+	results := make([]*DbIntegrityCheck, 0)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	for rows.Next() {
+		val := &DbIntegrityCheck{Locatable: &Locatable{}}
+		if err = rows.Scan(&val.Sha256Hash, &val.DatastoreId, &val.Location, &val.SizeBytes, &val.CheckedTs, &val.Corrupt); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+
+	return results, nil
+}
+
+// GetNeedingCheck returns up to limit media files created before beforeTs which have not been checked since
+// beforeTs. Quarantined media is skipped.
+func (s *integrityChecksTableWithContext) GetNeedingCheck(beforeTs int64, limit int) ([]*DbIntegrityCheck, error) {
+	return s.scanRows(s.statements.selectMediaNeedingIntegrityCheck.QueryContext(s.ctx, beforeTs, limit))
+}
+
+func (s *integrityChecksTableWithContext) Upsert(record *DbIntegrityCheck) error {
+	_, err := s.statements.upsertIntegrityCheck.ExecContext(s.ctx, record.DatastoreId, record.Location, record.Sha256Hash, record.CheckedTs, record.Corrupt)
+	return err
+}
@@ -1,8 +1,10 @@
 package database
 
 import (
+	"cmp"
 	"database/sql"
 	"errors"
+	"slices"
 
 	"github.com/lib/pq"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
@@ -29,16 +31,24 @@ type DbMedia struct {
 	//Location    string
 }
 
+// DbSimilarMedia is a media record with its perceptual hash, as found by a near-duplicate search.
+type DbSimilarMedia struct {
+	*DbMedia
+	PerceptualHash uint64
+}
+
 const selectDistinctMediaDatastoreIds = "SELECT DISTINCT datastore_id FROM media;"
 const selectMediaIsQuarantinedByHash = "SELECT quarantined FROM media WHERE quarantined = TRUE AND sha256_hash = $1;"
 const selectMediaByHash = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE sha256_hash = $1;"
 const insertMedia = "INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);"
+const selectMediaByHashes = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE sha256_hash = ANY($1);"
 const selectMediaExists = "SELECT TRUE FROM media WHERE origin = $1 AND media_id = $2 LIMIT 1;"
 const selectMediaById = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE origin = $1 AND media_id = $2;"
 const selectMediaByUserId = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE user_id = $1;"
 const selectOldMediaByUserId = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE user_id = $1 AND creation_ts < $2;"
 const selectMediaByOrigin = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE origin = $1;"
 const selectOldMediaByOrigin = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE origin = $1 AND creation_ts < $2;"
+const selectOldMediaByPurpose = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.creation_ts, m.quarantined, m.datastore_id, m.location FROM media AS m JOIN media_attributes AS a ON m.origin = a.origin AND m.media_id = a.media_id WHERE a.purpose = $1 AND m.creation_ts < $2;"
 const selectMediaByLocationExists = "SELECT TRUE FROM media WHERE datastore_id = $1 AND location = $2 LIMIT 1;"
 const selectMediaByUserCount = "SELECT COUNT(*) FROM media WHERE user_id = $1;"
 const selectMediaByOriginAndUserIds = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE origin = $1 AND user_id = ANY($2);"
@@ -49,11 +59,17 @@ const updateMediaLocation = "UPDATE media SET datastore_id = $3, location = $4 W
 const selectMediaByLocation = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE datastore_id = $1 AND location = $2;"
 const selectMediaByQuarantine = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE quarantined = TRUE;"
 const selectMediaByQuarantineAndOrigin = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE quarantined = TRUE AND origin = $1;"
+const selectMediaDominantColor = "SELECT dominant_color FROM media WHERE origin = $1 AND media_id = $2;"
+const updateMediaDominantColor = "UPDATE media SET dominant_color = $2 WHERE sha256_hash = $1;"
+const selectMediaPerceptualHashByHash = "SELECT perceptual_hash FROM media WHERE sha256_hash = $1 AND perceptual_hash IS NOT NULL LIMIT 1;"
+const updateMediaPerceptualHash = "UPDATE media SET perceptual_hash = $2 WHERE sha256_hash = $1;"
+const selectMediaByPerceptualHash = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location, perceptual_hash FROM media WHERE perceptual_hash IS NOT NULL AND LENGTH(REPLACE(((perceptual_hash # $1::BIGINT)::BIT(64))::TEXT, '0', '')) <= $2 ORDER BY creation_ts ASC LIMIT $3;"
 
 type mediaTableStatements struct {
 	selectDistinctMediaDatastoreIds  *sql.Stmt
 	selectMediaIsQuarantinedByHash   *sql.Stmt
 	selectMediaByHash                *sql.Stmt
+	selectMediaByHashes              *sql.Stmt
 	insertMedia                      *sql.Stmt
 	selectMediaExists                *sql.Stmt
 	selectMediaById                  *sql.Stmt
@@ -61,6 +77,7 @@ type mediaTableStatements struct {
 	selectOldMediaByUserId           *sql.Stmt
 	selectMediaByOrigin              *sql.Stmt
 	selectOldMediaByOrigin           *sql.Stmt
+	selectOldMediaByPurpose          *sql.Stmt
 	selectMediaByLocationExists      *sql.Stmt
 	selectMediaByUserCount           *sql.Stmt
 	selectMediaByOriginAndUserIds    *sql.Stmt
@@ -71,6 +88,11 @@ type mediaTableStatements struct {
 	selectMediaByLocation            *sql.Stmt
 	selectMediaByQuarantine          *sql.Stmt
 	selectMediaByQuarantineAndOrigin *sql.Stmt
+	selectMediaDominantColor         *sql.Stmt
+	updateMediaDominantColor         *sql.Stmt
+	selectMediaPerceptualHashByHash  *sql.Stmt
+	updateMediaPerceptualHash        *sql.Stmt
+	selectMediaByPerceptualHash      *sql.Stmt
 }
 
 type MediaTableWithContext struct {
@@ -91,6 +113,9 @@ func prepareMediaTables(db *sql.DB) (*mediaTableStatements, error) {
 	if stmts.selectMediaByHash, err = db.Prepare(selectMediaByHash); err != nil {
 		return nil, errors.New("error preparing selectMediaByHash: " + err.Error())
 	}
+	if stmts.selectMediaByHashes, err = db.Prepare(selectMediaByHashes); err != nil {
+		return nil, errors.New("error preparing selectMediaByHashes: " + err.Error())
+	}
 	if stmts.insertMedia, err = db.Prepare(insertMedia); err != nil {
 		return nil, errors.New("error preparing insertMedia: " + err.Error())
 	}
@@ -112,6 +137,9 @@ func prepareMediaTables(db *sql.DB) (*mediaTableStatements, error) {
 	if stmts.selectOldMediaByOrigin, err = db.Prepare(selectOldMediaByOrigin); err != nil {
 		return nil, errors.New("error preparing selectOldMediaByOrigin: " + err.Error())
 	}
+	if stmts.selectOldMediaByPurpose, err = db.Prepare(selectOldMediaByPurpose); err != nil {
+		return nil, errors.New("error preparing selectOldMediaByPurpose: " + err.Error())
+	}
 	if stmts.selectMediaByLocationExists, err = db.Prepare(selectMediaByLocationExists); err != nil {
 		return nil, errors.New("error preparing selectMediaByLocationExists: " + err.Error())
 	}
@@ -142,6 +170,21 @@ func prepareMediaTables(db *sql.DB) (*mediaTableStatements, error) {
 	if stmts.selectMediaByQuarantineAndOrigin, err = db.Prepare(selectMediaByQuarantineAndOrigin); err != nil {
 		return nil, errors.New("error preparing selectMediaByQuarantineAndOrigin: " + err.Error())
 	}
+	if stmts.selectMediaDominantColor, err = db.Prepare(selectMediaDominantColor); err != nil {
+		return nil, errors.New("error preparing selectMediaDominantColor: " + err.Error())
+	}
+	if stmts.updateMediaDominantColor, err = db.Prepare(updateMediaDominantColor); err != nil {
+		return nil, errors.New("error preparing updateMediaDominantColor: " + err.Error())
+	}
+	if stmts.selectMediaPerceptualHashByHash, err = db.Prepare(selectMediaPerceptualHashByHash); err != nil {
+		return nil, errors.New("error preparing selectMediaPerceptualHashByHash: " + err.Error())
+	}
+	if stmts.updateMediaPerceptualHash, err = db.Prepare(updateMediaPerceptualHash); err != nil {
+		return nil, errors.New("error preparing updateMediaPerceptualHash: " + err.Error())
+	}
+	if stmts.selectMediaByPerceptualHash, err = db.Prepare(selectMediaByPerceptualHash); err != nil {
+		return nil, errors.New("error preparing selectMediaByPerceptualHash: " + err.Error())
+	}
 
 	return stmts, nil
 }
@@ -209,6 +252,36 @@ func (s *MediaTableWithContext) GetByHash(sha256hash string) ([]*DbMedia, error)
 	return s.scanRows(s.statements.selectMediaByHash.QueryContext(s.ctx, sha256hash))
 }
 
+// GetByHashes is a batched GetByHash for checking many hashes in one query, such as during an import. Hashes
+// without any records are not in the returned map.
+func (s *MediaTableWithContext) GetByHashes(sha256hashes []string) (map[string][]*DbMedia, error) {
+	records, err := s.scanRows(s.statements.selectMediaByHashes.QueryContext(s.ctx, pq.Array(sha256hashes)))
+	if err != nil {
+		return nil, err
+	}
+	return GroupMediaByHash(records), nil
+}
+
+// GroupMediaByHash groups records by their SHA-256 hash, keeping their order within each group.
+func GroupMediaByHash(records []*DbMedia) map[string][]*DbMedia {
+	grouped := make(map[string][]*DbMedia)
+	for _, r := range records {
+		grouped[r.Sha256Hash] = append(grouped[r.Sha256Hash], r)
+	}
+	return grouped
+}
+
+// GetByHashPreferring is the same as GetByHash, but the records are sorted with SortMediaByPreference so callers
+// picking one of them get the same record each time.
+func (s *MediaTableWithContext) GetByHashPreferring(sha256hash string, preferOrigin string) ([]*DbMedia, error) {
+	records, err := s.GetByHash(sha256hash)
+	if err != nil {
+		return nil, err
+	}
+	SortMediaByPreference(records, preferOrigin)
+	return records, nil
+}
+
 func (s *MediaTableWithContext) GetByUserId(userId string) ([]*DbMedia, error) {
 	return s.scanRows(s.statements.selectMediaByUserId.QueryContext(s.ctx, userId))
 }
@@ -225,6 +298,10 @@ func (s *MediaTableWithContext) GetOldByOrigin(origin string, beforeTs int64) ([
 	return s.scanRows(s.statements.selectOldMediaByOrigin.QueryContext(s.ctx, origin, beforeTs))
 }
 
+func (s *MediaTableWithContext) GetOldByPurpose(purpose Purpose, beforeTs int64) ([]*DbMedia, error) {
+	return s.scanRows(s.statements.selectOldMediaByPurpose.QueryContext(s.ctx, purpose, beforeTs))
+}
+
 func (s *MediaTableWithContext) GetByOriginUsers(origin string, userIds []string) ([]*DbMedia, error) {
 	return s.scanRows(s.statements.selectMediaByOriginAndUserIds.QueryContext(s.ctx, origin, pq.Array(userIds)))
 }
@@ -307,3 +384,85 @@ func (s *MediaTableWithContext) UpdateLocation(sourceDsId string, sourceLocation
 	_, err := s.statements.updateMediaLocation.ExecContext(s.ctx, sourceDsId, sourceLocation, targetDsId, targetLocation)
 	return err
 }
+
+// GetDominantColor returns the stored dominant colour (#rrggbb) for the media, or an empty string if not known.
+func (s *MediaTableWithContext) GetDominantColor(origin string, mediaId string) (string, error) {
+	row := s.statements.selectMediaDominantColor.QueryRowContext(s.ctx, origin, mediaId)
+	val := sql.NullString{}
+	err := row.Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return val.String, err
+}
+
+// SetDominantColor stores the dominant colour on all media records sharing the given hash.
+func (s *MediaTableWithContext) SetDominantColor(sha256hash string, color string) error {
+	_, err := s.statements.updateMediaDominantColor.ExecContext(s.ctx, sha256hash, color)
+	return err
+}
+
+// GetPerceptualHash returns the perceptual hash of the file with the given SHA-256 hash, or nil if not known.
+func (s *MediaTableWithContext) GetPerceptualHash(sha256hash string) (*uint64, error) {
+	row := s.statements.selectMediaPerceptualHashByHash.QueryRowContext(s.ctx, sha256hash)
+	val := sql.NullInt64{}
+	err := row.Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !val.Valid) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	hash := uint64(val.Int64)
+	return &hash, nil
+}
+
+// SetPerceptualHash stores the perceptual hash on all media records sharing the given SHA-256 hash.
+func (s *MediaTableWithContext) SetPerceptualHash(sha256hash string, hash uint64) error {
+	_, err := s.statements.updateMediaPerceptualHash.ExecContext(s.ctx, sha256hash, int64(hash))
+	return err
+}
+
+// GetByPerceptualHash returns up to limit media records whose perceptual hash differs from the given hash in at
+// most maxDistance bits, oldest first. This checks every record with a perceptual hash, so can be slow.
+func (s *MediaTableWithContext) GetByPerceptualHash(hash uint64, maxDistance int, limit int) ([]*DbSimilarMedia, error) {
+	rows, err := s.statements.selectMediaByPerceptualHash.QueryContext(s.ctx, int64(hash), maxDistance, limit)
+	results := make([]*DbSimilarMedia, 0)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		val := &DbSimilarMedia{DbMedia: &DbMedia{Locatable: &Locatable{}}}
+		phash := int64(0)
+		if err = rows.Scan(&val.Origin, &val.MediaId, &val.UploadName, &val.ContentType, &val.UserId, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.Quarantined, &val.DatastoreId, &val.Location, &phash); err != nil {
+			return nil, err
+		}
+		val.PerceptualHash = uint64(phash)
+		results = append(results, val)
+	}
+	return results, rows.Err()
+}
+
+// SortMediaByPreference sorts records from preferOrigin (if not empty) first, then oldest first. Ties are broken
+// by origin and media ID, so the same records always sort the same way regardless of the order they were read in.
+func SortMediaByPreference(records []*DbMedia, preferOrigin string) {
+	slices.SortFunc(records, func(a *DbMedia, b *DbMedia) int {
+		if preferOrigin != "" && (a.Origin == preferOrigin) != (b.Origin == preferOrigin) {
+			if a.Origin == preferOrigin {
+				return -1
+			}
+			return 1
+		}
+		if c := cmp.Compare(a.CreationTs, b.CreationTs); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.Origin, b.Origin); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.MediaId, b.MediaId)
+	})
+}
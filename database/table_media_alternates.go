@@ -0,0 +1,73 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbMediaAlternate struct {
+	Origin           string
+	MediaId          string
+	Reason           AlternateReason
+	AlternateOrigin  string
+	AlternateMediaId string
+}
+
+type AlternateReason string
+
+const (
+	// OriginalAlternateReason links converted media to the file which was originally uploaded.
+	OriginalAlternateReason AlternateReason = "original"
+)
+
+const insertMediaAlternate = "INSERT INTO media_alternates (origin, media_id, reason, alternate_origin, alternate_media_id) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (origin, media_id, reason) DO UPDATE SET alternate_origin = $4, alternate_media_id = $5;"
+const selectMediaAlternate = "SELECT origin, media_id, reason, alternate_origin, alternate_media_id FROM media_alternates WHERE origin = $1 AND media_id = $2 AND reason = $3;"
+
+type mediaAlternatesTableStatements struct {
+	insertMediaAlternate *sql.Stmt
+	selectMediaAlternate *sql.Stmt
+}
+
+type mediaAlternatesTableWithContext struct {
+	statements *mediaAlternatesTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareMediaAlternatesTables(db *sql.DB) (*mediaAlternatesTableStatements, error) {
+	var err error
+	var stmts = &mediaAlternatesTableStatements{}
+
+	if stmts.insertMediaAlternate, err = db.Prepare(insertMediaAlternate); err != nil {
+		return nil, errors.New("error preparing insertMediaAlternate: " + err.Error())
+	}
+	if stmts.selectMediaAlternate, err = db.Prepare(selectMediaAlternate); err != nil {
+		return nil, errors.New("error preparing selectMediaAlternate: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *mediaAlternatesTableStatements) Prepare(ctx rcontext.RequestContext) *mediaAlternatesTableWithContext {
+	return &mediaAlternatesTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *mediaAlternatesTableWithContext) Upsert(alternate *DbMediaAlternate) error {
+	_, err := s.statements.insertMediaAlternate.ExecContext(s.ctx, alternate.Origin, alternate.MediaId, alternate.Reason, alternate.AlternateOrigin, alternate.AlternateMediaId)
+	return err
+}
+
+func (s *mediaAlternatesTableWithContext) Get(origin string, mediaId string, reason AlternateReason) (*DbMediaAlternate, error) {
+	row := s.statements.selectMediaAlternate.QueryRowContext(s.ctx, origin, mediaId, reason)
+	val := &DbMediaAlternate{}
+	err := row.Scan(&val.Origin, &val.MediaId, &val.Reason, &val.AlternateOrigin, &val.AlternateMediaId)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+		val = nil
+	}
+	return val, err
+}
@@ -18,6 +18,8 @@ type Purpose string
 const (
 	PurposeNone   Purpose = "none"
 	PurposePinned Purpose = "pinned"
+	// PurposeUrlPreview is set on images stored for URL previews. It can't be set through the API.
+	PurposeUrlPreview Purpose = "url_preview"
 )
 
 func IsPurpose(purpose Purpose) bool {
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// DbMediaExif holds the camera settings a photo was taken with, by file hash. It never holds location or other
+// identifying details.
+type DbMediaExif struct {
+	Sha256Hash   string
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	FocalLength  float64
+	ExposureTime string
+	FNumber      float64
+	Iso          int
+	DateTaken    string
+}
+
+const insertMediaExif = "INSERT INTO media_exif (sha256_hash, camera_make, camera_model, lens_model, focal_length, exposure_time, f_number, iso, date_taken) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (sha256_hash) DO NOTHING;"
+const selectMediaExif = "SELECT sha256_hash, camera_make, camera_model, lens_model, focal_length, exposure_time, f_number, iso, date_taken FROM media_exif WHERE sha256_hash = $1;"
+
+type mediaExifTableStatements struct {
+	insertMediaExif *sql.Stmt
+	selectMediaExif *sql.Stmt
+}
+
+type mediaExifTableWithContext struct {
+	statements *mediaExifTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareMediaExifTables(db *sql.DB) (*mediaExifTableStatements, error) {
+	var err error
+	var stmts = &mediaExifTableStatements{}
+
+	if stmts.insertMediaExif, err = db.Prepare(insertMediaExif); err != nil {
+		return nil, errors.New("error preparing insertMediaExif: " + err.Error())
+	}
+	if stmts.selectMediaExif, err = db.Prepare(selectMediaExif); err != nil {
+		return nil, errors.New("error preparing selectMediaExif: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *mediaExifTableStatements) Prepare(ctx rcontext.RequestContext) *mediaExifTableWithContext {
+	return &mediaExifTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *mediaExifTableWithContext) Insert(exif *DbMediaExif) error {
+	_, err := s.statements.insertMediaExif.ExecContext(s.ctx, exif.Sha256Hash, exif.CameraMake, exif.CameraModel, exif.LensModel, exif.FocalLength, exif.ExposureTime, exif.FNumber, exif.Iso, exif.DateTaken)
+	return err
+}
+
+func (s *mediaExifTableWithContext) Get(sha256hash string) (*DbMediaExif, error) {
+	row := s.statements.selectMediaExif.QueryRowContext(s.ctx, sha256hash)
+	val := &DbMediaExif{}
+	err := row.Scan(&val.Sha256Hash, &val.CameraMake, &val.CameraModel, &val.LensModel, &val.FocalLength, &val.ExposureTime, &val.FNumber, &val.Iso, &val.DateTaken)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+		val = nil
+	}
+	return val, err
+}
@@ -23,16 +23,20 @@ type DbThumbnail struct {
 	CreationTs int64
 	//DatastoreId string
 	//Location    string
+	GeneratorVersion int
+	OutputWidth      int // the size of the thumbnail itself, which may differ from the requested Width and Height.
+	OutputHeight     int // zero if unknown (generated before this was recorded).
 }
 
-const selectThumbnailByParams = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location FROM thumbnails WHERE origin = $1 AND media_id = $2 AND width = $3 AND height = $4 AND method = $5 AND animated = $6;"
-const insertThumbnail = "INSERT INTO thumbnails (origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);"
+const selectThumbnailByParams = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location, generator_version, output_width, output_height FROM thumbnails WHERE origin = $1 AND media_id = $2 AND width = $3 AND height = $4 AND method = $5 AND animated = $6;"
+const insertThumbnail = "INSERT INTO thumbnails (origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location, generator_version, output_width, output_height) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15);"
 const selectThumbnailByLocationExists = "SELECT TRUE FROM thumbnails WHERE datastore_id = $1 AND location = $2 LIMIT 1;"
-const selectThumbnailsForMedia = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location FROM thumbnails WHERE origin = $1 AND media_id = $2;"
-const selectOldThumbnails = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location FROM thumbnails WHERE sha256_hash IN (SELECT t2.sha256_hash FROM thumbnails AS t2 WHERE t2.creation_ts < $1);"
+const selectThumbnailsForMedia = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location, generator_version, output_width, output_height FROM thumbnails WHERE origin = $1 AND media_id = $2;"
+const selectOldThumbnails = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location, generator_version, output_width, output_height FROM thumbnails WHERE sha256_hash IN (SELECT t2.sha256_hash FROM thumbnails AS t2 WHERE t2.creation_ts < $1);"
 const deleteThumbnail = "DELETE FROM thumbnails WHERE origin = $1 AND media_id = $2 AND content_type = $3 AND width = $4 AND height = $5 AND method = $6 AND animated = $7 AND sha256_hash = $8 AND size_bytes = $9 AND creation_ts = $10 AND datastore_id = $11 AND location = $12;"
 const updateThumbnailLocation = "UPDATE thumbnails SET datastore_id = $3, location = $4 WHERE datastore_id = $1 AND location = $2;"
-const selectThumbnailsByLocation = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location FROM thumbnails WHERE datastore_id = $1 AND location = $2;"
+const updateThumbnailReplace = "UPDATE thumbnails SET content_type = $7, sha256_hash = $8, size_bytes = $9, creation_ts = $10, datastore_id = $11, location = $12, generator_version = $13, output_width = $14, output_height = $15 WHERE origin = $1 AND media_id = $2 AND width = $3 AND height = $4 AND method = $5 AND animated = $6;"
+const selectThumbnailsByLocation = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location, generator_version, output_width, output_height FROM thumbnails WHERE datastore_id = $1 AND location = $2;"
 
 type thumbnailsTableStatements struct {
 	selectThumbnailByParams         *sql.Stmt
@@ -43,6 +47,7 @@ type thumbnailsTableStatements struct {
 	deleteThumbnail                 *sql.Stmt
 	updateThumbnailLocation         *sql.Stmt
 	selectThumbnailsByLocation      *sql.Stmt
+	updateThumbnailReplace          *sql.Stmt
 }
 
 type thumbnailsTableWithContext struct {
@@ -78,6 +83,9 @@ func prepareThumbnailsTables(db *sql.DB) (*thumbnailsTableStatements, error) {
 	if stmts.selectThumbnailsByLocation, err = db.Prepare(selectThumbnailsByLocation); err != nil {
 		return nil, errors.New("error preparing selectThumbnailsByLocation: " + err.Error())
 	}
+	if stmts.updateThumbnailReplace, err = db.Prepare(updateThumbnailReplace); err != nil {
+		return nil, errors.New("error preparing updateThumbnailReplace: " + err.Error())
+	}
 
 	return stmts, nil
 }
@@ -92,7 +100,7 @@ func (s *thumbnailsTableStatements) Prepare(ctx rcontext.RequestContext) *thumbn
 func (s *thumbnailsTableWithContext) GetByParams(origin string, mediaId string, width int, height int, method string, animated bool) (*DbThumbnail, error) {
 	row := s.statements.selectThumbnailByParams.QueryRowContext(s.ctx, origin, mediaId, width, height, method, animated)
 	val := &DbThumbnail{Locatable: &Locatable{}}
-	err := row.Scan(&val.Origin, &val.MediaId, &val.ContentType, &val.Width, &val.Height, &val.Method, &val.Animated, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.DatastoreId, &val.Location)
+	err := row.Scan(&val.Origin, &val.MediaId, &val.ContentType, &val.Width, &val.Height, &val.Method, &val.Animated, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.DatastoreId, &val.Location, &val.GeneratorVersion, &val.OutputWidth, &val.OutputHeight)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
 		val = nil
@@ -110,7 +118,7 @@ func (s *thumbnailsTableWithContext) scanRows(rows *sql.Rows, err error) ([]*DbT
 	}
 	for rows.Next() {
 		val := &DbThumbnail{Locatable: &Locatable{}}
-		if err = rows.Scan(&val.Origin, &val.MediaId, &val.ContentType, &val.Width, &val.Height, &val.Method, &val.Animated, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.DatastoreId, &val.Location); err != nil {
+		if err = rows.Scan(&val.Origin, &val.MediaId, &val.ContentType, &val.Width, &val.Height, &val.Method, &val.Animated, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.DatastoreId, &val.Location, &val.GeneratorVersion, &val.OutputWidth, &val.OutputHeight); err != nil {
 			return nil, err
 		}
 		results = append(results, val)
@@ -132,7 +140,13 @@ func (s *thumbnailsTableWithContext) GetByLocation(datastoreId string, location
 }
 
 func (s *thumbnailsTableWithContext) Insert(record *DbThumbnail) error {
-	_, err := s.statements.insertThumbnail.ExecContext(s.ctx, record.Origin, record.MediaId, record.ContentType, record.Width, record.Height, record.Method, record.Animated, record.Sha256Hash, record.SizeBytes, record.CreationTs, record.DatastoreId, record.Location)
+	_, err := s.statements.insertThumbnail.ExecContext(s.ctx, record.Origin, record.MediaId, record.ContentType, record.Width, record.Height, record.Method, record.Animated, record.Sha256Hash, record.SizeBytes, record.CreationTs, record.DatastoreId, record.Location, record.GeneratorVersion, record.OutputWidth, record.OutputHeight)
+	return err
+}
+
+// Replace overwrites the thumbnail record with the same origin, media ID, dimensions, method, and animation flag.
+func (s *thumbnailsTableWithContext) Replace(record *DbThumbnail) error {
+	_, err := s.statements.updateThumbnailReplace.ExecContext(s.ctx, record.Origin, record.MediaId, record.Width, record.Height, record.Method, record.Animated, record.ContentType, record.Sha256Hash, record.SizeBytes, record.CreationTs, record.DatastoreId, record.Location, record.GeneratorVersion, record.OutputWidth, record.OutputHeight)
 	return err
 }
 
@@ -2,8 +2,11 @@ package database
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 
+	"github.com/lib/pq"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/util"
 )
@@ -23,16 +26,53 @@ type DbUrlPreview struct {
 	ImageWidth     int
 	ImageHeight    int
 	LanguageHeader string
+	Gallery        DbUrlPreviewGallery
+	FileType       string
+	FileSize       int64
+	Warnings       []string
 }
 
-const selectUrlPreview = "SELECT url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header FROM url_previews WHERE url = $1 AND bucket_ts = $2 AND language_header = $3;"
-const insertUrlPreview = "INSERT INTO url_previews (url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);"
+type DbUrlPreviewImage struct {
+	Mxc    string `json:"mxc"`
+	Type   string `json:"type"`
+	Size   int64  `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type DbUrlPreviewGallery []*DbUrlPreviewImage
+
+// Value implements driver.Valuer
+func (g DbUrlPreviewGallery) Value() (driver.Value, error) {
+	if g == nil {
+		return nil, nil
+	}
+	return json.Marshal(g)
+}
+
+// Scan implements sql.Scanner
+func (g *DbUrlPreviewGallery) Scan(value interface{}) error {
+	if value == nil {
+		*g = nil
+		return nil
+	}
+	if b, ok := value.([]byte); !ok {
+		return errors.New("failed to assert json is bytes")
+	} else {
+		return json.Unmarshal(b, g)
+	}
+}
+
+const selectUrlPreview = "SELECT url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header, gallery, file_type, file_size, warnings FROM url_previews WHERE url = $1 AND bucket_ts = $2 AND language_header = $3;"
+const insertUrlPreview = "INSERT INTO url_previews (url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header, gallery, file_type, file_size, warnings) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18);"
 const deleteOldUrlPreviews = "DELETE FROM url_previews WHERE bucket_ts <= $1;"
+const deleteUrlPreviewsByImage = "DELETE FROM url_previews WHERE image_mxc = ANY($1) OR EXISTS (SELECT 1 FROM json_array_elements(gallery) AS g WHERE g->>'mxc' = ANY($1));"
 
 type urlPreviewsTableStatements struct {
-	selectUrlPreview     *sql.Stmt
-	insertUrlPreview     *sql.Stmt
-	deleteOldUrlPreviews *sql.Stmt
+	selectUrlPreview         *sql.Stmt
+	insertUrlPreview         *sql.Stmt
+	deleteOldUrlPreviews     *sql.Stmt
+	deleteUrlPreviewsByImage *sql.Stmt
 }
 
 type urlPreviewsTableWithContext struct {
@@ -53,6 +93,9 @@ func prepareUrlPreviewsTables(db *sql.DB) (*urlPreviewsTableStatements, error) {
 	if stmts.deleteOldUrlPreviews, err = db.Prepare(deleteOldUrlPreviews); err != nil {
 		return nil, errors.New("error preparing deleteOldUrlPreviews: " + err.Error())
 	}
+	if stmts.deleteUrlPreviewsByImage, err = db.Prepare(deleteUrlPreviewsByImage); err != nil {
+		return nil, errors.New("error preparing deleteUrlPreviewsByImage: " + err.Error())
+	}
 
 	return stmts, nil
 }
@@ -67,7 +110,7 @@ func (s *urlPreviewsTableStatements) Prepare(ctx rcontext.RequestContext) *urlPr
 func (s *urlPreviewsTableWithContext) Get(url string, ts int64, languageHeader string) (*DbUrlPreview, error) {
 	row := s.statements.selectUrlPreview.QueryRowContext(s.ctx, url, ts, languageHeader)
 	val := &DbUrlPreview{}
-	err := row.Scan(&val.Url, &val.ErrorCode, &val.BucketTs, &val.SiteUrl, &val.SiteName, &val.ResourceType, &val.Description, &val.Title, &val.ImageMxc, &val.ImageType, &val.ImageSize, &val.ImageWidth, &val.ImageHeight, &val.LanguageHeader)
+	err := row.Scan(&val.Url, &val.ErrorCode, &val.BucketTs, &val.SiteUrl, &val.SiteName, &val.ResourceType, &val.Description, &val.Title, &val.ImageMxc, &val.ImageType, &val.ImageSize, &val.ImageWidth, &val.ImageHeight, &val.LanguageHeader, &val.Gallery, &val.FileType, &val.FileSize, pq.Array(&val.Warnings))
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
@@ -75,7 +118,7 @@ func (s *urlPreviewsTableWithContext) Get(url string, ts int64, languageHeader s
 }
 
 func (s *urlPreviewsTableWithContext) Insert(p *DbUrlPreview) error {
-	_, err := s.statements.insertUrlPreview.ExecContext(s.ctx, p.Url, p.ErrorCode, p.BucketTs, p.SiteUrl, p.SiteName, p.ResourceType, p.Description, p.Title, p.ImageMxc, p.ImageType, p.ImageSize, p.ImageWidth, p.ImageHeight, p.LanguageHeader)
+	_, err := s.statements.insertUrlPreview.ExecContext(s.ctx, p.Url, p.ErrorCode, p.BucketTs, p.SiteUrl, p.SiteName, p.ResourceType, p.Description, p.Title, p.ImageMxc, p.ImageType, p.ImageSize, p.ImageWidth, p.ImageHeight, p.LanguageHeader, p.Gallery, p.FileType, p.FileSize, pq.Array(p.Warnings))
 	return err
 }
 
@@ -92,3 +135,9 @@ func (s *urlPreviewsTableWithContext) DeleteOlderThan(ts int64) error {
 	_, err := s.statements.deleteOldUrlPreviews.ExecContext(s.ctx, ts)
 	return err
 }
+
+// DeleteByImages deletes the previews which use any of the given MXC URIs as their image, or in their gallery.
+func (s *urlPreviewsTableWithContext) DeleteByImages(mxcs []string) error {
+	_, err := s.statements.deleteUrlPreviewsByImage.ExecContext(s.ctx, pq.Array(mxcs))
+	return err
+}
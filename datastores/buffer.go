@@ -13,12 +13,12 @@ import (
 	"github.com/t2bot/matrix-media-repo/util/readers"
 )
 
-func BufferTemp(datastore config.DatastoreConfig, contents io.ReadCloser) (string, int64, io.ReadCloser, error) {
+func BufferTemp(datastore config.DatastoreConfig, contents io.ReadCloser) (string, int64, io.ReadSeekCloser, error) {
 	fpath := ""
 	var err error
 	if datastore.Type == "s3" {
 		fpath = datastore.Options["tempPath"]
-	} else if datastore.Type == "file" {
+	} else if datastore.Type == "file" || datastore.Type == "proxy" {
 		fpath, err = os.MkdirTemp(os.TempDir(), "mmr")
 		if err != nil {
 			return "", 0, nil, errors.New("error generating temporary directory: " + err.Error())
@@ -53,6 +53,12 @@ func BufferTemp(datastore config.DatastoreConfig, contents io.ReadCloser) (strin
 	// Actually copy to the temp file
 	var sizeBytes int64
 	if sizeBytes, err = io.Copy(mw, contents); err != nil {
+		// Don't leave partial files lying around (they may have been cut off by a size limit)
+		if f, ok := target.(*os.File); ok {
+			if err2 := readers.NewTempFileCloser(fpath, f.Name(), f).Close(); err2 != nil {
+				logrus.Warn("Error cleaning up temporary file after failed buffer: ", err2)
+			}
+		}
 		return "", 0, nil, err
 	}
 	if err = contents.Close(); err != nil {
@@ -75,7 +81,7 @@ func BufferTemp(datastore config.DatastoreConfig, contents io.ReadCloser) (strin
 		}
 		return hash(), sizeBytes, readers.NewTempFileCloser(fpath, f.Name(), f), nil
 	} else if b, ok := target.(*bytes.Buffer); ok {
-		return hash(), sizeBytes, io.NopCloser(b), nil
+		return hash(), sizeBytes, readers.NopSeekCloser(bytes.NewReader(b.Bytes())), nil
 	} else {
 		return "", 0, nil, errors.New("developer error - did not account for possible stream writer type")
 	}
@@ -0,0 +1,514 @@
+package datastores
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ryanuber/go-glob"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// CompressionGzip is the only compression method currently supported for the `compression` datastore option.
+const CompressionGzip = "gzip"
+
+// gzipSuffix is added to the location of objects which are stored gzipped. The location is kept on the media
+// record, so the suffix is what records how the object was stored, and is checked when the object is read.
+const gzipSuffix = ".gz"
+
+// Gzipped objects are stored as a series of gzip members (which is still a valid gzip file), each holding a block of
+// the original media. Every block but the last is the same size, and each member's header records the member's
+// size in an extra field, much like BGZF. Reading from part way through the media, like for range requests, only
+// needs to walk the headers to the block and decompress from there, rather than decompress everything before it.
+// Smaller blocks make seeking cheaper, but compress a little worse as each block is compressed on its own.
+const defaultCompressionBlockSize = 1024 * 1024 // 1mb
+
+// gzipBlockSubfield identifies the extra field which records the size of the member, followed by the block size.
+var gzipBlockSubfield = []byte{'M', 'B'}
+
+const gzipBlockExtraSize = 4 + 8 + 8 // subfield ID and length, member size, block size
+const gzipFixedHeaderSize = 10
+
+// After the blocks, an index member records where the members start, and a locator member at the very end of the
+// object records where the index is. Both are empty, so don't change what the object decompresses to. With the
+// index, seeking reads the index once rather than the header of every member before the block. The offsets are
+// kept in the index's extra field, which is limited in size, so media with more blocks than fit has the offset of
+// every few members recorded instead (the stride), and the headers of the members between are walked.
+var gzipIndexSubfield = []byte{'M', 'I'}
+var gzipLocatorSubfield = []byte{'M', 'L'}
+
+const gzipIndexExtraSize = 4 + 8 + 8 // subfield ID and length, stride, block count, then the offsets
+const gzipMaxIndexOffsets = (0xFFFF - gzipIndexExtraSize) / 8
+const gzipLocatorExtraSize = 4 + 8 // subfield ID and length, index offset
+const gzipLocatorSize = gzipFixedHeaderSize + 2 + gzipLocatorExtraSize + 2 + 8
+
+// defaultCompressTypes are the content types compressed when the datastore doesn't set `compressTypes`.
+var defaultCompressTypes = []string{"text/*", "application/json", "application/xml", "image/svg+xml"}
+
+// alreadyCompressedTypes gain little (or get bigger) from being compressed again, so are never compressed.
+var alreadyCompressedTypes = []string{
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+	"application/pdf",
+}
+
+// Compression returns the compression method of the object at the location, or an empty string if it isn't
+// compressed.
+func Compression(dsFileName string) string {
+	if strings.HasSuffix(withoutEncryption(dsFileName), gzipSuffix) {
+		return CompressionGzip
+	}
+	return ""
+}
+
+// compressionFor returns the compression method to store media of the content type with, or an empty string if
+// it shouldn't be compressed. Only file and S3 datastores support compression.
+func compressionFor(ds config.DatastoreConfig, contentType string) (string, error) {
+	method := ds.Options["compression"]
+	if method == "" || (ds.Type != "file" && ds.Type != "s3") {
+		return "", nil
+	}
+	if method != CompressionGzip {
+		return "", errors.New("unknown compression for datastore " + ds.Id + ": " + method)
+	}
+
+	contentType = strings.ToLower(util.FixContentType(contentType))
+	if isAlreadyCompressed(contentType) {
+		return "", nil
+	}
+	patterns := defaultCompressTypes
+	if val := ds.Options["compressTypes"]; val != "" {
+		patterns = strings.Split(val, ",")
+	}
+	for _, pattern := range patterns {
+		if glob.Glob(strings.ToLower(strings.TrimSpace(pattern)), contentType) {
+			return method, nil
+		}
+	}
+	return "", nil
+}
+
+// compressionBlockSize returns the size of the blocks media is compressed in, which is set with the
+// `compressionBlockSize` option.
+func compressionBlockSize(ds config.DatastoreConfig) (int64, error) {
+	val := ds.Options["compressionBlockSize"]
+	if val == "" {
+		return defaultCompressionBlockSize, nil
+	}
+	size, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, errors.New("invalid compressionBlockSize for datastore " + ds.Id + ": " + val)
+	}
+	return size, nil
+}
+
+func isAlreadyCompressed(contentType string) bool {
+	if contentType == "image/svg+xml" {
+		return false
+	}
+	if strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "video/") || strings.HasPrefix(contentType, "audio/") {
+		return true
+	}
+	return util.ArrayContains(alreadyCompressedTypes, contentType)
+}
+
+// gzipStream compresses data as it is read, one block at a time.
+func gzipStream(data io.Reader, blockSize int64) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		extra := make([]byte, gzipBlockExtraSize)
+		copy(extra, gzipBlockSubfield)
+		binary.LittleEndian.PutUint16(extra[2:], gzipBlockExtraSize-4)
+		binary.LittleEndian.PutUint64(extra[12:], uint64(blockSize))
+
+		buf := make([]byte, blockSize)
+		member := &bytes.Buffer{}
+		zw := gzip.NewWriter(member)
+		offsets := make([]int64, 0)
+		written := int64(0)
+		finish := func() {
+			index, err := gzipIndex(offsets, written)
+			if err == nil {
+				_, err = pw.Write(index)
+			}
+			_ = pw.CloseWithError(err)
+		}
+		for first := true; ; first = false {
+			n, err := io.ReadFull(data, buf)
+			final := err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !final {
+				_ = pw.CloseWithError(err)
+				return
+			}
+			if n == 0 && !first {
+				finish()
+				return
+			}
+
+			// The member's size is only known once it is compressed, so is filled in afterwards
+			member.Reset()
+			zw.Reset(member)
+			zw.Extra = extra
+			if _, err = zw.Write(buf[:n]); err == nil {
+				err = zw.Close()
+			}
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+			b := member.Bytes()
+			binary.LittleEndian.PutUint64(b[gzipFixedHeaderSize+2+4:], uint64(len(b)))
+			if _, err = pw.Write(b); err != nil {
+				return
+			}
+			offsets = append(offsets, written)
+			written += int64(len(b))
+			if final {
+				finish()
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// gzipIndex returns the index and locator members for an object whose block members start at the offsets, with
+// the last ending at end.
+func gzipIndex(offsets []int64, end int64) ([]byte, error) {
+	stride := max(1, (len(offsets)+gzipMaxIndexOffsets-1)/gzipMaxIndexOffsets)
+	count := (len(offsets) + stride - 1) / stride
+	index := make([]byte, gzipIndexExtraSize+8*count)
+	copy(index, gzipIndexSubfield)
+	binary.LittleEndian.PutUint16(index[2:], uint16(len(index)-4))
+	binary.LittleEndian.PutUint64(index[4:], uint64(stride))
+	binary.LittleEndian.PutUint64(index[12:], uint64(len(offsets)))
+	for i := 0; i < count; i++ {
+		binary.LittleEndian.PutUint64(index[gzipIndexExtraSize+8*i:], uint64(offsets[i*stride]))
+	}
+
+	locator := make([]byte, gzipLocatorExtraSize)
+	copy(locator, gzipLocatorSubfield)
+	binary.LittleEndian.PutUint16(locator[2:], gzipLocatorExtraSize-4)
+	binary.LittleEndian.PutUint64(locator[4:], uint64(end))
+
+	buf := &bytes.Buffer{}
+	for _, extra := range [][]byte{index, locator} {
+		zw := gzip.NewWriter(buf)
+		zw.Extra = extra
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// countingReader counts the bytes read through it, as the size of what is stored doesn't match the original
+// when it is compressed.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// gzipObject decompresses a gzipped object as it is read. Seeking decompresses from the start of the block the new
+// position is in, which is found from the object's index. Objects stored before they were compressed in blocks are
+// one big block, so seeking backwards starts decompressing from the start of the object again, and seeking forwards
+// (or from the end) reads up to the new position.
+type gzipObject struct {
+	src io.ReadSeekCloser
+	zr  *gzip.Reader
+	pos int64
+
+	blockSize    int64           // or 0 if the object isn't compressed in blocks
+	offsets      map[int64]int64 // of the members found so far, by block
+	blocks       int64           // or -1 if not known yet
+	end          int64           // of the last block's member, if the number of blocks is known
+	indexChecked bool
+}
+
+func newGzipObject(src io.ReadSeekCloser) (*gzipObject, error) {
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		_ = src.Close()
+		return nil, err
+	}
+	o := &gzipObject{src: src, zr: zr}
+	if _, blockSize, ok := parseGzipBlockExtra(zr.Extra); ok && blockSize > 0 {
+		o.blockSize = blockSize
+		o.offsets = map[int64]int64{0: 0}
+		o.blocks = -1
+	}
+	return o, nil
+}
+
+func parseGzipBlockExtra(extra []byte) (int64, int64, bool) {
+	if len(extra) != gzipBlockExtraSize || !bytes.Equal(extra[:2], gzipBlockSubfield) {
+		return 0, 0, false
+	}
+	return int64(binary.LittleEndian.Uint64(extra[4:])), int64(binary.LittleEndian.Uint64(extra[12:])), true
+}
+
+// loadIndex reads the member offsets from the object's index. Objects stored before they had an index are left to
+// have their headers walked.
+func (o *gzipObject) loadIndex() error {
+	o.indexChecked = true
+	end, err := o.src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if end < gzipLocatorSize {
+		return nil
+	}
+	if _, err = o.src.Seek(end-gzipLocatorSize, io.SeekStart); err != nil {
+		return err
+	}
+	locator := make([]byte, gzipLocatorSize)
+	if _, err = io.ReadFull(o.src, locator); err != nil {
+		return err
+	}
+	extra, ok := readEmptyGzipMember(bytes.NewReader(locator), gzipLocatorSubfield)
+	if !ok || len(extra) != gzipLocatorExtraSize {
+		return nil // no index
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(extra[4:]))
+	if indexOffset <= 0 || indexOffset >= end {
+		return errors.New("gzip: invalid index location")
+	}
+
+	if _, err = o.src.Seek(indexOffset, io.SeekStart); err != nil {
+		return err
+	}
+	extra, ok = readEmptyGzipMember(io.LimitReader(o.src, end-gzipLocatorSize-indexOffset), gzipIndexSubfield)
+	if !ok || len(extra) < gzipIndexExtraSize || (len(extra)-gzipIndexExtraSize)%8 != 0 {
+		return errors.New("gzip: invalid index")
+	}
+	stride := int64(binary.LittleEndian.Uint64(extra[4:]))
+	blocks := int64(binary.LittleEndian.Uint64(extra[12:]))
+	count := int64(len(extra)-gzipIndexExtraSize) / 8
+	if stride <= 0 || blocks <= 0 || count != (blocks+stride-1)/stride {
+		return errors.New("gzip: invalid index")
+	}
+	for i := int64(0); i < count; i++ {
+		o.offsets[i*stride] = int64(binary.LittleEndian.Uint64(extra[gzipIndexExtraSize+8*i:]))
+	}
+	o.blocks = blocks
+	o.end = indexOffset
+	return nil
+}
+
+// readEmptyGzipMember returns the extra field of the gzip member, if it is an empty member with the subfield.
+func readEmptyGzipMember(r io.Reader, subfield []byte) ([]byte, bool) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, false
+	}
+	zr.Multistream(false)
+	if n, err := io.Copy(io.Discard, zr); err != nil || n != 0 {
+		return nil, false
+	}
+	if len(zr.Extra) < 4 || !bytes.Equal(zr.Extra[:2], subfield) {
+		return nil, false
+	}
+	return zr.Extra, true
+}
+
+// memberOffset returns the offset of the member holding the block, from the index if the object has one, reading
+// the headers of the members before it as needed. It returns -1 if the object has fewer blocks.
+func (o *gzipObject) memberOffset(block int64) (int64, error) {
+	if !o.indexChecked {
+		if err := o.loadIndex(); err != nil {
+			return 0, err
+		}
+	}
+	if o.blocks >= 0 && block >= o.blocks {
+		return -1, nil
+	}
+	if offset, ok := o.offsets[block]; ok {
+		return offset, nil
+	}
+
+	// Walk the headers from the closest member before the block which has been found
+	known := block - 1
+	for ; known > 0; known-- {
+		if _, ok := o.offsets[known]; ok {
+			break
+		}
+	}
+	header := make([]byte, gzipFixedHeaderSize+2+gzipBlockExtraSize)
+	for b := known; b < block; b++ {
+		offset := o.offsets[b]
+		if _, err := o.src.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(o.src, header); err != nil {
+			return 0, err
+		}
+		size, _, ok := parseGzipBlockExtra(header[gzipFixedHeaderSize+2:])
+		if !ok || size <= 0 {
+			return 0, errors.New("gzip: invalid block header")
+		}
+		if o.blocks < 0 {
+			// Without an index, the last member is followed by nothing
+			if _, err := o.src.Seek(offset+size, io.SeekStart); err != nil {
+				return 0, err
+			}
+			if n, err := o.src.Read(header[:1]); n == 0 {
+				if err == io.EOF {
+					o.blocks = b + 1
+					o.end = offset + size
+					return -1, nil
+				}
+				return 0, err
+			}
+		}
+		o.offsets[b+1] = offset + size
+	}
+	return o.offsets[block], nil
+}
+
+// size returns the size of the original media, from the size recorded at the end of the last block's member.
+func (o *gzipObject) size() (int64, error) {
+	for o.blocks < 0 {
+		// Without an index, the found offsets run from the first block
+		if _, err := o.memberOffset(int64(len(o.offsets))); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := o.src.Seek(o.end-4, io.SeekStart); err != nil {
+		return 0, err
+	}
+	trailer := make([]byte, 4)
+	if _, err := io.ReadFull(o.src, trailer); err != nil {
+		return 0, err
+	}
+	return (o.blocks-1)*o.blockSize + int64(binary.LittleEndian.Uint32(trailer)), nil
+}
+
+// seekBlock starts decompressing from the start of the block holding the position.
+func (o *gzipObject) seekBlock(target int64) error {
+	block := target / o.blockSize
+	offset, err := o.memberOffset(block)
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		// Past the end, so there's nothing to read
+		o.pos = target
+		o.zr = nil
+		return nil
+	}
+	if _, err = o.src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if o.zr == nil {
+		o.zr, err = gzip.NewReader(o.src)
+	} else {
+		err = o.zr.Reset(o.src)
+	}
+	if err != nil {
+		return err
+	}
+	o.pos = block * o.blockSize
+	return nil
+}
+
+func (o *gzipObject) Read(p []byte) (int, error) {
+	if o.zr == nil {
+		return 0, io.EOF
+	}
+	n, err := o.zr.Read(p)
+	o.pos += int64(n)
+	return n, err
+}
+
+func (o *gzipObject) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	moved := false // whether the source was read from somewhere other than where decompression is up to
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = o.pos + offset
+	case io.SeekEnd:
+		if o.blockSize > 0 {
+			size, err := o.size()
+			if err != nil {
+				return o.pos, err
+			}
+			target = size + offset
+			moved = true
+			break
+		}
+		// The uncompressed size isn't stored anywhere, so find it the slow way
+		if _, err := io.Copy(io.Discard, o); err != nil {
+			return o.pos, err
+		}
+		target = o.pos + offset
+	default:
+		return o.pos, errors.New("gzip: invalid whence")
+	}
+	if target < 0 {
+		if moved {
+			// Carry on decompressing from where we were
+			pos := o.pos
+			if err := o.seekBlock(pos); err != nil {
+				return o.pos, err
+			}
+			if err := o.discardTo(pos); err != nil {
+				return o.pos, err
+			}
+		}
+		return o.pos, errors.New("gzip: negative position")
+	}
+
+	if o.blockSize > 0 && (moved || target < o.pos || target/o.blockSize != o.pos/o.blockSize || o.zr == nil) {
+		if err := o.seekBlock(target); err != nil {
+			return o.pos, err
+		}
+	} else if target < o.pos {
+		if _, err := o.src.Seek(0, io.SeekStart); err != nil {
+			return o.pos, err
+		}
+		if err := o.zr.Reset(o.src); err != nil {
+			return o.pos, err
+		}
+		o.pos = 0
+	}
+	if err := o.discardTo(target); err != nil {
+		return o.pos, err
+	}
+	return target, nil
+}
+
+// discardTo decompresses up to the position, which can be past the end of the object.
+func (o *gzipObject) discardTo(target int64) error {
+	if _, err := io.CopyN(io.Discard, o, target-o.pos); err != nil && err != io.EOF {
+		return err
+	}
+	o.pos = target
+	return nil
+}
+
+func (o *gzipObject) Close() error {
+	if o.zr != nil {
+		_ = o.zr.Close()
+	}
+	return o.src.Close()
+}
@@ -29,6 +29,13 @@ func Remove(ctx rcontext.RequestContext, ds config.DatastoreConfig, location str
 		if err != nil && os.IsNotExist(err) {
 			return nil // not existing means it was deleted, as far as we care
 		}
+	} else if ds.Type == "proxy" {
+		var p *proxy
+		p, err = getProxy(ds)
+		if err != nil {
+			return err
+		}
+		err = p.remove(ctx, location)
 	} else {
 		return errors.New("unknown datastore type - contact developer")
 	}
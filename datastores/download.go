@@ -30,15 +30,30 @@ func Download(ctx rcontext.RequestContext, ds config.DatastoreConfig, dsFileName
 		basePath := ds.Options["path"]
 
 		rsc, err = os.Open(path.Join(basePath, dsFileName))
+	} else if ds.Type == "proxy" {
+		var p *proxy
+		p, err = getProxy(ds)
+		if err != nil {
+			return nil, err
+		}
+
+		rsc, err = p.download(ctx, dsFileName)
 	} else {
 		return nil, errors.New("unknown datastore type - contact developer")
 	}
+	if err == nil && EncryptionKeyId(dsFileName) != "" {
+		rsc, err = newEncryptedObject(rsc, ds, dsFileName)
+	}
+	if err == nil && Compression(dsFileName) == CompressionGzip {
+		return newGzipObject(rsc)
+	}
 
 	return rsc, err
 }
 
 func DownloadOrRedirect(ctx rcontext.RequestContext, ds config.DatastoreConfig, dsFileName string) (io.ReadSeekCloser, error) {
-	if ds.Type != "s3" {
+	if ds.Type != "s3" || !isStoredAsIs(dsFileName) {
+		// Compressed and encrypted objects need decoding before they're served
 		return Download(ctx, ds, dsFileName)
 	}
 
@@ -0,0 +1,290 @@
+package datastores
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+// encryptedSuffix, followed by the ID of the key, is added to the location of objects which are stored encrypted.
+// Like gzipSuffix, the location is what records how the object was stored, so keys can be rotated by changing
+// `encryptionKeyId` while older objects are still read with the key they were written with.
+const encryptedSuffix = ".enc-"
+
+// encryptionVersion is the first byte of every encrypted object, followed by the object's random base nonce.
+const encryptionVersion = 1
+
+// Objects are encrypted in chunks with AES-256-GCM, so they can be read (and seeked) without holding the whole
+// object in memory. Each chunk's nonce is the base nonce mixed with the chunk's index, and the final chunk is
+// marked in its additional data so an object can't be truncated at a chunk boundary unnoticed. The final chunk is
+// always shorter than encryptionChunkSize, even if that means it is empty.
+const encryptionChunkSize = 64 * 1024
+const encryptionHeaderSize = 1 + 12 // version, nonce
+const encryptionTagSize = 16
+
+var encryptionKeyIdRegex = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// EncryptionKeyId returns the ID of the key the object at the location is encrypted with, or an empty string if it
+// isn't encrypted.
+func EncryptionKeyId(dsFileName string) string {
+	i := strings.LastIndex(dsFileName, encryptedSuffix)
+	if i < 0 {
+		return ""
+	}
+	keyId := dsFileName[i+len(encryptedSuffix):]
+	if !encryptionKeyIdRegex.MatchString(keyId) {
+		return ""
+	}
+	return keyId
+}
+
+// withoutEncryption returns the location of the object as it would be if it weren't encrypted.
+func withoutEncryption(dsFileName string) string {
+	if keyId := EncryptionKeyId(dsFileName); keyId != "" {
+		return strings.TrimSuffix(dsFileName, encryptedSuffix+keyId)
+	}
+	return dsFileName
+}
+
+// isStoredAsIs returns whether the object is the original media byte for byte, so the datastore's own size and
+// checksum (and redirects to it) can be used.
+func isStoredAsIs(dsFileName string) bool {
+	return Compression(dsFileName) == "" && EncryptionKeyId(dsFileName) == ""
+}
+
+// encryptionKeys returns the datastore's keys by ID. Keys are set with the `encryptionKeys` option as a list of
+// `id:key` pairs separated by commas, where each key is 32 bytes encoded as base64.
+func encryptionKeys(ds config.DatastoreConfig) (map[string]cipher.AEAD, error) {
+	keys := make(map[string]cipher.AEAD)
+	val := ds.Options["encryptionKeys"]
+	if val == "" {
+		return keys, nil
+	}
+	for _, pair := range strings.Split(val, ",") {
+		keyId, encoded, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || !encryptionKeyIdRegex.MatchString(keyId) {
+			return nil, errors.New("invalid encryption key ID for datastore " + ds.Id + ": IDs must be letters, numbers, and underscores")
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("invalid encryption key " + keyId + " for datastore " + ds.Id + ": must be 32 bytes encoded as base64")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keys[keyId] = aead
+	}
+	return keys, nil
+}
+
+// encryptionFor returns the ID of the key to store new objects with, and the key itself, or an empty ID if new
+// objects shouldn't be encrypted. Only file and S3 datastores support encryption.
+func encryptionFor(ds config.DatastoreConfig) (string, cipher.AEAD, error) {
+	keyId := ds.Options["encryptionKeyId"]
+	if keyId == "" || (ds.Type != "file" && ds.Type != "s3") {
+		return "", nil, nil
+	}
+	keys, err := encryptionKeys(ds)
+	if err != nil {
+		return "", nil, err
+	}
+	key, ok := keys[keyId]
+	if !ok {
+		return "", nil, errors.New("encryption key " + keyId + " for datastore " + ds.Id + " is not in encryptionKeys")
+	}
+	return keyId, key, nil
+}
+
+// encryptedSize is the size of an object storing size bytes once encrypted.
+func encryptedSize(size int64) int64 {
+	return encryptionHeaderSize + size + (size/encryptionChunkSize+1)*encryptionTagSize
+}
+
+func chunkNonce(base []byte, index int64) []byte {
+	nonce := append([]byte{}, base...)
+	binary.BigEndian.PutUint64(nonce[4:], binary.BigEndian.Uint64(nonce[4:])^uint64(index))
+	return nonce
+}
+
+func chunkAdditionalData(header []byte, final bool) []byte {
+	ad := append([]byte{}, header...)
+	if final {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// encryptStream encrypts data as it is read.
+func encryptStream(data io.Reader, key cipher.AEAD) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		header := make([]byte, encryptionHeaderSize)
+		header[0] = encryptionVersion
+		if _, err := rand.Read(header[1:]); err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+		if _, err := pw.Write(header); err != nil {
+			return
+		}
+
+		buf := make([]byte, encryptionChunkSize)
+		sealed := make([]byte, 0, encryptionChunkSize+encryptionTagSize)
+		for index := int64(0); ; index++ {
+			n, err := io.ReadFull(data, buf)
+			final := err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !final {
+				_ = pw.CloseWithError(err)
+				return
+			}
+			sealed = key.Seal(sealed[:0], chunkNonce(header[1:], index), buf[:n], chunkAdditionalData(header, final))
+			if _, err = pw.Write(sealed); err != nil {
+				return
+			}
+			if final {
+				_ = pw.Close()
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// encryptedObject decrypts an encrypted object as it is read, one chunk at a time. Seeking only decrypts the
+// chunk at the new position.
+type encryptedObject struct {
+	src    io.ReadSeekCloser
+	key    cipher.AEAD
+	header []byte
+	size   int64 // of the original media
+	pos    int64
+
+	chunk      []byte
+	chunkIndex int64 // of the decrypted chunk, or -1 if there isn't one
+	sealed     []byte
+}
+
+func newEncryptedObject(src io.ReadSeekCloser, ds config.DatastoreConfig, dsFileName string) (*encryptedObject, error) {
+	keys, err := encryptionKeys(ds)
+	if err != nil {
+		_ = src.Close()
+		return nil, err
+	}
+	keyId := EncryptionKeyId(dsFileName)
+	key, ok := keys[keyId]
+	if !ok {
+		_ = src.Close()
+		return nil, errors.New("encryption key " + keyId + " for datastore " + ds.Id + " is not in encryptionKeys")
+	}
+
+	header := make([]byte, encryptionHeaderSize)
+	if _, err = io.ReadFull(src, header); err != nil {
+		_ = src.Close()
+		return nil, err
+	}
+	if header[0] != encryptionVersion {
+		_ = src.Close()
+		return nil, errors.New("encryption: unknown version")
+	}
+
+	// The original size comes from the object's size, as every chunk but the last is full
+	total, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = src.Close()
+		return nil, err
+	}
+	body := total - encryptionHeaderSize
+	fullChunks := body / (encryptionChunkSize + encryptionTagSize)
+	remaining := body - fullChunks*(encryptionChunkSize+encryptionTagSize)
+	if remaining < encryptionTagSize {
+		_ = src.Close()
+		return nil, errors.New("encryption: object is truncated")
+	}
+
+	return &encryptedObject{
+		src:        src,
+		key:        key,
+		header:     header,
+		size:       fullChunks*encryptionChunkSize + remaining - encryptionTagSize,
+		chunkIndex: -1,
+		sealed:     make([]byte, encryptionChunkSize+encryptionTagSize),
+	}, nil
+}
+
+func (o *encryptedObject) loadChunk(index int64) error {
+	if index == o.chunkIndex {
+		return nil
+	}
+	final := index == o.size/encryptionChunkSize
+	length := int64(encryptionChunkSize)
+	if final {
+		length = o.size - index*encryptionChunkSize
+	}
+	if _, err := o.src.Seek(encryptionHeaderSize+index*(encryptionChunkSize+encryptionTagSize), io.SeekStart); err != nil {
+		return err
+	}
+	sealed := o.sealed[:length+encryptionTagSize]
+	if _, err := io.ReadFull(o.src, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	chunk, err := o.key.Open(o.chunk[:0], chunkNonce(o.header[1:], index), sealed, chunkAdditionalData(o.header, final))
+	if err != nil {
+		o.chunkIndex = -1
+		return errors.New("encryption: unable to decrypt object: " + err.Error())
+	}
+	o.chunk = chunk
+	o.chunkIndex = index
+	return nil
+}
+
+func (o *encryptedObject) Read(p []byte) (int, error) {
+	if o.pos >= o.size {
+		return 0, io.EOF
+	}
+	index := o.pos / encryptionChunkSize
+	if err := o.loadChunk(index); err != nil {
+		return 0, err
+	}
+	n := copy(p, o.chunk[o.pos-index*encryptionChunkSize:])
+	o.pos += int64(n)
+	return n, nil
+}
+
+func (o *encryptedObject) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = o.pos + offset
+	case io.SeekEnd:
+		target = o.size + offset
+	default:
+		return o.pos, errors.New("encryption: invalid whence")
+	}
+	if target < 0 {
+		return o.pos, errors.New("encryption: negative position")
+	}
+	o.pos = target
+	return target, nil
+}
+
+func (o *encryptedObject) Close() error {
+	return o.src.Close()
+}
@@ -0,0 +1,60 @@
+package datastores
+
+import (
+	"errors"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+const (
+	// FileLayoutId buckets files by the first characters of their (unique) object name. This is the default.
+	FileLayoutId = "id"
+	// FileLayoutHash buckets files by the first characters of their SHA-256 hash.
+	FileLayoutHash = "hash"
+	// FileLayoutDate buckets files by the date they were uploaded, as year/month/day.
+	FileLayoutDate = "date"
+)
+
+const defaultFileLayoutDepth = 2
+const maxFileLayoutDepth = 4
+
+// fileLocation returns where a new file should be stored in a file datastore, relative to the datastore's path.
+// Existing files keep the location they were stored with, so changing the layout only affects new uploads.
+func fileLocation(ds config.DatastoreConfig, objectName string, sha256hash string, now time.Time) (string, error) {
+	depth := defaultFileLayoutDepth
+	if val := ds.Options["pathDepth"]; val != "" {
+		var err error
+		depth, err = strconv.Atoi(val)
+		if err != nil || depth < 0 || depth > maxFileLayoutDepth {
+			return "", errors.New("pathDepth must be a number between 0 and " + strconv.Itoa(maxFileLayoutDepth))
+		}
+	}
+
+	switch ds.Options["pathLayout"] {
+	case "", FileLayoutId:
+		// The object name's prefix becomes the directories, which keeps the paths of existing datastores the same
+		dirs := prefixDirs(objectName, depth)
+		return path.Join(append(dirs, objectName[depth*2:])...), nil
+	case FileLayoutHash:
+		if len(sha256hash) < depth*2 {
+			return "", errors.New("hash too short for pathDepth")
+		}
+		return path.Join(append(prefixDirs(sha256hash, depth), objectName)...), nil
+	case FileLayoutDate:
+		return path.Join(now.UTC().Format("2006/01/02"), objectName), nil
+	default:
+		return "", errors.New("unknown pathLayout for datastore " + ds.Id)
+	}
+}
+
+// prefixDirs splits the first depth pairs of characters off s, for use as directory names.
+func prefixDirs(s string, depth int) []string {
+	dirs := make([]string, 0, depth)
+	for i := 0; i < depth; i++ {
+		dirs = append(dirs, s[i*2:i*2+2])
+	}
+	return dirs
+}
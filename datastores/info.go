@@ -3,12 +3,19 @@ package datastores
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path"
 
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/metrics"
 )
 
+var ErrNotExist = errors.New("object does not exist in the datastore")
+
 type SizeEstimate struct {
 	ThumbnailsAffected      int64 `json:"thumbnails_affected"`
 	ThumbnailHashesAffected int64 `json:"thumbnail_hashes_affected"`
@@ -31,11 +38,60 @@ func GetUri(ds config.DatastoreConfig) (string, error) {
 		return fmt.Sprintf("s3://%s/%s", s3c.client.EndpointURL().Hostname(), s3c.bucket), nil
 	} else if ds.Type == "file" {
 		return ds.Options["path"], nil
+	} else if ds.Type == "proxy" {
+		p, err := getProxy(ds)
+		if err != nil {
+			return "", err
+		}
+		return p.baseUrl, nil
 	} else {
 		return "", errors.New("unknown datastore type - contact developer")
 	}
 }
 
+// StoredSize returns the size of the object in the datastore, which may differ from the size recorded for the
+// media if the object was changed or truncated, or is compressed or encrypted (see Compression and
+// EncryptionKeyId). Returns ErrNotExist if the object is missing.
+func StoredSize(ctx rcontext.RequestContext, ds config.DatastoreConfig, dsFileName string) (int64, error) {
+	if ds.Type == "s3" {
+		s3c, err := getS3(ds)
+		if err != nil {
+			return 0, err
+		}
+
+		metrics.S3Operations.With(prometheus.Labels{"operation": "StatObject"}).Inc()
+		info, err := s3c.client.StatObject(ctx.Context, s3c.bucket, dsFileName, minio.StatObjectOptions{})
+		if err != nil {
+			if isNotExist(err) {
+				return 0, ErrNotExist
+			}
+			return 0, err
+		}
+		return info.Size, nil
+	} else if ds.Type == "file" {
+		info, err := os.Stat(path.Join(ds.Options["path"], dsFileName))
+		if err != nil {
+			if isNotExist(err) {
+				return 0, ErrNotExist
+			}
+			return 0, err
+		}
+		return info.Size(), nil
+	} else if ds.Type == "proxy" {
+		p, err := getProxy(ds)
+		if err != nil {
+			return 0, err
+		}
+		info, err := p.info(ctx, dsFileName)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size, nil
+	} else {
+		return 0, errors.New("unknown datastore type - contact developer")
+	}
+}
+
 func SizeOfDsIdWithAge(ctx rcontext.RequestContext, dsId string, beforeTs int64) (*SizeEstimate, error) {
 	db := database.GetInstance().MetadataView.Prepare(ctx)
 	media, err := db.GetMediaForDatastoreByLastAccess(dsId, beforeTs)
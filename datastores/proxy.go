@@ -0,0 +1,276 @@
+package datastores
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/metrics"
+)
+
+// proxyClient is shared by the proxy datastores, so connections to upstreams are reused. There's no overall timeout,
+// as large media can take a long time to transfer, but an upstream which can't be reached or doesn't respond is
+// given up on.
+var proxyClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second, // after the request is sent, so uploads aren't cut short
+		ExpectContinueTimeout: 1 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   10,
+	},
+}
+
+// proxy is a datastore which keeps everything on another media repo, using its client-server API. Objects are
+// named after the media ID the upstream gave them, as "server/mediaId".
+type proxy struct {
+	baseUrl     string
+	accessToken string
+}
+
+type proxyUploadResponse struct {
+	ContentUri string `json:"content_uri"`
+}
+
+type proxyInfoResponse struct {
+	Size   int64 `json:"size"`
+	Hashes struct {
+		Sha256 string `json:"sha256"`
+	} `json:"hashes"`
+}
+
+func getProxy(ds config.DatastoreConfig) (*proxy, error) {
+	baseUrl := strings.TrimSuffix(ds.Options["upstream"], "/")
+	if baseUrl == "" {
+		return nil, errors.New("upstream is required for proxy datastore " + ds.Id)
+	}
+	if _, err := url.Parse(baseUrl); err != nil {
+		return nil, fmt.Errorf("invalid upstream for proxy datastore %s: %w", ds.Id, err)
+	}
+	return &proxy{
+		baseUrl:     baseUrl,
+		accessToken: ds.Options["accessToken"],
+	}, nil
+}
+
+func (p *proxy) do(ctx rcontext.RequestContext, operation string, method string, endpoint string, body io.Reader, headers http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx.Context, method, p.baseUrl+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	if l := headers.Get("Content-Length"); l != "" {
+		req.ContentLength, _ = strconv.ParseInt(l, 10, 64)
+	}
+	if p.accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.accessToken)
+	}
+
+	metrics.ProxyOperations.With(prometheus.Labels{"operation": operation}).Inc()
+	return proxyClient.Do(req)
+}
+
+// mediaPath returns the upstream's path for the object, relative to an endpoint.
+func (p *proxy) mediaPath(location string) (string, error) {
+	server, mediaId, ok := strings.Cut(location, "/")
+	if !ok || server == "" || mediaId == "" {
+		return "", errors.New("invalid proxy datastore location: " + location)
+	}
+	return url.PathEscape(server) + "/" + url.PathEscape(mediaId), nil
+}
+
+func (p *proxy) upload(ctx rcontext.RequestContext, data io.Reader, size int64, contentType string) (string, error) {
+	resp, err := p.do(ctx, "upload", http.MethodPost, "/_matrix/media/v3/upload", data, http.Header{
+		"Content-Type":   []string{contentType},
+		"Content-Length": []string{strconv.FormatInt(size, 10)},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upstream returned status %d for upload", resp.StatusCode)
+	}
+
+	uploaded := &proxyUploadResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(uploaded); err != nil {
+		return "", err
+	}
+	location, ok := strings.CutPrefix(uploaded.ContentUri, "mxc://")
+	if !ok {
+		return "", errors.New("upstream returned an invalid content URI: " + uploaded.ContentUri)
+	}
+	if _, err = p.mediaPath(location); err != nil {
+		return "", err
+	}
+	return location, nil
+}
+
+// info returns what the upstream knows about the object, or ErrNotExist.
+func (p *proxy) info(ctx rcontext.RequestContext, location string) (*proxyInfoResponse, error) {
+	mediaPath, err := p.mediaPath(location)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.do(ctx, "info", http.MethodGet, "/_matrix/media/unstable/info/"+mediaPath+"?allow_remote=false", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned status %d for info", resp.StatusCode)
+	}
+
+	info := &proxyInfoResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (p *proxy) remove(ctx rcontext.RequestContext, location string) error {
+	mediaPath, err := p.mediaPath(location)
+	if err != nil {
+		return err
+	}
+	resp, err := p.do(ctx, "remove", http.MethodDelete, "/_matrix/media/unstable/download/"+mediaPath, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil // not existing means it was deleted, as far as we care
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream returned status %d for remove", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *proxy) download(ctx rcontext.RequestContext, location string) (io.ReadSeekCloser, error) {
+	mediaPath, err := p.mediaPath(location)
+	if err != nil {
+		return nil, err
+	}
+	obj := &proxyObject{
+		ctx:      ctx,
+		p:        p,
+		endpoint: "/_matrix/media/v3/download/" + mediaPath + "?allow_remote=false",
+	}
+	// Start reading straight away, so missing objects are reported here rather than on the first read
+	if err = obj.open(); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// proxyObject reads an object from the upstream. Seeking closes the current response, and the next read resumes
+// from the new offset with a Range request.
+type proxyObject struct {
+	ctx      rcontext.RequestContext
+	p        *proxy
+	endpoint string
+	size     int64
+	offset   int64
+	body     io.ReadCloser
+}
+
+func (o *proxyObject) open() error {
+	var headers http.Header
+	if o.offset > 0 {
+		headers = http.Header{"Range": []string{fmt.Sprintf("bytes=%d-", o.offset)}}
+	}
+	resp, err := o.p.do(o.ctx, "download", http.MethodGet, o.endpoint, nil, headers)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if o.offset == 0 {
+			o.size = resp.ContentLength
+		} else {
+			// The upstream ignored the range, so skip to where we should be
+			if _, err = io.CopyN(io.Discard, resp.Body, o.offset); err != nil {
+				resp.Body.Close()
+				return err
+			}
+		}
+	case http.StatusPartialContent:
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return ErrNotExist
+	default:
+		resp.Body.Close()
+		return fmt.Errorf("upstream returned status %d for download", resp.StatusCode)
+	}
+	o.body = resp.Body
+	return nil
+}
+
+func (o *proxyObject) Read(b []byte) (int, error) {
+	if o.body == nil {
+		if o.size >= 0 && o.offset >= o.size {
+			return 0, io.EOF
+		}
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := o.body.Read(b)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *proxyObject) Seek(offset int64, whence int) (int64, error) {
+	target := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		target += o.offset
+	case io.SeekEnd:
+		if o.size < 0 {
+			return 0, errors.New("size of object is unknown")
+		}
+		target += o.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if target < 0 {
+		return 0, errors.New("negative position")
+	}
+	if target != o.offset && o.body != nil {
+		_ = o.body.Close()
+		o.body = nil
+	}
+	o.offset = target
+	return target, nil
+}
+
+func (o *proxyObject) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
@@ -0,0 +1,24 @@
+package datastores
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// IsOutOfSpace returns true if err is caused by a datastore, or the temporary storage used while uploading to one,
+// having no space left.
+func IsOutOfSpace(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return true
+	}
+	var s3Err minio.ErrorResponse
+	if errors.As(err, &s3Err) {
+		return s3Err.Code == "XMinioStorageFull"
+	}
+	return false
+}
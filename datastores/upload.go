@@ -8,6 +8,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/prometheus/client_golang/prometheus"
@@ -30,6 +31,46 @@ func Upload(ctx rcontext.RequestContext, ds config.DatastoreConfig, data io.Read
 	// Suffix the ID so file paths are correctly bucketed
 	objectName = fmt.Sprintf("%sidv2fmt", objectName)
 
+	// Compressed and encrypted objects are stored with a suffix to say so. The size and hash are still checked
+	// against the original bytes, so deduplication is unaffected.
+	compression, err := compressionFor(ds, contentType)
+	if err != nil {
+		return "", err
+	}
+	keyId, key, err := encryptionFor(ds)
+	if err != nil {
+		return "", err
+	}
+	var body io.Reader = tee
+	var counter *countingReader
+	uploadSize := size
+	uploadContentType := contentType
+	contentEncoding := ""
+	if compression != "" || key != nil {
+		counter = &countingReader{r: tee}
+		body = counter
+	}
+	if compression == CompressionGzip {
+		var blockSize int64
+		blockSize, err = compressionBlockSize(ds)
+		if err != nil {
+			return "", err
+		}
+		objectName += gzipSuffix
+		compressed := gzipStream(body, blockSize)
+		defer compressed.Close()
+		body, uploadSize, contentEncoding = compressed, -1, "gzip"
+	}
+	if key != nil {
+		objectName += encryptedSuffix + keyId
+		encrypted := encryptStream(body, key)
+		defer encrypted.Close()
+		body, uploadContentType, contentEncoding = encrypted, "application/octet-stream", ""
+		if uploadSize >= 0 {
+			uploadSize = encryptedSize(uploadSize)
+		}
+	}
+
 	var uploadedBytes int64
 	if ds.Type == "s3" {
 		var s3c *s3
@@ -40,23 +81,17 @@ func Upload(ctx rcontext.RequestContext, ds config.DatastoreConfig, data io.Read
 
 		metrics.S3Operations.With(prometheus.Labels{"operation": "PutObject"}).Inc()
 		var info minio.UploadInfo
-		info, err = s3c.client.PutObject(ctx.Context, s3c.bucket, objectName, tee, size, minio.PutObjectOptions{StorageClass: s3c.storageClass, ContentType: contentType})
+		info, err = s3c.client.PutObject(ctx.Context, s3c.bucket, objectName, body, uploadSize, minio.PutObjectOptions{StorageClass: s3c.storageClass, ContentType: uploadContentType, ContentEncoding: contentEncoding})
 		uploadedBytes = info.Size
 	} else if ds.Type == "file" {
 		basePath := ds.Options["path"]
 
-		var firstContainer string
-		var secondContainer string
-		var fileName string
-		var targetDir string
-		var targetFile string
-
-		firstContainer = objectName[0:2]
-		secondContainer = objectName[2:4]
-		fileName = objectName[4:]
-		objectName = path.Join(firstContainer, secondContainer, fileName)
-		targetDir = path.Join(basePath, firstContainer, secondContainer)
-		targetFile = path.Join(targetDir, fileName)
+		objectName, err = fileLocation(ds, objectName, sha256hash, time.Now())
+		if err != nil {
+			return "", err
+		}
+		targetFile := path.Join(basePath, objectName)
+		targetDir := path.Dir(targetFile)
 
 		// Persist file
 		var file *os.File
@@ -67,11 +102,33 @@ func Upload(ctx rcontext.RequestContext, ds config.DatastoreConfig, data io.Read
 		if err != nil {
 			return "", err
 		}
-		uploadedBytes, err = io.Copy(file, tee)
+		uploadedBytes, err = io.Copy(file, body)
 		if err != nil {
 			return "", err
 		}
 		err = file.Close()
+	} else if ds.Type == "proxy" {
+		var p *proxy
+		p, err = getProxy(ds)
+		if err != nil {
+			return "", err
+		}
+
+		objectName, err = p.upload(ctx, tee, size, contentType)
+		if err == nil {
+			// The upstream's view of the object is what matters, as that's what will be served later
+			var info *proxyInfoResponse
+			info, err = p.info(ctx, objectName)
+			if err == nil {
+				uploadedBytes = info.Size
+				if info.Hashes.Sha256 != sha256hash {
+					if err = Remove(ctx, ds, objectName); err != nil {
+						ctx.Log.Warn("Error deleting upload (delete attempted due to persistence error): ", err)
+					}
+					return "", fmt.Errorf("upstream hash mismatch: expected %s got %s", sha256hash, info.Hashes.Sha256)
+				}
+			}
+		}
 	} else {
 		return "", errors.New("unknown datastore type - contact developer")
 	}
@@ -79,6 +136,9 @@ func Upload(ctx rcontext.RequestContext, ds config.DatastoreConfig, data io.Read
 	if err != nil {
 		return "", err
 	}
+	if counter != nil {
+		uploadedBytes = counter.n
+	}
 	if uploadedBytes != size {
 		if err = Remove(ctx, ds, objectName); err != nil {
 			ctx.Log.Warn("Error deleting upload (delete attempted due to persistence error): ", err)
@@ -0,0 +1,125 @@
+package datastores
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/util/ids"
+)
+
+// Parts are buffered in memory while streaming. 16mb parts allow uploads of up to ~160gb (10,000 parts).
+const streamedPartSize = 16 * 1024 * 1024
+
+// streamedTempPrefix is where uploads are kept until their hash is known.
+const streamedTempPrefix = "incoming/"
+
+// StreamedUpload is an upload which was sent to a datastore before its hash was known. It is kept under a
+// temporary name until it is either finalized or abandoned.
+type StreamedUpload struct {
+	Sha256Hash  string
+	SizeBytes   int64
+	ds          config.DatastoreConfig
+	tempName    string
+	contentType string
+}
+
+// CanStreamUpload returns whether uploads can be sent directly to the datastore, rather than being buffered to
+// a temporary file first to calculate their hash.
+func CanStreamUpload(ds config.DatastoreConfig) bool {
+	if ds.Type != "s3" || ds.Options["encryptionKeyId"] != "" {
+		// Streamed uploads are stored as they are received, which would leave them unencrypted
+		return false
+	}
+	streamUploads, _ := strconv.ParseBool(ds.Options["streamUploads"])
+	return streamUploads
+}
+
+// UploadStream sends the data to the datastore as a multipart upload, calculating the hash as it goes. The
+// returned upload must be finalized or abandoned by the caller.
+func UploadStream(ctx rcontext.RequestContext, ds config.DatastoreConfig, data io.ReadCloser, contentType string) (*StreamedUpload, error) {
+	defer data.Close()
+	if !CanStreamUpload(ds) {
+		return nil, errors.New("datastore does not support streamed uploads")
+	}
+
+	s3c, err := getS3(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	objectName, err := ids.NewUniqueId()
+	if err != nil {
+		return nil, err
+	}
+	tempName := streamedTempPrefix + objectName
+
+	hasher := sha256.New()
+	tee := io.TeeReader(data, hasher)
+
+	// The size is unknown, so this will always be a multipart upload. If the stream fails part way through, the
+	// multipart upload is aborted and nothing is left behind.
+	metrics.S3Operations.With(prometheus.Labels{"operation": "PutObject"}).Inc()
+	info, err := s3c.client.PutObject(ctx.Context, s3c.bucket, tempName, tee, -1, minio.PutObjectOptions{
+		StorageClass: s3c.storageClass,
+		ContentType:  contentType,
+		PartSize:     streamedPartSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamedUpload{
+		Sha256Hash:  hex.EncodeToString(hasher.Sum(nil)),
+		SizeBytes:   info.Size,
+		ds:          ds,
+		tempName:    tempName,
+		contentType: contentType,
+	}, nil
+}
+
+// Finalize moves the upload to a location derived from its hash, returning that location. Uploads with the
+// same hash are expected to be deduplicated before this point, so the location is not shared with other media.
+func (u *StreamedUpload) Finalize(ctx rcontext.RequestContext) (string, error) {
+	s3c, err := getS3(u.ds)
+	if err != nil {
+		return "", err
+	}
+
+	metrics.S3Operations.With(prometheus.Labels{"operation": "ComposeObject"}).Inc()
+	_, err = s3c.client.ComposeObject(ctx.Context, minio.CopyDestOptions{
+		Bucket:          s3c.bucket,
+		Object:          u.Sha256Hash,
+		ReplaceMetadata: true,
+		UserMetadata: map[string]string{
+			"Content-Type":        u.contentType,
+			"X-Amz-Storage-Class": s3c.storageClass,
+		},
+	}, minio.CopySrcOptions{
+		Bucket: s3c.bucket,
+		Object: u.tempName,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	u.Abandon(ctx) // the temporary copy is no longer needed
+	return u.Sha256Hash, nil
+}
+
+// Abandon deletes the upload, such as when it turns out to be a duplicate. Errors are logged rather than
+// returned as there is nothing the caller can do about them.
+func (u *StreamedUpload) Abandon(ctx rcontext.RequestContext) {
+	if err := Remove(ctx, u.ds, u.tempName); err != nil {
+		ctx.Log.Warnf("Error deleting temporary object %s: %v", u.tempName, err)
+		sentry.CaptureException(err)
+	}
+}
@@ -0,0 +1,102 @@
+package datastores
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+const verifyChunkSize = 1024 * 1024 // 1mb
+
+// Verify reports whether the object still matches sha256hash. When the datastore keeps its own SHA-256 checksum
+// for the object, that is compared. Otherwise, the object is re-hashed in chunks, reading no faster than
+// maxBytesPerSecond (when positive). Objects which no longer exist are reported as not matching.
+func Verify(ctx rcontext.RequestContext, ds config.DatastoreConfig, dsFileName string, sha256hash string, maxBytesPerSecond int64) (bool, error) {
+	stored := ""
+	if isStoredAsIs(dsFileName) {
+		// The datastore's checksum would be of the compressed or encrypted object, not the original
+		var err error
+		stored, err = storedSha256(ctx, ds, dsFileName)
+		if err != nil {
+			if isNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	if stored != "" {
+		return stored == sha256hash, nil
+	}
+
+	f, err := Download(ctx, ds, dsFileName)
+	if err != nil {
+		if isNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err = io.CopyBuffer(hasher, readers.NewRateLimitedReader(f, maxBytesPerSecond), make([]byte, verifyChunkSize)); err != nil {
+		if isNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)) == sha256hash, nil
+}
+
+// storedSha256 returns the hex-encoded SHA-256 checksum the datastore keeps for the object, if any.
+func storedSha256(ctx rcontext.RequestContext, ds config.DatastoreConfig, dsFileName string) (string, error) {
+	if ds.Type == "proxy" {
+		p, err := getProxy(ds)
+		if err != nil {
+			return "", err
+		}
+		info, err := p.info(ctx, dsFileName)
+		if err != nil {
+			return "", err
+		}
+		return info.Hashes.Sha256, nil
+	}
+	if ds.Type != "s3" {
+		return "", nil
+	}
+
+	s3c, err := getS3(ds)
+	if err != nil {
+		return "", err
+	}
+
+	metrics.S3Operations.With(prometheus.Labels{"operation": "StatObject"}).Inc()
+	info, err := s3c.client.StatObject(ctx.Context, s3c.bucket, dsFileName, minio.StatObjectOptions{Checksum: true})
+	if err != nil {
+		return "", err
+	}
+
+	// Multipart uploads have a checksum of checksums (suffixed with the part count), which we can't compare
+	if info.ChecksumSHA256 == "" || strings.Contains(info.ChecksumSHA256, "-") {
+		return "", nil
+	}
+	b, err := base64.StdEncoding.DecodeString(info.ChecksumSHA256)
+	if err != nil {
+		return "", nil
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func isNotExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrNotExist) || minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
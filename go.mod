@@ -60,6 +60,7 @@ require (
 	github.com/testcontainers/testcontainers-go/modules/postgres v0.26.0
 	golang.org/x/sync v0.6.0
 	golang.org/x/term v0.17.0
+	golang.org/x/time v0.5.0
 )
 
 require (
@@ -161,7 +162,6 @@ require (
 	github.com/oklog/run v1.1.0 // indirect
 	github.com/peterbourgon/g2s v0.0.0-20170223122336-d4e7ad98afea // indirect
 	github.com/tebeka/strftime v0.1.3 // indirect
-	golang.org/x/time v0.5.0 // indirect
 	google.golang.org/grpc v1.61.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1
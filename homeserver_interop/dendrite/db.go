@@ -1,8 +1,12 @@
 package dendrite
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"strings"
 
 	_ "github.com/lib/pq" // postgres driver
 	"github.com/t2bot/matrix-media-repo/homeserver_interop"
@@ -22,6 +26,16 @@ type LocalMedia struct {
 	UserId        string
 }
 
+// Sha256Hash converts Dendrite's unpadded URL-safe base64 hash to the hex encoding the media repo uses. Returns
+// an empty string if the hash can't be decoded.
+func (m *LocalMedia) Sha256Hash() string {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(m.Base64Hash, "="))
+	if err != nil || len(b) != sha256.Size {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
 type DenDatabase struct {
 	homeserver_interop.ImportDb[LocalMedia]
 	db         *sql.DB
@@ -0,0 +1,32 @@
+package synapse
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// LocalMediaPath returns where Synapse keeps the file for the media within its media_store_path. Thumbnails are
+// kept separately (under local_thumbnails) and are not needed: they are generated again on demand.
+func LocalMediaPath(mediaStorePath string, media *LocalMedia) (string, error) {
+	if strings.ContainsAny(media.MediaId, "/\\") || strings.Contains(media.MediaId, "..") {
+		return "", errors.New("invalid media ID: " + media.MediaId)
+	}
+
+	if media.UrlCache != "" {
+		// For a URL MediaID 2020-08-17_AABBCCDD:
+		// $mediaStorePath/url_cache/2020-08-17/AABBCCDD
+		dateParts := strings.Split(media.MediaId, "_")
+		if len(dateParts) < 2 {
+			return "", errors.New("invalid url cache media ID: " + media.MediaId)
+		}
+		return path.Join(mediaStorePath, "url_cache", dateParts[0], strings.Join(dateParts[1:], "_")), nil
+	}
+
+	// For MediaID AABBCCDD :
+	// $mediaStorePath/local_content/AA/BB/CCDD
+	if len(media.MediaId) <= 4 {
+		return "", errors.New("invalid media ID: " + media.MediaId)
+	}
+	return path.Join(mediaStorePath, "local_content", media.MediaId[0:2], media.MediaId[2:4], media.MediaId[4:]), nil
+}
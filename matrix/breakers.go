@@ -15,7 +15,7 @@ var breakers = &sync.Map{}
 var federationBreakers = &sync.Map{}
 
 func getBreakerAndConfig(serverName string) (*config.DomainRepoConfig, *circuit.Breaker) {
-	hs := config.GetDomain(serverName)
+	hs := util.GetDomainConfig(serverName)
 
 	var cb *circuit.Breaker
 	cbRaw, hasCb := breakers.Load(hs.Name)
@@ -79,17 +79,46 @@ func doRequest(ctx rcontext.RequestContext, method string, urlStr string, body i
 }
 
 func FederatedGet(url string, realHost string, ctx rcontext.RequestContext) (*http.Response, error) {
-	ctx.Log.Debug("Doing federated GET to " + url + " with host " + realHost)
+	return FederatedGetWithHeaders(url, realHost, nil, ctx)
+}
+
+// FederatedGetWithHeaders is the same as FederatedGet, but adds the given headers to the request. When a Range
+// header is supplied, partial (206) and unsatisfiable (416) responses are returned to the caller rather than
+// treated as errors.
+func FederatedGetWithHeaders(url string, realHost string, headers http.Header, ctx rcontext.RequestContext) (*http.Response, error) {
+	isRanged := headers.Get("Range") != ""
+	return federatedRequest("GET", url, realHost, headers, func(statusCode int) bool {
+		return isRanged && (statusCode == http.StatusPartialContent || statusCode == http.StatusRequestedRangeNotSatisfiable)
+	}, ctx)
+}
+
+// FederatedHead is the same as FederatedGet, but makes a HEAD request. Responses from servers which don't support
+// HEAD requests (405 Method Not Allowed or 501 Not Implemented) are returned to the caller rather than treated
+// as errors.
+func FederatedHead(url string, realHost string, ctx rcontext.RequestContext) (*http.Response, error) {
+	return federatedRequest("HEAD", url, realHost, nil, func(statusCode int) bool {
+		return statusCode == http.StatusMethodNotAllowed || statusCode == http.StatusNotImplemented
+	}, ctx)
+}
+
+// federatedRequest makes the request to the server. Responses are errors unless they are 200 OK, 404 Not Found,
+// or accepted by acceptStatus.
+func federatedRequest(method string, url string, realHost string, headers http.Header, acceptStatus func(statusCode int) bool, ctx rcontext.RequestContext) (*http.Response, error) {
+	ctx.Log.Debug("Doing federated " + method + " to " + url + " with host " + realHost)
 
 	cb := getFederationBreaker(realHost)
 
 	var resp *http.Response
 	replyError := cb.CallContext(ctx, func() error {
-		req, err := http.NewRequest("GET", url, nil)
+		req, err := http.NewRequest(method, url, nil)
 		if err != nil {
 			return err
 		}
 
+		for k, v := range headers {
+			req.Header[k] = v
+		}
+
 		// Override the host to be compliant with the spec
 		req.Header.Set("Host", realHost)
 		req.Header.Set("User-Agent", "matrix-media-repo")
@@ -158,6 +187,9 @@ func FederatedGet(url string, realHost string, ctx rcontext.RequestContext) (*ht
 		if err != nil {
 			return err
 		}
+		if acceptStatus(resp.StatusCode) {
+			return nil
+		}
 		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
 			return fmt.Errorf("response not ok: %d", resp.StatusCode)
 		}
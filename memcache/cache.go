@@ -0,0 +1,95 @@
+package memcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/metrics"
+)
+
+// The cache is a least recently used list of media, keyed by hash, which is kept below the configured total size.
+// Entries also expire once they are older than the configured TTL, so media doesn't stay cached forever.
+
+type entry struct {
+	hash    string
+	b       []byte
+	expires time.Time
+}
+
+var lock = &sync.Mutex{}
+var entries = make(map[string]*list.Element)
+var recent = list.New() // most recently used at the front
+var totalBytes int64
+
+// Fits returns true if media of the size would be cached.
+func Fits(size int64) bool {
+	conf := config.Get().Downloads.MemoryCache
+	return conf.Enabled && size >= 0 && size <= conf.MaxMediaSizeBytes && size <= conf.MaxTotalBytes
+}
+
+// Get returns the cached media with the hash, if there is any. The returned bytes must not be modified.
+func Get(hash string) ([]byte, bool) {
+	if !config.Get().Downloads.MemoryCache.Enabled {
+		return nil, false
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	el, ok := entries[hash]
+	if ok && time.Now().After(el.Value.(*entry).expires) {
+		remove(el)
+		ok = false
+	}
+	if !ok {
+		metrics.CacheMisses.With(prometheus.Labels{"cache": "memory"}).Inc()
+		return nil, false
+	}
+	recent.MoveToFront(el)
+	metrics.CacheHits.With(prometheus.Labels{"cache": "memory"}).Inc()
+	return el.Value.(*entry).b, true
+}
+
+// Set caches the media with the hash, if it fits, evicting the least recently used media to make room for it. The
+// bytes must not be modified afterwards.
+func Set(hash string, b []byte) {
+	if !Fits(int64(len(b))) {
+		return
+	}
+	conf := config.Get().Downloads.MemoryCache
+
+	lock.Lock()
+	defer lock.Unlock()
+	if el, ok := entries[hash]; ok {
+		remove(el)
+	}
+	entries[hash] = recent.PushFront(&entry{
+		hash:    hash,
+		b:       b,
+		expires: time.Now().Add(time.Duration(conf.TtlSeconds) * time.Second),
+	})
+	totalBytes += int64(len(b))
+	for totalBytes > conf.MaxTotalBytes {
+		remove(recent.Back())
+	}
+	metrics.MemoryCacheBytes.Set(float64(totalBytes))
+}
+
+// Delete removes the media with the hash from the cache, such as when it is quarantined or deleted.
+func Delete(hash string) {
+	lock.Lock()
+	defer lock.Unlock()
+	if el, ok := entries[hash]; ok {
+		remove(el)
+		metrics.MemoryCacheBytes.Set(float64(totalBytes))
+	}
+}
+
+func remove(el *list.Element) {
+	e := el.Value.(*entry)
+	recent.Remove(el)
+	delete(entries, e.hash)
+	totalBytes -= int64(len(e.b))
+}
@@ -22,6 +22,9 @@ var CacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
 var CacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_cache_misses_total",
 }, []string{"cache"})
+var MemoryCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "media_memory_cache_bytes",
+})
 var ThumbnailsGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_thumbnails_generated_total",
 }, []string{"width", "height", "method", "animated", "origin"})
@@ -34,6 +37,27 @@ var UrlPreviewsGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
 var S3Operations = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_s3_operations_total",
 }, []string{"operation"})
+var ProxyOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_proxy_operations_total",
+}, []string{"operation"})
+var MediaScrubbed = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_scrubbed_total",
+}, []string{"datastore", "result"})
+var ThumbnailsNotStored = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_thumbnails_not_stored_total",
+}, []string{"reason"})
+var MemoryBudgetInFlightBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "media_memory_budget_in_flight_bytes",
+})
+var MemoryBudgetRejections = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "media_memory_budget_rejections_total",
+})
+var DownloadsThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "media_downloads_throttled_total",
+})
+var DownloadThrottleWaitSeconds = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "media_download_throttle_wait_seconds_total",
+})
 var MediaAgeAccessed = prometheus.NewHistogram(prometheus.HistogramOpts{
 	Name: "media_age_accessed_media_seconds",
 	Buckets: []float64{
@@ -52,5 +76,13 @@ func init() {
 	prometheus.MustRegister(MediaDownloaded)
 	prometheus.MustRegister(UrlPreviewsGenerated)
 	prometheus.MustRegister(S3Operations)
+	prometheus.MustRegister(ProxyOperations)
 	prometheus.MustRegister(MediaAgeAccessed)
+	prometheus.MustRegister(MediaScrubbed)
+	prometheus.MustRegister(ThumbnailsNotStored)
+	prometheus.MustRegister(MemoryBudgetInFlightBytes)
+	prometheus.MustRegister(MemoryBudgetRejections)
+	prometheus.MustRegister(DownloadsThrottled)
+	prometheus.MustRegister(DownloadThrottleWaitSeconds)
+	prometheus.MustRegister(MemoryCacheBytes)
 }
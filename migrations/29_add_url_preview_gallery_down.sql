@@ -0,0 +1 @@
+ALTER TABLE url_previews DROP COLUMN gallery;
@@ -0,0 +1 @@
+ALTER TABLE url_previews ADD COLUMN gallery JSON NULL DEFAULT NULL;
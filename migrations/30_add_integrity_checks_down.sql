@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_integrity_checks_corrupt;
+DROP INDEX IF EXISTS idx_integrity_checks;
+DROP TABLE IF EXISTS integrity_checks;
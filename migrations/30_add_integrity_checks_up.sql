@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS integrity_checks (
+	datastore_id TEXT NOT NULL,
+	location TEXT NOT NULL,
+	sha256_hash TEXT NOT NULL,
+	checked_ts BIGINT NOT NULL,
+	corrupt BOOLEAN NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_integrity_checks ON integrity_checks (datastore_id, location);
+CREATE INDEX IF NOT EXISTS idx_integrity_checks_corrupt ON integrity_checks (corrupt);
@@ -0,0 +1 @@
+ALTER TABLE media ADD COLUMN dominant_color TEXT NULL DEFAULT NULL;
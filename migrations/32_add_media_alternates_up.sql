@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS media_alternates (
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	alternate_origin TEXT NOT NULL,
+	alternate_media_id TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_media_alternates ON media_alternates (origin, media_id, reason);
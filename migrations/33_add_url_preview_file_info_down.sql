@@ -0,0 +1,2 @@
+ALTER TABLE url_previews DROP COLUMN IF EXISTS file_size;
+ALTER TABLE url_previews DROP COLUMN IF EXISTS file_type;
@@ -0,0 +1,2 @@
+ALTER TABLE url_previews ADD COLUMN file_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE url_previews ADD COLUMN file_size BIGINT NOT NULL DEFAULT 0;
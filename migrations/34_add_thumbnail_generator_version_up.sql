@@ -0,0 +1 @@
+ALTER TABLE thumbnails ADD COLUMN generator_version INT NOT NULL DEFAULT 0;
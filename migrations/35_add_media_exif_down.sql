@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_media_exif;
+DROP TABLE IF EXISTS media_exif;
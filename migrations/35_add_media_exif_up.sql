@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS media_exif (
+	sha256_hash TEXT NOT NULL,
+	camera_make TEXT NOT NULL,
+	camera_model TEXT NOT NULL,
+	lens_model TEXT NOT NULL,
+	focal_length DOUBLE PRECISION NOT NULL,
+	exposure_time TEXT NOT NULL,
+	f_number DOUBLE PRECISION NOT NULL,
+	iso INT NOT NULL,
+	date_taken TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_media_exif ON media_exif (sha256_hash);
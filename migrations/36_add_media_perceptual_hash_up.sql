@@ -0,0 +1 @@
+ALTER TABLE media ADD COLUMN perceptual_hash BIGINT NULL DEFAULT NULL;
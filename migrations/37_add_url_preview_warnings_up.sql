@@ -0,0 +1 @@
+ALTER TABLE url_previews ADD COLUMN warnings TEXT[] NULL DEFAULT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE thumbnails DROP COLUMN IF EXISTS output_height;
+ALTER TABLE thumbnails DROP COLUMN IF EXISTS output_width;
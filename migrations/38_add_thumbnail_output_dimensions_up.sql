@@ -0,0 +1,2 @@
+ALTER TABLE thumbnails ADD COLUMN output_width INT NOT NULL DEFAULT 0;
+ALTER TABLE thumbnails ADD COLUMN output_height INT NOT NULL DEFAULT 0;
@@ -0,0 +1,175 @@
+package notifier
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type UploadStage string
+
+const (
+	UploadStageReceiving  UploadStage = "receiving"
+	UploadStageProcessing UploadStage = "processing"
+	UploadStageStoring    UploadStage = "storing"
+	UploadStageDone       UploadStage = "done"
+	UploadStageFailed     UploadStage = "failed"
+)
+
+type UploadProgress struct {
+	Stage         UploadStage `json:"stage"`
+	BytesReceived int64       `json:"bytes_received"`
+}
+
+// ErrTooManyProgressSubscribers is returned when an upload already has as many progress watchers as allowed.
+var ErrTooManyProgressSubscribers = errors.New("too many subscribers for upload progress")
+
+// progressBufferSize is how many events are held for each subscriber. Subscribers which fall behind miss
+// byte count updates rather than holding up the upload.
+const progressBufferSize = 16
+
+// progressReportBytes is how often (in bytes received) byte count updates are sent.
+const progressReportBytes = 256 * 1024
+
+type uploadProgressState struct {
+	current      UploadProgress
+	active       bool
+	lastReported int64
+	subscribers  []chan UploadProgress
+}
+
+// Progress is only tracked in this process, so there is no Redis relay like there is for finished uploads.
+var progressStates = make(map[string]*uploadProgressState)
+var progressMutex = new(sync.Mutex)
+
+// SubscribeToUploadProgress returns a channel of progress events for an async upload, and a function to
+// unsubscribe. The channel is closed once the upload finishes or fails. If the upload is already underway,
+// the current progress is sent first.
+func SubscribeToUploadProgress(origin string, mediaId string, maxSubscribers int) (<-chan UploadProgress, func(), error) {
+	mxc := util.MxcUri(origin, mediaId)
+
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	state, ok := progressStates[mxc]
+	if !ok {
+		state = &uploadProgressState{subscribers: make([]chan UploadProgress, 0)}
+		progressStates[mxc] = state
+	}
+	if maxSubscribers > 0 && len(state.subscribers) >= maxSubscribers {
+		return nil, nil, ErrTooManyProgressSubscribers
+	}
+
+	ch := make(chan UploadProgress, progressBufferSize)
+	state.subscribers = append(state.subscribers, ch)
+	if state.active {
+		ch <- state.current
+	}
+
+	finishFn := func() {
+		progressMutex.Lock()
+		defer progressMutex.Unlock()
+
+		// The channel is already closed (and removed) if the upload finished
+		state, ok := progressStates[mxc]
+		if !ok {
+			return
+		}
+		newArr := make([]chan UploadProgress, 0)
+		for _, xch := range state.subscribers {
+			if xch != ch {
+				newArr = append(newArr, xch)
+			} else {
+				close(ch)
+			}
+		}
+		state.subscribers = newArr
+		if len(newArr) == 0 && !state.active {
+			delete(progressStates, mxc)
+		}
+	}
+
+	return ch, finishFn, nil
+}
+
+// UploadStarted marks the upload as underway, so subscribers which join later receive its progress.
+func UploadStarted(origin string, mediaId string) {
+	mxc := util.MxcUri(origin, mediaId)
+
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	state, ok := progressStates[mxc]
+	if !ok {
+		state = &uploadProgressState{subscribers: make([]chan UploadProgress, 0)}
+		progressStates[mxc] = state
+	}
+	state.active = true
+	state.lastReported = 0
+	state.current = UploadProgress{Stage: UploadStageReceiving}
+	publishProgress(state, true)
+}
+
+// UploadReceived records how many bytes of the upload have been received so far.
+func UploadReceived(origin string, mediaId string, bytesReceived int64) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	state, ok := progressStates[util.MxcUri(origin, mediaId)]
+	if !ok || !state.active {
+		return
+	}
+	state.current.BytesReceived = bytesReceived
+	if bytesReceived-state.lastReported >= progressReportBytes {
+		state.lastReported = bytesReceived
+		publishProgress(state, false)
+	}
+}
+
+// UploadStageChanged records that the upload moved to another stage. Finishing stages (done or failed)
+// close all subscriptions. This does nothing for uploads which aren't being tracked.
+func UploadStageChanged(origin string, mediaId string, stage UploadStage) {
+	mxc := util.MxcUri(origin, mediaId)
+
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	state, ok := progressStates[mxc]
+	if !ok || !state.active {
+		return
+	}
+	state.current.Stage = stage
+	publishProgress(state, true)
+
+	if stage == UploadStageDone || stage == UploadStageFailed {
+		for _, ch := range state.subscribers {
+			close(ch)
+		}
+		delete(progressStates, mxc)
+	}
+}
+
+// publishProgress sends the current progress to all subscribers without blocking. Byte count updates are
+// skipped for subscribers which are behind, but stage changes always make it through by dropping the oldest
+// pending event instead. Must be called with progressMutex held.
+func publishProgress(state *uploadProgressState, isStageChange bool) {
+	for _, ch := range state.subscribers {
+		select {
+		case ch <- state.current:
+			continue
+		default:
+		}
+		if !isStageChange {
+			continue
+		}
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- state.current:
+		default:
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package download
+
+import (
+	"io"
+	"strings"
+
+	"github.com/ryanuber/go-glob"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// MaxRemoteSize returns the largest media, in bytes, to download from the origin. This is from the first of the
+// downloads.originMaxBytes entries to match the origin, or downloads.maxBytes otherwise. Zero means no limit.
+func MaxRemoteSize(ctx rcontext.RequestContext, origin string) int64 {
+	origin = strings.ToLower(origin)
+	for _, limit := range ctx.Config.Downloads.OriginMaxSizeBytes {
+		if glob.Glob(strings.ToLower(limit.Origin), origin) {
+			return limit.MaxSizeBytes
+		}
+	}
+	return ctx.Config.Downloads.MaxSizeBytes
+}
+
+// LimitRemoteStream limits the media being downloaded from the origin to MaxRemoteSize. If the origin said the
+// media is larger than that (a contentLength of zero is unknown), the stream is closed and common.ErrMediaTooLarge
+// is returned. Otherwise, reading past the limit returns common.ErrMediaTooLarge.
+func LimitRemoteStream(ctx rcontext.RequestContext, origin string, r io.ReadCloser, contentLength int64) (io.ReadCloser, error) {
+	maxBytes := MaxRemoteSize(ctx, origin)
+	if maxBytes <= 0 {
+		return r, nil
+	}
+	if contentLength > maxBytes {
+		r.Close()
+		return nil, common.ErrMediaTooLarge
+	}
+	return readers.LimitReaderWithOverrunError(r, maxBytes), nil
+}
@@ -0,0 +1,64 @@
+package download
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/memcache"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// OpenCached opens the media like OpenStream or OpenOrRedirect, but serves small media from (and adds it to) the
+// in-memory cache. Media which would be redirected to its datastore is never cached, so redirects keep working.
+func OpenCached(ctx rcontext.RequestContext, media *database.Locatable, sizeBytes int64, canRedirect bool) (io.ReadSeekCloser, error) {
+	if !memcache.Fits(sizeBytes) || (canRedirect && wouldRedirect(ctx, media)) {
+		if canRedirect {
+			return OpenOrRedirect(ctx, media)
+		}
+		return OpenStream(ctx, media)
+	}
+
+	if b, ok := memcache.Get(media.Sha256Hash); ok {
+		ctx.Log.Debugf("Got %s from memory cache", media.Sha256Hash)
+		return readers.NopSeekCloser(bytes.NewReader(b)), nil
+	}
+
+	f, err := OpenStream(ctx, media)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, sizeBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) == sizeBytes {
+		memcache.Set(media.Sha256Hash, b)
+	} else {
+		ctx.Log.Warnf("Expected %d bytes for %s but read %d - not caching", sizeBytes, media.Sha256Hash, len(b))
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		b, err = io.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return readers.NopSeekCloser(bytes.NewReader(b)), nil
+}
+
+func wouldRedirect(ctx rcontext.RequestContext, media *database.Locatable) bool {
+	ds, ok := datastores.Get(ctx, media.DatastoreId)
+	if !ok {
+		return false // let the regular path report the error
+	}
+	redirect, err := datastores.WouldRedirectWhenCached(ctx, ds)
+	if err != nil {
+		ctx.Log.Warn("Unable to determine if cache would be ignored: ", err)
+		return false
+	}
+	return redirect
+}
@@ -0,0 +1,89 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// RemoteProbe describes remote media without it being downloaded.
+type RemoteProbe struct {
+	ContentType string
+	Filename    string
+	SizeBytes   int64 // -1 when the origin didn't say
+}
+
+// ProbeRemote asks the origin about the media without downloading it, so callers can decide whether to fetch it
+// fully. A HEAD request is used, falling back to requesting only the first byte for origins which don't support
+// HEAD requests. Nothing is stored or cached.
+func ProbeRemote(ctx rcontext.RequestContext, origin string, mediaId string) (*RemoteProbe, error) {
+	if util.IsServerOurs(origin) {
+		return nil, common.ErrMediaNotFound
+	}
+
+	baseUrl, realHost, err := matrix.GetServerApiUrl(origin)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", common.ErrRemoteFetchFailed, err)
+	}
+	downloadUrl := fmt.Sprintf("%s/_matrix/media/v3/download/%s/%s?allow_remote=false&allow_redirect=true", baseUrl, url.PathEscape(origin), url.PathEscape(mediaId))
+
+	resp, err := matrix.FederatedHead(downloadUrl, realHost, ctx)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err == nil && resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusNotImplemented {
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, common.ErrMediaNotFound
+		}
+		return probeFromResponse(resp, resp.ContentLength), nil
+	}
+	if err != nil {
+		ctx.Log.Debug("HEAD request failed, trying a ranged request instead: ", err)
+	}
+
+	// The origin doesn't do HEAD requests (or failed to), so ask for a single byte instead
+	rng := RemoteRange{Start: 0, End: 0}
+	resp, err = matrix.FederatedGetWithHeaders(downloadUrl, realHost, http.Header{"Range": []string{rng.Header()}}, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", common.ErrRemoteFetchFailed, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, common.ErrMediaNotFound
+	}
+	r, contentRange, err := ReadRangedResponse(resp, rng)
+	if errors.Is(err, common.ErrRangeNotSatisfiable) {
+		// Not even the first byte exists
+		return probeFromResponse(resp, 0), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", common.ErrRemoteFetchFailed, err)
+	}
+	defer r.Close() // the rest of the media is never read
+	sizeBytes := resp.ContentLength
+	if contentRange != nil {
+		sizeBytes = contentRange.Size
+	}
+	return probeFromResponse(resp, sizeBytes), nil
+}
+
+func probeFromResponse(resp *http.Response, sizeBytes int64) *RemoteProbe {
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream" // binary
+	}
+	if sizeBytes < 0 {
+		sizeBytes = -1
+	}
+	return &RemoteProbe{
+		ContentType: contentType,
+		Filename:    OriginFilename(resp),
+		SizeBytes:   sizeBytes,
+	}
+}
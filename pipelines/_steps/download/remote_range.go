@@ -0,0 +1,135 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// RemoteRange is a byte range to request from a remote server. End is inclusive, or -1 to read to the end.
+type RemoteRange struct {
+	Start int64
+	End   int64
+}
+
+func (r RemoteRange) Header() string {
+	if r.End < 0 {
+		return fmt.Sprintf("bytes=%d-", r.Start)
+	}
+	return fmt.Sprintf("bytes=%d-%d", r.Start, r.End)
+}
+
+// RangedStream is a stream which only contains the described part of the media.
+type RangedStream struct {
+	io.ReadCloser
+	Range *util.ContentRange
+}
+
+// ParseRemoteRange converts a client's Range header into a range which can be forwarded to the origin. Only
+// single ranges with a starting position are supported - anything else returns nil, and the whole media is
+// fetched instead. Open-ended ranges are capped at defaultChunkSize bytes, if set.
+func ParseRemoteRange(s string, defaultChunkSize int64) *RemoteRange {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) || strings.Contains(s, ",") {
+		return nil
+	}
+	startStr, endStr, ok := strings.Cut(s[len(b):], "-")
+	if !ok {
+		return nil
+	}
+	startStr = textproto.TrimString(startStr)
+	endStr = textproto.TrimString(endStr)
+	if startStr == "" {
+		return nil // suffix ranges need the size of the media, which we don't know yet
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return nil
+	}
+	end := int64(-1)
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return nil
+		}
+	} else if defaultChunkSize > 0 {
+		end = start + defaultChunkSize - 1
+	}
+	return &RemoteRange{Start: start, End: end}
+}
+
+// ReadRangedResponse validates the origin's response to a request for the given range, returning a stream
+// of only the requested bytes and the range it covers. Origins which ignore the range and reply with the
+// whole file have it sliced down when their Content-Length is known. When it isn't known, the whole file is
+// returned with a nil range.
+func ReadRangedResponse(resp *http.Response, rng RemoteRange) (io.ReadCloser, *util.ContentRange, error) {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		cr, err := util.ParseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("%w: %w", common.ErrOriginRangeMismatch, err)
+		}
+		if err = verifyContentRange(cr, rng); err != nil {
+			resp.Body.Close()
+			return nil, nil, err
+		}
+		if resp.ContentLength >= 0 && resp.ContentLength != cr.Length() {
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("%w: Content-Length %d does not match %s", common.ErrOriginRangeMismatch, resp.ContentLength, cr.String())
+		}
+		return readers.LimitReaderWithOverrunError(resp.Body, cr.Length()), cr, nil
+	case http.StatusOK:
+		// The origin ignored our range and sent the whole file
+		if resp.ContentLength < 0 {
+			return resp.Body, nil, nil
+		}
+		if rng.Start >= resp.ContentLength {
+			resp.Body.Close()
+			return nil, nil, common.ErrRangeNotSatisfiable
+		}
+		cr := &util.ContentRange{Start: rng.Start, End: rng.End, Size: resp.ContentLength}
+		if cr.End < 0 || cr.End >= cr.Size {
+			cr.End = cr.Size - 1
+		}
+		if _, err := io.CopyN(io.Discard, resp.Body, cr.Start); err != nil {
+			resp.Body.Close()
+			return nil, nil, err
+		}
+		body := resp.Body
+		return readers.NewCancelCloser(io.NopCloser(io.LimitReader(body, cr.Length())), func() {
+			_ = body.Close()
+		}), cr, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return nil, nil, common.ErrRangeNotSatisfiable
+	default:
+		resp.Body.Close()
+		return nil, nil, errors.New(fmt.Sprintf("unexpected status code %d", resp.StatusCode))
+	}
+}
+
+func verifyContentRange(cr *util.ContentRange, rng RemoteRange) error {
+	if cr.Start != rng.Start {
+		return fmt.Errorf("%w: requested %s, got %s", common.ErrOriginRangeMismatch, rng.Header(), cr.String())
+	}
+	if rng.End >= 0 {
+		if cr.End > rng.End {
+			return fmt.Errorf("%w: requested %s, got %s", common.ErrOriginRangeMismatch, rng.Header(), cr.String())
+		}
+		// A shorter range is only acceptable if it stops at the end of the file
+		if cr.End < rng.End && cr.Size >= 0 && cr.End != cr.Size-1 {
+			return fmt.Errorf("%w: requested %s, got %s", common.ErrOriginRangeMismatch, rng.Header(), cr.String())
+		}
+	}
+	return nil
+}
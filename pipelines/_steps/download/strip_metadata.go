@@ -0,0 +1,36 @@
+package download
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+	"github.com/t2bot/matrix-media-repo/util/stripmeta"
+)
+
+// ShouldStripMetadata returns true if the media should be served through StripMetadata.
+func ShouldStripMetadata(ctx rcontext.RequestContext, record *database.DbMedia) bool {
+	conf := ctx.Config.Downloads.StripMetadata
+	if !conf.Enabled || !stripmeta.Supported(record.ContentType) {
+		return false
+	}
+	return conf.MaxSizeBytes <= 0 || record.SizeBytes <= conf.MaxSizeBytes
+}
+
+// StripMetadata returns a stream of the media with its metadata removed, and the new size of the media. The
+// stored media is not modified. The stream r is always closed.
+func StripMetadata(ctx rcontext.RequestContext, record *database.DbMedia, r io.ReadCloser) (io.ReadSeekCloser, int64, error) {
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err = stripmeta.Strip(record.ContentType, b)
+	if err != nil {
+		return nil, 0, err
+	}
+	return readers.NopSeekCloser(bytes.NewReader(b)), int64(len(b)), nil
+}
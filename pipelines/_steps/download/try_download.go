@@ -11,6 +11,7 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
@@ -20,19 +21,69 @@ import (
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/datastore_op"
 	"github.com/t2bot/matrix-media-repo/pool"
 	"github.com/t2bot/matrix-media-repo/util"
-	"github.com/t2bot/matrix-media-repo/util/readers"
 )
 
 type downloadResult struct {
-	r           io.ReadCloser
-	filename    string
-	contentType string
-	err         error
+	r            io.ReadCloser
+	filename     string
+	contentType  string
+	sizeBytes    int64
+	contentRange *util.ContentRange
+	err          error
 }
 
 func TryDownload(ctx rcontext.RequestContext, origin string, mediaId string) (*database.DbMedia, io.ReadCloser, error) {
+	res, err := fetchRemote(ctx, origin, mediaId, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// At this point, res.r is our http response body.
+
+	if config.IsReadOnly() {
+		// Serve the media without caching it. The record is not persisted, and has no location.
+		ctx.Log.Debug("Read-only: serving remote media without storing it")
+		return transientRecord(origin, mediaId, res), res.r, nil
+	}
+
+	return datastore_op.PutAndReturnStream(ctx, origin, mediaId, res.r, res.contentType, res.filename, datastores.RemoteMediaKind)
+}
+
+// TryDownloadRange asks the origin for only part of the media. Only part of the media is downloaded, so it isn't
+// stored - TryDownload is still needed for that. The returned stream will be a *RangedStream when the origin's
+// response could be limited to the range.
+func TryDownloadRange(ctx rcontext.RequestContext, origin string, mediaId string, rng RemoteRange) (*database.DbMedia, io.ReadCloser, error) {
+	res, err := fetchRemote(ctx, origin, mediaId, &rng)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx.Log.Debugf("Serving %s of remote media from the origin", rng.Header())
+	record := transientRecord(origin, mediaId, res)
+	if res.contentRange == nil {
+		return record, res.r, nil
+	}
+	return record, &RangedStream{ReadCloser: res.r, Range: res.contentRange}, nil
+}
+
+func transientRecord(origin string, mediaId string, res downloadResult) *database.DbMedia {
+	if res.sizeBytes <= 0 {
+		res.sizeBytes = -1 // unknown
+	}
+	return &database.DbMedia{
+		Origin:      origin,
+		MediaId:     mediaId,
+		UploadName:  res.filename,
+		ContentType: res.contentType,
+		SizeBytes:   res.sizeBytes,
+		CreationTs:  util.NowMillis(),
+		Locatable:   &database.Locatable{},
+	}
+}
+
+func fetchRemote(ctx rcontext.RequestContext, origin string, mediaId string, rng *RemoteRange) (downloadResult, error) {
 	if util.IsServerOurs(origin) {
-		return nil, nil, common.ErrMediaNotFound
+		return downloadResult{}, common.ErrMediaNotFound
 	}
 
 	ch := make(chan downloadResult)
@@ -48,75 +99,100 @@ func TryDownload(ctx rcontext.RequestContext, origin string, mediaId string) (*d
 			errcache.DownloadErrors.Set(cacheKey, err)
 			ch <- downloadResult{err: err}
 		}
+		failedFn := func(err error) {
+			// The origin couldn't be reached or didn't respond sensibly, which is different from it not having the media
+			errFn(fmt.Errorf("%w: %w", common.ErrRemoteFetchFailed, err))
+		}
 
 		baseUrl, realHost, err := matrix.GetServerApiUrl(origin)
 		if err != nil {
-			errFn(err)
+			failedFn(err)
 			return
 		}
 
+		headers := make(http.Header)
+		if rng != nil {
+			headers.Set("Range", rng.Header())
+		}
+
 		downloadUrl := fmt.Sprintf("%s/_matrix/media/v3/download/%s/%s?allow_remote=false&allow_redirect=true", baseUrl, url.PathEscape(origin), url.PathEscape(mediaId))
-		resp, err := matrix.FederatedGet(downloadUrl, realHost, ctx)
+		resp, err := matrix.FederatedGetWithHeaders(downloadUrl, realHost, headers, ctx)
 		metrics.MediaDownloaded.With(prometheus.Labels{"origin": origin}).Inc()
 		if err != nil {
-			errFn(err)
+			failedFn(err)
 			return
 		}
 
 		if resp.StatusCode == http.StatusNotFound {
 			errFn(common.ErrMediaNotFound)
 			return
-		} else if resp.StatusCode != http.StatusOK {
-			errFn(errors.New(fmt.Sprintf("unexpected status code %d", resp.StatusCode)))
+		} else if resp.StatusCode != http.StatusOK && rng == nil {
+			failedFn(errors.New(fmt.Sprintf("unexpected status code %d", resp.StatusCode)))
 			return
 		}
 
+		var r io.ReadCloser
+		var contentRange *util.ContentRange
 		contentLength := int64(0)
-		if resp.Header.Get("Content-Length") != "" {
-			contentLength, err = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		if rng != nil {
+			// Range problems are specific to this request, so are not cached
+			r, contentRange, err = ReadRangedResponse(resp, *rng)
 			if err != nil {
-				errFn(err)
+				ch <- downloadResult{err: err}
 				return
 			}
+			if contentRange != nil && contentRange.Size >= 0 {
+				contentLength = contentRange.Size
+			} else if contentRange == nil && resp.ContentLength > 0 {
+				contentLength = resp.ContentLength
+			}
+		} else {
+			r = resp.Body
+			if resp.Header.Get("Content-Length") != "" {
+				contentLength, err = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+				if err != nil {
+					failedFn(err)
+					return
+				}
+			}
 		}
 
-		if contentLength != 0 && ctx.Config.Downloads.MaxSizeBytes > 0 && contentLength > ctx.Config.Downloads.MaxSizeBytes {
-			errFn(common.ErrMediaTooLarge)
+		r, err = LimitRemoteStream(ctx, origin, r, contentLength)
+		if err != nil {
+			errFn(err)
 			return
 		}
 
-		r := resp.Body
-		if ctx.Config.Downloads.MaxSizeBytes > 0 {
-			r = readers.LimitReaderWithOverrunError(resp.Body, ctx.Config.Downloads.MaxSizeBytes)
-		}
-
 		contentType := resp.Header.Get("Content-Type")
 		if contentType == "" {
 			contentType = "application/octet-stream" // binary
 		}
 
-		fileName := "download"
-		_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
-		if err == nil && params["filename"] != "" {
-			fileName = params["filename"]
-		}
-
 		ch <- downloadResult{
-			r:           r,
-			filename:    fileName,
-			contentType: contentType,
-			err:         nil,
+			r:            r,
+			filename:     OriginFilename(resp),
+			contentType:  contentType,
+			sizeBytes:    contentLength,
+			contentRange: contentRange,
+			err:          nil,
 		}
 	}
 	if err := pool.DownloadQueue.Schedule(fn); err != nil {
-		return nil, nil, err
+		return downloadResult{}, err
 	}
 	res := <-ch
 	if res.err != nil {
-		return nil, nil, res.err
+		return res, res.err
 	}
+	return res, nil
+}
 
-	// At this point, res.r is our http response body.
-
-	return datastore_op.PutAndReturnStream(ctx, origin, mediaId, res.r, res.contentType, res.filename, datastores.RemoteMediaKind)
+// OriginFilename is the filename the origin supplied in its Content-Disposition header, if any. Media without one
+// is left unnamed so the download falls back to the configured default filename.
+func OriginFilename(resp *http.Response) string {
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
 }
@@ -0,0 +1,120 @@
+package thumbnails
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/patrickmn/go-cache"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/i"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// sourceDimensions holds the displayed dimensions FillAutoAspect found for media, so the media isn't opened again
+// for every thumbnail request which leaves out a dimension. Stored media doesn't change, so nothing needs
+// invalidating.
+var sourceDimensions = cache.New(1*time.Hour, 2*time.Hour)
+
+// FillAutoAspect works out a width or height of zero from the aspect ratio of the media (or the sub-image, if
+// given), for the thumbnails.autoAspect option. Dimensions which are both set are returned as-is. The result
+// still needs to go through PickNewDimensions.
+func FillAutoAspect(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, subImage *int, desiredWidth int, desiredHeight int) (int, int, error) {
+	if desiredWidth > 0 && desiredHeight > 0 {
+		return desiredWidth, desiredHeight, nil
+	}
+	if desiredWidth <= 0 && desiredHeight <= 0 {
+		return 0, 0, errors.New("width or height must be positive")
+	}
+
+	srcWidth, srcHeight, err := getSourceDimensions(ctx, mediaRecord, subImage)
+	if err != nil {
+		return 0, 0, err
+	}
+	w, h := ScaleToAspect(desiredWidth, desiredHeight, srcWidth, srcHeight)
+	return w, h, nil
+}
+
+// getSourceDimensions returns the displayed dimensions of the media (or sub-image), from sourceDimensions if they
+// have been found before.
+func getSourceDimensions(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, subImage *int) (int, int, error) {
+	if mediaRecord.Locatable == nil || mediaRecord.DatastoreId == "" {
+		return 0, 0, nil
+	}
+
+	index := -1
+	if subImage != nil {
+		index = *subImage
+	}
+	cacheKey := fmt.Sprintf("%s/%s?s=%d", mediaRecord.Origin, mediaRecord.MediaId, index)
+	if val, ok := sourceDimensions.Get(cacheKey); ok {
+		dimensions := val.([2]int)
+		return dimensions[0], dimensions[1], nil
+	}
+
+	stream, err := download.OpenStream(ctx, mediaRecord.Locatable)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stream.Close()
+	width, height := GetDisplayedDimensions(u.WithSourceOrigin(ctx, mediaRecord.Origin), stream, util.FixContentType(mediaRecord.ContentType), subImage)
+	sourceDimensions.Set(cacheKey, [2]int{width, height}, cache.DefaultExpiration)
+	return width, height, nil
+}
+
+// GetDisplayedDimensions returns the dimensions of the media as it is shown, after any EXIF orientation. Zeros
+// are returned if the dimensions can't be found, such as for audio or unsupported media.
+func GetDisplayedDimensions(ctx rcontext.RequestContext, r io.Reader, contentType string, subImage *int) (int, int) {
+	var orientation *u.ExifOrientation
+	if contentType == "image/jpeg" || contentType == "image/jpg" {
+		br := readers.NewBufferReadsReader(r)
+		orientation = u.ExtractExifOrientation(br)
+		r = br.GetRewoundReader()
+	}
+
+	generator, r, err := thumbnailing.GetGenerator(r, contentType, false, ctx)
+	if err != nil {
+		return 0, 0
+	}
+	width := 0
+	height := 0
+	if subGenerator, ok := generator.(i.SubImageGenerator); ok && subImage != nil {
+		width, height, err = subGenerator.GetSubImageDimensions(r, *subImage, ctx)
+	} else {
+		_, width, height, err = generator.GetOriginDimensions(r, contentType, ctx)
+	}
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error getting dimensions for thumbnail aspect ratio: ", err)
+		sentry.CaptureException(err)
+		return 0, 0
+	}
+	orientation = u.OrientationFor(ctx, orientation, width, height)
+	if orientation != nil && (orientation.RotateDegrees == 90 || orientation.RotateDegrees == 270) {
+		width, height = height, width
+	}
+	return width, height
+}
+
+// ScaleToAspect fills in whichever of the desired dimensions is zero so they match the aspect ratio of the source
+// dimensions. When the source dimensions are unknown (zero), the missing dimension matches the other.
+func ScaleToAspect(desiredWidth int, desiredHeight int, srcWidth int, srcHeight int) (int, int) {
+	if srcWidth <= 0 || srcHeight <= 0 {
+		srcWidth = 1
+		srcHeight = 1
+	}
+	if desiredWidth <= 0 {
+		desiredWidth = util.MaxInt(1, int(math.Round(float64(desiredHeight)*float64(srcWidth)/float64(srcHeight))))
+	}
+	if desiredHeight <= 0 {
+		desiredHeight = util.MaxInt(1, int(math.Round(float64(desiredWidth)*float64(srcHeight)/float64(srcWidth))))
+	}
+	return desiredWidth, desiredHeight
+}
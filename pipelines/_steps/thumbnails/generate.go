@@ -1,6 +1,7 @@
 package thumbnails
 
 import (
+	"context"
 	"errors"
 	"io"
 	"strconv"
@@ -8,6 +9,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
@@ -17,6 +19,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/pool"
 	"github.com/t2bot/matrix-media-repo/thumbnailing"
 	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
@@ -26,69 +29,42 @@ type generateResult struct {
 }
 
 func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width int, height int, method string, animated bool) (*database.DbThumbnail, io.ReadCloser, error) {
-	ch := make(chan generateResult)
-	defer close(ch)
-	fn := func() {
-		metric := metrics.ThumbnailsGenerated.With(prometheus.Labels{
-			"width":    strconv.Itoa(width),
-			"height":   strconv.Itoa(height),
-			"method":   method,
-			"animated": strconv.FormatBool(animated),
-			"origin":   mediaRecord.Origin,
-		})
-
-		mediaStream, err := download.OpenStream(ctx, mediaRecord.Locatable)
-		if err != nil {
-			ch <- generateResult{err: err}
-			return
-		}
-		fixedContentType := util.FixContentType(mediaRecord.ContentType)
-
-		i, err := thumbnailing.GenerateThumbnail(mediaStream, fixedContentType, width, height, method, animated, ctx)
-		if err != nil {
-			if errors.Is(err, common.ErrMediaDimensionsTooSmall) {
-				metric.Inc()
-			}
-			ch <- generateResult{err: err}
-			return
-		}
-
-		metric.Inc()
-		ch <- generateResult{i: i}
+	if mediaRecord.Locatable == nil || mediaRecord.DatastoreId == "" {
+		// Remote media served without being stored (read-only mode) can't be read again to thumbnail it
+		return nil, nil, common.ErrMediaNotFound
 	}
 
-	if err := pool.ThumbnailQueue.Schedule(fn); err != nil {
+	res, err := generateInQueue(ctx, mediaRecord, width, height, method, animated)
+	if err != nil {
 		return nil, nil, err
 	}
-	res := <-ch
-	if res.err != nil {
-		return nil, nil, res.err
-	}
-	if res.i == nil {
-		// Couldn't generate a thumbnail
-		return nil, nil, common.ErrMediaNotFound
-	}
 
-	// At this point, res.i is our thumbnail
+	// Remember the source's dominant colour while we have it. This isn't critical, so don't fail the request.
+	if res.DominantColor != "" {
+		if err := database.GetInstance().Media.Prepare(ctx).SetDominantColor(mediaRecord.Sha256Hash, res.DominantColor); err != nil {
+			ctx.Log.Warn("Non-fatal error while storing dominant color: ", err)
+			sentry.CaptureException(err)
+		}
+	}
 
 	// Quickly check to see if we already have a database record for this thumbnail. We do this because predicting
 	// what the thumbnailer will generate is non-trivial, but it might generate a conflicting thumbnail (particularly
 	// when `defaultAnimated` is `true`.
 	db := database.GetInstance().Thumbnails.Prepare(ctx)
-	if res.i.Animated != animated { // this is the only thing that could have changed during generation
-		existingRecord, err := db.GetByParams(mediaRecord.Origin, mediaRecord.MediaId, width, height, method, res.i.Animated)
+	if res.Animated != animated { // this is the only thing that could have changed during generation
+		existingRecord, err := db.GetByParams(mediaRecord.Origin, mediaRecord.MediaId, width, height, method, res.Animated)
 		if err != nil {
 			return nil, nil, err
 		}
-		if existingRecord != nil {
+		if existingRecord != nil && !IsStale(ctx, existingRecord) {
 			ctx.Log.Debug("Found existing record for parameters - discarding generated thumbnail")
-			defer res.i.Reader.Close()
+			defer res.Reader.Close()
 
 			// Optimization: prevent future generator waste by inserting an `animated=true` record for static media,
 			// since we won't ever generate an animated version. This is safe because to get here the thumbnail needed
 			// to be requested as animated, but the generated one wasn't. This implies we are trying to animate a static
 			// image, which doesn't work.
-			if !res.i.Animated {
+			if !res.Animated && !config.IsReadOnly() {
 				existingRecord.Animated = true
 				// we don't modify the creation time, so it expires at a sane point in history
 				err = db.Insert(existingRecord)
@@ -106,11 +82,37 @@ func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width
 		}
 	}
 
-	// We don't have an existing record. Store the stream and insert a record.
-	thumbMediaRecord, thumbStream, err := datastore_op.PutAndReturnStream(ctx, ctx.Request.Host, "", res.i.Reader, res.i.ContentType, "", datastores.ThumbnailsKind)
+	// While read-only, return the thumbnail without storing it. It'll be generated again next time.
+	if config.IsReadOnly() {
+		return unstoredRecord(mediaRecord, res, width, height, method), res.Reader, nil
+	}
+
+	// We don't have an existing record. The thumbnail is sent to the requester as it is encoded, and stored at the
+	// same time, so it's neither held in memory nor generated twice. Storing it carries on if the requester goes
+	// away, and the thumbnail is still served if it can't be stored.
+	storeCtx := ctx
+	storeCtx.Context = context.WithoutCancel(ctx.Context)
+	stream := ServeWhileStoring(res.Reader, func(r io.Reader) {
+		err := storeThumbnail(storeCtx, mediaRecord, res, width, height, method, r)
+		if datastores.IsOutOfSpace(err) {
+			ctx.Log.Error("Thumbnail datastore is out of space - serving thumbnail without storing it: ", err)
+			sentry.CaptureException(err)
+			metrics.ThumbnailsNotStored.With(prometheus.Labels{"reason": "no_space"}).Inc()
+		} else if err != nil {
+			ctx.Log.Error("Error storing thumbnail - serving it without storing it: ", err)
+			sentry.CaptureException(err)
+		}
+	})
+	return unstoredRecord(mediaRecord, res, width, height, method), stream, nil
+}
+
+// storeThumbnail stores the thumbnail read from r, and inserts (or replaces) its record.
+func storeThumbnail(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, res *m.Thumbnail, width int, height int, method string, r io.Reader) error {
+	thumbMediaRecord, thumbStream, err := datastore_op.PutAndReturnStream(ctx, ctx.Request.Host, "", io.NopCloser(r), res.ContentType, "", datastores.ThumbnailsKind)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
+	_ = thumbStream.Close() // the requester is sent the thumbnail as it is encoded instead
 
 	// Create a DbThumbnail
 	newRecord := &database.DbThumbnail{
@@ -120,7 +122,7 @@ func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width
 		Width:       width,
 		Height:      height,
 		Method:      method,
-		Animated:    res.i.Animated,
+		Animated:    res.Animated,
 		SizeBytes:   thumbMediaRecord.SizeBytes,
 		CreationTs:  thumbMediaRecord.CreationTs,
 		Locatable: &database.Locatable{
@@ -128,12 +130,128 @@ func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width
 			DatastoreId: thumbMediaRecord.DatastoreId,
 			Location:    thumbMediaRecord.Location,
 		},
+		GeneratorVersion: thumbnailing.GeneratorVersion,
+		OutputWidth:      res.Width,
+		OutputHeight:     res.Height,
 	}
-	err = db.Insert(newRecord)
+
+	// A stale thumbnail (see IsStale) is replaced rather than conflicting with the new record
+	db := database.GetInstance().Thumbnails.Prepare(ctx)
+	staleRecord, err := db.GetByParams(newRecord.Origin, newRecord.MediaId, newRecord.Width, newRecord.Height, newRecord.Method, newRecord.Animated)
 	if err != nil {
-		defer thumbStream.Close()
-		return nil, nil, err
+		return err
+	}
+	if staleRecord != nil {
+		err = db.Replace(newRecord)
+	} else {
+		err = db.Insert(newRecord)
+	}
+	if err != nil {
+		return err
+	}
+	if staleRecord != nil {
+		removeStaleObject(ctx, staleRecord, newRecord)
+	}
+	return nil
+}
+
+// generateInQueue generates the thumbnail on the thumbnail queue. The thumbnail is encoded as its reader is read.
+func generateInQueue(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width int, height int, method string, animated bool) (*m.Thumbnail, error) {
+	ch := make(chan generateResult)
+	defer close(ch)
+	fn := func() {
+		metric := metrics.ThumbnailsGenerated.With(prometheus.Labels{
+			"width":    strconv.Itoa(width),
+			"height":   strconv.Itoa(height),
+			"method":   method,
+			"animated": strconv.FormatBool(animated),
+			"origin":   mediaRecord.Origin,
+		})
+
+		fixedContentType := util.FixContentType(mediaRecord.ContentType)
+		i, err := generateWithRetries(ctx, mediaRecord, func(mediaStream io.ReadCloser) (*m.Thumbnail, error) {
+			return thumbnailing.GenerateThumbnail(mediaStream, fixedContentType, width, height, method, animated, u.WithSourceSize(u.WithSourceOrigin(ctx, mediaRecord.Origin), mediaRecord.SizeBytes))
+		})
+		if err != nil {
+			if errors.Is(err, common.ErrMediaDimensionsTooSmall) {
+				metric.Inc()
+			}
+			ch <- generateResult{err: err}
+			return
+		}
+
+		metric.Inc()
+		ch <- generateResult{i: i}
 	}
 
-	return newRecord, thumbStream, nil
+	if err := pool.ThumbnailQueue.Schedule(fn); err != nil {
+		return nil, err
+	}
+	res := <-ch
+	if res.err != nil {
+		return nil, res.err
+	}
+	if res.i == nil {
+		// Couldn't generate a thumbnail
+		return nil, common.ErrMediaNotFound
+	}
+	return res.i, nil
+}
+
+// generateWithRetries opens the media for generate to thumbnail, opening it again for each retry of a transient
+// error (see thumbnailing.WithRetries).
+func generateWithRetries(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, generate func(mediaStream io.ReadCloser) (*m.Thumbnail, error)) (*m.Thumbnail, error) {
+	return thumbnailing.WithRetries(ctx, func() (*m.Thumbnail, error) {
+		mediaStream, err := download.OpenStream(ctx, mediaRecord.Locatable)
+		if err != nil {
+			return nil, err
+		}
+		return generate(mediaStream)
+	})
+}
+
+// unstoredRecord describes a thumbnail which is served as it is generated rather than from a stored copy, so its
+// size isn't known yet.
+func unstoredRecord(mediaRecord *database.DbMedia, i *m.Thumbnail, width int, height int, method string) *database.DbThumbnail {
+	return &database.DbThumbnail{
+		Origin:           mediaRecord.Origin,
+		MediaId:          mediaRecord.MediaId,
+		ContentType:      i.ContentType,
+		Width:            width,
+		Height:           height,
+		Method:           method,
+		Animated:         i.Animated,
+		SizeBytes:        -1, // unknown
+		CreationTs:       util.NowMillis(),
+		Locatable:        &database.Locatable{},
+		GeneratorVersion: thumbnailing.GeneratorVersion,
+		OutputWidth:      i.Width,
+		OutputHeight:     i.Height,
+	}
+}
+
+// removeStaleObject deletes the datastore object of a thumbnail which was replaced, if nothing else uses it.
+// Failures are only logged, as the new thumbnail is already in place.
+func removeStaleObject(ctx rcontext.RequestContext, stale *database.DbThumbnail, replacement *database.DbThumbnail) {
+	if stale.DatastoreId == replacement.DatastoreId && stale.Location == replacement.Location {
+		return // the generator made an identical thumbnail
+	}
+	if exists, err := database.GetInstance().Media.Prepare(ctx).LocationExists(stale.DatastoreId, stale.Location); err != nil || exists {
+		if err != nil {
+			ctx.Log.Warn("Non-fatal error checking if stale thumbnail is in use: ", err)
+			sentry.CaptureException(err)
+		}
+		return
+	}
+	if exists, err := database.GetInstance().Thumbnails.Prepare(ctx).LocationExists(stale.DatastoreId, stale.Location); err != nil || exists {
+		if err != nil {
+			ctx.Log.Warn("Non-fatal error checking if stale thumbnail is in use: ", err)
+			sentry.CaptureException(err)
+		}
+		return
+	}
+	if err := datastores.RemoveWithDsId(ctx, stale.DatastoreId, stale.Location); err != nil {
+		ctx.Log.Warn("Non-fatal error removing stale thumbnail: ", err)
+		sentry.CaptureException(err)
+	}
 }
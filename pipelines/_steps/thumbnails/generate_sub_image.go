@@ -0,0 +1,43 @@
+package thumbnails
+
+import (
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pool"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// GenerateSubImage thumbnails the image at index of media which holds several, such as a multi-page TIFF. The
+// thumbnail isn't stored, as it would conflict with the stored thumbnail of the primary image.
+func GenerateSubImage(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, index int, width int, height int, method string) (*database.DbThumbnail, io.ReadCloser, error) {
+	if mediaRecord.Locatable == nil || mediaRecord.DatastoreId == "" {
+		return nil, nil, common.ErrMediaNotFound
+	}
+
+	ch := make(chan generateResult)
+	defer close(ch)
+	fn := func() {
+		i, err := generateWithRetries(ctx, mediaRecord, func(mediaStream io.ReadCloser) (*m.Thumbnail, error) {
+			return thumbnailing.GenerateSubImageThumbnail(mediaStream, util.FixContentType(mediaRecord.ContentType), index, width, height, method, ctx)
+		})
+		ch <- generateResult{i: i, err: err}
+	}
+
+	if err := pool.ThumbnailQueue.Schedule(fn); err != nil {
+		return nil, nil, err
+	}
+	res := <-ch
+	if res.err != nil {
+		return nil, nil, res.err
+	}
+	if res.i == nil {
+		return nil, nil, common.ErrMediaNotFound
+	}
+
+	return unstoredRecord(mediaRecord, res.i, width, height, method), res.i.Reader, nil
+}
@@ -2,11 +2,52 @@ package thumbnails
 
 import (
 	"errors"
+	"math"
 
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
+// MinDevicePixelRatio and MaxDevicePixelRatio are the bounds for ApplyDevicePixelRatio.
+const MinDevicePixelRatio = 1.0
+const MaxDevicePixelRatio = 4.0
+
+// ApplyDevicePixelRatio multiplies the requested dimensions for high-DPI displays. If that exceeds the largest
+// configured thumbnail size, the dimensions are scaled down to fit while keeping their aspect ratio. The result
+// still needs to go through PickNewDimensions. A dimension of zero (see FillAutoAspect) stays zero.
+func ApplyDevicePixelRatio(ctx rcontext.RequestContext, desiredWidth int, desiredHeight int, dpr float64) (int, int, error) {
+	if math.IsNaN(dpr) || dpr < MinDevicePixelRatio || dpr > MaxDevicePixelRatio {
+		return 0, 0, errors.New("device pixel ratio is out of range")
+	}
+
+	width := float64(desiredWidth) * dpr
+	height := float64(desiredHeight) * dpr
+	largestWidth := 0
+	largestHeight := 0
+	for _, size := range ctx.Config.Thumbnails.Sizes {
+		largestWidth = util.MaxInt(largestWidth, size.Width)
+		largestHeight = util.MaxInt(largestHeight, size.Height)
+	}
+	if largestWidth > 0 && largestHeight > 0 {
+		// Never scale below what was originally asked for, though
+		ratio := math.Min(float64(largestWidth)/width, float64(largestHeight)/height)
+		ratio = math.Max(ratio, 1/dpr)
+		if ratio < 1 {
+			width *= ratio
+			height *= ratio
+		}
+	}
+	return scaledDimension(desiredWidth, width), scaledDimension(desiredHeight, height), nil
+}
+
+func scaledDimension(desired int, scaled float64) int {
+	if desired == 0 {
+		return 0
+	}
+	return util.MaxInt(1, int(math.Round(scaled)))
+}
+
 func PickNewDimensions(ctx rcontext.RequestContext, desiredWidth int, desiredHeight int, desiredMethod string) (int, int, string, error) {
 	if desiredWidth <= 0 {
 		return 0, 0, "", errors.New("width must be positive")
@@ -14,7 +55,8 @@ func PickNewDimensions(ctx rcontext.RequestContext, desiredWidth int, desiredHei
 	if desiredHeight <= 0 {
 		return 0, 0, "", errors.New("height must be positive")
 	}
-	if desiredMethod != "crop" && desiredMethod != "scale" {
+	baseMethod, _, err := u.ParseMethod(desiredMethod)
+	if err != nil {
 		return 0, 0, "", errors.New("method must be crop or scale")
 	}
 
@@ -55,7 +97,7 @@ func PickNewDimensions(ctx rcontext.RequestContext, desiredWidth int, desiredHei
 		targetHeight = largestHeight
 	}
 
-	if desiredMethod == "crop" {
+	if baseMethod == "crop" {
 		// We need to maintain the aspect ratio of the request
 		sizeAspect := float32(targetWidth) / float32(targetHeight)
 		if sizeAspect != desiredAspectRatio { // it's unlikely to match, but we can dream
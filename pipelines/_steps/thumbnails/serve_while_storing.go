@@ -0,0 +1,67 @@
+package thumbnails
+
+import (
+	"io"
+	"sync"
+)
+
+// storingReader is the requester's side of ServeWhileStoring.
+type storingReader struct {
+	*io.PipeReader
+	done *sync.WaitGroup
+}
+
+// Close stops sending the thumbnail to the requester, then waits for it to finish being stored.
+func (s *storingReader) Close() error {
+	err := s.PipeReader.Close()
+	s.done.Wait()
+	return err
+}
+
+// ServeWhileStoring reads r once, sending it both to the returned reader (for the requester) and to store, so a
+// thumbnail can be served as it is encoded while it is stored. Neither side buffers more than a chunk at a time. If
+// either side stops reading, like when the requester goes away or store fails, the other side carries on alone.
+// Closing the returned reader waits for store to return, and for r to be closed.
+func ServeWhileStoring(r io.ReadCloser, store func(r io.Reader)) io.ReadCloser {
+	requesterR, requesterW := io.Pipe()
+	storeR, storeW := io.Pipe()
+
+	done := &sync.WaitGroup{}
+	done.Add(2)
+	go func() {
+		defer done.Done()
+		store(storeR)
+		_ = storeR.Close() // anything store didn't read is dropped
+	}()
+
+	go func() {
+		defer done.Done()
+		defer r.Close()
+		var err error
+		writers := []*io.PipeWriter{requesterW, storeW}
+		buf := make([]byte, 32*1024)
+		for len(writers) > 0 {
+			var n int
+			n, err = r.Read(buf)
+			if n > 0 {
+				open := writers[:0]
+				for _, w := range writers {
+					if _, werr := w.Write(buf[:n]); werr == nil {
+						open = append(open, w)
+					}
+				}
+				writers = open
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		_ = requesterW.CloseWithError(err)
+		_ = storeW.CloseWithError(err)
+	}()
+
+	return &storingReader{PipeReader: requesterR, done: done}
+}
@@ -0,0 +1,15 @@
+package thumbnails
+
+import (
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// IsStale returns true if the thumbnail was made by a generator older than the configured minimum, and should
+// be regenerated instead of served. A minimum above the current generator version is treated as the current
+// version, as the regenerated thumbnails would never meet it.
+func IsStale(ctx rcontext.RequestContext, record *database.DbThumbnail) bool {
+	return record.GeneratorVersion < util.MinInt(ctx.Config.Thumbnails.MinGeneratorVersion, thumbnailing.GeneratorVersion)
+}
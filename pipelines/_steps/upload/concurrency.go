@@ -0,0 +1,57 @@
+package upload
+
+import (
+	"sync"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// Counts are per-process: when running multiple media repo processes, each enforces the limits separately.
+var concurrentLock = new(sync.Mutex)
+var concurrentByUser = make(map[string]int)
+var concurrentByIp = make(map[string]int)
+
+// AcquireUploadSlot reserves one of the user's (and IP address's) concurrent upload slots, returning
+// common.ErrTooManyUploads if either has too many uploads in progress already. The returned function releases
+// the slot, and must be called once the upload is finished regardless of whether it succeeded.
+func AcquireUploadSlot(ctx rcontext.RequestContext, userId string, ipAddr string) (func(), error) {
+	perUser := ctx.Config.Uploads.MaxConcurrent.PerUser
+	perIp := ctx.Config.Uploads.MaxConcurrent.PerIp
+	trackUser := perUser > 0 && userId != ""
+	trackIp := perIp > 0 && ipAddr != ""
+
+	concurrentLock.Lock()
+	defer concurrentLock.Unlock()
+
+	if (trackUser && concurrentByUser[userId] >= perUser) || (trackIp && concurrentByIp[ipAddr] >= perIp) {
+		return nil, common.ErrTooManyUploads
+	}
+	if trackUser {
+		concurrentByUser[userId]++
+	}
+	if trackIp {
+		concurrentByIp[ipAddr]++
+	}
+
+	once := new(sync.Once)
+	return func() {
+		once.Do(func() {
+			concurrentLock.Lock()
+			defer concurrentLock.Unlock()
+			if trackUser {
+				release(concurrentByUser, userId)
+			}
+			if trackIp {
+				release(concurrentByIp, ipAddr)
+			}
+		})
+	}, nil
+}
+
+func release(counts map[string]int, key string) {
+	counts[key]--
+	if counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
@@ -0,0 +1,88 @@
+package upload
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/strukturag/libheif/go/heif"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+var heicContentTypes = []string{"image/heic", "image/heif"}
+
+// ConvertedHeic is the result of ConvertHeicToJpeg. When the conversion is skipped, Converted is false and
+// Stream contains the original upload.
+type ConvertedHeic struct {
+	Stream      io.ReadCloser
+	ContentType string
+	FileName    string
+	Converted   bool
+	Original    []byte
+}
+
+func ShouldConvertHeic(ctx rcontext.RequestContext, contentType string) bool {
+	return ctx.Config.Uploads.ConvertHeicToJpeg.Enabled && util.ArrayContains(heicContentTypes, contentType)
+}
+
+// ConvertHeicToJpeg re-encodes a HEIC/HEIF upload as a JPEG. The whole upload is read into memory to do this.
+// Uploads which can't be decoded, or which are too large to decode safely, are passed through unchanged.
+func ConvertHeicToJpeg(ctx rcontext.RequestContext, r io.ReadCloser, contentType string, fileName string) (*ConvertedHeic, error) {
+	defer r.Close()
+	original, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	res := &ConvertedHeic{
+		Stream:      io.NopCloser(bytes.NewReader(original)),
+		ContentType: contentType,
+		FileName:    fileName,
+		Original:    original,
+	}
+
+	b, err := convertHeic(ctx, original)
+	if err != nil {
+		ctx.Log.Warn("Storing HEIC upload without converting it: ", err)
+		return res, nil
+	}
+
+	res.Stream = io.NopCloser(bytes.NewReader(b))
+	res.ContentType = "image/jpeg"
+	res.Converted = true
+	if fileName != "" {
+		res.FileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".jpg"
+	}
+	return res, nil
+}
+
+func convertHeic(ctx rcontext.RequestContext, original []byte) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(original))
+	if err != nil {
+		return nil, errors.New("error reading dimensions: " + err.Error())
+	}
+	if (cfg.Width * cfg.Height) >= ctx.Config.Thumbnails.MaxPixels {
+		return nil, errors.New("image has too many pixels")
+	}
+
+	// libheif applies the rotation and mirroring recorded in the container while decoding, so the pixels we
+	// get back are already the right way up.
+	img, _, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return nil, errors.New("error decoding image: " + err.Error())
+	}
+
+	quality := ctx.Config.Uploads.ConvertHeicToJpeg.Quality
+	if quality <= 0 || quality > 100 {
+		quality = jpeg.DefaultQuality
+	}
+	buf := &bytes.Buffer{}
+	if err = jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, errors.New("error encoding jpeg: " + err.Error())
+	}
+	return buf.Bytes(), nil
+}
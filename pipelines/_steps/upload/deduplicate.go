@@ -5,26 +5,27 @@ import (
 	"github.com/t2bot/matrix-media-repo/database"
 )
 
-func FindRecord(ctx rcontext.RequestContext, hash string, userId string, contentType string, fileName string) (*database.DbMedia, bool, error) {
+func FindRecord(ctx rcontext.RequestContext, hash string, origin string, userId string, contentType string, fileName string) (*database.DbMedia, bool, error) {
 	mediaDb := database.GetInstance().Media.Prepare(ctx)
-	records, err := mediaDb.GetByHash(hash)
+	records, err := mediaDb.GetByHashPreferring(hash, origin)
 	if err != nil {
 		return nil, false, err
 	}
-	var perfectMatch *database.DbMedia = nil
-	var hashMatch *database.DbMedia = nil
+	record, perfect := PickRecord(records, origin, userId, contentType, fileName)
+	return record, perfect, nil
+}
+
+// PickRecord chooses which of the records (sorted by database.SortMediaByPreference) an upload should reuse. A
+// perfect match has the same origin, user, content type, and file name as the upload. Otherwise, the first record
+// is returned so its file can be reused. Returns nil if there are no records.
+func PickRecord(records []*database.DbMedia, origin string, userId string, contentType string, fileName string) (*database.DbMedia, bool) {
+	if len(records) == 0 {
+		return nil, false
+	}
 	for _, r := range records {
-		if hashMatch == nil {
-			hashMatch = r
+		if r.Origin == origin && r.UserId == userId && r.ContentType == contentType && r.UploadName == fileName {
+			return r, true
 		}
-		if r.UserId == userId && r.ContentType == r.ContentType && r.UploadName == fileName {
-			perfectMatch = r
-			break
-		}
-	}
-	if perfectMatch != nil {
-		return perfectMatch, true, nil
-	} else {
-		return hashMatch, false, nil
 	}
+	return records[0], false
 }
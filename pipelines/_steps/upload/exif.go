@@ -0,0 +1,59 @@
+package upload
+
+import (
+	"io"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// exifSearchBytes limits how much of a file is searched for EXIF data. Cameras put it near the start.
+const exifSearchBytes = 1024 * 1024
+
+// ExtractExif stores the camera settings from the media's EXIF data, if enabled. Media which shares a file with
+// another upload shares its settings too, so files are only read once.
+func ExtractExif(ctx rcontext.RequestContext, record *database.DbMedia) error {
+	if !ctx.Config.Uploads.ExtractExifMetadata || !strings.HasPrefix(record.ContentType, "image/") {
+		return nil
+	}
+
+	exifDb := database.GetInstance().MediaExif.Prepare(ctx)
+	existing, err := exifDb.Get(record.Sha256Hash)
+	if err != nil || existing != nil {
+		return err
+	}
+
+	dsConf, ok := datastores.Get(ctx, record.DatastoreId)
+	if !ok {
+		return nil // nothing to read from
+	}
+	f, err := datastores.Download(ctx, dsConf, record.Location)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	meta, err := u.GetExifCaptureMetadata(io.LimitReader(f, exifSearchBytes))
+	if err != nil || meta == nil {
+		return err
+	}
+	return exifDb.Insert(exifRecord(record.Sha256Hash, meta))
+}
+
+// exifRecord converts the camera settings read from a file to a database record.
+func exifRecord(sha256hash string, meta *u.ExifCaptureMetadata) *database.DbMediaExif {
+	return &database.DbMediaExif{
+		Sha256Hash:   sha256hash,
+		CameraMake:   meta.CameraMake,
+		CameraModel:  meta.CameraModel,
+		LensModel:    meta.LensModel,
+		FocalLength:  meta.FocalLength,
+		ExposureTime: meta.ExposureTime,
+		FNumber:      meta.FNumber,
+		Iso:          meta.Iso,
+		DateTaken:    meta.DateTaken,
+	}
+}
@@ -0,0 +1,47 @@
+package upload
+
+import (
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// CheckFileName applies the configured maximum file name length, measured in bytes. Names which are too long
+// are either truncated or rejected with common.ErrFileNameTooLong, depending on config. Imports are always
+// truncated so that existing media isn't lost.
+func CheckFileName(ctx rcontext.RequestContext, fileName string) (string, error) {
+	maxLength := ctx.Config.Uploads.MaxFilenameLength
+	if maxLength <= 0 || len(fileName) <= maxLength {
+		return fileName, nil
+	}
+	if ctx.Config.Uploads.RejectLongFilenames && !config.Runtime.IsImportProcess {
+		return "", common.ErrFileNameTooLong
+	}
+	return TruncateFileName(fileName, maxLength), nil
+}
+
+// TruncateFileName shortens the name to at most maxBytes, keeping the extension if it's reasonably short. The
+// name is never cut part way through a UTF-8 character.
+func TruncateFileName(fileName string, maxBytes int) string {
+	if len(fileName) <= maxBytes {
+		return fileName
+	}
+	ext := filepath.Ext(fileName)
+	if len(ext) > maxBytes/2 {
+		ext = ""
+	}
+	return truncateUtf8(fileName[:len(fileName)-len(ext)], maxBytes-len(ext)) + ext
+}
+
+func truncateUtf8(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	for maxBytes > 0 && !utf8.RuneStart(s[maxBytes]) {
+		maxBytes--
+	}
+	return s[:maxBytes]
+}
@@ -3,6 +3,7 @@ package upload
 import (
 	"io"
 
+	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/util/readers"
 )
@@ -14,3 +15,11 @@ func LimitStream(ctx rcontext.RequestContext, r io.ReadCloser) io.ReadCloser {
 		return r
 	}
 }
+
+// CheckMinSize returns common.ErrMediaTooSmall if fewer bytes than the configured minimum were received.
+func CheckMinSize(ctx rcontext.RequestContext, sizeBytes int64) error {
+	if ctx.Config.Uploads.MinSizeBytes > 0 && sizeBytes < ctx.Config.Uploads.MinSizeBytes {
+		return common.ErrMediaTooSmall
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package upload
 import (
 	"context"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
@@ -11,6 +12,19 @@ import (
 
 const maxLockAttemptTime = 30 * time.Second
 
+// localLocks are used instead of Redis locks when Redis isn't configured. They only protect against other
+// requests in this process.
+var localLocksMutex = new(sync.Mutex)
+var localLocks = make(map[string]*localLock)
+
+type localLock struct {
+	ch    chan struct{}
+	users int
+}
+
+// LockForUpload locks the media hash, returning a function to unlock it again. The lock is held while uploads
+// look for existing media with the hash and while media is deleted, so an upload can't reuse a file which is
+// being removed.
 func LockForUpload(ctx rcontext.RequestContext, hash string) (func() error, error) {
 	mutex := redislib.GetMutex(hash, 5*time.Minute)
 	if mutex != nil {
@@ -44,7 +58,49 @@ func LockForUpload(ctx rcontext.RequestContext, hash string) (func() error, erro
 			return nil
 		}, nil
 	} else {
-		ctx.Log.Warn("Continuing upload without lock! Set up Redis to make this warning go away.")
-		return func() error { return nil }, nil
+		ctx.Log.Debug("Redis is not configured - locking within this process only")
+		return lockLocally(ctx, hash)
 	}
 }
+
+func lockLocally(ctx rcontext.RequestContext, hash string) (func() error, error) {
+	localLocksMutex.Lock()
+	lock, ok := localLocks[hash]
+	if !ok {
+		lock = &localLock{ch: make(chan struct{}, 1)}
+		localLocks[hash] = lock
+	}
+	lock.users++
+	localLocksMutex.Unlock()
+
+	release := func() {
+		localLocksMutex.Lock()
+		defer localLocksMutex.Unlock()
+		lock.users--
+		if lock.users <= 0 {
+			delete(localLocks, hash)
+		}
+	}
+
+	timer := time.NewTimer(maxLockAttemptTime)
+	defer timer.Stop()
+	select {
+	case lock.ch <- struct{}{}:
+	case <-ctx.Context.Done():
+		release()
+		return nil, ctx.Context.Err()
+	case <-timer.C:
+		release()
+		return nil, errors.New("failed to acquire upload lock: timeout")
+	}
+
+	once := new(sync.Once)
+	return func() error {
+		once.Do(func() {
+			ctx.Log.Debug("Unlocking upload lock")
+			<-lock.ch
+			release()
+		})
+		return nil
+	}, nil
+}
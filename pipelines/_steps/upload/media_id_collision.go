@@ -0,0 +1,39 @@
+package upload
+
+import (
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+)
+
+// CheckMediaId makes sure the media ID isn't already used by another record before the upload is stored. Generated
+// IDs are replaced with a new one if taken. Otherwise, an existing record to return in place of the upload may be
+// returned (see ResolveMediaIdCollision), along with the media ID to use.
+func CheckMediaId(ctx rcontext.RequestContext, origin string, mediaId string, generated bool, sha256hash string) (string, *database.DbMedia, error) {
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+	existing, err := mediaDb.GetById(origin, mediaId)
+	if err != nil || existing == nil {
+		return mediaId, nil, err
+	}
+	if generated {
+		ctx.Log.Warnf("Generated media ID %s was taken by another upload - picking a new one", mediaId)
+		mediaId, err = GenerateMediaId(ctx, origin)
+		return mediaId, nil, err
+	}
+	existing, err = ResolveMediaIdCollision(ctx, existing, sha256hash)
+	return mediaId, existing, err
+}
+
+// ResolveMediaIdCollision decides what an upload with a specific media ID does when that ID is already used by
+// existing. Uploads of the same content reuse the existing record, as that is what the uploader would have got
+// anyway. Different content is handled according to the uploads.mediaIdCollisions option.
+func ResolveMediaIdCollision(ctx rcontext.RequestContext, existing *database.DbMedia, sha256hash string) (*database.DbMedia, error) {
+	if existing.Sha256Hash == sha256hash {
+		return existing, nil
+	}
+	if ctx.Config.Uploads.MediaIdCollisions == "keepExisting" {
+		ctx.Log.Warnf("Media ID %s is already used for different content - keeping the existing media", existing.MediaId)
+		return existing, nil
+	}
+	return nil, common.ErrMediaIdCollision
+}
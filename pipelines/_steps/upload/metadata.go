@@ -0,0 +1,38 @@
+package upload
+
+import (
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pool"
+)
+
+// QueueMetadataExtraction reads the EXIF data and perceptual hash of the media in the background, so a burst of
+// uploads doesn't compete with request handling. Metadata is best-effort: if the queue is full, the upload goes
+// ahead without it. Missing perceptual hashes are filled in later by the media info endpoint.
+func QueueMetadataExtraction(ctx rcontext.RequestContext, record *database.DbMedia) bool {
+	if !ctx.Config.Uploads.ExtractExifMetadata && !ctx.Config.Uploads.PerceptualHashes {
+		return false
+	}
+	if !strings.HasPrefix(record.ContentType, "image/") {
+		return false
+	}
+
+	ctx = ctx.Detached()
+	queued := pool.MetadataQueue.TrySchedule(func() {
+		if err := ExtractExif(ctx, record); err != nil {
+			ctx.Log.Warn("Non-fatal error reading EXIF data from upload: ", err)
+			sentry.CaptureException(err)
+		}
+		if err := CalculatePerceptualHash(ctx, record); err != nil {
+			ctx.Log.Warn("Non-fatal error calculating perceptual hash of upload: ", err)
+			sentry.CaptureException(err)
+		}
+	})
+	if !queued {
+		ctx.Log.Warn("Metadata extraction queue is full - skipping metadata for upload")
+	}
+	return queued
+}
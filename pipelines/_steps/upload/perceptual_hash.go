@@ -0,0 +1,65 @@
+package upload
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// CalculatePerceptualHash stores a perceptual hash for the media, if enabled, so near-duplicates can be found
+// later. Media which shares a file with another upload shares its hash too, so files are only decoded once.
+// Images which are too large to thumbnail are skipped.
+func CalculatePerceptualHash(ctx rcontext.RequestContext, record *database.DbMedia) error {
+	if !ctx.Config.Uploads.PerceptualHashes || !strings.HasPrefix(record.ContentType, "image/") {
+		return nil
+	}
+	if ctx.Config.Thumbnails.MaxSourceBytes > 0 && record.SizeBytes > ctx.Config.Thumbnails.MaxSourceBytes {
+		return nil
+	}
+
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+	existing, err := mediaDb.GetPerceptualHash(record.Sha256Hash)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		// The new record might not have it yet
+		return mediaDb.SetPerceptualHash(record.Sha256Hash, *existing)
+	}
+
+	dsConf, ok := datastores.Get(ctx, record.DatastoreId)
+	if !ok {
+		return nil // nothing to read from
+	}
+	f, err := datastores.Download(ctx, dsConf, record.Location)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil // not an image we can read
+	}
+	if (cfg.Width * cfg.Height) >= ctx.Config.Thumbnails.MaxPixels {
+		return nil
+	}
+	img, err := imaging.Decode(bytes.NewReader(b))
+	if err != nil {
+		return errors.New("error decoding image: " + err.Error())
+	}
+
+	return mediaDb.SetPerceptualHash(record.Sha256Hash, u.PerceptualHash(img))
+}
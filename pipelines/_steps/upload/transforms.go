@@ -0,0 +1,214 @@
+package upload
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/stripmeta"
+)
+
+const (
+	TransformStripMetadata = "stripMetadata"
+	TransformDownscale     = "downscale"
+	TransformTranscode     = "transcode"
+)
+
+type transform struct {
+	// defaultTypes are the content types the transform applies to when the stage doesn't list any
+	defaultTypes []string
+	// apply changes the media in place, returning false if there was nothing to do
+	apply func(ctx rcontext.RequestContext, conf config.UploadTransformConfig, media *TransformedMedia) (bool, error)
+}
+
+var transforms = map[string]transform{
+	TransformStripMetadata: {
+		defaultTypes: []string{"image/jpeg", "image/png", "image/webp"},
+		apply:        stripMetadataTransform,
+	},
+	TransformDownscale: {
+		defaultTypes: []string{"image/jpeg", "image/png"},
+		apply:        downscaleTransform,
+	},
+	TransformTranscode: {
+		defaultTypes: []string{"image/heic", "image/heif", "image/bmp", "image/tiff"},
+		apply:        transcodeTransform,
+	},
+}
+
+var transcodeExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// TransformedMedia is the result of ApplyTransforms. Applied lists the stages which changed the media, in order.
+type TransformedMedia struct {
+	Data        []byte
+	ContentType string
+	FileName    string
+	Applied     []string
+}
+
+func (m *TransformedMedia) Stream() io.ReadCloser {
+	return io.NopCloser(bytes.NewReader(m.Data))
+}
+
+func ShouldTransform(ctx rcontext.RequestContext) bool {
+	return len(ctx.Config.Uploads.Transforms) > 0
+}
+
+// ApplyTransforms runs the upload through the configured transform stages, in order. Each stage sees the output
+// of the one before it, so a stage only applies if the content type at that point is one it handles. The whole
+// upload is read into memory to do this. Stages which fail are skipped, leaving the media as it was.
+func ApplyTransforms(ctx rcontext.RequestContext, r io.ReadCloser, contentType string, fileName string) (*TransformedMedia, error) {
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	media := &TransformedMedia{
+		Data:        b,
+		ContentType: contentType,
+		FileName:    fileName,
+		Applied:     make([]string, 0),
+	}
+
+	for i, conf := range ctx.Config.Uploads.Transforms {
+		t, ok := transforms[conf.Name]
+		if !ok {
+			ctx.Log.Warnf("Skipping unknown upload transform '%s' (stage %d)", conf.Name, i+1)
+			continue
+		}
+		contentTypes := conf.ContentTypes
+		if len(contentTypes) == 0 {
+			contentTypes = t.defaultTypes
+		}
+		if !util.ArrayContains(contentTypes, media.ContentType) {
+			continue
+		}
+
+		// Work on a copy so a failed stage can't leave half-transformed media behind
+		result := *media
+		changed, err := t.apply(ctx, conf, &result)
+		if err != nil {
+			ctx.Log.Warnf("Skipping upload transform '%s' (stage %d): %s", conf.Name, i+1, err.Error())
+			continue
+		}
+		if changed {
+			media = &result
+			media.Applied = append(media.Applied, conf.Name)
+		}
+	}
+
+	return media, nil
+}
+
+func stripMetadataTransform(ctx rcontext.RequestContext, conf config.UploadTransformConfig, media *TransformedMedia) (bool, error) {
+	if !stripmeta.Supported(media.ContentType) {
+		return false, errors.New("unsupported content type " + media.ContentType)
+	}
+	b, err := stripmeta.Strip(media.ContentType, media.Data)
+	if err != nil {
+		return false, err
+	}
+	media.Data = b
+	return true, nil
+}
+
+func downscaleTransform(ctx rcontext.RequestContext, conf config.UploadTransformConfig, media *TransformedMedia) (bool, error) {
+	if conf.MaxWidth <= 0 && conf.MaxHeight <= 0 {
+		return false, errors.New("maxWidth or maxHeight must be set")
+	}
+	img, err := decodeForTransform(ctx, media.Data)
+	if err != nil {
+		return false, err
+	}
+
+	maxWidth := conf.MaxWidth
+	if maxWidth <= 0 {
+		maxWidth = img.Bounds().Dx()
+	}
+	maxHeight := conf.MaxHeight
+	if maxHeight <= 0 {
+		maxHeight = img.Bounds().Dy()
+	}
+	if img.Bounds().Dx() <= maxWidth && img.Bounds().Dy() <= maxHeight {
+		return false, nil // already small enough
+	}
+
+	b, err := encodeForTransform(imaging.Fit(img, maxWidth, maxHeight, imaging.Lanczos), media.ContentType, conf.Quality)
+	if err != nil {
+		return false, err
+	}
+	media.Data = b
+	return true, nil
+}
+
+func transcodeTransform(ctx rcontext.RequestContext, conf config.UploadTransformConfig, media *TransformedMedia) (bool, error) {
+	ext, ok := transcodeExtensions[conf.TargetType]
+	if !ok {
+		return false, errors.New("unsupported targetType " + conf.TargetType)
+	}
+	if media.ContentType == conf.TargetType {
+		return false, nil
+	}
+	img, err := decodeForTransform(ctx, media.Data)
+	if err != nil {
+		return false, err
+	}
+	b, err := encodeForTransform(img, conf.TargetType, conf.Quality)
+	if err != nil {
+		return false, err
+	}
+	media.Data = b
+	media.ContentType = conf.TargetType
+	if media.FileName != "" {
+		media.FileName = strings.TrimSuffix(media.FileName, filepath.Ext(media.FileName)) + ext
+	}
+	return true, nil
+}
+
+// decodeForTransform decodes the image, applying any EXIF orientation as re-encoding won't keep it.
+func decodeForTransform(ctx rcontext.RequestContext, b []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.New("error reading dimensions: " + err.Error())
+	}
+	if (cfg.Width * cfg.Height) >= ctx.Config.Thumbnails.MaxPixels {
+		return nil, errors.New("image has too many pixels")
+	}
+	img, err := imaging.Decode(bytes.NewReader(b), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, errors.New("error decoding image: " + err.Error())
+	}
+	return img, nil
+}
+
+func encodeForTransform(img image.Image, contentType string, quality int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		if quality <= 0 || quality > 100 {
+			quality = jpeg.DefaultQuality
+		}
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: quality})
+	case "image/png":
+		err = png.Encode(buf, img)
+	default:
+		return nil, errors.New("cannot encode " + contentType)
+	}
+	if err != nil {
+		return nil, errors.New("error encoding image: " + err.Error())
+	}
+	return buf.Bytes(), nil
+}
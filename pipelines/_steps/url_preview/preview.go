@@ -22,9 +22,15 @@ func Preview(ctx rcontext.RequestContext, targetUrl *m.UrlPayload, languageHeade
 		err := m.ErrPreviewUnsupported
 
 		// Try oEmbed first
+		oEmbedFailed := false
 		if ctx.Config.UrlPreviews.OEmbed {
 			ctx.Log.Debug("Trying oEmbed previewer")
 			preview, err = p.GenerateOEmbedPreview(targetUrl, languageHeader, ctx)
+			if err != nil && !errors.Is(err, m.ErrPreviewUnsupported) {
+				// The page itself might still be previewable without the provider's help
+				oEmbedFailed = true
+				err = m.ErrPreviewUnsupported
+			}
 		}
 
 		// Try OpenGraph if that failed
@@ -39,6 +45,10 @@ func Preview(ctx rcontext.RequestContext, targetUrl *m.UrlPayload, languageHeade
 			preview, err = p.GenerateCalculatedPreview(targetUrl, languageHeader, ctx)
 		}
 
+		if err == nil && oEmbedFailed {
+			preview.Warnings = m.AddWarning(preview.Warnings, m.WarningOEmbedFailed)
+		}
+
 		ch <- generateResult{
 			preview: preview,
 			err:     err,
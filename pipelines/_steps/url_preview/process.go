@@ -8,6 +8,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/url_previewing/m"
+	"github.com/t2bot/matrix-media-repo/util"
 )
 
 func Process(ctx rcontext.RequestContext, previewUrl string, preview m.PreviewResult, err error, onHost string, userId string, languageHeader string, ts int64) (*database.DbUrlPreview, error) {
@@ -20,6 +21,10 @@ func Process(ctx rcontext.RequestContext, previewUrl string, preview m.PreviewRe
 
 		if errors.Is(err, common.ErrMediaNotFound) {
 			previewDb.InsertError(previewUrl, common.ErrCodeNotFound)
+		} else if errors.Is(err, m.ErrOriginRateLimited) {
+			previewDb.InsertError(previewUrl, common.ErrCodeOriginRateLimited)
+		} else if errors.Is(err, m.ErrTransferFailed) {
+			previewDb.InsertError(previewUrl, common.ErrCodeRemoteFetchFailed)
 		} else {
 			previewDb.InsertError(previewUrl, common.ErrCodeUnknown)
 		}
@@ -35,10 +40,46 @@ func Process(ctx rcontext.RequestContext, previewUrl string, preview m.PreviewRe
 			Description:    preview.Description,
 			Title:          preview.Title,
 			LanguageHeader: languageHeader,
+			FileType:       preview.FileType,
+			FileSize:       preview.FileSize,
+			Warnings:       preview.Warnings,
+		}
+		uploadImage := func(img *m.PreviewImage, maxBytes int64) *database.DbUrlPreviewImage {
+			stored, err := UploadImage(ctx, img, onHost, userId, maxBytes)
+			if err != nil {
+				result.Warnings = m.AddWarning(result.Warnings, m.ImageWarning(err))
+			}
+			return stored
 		}
 
-		// Step 7: Store the thumbnail, if needed
-		UploadImage(ctx, preview.Image, onHost, userId, result)
+		// Step 7: Store the thumbnail(s), if needed
+		galleryConf := ctx.Config.UrlPreviews.Gallery
+		if !galleryConf.Enabled {
+			applyPrimaryImage(result, uploadImage(preview.Image, 0))
+		} else {
+			result.Gallery = make(database.DbUrlPreviewGallery, 0)
+			maxImages := util.MaxInt(galleryConf.MaxImages, 1)
+			remainingBytes := galleryConf.MaxBytes
+			for _, img := range append([]*m.PreviewImage{preview.Image}, preview.ExtraImages...) {
+				if len(result.Gallery) >= maxImages || (galleryConf.MaxBytes > 0 && remainingBytes <= 0) {
+					if img != nil && img.Data != nil {
+						_ = img.Data.Close()
+					}
+					continue
+				}
+				limit := int64(0) // no limit
+				if galleryConf.MaxBytes > 0 {
+					limit = remainingBytes
+				}
+				if stored := uploadImage(img, limit); stored != nil {
+					result.Gallery = append(result.Gallery, stored)
+					remainingBytes -= stored.Size
+				}
+			}
+			if len(result.Gallery) > 0 {
+				applyPrimaryImage(result, result.Gallery[0])
+			}
+		}
 
 		// Step 8: Insert the record
 		err = previewDb.Insert(result)
@@ -50,3 +91,14 @@ func Process(ctx rcontext.RequestContext, previewUrl string, preview m.PreviewRe
 		return result, nil
 	}
 }
+
+func applyPrimaryImage(record *database.DbUrlPreview, image *database.DbUrlPreviewImage) {
+	if image == nil {
+		return
+	}
+	record.ImageMxc = image.Mxc
+	record.ImageType = image.Type
+	record.ImageSize = image.Size
+	record.ImageWidth = image.Width
+	record.ImageHeight = image.Height
+}
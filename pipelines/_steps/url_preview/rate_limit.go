@@ -0,0 +1,79 @@
+package url_preview
+
+import (
+	"sync"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"golang.org/x/time/rate"
+)
+
+// Limits are per-process: when running multiple media repo processes, each enforces the limits separately.
+var previewLimitsLock = new(sync.Mutex)
+var previewLimitsByUser = make(map[string]*rate.Limiter)
+var previewLimitsByIp = make(map[string]*rate.Limiter)
+var previewLimitsSwept = time.Now()
+
+// CheckRateLimit takes one of the user's (and IP address's) preview requests, returning a *common.RateLimitedError
+// if either has made too many recently. Only previews which need generating should be checked, as cached ones don't
+// contact anything.
+func CheckRateLimit(ctx rcontext.RequestContext, userId string, ipAddr string) error {
+	limits := ctx.Config.UrlPreviews.RateLimit
+	now := time.Now()
+
+	previewLimitsLock.Lock()
+	defer previewLimitsLock.Unlock()
+
+	if now.Sub(previewLimitsSwept) > time.Minute {
+		sweepLimiters(previewLimitsByUser, now)
+		sweepLimiters(previewLimitsByIp, now)
+		previewLimitsSwept = now
+	}
+
+	var reservations []*rate.Reservation
+	var wait time.Duration
+	if userId != "" && limits.PerUser.PerMinute > 0 {
+		r := reserve(previewLimitsByUser, userId, limits.PerUser, now)
+		reservations = append(reservations, r)
+		wait = max(wait, r.DelayFrom(now))
+	}
+	if ipAddr != "" && limits.PerIp.PerMinute > 0 {
+		r := reserve(previewLimitsByIp, ipAddr, limits.PerIp, now)
+		reservations = append(reservations, r)
+		wait = max(wait, r.DelayFrom(now))
+	}
+	if wait > 0 {
+		// Neither is used up when the request isn't allowed
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+		return &common.RateLimitedError{RetryAfter: wait}
+	}
+	return nil
+}
+
+func reserve(limiters map[string]*rate.Limiter, key string, conf config.UrlPreviewRate, now time.Time) *rate.Reservation {
+	limit := rate.Limit(conf.PerMinute / 60)
+	burst := max(1, conf.Burst)
+	l, ok := limiters[key]
+	if !ok {
+		l = rate.NewLimiter(limit, burst)
+		limiters[key] = l
+	} else if l.Limit() != limit || l.Burst() != burst {
+		// The config was changed
+		l.SetLimitAt(now, limit)
+		l.SetBurstAt(now, burst)
+	}
+	return l.ReserveN(now, 1)
+}
+
+// sweepLimiters forgets keys which have no requests counting against them anymore.
+func sweepLimiters(limiters map[string]*rate.Limiter, now time.Time) {
+	for key, l := range limiters {
+		if l.TokensAt(now) >= float64(l.Burst()) {
+			delete(limiters, key)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package url_preview
 
 import (
+	"errors"
 	"io"
 
 	"github.com/getsentry/sentry-go"
@@ -10,18 +11,43 @@ import (
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
 	"github.com/t2bot/matrix-media-repo/thumbnailing"
 	"github.com/t2bot/matrix-media-repo/url_previewing/m"
+	"github.com/t2bot/matrix-media-repo/url_previewing/u"
 	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/readers"
 )
 
-func UploadImage(ctx rcontext.RequestContext, image *m.PreviewImage, onHost string, userId string, forRecord *database.DbUrlPreview) {
+type uploadResult struct {
+	media *database.DbMedia
+	err   error
+}
+
+// UploadImage stores the preview image as local media, returning an error if the image could not be stored. If
+// maxBytes is greater than zero, images larger than that many bytes are not stored (common.ErrMediaTooLarge).
+// When there is no image, nil is returned for both.
+func UploadImage(ctx rcontext.RequestContext, image *m.PreviewImage, onHost string, userId string, maxBytes int64) (*database.DbUrlPreviewImage, error) {
 	if image == nil || image.Data == nil {
-		return
+		return nil, nil
+	}
+
+	image = u.ResizeImage(image, ctx)
+	if image == nil {
+		return nil, errors.New("error resizing image")
+	}
+	if u.IsSvg(image.ContentType) && ctx.Config.UrlPreviews.SvgImages != u.SvgImagesStore {
+		// The SVG should have been rasterized, but wasn't, and isn't allowed to be stored as it is
+		_ = image.Data.Close()
+		return nil, errors.New("svg preview image could not be rasterized")
 	}
 
 	defer image.Data.Close()
+	var data io.ReadCloser = image.Data
+	if maxBytes > 0 {
+		data = readers.LimitReaderWithOverrunError(image.Data, maxBytes)
+	}
+	startTs := util.NowMillis()
 	pr, pw := io.Pipe()
-	tee := io.TeeReader(image.Data, pw)
-	mediaChan := make(chan *database.DbMedia)
+	tee := io.TeeReader(data, pw)
+	mediaChan := make(chan uploadResult)
 	defer close(mediaChan)
 	go func() {
 		media, err := pipeline_upload.Execute(ctx, onHost, "", io.NopCloser(tee), image.ContentType, image.Filename, userId, datastores.LocalMediaKind)
@@ -34,35 +60,57 @@ func UploadImage(ctx rcontext.RequestContext, image *m.PreviewImage, onHost stri
 			defer func() {
 				recover() // consume write-to-closed-channel errors
 			}()
-			mediaChan <- media
+			mediaChan <- uploadResult{media, err}
 		}()
 	}()
 
 	w := 0
 	h := 0
-	g, r, err := thumbnailing.GetGenerator(pr, image.ContentType, false)
-	_, _ = io.Copy(io.Discard, pr)
-	if err != nil {
-		ctx.Log.Warn("Non-fatal error handling URL preview thumbnail: ", err)
-		sentry.CaptureException(err)
-		return
-	}
-	if g != nil {
-		_, w, h, err = g.GetOriginDimensions(r, image.ContentType, ctx)
+	if u.IsSvg(image.ContentType) {
+		// SVGs which weren't rasterized are stored as they are, without dimensions, so don't need the (possibly
+		// disabled) SVG generator
+		_, _ = io.Copy(io.Discard, pr)
+	} else {
+		g, r, err := thumbnailing.GetGenerator(pr, image.ContentType, false, ctx)
+		_, _ = io.Copy(io.Discard, pr)
 		if err != nil {
-			ctx.Log.Warn("Non-fatal error getting URL preview thumbnail dimensions: ", err)
+			ctx.Log.Warn("Non-fatal error handling URL preview thumbnail: ", err)
 			sentry.CaptureException(err)
+			return nil, err
+		}
+		if g != nil {
+			_, w, h, err = g.GetOriginDimensions(r, image.ContentType, ctx)
+			if err != nil {
+				ctx.Log.Warn("Non-fatal error getting URL preview thumbnail dimensions: ", err)
+				sentry.CaptureException(err)
+			}
 		}
 	}
 
-	record := <-mediaChan
+	uploaded := <-mediaChan
+	if uploaded.err != nil {
+		return nil, uploaded.err
+	}
+	record := uploaded.media
 	if record == nil {
-		return
+		return nil, errors.New("image was not stored")
+	}
+
+	// Mark the image so it can be purged separately from user media. If the image was deduplicated against an
+	// existing record, that record might be someone's upload, so it's left alone.
+	if record.CreationTs >= startTs {
+		err := database.GetInstance().MediaAttributes.Prepare(ctx).UpsertPurpose(record.Origin, record.MediaId, database.PurposeUrlPreview)
+		if err != nil {
+			ctx.Log.Warn("Non-fatal error marking URL preview image: ", err)
+			sentry.CaptureException(err)
+		}
 	}
 
-	forRecord.ImageMxc = util.MxcUri(record.Origin, record.MediaId)
-	forRecord.ImageType = record.ContentType
-	forRecord.ImageSize = record.SizeBytes
-	forRecord.ImageWidth = w
-	forRecord.ImageHeight = h
+	return &database.DbUrlPreviewImage{
+		Mxc:    util.MxcUri(record.Origin, record.MediaId),
+		Type:   record.ContentType,
+		Size:   record.SizeBytes,
+		Width:  w,
+		Height: h,
+	}, nil
 }
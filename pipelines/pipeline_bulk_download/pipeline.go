@@ -0,0 +1,141 @@
+package pipeline_bulk_download
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// Values for downloads.bulk.quarantined
+const (
+	QuarantinedSkip  = "skip"
+	QuarantinedError = "error"
+)
+
+type MediaId struct {
+	Origin  string
+	MediaId string
+}
+
+// Execute streams the media as a ZIP file. The records are all looked up first, so missing media
+// (common.ErrMediaNotFound), quarantined media (common.ErrMediaQuarantined, depending on downloads.bulk.quarantined),
+// and requests which are too large (common.ErrMediaTooLarge) are rejected before anything is sent. Only media
+// already stored by the media repo is included.
+func Execute(ctx rcontext.RequestContext, ids []MediaId) (io.ReadCloser, error) {
+	db := database.GetInstance().Media.Prepare(ctx)
+	records := make([]*database.DbMedia, 0, len(ids))
+	totalBytes := int64(0)
+	for _, id := range ids {
+		record, err := db.GetById(id.Origin, id.MediaId)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil || record.Locatable == nil || record.DatastoreId == "" {
+			return nil, fmt.Errorf("%w: %s", common.ErrMediaNotFound, util.MxcUri(id.Origin, id.MediaId))
+		}
+		if record.Quarantined {
+			if ctx.Config.Downloads.Bulk.Quarantined == QuarantinedError {
+				return nil, fmt.Errorf("%w: %s", common.ErrMediaQuarantined, util.MxcUri(id.Origin, id.MediaId))
+			}
+			continue
+		}
+		totalBytes += record.SizeBytes
+		if ctx.Config.Downloads.Bulk.MaxSizeBytes > 0 && totalBytes > ctx.Config.Downloads.Bulk.MaxSizeBytes {
+			return nil, common.ErrMediaTooLarge
+		}
+		records = append(records, record)
+	}
+
+	return Zip(ctx, records), nil
+}
+
+// Zip streams the media as a ZIP file, without checking whether it should be. The file is generated as it is read,
+// one piece of media at a time. If any media can't be read, the error is returned from reading the ZIP file.
+func Zip(ctx rcontext.RequestContext, records []*database.DbMedia) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := zip.NewWriter(pw)
+		names := EntryNames(records)
+		for i, record := range records {
+			if err := writeEntry(ctx, zw, names[i], record); err != nil {
+				if errors.Is(err, io.ErrClosedPipe) {
+					ctx.Log.Debug("ZIP file closed before it was finished")
+				} else {
+					ctx.Log.Error("Error adding media to ZIP file: ", err)
+					sentry.CaptureException(err)
+				}
+				_ = pw.CloseWithError(err)
+				return
+			}
+		}
+		_ = pw.CloseWithError(zw.Close())
+	}()
+	return pr
+}
+
+func writeEntry(ctx rcontext.RequestContext, zw *zip.Writer, name string, record *database.DbMedia) error {
+	f, err := download.OpenStream(ctx, record.Locatable)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.UnixMilli(record.CreationTs),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// EntryNames returns the name of each record in a ZIP file: its upload name, or the media ID (with an extension for
+// its content type) when it doesn't have one. Names are made unique by numbering repeats, like "cat (2).png".
+func EntryNames(records []*database.DbMedia) []string {
+	names := make([]string, len(records))
+	used := make(map[string]bool)
+	for i, record := range records {
+		name := sanitizeEntryName(record.UploadName)
+		if name == "" {
+			name = record.MediaId + util.ExtensionForContentType(util.FixContentType(record.ContentType))
+		}
+
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		candidate := name
+		for n := 2; used[strings.ToLower(candidate)]; n++ {
+			candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		used[strings.ToLower(candidate)] = true
+		names[i] = candidate
+	}
+	return names
+}
+
+// sanitizeEntryName keeps upload names from escaping the directory the ZIP file is extracted to, or being hidden.
+func sanitizeEntryName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		if r == '/' || r == '\\' || r == ':' {
+			return '_'
+		}
+		return r
+	}, name)
+	return strings.TrimLeft(strings.TrimSpace(name), ".")
+}
@@ -1,6 +1,8 @@
 package pipeline_create
 
 import (
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/quota"
@@ -11,6 +13,11 @@ import (
 const DefaultExpirationTime = 0
 
 func Execute(ctx rcontext.RequestContext, origin string, userId string, expirationTime int64) (*database.DbExpiringMedia, error) {
+	// Step 0: Don't reserve media IDs while read-only, as they couldn't be uploaded to
+	if config.IsReadOnly() {
+		return nil, common.ErrReadOnly
+	}
+
 	// Step 1: Check quota
 	if err := quota.Check(ctx, userId, quota.MaxPending); err != nil {
 		return nil, err
@@ -10,11 +10,13 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/go-singleflight-streams"
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/meta"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/quarantine"
+	"github.com/t2bot/matrix-media-repo/util"
 	"github.com/t2bot/matrix-media-repo/util/readers"
 	"github.com/t2bot/matrix-media-repo/util/sfcache"
 )
@@ -31,6 +33,9 @@ type DownloadOpts struct {
 	BlockForReadUntil   time.Duration
 	RecordOnly          bool
 	CanRedirect         bool
+
+	// Range is forwarded to the origin when the remote media isn't stored yet. See download.TryDownloadRange
+	Range *download.RemoteRange
 }
 
 func (o DownloadOpts) String() string {
@@ -38,6 +43,8 @@ func (o DownloadOpts) String() string {
 }
 
 func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts DownloadOpts) (*database.DbMedia, io.ReadCloser, error) {
+	origin = util.CanonicalServerName(origin)
+
 	// Step 1: Make our context a timeout context
 	var cancel context.CancelFunc
 	//goland:noinspection GoVetLostCancel - we handle the function in our custom cancelCloser struct
@@ -62,6 +69,27 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Do
 		cancel()
 		return nil, nil, err
 	}
+
+	// Step 2a: If we don't have the remote media, ask the origin for just the range we need rather than waiting
+	// for everything before it. Unless we're read-only, the whole media is then stored in the background for
+	// later requests. Ranges from the start are served while the whole media is downloaded and stored instead,
+	// as that needs nothing more from the origin. This skips the stream singleflight because ranged requests are
+	// unlikely to overlap exactly.
+	if record == nil && opts.Range != nil && opts.FetchRemoteIfNeeded && !opts.RecordOnly && (config.IsReadOnly() || opts.Range.Start > 0) {
+		record, r, err := download.TryDownloadRange(ctx, origin, mediaId, *opts.Range)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		if !config.IsReadOnly() {
+			storeInBackground(ctx, origin, mediaId, opts)
+		}
+		if ranged, ok := r.(*download.RangedStream); ok {
+			return record, &download.RangedStream{ReadCloser: readers.NewCancelCloser(ranged.ReadCloser, cancel), Range: ranged.Range}, nil
+		}
+		return record, readers.NewCancelCloser(r, cancel), nil
+	}
+
 	r, err, _ := streamSf.Do(sfKey, func() (io.ReadCloser, error) {
 		// Step 3: Do we already have the media? Serve it if yes.
 		if record != nil {
@@ -72,17 +100,16 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Do
 			if opts.RecordOnly {
 				return nil, nil
 			}
-			if opts.CanRedirect {
-				return download.OpenOrRedirect(ctx, record.Locatable)
-			} else {
-				return download.OpenStream(ctx, record.Locatable)
-			}
+			return download.OpenCached(ctx, record.Locatable, record.SizeBytes, opts.CanRedirect)
 		}
 
 		// Step 4: Media record unknown - download it (if possible)
-		if !opts.FetchRemoteIfNeeded {
+		if util.IsServerOurs(origin) {
 			return nil, common.ErrMediaNotFound
 		}
+		if !opts.FetchRemoteIfNeeded {
+			return nil, common.ErrRemoteFetchDisabled
+		}
 		record, r, err := download.TryDownload(ctx, origin, mediaId)
 		if err != nil {
 			return nil, err
@@ -91,7 +118,9 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Do
 		if record.Quarantined {
 			return quarantine.ReturnAppropriateThing(ctx, true, opts.RecordOnly, 512, 512)
 		}
-		meta.FlagAccess(ctx, record.Sha256Hash, record.CreationTs)
+		if record.DatastoreId != "" { // not stored when read-only
+			meta.FlagAccess(ctx, record.Sha256Hash, record.CreationTs)
+		}
 		if opts.RecordOnly {
 			r.Close()
 			return nil, nil
@@ -132,3 +161,19 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Do
 	}
 	return record, readers.NewCancelCloser(r, cancel), nil
 }
+
+// storeInBackground downloads and stores the whole of the remote media after a ranged request for it, without the
+// requester waiting. Other ranged requests for the media while it is downloading share the download.
+func storeInBackground(ctx rcontext.RequestContext, origin string, mediaId string, opts DownloadOpts) {
+	ctx.Context = context.WithoutCancel(ctx.Context)
+	go func() {
+		_, _, err := Execute(ctx, origin, mediaId, DownloadOpts{
+			FetchRemoteIfNeeded: true,
+			BlockForReadUntil:   opts.BlockForReadUntil,
+			RecordOnly:          true,
+		})
+		if err != nil {
+			ctx.Log.Warn("Error storing remote media after a ranged request: ", err)
+		}
+	}()
+}
@@ -0,0 +1,73 @@
+package pipeline_prefetch
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+var prefetcher *Prefetcher
+var prefetcherLock = new(sync.Mutex)
+
+// Execute queues remote media to be downloaded in the background. Prefetching must be enabled, and the origin
+// must be allowed for both prefetching and federation in general.
+func Execute(ctx rcontext.RequestContext, origin string, mediaId string) error {
+	conf := config.Get().Downloads.Prefetch
+	if !conf.Enabled {
+		return common.ErrRemoteFetchDisabled
+	}
+	if util.IsServerOurs(origin) || util.IsHostIgnored(origin) {
+		return common.ErrHostNotAllowed
+	}
+
+	prefetcherLock.Lock()
+	if prefetcher == nil {
+		prefetcher = NewPrefetcher(conf, downloadRecord)
+	}
+	p := prefetcher
+	prefetcherLock.Unlock()
+
+	err := p.Enqueue(origin, mediaId)
+	if err == nil {
+		ctx.Log.Debugf("Queued %s for prefetching", util.MxcUri(origin, mediaId))
+	}
+	return err
+}
+
+// Reset stops the prefetch queue (once it's empty), so the next prefetch starts a new one with the latest config.
+func Reset() {
+	prefetcherLock.Lock()
+	p := prefetcher
+	prefetcher = nil
+	prefetcherLock.Unlock()
+	if p != nil {
+		p.Stop()
+	}
+}
+
+func downloadRecord(origin string, mediaId string) error {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{
+		"prefetch": util.MxcUri(origin, mediaId),
+	})
+	// Downloads are limited by the regular (size, single-flight, failure caching) rules
+	_, _, err := pipeline_download.Execute(ctx, origin, mediaId, pipeline_download.DownloadOpts{
+		FetchRemoteIfNeeded: true,
+		BlockForReadUntil:   time.Duration(ctx.Config.TimeoutSeconds.Federation) * time.Second,
+		RecordOnly:          true,
+	})
+	if err != nil && !errors.Is(err, common.ErrMediaNotFound) && !errors.Is(err, common.ErrMediaQuarantined) {
+		ctx.Log.Warn("Error prefetching remote media: ", err)
+		if !errors.Is(err, common.ErrRemoteFetchFailed) && !errors.Is(err, common.ErrMediaTooLarge) {
+			sentry.CaptureException(err)
+		}
+	}
+	return err
+}
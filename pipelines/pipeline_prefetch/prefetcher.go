@@ -0,0 +1,165 @@
+package pipeline_prefetch
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanuber/go-glob"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// FetchFunc downloads a single piece of remote media, if it isn't already known.
+type FetchFunc func(origin string, mediaId string) error
+
+type prefetchItem struct {
+	origin  string
+	mediaId string
+}
+
+type originState struct {
+	active   int
+	nextSlot time.Time
+}
+
+// Prefetcher downloads remote media in the background, ahead of anyone asking for it. The queue is bounded,
+// and each origin is limited in how many downloads it can have running and how often they can start.
+type Prefetcher struct {
+	conf    config.PrefetchConfig
+	fetchFn FetchFunc
+	queue   chan prefetchItem
+	workers *sync.WaitGroup
+
+	lock     *sync.Mutex
+	pending  map[string]bool
+	origins  map[string]*originState
+	released chan struct{} // closed (and replaced) whenever an origin slot is released
+	stopped  bool
+}
+
+func NewPrefetcher(conf config.PrefetchConfig, fetchFn FetchFunc) *Prefetcher {
+	p := &Prefetcher{
+		conf:     conf,
+		fetchFn:  fetchFn,
+		queue:    make(chan prefetchItem, max(1, conf.QueueSize)),
+		workers:  new(sync.WaitGroup),
+		lock:     new(sync.Mutex),
+		pending:  make(map[string]bool),
+		origins:  make(map[string]*originState),
+		released: make(chan struct{}),
+	}
+	for i := 0; i < max(1, conf.NumWorkers); i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// IsOriginAllowed returns whether the origin matches the configured allowlist. An empty allowlist allows all
+// origins.
+func (p *Prefetcher) IsOriginAllowed(origin string) bool {
+	if len(p.conf.AllowedOrigins) == 0 {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, pattern := range p.conf.AllowedOrigins {
+		if glob.Glob(strings.ToLower(pattern), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enqueue adds the media to the prefetch queue without waiting for it to download. Media which is already
+// queued is ignored. If the queue is full, common.ErrPrefetchQueueFull is returned.
+func (p *Prefetcher) Enqueue(origin string, mediaId string) error {
+	if !p.IsOriginAllowed(origin) {
+		return common.ErrHostNotAllowed
+	}
+
+	mxc := util.MxcUri(origin, mediaId)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stopped {
+		return common.ErrPrefetchQueueFull
+	}
+	if p.pending[mxc] {
+		return nil
+	}
+	select {
+	case p.queue <- prefetchItem{origin: origin, mediaId: mediaId}:
+		p.pending[mxc] = true
+		return nil
+	default:
+		return common.ErrPrefetchQueueFull
+	}
+}
+
+// Stop prevents further media from being queued, and waits for the queue to be drained.
+func (p *Prefetcher) Stop() {
+	p.lock.Lock()
+	if p.stopped {
+		p.lock.Unlock()
+		return
+	}
+	p.stopped = true
+	close(p.queue)
+	p.lock.Unlock()
+	p.workers.Wait()
+}
+
+func (p *Prefetcher) work() {
+	defer p.workers.Done()
+	for item := range p.queue {
+		p.acquireOrigin(item.origin)
+		_ = p.fetchFn(item.origin, item.mediaId)
+		p.releaseOrigin(item.origin)
+
+		p.lock.Lock()
+		delete(p.pending, util.MxcUri(item.origin, item.mediaId))
+		p.lock.Unlock()
+	}
+}
+
+// acquireOrigin waits until the origin has a free download slot, and enough time has passed since the last
+// download to that origin started.
+func (p *Prefetcher) acquireOrigin(origin string) {
+	interval := time.Duration(p.conf.OriginIntervalMs) * time.Millisecond
+	for {
+		p.lock.Lock()
+		state, ok := p.origins[origin]
+		if !ok {
+			state = &originState{}
+			p.origins[origin] = state
+		}
+		now := time.Now()
+		if p.conf.MaxPerOrigin <= 0 || state.active < p.conf.MaxPerOrigin {
+			if wait := state.nextSlot.Sub(now); wait > 0 {
+				p.lock.Unlock()
+				time.Sleep(wait)
+				continue
+			}
+			state.active++
+			state.nextSlot = now.Add(interval)
+			p.lock.Unlock()
+			return
+		}
+		released := p.released
+		p.lock.Unlock()
+		<-released
+	}
+}
+
+func (p *Prefetcher) releaseOrigin(origin string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	state := p.origins[origin]
+	state.active--
+	if state.active <= 0 && time.Now().After(state.nextSlot) {
+		delete(p.origins, origin)
+	}
+	close(p.released)
+	p.released = make(chan struct{})
+}
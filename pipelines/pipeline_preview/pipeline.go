@@ -19,6 +19,12 @@ var sf = new(singleflight.Group)
 type PreviewOpts struct {
 	Timestamp      int64
 	LanguageHeader string
+
+	// OnlyIfCached returns ErrMediaNotFound instead of generating a preview when there isn't one cached already
+	OnlyIfCached bool
+
+	// IpAddr is the address of the requester, for rate limiting
+	IpAddr string
 }
 
 func Execute(ctx rcontext.RequestContext, onHost string, previewUrl string, userId string, opts PreviewOpts) (*database.DbUrlPreview, error) {
@@ -38,8 +44,19 @@ func Execute(ctx rcontext.RequestContext, onHost string, previewUrl string, user
 		return Execute(ctx, onHost, previewUrl, userId, PreviewOpts{
 			Timestamp:      now,
 			LanguageHeader: opts.LanguageHeader,
+			OnlyIfCached:   opts.OnlyIfCached,
+			IpAddr:         opts.IpAddr,
 		})
 	}
+	if opts.OnlyIfCached {
+		return nil, common.ErrMediaNotFound
+	}
+
+	// Step 2a: Make sure the requester hasn't generated too many previews recently. Cached previews (above) don't
+	// count, as they don't contact anything.
+	if err = url_preview.CheckRateLimit(ctx, userId, opts.IpAddr); err != nil {
+		return nil, err
+	}
 
 	// Step 3: Process the URL
 	parsedUrl, err := url.Parse(previewUrl)
@@ -15,6 +15,8 @@ import (
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/quarantine"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/util"
 	"github.com/t2bot/matrix-media-repo/util/readers"
 	"github.com/t2bot/matrix-media-repo/util/sfcache"
 )
@@ -33,10 +35,19 @@ type ThumbnailOpts struct {
 	Height   int
 	Method   string
 	Animated bool
+
+	// SubImage, if set, is the index of the image to thumbnail from formats which hold several. These thumbnails
+	// are generated each time they are requested rather than stored, though requests at the same time share one
+	// generation. When nil, the primary image is used.
+	SubImage *int
 }
 
 func (o ThumbnailOpts) String() string {
-	return fmt.Sprintf("%s,w=%d,h=%d,m=%s,a=%t", o.DownloadOpts.String(), o.Width, o.Height, o.Method, o.Animated)
+	s := fmt.Sprintf("%s,w=%d,h=%d,m=%s,a=%t", o.DownloadOpts.String(), o.Width, o.Height, o.Method, o.Animated)
+	if o.SubImage != nil {
+		s += fmt.Sprintf(",s=%d", *o.SubImage)
+	}
+	return s
 }
 
 func (o ThumbnailOpts) ImpliedDownloadOpts() pipeline_download.DownloadOpts {
@@ -48,7 +59,13 @@ func (o ThumbnailOpts) ImpliedDownloadOpts() pipeline_download.DownloadOpts {
 }
 
 func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts ThumbnailOpts) (*database.DbThumbnail, io.ReadCloser, error) {
+	origin = util.CanonicalServerName(origin)
+
 	// Step 1: Fix the request parameters
+	opts, err1 := fillAutoAspect(ctx, origin, mediaId, opts)
+	if err1 != nil {
+		return nil, nil, err1
+	}
 	w, h, method, err1 := thumbnails.PickNewDimensions(ctx, opts.Width, opts.Height, opts.Method)
 	if err1 != nil {
 		return nil, nil, err1
@@ -56,6 +73,9 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 	opts.Width = w
 	opts.Height = h
 	opts.Method = method
+	if opts.SubImage != nil {
+		return executeSubImage(ctx, origin, mediaId, opts)
+	}
 
 	// Step 2: Make our context a timeout context
 	var cancel context.CancelFunc
@@ -66,7 +86,13 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 	sfKey := fmt.Sprintf("%s/%s?%s", origin, mediaId, opts.String())
 	fetchRecordFn := func() (*database.DbThumbnail, error) {
 		thumbDb := database.GetInstance().Thumbnails.Prepare(ctx)
-		return thumbDb.GetByParams(origin, mediaId, opts.Width, opts.Height, opts.Method, opts.Animated)
+		record, err := thumbDb.GetByParams(origin, mediaId, opts.Width, opts.Height, opts.Method, opts.Animated)
+		if record != nil && thumbnails.IsStale(ctx, record) {
+			// Pretend we don't have it so it gets generated again
+			ctx.Log.Debugf("Thumbnail is from generator version %d - regenerating", record.GeneratorVersion)
+			return nil, err
+		}
+		return record, err
 	}
 	record, err := recordSf.Do(sfKey, fetchRecordFn)
 	defer recordSf.ForgetCacheKey(sfKey)
@@ -105,11 +131,7 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 			if opts.RecordOnly {
 				return nil, nil
 			}
-			if opts.CanRedirect {
-				return download.OpenOrRedirect(ctx, record.Locatable)
-			} else {
-				return download.OpenStream(ctx, record.Locatable)
-			}
+			return download.OpenCached(ctx, record.Locatable, record.SizeBytes, opts.CanRedirect)
 		}
 
 		// Step 6: Generate the thumbnail and return that
@@ -128,18 +150,29 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 					return d, common.ErrMediaDimensionsTooSmall
 				}
 			}
+			if !opts.RecordOnly && errors.Is(err, thumbnailing.ErrUnsupported) {
+				return placeholder(ctx, mediaRecord, opts)
+			}
 			return nil, err
 		}
+		if opts.RecordOnly {
+			// Wait for the thumbnail to be stored, then use its stored record. If it couldn't be stored, the
+			// generated record will do.
+			_, _ = io.Copy(io.Discard, r)
+			_ = r.Close()
+			if stored, err := fetchRecordFn(); err == nil && stored != nil {
+				record = stored
+			}
+		}
 		recordSf.OverwriteCacheKey(sfKey, record)
 		if opts.RecordOnly {
-			defer r.Close()
 			return nil, nil
 		}
 
 		// Step 7: Return stream
 		return r, nil
 	})
-	if errors.Is(err, common.ErrMediaQuarantined) || errors.Is(err, common.ErrMediaDimensionsTooSmall) {
+	if errors.Is(err, common.ErrMediaQuarantined) || errors.Is(err, common.ErrMediaDimensionsTooSmall) || errors.Is(err, thumbnailing.ErrUnsupported) {
 		if r != nil {
 			return nil, readers.NewCancelCloser(r, cancel), err
 		}
@@ -175,3 +208,50 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 	}
 	return record, readers.NewCancelCloser(r, cancel), nil
 }
+
+// fillAutoAspect works out a width or height left at zero from the aspect ratio of the media. This happens before
+// the dimensions are picked so the thumbnail is stored and shared under the dimensions it is generated at. Only the
+// media record is looked up for each request, as the media's dimensions are remembered once found.
+func fillAutoAspect(ctx rcontext.RequestContext, origin string, mediaId string, opts ThumbnailOpts) (ThumbnailOpts, error) {
+	if opts.Width > 0 && opts.Height > 0 {
+		return opts, nil
+	}
+	if opts.Width <= 0 && opts.Height <= 0 {
+		return opts, errors.New("width or height must be positive")
+	}
+
+	var cancel context.CancelFunc
+	ctx.Context, cancel = context.WithTimeout(ctx.Context, opts.BlockForReadUntil)
+	defer cancel()
+
+	mediaRecord, dr, err := pipeline_download.Execute(ctx, origin, mediaId, opts.ImpliedDownloadOpts())
+	if dr != nil {
+		// Shouldn't be returned, but just in case...
+		dr.Close()
+	}
+	if err != nil {
+		if errors.Is(err, common.ErrMediaQuarantined) {
+			// The quarantine image is returned later on in place of the thumbnail, so any aspect ratio will do
+			opts.Width, opts.Height = thumbnails.ScaleToAspect(opts.Width, opts.Height, 1, 1)
+			return opts, nil
+		}
+		return opts, err
+	}
+	if mediaRecord == nil {
+		return opts, common.ErrMediaNotFound
+	}
+
+	opts.Width, opts.Height, err = thumbnails.FillAutoAspect(ctx, mediaRecord, opts.SubImage, opts.Width, opts.Height)
+	return opts, err
+}
+
+// placeholder returns the placeholder image for media which can't be thumbnailed (see thumbnails.placeholders), along
+// with thumbnailing.ErrUnsupported so it isn't mistaken for a stored thumbnail. There is no stream if the media's
+// content type doesn't have a placeholder.
+func placeholder(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, opts ThumbnailOpts) (io.ReadCloser, error) {
+	thumb, err := thumbnailing.GeneratePlaceholder(util.FixContentType(mediaRecord.ContentType), opts.Width, opts.Height, opts.Method, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return thumb.Reader, thumbnailing.ErrUnsupported
+}
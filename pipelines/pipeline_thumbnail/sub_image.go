@@ -0,0 +1,80 @@
+package pipeline_thumbnail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/quarantine"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// subImageRecords holds the records of sub-image thumbnails as they are generated, for the requests which share the
+// generated stream. There's no database record to look up, as they aren't stored.
+var subImageRecords = cache.New(1*time.Minute, 2*time.Minute)
+
+// executeSubImage is Execute for thumbnails of a specific sub-image. These aren't stored, but requests for the same
+// thumbnail at the same time share one generation of it.
+func executeSubImage(ctx rcontext.RequestContext, origin string, mediaId string, opts ThumbnailOpts) (*database.DbThumbnail, io.ReadCloser, error) {
+	var cancel context.CancelFunc
+	//goland:noinspection GoVetLostCancel - we handle the function in our custom cancelCloser struct
+	ctx.Context, cancel = context.WithTimeout(ctx.Context, opts.BlockForReadUntil)
+
+	sfKey := fmt.Sprintf("%s/%s?%s", origin, mediaId, opts.String())
+	r, err, _ := streamSf.Do(sfKey, func() (io.ReadCloser, error) {
+		mediaRecord, dr, err := pipeline_download.Execute(ctx, origin, mediaId, opts.ImpliedDownloadOpts())
+		if dr != nil {
+			// Shouldn't be returned, but just in case...
+			dr.Close()
+		}
+		if err != nil {
+			if errors.Is(err, common.ErrMediaQuarantined) {
+				r, err := quarantine.ReturnAppropriateThing(ctx, false, opts.RecordOnly, opts.Width, opts.Height)
+				if r != nil && err == nil {
+					err = common.ErrMediaQuarantined
+				}
+				return r, err
+			}
+			return nil, err
+		}
+		if mediaRecord == nil {
+			return nil, common.ErrMediaNotFound
+		}
+
+		record, r, err := thumbnails.GenerateSubImage(ctx, mediaRecord, *opts.SubImage, opts.Width, opts.Height, opts.Method)
+		if err != nil {
+			return nil, err
+		}
+		subImageRecords.Set(sfKey, record, cache.DefaultExpiration)
+		return r, nil
+	})
+	if errors.Is(err, common.ErrMediaQuarantined) && r != nil {
+		return nil, readers.NewCancelCloser(r, cancel), err
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	val, ok := subImageRecords.Get(sfKey)
+	if !ok {
+		r.Close()
+		cancel()
+		return nil, nil, errors.New("unexpected error: no record for generated sub-image thumbnail")
+	}
+	record := val.(*database.DbThumbnail)
+	if opts.RecordOnly {
+		r.Close()
+		cancel()
+		return record, nil, nil
+	}
+	return record, readers.NewCancelCloser(r, cancel), nil
+}
@@ -0,0 +1,69 @@
+package pipeline_upload
+
+import (
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// ExecuteAndReturnStream stores media which is also being served to the requester, like remote media and
+// thumbnails. The media is hashed while it is buffered to the datastore's temporary path, and checked against
+// existing media with that hash before being stored, so content we already have (under any media ID) is reused
+// rather than stored again. The returned stream is the buffered media, and must be closed by the caller.
+func ExecuteAndReturnStream(ctx rcontext.RequestContext, origin string, mediaId string, r io.ReadCloser, contentType string, fileName string, kind datastores.Kind) (*database.DbMedia, io.ReadCloser, error) {
+	origin = util.CanonicalServerName(origin)
+
+	// Step 0: Don't store anything while read-only
+	if config.IsReadOnly() && !config.Runtime.IsImportProcess {
+		return nil, nil, common.ErrReadOnly
+	}
+
+	// Step 1: Create a media ID (if needed)
+	mustUseMediaId := true
+	if mediaId == "" {
+		var err error
+		mediaId, err = upload.GenerateMediaId(ctx, origin)
+		if err != nil {
+			return nil, nil, err
+		}
+		mustUseMediaId = false
+	}
+
+	// Step 2: Pick a datastore. The media is always buffered, even if the datastore could take it as a stream,
+	// as it needs to be served from somewhere.
+	dsConf, err := datastores.Pick(ctx, kind)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Step 3: Buffer and hash the media in a single pass, and check for spam
+	sha256hash, sizeBytes, reader, err := bufferAndCheckSpam(ctx, dsConf, r, upload.FileMetadata{
+		Name:        fileName,
+		ContentType: contentType,
+		Origin:      origin,
+		MediaId:     mediaId,
+	}, kind)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Step 4: Deduplicate or store the media, as normal
+	record, err := executeBuffered(ctx, dsConf, origin, mediaId, mustUseMediaId, reader, sha256hash, sizeBytes, contentType, fileName, "", uploadDoneFn(ctx))
+	if err != nil {
+		_ = reader.Close()
+		return nil, nil, err
+	}
+
+	// Step 5: Rewind the buffer (which may have been read to store it) for the caller
+	if _, err = reader.Seek(0, io.SeekStart); err != nil {
+		_ = reader.Close()
+		return nil, nil, err
+	}
+	return record, reader, nil
+}
@@ -1,8 +1,10 @@
 package pipeline_upload
 
 import (
+	"bytes"
 	"errors"
 	"io"
+	"strings"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/common"
@@ -20,18 +22,101 @@ import (
 
 // Execute Media upload. If mediaId is an empty string, one will be generated.
 func Execute(ctx rcontext.RequestContext, origin string, mediaId string, r io.ReadCloser, contentType string, fileName string, userId string, kind datastores.Kind) (*database.DbMedia, error) {
-	uploadDone := func(record *database.DbMedia) {
+	origin = util.CanonicalServerName(origin)
+
+	// Step 0: Don't store anything while read-only
+	if config.IsReadOnly() && !config.Runtime.IsImportProcess {
+		return nil, common.ErrReadOnly
+	}
+
+	// Step 1: Limit the stream's length, and the file name's
+	if kind == datastores.LocalMediaKind {
+		r = upload.LimitStream(ctx, r)
+
+		var err error
+		if fileName, err = upload.CheckFileName(ctx, fileName); err != nil {
+			return nil, err
+		}
+	}
+
+	// Step 1a: Convert HEIC uploads to JPEG, if enabled. This happens before hashing so the converted file is
+	// what gets deduplicated and stored.
+	var converted *upload.ConvertedHeic
+	if kind == datastores.LocalMediaKind && !config.Runtime.IsImportProcess && upload.ShouldConvertHeic(ctx, contentType) {
+		var err error
+		converted, err = upload.ConvertHeicToJpeg(ctx, r, contentType, fileName)
+		if err != nil {
+			return nil, err
+		}
+		r = converted.Stream
+	}
+
+	// Step 1b: Run the configured transforms, in order. Like above, the transformed file is what gets stored.
+	transformedType, transformedName := contentType, fileName
+	if converted != nil {
+		transformedType, transformedName = converted.ContentType, converted.FileName
+	}
+	if kind == datastores.LocalMediaKind && !config.Runtime.IsImportProcess && upload.ShouldTransform(ctx) {
+		transformed, err := upload.ApplyTransforms(ctx, r, transformedType, transformedName)
+		if err != nil {
+			return nil, err
+		}
+		if len(transformed.Applied) > 0 {
+			ctx.Log.Debugf("Applied upload transforms: %s", strings.Join(transformed.Applied, ", "))
+		}
+		r = transformed.Stream()
+		transformedType, transformedName = transformed.ContentType, transformed.FileName
+	}
+
+	record, err := execute(ctx, origin, mediaId, r, transformedType, transformedName, userId, kind)
+	if err != nil {
+		return nil, err
+	}
+	if converted != nil && converted.Converted && ctx.Config.Uploads.ConvertHeicToJpeg.KeepOriginal {
+		storeOriginal(ctx, record, bytes.NewReader(converted.Original), contentType, fileName, userId, kind)
+	}
+	return record, nil
+}
+
+// storeOriginal uploads the media as it was before conversion, and links it to the converted record. Errors
+// are logged rather than returned because the converted media was already stored successfully.
+func storeOriginal(ctx rcontext.RequestContext, converted *database.DbMedia, r io.Reader, contentType string, fileName string, userId string, kind datastores.Kind) {
+	origCtx := ctx
+	origCtx.Config.Uploads.ConvertHeicToJpeg.Enabled = false
+	origCtx.Config.Uploads.Transforms = nil
+	original, err := Execute(origCtx, converted.Origin, "", io.NopCloser(r), contentType, fileName, userId, kind)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error storing original of converted upload: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	err = database.GetInstance().MediaAlternates.Prepare(ctx).Upsert(&database.DbMediaAlternate{
+		Origin:           converted.Origin,
+		MediaId:          converted.MediaId,
+		Reason:           database.OriginalAlternateReason,
+		AlternateOrigin:  original.Origin,
+		AlternateMediaId: original.MediaId,
+	})
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error linking original of converted upload: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+// uploadDoneFn returns what to do after a new media record is stored.
+func uploadDoneFn(ctx rcontext.RequestContext) func(record *database.DbMedia) {
+	return func(record *database.DbMedia) {
 		meta.FlagAccess(ctx, record.Sha256Hash, 0) // upload time is zero here to skip metrics gathering
+		upload.QueueMetadataExtraction(ctx, record)
 		if err := notifier.UploadDone(ctx, record); err != nil {
 			ctx.Log.Warn("Non-fatal error notifying about completed upload: ", err)
 			sentry.CaptureException(err)
 		}
 	}
+}
 
-	// Step 1: Limit the stream's length
-	if kind == datastores.LocalMediaKind {
-		r = upload.LimitStream(ctx, r)
-	}
+func execute(ctx rcontext.RequestContext, origin string, mediaId string, r io.ReadCloser, contentType string, fileName string, userId string, kind datastores.Kind) (*database.DbMedia, error) {
+	uploadDone := uploadDoneFn(ctx)
 
 	// Step 2: Create a media ID (if needed)
 	mustUseMediaId := true
@@ -50,34 +135,72 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, r io.Re
 		return nil, err
 	}
 
+	// Step 3a: Send the upload straight to the datastore if it supports it, skipping the temporary file
+	if datastores.CanStreamUpload(dsConf) {
+		return executeStreamed(ctx, dsConf, origin, mediaId, mustUseMediaId, r, contentType, fileName, userId, kind, uploadDone)
+	}
+
 	// Step 4: Buffer to the datastore's temporary path, and check for spam
-	spamR, spamW := io.Pipe()
-	spamTee := io.TeeReader(r, spamW)
-	spamChan := upload.CheckSpamAsync(ctx, spamR, upload.FileMetadata{
+	sha256hash, sizeBytes, reader, err := bufferAndCheckSpam(ctx, dsConf, r, upload.FileMetadata{
 		Name:        fileName,
 		ContentType: contentType,
 		UserId:      userId,
 		Origin:      origin,
 		MediaId:     mediaId,
-	})
+	}, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return executeBuffered(ctx, dsConf, origin, mediaId, mustUseMediaId, reader, sha256hash, sizeBytes, contentType, fileName, userId, uploadDone)
+}
+
+// bufferAndCheckSpam buffers the upload to the datastore's temporary path, hashing it and passing it to the spam
+// checker as it is written, so the upload is only read once.
+func bufferAndCheckSpam(ctx rcontext.RequestContext, dsConf config.DatastoreConfig, r io.ReadCloser, metadata upload.FileMetadata, kind datastores.Kind) (string, int64, io.ReadSeekCloser, error) {
+	spamR, spamW := io.Pipe()
+	spamTee := io.TeeReader(r, spamW)
+	spamChan := upload.CheckSpamAsync(ctx, spamR, metadata)
 	sha256hash, sizeBytes, reader, err := datastores.BufferTemp(dsConf, readers.NewCancelCloser(io.NopCloser(spamTee), func() {
 		r.Close()
 	}))
 	if err != nil {
-		return nil, err
+		// Unblock the spam checker so it doesn't wait forever on a stream which won't finish, and wait for it to
+		// give up so it isn't left blocked sending its result
+		_ = spamW.CloseWithError(err)
+		<-spamChan
+		return "", 0, nil, err
 	}
 	if err = spamW.Close(); err != nil {
 		ctx.Log.Warn("Failed to close writer for spam checker: ", err)
 		spamChan <- upload.SpamResponse{Err: errors.New("failed to close")}
 	}
-	defer reader.Close()
+	notifier.UploadStageChanged(metadata.Origin, metadata.MediaId, notifier.UploadStageProcessing)
 	spam := <-spamChan
 	if spam.Err != nil {
-		return nil, err
+		_ = reader.Close()
+		return "", 0, nil, spam.Err
 	}
 	if spam.IsSpam {
-		return nil, common.ErrMediaQuarantined
+		_ = reader.Close()
+		return "", 0, nil, common.ErrMediaQuarantined
+	}
+	if kind == datastores.LocalMediaKind && !config.Runtime.IsImportProcess {
+		// The request may have claimed a different size, so check what we actually received. This is after the
+		// spam checker's result is received so it isn't left blocked sending it.
+		if err = upload.CheckMinSize(ctx, sizeBytes); err != nil {
+			_ = reader.Close()
+			return "", 0, nil, err
+		}
 	}
+	return sha256hash, sizeBytes, reader, nil
+}
+
+// executeBuffered is the second half of execute, for uploads which have been buffered and hashed. Existing media
+// with the same hash is reused before anything is sent to the datastore.
+func executeBuffered(ctx rcontext.RequestContext, dsConf config.DatastoreConfig, origin string, mediaId string, mustUseMediaId bool, reader io.Reader, sha256hash string, sizeBytes int64, contentType string, fileName string, userId string, uploadDone func(record *database.DbMedia)) (*database.DbMedia, error) {
+	var err error
 
 	// Step 5: Split the buffer to populate cache later
 	cacheR, cacheW := io.Pipe()
@@ -109,6 +232,15 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, r io.Re
 	//goland:noinspection GoUnhandledErrorResult
 	defer unlockFn()
 
+	// Step 8a: Make sure the media ID isn't already used by something else
+	mediaId, existing, err := upload.CheckMediaId(ctx, origin, mediaId, !mustUseMediaId, sha256hash)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, nil
+	}
+
 	// Step 9: Pull all upload records (to check if an upload has already happened)
 	newRecord := &database.DbMedia{
 		Origin:      origin,
@@ -125,18 +257,21 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, r io.Re
 			Location:    "", // Populated later
 		},
 	}
-	record, perfect, err := upload.FindRecord(ctx, sha256hash, userId, contentType, fileName)
+	record, perfect, err := upload.FindRecord(ctx, sha256hash, origin, userId, contentType, fileName)
 	if err != nil {
 		return nil, err
 	}
 	if record != nil {
-		// We already had this record in some capacity
+		// We already had this record in some capacity. The media may have been quarantined while we were
+		// waiting for the lock, and reusing its location would make it servable again under a new media ID.
+		if record.Quarantined {
+			return nil, common.ErrMediaQuarantined
+		}
 		if perfect && !mustUseMediaId {
 			// Exact match - deduplicate, skip upload to datastore
 			return record, nil
 		} else {
 			// We already uploaded it somewhere else - use the datastore ID and location
-			newRecord.Quarantined = record.Quarantined // just in case (shouldn't be a different value by here)
 			newRecord.DatastoreId = record.DatastoreId
 			newRecord.Location = record.Location
 			if err = database.GetInstance().Media.Prepare(ctx).Insert(newRecord); err != nil {
@@ -151,6 +286,7 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, r io.Re
 	cacheChan := upload.PopulateCacheAsync(ctx, cacheR, sizeBytes, sha256hash)
 
 	// Step 12: Since we didn't find a duplicate, upload it to the datastore
+	notifier.UploadStageChanged(origin, mediaId, notifier.UploadStageStoring)
 	dsLocation, err := datastores.Upload(ctx, dsConf, io.NopCloser(tee), sizeBytes, contentType, sha256hash)
 	if err != nil {
 		return nil, err
@@ -5,12 +5,20 @@ import (
 
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/notifier"
+	"github.com/t2bot/matrix-media-repo/util/readers"
 )
 
 func ExecutePut(ctx rcontext.RequestContext, origin string, mediaId string, r io.ReadCloser, contentType string, fileName string, userId string) (*database.DbMedia, error) {
+	// Step 0: Don't store anything while read-only
+	if config.IsReadOnly() {
+		return nil, common.ErrReadOnly
+	}
+
 	// Step 1: Do we already have a media record for this?
 	mediaDb := database.GetInstance().Media.Prepare(ctx)
 	mediaRecord, err := mediaDb.GetById(origin, mediaId)
@@ -38,11 +46,19 @@ func ExecutePut(ctx rcontext.RequestContext, origin string, mediaId string, r io
 		return nil, common.ErrWrongUser
 	}
 
-	// Step 5: Do the upload
+	// Step 5: Do the upload, reporting progress to anyone watching
+	if ctx.Config.Uploads.Progress.Enabled {
+		notifier.UploadStarted(origin, mediaId)
+		r = readers.NewProgressReader(r, func(total int64) {
+			notifier.UploadReceived(origin, mediaId, total)
+		})
+	}
 	newRecord, err := Execute(ctx, origin, mediaId, r, contentType, fileName, userId, datastores.LocalMediaKind)
 	if err != nil {
+		notifier.UploadStageChanged(origin, mediaId, notifier.UploadStageFailed)
 		return nil, err
 	}
+	notifier.UploadStageChanged(origin, mediaId, notifier.UploadStageDone)
 
 	// Step 6: Delete the holding record
 	if err2 := expiringDb.Delete(origin, mediaId); err2 != nil {
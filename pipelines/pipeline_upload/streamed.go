@@ -0,0 +1,160 @@
+package pipeline_upload
+
+import (
+	"errors"
+	"io"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/notifier"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/quota"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// executeStreamed is the second half of execute for datastores which accept uploads of unknown size. Rather than
+// buffering to a temporary file first, the upload is sent straight to the datastore and only kept if it turns
+// out not to be a duplicate. Streamed uploads are not added to the cache.
+func executeStreamed(ctx rcontext.RequestContext, dsConf config.DatastoreConfig, origin string, mediaId string, mustUseMediaId bool, r io.ReadCloser, contentType string, fileName string, userId string, kind datastores.Kind, uploadDone func(record *database.DbMedia)) (*database.DbMedia, error) {
+	// Step 4: Upload to the datastore, and check for spam
+	spamR, spamW := io.Pipe()
+	spamTee := io.TeeReader(r, spamW)
+	spamChan := upload.CheckSpamAsync(ctx, spamR, upload.FileMetadata{
+		Name:        fileName,
+		ContentType: contentType,
+		UserId:      userId,
+		Origin:      origin,
+		MediaId:     mediaId,
+	})
+	streamed, err := datastores.UploadStream(ctx, dsConf, io.NopCloser(spamTee), contentType)
+	_ = r.Close()
+	if err != nil {
+		// Unblock the spam checker so it doesn't wait forever on a stream which won't finish, and wait for it to
+		// give up so it isn't left blocked sending its result
+		_ = spamW.CloseWithError(err)
+		<-spamChan
+		return nil, err
+	}
+	if err = spamW.Close(); err != nil {
+		ctx.Log.Warn("Failed to close writer for spam checker: ", err)
+		spamChan <- upload.SpamResponse{Err: errors.New("failed to close")}
+	}
+
+	// The upload is already in the datastore, so there's no separate storing stage
+	notifier.UploadStageChanged(origin, mediaId, notifier.UploadStageProcessing)
+
+	// From here on, the upload is thrown away unless it is finalized
+	keep := false
+	defer func() {
+		if !keep {
+			streamed.Abandon(ctx)
+		}
+	}()
+
+	spam := <-spamChan
+	if spam.Err != nil {
+		return nil, spam.Err
+	}
+	if spam.IsSpam {
+		return nil, common.ErrMediaQuarantined
+	}
+	if kind == datastores.LocalMediaKind && !config.Runtime.IsImportProcess {
+		// The request may have claimed a different size, so check what we actually received. This is after the
+		// spam checker's result is received so it isn't left blocked sending it.
+		if err = upload.CheckMinSize(ctx, streamed.SizeBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	// Step 5: Check quarantine
+	if err = upload.CheckQuarantineStatus(ctx, streamed.Sha256Hash); err != nil {
+		return nil, err
+	}
+
+	// Step 6: Ensure user can upload within quota
+	if userId != "" && !config.Runtime.IsImportProcess {
+		if err = quota.CanUpload(ctx, userId, streamed.SizeBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	// Step 7: Acquire a lock on the media hash for uploading
+	unlockFn, err := upload.LockForUpload(ctx, streamed.Sha256Hash)
+	if err != nil {
+		return nil, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer unlockFn()
+
+	// Step 7a: Make sure the media ID isn't already used by something else
+	mediaId, existing, err := upload.CheckMediaId(ctx, origin, mediaId, !mustUseMediaId, streamed.Sha256Hash)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, nil
+	}
+
+	// Step 8: Pull all upload records (to check if an upload has already happened)
+	newRecord := &database.DbMedia{
+		Origin:      origin,
+		MediaId:     mediaId,
+		UploadName:  fileName,
+		ContentType: contentType,
+		UserId:      userId,
+		SizeBytes:   streamed.SizeBytes,
+		CreationTs:  util.NowMillis(),
+		Quarantined: false,
+		Locatable: &database.Locatable{
+			Sha256Hash:  streamed.Sha256Hash,
+			DatastoreId: "", // Populated later
+			Location:    "", // Populated later
+		},
+	}
+	record, perfect, err := upload.FindRecord(ctx, streamed.Sha256Hash, origin, userId, contentType, fileName)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		// We already had this record in some capacity, so our copy is abandoned
+		if record.Quarantined {
+			return nil, common.ErrMediaQuarantined
+		}
+		if perfect && !mustUseMediaId {
+			// Exact match - deduplicate
+			return record, nil
+		}
+		// We already uploaded it somewhere else - use the datastore ID and location
+		newRecord.DatastoreId = record.DatastoreId
+		newRecord.Location = record.Location
+		if err = database.GetInstance().Media.Prepare(ctx).Insert(newRecord); err != nil {
+			return nil, err
+		}
+		uploadDone(newRecord)
+		return newRecord, nil
+	}
+
+	// Step 9: Since we didn't find a duplicate, move the upload to its final location
+	dsLocation, err := streamed.Finalize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keep = true
+
+	// Step 10: Everything finally looks good - return some stuff
+	newRecord.DatastoreId = dsConf.Id
+	newRecord.Location = dsLocation
+	if err = database.GetInstance().Media.Prepare(ctx).Insert(newRecord); err != nil {
+		if err2 := datastores.Remove(ctx, dsConf, dsLocation); err2 != nil {
+			sentry.CaptureException(err2)
+			ctx.Log.Warn("Error deleting upload (delete attempted due to persistence error): ", err2)
+		}
+		return nil, err
+	}
+	uploadDone(newRecord)
+	return newRecord, nil
+}
@@ -0,0 +1,87 @@
+package pool
+
+import (
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+)
+
+// BoundedQueue runs tasks on a fixed number of workers, holding a limited number of tasks while the workers are
+// busy. Unlike Queue, scheduling never waits: tasks which don't fit are rejected. This is for best-effort work
+// which shouldn't hold up (or pile up behind) requests.
+type BoundedQueue struct {
+	name    string
+	tasks   chan func()
+	lock    *sync.Mutex
+	workers int
+	stop    chan struct{}
+}
+
+func NewBoundedQueue(workers int, maxWaiting int, name string) *BoundedQueue {
+	q := &BoundedQueue{
+		name:  name,
+		tasks: make(chan func(), max(0, maxWaiting)),
+		lock:  new(sync.Mutex),
+		stop:  make(chan struct{}),
+	}
+	q.Tune(workers)
+	return q
+}
+
+// TrySchedule queues the task, returning false if there is no room for it.
+func (q *BoundedQueue) TrySchedule(task func()) bool {
+	select {
+	case q.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// Tune changes the number of workers. Workers being removed finish their current task first. The number of
+// waiting tasks can't be changed.
+func (q *BoundedQueue) Tune(workers int) {
+	q.setWorkers(max(1, workers))
+}
+
+// Release stops all the workers once they finish their current task. Tasks still waiting might not be run.
+func (q *BoundedQueue) Release() {
+	q.setWorkers(0)
+}
+
+func (q *BoundedQueue) setWorkers(workers int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for ; q.workers < workers; q.workers++ {
+		go q.work()
+	}
+	for ; q.workers > workers; q.workers-- {
+		go func() { q.stop <- struct{}{} }()
+	}
+}
+
+func (q *BoundedQueue) work() {
+	for {
+		select {
+		case <-q.stop:
+			return
+		case task := <-q.tasks:
+			q.run(task)
+		}
+	}
+}
+
+func (q *BoundedQueue) run(task func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			logrus.Errorf("Panic from internal queue %s", q.name)
+			logrus.Error(err)
+			//goland:noinspection GoTypeAssertionOnErrors
+			if e, ok := err.(error); ok {
+				sentry.CaptureException(e)
+			}
+		}
+	}()
+	task()
+}
@@ -10,6 +10,7 @@ var DownloadQueue *Queue
 var ThumbnailQueue *Queue
 var UrlPreviewQueue *Queue
 var TaskQueue *Queue
+var MetadataQueue *BoundedQueue
 
 func Init() {
 	var err error
@@ -33,6 +34,8 @@ func Init() {
 		logrus.Error("Error setting up tasks queue")
 		logrus.Fatal(err)
 	}
+	metadataConf := config.Get().Uploads.MetadataExtraction
+	MetadataQueue = NewBoundedQueue(metadataConf.NumWorkers, metadataConf.MaxQueued, "metadata")
 }
 
 func AdjustSize() {
@@ -40,6 +43,7 @@ func AdjustSize() {
 	ThumbnailQueue.pool.Tune(config.Get().Thumbnails.NumWorkers)
 	UrlPreviewQueue.pool.Tune(config.Get().UrlPreviews.NumWorkers)
 	TaskQueue.pool.Tune(config.Get().Tasks.NumWorkers)
+	MetadataQueue.Tune(config.Get().Uploads.MetadataExtraction.NumWorkers)
 }
 
 func Drain() {
@@ -47,4 +51,5 @@ func Drain() {
 	ThumbnailQueue.pool.Release()
 	UrlPreviewQueue.pool.Release()
 	TaskQueue.pool.Release()
+	MetadataQueue.Release()
 }
@@ -0,0 +1,82 @@
+package pool
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/metrics"
+)
+
+// The budget is per-process: when running multiple media repo processes, each enforces it separately.
+var memoryLock = new(sync.Mutex)
+var memoryInFlight = int64(0)
+var memoryReleased = make(chan struct{}) // closed (and replaced) whenever bytes are released
+
+// ReserveMemory accounts for n bytes of upload or download streaming against the memory budget, waiting up to
+// the configured queue time for other streams to finish if the budget is used up. If there's still no room,
+// common.ErrMemoryBudgetExceeded is returned. The returned function releases the bytes, and must be called
+// once the stream is finished regardless of whether it succeeded.
+func ReserveMemory(ctx context.Context, n int64) (func(), error) {
+	conf := config.Get().MemoryBudget
+	if conf.MaxBytes <= 0 || n <= 0 {
+		return func() {}, nil
+	}
+	if n > conf.MaxBytes {
+		// Streams larger than the whole budget can still happen, but only once everything else is done
+		n = conf.MaxBytes
+	}
+
+	var timeout <-chan time.Time
+	if conf.QueueSeconds > 0 {
+		timer := time.NewTimer(time.Duration(conf.QueueSeconds) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		memoryLock.Lock()
+		if memoryInFlight+n <= conf.MaxBytes {
+			memoryInFlight += n
+			metrics.MemoryBudgetInFlightBytes.Set(float64(memoryInFlight))
+			memoryLock.Unlock()
+			break
+		}
+		released := memoryReleased
+		memoryLock.Unlock()
+
+		if timeout == nil {
+			metrics.MemoryBudgetRejections.Inc()
+			return nil, common.ErrMemoryBudgetExceeded
+		}
+		select {
+		case <-released:
+			continue
+		case <-timeout:
+		case <-ctx.Done():
+		}
+		metrics.MemoryBudgetRejections.Inc()
+		return nil, common.ErrMemoryBudgetExceeded
+	}
+
+	once := new(sync.Once)
+	return func() {
+		once.Do(func() {
+			memoryLock.Lock()
+			defer memoryLock.Unlock()
+			memoryInFlight -= n
+			metrics.MemoryBudgetInFlightBytes.Set(float64(memoryInFlight))
+			close(memoryReleased)
+			memoryReleased = make(chan struct{})
+		})
+	}, nil
+}
+
+// MemoryInFlight returns the number of bytes currently reserved with ReserveMemory.
+func MemoryInFlight() int64 {
+	memoryLock.Lock()
+	defer memoryLock.Unlock()
+	return memoryInFlight
+}
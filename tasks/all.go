@@ -11,6 +11,7 @@ func StartAll() {
 	scheduleHourly(RecurringTaskPurgeThumbnails, task_runner.PurgeThumbnails)
 	scheduleHourly(RecurringTaskPurgePreviews, task_runner.PurgePreviews)
 	scheduleHourly(RecurringTaskPurgeHeldMediaIds, task_runner.PurgeHeldMediaIds)
+	scheduleHourly(RecurringTaskScrubMedia, task_runner.ScrubMedia)
 
 	scheduleUnfinished()
 }
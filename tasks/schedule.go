@@ -28,6 +28,7 @@ const (
 	RecurringTaskPurgePreviews     RecurringTaskName = "recurring_purge_previews"
 	RecurringTaskPurgeRemoteMedia  RecurringTaskName = "recurring_purge_remote_media"
 	RecurringTaskPurgeHeldMediaIds RecurringTaskName = "recurring_purge_held_media_ids"
+	RecurringTaskScrubMedia        RecurringTaskName = "recurring_scrub_media"
 )
 
 const ExecutingMachineId = int64(0)
@@ -8,6 +8,8 @@ import (
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/memcache"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
@@ -48,6 +50,39 @@ func PurgeMedia(ctx rcontext.RequestContext, authContext *PurgeAuthContext, toHa
 }
 
 func doPurge(ctx rcontext.RequestContext, records []*database.DbMedia, config *purgeConfig) ([]string, error) {
+	// Media sharing a hash shares its file, so is purged together
+	hashes := make([]string, 0)
+	byHash := make(map[string][]*database.DbMedia)
+	for _, r := range records {
+		if _, ok := byHash[r.Sha256Hash]; !ok {
+			hashes = append(hashes, r.Sha256Hash)
+		}
+		byHash[r.Sha256Hash] = append(byHash[r.Sha256Hash], r)
+	}
+
+	removedMxcs := make([]string, 0)
+	for _, hash := range hashes {
+		removed, err := purgeHash(ctx, hash, byHash[hash], config)
+		if err != nil {
+			return nil, err
+		}
+		removedMxcs = append(removedMxcs, removed...)
+	}
+	return removedMxcs, nil
+}
+
+// purgeHash purges the records, which all have the given hash, while holding the upload lock for it. This stops
+// uploads from reusing the file while we decide whether to delete it: uploads only reuse files by hash, so once
+// locked the references we find can't grow. Only one hash is locked at a time, so a large purge doesn't hold up
+// uploads of everything it covers.
+func purgeHash(ctx rcontext.RequestContext, hash string, records []*database.DbMedia, config *purgeConfig) ([]string, error) {
+	unlockFn, err := upload.LockForUpload(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer unlockFn()
+
 	mediaDb := database.GetInstance().Media.Prepare(ctx)
 	thumbsDb := database.GetInstance().Thumbnails.Prepare(ctx)
 	attrsDb := database.GetInstance().MediaAttributes.Prepare(ctx)
@@ -57,6 +92,16 @@ func doPurge(ctx rcontext.RequestContext, records []*database.DbMedia, config *p
 	ctx.Log.Debug("Purge pre-filter")
 	records2 := make([]*database.DbMedia, 0)
 	for _, r := range records {
+		// Another purge may have removed the record while we waited for the lock
+		current, err := mediaDb.GetById(r.Origin, r.MediaId)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			continue
+		}
+		r = current
+
 		if r.Quarantined && !config.IncludeQuarantined {
 			continue // skip quarantined media so later loops don't try to purge it
 		}
@@ -195,6 +240,7 @@ func doPurge(ctx rcontext.RequestContext, records []*database.DbMedia, config *p
 		if err := tryRemoveDsFile(r.DatastoreId, r.Location); err != nil {
 			return nil, err
 		}
+		memcache.Delete(r.Sha256Hash)
 		if util.IsServerOurs(r.Origin) {
 			if err := reservedDb.InsertNoConflict(r.Origin, r.MediaId, "purged / deleted"); err != nil {
 				return nil, err
@@ -215,6 +261,7 @@ func doPurge(ctx rcontext.RequestContext, records []*database.DbMedia, config *p
 				if err := tryRemoveDsFile(t.DatastoreId, t.Location); err != nil {
 					return nil, err
 				}
+				memcache.Delete(t.Sha256Hash)
 				if err := thumbsDb.Delete(t); err != nil {
 					return nil, err
 				}
@@ -11,16 +11,49 @@ import (
 func PurgePreviews(ctx rcontext.RequestContext) {
 	// dev note: don't use ctx for config lookup to avoid misreading it
 
-	if config.Get().UrlPreviews.ExpireDays <= 0 {
-		return
+	if config.Get().UrlPreviews.ExpireDays > 0 {
+		beforeTs := util.NowMillis() - int64(config.Get().UrlPreviews.ExpireDays*24*60*60*1000)
+		db := database.GetInstance().UrlPreviews.Prepare(ctx)
+
+		if err := db.DeleteOlderThan(beforeTs); err != nil {
+			ctx.Log.Error("Error deleting previews: ", err)
+			sentry.CaptureException(err)
+		}
+	}
+
+	if config.Get().UrlPreviews.ImageExpireDays > 0 {
+		beforeTs := util.NowMillis() - int64(config.Get().UrlPreviews.ImageExpireDays*24*60*60*1000)
+		if _, err := PurgePreviewImagesBefore(ctx, beforeTs); err != nil {
+			ctx.Log.Error("Error purging preview images: ", err)
+			sentry.CaptureException(err)
+		}
+	}
+}
+
+// PurgePreviewImagesBefore deletes images stored for URL previews before the given timestamp, and the cached
+// previews using them. Files which are also used by other media are kept. Returns (count affected, error).
+func PurgePreviewImagesBefore(ctx rcontext.RequestContext, beforeTs int64) (int, error) {
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+
+	records, err := mediaDb.GetOldByPurpose(database.PurposeUrlPreview, beforeTs)
+	if err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
 	}
 
-	beforeTs := util.NowMillis() - int64(config.Get().UrlPreviews.ExpireDays*24*60*60*1000)
-	db := database.GetInstance().UrlPreviews.Prepare(ctx)
+	removed, err := doPurge(ctx, records, &purgeConfig{IncludeQuarantined: false})
+	if err != nil {
+		return 0, err
+	}
 
-	// TODO: Fix https://github.com/t2bot/matrix-media-repo/issues/424 ("can't clean up preview media")
-	if err := db.DeleteOlderThan(beforeTs); err != nil {
-		ctx.Log.Error("Error deleting previews: ", err)
-		sentry.CaptureException(err)
+	// Don't keep serving previews which point at the removed images
+	if len(removed) > 0 {
+		if err = database.GetInstance().UrlPreviews.Prepare(ctx).DeleteByImages(removed); err != nil {
+			return 0, err
+		}
 	}
+
+	return len(removed), nil
 }
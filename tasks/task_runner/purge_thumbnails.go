@@ -8,6 +8,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/memcache"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
@@ -52,6 +53,7 @@ func doPurgeThumbnails(ctx rcontext.RequestContext, thumbs []*database.DbThumbna
 				}
 				deletedLocations[locationId] = true
 			}
+			memcache.Delete(thumb.Sha256Hash)
 			ctx.Log.Debugf("Trying to database record for %s", mxc)
 			if err = thumbsDb.Delete(thumb); err != nil {
 				ctx.Log.Error("Error deleting thumbnail record: ", err)
@@ -4,6 +4,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/memcache"
 	"github.com/t2bot/matrix-media-repo/redislib"
 	"github.com/t2bot/matrix-media-repo/util"
 )
@@ -44,6 +45,7 @@ func QuarantineMedia(ctx rcontext.RequestContext, onlyHost string, toHandle *Qua
 			return total, err
 		}
 
+		memcache.Delete(r.Sha256Hash)
 		err = redislib.DeleteMedia(ctx, r.Sha256Hash)
 		if err != nil {
 			ctx.Log.Warn("Error while deleting cached media: ", err)
@@ -0,0 +1,114 @@
+package task_runner
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const scrubBatchSize = 100
+const scrubMaxRunTime = 50 * time.Minute // so runs don't overlap the next hourly schedule
+
+var scrubRunning = &atomic.Bool{}
+
+func ScrubMedia(ctx rcontext.RequestContext) {
+	// dev note: don't use ctx for config lookup to avoid misreading it
+
+	scrubConf := config.Get().Tasks.Scrubber
+	if !scrubConf.Enabled || scrubConf.RecheckDays <= 0 {
+		return
+	}
+	if !scrubRunning.CompareAndSwap(false, true) {
+		ctx.Log.Debug("Previous scrub is still running - skipping")
+		return
+	}
+	defer scrubRunning.Store(false)
+
+	// Progress is checkpointed by the check timestamps, so a run which is stopped early (or by a restart) will
+	// resume from where it left off.
+	beforeTs := util.NowMillis() - int64(scrubConf.RecheckDays)*24*60*60*1000
+	deadline := time.Now().Add(scrubMaxRunTime)
+	db := database.GetInstance().IntegrityChecks.Prepare(ctx)
+	for time.Now().Before(deadline) {
+		records, err := db.GetNeedingCheck(beforeTs, scrubBatchSize)
+		if err != nil {
+			ctx.Log.Error("Error finding media to scrub: ", err)
+			sentry.CaptureException(err)
+			return
+		}
+		if len(records) == 0 {
+			return
+		}
+		for _, record := range records {
+			if !time.Now().Before(deadline) {
+				return
+			}
+			if !scrubRecord(ctx, record, scrubConf) {
+				return // try again next run - the error may be temporary
+			}
+		}
+	}
+}
+
+func scrubRecord(ctx rcontext.RequestContext, record *database.DbIntegrityCheck, scrubConf config.ScrubberConfig) bool {
+	ctx.Log.Debugf("Scrubbing %s/%s", record.DatastoreId, record.Location)
+	ds, ok := datastores.Get(ctx, record.DatastoreId)
+	if !ok {
+		// Record the check anyway so we don't get stuck on it. It'll be retried after the recheck interval.
+		ctx.Log.Warnf("Skipping scrub of %s/%s because the datastore is not configured", record.DatastoreId, record.Location)
+		metrics.MediaScrubbed.With(prometheus.Labels{"datastore": record.DatastoreId, "result": "skipped"}).Inc()
+	} else {
+		matches, err := datastores.Verify(ctx, ds, record.Location, record.Sha256Hash, scrubConf.MaxBytesPerSecond)
+		if err != nil {
+			ctx.Log.Errorf("Error scrubbing %s/%s: %s", record.DatastoreId, record.Location, err)
+			sentry.CaptureException(err)
+			metrics.MediaScrubbed.With(prometheus.Labels{"datastore": record.DatastoreId, "result": "error"}).Inc()
+			return false
+		}
+		record.Corrupt = !matches
+	}
+
+	record.CheckedTs = util.NowMillis()
+	db := database.GetInstance().IntegrityChecks.Prepare(ctx)
+	if err := db.Upsert(record); err != nil {
+		ctx.Log.Error("Error recording scrub result: ", err)
+		sentry.CaptureException(err)
+		return false
+	}
+	if !ok {
+		return true
+	}
+
+	if !record.Corrupt {
+		metrics.MediaScrubbed.With(prometheus.Labels{"datastore": record.DatastoreId, "result": "ok"}).Inc()
+		return true
+	}
+
+	metrics.MediaScrubbed.With(prometheus.Labels{"datastore": record.DatastoreId, "result": "corrupt"}).Inc()
+	ctx.Log.Errorf("Media at %s/%s is missing or does not match its hash %s", record.DatastoreId, record.Location, record.Sha256Hash)
+	if scrubConf.QuarantineCorrupt {
+		mediaDb := database.GetInstance().Media.Prepare(ctx)
+		media, err := mediaDb.GetByLocation(record.DatastoreId, record.Location)
+		if err != nil {
+			ctx.Log.Error("Error finding corrupt media to quarantine: ", err)
+			sentry.CaptureException(err)
+			return true
+		}
+		count, err := QuarantineMedia(ctx, "", &QuarantineThis{DbMedia: media})
+		if err != nil {
+			ctx.Log.Error("Error quarantining corrupt media: ", err)
+			sentry.CaptureException(err)
+			return true
+		}
+		ctx.Log.Warnf("Quarantined %d media records due to corruption", count)
+	}
+	return true
+}
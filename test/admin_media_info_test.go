@@ -0,0 +1,72 @@
+package test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/custom"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+)
+
+func TestAdminMediaInfoDatastore(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "ab", "cd"), 0755))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "ab", "cd", "media"), []byte("stored contents"), 0644))
+
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.DataStores = []config.DatastoreConfig{
+		{Id: "other", Type: "file", Options: map[string]string{"path": t.TempDir()}},
+		{Id: "tiered", Type: "file", Options: map[string]string{"path": dir}},
+	}
+
+	record := &database.DbMedia{
+		Origin:      "example.org",
+		MediaId:     "abc",
+		ContentType: "text/plain",
+		SizeBytes:   100, // deliberately different from what's stored
+		Locatable: &database.Locatable{
+			Sha256Hash:  "hash",
+			DatastoreId: "tiered",
+			Location:    "ab/cd/media",
+		},
+	}
+	sameHash := []*database.DbMedia{
+		record,
+		{Origin: "example.org", MediaId: "copy", Locatable: record.Locatable},
+	}
+	thumbnails := []*database.DbThumbnail{{Origin: "example.org", MediaId: "abc"}}
+
+	info, err := custom.NewAdminMediaInfo(ctx, record, sameHash, thumbnails)
+	assert.NoError(t, err)
+	assert.Equal(t, "mxc://example.org/abc", info.MxcUri)
+	assert.Equal(t, &custom.MediaDatastoreInfo{Id: "tiered", Type: "file", Uri: dir}, info.Datastore)
+	assert.Equal(t, "ab/cd/media", info.Location)
+	assert.Equal(t, int64(100), info.SizeBytes)
+	if assert.NotNil(t, info.StoredSizeBytes) {
+		assert.Equal(t, int64(len("stored contents")), *info.StoredSizeBytes)
+	}
+	assert.Equal(t, []string{"mxc://example.org/copy"}, info.SharedWith)
+	assert.Equal(t, 1, info.ThumbnailCount)
+
+	// Files missing from the datastore have no stored size
+	assert.NoError(t, os.Remove(path.Join(dir, "ab", "cd", "media")))
+	info, err = custom.NewAdminMediaInfo(ctx, record, []*database.DbMedia{record}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "tiered", info.Datastore.Id)
+	assert.Nil(t, info.StoredSizeBytes)
+	assert.Empty(t, info.SharedWith)
+	assert.Equal(t, 0, info.ThumbnailCount)
+
+	// ... and media in a datastore which isn't configured anymore has no datastore
+	record.DatastoreId = "removed"
+	info, err = custom.NewAdminMediaInfo(ctx, record, nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, info.Datastore)
+	assert.Nil(t, info.StoredSizeBytes)
+	assert.Equal(t, "ab/cd/media", info.Location)
+}
@@ -0,0 +1,205 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/audit"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/logging"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+var auditTestData = []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+// serveAuditedDownload serves auditTestData as a download of example.org/abc123 on behalf of userId.
+func serveAuditedDownload(userId string) *httptest.Server {
+	return serveGenerated(func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+		return &_responses.DownloadResponse{
+			ContentType: "application/octet-stream",
+			SizeBytes:   int64(len(auditTestData)),
+			Data:        readers.NopSeekCloser(bytes.NewReader(auditTestData)),
+			Audit: &audit.Record{
+				Action:  audit.ActionDownload,
+				UserId:  userId,
+				Origin:  "example.org",
+				MediaId: "abc123",
+			},
+		}
+	})
+}
+
+func readAuditFile(t *testing.T, fpath string) []*audit.Record {
+	f, err := os.Open(fpath)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	records := make([]*audit.Record, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := &audit.Record{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditFileSink(t *testing.T) {
+	fpath := path.Join(t.TempDir(), "audit.log")
+	assert.NoError(t, audit.Start(config.AuditLogConfig{Enabled: true, Sink: "file", FilePath: fpath, QueueSize: 10}))
+	defer audit.Stop()
+
+	srv := serveAuditedDownload("@alice:example.org")
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Range", "bytes=10-19")
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, res.StatusCode)
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+
+	audit.Stop() // flushes the queue
+	records := readAuditFile(t, fpath)
+	assert.Len(t, records, 2)
+	for _, record := range records {
+		assert.Equal(t, audit.ActionDownload, record.Action)
+		assert.Equal(t, "@alice:example.org", record.UserId)
+		assert.Equal(t, "example.org", record.Origin)
+		assert.Equal(t, "abc123", record.MediaId)
+		assert.NotZero(t, record.Timestamp)
+	}
+	assert.Equal(t, int64(len(auditTestData)), records[0].BytesServed)
+	assert.Empty(t, records[0].Range)
+	assert.Equal(t, int64(10), records[1].BytesServed)
+	assert.Equal(t, "bytes 10-19/36", records[1].Range)
+}
+
+func TestAuditRedaction(t *testing.T) {
+	logging.SetRedaction(true, "")
+	defer logging.SetRedaction(false, "")
+
+	fpath := path.Join(t.TempDir(), "audit.log")
+	assert.NoError(t, audit.Start(config.AuditLogConfig{Enabled: true, Sink: "file", FilePath: fpath, QueueSize: 10}))
+	defer audit.Stop()
+
+	srv := serveAuditedDownload("@alice:example.org")
+	defer srv.Close()
+	res, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	_ = res.Body.Close()
+
+	audit.Stop()
+	records := readAuditFile(t, fpath)
+	assert.Len(t, records, 1)
+	assert.Equal(t, logging.Redact("@alice:example.org"), records[0].UserId)
+	assert.Equal(t, "abc123", records[0].MediaId)
+}
+
+func TestAuditWebhookSink(t *testing.T) {
+	mu := &sync.Mutex{}
+	received := make([]*audit.Record, 0)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := &audit.Record{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(record))
+		mu.Lock()
+		received = append(received, record)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	assert.NoError(t, audit.Start(config.AuditLogConfig{Enabled: true, Sink: "webhook", WebhookUrl: hook.URL, QueueSize: 10}))
+	defer audit.Stop()
+
+	srv := serveAuditedDownload("")
+	defer srv.Close()
+	for i := 0; i < 3; i++ {
+		res, err := http.Get(srv.URL)
+		assert.NoError(t, err)
+		_ = res.Body.Close()
+	}
+
+	audit.Stop()
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, received, 3)
+	for _, record := range received {
+		assert.Empty(t, record.UserId) // anonymous
+		assert.Equal(t, int64(len(auditTestData)), record.BytesServed)
+	}
+}
+
+func TestAuditStopDoesNotBlockLogging(t *testing.T) {
+	release := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hook.Close()
+	defer close(release) // before the server is closed, as that waits for the handler
+
+	assert.NoError(t, audit.Start(config.AuditLogConfig{Enabled: true, Sink: "webhook", WebhookUrl: hook.URL, QueueSize: 10}))
+	record := &audit.Record{Action: audit.ActionDownload, Origin: "example.org", MediaId: "abc123"}
+	audit.Log(record)
+
+	// Stop waits for the webhook to receive the record, which it won't until released
+	stopped := make(chan struct{})
+	go func() {
+		audit.Stop()
+		close(stopped)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	logged := make(chan struct{})
+	go func() {
+		audit.Log(record)
+		close(logged)
+	}()
+	select {
+	case <-logged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("logging was blocked by the audit log stopping")
+	}
+	select {
+	case <-stopped:
+		t.Fatal("audit log stopped before its queue was written")
+	default:
+	}
+}
+
+func TestAuditDisabled(t *testing.T) {
+	fpath := path.Join(t.TempDir(), "audit.log")
+	assert.NoError(t, audit.Start(config.AuditLogConfig{Enabled: false, Sink: "file", FilePath: fpath}))
+	defer audit.Stop()
+
+	srv := serveAuditedDownload("@alice:example.org")
+	defer srv.Close()
+	res, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	_ = res.Body.Close()
+
+	audit.Stop()
+	_, err = os.Stat(fpath)
+	assert.True(t, os.IsNotExist(err))
+
+	// Unknown sinks are rejected up front
+	assert.Error(t, audit.Start(config.AuditLogConfig{Enabled: true, Sink: "carrier-pigeon"}))
+}
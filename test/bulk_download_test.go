@@ -0,0 +1,106 @@
+package test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_bulk_download"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+func TestBulkDownloadEntryNames(t *testing.T) {
+	names := pipeline_bulk_download.EntryNames([]*database.DbMedia{
+		{MediaId: "a", UploadName: "cat.png", ContentType: "image/png"},
+		{MediaId: "b", UploadName: "CAT.png", ContentType: "image/png"},
+		{MediaId: "c", UploadName: "cat.png", ContentType: "image/png"},
+		{MediaId: "d", UploadName: "../evil.txt", ContentType: "text/plain"},
+		{MediaId: "e", UploadName: "C:\\windows\\evil.txt", ContentType: "text/plain"},
+		{MediaId: "f", UploadName: "", ContentType: "image/png"},
+		{MediaId: "g", UploadName: "...", ContentType: "image/png"},
+		{MediaId: "h", UploadName: "no\nnewlines", ContentType: "text/plain"},
+	})
+	assert.Equal(t, []string{
+		"cat.png",
+		"CAT (2).png",
+		"cat (3).png",
+		"_evil.txt",
+		"C__windows_evil.txt",
+		"f.png",
+		"g.png",
+		"nonewlines",
+	}, names)
+}
+
+func TestBulkDownloadZip(t *testing.T) {
+	test_internals.UseTempConfig(t) // for the (disabled) redis cache
+	ds := makeFileDatastore(t, nil)
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.DataStores = []config.DatastoreConfig{ds}
+
+	contents := [][]byte{[]byte("first"), []byte("second"), bytes.Repeat([]byte("third"), 1024)}
+	records := make([]*database.DbMedia, len(contents))
+	for i, c := range contents {
+		location, sha256hash := uploadToFileDatastore(t, ds, c)
+		records[i] = &database.DbMedia{
+			Origin:      "example.org",
+			MediaId:     string(rune('a' + i)),
+			UploadName:  "file.txt",
+			ContentType: "text/plain",
+			SizeBytes:   int64(len(c)),
+			CreationTs:  1700000000000,
+			Locatable:   &database.Locatable{Sha256Hash: sha256hash, DatastoreId: ds.Id, Location: location},
+		}
+	}
+
+	f := pipeline_bulk_download.Zip(ctx, records)
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.Len(t, zr.File, len(contents)) {
+		return
+	}
+	for i, expectedName := range []string{"file.txt", "file (2).txt", "file (3).txt"} {
+		assert.Equal(t, expectedName, zr.File[i].Name)
+		assert.Equal(t, int64(1700000000), zr.File[i].Modified.Unix())
+		r, err := zr.File[i].Open()
+		if !assert.NoError(t, err) {
+			continue
+		}
+		entry, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, contents[i], entry)
+		_ = r.Close()
+	}
+}
+
+func TestBulkDownloadZipMissing(t *testing.T) {
+	test_internals.UseTempConfig(t)
+	ds := makeFileDatastore(t, nil)
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.DataStores = []config.DatastoreConfig{ds}
+
+	location, sha256hash := uploadToFileDatastore(t, ds, []byte("present"))
+	records := []*database.DbMedia{
+		{MediaId: "a", UploadName: "a.txt", Locatable: &database.Locatable{Sha256Hash: sha256hash, DatastoreId: ds.Id, Location: location}},
+		{MediaId: "b", UploadName: "b.txt", Locatable: &database.Locatable{Sha256Hash: "missing", DatastoreId: ds.Id, Location: "no/such/file"}},
+	}
+
+	// The error surfaces while reading, as the ZIP file has already started being sent
+	f := pipeline_bulk_download.Zip(ctx, records)
+	_, err := io.ReadAll(f)
+	assert.Error(t, err)
+	assert.NoError(t, f.Close())
+}
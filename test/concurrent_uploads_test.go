@@ -0,0 +1,102 @@
+package test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+func TestConcurrentUploadsPerUser(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) {
+		c.Uploads.MaxConcurrent.PerUser = 3
+		c.Uploads.MaxConcurrent.PerIp = 0
+	})
+	userId := "@concurrent_user:example.org"
+
+	// Try to take far more slots than allowed, all at once
+	releases := make(chan func(), 50)
+	succeeded := &atomic.Int32{}
+	failed := &atomic.Int32{}
+	wg := &sync.WaitGroup{}
+	for idx := 0; idx < 50; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := upload.AcquireUploadSlot(ctx, userId, "")
+			if err != nil {
+				assert.ErrorIs(t, err, common.ErrTooManyUploads)
+				failed.Add(1)
+				return
+			}
+			succeeded.Add(1)
+			releases <- release
+		}()
+	}
+	wg.Wait()
+	close(releases)
+	assert.Equal(t, int32(3), succeeded.Load())
+	assert.Equal(t, int32(47), failed.Load())
+
+	// Other users are unaffected
+	release, err := upload.AcquireUploadSlot(ctx, "@another_user:example.org", "")
+	assert.NoError(t, err)
+	release()
+
+	// Finishing an upload frees its slot, even if released more than once
+	first := <-releases
+	first()
+	first()
+	release, err = upload.AcquireUploadSlot(ctx, userId, "")
+	assert.NoError(t, err)
+	_, err = upload.AcquireUploadSlot(ctx, userId, "")
+	assert.ErrorIs(t, err, common.ErrTooManyUploads)
+
+	release()
+	for r := range releases {
+		r()
+	}
+}
+
+func TestConcurrentUploadsPerIp(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) {
+		c.Uploads.MaxConcurrent.PerUser = 0
+		c.Uploads.MaxConcurrent.PerIp = 2
+	})
+	ip := "203.0.113.10"
+
+	release1, err := upload.AcquireUploadSlot(ctx, "@ip_user1:example.org", ip)
+	assert.NoError(t, err)
+	release2, err := upload.AcquireUploadSlot(ctx, "@ip_user2:example.org", ip)
+	assert.NoError(t, err)
+	_, err = upload.AcquireUploadSlot(ctx, "@ip_user3:example.org", ip)
+	assert.ErrorIs(t, err, common.ErrTooManyUploads)
+
+	release1()
+	release3, err := upload.AcquireUploadSlot(ctx, "@ip_user3:example.org", ip)
+	assert.NoError(t, err)
+
+	release2()
+	release3()
+}
+
+func TestConcurrentUploadsDisabled(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) {
+		c.Uploads.MaxConcurrent.PerUser = 0
+		c.Uploads.MaxConcurrent.PerIp = 0
+	})
+	releases := make([]func(), 0)
+	for idx := 0; idx < 100; idx++ {
+		release, err := upload.AcquireUploadSlot(ctx, "@unlimited:example.org", "203.0.113.11")
+		assert.NoError(t, err)
+		releases = append(releases, release)
+	}
+	for _, release := range releases {
+		release()
+	}
+}
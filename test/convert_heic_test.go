@@ -0,0 +1,113 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/strukturag/libheif/go/heif"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+func makeHeicFixture(t *testing.T) []byte {
+	// Left half red, right half blue, so we can tell if the image was flipped or rotated
+	img := image.NewRGBA(image.Rect(0, 0, 128, 64))
+	for x := 0; x < 128; x++ {
+		for y := 0; y < 64; y++ {
+			if x < 64 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+
+	hctx, err := heif.EncodeFromImage(img, heif.CompressionHEVC, 90, heif.LosslessModeDisabled, heif.LoggingLevelNone)
+	if err != nil {
+		t.Skip("HEIC encoding is not available: ", err)
+	}
+	fpath := path.Join(t.TempDir(), "fixture.heic")
+	assert.NoError(t, hctx.WriteToFile(fpath))
+	b, err := os.ReadFile(fpath)
+	assert.NoError(t, err)
+	return b
+}
+
+func TestShouldConvertHeic(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Uploads.ConvertHeicToJpeg.Enabled = true })
+	assert.True(t, upload.ShouldConvertHeic(ctx, "image/heic"))
+	assert.True(t, upload.ShouldConvertHeic(ctx, "image/heif"))
+	assert.False(t, upload.ShouldConvertHeic(ctx, "image/jpeg"))
+
+	ctx = test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Uploads.ConvertHeicToJpeg.Enabled = false })
+	assert.False(t, upload.ShouldConvertHeic(ctx, "image/heic"))
+}
+
+func TestConvertHeicToJpeg(t *testing.T) {
+	fixture := makeHeicFixture(t)
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Uploads.ConvertHeicToJpeg.Enabled = true })
+
+	res, err := upload.ConvertHeicToJpeg(ctx, io.NopCloser(bytes.NewReader(fixture)), "image/heic", "IMG_0001.HEIC")
+	assert.NoError(t, err)
+	assert.True(t, res.Converted)
+	assert.Equal(t, "image/jpeg", res.ContentType)
+	assert.Equal(t, "IMG_0001.jpg", res.FileName)
+	assert.Equal(t, fixture, res.Original)
+
+	b, err := io.ReadAll(res.Stream)
+	assert.NoError(t, err)
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	assert.NoError(t, err)
+	assert.Equal(t, 128, img.Bounds().Dx())
+	assert.Equal(t, 64, img.Bounds().Dy())
+
+	r, _, bl, _ := img.At(10, 32).RGBA()
+	assert.Greater(t, r>>8, uint32(200))
+	assert.Less(t, bl>>8, uint32(60))
+	r, _, bl, _ = img.At(118, 32).RGBA()
+	assert.Less(t, r>>8, uint32(60))
+	assert.Greater(t, bl>>8, uint32(200))
+
+	// Lower quality should produce a smaller file
+	ctx.Config.Uploads.ConvertHeicToJpeg.Quality = 10
+	res, err = upload.ConvertHeicToJpeg(ctx, io.NopCloser(bytes.NewReader(fixture)), "image/heic", "")
+	assert.NoError(t, err)
+	assert.True(t, res.Converted)
+	assert.Equal(t, "", res.FileName)
+	b2, err := io.ReadAll(res.Stream)
+	assert.NoError(t, err)
+	assert.Less(t, len(b2), len(b))
+}
+
+func TestConvertHeicToJpegPassesThroughInvalid(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Uploads.ConvertHeicToJpeg.Enabled = true })
+	body := []byte("definitely not a heic file")
+
+	res, err := upload.ConvertHeicToJpeg(ctx, io.NopCloser(bytes.NewReader(body)), "image/heic", "photo.heic")
+	assert.NoError(t, err)
+	assert.False(t, res.Converted)
+	assert.Equal(t, "image/heic", res.ContentType)
+	assert.Equal(t, "photo.heic", res.FileName)
+	b, err := io.ReadAll(res.Stream)
+	assert.NoError(t, err)
+	assert.Equal(t, body, b)
+}
+
+func TestConvertHeicToJpegTooManyPixels(t *testing.T) {
+	fixture := makeHeicFixture(t)
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Uploads.ConvertHeicToJpeg.Enabled = true })
+	ctx.Config.Thumbnails.MaxPixels = 100
+
+	res, err := upload.ConvertHeicToJpeg(ctx, io.NopCloser(bytes.NewReader(fixture)), "image/heic", "photo.heic")
+	assert.NoError(t, err)
+	assert.False(t, res.Converted)
+	assert.Equal(t, "image/heic", res.ContentType)
+}
@@ -0,0 +1,364 @@
+package test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/datastores"
+)
+
+func TestDatastoreCompressionRoundTrip(t *testing.T) {
+	ds := makeFileDatastore(t, map[string]string{"compression": "gzip"})
+	ctx := rcontext.InitialNoConfig()
+	contents := []byte(strings.Repeat(`{"hello": "world"}`+"\n", 1000))
+	hash := sha256.Sum256(contents)
+	sha256hash := hex.EncodeToString(hash[:])
+
+	// The hash is of the original bytes, so the upload is checked against the same hash as it would be uncompressed
+	location, err := datastores.Upload(rcontext.InitialNoConfig(), ds, io.NopCloser(bytes.NewReader(contents)), int64(len(contents)), "application/json; charset=utf-8", sha256hash)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, datastores.CompressionGzip, datastores.Compression(location))
+
+	raw, err := os.ReadFile(path.Join(ds.Options["path"], location))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x1f, 0x8b}, raw[:2])
+	assert.Less(t, len(raw), len(contents))
+	size, err := datastores.StoredSize(ctx, ds, location)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(raw)), size)
+
+	assertFileDatastoreContents(t, ds, location, contents)
+	ok, err := datastores.Verify(ctx, ds, location, sha256hash, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// Redirects (and everything else) get the decompressed object too
+	f, err := datastores.DownloadOrRedirect(ctx, ds, location)
+	assert.NoError(t, err)
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, b)
+	assert.NoError(t, f.Close())
+
+	assert.NoError(t, datastores.Remove(ctx, ds, location))
+	ok, err = datastores.Verify(ctx, ds, location, sha256hash, 0)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestDatastoreCompressionSeek(t *testing.T) {
+	ds := makeFileDatastore(t, map[string]string{"compression": "gzip"})
+	ctx := rcontext.InitialNoConfig()
+	contents := []byte(strings.Repeat("0123456789", 10000))
+	hash := sha256.Sum256(contents)
+	location, err := datastores.Upload(ctx, ds, io.NopCloser(bytes.NewReader(contents)), int64(len(contents)), "text/plain", hex.EncodeToString(hash[:]))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	f, err := datastores.Download(ctx, ds, location)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	end, err := f.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(contents)), end)
+
+	for _, offset := range []int64{50005, 12, 99990} {
+		pos, err := f.Seek(offset, io.SeekStart)
+		assert.NoError(t, err)
+		assert.Equal(t, offset, pos)
+		b := make([]byte, 10)
+		_, err = io.ReadFull(f, b)
+		assert.NoError(t, err)
+		assert.Equal(t, contents[offset:offset+10], b)
+	}
+
+	pos, err := f.Seek(-20, io.SeekCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(99980), pos)
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, contents[99980:], b)
+}
+
+func TestDatastoreCompressionTypes(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	contents := []byte(strings.Repeat("not really an image ", 100))
+	hash := sha256.Sum256(contents)
+	sha256hash := hex.EncodeToString(hash[:])
+
+	for _, c := range []struct {
+		options     map[string]string
+		contentType string
+		compressed  bool
+	}{
+		{map[string]string{"compression": "gzip"}, "text/plain", true},
+		{map[string]string{"compression": "gzip"}, "image/svg+xml", true},
+		{map[string]string{"compression": "gzip"}, "image/png", false},
+		{map[string]string{"compression": "gzip"}, "application/octet-stream", false},
+		{map[string]string{"compression": "gzip", "compressTypes": "application/*"}, "application/octet-stream", true},
+		{map[string]string{"compression": "gzip", "compressTypes": "application/*"}, "text/plain", false},
+		// Already compressed formats are skipped, even when configured
+		{map[string]string{"compression": "gzip", "compressTypes": "*"}, "video/mp4", false},
+		{map[string]string{"compression": "gzip", "compressTypes": "*"}, "application/zip", false},
+		{map[string]string{}, "text/plain", false},
+	} {
+		ds := makeFileDatastore(t, c.options)
+		location, err := datastores.Upload(ctx, ds, io.NopCloser(bytes.NewReader(contents)), int64(len(contents)), c.contentType, sha256hash)
+		if !assert.NoError(t, err, c.contentType) {
+			continue
+		}
+		assert.Equal(t, c.compressed, datastores.Compression(location) != "", "%s %v", c.contentType, c.options)
+		assertFileDatastoreContents(t, ds, location, contents)
+	}
+
+	ds := makeFileDatastore(t, map[string]string{"compression": "lzma"})
+	_, err := datastores.Upload(ctx, ds, io.NopCloser(bytes.NewReader(contents)), int64(len(contents)), "text/plain", sha256hash)
+	assert.Error(t, err)
+}
+
+func TestDatastoreCompressionHashMismatch(t *testing.T) {
+	ds := makeFileDatastore(t, map[string]string{"compression": "gzip"})
+	contents := []byte(strings.Repeat("text ", 100))
+	_, err := datastores.Upload(rcontext.InitialNoConfig(), ds, io.NopCloser(bytes.NewReader(contents)), int64(len(contents)), "text/plain", strings.Repeat("0", 64))
+	assert.Error(t, err)
+	_, err = datastores.Upload(rcontext.InitialNoConfig(), ds, io.NopCloser(bytes.NewReader(contents)), int64(len(contents)+1), "text/plain", strings.Repeat("0", 64))
+	assert.Error(t, err)
+}
+
+func TestDatastoreCompressionBlocks(t *testing.T) {
+	ds := makeFileDatastore(t, map[string]string{"compression": "gzip", "compressionBlockSize": "4096"})
+	ctx := rcontext.InitialNoConfig()
+
+	// A partial block at the end, exactly one block, and no blocks at all
+	for _, contents := range [][]byte{
+		[]byte(strings.Repeat("0123456789", 5000)),
+		[]byte(strings.Repeat("x", 4096)),
+		{},
+	} {
+		location, _ := uploadToFileDatastore(t, ds, contents)
+		if location == "" {
+			continue
+		}
+		assertFileDatastoreContents(t, ds, location, contents)
+
+		// Still a normal gzip file, with a member for each block
+		raw, err := os.ReadFile(path.Join(ds.Options["path"], location))
+		assert.NoError(t, err)
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if assert.NoError(t, err) {
+			b, err := io.ReadAll(zr)
+			assert.NoError(t, err)
+			assert.Equal(t, contents, b)
+			assert.NoError(t, zr.Reset(bytes.NewReader(raw)))
+			zr.Multistream(false)
+			b, err = io.ReadAll(zr)
+			assert.NoError(t, err)
+			assert.Equal(t, contents[:min(len(contents), 4096)], b)
+		}
+
+		f, err := datastores.Download(ctx, ds, location)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		end, err := f.Seek(0, io.SeekEnd)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(contents)), end)
+		b, err := io.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Empty(t, b)
+		assert.NoError(t, f.Close())
+	}
+
+	contents := []byte(strings.Repeat("0123456789", 5000))
+	location, _ := uploadToFileDatastore(t, ds, contents)
+	f, err := datastores.Download(ctx, ds, location)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	for _, offset := range []int64{40000, 4090, 5, 4096, 49990, 12288, 12290} {
+		pos, err := f.Seek(offset, io.SeekStart)
+		assert.NoError(t, err)
+		assert.Equal(t, offset, pos)
+		b := make([]byte, 10)
+		_, err = io.ReadFull(f, b)
+		assert.NoError(t, err)
+		assert.Equal(t, contents[offset:offset+10], b)
+	}
+
+	// Reads carry on into the next block, even after finding the size
+	_, err = f.Seek(8190, io.SeekStart)
+	assert.NoError(t, err)
+	_, err = f.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	pos, err := f.Seek(8190, io.SeekStart)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8190), pos)
+	b := make([]byte, 100)
+	_, err = io.ReadFull(f, b)
+	assert.NoError(t, err)
+	assert.Equal(t, contents[8190:8290], b)
+
+	ds.Options["compressionBlockSize"] = "zero"
+	_, err = datastores.Upload(ctx, ds, io.NopCloser(bytes.NewReader(contents)), int64(len(contents)), "text/plain", strings.Repeat("0", 64))
+	assert.Error(t, err)
+}
+
+// assertCompressedSeeks checks reads from the offsets in the object match the contents.
+func assertCompressedSeeks(t *testing.T, ds config.DatastoreConfig, location string, contents []byte, offsets ...int64) {
+	f, err := datastores.Download(rcontext.InitialNoConfig(), ds, location)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	for _, offset := range offsets {
+		pos, err := f.Seek(offset, io.SeekStart)
+		assert.NoError(t, err)
+		assert.Equal(t, offset, pos)
+		b := make([]byte, min(10, int64(len(contents))-offset))
+		_, err = io.ReadFull(f, b)
+		assert.NoError(t, err)
+		assert.Equal(t, contents[offset:offset+int64(len(b))], b)
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(contents)), end)
+}
+
+func TestDatastoreCompressionIndex(t *testing.T) {
+	ds := makeFileDatastore(t, map[string]string{"compression": "gzip", "compressionBlockSize": "4096"})
+	contents := []byte(strings.Repeat("0123456789", 5000))
+	location, _ := uploadToFileDatastore(t, ds, contents)
+	file := path.Join(ds.Options["path"], location)
+	raw, err := os.ReadFile(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Break the header of the second member. Seeking past it uses the index, so never reads the header.
+	secondMember := binary.LittleEndian.Uint64(raw[16:])
+	broken := bytes.Clone(raw)
+	broken[secondMember+12] = 'X'
+	assert.NoError(t, os.WriteFile(file, broken, 0644))
+	assertCompressedSeeks(t, ds, location, contents, 40000, 20480, 49990)
+	f, err := datastores.Download(rcontext.InitialNoConfig(), ds, location)
+	if assert.NoError(t, err) {
+		_, err = f.Seek(5000, io.SeekStart)
+		assert.NoError(t, err, "the index records where each member starts")
+		assert.NoError(t, f.Close())
+	}
+
+	// Objects stored before there was an index have their headers walked instead
+	indexOffset := binary.LittleEndian.Uint64(raw[len(raw)-8-2-8:])
+	assert.NoError(t, os.WriteFile(file, raw[:indexOffset], 0644))
+	assertFileDatastoreContents(t, ds, location, contents)
+	assertCompressedSeeks(t, ds, location, contents, 40000, 4090, 5, 49990)
+	assert.NoError(t, os.WriteFile(file, broken[:indexOffset], 0644))
+	f, err = datastores.Download(rcontext.InitialNoConfig(), ds, location)
+	if assert.NoError(t, err) {
+		_, err = f.Seek(40000, io.SeekStart)
+		assert.Error(t, err)
+		assert.NoError(t, f.Close())
+	}
+}
+
+func TestDatastoreCompressionIndexStride(t *testing.T) {
+	// More blocks than fit in the index, so only every other member's offset is recorded
+	ds := makeFileDatastore(t, map[string]string{"compression": "gzip", "compressionBlockSize": "1"})
+	contents := []byte(strings.Repeat("0123456789", 900))
+	location, _ := uploadToFileDatastore(t, ds, contents)
+	assertFileDatastoreContents(t, ds, location, contents)
+	assertCompressedSeeks(t, ds, location, contents, 0, 1, 8998, 4001, 4000, 8999)
+}
+
+func TestDatastoreCompressionUnblocked(t *testing.T) {
+	// Objects compressed before blocks were used are a single gzip member
+	ds := makeFileDatastore(t, map[string]string{"compression": "gzip"})
+	contents := []byte(strings.Repeat("0123456789", 5000))
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, _ = zw.Write(contents)
+	assert.NoError(t, zw.Close())
+	location := "unblocked.txt.gz"
+	assert.NoError(t, os.WriteFile(path.Join(ds.Options["path"], location), buf.Bytes(), 0644))
+
+	f, err := datastores.Download(rcontext.InitialNoConfig(), ds, location)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	end, err := f.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(contents)), end)
+	for _, offset := range []int64{40000, 5, 49990} {
+		pos, err := f.Seek(offset, io.SeekStart)
+		assert.NoError(t, err)
+		assert.Equal(t, offset, pos)
+		b := make([]byte, 10)
+		_, err = io.ReadFull(f, b)
+		assert.NoError(t, err)
+		assert.Equal(t, contents[offset:offset+10], b)
+	}
+}
+
+func TestDatastoreCompressionRangeRequest(t *testing.T) {
+	ds := makeFileDatastore(t, map[string]string{"compression": "gzip", "compressionBlockSize": "4096"})
+	contents := []byte(strings.Repeat("0123456789abcdef", 2000))
+	location, _ := uploadToFileDatastore(t, ds, contents)
+	assert.Equal(t, datastores.CompressionGzip, datastores.Compression(location))
+
+	srv := serveGenerated(func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+		f, err := datastores.Download(ctx, ds, location)
+		assert.NoError(t, err)
+		return &_responses.DownloadResponse{
+			ContentType: "text/plain",
+			SizeBytes:   int64(len(contents)),
+			Data:        f,
+		}
+	})
+	defer srv.Close()
+
+	// Ranges are of the original bytes, not the compressed ones
+	for _, c := range []struct {
+		header string
+		start  int
+		end    int // exclusive
+	}{
+		{"bytes=10000-10099", 10000, 10100},
+		{"bytes=4000-9000", 4000, 9001},
+		{"bytes=-50", len(contents) - 50, len(contents)},
+		{"bytes=31990-", 31990, len(contents)},
+	} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Range", c.header)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, c.header) {
+			continue
+		}
+		b, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		assert.NoError(t, err, c.header)
+		assert.Equal(t, http.StatusPartialContent, res.StatusCode, c.header)
+		assert.Equal(t, fmt.Sprintf("bytes %d-%d/%d", c.start, c.end-1, len(contents)), res.Header.Get("Content-Range"), c.header)
+		assert.Equal(t, string(contents[c.start:c.end]), string(b), c.header)
+	}
+}
@@ -0,0 +1,162 @@
+package test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/datastores"
+)
+
+func makeEncryptionKey(t *testing.T) string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestDatastoreEncryptionRoundTrip(t *testing.T) {
+	ds := makeFileDatastore(t, map[string]string{
+		"encryptionKeys":  "primary:" + makeEncryptionKey(t),
+		"encryptionKeyId": "primary",
+	})
+	ctx := rcontext.InitialNoConfig()
+
+	// Several chunks, with a partial one at the end. Empty files and files of exactly one chunk are edge cases too.
+	for _, contents := range [][]byte{
+		[]byte(strings.Repeat("0123456789", 20000)),
+		{},
+		bytes.Repeat([]byte{'x'}, 64*1024),
+	} {
+		location, sha256hash := uploadToFileDatastore(t, ds, contents)
+		if location == "" {
+			continue
+		}
+		assert.Equal(t, "primary", datastores.EncryptionKeyId(location))
+		assert.Equal(t, "", datastores.Compression(location))
+
+		raw, err := os.ReadFile(path.Join(ds.Options["path"], location))
+		assert.NoError(t, err)
+		assert.Greater(t, len(raw), len(contents))
+		if len(contents) >= 10 {
+			assert.False(t, bytes.Contains(raw, contents[:10]))
+		}
+
+		assertFileDatastoreContents(t, ds, location, contents)
+		ok, err := datastores.Verify(ctx, ds, location, sha256hash, 0)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	// Seeking only decrypts the chunk which is read
+	contents := []byte(strings.Repeat("0123456789", 20000))
+	location, _ := uploadToFileDatastore(t, ds, contents)
+	f, err := datastores.Download(ctx, ds, location)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	end, err := f.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(contents)), end)
+	for _, offset := range []int64{150005, 12, 65530, 199990} {
+		pos, err := f.Seek(offset, io.SeekStart)
+		assert.NoError(t, err)
+		assert.Equal(t, offset, pos)
+		b := make([]byte, 10)
+		_, err = io.ReadFull(f, b)
+		assert.NoError(t, err)
+		assert.Equal(t, contents[offset:offset+10], b)
+	}
+}
+
+func TestDatastoreEncryptionRotatedKey(t *testing.T) {
+	oldKey := "old:" + makeEncryptionKey(t)
+	newKey := "new:" + makeEncryptionKey(t)
+	ds := makeFileDatastore(t, map[string]string{
+		"encryptionKeys":  oldKey,
+		"encryptionKeyId": "old",
+	})
+	oldContents := []byte("stored before the key was rotated")
+	oldLocation, _ := uploadToFileDatastore(t, ds, oldContents)
+	assert.Equal(t, "old", datastores.EncryptionKeyId(oldLocation))
+
+	// Rotating the key only changes which key new files use
+	ds.Options["encryptionKeys"] = oldKey + ", " + newKey
+	ds.Options["encryptionKeyId"] = "new"
+	newContents := []byte("stored after the key was rotated")
+	newLocation, _ := uploadToFileDatastore(t, ds, newContents)
+	assert.Equal(t, "new", datastores.EncryptionKeyId(newLocation))
+	assertFileDatastoreContents(t, ds, oldLocation, oldContents)
+	assertFileDatastoreContents(t, ds, newLocation, newContents)
+
+	// Files can't be read once their key is gone, or with the wrong key
+	ds.Options["encryptionKeys"] = newKey
+	_, err := datastores.Download(rcontext.InitialNoConfig(), ds, oldLocation)
+	assert.Error(t, err)
+	ds.Options["encryptionKeys"] = "old:" + strings.TrimPrefix(newKey, "new:") + ", " + newKey
+	f, err := datastores.Download(rcontext.InitialNoConfig(), ds, oldLocation)
+	if assert.NoError(t, err) {
+		_, err = io.ReadAll(f)
+		assert.Error(t, err)
+		_ = f.Close()
+	}
+
+	// Uploads fail rather than being stored unencrypted when the key is missing
+	ds.Options["encryptionKeyId"] = "missing"
+	_, err = datastores.Upload(rcontext.InitialNoConfig(), ds, io.NopCloser(bytes.NewReader(newContents)), int64(len(newContents)), "text/plain", strings.Repeat("0", 64))
+	assert.Error(t, err)
+}
+
+func TestDatastoreEncryptionCompressed(t *testing.T) {
+	ds := makeFileDatastore(t, map[string]string{
+		"compression":     "gzip",
+		"encryptionKeys":  "k1:" + makeEncryptionKey(t),
+		"encryptionKeyId": "k1",
+	})
+	contents := []byte(strings.Repeat(`{"hello": "world"}`+"\n", 1000))
+	location, sha256hash := uploadToFileDatastore(t, ds, contents)
+	assert.Equal(t, datastores.CompressionGzip, datastores.Compression(location))
+	assert.Equal(t, "k1", datastores.EncryptionKeyId(location))
+
+	// Compressed before being encrypted, as encrypted data doesn't compress
+	size, err := datastores.StoredSize(rcontext.InitialNoConfig(), ds, location)
+	assert.NoError(t, err)
+	assert.Less(t, size, int64(len(contents)))
+
+	assertFileDatastoreContents(t, ds, location, contents)
+	ok, err := datastores.Verify(rcontext.InitialNoConfig(), ds, location, sha256hash, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestDatastoreEncryptionTampered(t *testing.T) {
+	ds := makeFileDatastore(t, map[string]string{
+		"encryptionKeys":  "k1:" + makeEncryptionKey(t),
+		"encryptionKeyId": "k1",
+	})
+	contents := []byte(strings.Repeat("0123456789", 20000))
+	location, sha256hash := uploadToFileDatastore(t, ds, contents)
+	filePath := path.Join(ds.Options["path"], location)
+	raw, err := os.ReadFile(filePath)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// A changed byte, and a file cut off at a chunk boundary (65536 bytes and a 16 byte tag, after a 13 byte header)
+	changed := append([]byte{}, raw...)
+	changed[100] ^= 0xFF
+	for _, b := range [][]byte{changed, raw[:13+2*(65536+16)]} {
+		assert.NoError(t, os.WriteFile(filePath, b, 0644))
+		ok, err := datastores.Verify(rcontext.InitialNoConfig(), ds, location, sha256hash, 0)
+		assert.Error(t, err)
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,196 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/datastores"
+)
+
+// mockUpstream implements just enough of a media repo's API for the proxy datastore: uploads, downloads, info,
+// and deletes. Requests must use the access token "upstream_token".
+type mockUpstream struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	nextId  int
+	ranges  []string
+
+	ignoreRanges bool
+	corrupt      bool // store something other than what was uploaded
+}
+
+func (m *mockUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer upstream_token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/_matrix/media/v3/upload":
+		body, _ := io.ReadAll(r.Body)
+		if m.corrupt {
+			body = append(body, '!')
+		}
+		m.nextId++
+		mediaId := "media" + strconv.Itoa(m.nextId)
+		m.objects[mediaId] = body
+		_ = json.NewEncoder(w).Encode(map[string]string{"content_uri": "mxc://upstream.example.org/" + mediaId})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/_matrix/media/v3/download/upstream.example.org/"):
+		object, ok := m.objects[strings.TrimPrefix(r.URL.Path, "/_matrix/media/v3/download/upstream.example.org/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		m.ranges = append(m.ranges, r.Header.Get("Range"))
+		if m.ignoreRanges {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(object))
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/_matrix/media/unstable/info/upstream.example.org/"):
+		object, ok := m.objects[strings.TrimPrefix(r.URL.Path, "/_matrix/media/unstable/info/upstream.example.org/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		hash := sha256.Sum256(object)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"size":   len(object),
+			"hashes": map[string]string{"sha256": hex.EncodeToString(hash[:])},
+		})
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/_matrix/media/unstable/download/upstream.example.org/"):
+		mediaId := strings.TrimPrefix(r.URL.Path, "/_matrix/media/unstable/download/upstream.example.org/")
+		if _, ok := m.objects[mediaId]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(m.objects, mediaId)
+		_, _ = w.Write([]byte("{}"))
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func makeProxyDatastore(t *testing.T) (*mockUpstream, config.DatastoreConfig) {
+	mock := &mockUpstream{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(mock)
+	t.Cleanup(srv.Close)
+
+	return mock, config.DatastoreConfig{
+		Id:   "proxy_" + t.Name(),
+		Type: "proxy",
+		Options: map[string]string{
+			"upstream":    srv.URL + "/",
+			"accessToken": "upstream_token",
+		},
+	}
+}
+
+func TestProxyDatastore(t *testing.T) {
+	mock, ds := makeProxyDatastore(t)
+	ctx := rcontext.InitialNoConfig()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	hash := sha256.Sum256(data)
+	sha256hash := hex.EncodeToString(hash[:])
+
+	location, err := datastores.Upload(ctx, ds, io.NopCloser(bytes.NewReader(data)), int64(len(data)), "application/octet-stream", sha256hash)
+	assert.NoError(t, err)
+	assert.Equal(t, "upstream.example.org/media1", location)
+
+	size, err := datastores.StoredSize(ctx, ds, location)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), size)
+
+	ok, err := datastores.Verify(ctx, ds, location, sha256hash, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	f, err := datastores.Download(ctx, ds, location)
+	assert.NoError(t, err)
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+	assert.NoError(t, f.Close())
+
+	assert.NoError(t, datastores.Remove(ctx, ds, location))
+	assert.Empty(t, mock.objects)
+	assert.NoError(t, datastores.Remove(ctx, ds, location)) // already gone
+
+	_, err = datastores.Download(ctx, ds, location)
+	assert.ErrorIs(t, err, datastores.ErrNotExist)
+	_, err = datastores.StoredSize(ctx, ds, location)
+	assert.ErrorIs(t, err, datastores.ErrNotExist)
+	ok, err = datastores.Verify(ctx, ds, location, sha256hash, 0)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestProxyDatastoreSeek(t *testing.T) {
+	for _, ignoreRanges := range []bool{false, true} {
+		mock, ds := makeProxyDatastore(t)
+		mock.ignoreRanges = ignoreRanges
+		ctx := rcontext.InitialNoConfig()
+
+		data := []byte("hello world, from upstream")
+		hash := sha256.Sum256(data)
+		location, err := datastores.Upload(ctx, ds, io.NopCloser(bytes.NewReader(data)), int64(len(data)), "text/plain", hex.EncodeToString(hash[:]))
+		assert.NoError(t, err)
+
+		f, err := datastores.Download(ctx, ds, location)
+		assert.NoError(t, err)
+		end, err := f.Seek(0, io.SeekEnd)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(data)), end)
+		pos, err := f.Seek(6, io.SeekStart)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(6), pos)
+		b, err := io.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, "world, from upstream", string(b))
+		assert.NoError(t, f.Close())
+
+		// The first request is for the whole object, then the rest is requested from the new position
+		assert.Equal(t, []string{"", "bytes=6-"}, mock.ranges, "ignoreRanges=%v", ignoreRanges)
+	}
+}
+
+func TestProxyDatastoreHashMismatch(t *testing.T) {
+	mock, ds := makeProxyDatastore(t)
+	mock.corrupt = true
+	ctx := rcontext.InitialNoConfig()
+
+	data := []byte("this won't be stored correctly")
+	hash := sha256.Sum256(data)
+	_, err := datastores.Upload(ctx, ds, io.NopCloser(bytes.NewReader(data)), int64(len(data)), "text/plain", hex.EncodeToString(hash[:]))
+	assert.Error(t, err)
+	assert.Empty(t, mock.objects) // removed again
+}
+
+func TestProxyDatastoreConfig(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	_, err := datastores.Download(ctx, config.DatastoreConfig{Id: "proxy", Type: "proxy", Options: map[string]string{}}, "upstream.example.org/media1")
+	assert.Error(t, err)
+
+	_, ds := makeProxyDatastore(t)
+	ds.Options["accessToken"] = "wrong"
+	data := []byte("unauthorized")
+	hash := sha256.Sum256(data)
+	_, err = datastores.Upload(ctx, ds, io.NopCloser(bytes.NewReader(data)), int64(len(data)), "text/plain", hex.EncodeToString(hash[:]))
+	assert.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+)
+
+func TestDatastoreOutOfSpace(t *testing.T) {
+	assert.False(t, datastores.IsOutOfSpace(nil))
+	assert.False(t, datastores.IsOutOfSpace(errors.New("something else")))
+	assert.False(t, datastores.IsOutOfSpace(os.ErrPermission))
+
+	// S3-compatible stores report it as an error code
+	full := minio.ErrorResponse{Code: "XMinioStorageFull", Message: "Storage backend has reached its minimum free drive threshold"}
+	assert.True(t, datastores.IsOutOfSpace(full))
+	assert.True(t, datastores.IsOutOfSpace(fmt.Errorf("uploading thumbnail: %w", full)))
+	assert.False(t, datastores.IsOutOfSpace(minio.ErrorResponse{Code: "AccessDenied"}))
+}
+
+func TestDatastoreOutOfSpaceWrite(t *testing.T) {
+	// /dev/full fails every write with "no space left on device", like a full file datastore would
+	f, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("/dev/full is not available: ", err)
+	}
+	defer f.Close()
+
+	_, err = f.Write([]byte("thumbnail"))
+	assert.Error(t, err)
+	assert.True(t, datastores.IsOutOfSpace(err))
+	assert.True(t, datastores.IsOutOfSpace(fmt.Errorf("storing thumbnail: %w", err)))
+}
+
+func TestThumbnailServedWhenDatastoreIsFull(t *testing.T) {
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("/dev/full is not available: ", err)
+	}
+	defer full.Close()
+
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	b := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(b, makeProgressiveFixture(800, 600)))
+	source := b.Bytes()
+	generate := func() io.ReadCloser {
+		thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(source)), "image/png", 320, 240, "scale", false, ctx)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return thumb.Reader
+	}
+	expected, err := io.ReadAll(generate())
+	assert.NoError(t, err)
+
+	// The thumbnail is generated once, and the requester gets all of it even though storing it fails
+	var storeErr error
+	r := thumbnails.ServeWhileStoring(generate(), func(r io.Reader) {
+		_, storeErr = io.Copy(full, r)
+	})
+	served, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, expected, served)
+	assert.True(t, datastores.IsOutOfSpace(storeErr))
+}
@@ -0,0 +1,225 @@
+package test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/datastores"
+)
+
+// mockS3 implements just enough of S3 for the datastore's streamed uploads: multipart uploads, copies, and
+// deletes. Requests aren't authenticated.
+type mockS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextId  int
+}
+
+func (m *mockS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Path style: /bucket/key
+	pathParts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := pathParts[0], pathParts[1]
+	q := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		m.nextId++
+		uploadId := strconv.Itoa(m.nextId)
+		m.uploads[uploadId] = make(map[int][]byte)
+		_, _ = fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", bucket, key, uploadId)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		parts, ok := m.uploads[q.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		partNumber, _ := strconv.Atoi(q.Get("partNumber"))
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			// Copies are done as multipart uploads of a single part. Ranges aren't needed for small objects.
+			object, ok := m.sourceObject(source)
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			parts[partNumber] = object
+			_, _ = fmt.Fprintf(w, "<CopyPartResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyPartResult>", etag(object), time.Now().UTC().Format(time.RFC3339))
+			return
+		}
+		parts[partNumber] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		parts, ok := m.uploads[q.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		object := make([]byte, 0)
+		for _, n := range numbers {
+			object = append(object, parts[n]...)
+		}
+		m.objects[key] = object
+		delete(m.uploads, q.Get("uploadId"))
+		_, _ = fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>", bucket, key, etag(object))
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(m.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		object, ok := m.sourceObject(r.Header.Get("X-Amz-Copy-Source"))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		m.objects[key] = object
+		_, _ = fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>", etag(object), time.Now().UTC().Format(time.RFC3339))
+	case r.Method == http.MethodHead:
+		object, ok := m.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag(object))
+		w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	case r.Method == http.MethodDelete:
+		delete(m.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// sourceObject finds the object named by a copy source header, which is /bucket/key.
+func (m *mockS3) sourceObject(source string) ([]byte, bool) {
+	source, _ = url.PathUnescape(source)
+	object, ok := m.objects[strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)[1]]
+	return object, ok
+}
+
+func (m *mockS3) keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.objects))
+	for k := range m.objects {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func makeStreamDatastore(t *testing.T) (*mockS3, config.DatastoreConfig) {
+	mock := &mockS3{objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+	srv := httptest.NewServer(mock)
+	t.Cleanup(srv.Close)
+	t.Cleanup(datastores.ResetS3Clients)
+
+	return mock, config.DatastoreConfig{
+		Id:   "stream_" + t.Name(),
+		Type: "s3",
+		Options: map[string]string{
+			"endpoint":      strings.TrimPrefix(srv.URL, "http://"),
+			"bucketName":    "media",
+			"region":        "us-east-1",
+			"ssl":           "false",
+			"streamUploads": "true",
+		},
+	}
+}
+
+// failingReader returns some data, then an error, like a client disconnecting part way through an upload.
+type failingReader struct {
+	remaining int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, errors.New("client went away")
+	}
+	n := min(len(p), r.remaining)
+	r.remaining -= n
+	return n, nil
+}
+
+func TestCanStreamUpload(t *testing.T) {
+	assert.True(t, datastores.CanStreamUpload(config.DatastoreConfig{Type: "s3", Options: map[string]string{"streamUploads": "true"}}))
+	assert.False(t, datastores.CanStreamUpload(config.DatastoreConfig{Type: "s3", Options: map[string]string{}}))
+	assert.False(t, datastores.CanStreamUpload(config.DatastoreConfig{Type: "file", Options: map[string]string{"streamUploads": "true"}}))
+}
+
+func TestUploadStreamFinalize(t *testing.T) {
+	mock, ds := makeStreamDatastore(t)
+	ctx := rcontext.InitialNoConfig()
+
+	// Larger than a single part, so the multipart upload is exercised
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024+1)
+	hash := sha256.Sum256(data)
+
+	streamed, err := datastores.UploadStream(ctx, ds, io.NopCloser(bytes.NewReader(data)), "application/octet-stream")
+	assert.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(hash[:]), streamed.Sha256Hash)
+	assert.Equal(t, int64(len(data)), streamed.SizeBytes)
+
+	// Before being finalized, the upload is kept somewhere temporary
+	keys := mock.keys()
+	assert.Len(t, keys, 1)
+	assert.True(t, strings.HasPrefix(keys[0], "incoming/"))
+
+	location, err := streamed.Finalize(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, streamed.Sha256Hash, location)
+	assert.Equal(t, []string{location}, mock.keys())
+	assert.Equal(t, data, mock.objects[location])
+}
+
+func TestUploadStreamAbandon(t *testing.T) {
+	mock, ds := makeStreamDatastore(t)
+	ctx := rcontext.InitialNoConfig()
+
+	streamed, err := datastores.UploadStream(ctx, ds, io.NopCloser(bytes.NewReader([]byte("duplicate"))), "text/plain")
+	assert.NoError(t, err)
+	assert.Len(t, mock.keys(), 1)
+
+	// Duplicates are abandoned without ever reaching a hash-derived location
+	streamed.Abandon(ctx)
+	assert.Empty(t, mock.keys())
+}
+
+func TestUploadStreamInterrupted(t *testing.T) {
+	mock, ds := makeStreamDatastore(t)
+	ctx := rcontext.InitialNoConfig()
+
+	_, err := datastores.UploadStream(ctx, ds, io.NopCloser(&failingReader{remaining: 17 * 1024 * 1024}), "application/octet-stream")
+	assert.Error(t, err)
+	assert.Empty(t, mock.keys())
+	assert.Empty(t, mock.uploads)
+}
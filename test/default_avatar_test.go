@@ -0,0 +1,106 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+)
+
+func generateAvatar(t *testing.T, ctx rcontext.RequestContext, seed string, name string, width int, height int) []byte {
+	avatar, err := thumbnailing.GenerateDefaultAvatar(seed, name, width, height, ctx)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer avatar.Reader.Close()
+	assert.Equal(t, "image/png", avatar.ContentType)
+	b, err := io.ReadAll(avatar.Reader)
+	assert.NoError(t, err)
+	return b
+}
+
+func avatarBackground(t *testing.T, b []byte) color.NRGBA {
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if !assert.NoError(t, err) {
+		return color.NRGBA{}
+	}
+	return color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA)
+}
+
+func TestDefaultAvatarInitials(t *testing.T) {
+	cases := []struct {
+		seed     string
+		name     string
+		initials string
+	}{
+		{"@alice:example.org", "", "A"},
+		{"@alice.smith:example.org", "", "AS"},
+		{"#room:example.org", "", "R"},
+		{"@alice:example.org", "bob", "B"},
+		{"@alice:example.org", "Carol Ann Jones", "CA"},
+		{"@alice:example.org", "  émile zola ", "ÉZ"},
+		{"@alice:example.org", "🎉", "?"},
+		{"", "", "?"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.initials, thumbnailing.AvatarInitials(c.seed, c.name), c.seed+" / "+c.name)
+	}
+}
+
+func TestDefaultAvatarDeterministic(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.DefaultAvatars.Enabled = true })
+
+	first := generateAvatar(t, ctx, "@alice:example.org", "", 96, 96)
+	second := generateAvatar(t, ctx, "@alice:example.org", "", 96, 96)
+	assert.Equal(t, first, second)
+
+	img, _, err := image.Decode(bytes.NewReader(first))
+	assert.NoError(t, err)
+	assert.Equal(t, 96, img.Bounds().Dx())
+	assert.Equal(t, 96, img.Bounds().Dy())
+
+	// The name changes the initials, but not the colour
+	named := generateAvatar(t, ctx, "@alice:example.org", "Zed", 96, 96)
+	assert.NotEqual(t, first, named)
+	assert.Equal(t, avatarBackground(t, first), avatarBackground(t, named))
+
+	// Different seeds spread across the palette
+	colours := make(map[color.NRGBA]bool)
+	for _, seed := range []string{"@a:example.org", "@b:example.org", "@c:example.org", "@d:example.org", "@e:example.org", "@f:example.org"} {
+		colours[avatarBackground(t, generateAvatar(t, ctx, seed, "", 32, 32))] = true
+	}
+	assert.Greater(t, len(colours), 1)
+
+	// Other sizes work too
+	b := generateAvatar(t, ctx, "@alice:example.org", "", 128, 64)
+	img, _, err = image.Decode(bytes.NewReader(b))
+	assert.NoError(t, err)
+	assert.Equal(t, 128, img.Bounds().Dx())
+	assert.Equal(t, 64, img.Bounds().Dy())
+}
+
+func TestDefaultAvatarPalette(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.DefaultAvatars.Enabled = true })
+	ctx.Config.DefaultAvatars.Colors = []string{"#123456"}
+	b := generateAvatar(t, ctx, "@alice:example.org", "", 64, 64)
+	assert.Equal(t, color.NRGBA{R: 0x12, G: 0x34, B: 0x56, A: 0xFF}, avatarBackground(t, b))
+
+	// Bad palettes and fonts are errors rather than silently ignored
+	ctx.Config.DefaultAvatars.Colors = []string{"blue"}
+	_, err := thumbnailing.GenerateDefaultAvatar("@alice:example.org", "", 64, 64, ctx)
+	assert.Error(t, err)
+	ctx.Config.DefaultAvatars.Colors = []string{}
+	_, err = thumbnailing.GenerateDefaultAvatar("@alice:example.org", "", 64, 64, ctx)
+	assert.Error(t, err)
+	ctx.Config.DefaultAvatars.Colors = []string{"#123456"}
+	ctx.Config.DefaultAvatars.FontPath = "/does/not/exist.ttf"
+	_, err = thumbnailing.GenerateDefaultAvatar("@alice:example.org", "", 64, 64, ctx)
+	assert.Error(t, err)
+}
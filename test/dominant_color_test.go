@@ -0,0 +1,83 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+func makeSolidImage(w int, h int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestDominantColorSolid(t *testing.T) {
+	assert.Equal(t, "#ff0000", u.DominantColor(makeSolidImage(10, 10, color.NRGBA{R: 0xFF, A: 0xFF})))
+	assert.Equal(t, "#12ab7f", u.DominantColor(makeSolidImage(1000, 700, color.NRGBA{R: 0x12, G: 0xAB, B: 0x7F, A: 0xFF})))
+}
+
+func TestDominantColorAverages(t *testing.T) {
+	img := makeSolidImage(10, 10, color.NRGBA{R: 0xFF, A: 0xFF})
+	for y := 0; y < 10; y++ {
+		for x := 5; x < 10; x++ {
+			img.Set(x, y, color.NRGBA{B: 0xFF, A: 0xFF})
+		}
+	}
+	assert.Equal(t, "#800080", u.DominantColor(img))
+}
+
+func TestDominantColorIgnoresTransparency(t *testing.T) {
+	img := makeSolidImage(10, 10, color.NRGBA{G: 0xFF, A: 0xFF})
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 10; x++ {
+			img.Set(x, y, color.NRGBA{R: 0xFF, A: 0x00})
+		}
+	}
+	assert.Equal(t, "#00ff00", u.DominantColor(img))
+
+	// Translucent pixels count at their un-premultiplied colour
+	assert.Equal(t, "#0000ff", u.DominantColor(makeSolidImage(4, 4, color.NRGBA{B: 0xFF, A: 0x40})))
+
+	assert.Equal(t, "", u.DominantColor(makeSolidImage(4, 4, color.NRGBA{})))
+}
+
+func TestDominantColorFromGenerators(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+
+	src := makeSolidImage(64, 64, color.NRGBA{R: 0x20, G: 0x40, B: 0x80, A: 0xFF})
+
+	b := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(b, src))
+	thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(b), "image/png", 32, 32, "scale", false, ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, thumb) {
+		assert.Equal(t, "#204080", thumb.DominantColor)
+		_ = thumb.Reader.Close()
+	}
+
+	b = &bytes.Buffer{}
+	assert.NoError(t, jpeg.Encode(b, src, &jpeg.Options{Quality: 100}))
+	thumb, err = thumbnailing.GenerateThumbnail(io.NopCloser(b), "image/jpeg", 32, 32, "scale", false, ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, thumb) {
+		// JPEG is lossy, so only check we got something close
+		assert.Len(t, thumb.DominantColor, 7)
+		_ = thumb.Reader.Close()
+	}
+}
@@ -0,0 +1,87 @@
+package test
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// servedFilename serves a PNG named fname through the router, returning the parsed Content-Disposition filename
+func servedFilename(t *testing.T, fname string) (string, string) {
+	srv := serveGenerated(func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+		return &_responses.DownloadResponse{
+			ContentType:       "image/png",
+			Filename:          fname,
+			SizeBytes:         3,
+			Data:              readers.NopSeekCloser(bytes.NewReader([]byte("png"))),
+			TargetDisposition: "attachment",
+		}
+	})
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	_ = res.Body.Close()
+
+	header := res.Header.Get("Content-Disposition")
+	_, params, err := mime.ParseMediaType(header)
+	assert.NoError(t, err, header)
+	return params["filename"], header
+}
+
+func originResponse(contentDisposition string) *http.Response {
+	res := &http.Response{Header: http.Header{}}
+	if contentDisposition != "" {
+		res.Header.Set("Content-Disposition", contentDisposition)
+	}
+	return res
+}
+
+func TestDownloadFilenameFallbacks(t *testing.T) {
+	// The client's filename wins, then the upload name (which is the origin's filename for remote media)
+	assert.Equal(t, "client.png", util.PickFilename("client.png", "stored.png"))
+	assert.Equal(t, "stored.png", util.PickFilename("", "stored.png"))
+	assert.Equal(t, "stored.png", util.PickFilename("  ", "stored.png"))
+	assert.Equal(t, "", util.PickFilename("", ""))
+
+	// The origin's filename is captured from its Content-Disposition header
+	assert.Equal(t, "origin.png", download.OriginFilename(originResponse(`attachment; filename="origin.png"`)))
+	assert.Equal(t, "ünïcode.png", download.OriginFilename(originResponse(`inline; filename*=utf-8''%C3%BCn%C3%AFcode.png`)))
+	assert.Equal(t, "", download.OriginFilename(originResponse("attachment")))
+	assert.Equal(t, "", download.OriginFilename(originResponse("")))
+
+	// And when nothing has a name, the default is used with an extension for the content type
+	fname, _ := servedFilename(t, "")
+	assert.Equal(t, "file.png", fname)
+}
+
+func TestDownloadFilenameEncoding(t *testing.T) {
+	cases := []struct {
+		fname  string
+		header string
+	}{
+		{"simple.png", `attachment; filename="simple.png"`},
+		{"my file+1.png", `attachment; filename="my file+1.png"`},
+		{`quote"back\slash.png`, `attachment; filename="quote\"back\\slash.png"`},
+		{"new\r\nline.png", `attachment; filename="newline.png"`},
+		{"ünïcode name.png", `attachment; filename*=utf-8''%C3%BCn%C3%AFcode%20name.png`},
+	}
+	for _, c := range cases {
+		_, header := servedFilename(t, c.fname)
+		assert.Equal(t, c.header, header, c.fname)
+	}
+
+	// Clients parsing the header get the original name back
+	for _, fname := range []string{"my file+1.png", `quote"back\slash.png`, "ünïcode name.png", "100% real.png"} {
+		parsed, _ := servedFilename(t, fname)
+		assert.Equal(t, fname, parsed)
+	}
+}
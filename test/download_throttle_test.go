@@ -0,0 +1,74 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+func fetchTimed(t *testing.T, url string, rangeHeader string) (*http.Response, []byte, time.Duration) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	assert.NoError(t, err)
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	start := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return nil, nil, 0
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	return res, b, time.Since(start)
+}
+
+func TestDownloadThrottle(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 8*1024) // 128kb
+	generator := func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+		return &_responses.DownloadResponse{
+			ContentType: "application/octet-stream",
+			SizeBytes:   int64(len(data)),
+			Data:        readers.NopSeekCloser(bytes.NewReader(data)),
+		}
+	}
+
+	// Unthrottled by default
+	srv := serveGenerated(generator)
+	res, b, elapsed := fetchTimed(t, srv.URL, "")
+	srv.Close()
+	if assert.NotNil(t, res) {
+		assert.Equal(t, data, b)
+		assert.Less(t, elapsed, 500*time.Millisecond)
+	}
+
+	// 64kb/s, after the first 16kb, means the rest takes at least 1.75 seconds
+	cfg := config.NewDefaultDomainConfig()
+	cfg.Downloads.Throttle = config.DownloadThrottle{BytesPerSecond: 64 * 1024, BurstBytes: 16 * 1024}
+	srv = serveGeneratedWith(cfg, generator)
+	defer srv.Close()
+	res, b, elapsed = fetchTimed(t, srv.URL, "")
+	if assert.NotNil(t, res) {
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, data, b)
+		assert.GreaterOrEqual(t, elapsed, 1700*time.Millisecond)
+	}
+
+	// Ranges are still served properly, and only the range is throttled
+	res, b, elapsed = fetchTimed(t, srv.URL, "bytes=65536-98303")
+	if assert.NotNil(t, res) {
+		assert.Equal(t, http.StatusPartialContent, res.StatusCode)
+		assert.Equal(t, "bytes 65536-98303/131072", res.Header.Get("Content-Range"))
+		assert.Equal(t, data[65536:98304], b)
+		assert.GreaterOrEqual(t, elapsed, 200*time.Millisecond)
+		assert.Less(t, elapsed, 1500*time.Millisecond)
+	}
+}
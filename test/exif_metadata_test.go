@@ -0,0 +1,95 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"testing"
+
+	"github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// makeCameraJpeg returns a JPEG with the sort of EXIF data a camera would write, including location and
+// serial numbers.
+func makeCameraJpeg(t *testing.T) []byte {
+	im, err := exifcommon.NewIfdMappingWithStandard()
+	assert.NoError(t, err)
+	rootIb := exif.NewIfdBuilder(im, exif.NewTagIndex(), exifcommon.IfdStandardIfdIdentity, exifcommon.EncodeDefaultByteOrder)
+	assert.NoError(t, rootIb.AddStandardWithName("Make", "Canon"))
+	assert.NoError(t, rootIb.AddStandardWithName("Model", "EOS 5D"))
+
+	exifIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD/Exif")
+	assert.NoError(t, err)
+	assert.NoError(t, exifIb.AddStandardWithName("LensModel", "EF 50mm f/1.8"))
+	assert.NoError(t, exifIb.AddStandardWithName("FocalLength", []exifcommon.Rational{{Numerator: 50, Denominator: 1}}))
+	assert.NoError(t, exifIb.AddStandardWithName("ExposureTime", []exifcommon.Rational{{Numerator: 1, Denominator: 125}}))
+	assert.NoError(t, exifIb.AddStandardWithName("FNumber", []exifcommon.Rational{{Numerator: 18, Denominator: 10}}))
+	assert.NoError(t, exifIb.AddStandardWithName("ISOSpeedRatings", []uint16{400}))
+	assert.NoError(t, exifIb.AddStandardWithName("DateTimeOriginal", "2024:05:06 07:08:09"))
+	assert.NoError(t, exifIb.AddStandardWithName("BodySerialNumber", "BODY-SERIAL-123"))
+	assert.NoError(t, exifIb.AddStandardWithName("LensSerialNumber", "LENS-SERIAL-456"))
+	assert.NoError(t, exifIb.AddStandardWithName("CameraOwnerName", "Alice"))
+
+	gpsIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD/GPSInfo")
+	assert.NoError(t, err)
+	assert.NoError(t, gpsIb.AddStandardWithName("GPSLatitudeRef", "N"))
+	assert.NoError(t, gpsIb.AddStandardWithName("GPSLatitude", []exifcommon.Rational{{Numerator: 51, Denominator: 1}, {Numerator: 28, Denominator: 1}, {Numerator: 40, Denominator: 1}}))
+
+	block, err := exif.NewIfdByteEncoder().EncodeToExif(rootIb)
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, 16, 8)), nil))
+	img := buf.Bytes()
+	payload := append([]byte("Exif\x00\x00"), block...)
+	out := append([]byte{}, img[0:2]...)
+	out = append(out, 0xFF, 0xE1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+	out = append(out, payload...)
+	return append(out, img[2:]...)
+}
+
+func TestExifCaptureMetadata(t *testing.T) {
+	fixture := makeCameraJpeg(t)
+	assert.Contains(t, exifTagNames(t, fixture), "GPSLatitude") // make sure there's something to exclude
+
+	meta, err := u.GetExifCaptureMetadata(bytes.NewReader(fixture))
+	assert.NoError(t, err)
+	if !assert.NotNil(t, meta) {
+		return
+	}
+	assert.Equal(t, "Canon", meta.CameraMake)
+	assert.Equal(t, "EOS 5D", meta.CameraModel)
+	assert.Equal(t, "EF 50mm f/1.8", meta.LensModel)
+	assert.Equal(t, 50.0, meta.FocalLength)
+	assert.Equal(t, "1/125", meta.ExposureTime)
+	assert.Equal(t, 1.8, meta.FNumber)
+	assert.Equal(t, 400, meta.Iso)
+	assert.Equal(t, "2024:05:06 07:08:09", meta.DateTaken)
+
+	// Location, serial numbers, and the owner's name are never picked up
+	b, err := json.Marshal(meta)
+	assert.NoError(t, err)
+	for _, sensitive := range []string{"BODY-SERIAL-123", "LENS-SERIAL-456", "Alice", "Latitude", "GPS"} {
+		assert.NotContains(t, string(b), sensitive)
+	}
+}
+
+func TestExifCaptureMetadataMissing(t *testing.T) {
+	// Images without EXIF data have no capture metadata, rather than an error
+	buf := &bytes.Buffer{}
+	assert.NoError(t, jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, 16, 8)), nil))
+	meta, err := u.GetExifCaptureMetadata(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Nil(t, meta)
+
+	// Nor do images which only have other EXIF data, like location
+	meta, err = u.GetExifCaptureMetadata(bytes.NewReader(makeGpsJpeg(t)))
+	assert.NoError(t, err)
+	assert.Nil(t, meta)
+}
@@ -0,0 +1,203 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// makeOrientedJpeg returns a JPEG with only an EXIF orientation tag.
+func makeOrientedJpeg(t *testing.T, orientation uint16) []byte {
+	return makeOrientedJpegOf(t, orientation, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+}
+
+// makeOrientedJpegOf encodes img as a JPEG with an EXIF orientation tag.
+func makeOrientedJpegOf(t *testing.T, orientation uint16, src image.Image) []byte {
+	return makeOrientedJpegSized(t, orientation, src, 0, 0)
+}
+
+// makeOrientedJpegSized is makeOrientedJpegOf, but also records the image's dimensions in the EXIF data (like a
+// camera would) if they aren't zero.
+func makeOrientedJpegSized(t *testing.T, orientation uint16, src image.Image, pixelWidth uint32, pixelHeight uint32) []byte {
+	entries := uint16(1)
+	if pixelWidth > 0 {
+		entries = 2
+	}
+	tiff := []byte("MM\x00\x2a")
+	tiff = binary.BigEndian.AppendUint32(tiff, 8) // IFD0 offset
+	tiff = binary.BigEndian.AppendUint16(tiff, entries)
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = binary.BigEndian.AppendUint16(tiff, 0) // padding
+	if pixelWidth > 0 {
+		tiff = binary.BigEndian.AppendUint16(tiff, 0x8769) // Exif IFD pointer
+		tiff = binary.BigEndian.AppendUint16(tiff, 4)      // LONG
+		tiff = binary.BigEndian.AppendUint32(tiff, 1)
+		tiff = binary.BigEndian.AppendUint32(tiff, 8+2+2*12+4)
+	}
+	tiff = binary.BigEndian.AppendUint32(tiff, 0) // no next IFD
+	if pixelWidth > 0 {
+		tiff = binary.BigEndian.AppendUint16(tiff, 2)
+		for i, val := range []uint32{pixelWidth, pixelHeight} {
+			tiff = binary.BigEndian.AppendUint16(tiff, 0xA002+uint16(i)) // PixelXDimension, PixelYDimension
+			tiff = binary.BigEndian.AppendUint16(tiff, 4)                // LONG
+			tiff = binary.BigEndian.AppendUint32(tiff, 1)
+			tiff = binary.BigEndian.AppendUint32(tiff, val)
+		}
+		tiff = binary.BigEndian.AppendUint32(tiff, 0) // no next IFD
+	}
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, jpeg.Encode(buf, src, nil))
+	img := buf.Bytes()
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	out := append([]byte{}, img[0:2]...)
+	out = append(out, 0xFF, 0xE1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+	out = append(out, payload...)
+	return append(out, img[2:]...)
+}
+
+// makeOrientationFixture returns a 3x2 image where every pixel is different, so any wrong rotation or flip
+// shows up.
+func makeOrientationFixture() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for x := 0; x < 3; x++ {
+		for y := 0; y < 2; y++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 100), G: uint8(y * 100), B: uint8(x*10 + y), A: 0xFF})
+		}
+	}
+	return img
+}
+
+func TestExifOrientations(t *testing.T) {
+	src := makeOrientationFixture()
+
+	// What each orientation value needs doing to the stored image to display it upright
+	cases := []struct {
+		orientation uint16
+		expected    *image.NRGBA
+	}{
+		{1, imaging.Clone(src)},
+		{2, imaging.FlipH(src)},
+		{3, imaging.Rotate180(src)},
+		{4, imaging.FlipV(src)},
+		{5, imaging.Transpose(src)},
+		{6, imaging.Rotate270(src)}, // 90 degrees clockwise
+		{7, imaging.Transverse(src)},
+		{8, imaging.Rotate90(src)}, // 90 degrees counter-clockwise
+	}
+	for _, c := range cases {
+		t.Run(strconv.Itoa(int(c.orientation)), func(t *testing.T) {
+			orientation, err := u.GetExifOrientation(bytes.NewReader(makeOrientedJpeg(t, c.orientation)))
+			assert.NoError(t, err)
+			if !assert.NotNil(t, orientation) {
+				return
+			}
+			assert.Equal(t, c.expected, imaging.Clone(u.ApplyOrientation(src, orientation)))
+		})
+	}
+
+	// Independently of imaging's naming: a transpose mirrors along the main diagonal, and a transverse along the other
+	assert.Equal(t, src.At(2, 1), imaging.Transpose(src).At(1, 2))
+	assert.Equal(t, src.At(0, 0), imaging.Transverse(src).At(1, 2))
+}
+
+func TestExifOrientationMissing(t *testing.T) {
+	orientation, err := u.GetExifOrientation(bytes.NewReader(makeOrientedJpeg(t, 0)))
+	assert.NoError(t, err)
+	assert.Nil(t, orientation)
+	assert.Equal(t, makeOrientationFixture(), u.ApplyOrientation(makeOrientationFixture(), nil))
+
+	_, err = u.GetExifOrientation(bytes.NewReader(makeOrientedJpeg(t, 9)))
+	assert.Error(t, err)
+}
+
+// thumbnailJpegDimensions thumbnails the JPEG to fit within 32x32, returning the thumbnail's dimensions.
+func thumbnailJpegDimensions(t *testing.T, ctx rcontext.RequestContext, b []byte) (int, int) {
+	thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(b)), "image/jpeg", 32, 32, "scale", false, ctx)
+	if !assert.NoError(t, err) {
+		return 0, 0
+	}
+	img, _, err := image.Decode(thumb.Reader)
+	if !assert.NoError(t, err) {
+		return 0, 0
+	}
+	return img.Bounds().Dx(), img.Bounds().Dy()
+}
+
+func TestExifOrientationConfig(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+
+	// A 64x32 image which should be shown a quarter turn around, as 32x64. The dimensions recorded with the tag
+	// agree, so it's correctly tagged.
+	tagged := makeOrientedJpegSized(t, 6, image.NewRGBA(image.Rect(0, 0, 64, 32)), 64, 32)
+	orientation, err := u.GetExifOrientation(bytes.NewReader(tagged))
+	assert.NoError(t, err)
+	if assert.NotNil(t, orientation) {
+		assert.Equal(t, 64, orientation.PixelWidth)
+		assert.Equal(t, 32, orientation.PixelHeight)
+		assert.False(t, orientation.IsStale(64, 32))
+	}
+	w, h := thumbnailJpegDimensions(t, ctx, tagged)
+	assert.Equal(t, 16, w)
+	assert.Equal(t, 32, h)
+	ctx.Config.Thumbnails.ExifOrientation.IgnoreStale = true
+	w, h = thumbnailJpegDimensions(t, ctx, tagged)
+	assert.Equal(t, 16, w)
+	assert.Equal(t, 32, h)
+
+	// The same image, already rotated by the client without resetting the tag
+	stale := makeOrientedJpegSized(t, 6, image.NewRGBA(image.Rect(0, 0, 32, 64)), 64, 32)
+	w, h = thumbnailJpegDimensions(t, ctx, stale)
+	assert.Equal(t, 16, w)
+	assert.Equal(t, 32, h)
+	ctx.Config.Thumbnails.ExifOrientation.IgnoreStale = false
+	w, h = thumbnailJpegDimensions(t, ctx, stale)
+	assert.Equal(t, 32, w)
+	assert.Equal(t, 16, h)
+
+	// Without recorded dimensions, there's nothing to go on
+	ctx.Config.Thumbnails.ExifOrientation.IgnoreStale = true
+	w, h = thumbnailJpegDimensions(t, ctx, makeOrientedJpegOf(t, 6, image.NewRGBA(image.Rect(0, 0, 32, 64))))
+	assert.Equal(t, 32, w)
+	assert.Equal(t, 16, h)
+
+	// Disabled entirely
+	ctx.Config.Thumbnails.ExifOrientation.Enabled = false
+	w, h = thumbnailJpegDimensions(t, ctx, tagged)
+	assert.Equal(t, 32, w)
+	assert.Equal(t, 16, h)
+
+	// Disabled for some origins
+	ctx.Config.Thumbnails.ExifOrientation.Enabled = true
+	ctx.Config.Thumbnails.ExifOrientation.DisabledOrigins = []string{"*.example.org"}
+	w, h = thumbnailJpegDimensions(t, u.WithSourceOrigin(ctx, "media.example.org"), tagged)
+	assert.Equal(t, 32, w)
+	assert.Equal(t, 16, h)
+	w, h = thumbnailJpegDimensions(t, u.WithSourceOrigin(ctx, "Media.Example.ORG"), tagged)
+	assert.Equal(t, 32, w)
+	assert.Equal(t, 16, h)
+	w, h = thumbnailJpegDimensions(t, u.WithSourceOrigin(ctx, "example.com"), tagged)
+	assert.Equal(t, 16, w)
+	assert.Equal(t, 32, h)
+	w, h = thumbnails.GetDisplayedDimensions(u.WithSourceOrigin(ctx, "media.example.org"), bytes.NewReader(tagged), "image/jpeg", nil)
+	assert.Equal(t, 64, w)
+	assert.Equal(t, 32, h)
+}
@@ -0,0 +1,104 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/datastores"
+)
+
+func makeFileDatastore(t *testing.T, options map[string]string) config.DatastoreConfig {
+	basePath := t.TempDir()
+	opts := map[string]string{"path": basePath}
+	for k, v := range options {
+		opts[k] = v
+	}
+	return config.DatastoreConfig{Id: "layout_test", Type: "file", Options: opts}
+}
+
+func uploadToFileDatastore(t *testing.T, ds config.DatastoreConfig, contents []byte) (string, string) {
+	hash := sha256.Sum256(contents)
+	sha256hash := hex.EncodeToString(hash[:])
+	location, err := datastores.Upload(rcontext.InitialNoConfig(), ds, io.NopCloser(bytes.NewReader(contents)), int64(len(contents)), "text/plain", sha256hash)
+	assert.NoError(t, err)
+	return location, sha256hash
+}
+
+func assertFileDatastoreContents(t *testing.T, ds config.DatastoreConfig, location string, expected []byte) {
+	f, err := datastores.Download(rcontext.InitialNoConfig(), ds, location)
+	if !assert.NoError(t, err, location) {
+		return
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, b)
+}
+
+func TestFileDatastoreLayouts(t *testing.T) {
+	contents := []byte("hello world")
+
+	// The default keeps the layout from before the option existed
+	ds := makeFileDatastore(t, nil)
+	location, _ := uploadToFileDatastore(t, ds, contents)
+	assert.Regexp(t, regexp.MustCompile(`^[^/]{2}/[^/]{2}/[^/]+idv2fmt$`), location)
+	assertFileDatastoreContents(t, ds, location, contents)
+
+	ds = makeFileDatastore(t, map[string]string{"pathLayout": "hash", "pathDepth": "3"})
+	location, sha256hash := uploadToFileDatastore(t, ds, contents)
+	assert.Regexp(t, regexp.MustCompile(`^`+sha256hash[0:2]+`/`+sha256hash[2:4]+`/`+sha256hash[4:6]+`/[^/]+idv2fmt$`), location)
+	assertFileDatastoreContents(t, ds, location, contents)
+
+	ds = makeFileDatastore(t, map[string]string{"pathLayout": "date"})
+	before := time.Now().UTC().Format("2006/01/02")
+	location, _ = uploadToFileDatastore(t, ds, contents)
+	after := time.Now().UTC().Format("2006/01/02")
+	assert.Contains(t, []string{before, after}, path.Dir(location))
+	assertFileDatastoreContents(t, ds, location, contents)
+
+	ds = makeFileDatastore(t, map[string]string{"pathLayout": "id", "pathDepth": "0"})
+	location, _ = uploadToFileDatastore(t, ds, contents)
+	assert.Regexp(t, regexp.MustCompile(`^[^/]+idv2fmt$`), location)
+	assertFileDatastoreContents(t, ds, location, contents)
+}
+
+func TestFileDatastoreLayoutInvalid(t *testing.T) {
+	contents := []byte("hello world")
+	hash := sha256.Sum256(contents)
+	for _, opts := range []map[string]string{
+		{"pathLayout": "alphabetical"},
+		{"pathLayout": "hash", "pathDepth": "-1"},
+		{"pathLayout": "hash", "pathDepth": "99"},
+		{"pathDepth": "two"},
+	} {
+		ds := makeFileDatastore(t, opts)
+		_, err := datastores.Upload(rcontext.InitialNoConfig(), ds, io.NopCloser(bytes.NewReader(contents)), int64(len(contents)), "text/plain", hex.EncodeToString(hash[:]))
+		assert.Error(t, err, opts)
+	}
+}
+
+func TestFileDatastoreLegacyLocations(t *testing.T) {
+	// Files stored under an older layout (or before layouts existed) are still found at their recorded location
+	ds := makeFileDatastore(t, map[string]string{"pathLayout": "date"})
+	contents := []byte("legacy")
+	for _, location := range []string{"flatfile", "ab/cd/efgh"} {
+		fpath := path.Join(ds.Options["path"], location)
+		assert.NoError(t, os.MkdirAll(path.Dir(fpath), 0755))
+		assert.NoError(t, os.WriteFile(fpath, contents, 0644))
+
+		assertFileDatastoreContents(t, ds, location, contents)
+		assert.NoError(t, datastores.Remove(rcontext.InitialNoConfig(), ds, location))
+		_, err := os.Stat(fpath)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
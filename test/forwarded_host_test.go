@@ -0,0 +1,92 @@
+package test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+func makeForwardedConfig(proxies ...string) config.GeneralConfig {
+	general := config.NewDefaultMainConfig().General
+	general.TrustedProxies = proxies
+	return general
+}
+
+func TestForwardedHostFromTrustedProxy(t *testing.T) {
+	general := makeForwardedConfig("10.0.0.0/8", "192.168.1.5")
+
+	r := httptest.NewRequest("POST", "/_matrix/media/v3/upload", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Set("X-Forwarded-Host", "example.org")
+	assert.Equal(t, "example.org", _routers.ResolveForwardedHost(r, general))
+
+	r = httptest.NewRequest("POST", "/_matrix/media/v3/upload", nil)
+	r.RemoteAddr = "192.168.1.5:4567"
+	r.Header.Set("Forwarded", `for=203.0.113.7;proto=https;host="example.org"`)
+	assert.Equal(t, "", _routers.ResolveForwardedHost(r, general)) // not the configured header
+	general.ForwardedHostHeader = "Forwarded"
+	assert.Equal(t, "example.org", _routers.ResolveForwardedHost(r, general))
+}
+
+func TestForwardedHostOnlyUsesConfiguredHeader(t *testing.T) {
+	general := makeForwardedConfig("10.0.0.0/8")
+	general.ForwardedHostHeader = "Forwarded"
+
+	// The proxy sets Forwarded, but passes along the client's X-Forwarded-Host
+	r := httptest.NewRequest("POST", "/_matrix/media/v3/upload", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Set("Forwarded", "for=203.0.113.7;host=example.org")
+	r.Header.Set("X-Forwarded-Host", "victim.example.org")
+	assert.Equal(t, "example.org", _routers.ResolveForwardedHost(r, general))
+
+	// And the other way around
+	general.ForwardedHostHeader = "X-Forwarded-Host"
+	r = httptest.NewRequest("POST", "/_matrix/media/v3/upload", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Set("Forwarded", "host=victim.example.org")
+	r.Header.Set("X-Forwarded-Host", "example.org")
+	assert.Equal(t, "example.org", _routers.ResolveForwardedHost(r, general))
+}
+
+func TestForwardedHostSpoofedFromUntrustedAddress(t *testing.T) {
+	general := makeForwardedConfig("10.0.0.0/8")
+
+	r := httptest.NewRequest("POST", "/_matrix/media/v3/upload", nil)
+	r.RemoteAddr = "203.0.113.7:4567"
+	r.Header.Set("X-Forwarded-Host", "victim.example.org")
+	r.Header.Set("Forwarded", "host=victim.example.org")
+	assert.Equal(t, "", _routers.ResolveForwardedHost(r, general))
+}
+
+func TestForwardedHostUsesClosestProxy(t *testing.T) {
+	general := makeForwardedConfig("10.0.0.0/8")
+
+	// A client can send its own headers through the proxy, but the proxy's value comes last
+	r := httptest.NewRequest("POST", "/_matrix/media/v3/upload", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Add("X-Forwarded-Host", "victim.example.org")
+	r.Header.Add("X-Forwarded-Host", "example.org")
+	assert.Equal(t, "example.org", _routers.ResolveForwardedHost(r, general))
+
+	general.ForwardedHostHeader = "Forwarded"
+	r = httptest.NewRequest("POST", "/_matrix/media/v3/upload", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Set("Forwarded", "host=victim.example.org, for=203.0.113.7;host=example.org")
+	assert.Equal(t, "example.org", _routers.ResolveForwardedHost(r, general))
+}
+
+func TestForwardedHostWithoutTrustedProxies(t *testing.T) {
+	// Nothing is trusted by default
+	r := httptest.NewRequest("POST", "/_matrix/media/v3/upload", nil)
+	r.RemoteAddr = "127.0.0.1:4567"
+	r.Header.Set("X-Forwarded-Host", "example.org")
+	assert.Equal(t, "", _routers.ResolveForwardedHost(r, makeForwardedConfig()))
+
+	general := makeForwardedConfig("127.0.0.1")
+	assert.Equal(t, "example.org", _routers.ResolveForwardedHost(r, general))
+	general.UseForwardedHost = false
+	assert.Equal(t, "", _routers.ResolveForwardedHost(r, general))
+}
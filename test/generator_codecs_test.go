@@ -0,0 +1,76 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/i"
+)
+
+func TestGeneratorUnavailableCodec(t *testing.T) {
+	// Without any external tools on the PATH, the generators which run them can't work. The tools are checked for
+	// again once the PATH is restored.
+	t.Cleanup(func() {
+		i.CheckCodecs()
+	})
+	t.Setenv("PATH", t.TempDir())
+	unavailable := i.CheckCodecs()
+	for _, name := range []string{"svg", "jpegxl", "mp4"} {
+		assert.Contains(t, unavailable, name)
+	}
+	assert.NotContains(t, unavailable, "png")
+
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" width="64" height="64"><rect width="64" height="64" fill="red"/></svg>`
+	ctx := test_internals.MakeTestContext(allowSvgThumbnails)
+	g, _, err := thumbnailing.GetGenerator(strings.NewReader(svg), "image/svg+xml", false, ctx)
+	assert.Nil(t, g)
+	assert.ErrorIs(t, err, thumbnailing.ErrUnsupported)
+	assert.ErrorIs(t, err, thumbnailing.ErrCodecUnavailable)
+
+	// By default the media is treated as unsupported, so gets a placeholder (if there is one)
+	_, err = thumbnailing.GenerateThumbnail(io.NopCloser(strings.NewReader(svg)), "image/svg+xml", 32, 32, "scale", false, ctx)
+	assert.ErrorIs(t, err, thumbnailing.ErrUnsupported)
+	assert.ErrorIs(t, err, thumbnailing.ErrCodecUnavailable)
+
+	ctx.Config.Thumbnails.UnavailableCodecs = thumbnailing.UnavailableCodecsError
+	_, err = thumbnailing.GenerateThumbnail(io.NopCloser(strings.NewReader(svg)), "image/svg+xml", 32, 32, "scale", false, ctx)
+	assert.ErrorIs(t, err, thumbnailing.ErrCodecUnavailable)
+	assert.NotErrorIs(t, err, thumbnailing.ErrUnsupported)
+
+	// Generators which don't need a codec are unaffected
+	b := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(b, image.NewNRGBA(image.Rect(0, 0, 64, 64))))
+	thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(b.Bytes())), "image/png", 32, 32, "scale", false, ctx)
+	if assert.NoError(t, err) {
+		_ = thumb.Reader.Close()
+	}
+}
+
+func TestGeneratorJpegxlCodec(t *testing.T) {
+	// An ImageMagick without JPEG XL support is installed, but can't convert the images
+	dir := t.TempDir()
+	t.Cleanup(func() {
+		i.CheckCodecs()
+	})
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "convert"), []byte("#!/bin/sh\necho 'no decode delegate for this image format' >&2\nexit 1\n"), 0700))
+	unavailable := i.CheckCodecs()
+	assert.Contains(t, unavailable, "jpegxl")
+	assert.NotContains(t, unavailable, "svg")
+
+	// One that can convert them is fine
+	b := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(b, image.NewNRGBA(image.Rect(0, 0, 10, 10))))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "fixture.png"), b.Bytes(), 0600))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "convert"), []byte("#!/bin/sh\ncp \""+path.Join(dir, "fixture.png")+"\" \"$2\"\n"), 0700))
+	assert.NotContains(t, i.CheckCodecs(), "jpegxl")
+}
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/kettek/apng"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/i"
+)
+
+func allowSvgThumbnails(c *config.DomainRepoConfig) {
+	c.Thumbnails.Types = append(c.Thumbnails.Types, "image/svg+xml")
+}
+
+func makeAnimatedPng(t *testing.T) []byte {
+	a := apng.APNG{Frames: make([]apng.Frame, 2)}
+	for idx := range a.Frames {
+		img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+		img.Set(idx, idx, color.NRGBA{R: 0xFF, A: 0xFF})
+		a.Frames[idx] = apng.Frame{Image: img, DelayNumerator: 1, DelayDenominator: 10}
+	}
+	b := &bytes.Buffer{}
+	assert.NoError(t, apng.Encode(b, a))
+	return b.Bytes()
+}
+
+func TestGeneratorDefaultOrderIsDeterministic(t *testing.T) {
+	names := i.GetGeneratorNames()
+	assert.Equal(t, names, i.GetGeneratorNames())
+	assert.Less(t, slices.Index(names, "apng"), slices.Index(names, "png"))
+}
+
+func TestGeneratorDisabledIsNeverSelected(t *testing.T) {
+	b := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(b, image.NewNRGBA(image.Rect(0, 0, 8, 8))))
+	ctx := test_internals.MakeTestContext(allowSvgThumbnails)
+
+	g, _, err := thumbnailing.GetGenerator(bytes.NewReader(b.Bytes()), "image/png", false, ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, g) {
+		assert.Equal(t, "png", g.Name())
+	}
+
+	ctx.Config.Thumbnails.DisabledGenerators = []string{"png"}
+	g, _, err = thumbnailing.GetGenerator(bytes.NewReader(b.Bytes()), "image/png", false, ctx)
+	assert.ErrorIs(t, err, thumbnailing.ErrUnsupported)
+	assert.Nil(t, g)
+
+	ctx.Config.Thumbnails.DisabledGenerators = []string{"svg"}
+	_, err = thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader([]byte("<svg></svg>"))), "image/svg+xml", 32, 32, "scale", false, ctx)
+	assert.ErrorIs(t, err, thumbnailing.ErrUnsupported)
+
+	// Disabling the animated generator falls back to a static one
+	animated := makeAnimatedPng(t)
+	ctx.Config.Thumbnails.DisabledGenerators = []string{"apng"}
+	g, _, err = thumbnailing.GetGenerator(bytes.NewReader(animated), "image/png", true, ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, g) {
+		assert.Equal(t, "png", g.Name())
+	}
+}
+
+func TestGeneratorOrderOverride(t *testing.T) {
+	animated := makeAnimatedPng(t)
+	ctx := test_internals.MakeTestContext(allowSvgThumbnails)
+
+	g, _, err := thumbnailing.GetGenerator(bytes.NewReader(animated), "image/png", false, ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, g) {
+		assert.Equal(t, "apng", g.Name())
+	}
+
+	ctx.Config.Thumbnails.GeneratorOrder = []string{"png"}
+	g, _, err = thumbnailing.GetGenerator(bytes.NewReader(animated), "image/png", false, ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, g) {
+		assert.Equal(t, "png", g.Name())
+	}
+}
@@ -0,0 +1,131 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+)
+
+var (
+	gifRed   = color.RGBA{R: 255, A: 255}
+	gifBlue  = color.RGBA{B: 255, A: 255}
+	gifGreen = color.RGBA{G: 255, A: 255}
+)
+
+var gifTestPalette = color.Palette{color.Transparent, gifRed, gifBlue, gifGreen}
+
+func makeGifFrame(bounds image.Rectangle, fill image.Rectangle, c color.Color) *image.Paletted {
+	img := image.NewPaletted(bounds, gifTestPalette)
+	draw.Draw(img, fill, image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+// renderGif draws the GIF's frames the way browsers do, returning what is shown for each frame.
+func renderGif(g *gif.GIF) []*image.RGBA {
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	frames := make([]*image.RGBA, 0, len(g.Image))
+	for i, img := range g.Image {
+		previous := append([]byte{}, canvas.Pix...)
+		draw.Draw(canvas, img.Bounds(), img, img.Bounds().Min, draw.Over)
+		frame := image.NewRGBA(canvas.Bounds())
+		copy(frame.Pix, canvas.Pix)
+		frames = append(frames, frame)
+
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, img.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous)
+		}
+	}
+	return frames
+}
+
+// makeDisposalGif makes a 16x16 GIF with a red bar on the left which stays put, and a blue square which moves
+// down the right side. The square's frames are restored to background, so it shouldn't leave a trail.
+func makeDisposalGif(t *testing.T) []byte {
+	canvas := image.Rect(0, 0, 16, 16)
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			makeGifFrame(canvas, image.Rect(0, 0, 4, 16), gifRed),
+			makeGifFrame(image.Rect(8, 0, 16, 8), image.Rect(8, 0, 16, 8), gifBlue),
+			makeGifFrame(image.Rect(8, 8, 16, 16), image.Rect(8, 8, 16, 16), gifBlue),
+			makeGifFrame(image.Rect(4, 4, 8, 8), image.Rect(4, 4, 8, 8), gifGreen),
+		},
+		Delay:    []int{10, 10, 10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalBackground, gif.DisposalPrevious},
+		Config:   image.Config{ColorModel: gifTestPalette, Width: 16, Height: 16},
+	}
+	b := &bytes.Buffer{}
+	assert.NoError(t, gif.EncodeAll(b, g))
+	return b.Bytes()
+}
+
+func thumbnailGif(t *testing.T, fixture []byte, transparency bool) *gif.GIF {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.Thumbnails.GifTransparency = transparency
+
+	// Asking for a larger thumbnail keeps the frames at their original size, so they can be compared exactly
+	thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(fixture)), "image/gif", 64, 64, "scale", true, ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer thumb.Reader.Close()
+	assert.True(t, thumb.Animated)
+	g, err := gif.DecodeAll(thumb.Reader)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return g
+}
+
+func TestGifThumbnailDisposal(t *testing.T) {
+	fixture := makeDisposalGif(t)
+	source, err := gif.DecodeAll(bytes.NewReader(fixture))
+	assert.NoError(t, err)
+	expected := renderGif(source)
+
+	// Sanity check what the frames should look like
+	assert.Equal(t, gifBlue, expected[1].At(12, 4))
+	assert.Equal(t, color.RGBA{}, expected[2].At(12, 4)) // the square has moved on
+	assert.Equal(t, gifBlue, expected[2].At(12, 12))
+	assert.Equal(t, gifRed, expected[2].At(2, 2)) // disposing of the square doesn't remove the bar
+	assert.Equal(t, gifGreen, expected[3].At(5, 5))
+	assert.Equal(t, color.RGBA{}, expected[3].At(12, 12))
+
+	g := thumbnailGif(t, fixture, true)
+	actual := renderGif(g)
+	assert.Len(t, actual, len(expected))
+	for i := range expected {
+		assert.Equal(t, expected[i].Pix, actual[i].Pix, "frame %d", i)
+	}
+}
+
+func TestGifThumbnailFlattened(t *testing.T) {
+	g := thumbnailGif(t, makeDisposalGif(t), false)
+	frames := renderGif(g)
+	assert.Len(t, frames, 4)
+
+	// Transparent areas are filled with the background colour (the first in the palette, made opaque)
+	black := color.RGBA{A: 255}
+	assert.Equal(t, black, frames[2].At(12, 4))
+	assert.Equal(t, gifBlue, frames[2].At(12, 12))
+	assert.Equal(t, gifRed, frames[2].At(2, 2))
+	for _, f := range frames {
+		for i := 3; i < len(f.Pix); i += 4 {
+			if f.Pix[i] != 255 {
+				t.Fatal("expected every pixel to be opaque")
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// makeTestIco builds an icon with a PNG-encoded image for each of the given sizes, plus a
+// 32-bit bitmap-encoded image of bmpSize (if greater than zero).
+func makeTestIco(t *testing.T, sizes []int, bmpSize int) []byte {
+	images := make([][]byte, 0)
+	dims := make([]int, 0)
+	for _, s := range sizes {
+		img := image.NewNRGBA(image.Rect(0, 0, s, s))
+		b := &bytes.Buffer{}
+		assert.NoError(t, png.Encode(b, img))
+		images = append(images, b.Bytes())
+		dims = append(dims, s)
+	}
+	if bmpSize > 0 {
+		header := make([]byte, 40)
+		binary.LittleEndian.PutUint32(header[0:4], 40)
+		binary.LittleEndian.PutUint32(header[4:8], uint32(bmpSize))
+		binary.LittleEndian.PutUint32(header[8:12], uint32(bmpSize*2)) // includes the AND mask
+		binary.LittleEndian.PutUint16(header[12:14], 1)
+		binary.LittleEndian.PutUint16(header[14:16], 32)
+		pixels := bytes.Repeat([]byte{0xFF, 0x00, 0x00, 0x80}, bmpSize*bmpSize) // translucent blue (BGRA)
+		mask := make([]byte, ((bmpSize+31)/32)*4*bmpSize)
+		images = append(images, append(append(header, pixels...), mask...))
+		dims = append(dims, bmpSize)
+	}
+
+	out := &bytes.Buffer{}
+	_ = binary.Write(out, binary.LittleEndian, []uint16{0, 1, uint16(len(images))})
+	offset := 6 + (16 * len(images))
+	for i, b := range images {
+		entry := make([]byte, 16)
+		entry[0] = byte(dims[i] % 256)
+		entry[1] = byte(dims[i] % 256)
+		binary.LittleEndian.PutUint16(entry[4:6], 1)
+		binary.LittleEndian.PutUint16(entry[6:8], 32)
+		binary.LittleEndian.PutUint32(entry[8:12], uint32(len(b)))
+		binary.LittleEndian.PutUint32(entry[12:16], uint32(offset))
+		out.Write(entry)
+		offset += len(b)
+	}
+	for _, b := range images {
+		out.Write(b)
+	}
+	return out.Bytes()
+}
+
+func TestIcoSelectsClosestSize(t *testing.T) {
+	ico, err := u.ReadIco(bytes.NewReader(makeTestIco(t, []int{16, 32, 256}, 0)))
+	assert.NoError(t, err)
+	assert.Len(t, ico.Entries, 3)
+
+	cases := map[int]int{
+		32:  32,  // exact
+		20:  16,  // closest below
+		40:  32,  // closest above
+		144: 256, // tie between 32 and 256 goes to the larger image
+		999: 256, // nothing close, so the largest
+		0:   256, // no preference, so the largest
+	}
+	for preferred, expected := range cases {
+		img, err := ico.Decode(preferred)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, img.Bounds().Dx(), "preferred size %d", preferred)
+		assert.Equal(t, expected, img.Bounds().Dy(), "preferred size %d", preferred)
+	}
+
+	largest := ico.Largest()
+	assert.Equal(t, 256, largest.Width)
+	assert.Equal(t, 256, largest.Height)
+}
+
+func TestIcoDecodesBitmapEntries(t *testing.T) {
+	ico, err := u.ReadIco(bytes.NewReader(makeTestIco(t, []int{16}, 48)))
+	assert.NoError(t, err)
+
+	img, err := ico.Decode(48)
+	assert.NoError(t, err)
+	assert.Equal(t, 48, img.Bounds().Dx())
+	assert.Equal(t, 48, img.Bounds().Dy())
+	assert.Equal(t, color.NRGBA{R: 0, G: 0, B: 255, A: 128}, color.NRGBAModel.Convert(img.At(10, 10)))
+}
+
+func TestIcoRejectsNonIcons(t *testing.T) {
+	_, err := u.ReadIco(bytes.NewReader([]byte("definitely not an icon")))
+	assert.Error(t, err)
+}
+
+func TestIcoRejectsMismatchedDimensions(t *testing.T) {
+	// The directory says 16x16, but the embedded images claim to be huge. Neither should be allocated.
+	withPng := makeTestIco(t, []int{16}, 0)
+	ihdr := withPng[6+16+8:] // after the directory and PNG signature
+	binary.BigEndian.PutUint32(ihdr[8:12], 65535)
+	binary.BigEndian.PutUint32(ihdr[12:16], 65535)
+	binary.BigEndian.PutUint32(ihdr[8+13:8+13+4], crc32.ChecksumIEEE(ihdr[4:8+13]))
+
+	withBmp := makeTestIco(t, nil, 16)
+	info := withBmp[6+16:]
+	binary.LittleEndian.PutUint32(info[4:8], 65535)
+	binary.LittleEndian.PutUint32(info[8:12], 65535*2)
+
+	for name, b := range map[string][]byte{"png": withPng, "bmp": withBmp} {
+		ico, err := u.ReadIco(bytes.NewReader(b))
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		assert.Equal(t, 16, ico.Largest().Width, name)
+		_, err = ico.Decode(0)
+		assert.ErrorContains(t, err, "65535x65535", name)
+	}
+}
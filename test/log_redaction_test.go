@@ -0,0 +1,77 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/logging"
+)
+
+func captureLogLine(t *testing.T, redact bool, key string, fields logrus.Fields) string {
+	logger := logrus.StandardLogger()
+	formatter := logger.Formatter
+	level := logger.GetLevel()
+	output := logger.Out
+	wasRedacting := logging.RedactionEnabled()
+	t.Cleanup(func() {
+		logger.SetFormatter(formatter)
+		logger.SetLevel(level)
+		logger.SetOutput(output)
+		logging.SetRedaction(wasRedacting, "")
+	})
+
+	assert.NoError(t, logging.Setup("-", false, true, "info"))
+	logging.SetRedaction(redact, key)
+	buf := &bytes.Buffer{}
+	logrus.SetOutput(buf)
+
+	logrus.WithFields(fields).Info("test message")
+	return buf.String()
+}
+
+func TestLogRedactionDisabled(t *testing.T) {
+	line := captureLogLine(t, false, "", logrus.Fields{"userId": "@alice:example.org", "filename": "holiday.jpg"})
+	assert.Contains(t, line, "@alice:example.org")
+	assert.Contains(t, line, "holiday.jpg")
+}
+
+func TestLogRedactionEnabled(t *testing.T) {
+	fields := logrus.Fields{
+		"userId":     "@alice:example.org",
+		"authUserId": "@alice:example.org",
+		"filename":   "holiday.jpg",
+		"mediaId":    "abc123",
+	}
+	line := captureLogLine(t, true, "", fields)
+	assert.NotContains(t, line, "@alice:example.org")
+	assert.NotContains(t, line, "holiday.jpg")
+	assert.Contains(t, line, "abc123")
+
+	// The hash must be stable so the same user can be correlated across lines
+	assert.Contains(t, line, `"userId":"`+logging.Redact("@alice:example.org")+`"`)
+	assert.Contains(t, line, `"authUserId":"`+logging.Redact("@alice:example.org")+`"`)
+	assert.Equal(t, logging.Redact("@alice:example.org"), logging.Redact("@alice:example.org"))
+	assert.NotEqual(t, logging.Redact("@alice:example.org"), logging.Redact("@bob:example.org"))
+
+	// The caller's fields are not modified
+	assert.Equal(t, "@alice:example.org", fields["userId"])
+}
+
+func TestLogRedactionKeyed(t *testing.T) {
+	fields := logrus.Fields{"userId": "@alice:example.org"}
+	captureLogLine(t, true, "first key", fields)
+	first := logging.Redact("@alice:example.org")
+	line := captureLogLine(t, true, "second key", fields)
+	second := logging.Redact("@alice:example.org")
+
+	// Without the key, the hash can't be checked against guesses
+	assert.NotEqual(t, first, second)
+	assert.Contains(t, line, `"userId":"`+second+`"`)
+	sum := sha256.Sum256([]byte("@alice:example.org"))
+	assert.NotContains(t, second, hex.EncodeToString(sum[:])[:12])
+	assert.Len(t, second, len("redacted:")+32)
+}
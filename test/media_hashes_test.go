@@ -0,0 +1,60 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/homeserver_interop/dendrite"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func TestGroupMediaByHash(t *testing.T) {
+	a1 := &database.DbMedia{MediaId: "a1", Locatable: &database.Locatable{Sha256Hash: "aaa"}}
+	b1 := &database.DbMedia{MediaId: "b1", Locatable: &database.Locatable{Sha256Hash: "bbb"}}
+	a2 := &database.DbMedia{MediaId: "a2", Locatable: &database.Locatable{Sha256Hash: "aaa"}}
+	a3 := &database.DbMedia{MediaId: "a3", Locatable: &database.Locatable{Sha256Hash: "aaa"}}
+
+	grouped := database.GroupMediaByHash([]*database.DbMedia{a1, b1, a2, a3})
+	assert.Len(t, grouped, 2)
+	assert.Equal(t, []*database.DbMedia{a1, a2, a3}, grouped["aaa"]) // order is kept
+	assert.Equal(t, []*database.DbMedia{b1}, grouped["bbb"])
+	assert.NotContains(t, grouped, "ccc")
+
+	assert.Empty(t, database.GroupMediaByHash(nil))
+}
+
+func TestChunk(t *testing.T) {
+	a := []string{"1", "2", "3", "4", "5"}
+	assert.Equal(t, [][]string{{"1", "2"}, {"3", "4"}, {"5"}}, util.Chunk(a, 2))
+	assert.Equal(t, [][]string{{"1", "2", "3", "4", "5"}}, util.Chunk(a, 5))
+	assert.Equal(t, [][]string{{"1", "2", "3", "4", "5"}}, util.Chunk(a, 10))
+	assert.Equal(t, [][]string{{"1", "2", "3", "4", "5"}}, util.Chunk(a, 0)) // no batching
+	assert.Empty(t, util.Chunk([]string{}, 2))
+
+	// Appending to a chunk must not overwrite the next one
+	chunks := util.Chunk(a, 2)
+	_ = append(chunks[0], "x")
+	assert.Equal(t, []string{"3", "4"}, chunks[1])
+}
+
+func TestDendriteSha256Hash(t *testing.T) {
+	hash := sha256.Sum256([]byte("hello world"))
+	expected := hex.EncodeToString(hash[:])
+
+	media := &dendrite.LocalMedia{Base64Hash: base64.RawURLEncoding.EncodeToString(hash[:])}
+	assert.Equal(t, expected, media.Sha256Hash())
+
+	media.Base64Hash = base64.URLEncoding.EncodeToString(hash[:]) // padded
+	assert.Equal(t, expected, media.Sha256Hash())
+
+	media.Base64Hash = ""
+	assert.Empty(t, media.Sha256Hash())
+	media.Base64Hash = "not base64!"
+	assert.Empty(t, media.Sha256Hash())
+	media.Base64Hash = base64.RawURLEncoding.EncodeToString([]byte("too short"))
+	assert.Empty(t, media.Sha256Hash())
+}
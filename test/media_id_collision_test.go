@@ -0,0 +1,39 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+)
+
+func TestMediaIdCollision(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	existing := &database.DbMedia{
+		Origin:    "example.org",
+		MediaId:   "imported",
+		Locatable: &database.Locatable{Sha256Hash: "existing_hash"},
+	}
+
+	// Storing the same content again reuses the existing record
+	record, err := upload.ResolveMediaIdCollision(ctx, existing, "existing_hash")
+	assert.NoError(t, err)
+	assert.Equal(t, existing, record)
+
+	// Different content is rejected by default, rather than handing back the wrong media
+	assert.Equal(t, "reject", ctx.Config.Uploads.MediaIdCollisions)
+	record, err = upload.ResolveMediaIdCollision(ctx, existing, "different_hash")
+	assert.ErrorIs(t, err, common.ErrMediaIdCollision)
+	assert.Nil(t, record)
+
+	// ... unless configured to keep the existing media
+	ctx.Config.Uploads.MediaIdCollisions = "keepExisting"
+	record, err = upload.ResolveMediaIdCollision(ctx, existing, "different_hash")
+	assert.NoError(t, err)
+	assert.Equal(t, existing, record)
+}
@@ -0,0 +1,94 @@
+package test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+)
+
+func makePreferenceRecords() []*database.DbMedia {
+	mk := func(origin string, mediaId string, userId string, creationTs int64) *database.DbMedia {
+		return &database.DbMedia{
+			Origin:      origin,
+			MediaId:     mediaId,
+			UserId:      userId,
+			ContentType: "image/png",
+			UploadName:  "image.png",
+			CreationTs:  creationTs,
+			Locatable:   &database.Locatable{Sha256Hash: "hash"},
+		}
+	}
+	return []*database.DbMedia{
+		mk("remote.example.org", "remote1", "@alice:remote.example.org", 100),
+		mk("example.org", "newest", "@bob:example.org", 300),
+		mk("example.org", "bbb", "@bob:example.org", 200),
+		mk("example.org", "aaa", "@alice:example.org", 200),
+		mk("another.example.org", "aaa", "@carol:another.example.org", 200),
+	}
+}
+
+func mediaIds(records []*database.DbMedia) []string {
+	ids := make([]string, 0, len(records))
+	for _, r := range records {
+		ids = append(ids, r.Origin+"/"+r.MediaId)
+	}
+	return ids
+}
+
+func TestSortMediaByPreferenceIsStable(t *testing.T) {
+	expected := []string{
+		"remote.example.org/remote1",
+		"another.example.org/aaa",
+		"example.org/aaa",
+		"example.org/bbb",
+		"example.org/newest",
+	}
+	expectedForOrigin := []string{
+		"example.org/aaa",
+		"example.org/bbb",
+		"example.org/newest",
+		"remote.example.org/remote1",
+		"another.example.org/aaa",
+	}
+
+	rnd := rand.New(rand.NewSource(42))
+	for i := 0; i < 20; i++ {
+		records := makePreferenceRecords()
+		rnd.Shuffle(len(records), func(i, j int) { records[i], records[j] = records[j], records[i] })
+		database.SortMediaByPreference(records, "")
+		assert.Equal(t, expected, mediaIds(records))
+
+		rnd.Shuffle(len(records), func(i, j int) { records[i], records[j] = records[j], records[i] })
+		database.SortMediaByPreference(records, "example.org")
+		assert.Equal(t, expectedForOrigin, mediaIds(records))
+	}
+}
+
+func TestPickRecord(t *testing.T) {
+	records := makePreferenceRecords()
+	database.SortMediaByPreference(records, "example.org")
+
+	// Oldest perfect match wins
+	record, perfect := upload.PickRecord(records, "example.org", "@bob:example.org", "image/png", "image.png")
+	assert.True(t, perfect)
+	assert.Equal(t, "bbb", record.MediaId)
+
+	// Same file from a different user reuses the preferred record's file
+	record, perfect = upload.PickRecord(records, "example.org", "@dave:example.org", "image/png", "image.png")
+	assert.False(t, perfect)
+	assert.Equal(t, "example.org", record.Origin)
+	assert.Equal(t, "aaa", record.MediaId)
+
+	// Different metadata is not a perfect match
+	_, perfect = upload.PickRecord(records, "example.org", "@bob:example.org", "image/jpeg", "image.png")
+	assert.False(t, perfect)
+	_, perfect = upload.PickRecord(records, "example.org", "@bob:example.org", "image/png", "other.png")
+	assert.False(t, perfect)
+
+	record, perfect = upload.PickRecord(nil, "example.org", "@bob:example.org", "image/png", "image.png")
+	assert.Nil(t, record)
+	assert.False(t, perfect)
+}
@@ -0,0 +1,116 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/pool"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+func setMemoryBudget(t *testing.T, budget config.MemoryBudgetConfig) {
+	test_internals.UseTempConfig(t)
+	original := config.Get().MemoryBudget
+	config.Get().MemoryBudget = budget
+	t.Cleanup(func() {
+		config.Get().MemoryBudget = original
+	})
+}
+
+func TestMemoryBudgetExhausted(t *testing.T) {
+	setMemoryBudget(t, config.MemoryBudgetConfig{MaxBytes: 100, QueueSeconds: 0, RetryAfterSeconds: 7})
+	rejections := testutil.ToFloat64(metrics.MemoryBudgetRejections)
+
+	release1, err := pool.ReserveMemory(context.Background(), 60)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(60), pool.MemoryInFlight())
+	assert.Equal(t, float64(60), testutil.ToFloat64(metrics.MemoryBudgetInFlightBytes))
+
+	// Over budget, and not willing to wait
+	_, err = pool.ReserveMemory(context.Background(), 50)
+	assert.ErrorIs(t, err, common.ErrMemoryBudgetExceeded)
+	assert.Equal(t, rejections+1, testutil.ToFloat64(metrics.MemoryBudgetRejections))
+	assert.Equal(t, int64(60), pool.MemoryInFlight())
+
+	// Releasing makes room again, and releasing twice doesn't count twice
+	release1()
+	release1()
+	assert.Equal(t, int64(0), pool.MemoryInFlight())
+	release2, err := pool.ReserveMemory(context.Background(), 50)
+	assert.NoError(t, err)
+	release2()
+
+	// Streams larger than the whole budget are allowed through on their own
+	release3, err := pool.ReserveMemory(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), pool.MemoryInFlight())
+	release3()
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.MemoryBudgetInFlightBytes))
+
+	// Clients are told the media repo is busy, and when to retry
+	srv := serveGenerated(func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+		return _responses.ServerBusy()
+	})
+	defer srv.Close()
+	res, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, "7", res.Header.Get("Retry-After"))
+}
+
+func TestMemoryBudgetQueues(t *testing.T) {
+	setMemoryBudget(t, config.MemoryBudgetConfig{MaxBytes: 100, QueueSeconds: 5})
+
+	release1, err := pool.ReserveMemory(context.Background(), 80)
+	assert.NoError(t, err)
+
+	reserved := make(chan error)
+	go func() {
+		release2, err := pool.ReserveMemory(context.Background(), 80)
+		if err == nil {
+			release2()
+		}
+		reserved <- err
+	}()
+
+	select {
+	case <-reserved:
+		assert.Fail(t, "reservation should have waited for room")
+	case <-time.After(100 * time.Millisecond):
+	}
+	release1()
+	select {
+	case err = <-reserved:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "reservation was not made after room was released")
+	}
+
+	// Waiting gives up if the request does
+	release1, err = pool.ReserveMemory(context.Background(), 80)
+	assert.NoError(t, err)
+	defer release1()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = pool.ReserveMemory(ctx, 80)
+	assert.ErrorIs(t, err, common.ErrMemoryBudgetExceeded)
+}
+
+func TestMemoryBudgetDisabled(t *testing.T) {
+	setMemoryBudget(t, config.MemoryBudgetConfig{MaxBytes: 0})
+
+	release, err := pool.ReserveMemory(context.Background(), 1<<40)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), pool.MemoryInFlight())
+	release()
+}
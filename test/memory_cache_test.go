@@ -0,0 +1,111 @@
+package test
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/memcache"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+func readCached(t *testing.T, ctx rcontext.RequestContext, media *database.Locatable, sizeBytes int64) ([]byte, error) {
+	f, err := download.OpenCached(ctx, media, sizeBytes, false)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	return b, nil
+}
+
+func setMemoryCache(t *testing.T, cache config.MemoryCacheConfig) {
+	test_internals.UseTempConfig(t)
+	original := config.Get().Downloads.MemoryCache
+	config.Get().Downloads.MemoryCache = cache
+	t.Cleanup(func() {
+		config.Get().Downloads.MemoryCache = original
+	})
+}
+
+func TestMemoryCache(t *testing.T) {
+	setMemoryCache(t, config.MemoryCacheConfig{
+		Enabled:           true,
+		MaxMediaSizeBytes: 64,
+		MaxTotalBytes:     100,
+		TtlSeconds:        3600,
+	})
+
+	ds := makeFileDatastore(t, nil)
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.DataStores = []config.DatastoreConfig{ds}
+
+	contents := []byte("small enough to be cached in memory")
+	location, sha256hash := uploadToFileDatastore(t, ds, contents)
+	media := &database.Locatable{Sha256Hash: sha256hash, DatastoreId: ds.Id, Location: location}
+	t.Cleanup(func() {
+		memcache.Delete(sha256hash)
+	})
+
+	b, err := readCached(t, ctx, media, int64(len(contents)))
+	assert.NoError(t, err)
+	assert.Equal(t, contents, b)
+
+	// The second read is served from memory, without touching the datastore
+	assert.NoError(t, os.Remove(path.Join(ds.Options["path"], location)))
+	b, err = readCached(t, ctx, media, int64(len(contents)))
+	assert.NoError(t, err)
+	assert.Equal(t, contents, b)
+
+	// Once invalidated, the datastore is used again
+	memcache.Delete(sha256hash)
+	_, err = readCached(t, ctx, media, int64(len(contents)))
+	assert.Error(t, err)
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	setMemoryCache(t, config.MemoryCacheConfig{
+		Enabled:           true,
+		MaxMediaSizeBytes: 10,
+		MaxTotalBytes:     20,
+		TtlSeconds:        3600,
+	})
+
+	assert.False(t, memcache.Fits(11))
+	memcache.Set("evict_a", []byte("aaaaaaaaaa"))
+	memcache.Set("evict_b", []byte("bbbbbbbbbb"))
+	t.Cleanup(func() {
+		for _, h := range []string{"evict_a", "evict_b", "evict_c", "evict_big"} {
+			memcache.Delete(h)
+		}
+	})
+
+	// Reading "a" makes "b" the least recently used, so it is evicted to make room for "c"
+	_, ok := memcache.Get("evict_a")
+	assert.True(t, ok)
+	memcache.Set("evict_c", []byte("cccccccccc"))
+	_, ok = memcache.Get("evict_b")
+	assert.False(t, ok)
+	b, ok := memcache.Get("evict_a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("aaaaaaaaaa"), b)
+
+	// Media over the threshold isn't cached
+	memcache.Set("evict_big", []byte("too large to be cached"))
+	_, ok = memcache.Get("evict_big")
+	assert.False(t, ok)
+
+	// Nor is anything kept past its TTL
+	config.Get().Downloads.MemoryCache.TtlSeconds = -1
+	memcache.Set("evict_c", []byte("cccccccccc"))
+	_, ok = memcache.Get("evict_c")
+	assert.False(t, ok)
+}
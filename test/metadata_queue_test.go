@@ -0,0 +1,129 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/pool"
+)
+
+func TestBoundedQueueRejectsWhenFull(t *testing.T) {
+	q := pool.NewBoundedQueue(2, 3, "test")
+	defer q.Release()
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	ran := int32(0)
+	blockingTask := func() {
+		started <- struct{}{}
+		<-release
+		atomic.AddInt32(&ran, 1)
+	}
+
+	// Occupy both workers, then fill up the waiting room
+	assert.True(t, q.TrySchedule(blockingTask))
+	assert.True(t, q.TrySchedule(blockingTask))
+	<-started
+	<-started
+	for i := 0; i < 3; i++ {
+		assert.True(t, q.TrySchedule(func() { atomic.AddInt32(&ran, 1) }))
+	}
+
+	// Anything else is turned away without waiting
+	begin := time.Now()
+	assert.False(t, q.TrySchedule(func() { atomic.AddInt32(&ran, 1) }))
+	assert.Less(t, time.Since(begin), 50*time.Millisecond)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&ran) == 5
+	}, time.Second, 5*time.Millisecond)
+
+	// ... and once there's room again, it's accepted
+	done := make(chan struct{})
+	assert.True(t, q.TrySchedule(func() { close(done) }))
+	<-done
+}
+
+func TestBoundedQueueSurvivesPanics(t *testing.T) {
+	q := pool.NewBoundedQueue(1, 1, "test")
+	defer q.Release()
+
+	assert.True(t, q.TrySchedule(func() { panic("expected panic") }))
+	done := make(chan struct{})
+	assert.Eventually(t, func() bool {
+		return q.TrySchedule(func() { close(done) })
+	}, time.Second, 5*time.Millisecond)
+	<-done
+}
+
+func TestMetadataExtractionBackpressure(t *testing.T) {
+	oldQueue := pool.MetadataQueue
+	defer func() { pool.MetadataQueue = oldQueue }()
+	pool.MetadataQueue = pool.NewBoundedQueue(1, 1, "metadata")
+	defer pool.MetadataQueue.Release()
+
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.Uploads.ExtractExifMetadata = true
+	ctx.Config.Uploads.PerceptualHashes = true
+	record := &database.DbMedia{
+		Origin:      "example.org",
+		MediaId:     "backpressure",
+		ContentType: "image/jpeg",
+		Locatable:   &database.Locatable{Sha256Hash: "abc123"},
+	}
+
+	// Saturate the queue with slow work
+	release := make(chan struct{})
+	started := make(chan struct{})
+	assert.True(t, pool.MetadataQueue.TrySchedule(func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	assert.True(t, pool.MetadataQueue.TrySchedule(func() { <-release }))
+
+	// Many uploads finishing at once don't wait for metadata extraction, and skip it instead
+	wg := new(sync.WaitGroup)
+	begin := time.Now()
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.False(t, upload.QueueMetadataExtraction(ctx, record))
+		}()
+	}
+	wg.Wait()
+	assert.Less(t, time.Since(begin), 100*time.Millisecond)
+	close(release)
+
+	// Nothing is queued when there's nothing to extract
+	ctx.Config.Uploads.ExtractExifMetadata = false
+	ctx.Config.Uploads.PerceptualHashes = false
+	assert.False(t, upload.QueueMetadataExtraction(ctx, record))
+}
+
+func TestDetachedContextOutlivesRequest(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.Uploads.PerceptualHashes = true
+
+	var cancel context.CancelFunc
+	ctx.Context, cancel = context.WithCancel(ctx.Context)
+	detached := ctx.Detached()
+	cancel()
+
+	assert.Error(t, ctx.Err())
+	assert.NoError(t, detached.Err())
+	assert.True(t, detached.Config.Uploads.PerceptualHashes)
+	assert.Equal(t, ctx.Log, detached.Log)
+}
@@ -0,0 +1,91 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// makeScene draws a few soft shapes, so the image has structure at several scales
+func makeScene(width int, height int, shift float64) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			fx := float64(x) / float64(width)
+			fy := float64(y) / float64(height)
+			v := 0.5 + 0.25*math.Sin(fx*7+shift) + 0.25*math.Cos(fy*5)
+			if math.Hypot(fx-0.3, fy-0.6) < 0.2 {
+				v = 0.1
+			} else if fx > 0.55 && fx < 0.85 && fy > 0.15 && fy < 0.45 {
+				v = 0.9
+			}
+			c := uint8(math.Max(0, math.Min(255, v*255)))
+			img.SetNRGBA(x, y, color.NRGBA{R: c, G: c / 2, B: 255 - c, A: 255})
+		}
+	}
+	return img
+}
+
+// makeStripes draws something structurally unrelated to makeScene
+func makeStripes(width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := uint8(0)
+			if (x/(width/6)+y/(height/4))%2 == 0 {
+				c = 255
+			}
+			img.SetNRGBA(x, y, color.NRGBA{R: c, G: c, B: c, A: 255})
+		}
+	}
+	return img
+}
+
+func TestPerceptualHashSimilarImages(t *testing.T) {
+	original := makeScene(640, 480, 0)
+	hash := u.PerceptualHash(original)
+
+	// Re-encoding, scaling, brightening, and blurring all keep the hash close
+	buf := &bytes.Buffer{}
+	assert.NoError(t, imaging.Encode(buf, original, imaging.JPEG, imaging.JPEGQuality(40)))
+	recompressed, err := imaging.Decode(buf)
+	assert.NoError(t, err)
+	similar := map[string]image.Image{
+		"recompressed": recompressed,
+		"scaled":       imaging.Resize(original, 200, 150, imaging.Box),
+		"brightened":   imaging.AdjustBrightness(original, 10),
+		"blurred":      imaging.Blur(original, 1.5),
+		"shifted":      makeScene(640, 480, 0.1),
+	}
+	for name, img := range similar {
+		assert.LessOrEqual(t, u.HammingDistance(hash, u.PerceptualHash(img)), 6, name)
+	}
+
+	// The same image always gets the same hash
+	assert.Equal(t, hash, u.PerceptualHash(original))
+}
+
+func TestPerceptualHashDissimilarImages(t *testing.T) {
+	hash := u.PerceptualHash(makeScene(640, 480, 0))
+
+	dissimilar := map[string]image.Image{
+		"stripes": makeStripes(640, 480),
+		"flipped": imaging.FlipV(makeScene(640, 480, 0)),
+		"other":   imaging.Rotate90(makeScene(480, 640, 2)),
+	}
+	for name, img := range dissimilar {
+		assert.Greater(t, u.HammingDistance(hash, u.PerceptualHash(img)), 20, name)
+	}
+}
+
+func TestHammingDistance(t *testing.T) {
+	assert.Equal(t, 0, u.HammingDistance(0xF0F0, 0xF0F0))
+	assert.Equal(t, 4, u.HammingDistance(0xF0F0, 0xF0FF))
+	assert.Equal(t, 64, u.HammingDistance(0, math.MaxUint64))
+}
@@ -0,0 +1,154 @@
+package test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_prefetch"
+)
+
+// prefetchRecorder tracks how many fetches are running at once, overall and per origin
+type prefetchRecorder struct {
+	lock          sync.Mutex
+	active        int
+	maxActive     int
+	originActive  map[string]int
+	maxPerOrigin  map[string]int
+	fetched       []string
+	originStarted map[string][]time.Time
+}
+
+func newPrefetchRecorder() *prefetchRecorder {
+	return &prefetchRecorder{
+		originActive:  make(map[string]int),
+		maxPerOrigin:  make(map[string]int),
+		fetched:       make([]string, 0),
+		originStarted: make(map[string][]time.Time),
+	}
+}
+
+func (r *prefetchRecorder) fetch(origin string, mediaId string) error {
+	r.lock.Lock()
+	r.active++
+	r.originActive[origin]++
+	r.maxActive = max(r.maxActive, r.active)
+	r.maxPerOrigin[origin] = max(r.maxPerOrigin[origin], r.originActive[origin])
+	r.originStarted[origin] = append(r.originStarted[origin], time.Now())
+	r.lock.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	r.lock.Lock()
+	r.active--
+	r.originActive[origin]--
+	r.fetched = append(r.fetched, fmt.Sprintf("%s/%s", origin, mediaId))
+	r.lock.Unlock()
+	return nil
+}
+
+func TestPrefetchConcurrency(t *testing.T) {
+	rec := newPrefetchRecorder()
+	p := pipeline_prefetch.NewPrefetcher(config.PrefetchConfig{
+		QueueSize:    100,
+		NumWorkers:   4,
+		MaxPerOrigin: 2,
+	}, rec.fetch)
+
+	for i := 0; i < 8; i++ {
+		assert.NoError(t, p.Enqueue("a.example.org", fmt.Sprintf("media%d", i)))
+		assert.NoError(t, p.Enqueue("b.example.org", fmt.Sprintf("media%d", i)))
+		assert.NoError(t, p.Enqueue("c.example.org", fmt.Sprintf("media%d", i)))
+	}
+	p.Stop()
+
+	assert.Len(t, rec.fetched, 24)
+	assert.LessOrEqual(t, rec.maxActive, 4)
+	for origin, n := range rec.maxPerOrigin {
+		assert.LessOrEqual(t, n, 2, origin)
+	}
+
+	// Once stopped, nothing else can be queued
+	assert.ErrorIs(t, p.Enqueue("a.example.org", "late"), common.ErrPrefetchQueueFull)
+}
+
+func TestPrefetchOriginInterval(t *testing.T) {
+	rec := newPrefetchRecorder()
+	p := pipeline_prefetch.NewPrefetcher(config.PrefetchConfig{
+		QueueSize:        10,
+		NumWorkers:       3,
+		MaxPerOrigin:     3,
+		OriginIntervalMs: 50,
+	}, rec.fetch)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, p.Enqueue("example.org", fmt.Sprintf("media%d", i)))
+	}
+	p.Stop()
+
+	started := rec.originStarted["example.org"]
+	if assert.Len(t, started, 3) {
+		for i := 1; i < len(started); i++ {
+			assert.GreaterOrEqual(t, started[i].Sub(started[i-1]), 45*time.Millisecond)
+		}
+	}
+}
+
+func TestPrefetchAllowlist(t *testing.T) {
+	rec := newPrefetchRecorder()
+	p := pipeline_prefetch.NewPrefetcher(config.PrefetchConfig{
+		QueueSize:      10,
+		NumWorkers:     1,
+		AllowedOrigins: []string{"example.org", "*.Example.NET"},
+	}, rec.fetch)
+
+	assert.True(t, p.IsOriginAllowed("example.org"))
+	assert.True(t, p.IsOriginAllowed("matrix.example.net"))
+	assert.False(t, p.IsOriginAllowed("example.net"))
+	assert.False(t, p.IsOriginAllowed("evil.example.org"))
+
+	assert.NoError(t, p.Enqueue("example.org", "allowed"))
+	assert.NoError(t, p.Enqueue("MATRIX.example.net", "allowed"))
+	assert.ErrorIs(t, p.Enqueue("evil.example.org", "denied"), common.ErrHostNotAllowed)
+	p.Stop()
+
+	assert.ElementsMatch(t, []string{"example.org/allowed", "MATRIX.example.net/allowed"}, rec.fetched)
+}
+
+func TestPrefetchQueueBounds(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	fetched := make(chan string, 10)
+	p := pipeline_prefetch.NewPrefetcher(config.PrefetchConfig{
+		QueueSize:  2,
+		NumWorkers: 1,
+	}, func(origin string, mediaId string) error {
+		started <- struct{}{}
+		<-release
+		fetched <- mediaId
+		return nil
+	})
+
+	// The first item is picked up by the worker, which then blocks
+	assert.NoError(t, p.Enqueue("example.org", "first"))
+	<-started
+	assert.NoError(t, p.Enqueue("example.org", "second"))
+	assert.NoError(t, p.Enqueue("example.org", "third"))
+
+	// Duplicates of queued media are ignored rather than taking space
+	assert.NoError(t, p.Enqueue("example.org", "third"))
+	assert.ErrorIs(t, p.Enqueue("example.org", "fourth"), common.ErrPrefetchQueueFull)
+
+	close(release)
+	p.Stop()
+	close(fetched)
+	ids := make([]string, 0)
+	for id := range fetched {
+		ids = append(ids, id)
+	}
+	assert.Equal(t, []string{"first", "second", "third"}, ids)
+}
@@ -0,0 +1,216 @@
+package test
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/t2bot/matrix-media-repo/api/r0"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/tasks/task_runner"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type PreviewCacheTestSuite struct {
+	suite.Suite
+	deps *test_internals.ContainerDeps
+}
+
+func (s *PreviewCacheTestSuite) SetupSuite() {
+	deps, err := test_internals.MakeTestDeps()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.deps = deps
+}
+
+func (s *PreviewCacheTestSuite) TearDownSuite() {
+	if s.deps != nil {
+		if s.T().Failed() {
+			s.deps.Debug()
+		}
+		s.deps.Teardown()
+	}
+}
+
+func (s *PreviewCacheTestSuite) TestPreviewOnlyIfCached() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+
+	requests := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><head><title>Should not be fetched</title></head></html>"))
+	}))
+	defer srv.Close()
+
+	// Nothing is cached for this URL, so we get a 404 without the media repo trying to fetch it
+	qs := url.Values{"url": []string{srv.URL + "/only-if-cached"}, "only_if_cached": []string{"true"}}
+	errRes, err := client1.DoExpectError("GET", "/_matrix/media/v3/preview_url", qs, "", nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, errRes)
+	assert.Equal(t, "M_NOT_FOUND", errRes.Code)
+	assert.Equal(t, http.StatusNotFound, errRes.InjectedStatusCode)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+
+	// Without the flag, the media repo does try to preview it (and refuses, as the host is on a private network)
+	qs.Del("only_if_cached")
+	errRes, err = client1.DoExpectError("GET", "/_matrix/media/v3/preview_url", qs, "", nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, errRes)
+	assert.Equal(t, http.StatusBadRequest, errRes.InjectedStatusCode)
+
+	// Bad flags are rejected
+	qs.Set("only_if_cached", "maybe")
+	errRes, err = client1.DoExpectError("GET", "/_matrix/media/v3/preview_url", qs, "", nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, errRes)
+	assert.Equal(t, http.StatusBadRequest, errRes.InjectedStatusCode)
+}
+
+func (s *PreviewCacheTestSuite) TestPreviewLanguages() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+
+	// Each language is cached separately, so seed a preview for each
+	previewUrl := "https://example.org/languages"
+	bucketTs := util.GetHourBucket(util.NowMillis())
+	previewDb := database.GetInstance().UrlPreviews.Prepare(rcontext.Initial())
+	for language, title := range map[string]string{"en": "Hello", "fr": "Bonjour"} {
+		assert.NoError(t, previewDb.Insert(&database.DbUrlPreview{
+			Url:            previewUrl,
+			BucketTs:       bucketTs,
+			SiteUrl:        previewUrl,
+			Title:          title,
+			LanguageHeader: language,
+		}))
+	}
+
+	qs := url.Values{
+		"url":            []string{previewUrl},
+		"ts":             []string{strconv.FormatInt(bucketTs, 10)},
+		"only_if_cached": []string{"true"},
+		"languages":      []string{"en, fr,en"},
+	}
+	previews := make(map[string]*r0.MatrixOpenGraph)
+	err := client1.DoReturnJson("GET", "/_matrix/media/v3/preview_url", qs, "", nil, &previews)
+	assert.NoError(t, err)
+	assert.Len(t, previews, 2)
+	if assert.Contains(t, previews, "en") && assert.Contains(t, previews, "fr") {
+		assert.Equal(t, "Hello", previews["en"].Title)
+		assert.Equal(t, "Bonjour", previews["fr"].Title)
+	}
+
+	// Languages which aren't available are left out
+	qs.Set("languages", "en,de")
+	previews = make(map[string]*r0.MatrixOpenGraph)
+	err = client1.DoReturnJson("GET", "/_matrix/media/v3/preview_url", qs, "", nil, &previews)
+	assert.NoError(t, err)
+	assert.Len(t, previews, 1)
+	assert.Contains(t, previews, "en")
+
+	// ... unless none are
+	qs.Set("languages", "de")
+	errRes, err := client1.DoExpectError("GET", "/_matrix/media/v3/preview_url", qs, "", nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, errRes)
+	assert.Equal(t, http.StatusNotFound, errRes.InjectedStatusCode)
+
+	// The number of languages is limited
+	qs.Set("languages", "en,fr,de,es,it")
+	errRes, err = client1.DoExpectError("GET", "/_matrix/media/v3/preview_url", qs, "", nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, errRes)
+	assert.Equal(t, http.StatusBadRequest, errRes.InjectedStatusCode)
+}
+
+func (s *PreviewCacheTestSuite) TestPurgePreviewImages() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+	ctx := rcontext.Initial()
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+	attrsDb := database.GetInstance().MediaAttributes.Prepare(ctx)
+
+	upload := func(name string, width int) *database.DbMedia {
+		contentType, img, err := test_internals.MakeTestImage(width, width)
+		assert.NoError(t, err)
+		res, err := client1.Upload(name+util.ExtensionForContentType(contentType), contentType, img)
+		assert.NoError(t, err)
+		origin, mediaId, err := util.SplitMxc(res.MxcUri)
+		assert.NoError(t, err)
+		record, err := mediaDb.GetById(origin, mediaId)
+		assert.NoError(t, err)
+		assert.NotNil(t, record)
+		return record
+	}
+
+	// A user's upload, a preview image, and a preview image sharing a file with another user upload
+	userMedia := upload("user", 128)
+	previewImage := upload("preview", 129)
+	sharedUserMedia := upload("user", 130)
+	sharedPreviewImage := upload("preview", 130)
+	assert.NotEqual(t, sharedUserMedia.MediaId, sharedPreviewImage.MediaId)
+	assert.Equal(t, sharedUserMedia.Location, sharedPreviewImage.Location)
+	for _, r := range []*database.DbMedia{previewImage, sharedPreviewImage} {
+		assert.NoError(t, attrsDb.UpsertPurpose(r.Origin, r.MediaId, database.PurposeUrlPreview))
+	}
+
+	// A cached preview using one of the images
+	previewDb := database.GetInstance().UrlPreviews.Prepare(ctx)
+	bucketTs := util.GetHourBucket(util.NowMillis())
+	previewUrl := "https://example.org/purge-preview-images"
+	assert.NoError(t, previewDb.Insert(&database.DbUrlPreview{
+		Url:      previewUrl,
+		BucketTs: bucketTs,
+		SiteUrl:  previewUrl,
+		ImageMxc: util.MxcUri(previewImage.Origin, previewImage.MediaId),
+	}))
+
+	// Nothing is old enough yet
+	count, err := task_runner.PurgePreviewImagesBefore(ctx, previewImage.CreationTs-1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	count, err = task_runner.PurgePreviewImagesBefore(ctx, util.NowMillis()+1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	for _, r := range []*database.DbMedia{previewImage, sharedPreviewImage} {
+		record, err := mediaDb.GetById(r.Origin, r.MediaId)
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+	}
+	for _, r := range []*database.DbMedia{userMedia, sharedUserMedia} {
+		record, err := mediaDb.GetById(r.Origin, r.MediaId)
+		assert.NoError(t, err)
+		assert.NotNil(t, record)
+
+		// ... and the file is still there
+		res, err := client1.DoRaw("GET", fmt.Sprintf("/_matrix/media/v3/download/%s/%s", r.Origin, r.MediaId), nil, "", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		test_internals.AssertIsTestImage(t, res.Body)
+		_ = res.Body.Close()
+	}
+
+	preview, err := previewDb.Get(previewUrl, bucketTs, "")
+	assert.NoError(t, err)
+	assert.Nil(t, preview)
+}
+
+func TestPreviewCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(PreviewCacheTestSuite))
+}
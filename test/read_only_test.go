@@ -0,0 +1,34 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_create"
+)
+
+func TestReadOnlyOverride(t *testing.T) {
+	readOnly := true
+	config.SetReadOnlyOverride(&readOnly)
+	defer config.SetReadOnlyOverride(nil)
+	assert.True(t, config.IsReadOnly())
+	assert.True(t, config.HasReadOnlyOverride())
+
+	readOnly = false
+	config.SetReadOnlyOverride(&readOnly)
+	assert.False(t, config.IsReadOnly())
+}
+
+func TestReadOnlyRejectsCreate(t *testing.T) {
+	readOnly := true
+	config.SetReadOnlyOverride(&readOnly)
+	defer config.SetReadOnlyOverride(nil)
+
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	_, err := pipeline_create.Execute(ctx, "example.org", "@alice:example.org", pipeline_create.DefaultExpirationTime)
+	assert.ErrorIs(t, err, common.ErrReadOnly)
+}
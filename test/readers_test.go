@@ -0,0 +1,33 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+func TestLimitReaderWithOverrunErrorUnderLimit(t *testing.T) {
+	r := readers.LimitReaderWithOverrunError(io.NopCloser(bytes.NewReader(make([]byte, 100))), 101)
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Len(t, b, 100)
+}
+
+func TestLimitReaderWithOverrunErrorExactLimit(t *testing.T) {
+	r := readers.LimitReaderWithOverrunError(io.NopCloser(bytes.NewReader(make([]byte, 100))), 100)
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Len(t, b, 100)
+}
+
+func TestLimitReaderWithOverrunErrorOverLimit(t *testing.T) {
+	// io.ReadAll uses a buffer larger than the limit, so this also ensures a single large read can't overrun
+	r := readers.LimitReaderWithOverrunError(io.NopCloser(bytes.NewReader(make([]byte, 101))), 100)
+	b, err := io.ReadAll(r)
+	assert.ErrorIs(t, err, common.ErrMediaTooLarge)
+	assert.LessOrEqual(t, len(b), 100)
+}
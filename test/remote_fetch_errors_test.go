@@ -0,0 +1,77 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// serveErrorResponse replies to every request with res, going through the same router which maps errors to
+// status codes for the real endpoints.
+func serveErrorResponse(res *_responses.ErrorResponse) *httptest.Server {
+	return serveGenerated(func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+		return res
+	})
+}
+
+// serveGenerated replies to every request with whatever the generator returns, like the real endpoints.
+func serveGenerated(generatorFn _routers.GeneratorFn) *httptest.Server {
+	return serveGeneratedWith(config.NewDefaultDomainConfig(), generatorFn)
+}
+
+// serveGeneratedWith is serveGenerated, but with the given config.
+func serveGeneratedWith(cfg config.DomainRepoConfig, generatorFn _routers.GeneratorFn) *httptest.Server {
+	router := _routers.NewRContextRouter(generatorFn, nil)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), common.ContextLogger, logrus.NewEntry(logrus.New()))
+		ctx = context.WithValue(ctx, common.ContextDomainConfig, &cfg)
+		router.ServeHTTP(w, r.WithContext(ctx))
+	}))
+}
+
+func TestRemoteFetchErrorResponses(t *testing.T) {
+	cases := []struct {
+		res          *_responses.ErrorResponse
+		status       int
+		code         string
+		internalCode string
+	}{
+		{_responses.NotFoundError(), http.StatusNotFound, common.ErrCodeNotFound, common.ErrCodeNotFound},
+		{_responses.RemoteFetchDisabled(), http.StatusNotFound, common.ErrCodeNotFound, common.ErrCodeRemoteFetchDisabled},
+		{_responses.RemoteFetchFailed(), http.StatusBadGateway, common.ErrCodeUnknown, common.ErrCodeRemoteFetchFailed},
+	}
+	for _, c := range cases {
+		srv := serveErrorResponse(c.res)
+		res, err := http.Get(srv.URL)
+		assert.NoError(t, err)
+		assert.Equal(t, c.status, res.StatusCode, c.internalCode)
+
+		body := &_responses.ErrorResponse{}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(body))
+		assert.Equal(t, c.code, body.Code)
+		assert.Equal(t, c.internalCode, body.InternalCode)
+		_ = res.Body.Close()
+		srv.Close()
+	}
+}
+
+func TestRemoteFetchFailedWrapping(t *testing.T) {
+	// The download steps wrap the underlying cause, which must still be reachable
+	cause := errors.New("connection refused")
+	err := fmt.Errorf("%w: %w", common.ErrRemoteFetchFailed, cause)
+	assert.ErrorIs(t, err, common.ErrRemoteFetchFailed)
+	assert.ErrorIs(t, err, cause)
+	assert.NotErrorIs(t, err, common.ErrMediaNotFound)
+}
@@ -0,0 +1,81 @@
+package test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+var remoteProbeBody = bytes.Repeat([]byte("probe"), 1000)
+
+// probeOrigin is a federated server with one piece of media (called "media"). It records the requests made to it.
+type probeOrigin struct {
+	lock     sync.Mutex
+	requests []string
+
+	supportsHead bool
+}
+
+func (o *probeOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.lock.Lock()
+	o.requests = append(o.requests, r.Method+" "+r.Header.Get("Range"))
+	o.lock.Unlock()
+
+	if r.Method == http.MethodHead && !o.supportsHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/_matrix/media/v3/download/") || !strings.HasSuffix(r.URL.Path, "/media") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"archive.zip\"")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(remoteProbeBody))
+}
+
+func probeTestOrigin(t *testing.T, origin *probeOrigin) (rcontext.RequestContext, string) {
+	test_internals.UseTempConfig(t)
+	t.Setenv("MEDIA_REPO_UNSAFE_FEDERATION", "true") // for the test server's certificate
+	srv := httptest.NewTLSServer(origin)
+	t.Cleanup(srv.Close)
+
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	return ctx, srv.Listener.Addr().String()
+}
+
+func TestProbeRemote(t *testing.T) {
+	for _, supportsHead := range []bool{true, false} {
+		origin := &probeOrigin{supportsHead: supportsHead}
+		ctx, serverName := probeTestOrigin(t, origin)
+
+		probe, err := download.ProbeRemote(ctx, serverName, "media")
+		assert.NoError(t, err)
+		assert.Equal(t, &download.RemoteProbe{
+			ContentType: "application/zip",
+			Filename:    "archive.zip",
+			SizeBytes:   int64(len(remoteProbeBody)),
+		}, probe)
+
+		_, err = download.ProbeRemote(ctx, serverName, "missing")
+		assert.ErrorIs(t, err, common.ErrMediaNotFound)
+
+		if supportsHead {
+			assert.Equal(t, []string{"HEAD ", "HEAD "}, origin.requests)
+		} else {
+			assert.Equal(t, []string{"HEAD ", "GET bytes=0-0", "HEAD ", "GET bytes=0-0"}, origin.requests)
+		}
+	}
+}
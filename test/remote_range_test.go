@@ -0,0 +1,158 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+var remoteRangeBody = []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+func getRanged(t *testing.T, handler http.HandlerFunc, rng download.RemoteRange) *http.Response {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Range", rng.Header())
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	return resp
+}
+
+func readRanged(t *testing.T, handler http.HandlerFunc, rng download.RemoteRange) ([]byte, *util.ContentRange, error) {
+	r, cr, err := download.ReadRangedResponse(getRanged(t, handler, rng), rng)
+	if err != nil {
+		return nil, cr, err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return b, cr, nil
+}
+
+func compliantOrigin(w http.ResponseWriter, r *http.Request) {
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(remoteRangeBody))
+}
+
+func rangeIgnoringOrigin(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write(remoteRangeBody) // sets Content-Length for us
+}
+
+func TestParseContentRange(t *testing.T) {
+	cr, err := util.ParseContentRange("bytes 10-19/36")
+	assert.NoError(t, err)
+	assert.Equal(t, util.ContentRange{Start: 10, End: 19, Size: 36}, *cr)
+	assert.Equal(t, int64(10), cr.Length())
+	assert.Equal(t, "bytes 10-19/36", cr.String())
+
+	cr, err = util.ParseContentRange("bytes 0-9/*")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), cr.Size)
+	assert.Equal(t, "bytes 0-9/*", cr.String())
+
+	for _, val := range []string{"", "bytes */36", "bytes 10-9/36", "bytes 10-36/36", "bytes -1-9/36", "items 0-9/36", "bytes 0-9"} {
+		_, err = util.ParseContentRange(val)
+		assert.ErrorIs(t, err, util.ErrInvalidContentRange, val)
+	}
+}
+
+func TestParseRemoteRange(t *testing.T) {
+	assert.Equal(t, &download.RemoteRange{Start: 10, End: 19}, download.ParseRemoteRange("bytes=10-19", 100))
+	assert.Equal(t, &download.RemoteRange{Start: 10, End: 109}, download.ParseRemoteRange("bytes=10-", 100))
+	assert.Equal(t, &download.RemoteRange{Start: 10, End: -1}, download.ParseRemoteRange("bytes=10-", 0))
+
+	// Not forwarded: the whole media is fetched instead
+	assert.Nil(t, download.ParseRemoteRange("", 100))
+	assert.Nil(t, download.ParseRemoteRange("bytes=-10", 100))
+	assert.Nil(t, download.ParseRemoteRange("bytes=0-1,5-6", 100))
+	assert.Nil(t, download.ParseRemoteRange("bytes=19-10", 100))
+	assert.Nil(t, download.ParseRemoteRange("items=0-10", 100))
+}
+
+func TestRemoteRangeCompliantOrigin(t *testing.T) {
+	b, cr, err := readRanged(t, compliantOrigin, download.RemoteRange{Start: 10, End: 19})
+	assert.NoError(t, err)
+	assert.Equal(t, remoteRangeBody[10:20], b)
+	assert.Equal(t, util.ContentRange{Start: 10, End: 19, Size: 36}, *cr)
+
+	// The origin stops at the end of the file
+	b, cr, err = readRanged(t, compliantOrigin, download.RemoteRange{Start: 30, End: 99})
+	assert.NoError(t, err)
+	assert.Equal(t, remoteRangeBody[30:], b)
+	assert.Equal(t, util.ContentRange{Start: 30, End: 35, Size: 36}, *cr)
+
+	b, cr, err = readRanged(t, compliantOrigin, download.RemoteRange{Start: 30, End: -1})
+	assert.NoError(t, err)
+	assert.Equal(t, remoteRangeBody[30:], b)
+	assert.Equal(t, util.ContentRange{Start: 30, End: 35, Size: 36}, *cr)
+
+	_, _, err = readRanged(t, compliantOrigin, download.RemoteRange{Start: 50, End: 60})
+	assert.ErrorIs(t, err, common.ErrRangeNotSatisfiable)
+}
+
+func TestRemoteRangeOriginIgnoresRange(t *testing.T) {
+	b, cr, err := readRanged(t, rangeIgnoringOrigin, download.RemoteRange{Start: 10, End: 19})
+	assert.NoError(t, err)
+	assert.Equal(t, remoteRangeBody[10:20], b)
+	assert.Equal(t, util.ContentRange{Start: 10, End: 19, Size: 36}, *cr)
+
+	b, cr, err = readRanged(t, rangeIgnoringOrigin, download.RemoteRange{Start: 30, End: -1})
+	assert.NoError(t, err)
+	assert.Equal(t, remoteRangeBody[30:], b)
+	assert.Equal(t, util.ContentRange{Start: 30, End: 35, Size: 36}, *cr)
+
+	_, _, err = readRanged(t, rangeIgnoringOrigin, download.RemoteRange{Start: 50, End: 60})
+	assert.ErrorIs(t, err, common.ErrRangeNotSatisfiable)
+
+	// Without a Content-Length we can't produce a Content-Range, so the whole thing is returned
+	b, cr, err = readRanged(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(remoteRangeBody[:10])
+		w.(http.Flusher).Flush() // forces a chunked response
+		_, _ = w.Write(remoteRangeBody[10:])
+	}, download.RemoteRange{Start: 10, End: 19})
+	assert.NoError(t, err)
+	assert.Nil(t, cr)
+	assert.Equal(t, remoteRangeBody, b)
+}
+
+func TestRemoteRangeInconsistentOrigin(t *testing.T) {
+	cases := map[string]http.HandlerFunc{
+		"wrong start": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 0-9/36")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(remoteRangeBody[0:10])
+		},
+		"too long": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 10-29/36")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(remoteRangeBody[10:30])
+		},
+		"too short": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 10-14/36")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(remoteRangeBody[10:15])
+		},
+		"missing header": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(remoteRangeBody[10:20])
+		},
+		"wrong length": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 10-19/36")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(remoteRangeBody[10:25])
+		},
+	}
+	for name, handler := range cases {
+		_, _, err := readRanged(t, handler, download.RemoteRange{Start: 10, End: 19})
+		assert.ErrorIs(t, err, common.ErrOriginRangeMismatch, name)
+	}
+}
@@ -0,0 +1,65 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+func setRemoteLimits(c *config.DomainRepoConfig) {
+	c.Uploads.MaxSizeBytes = 1000
+	c.Downloads.MaxSizeBytes = 500
+	c.Downloads.OriginMaxSizeBytes = []config.OriginSizeLimit{
+		{Origin: "untrusted.example.org", MaxSizeBytes: 100},
+		{Origin: "*.Example.NET", MaxSizeBytes: 0},
+		{Origin: "media.example.net", MaxSizeBytes: 10}, // shadowed by the glob above
+	}
+}
+
+func TestMaxRemoteSize(t *testing.T) {
+	ctx := test_internals.MakeTestContext(setRemoteLimits)
+	assert.Equal(t, int64(100), download.MaxRemoteSize(ctx, "untrusted.example.org"))
+	assert.Equal(t, int64(100), download.MaxRemoteSize(ctx, "Untrusted.Example.org"))
+	assert.Equal(t, int64(0), download.MaxRemoteSize(ctx, "media.example.net"))
+	assert.Equal(t, int64(500), download.MaxRemoteSize(ctx, "example.org"))
+	assert.Equal(t, int64(500), download.MaxRemoteSize(ctx, "example.net"))
+}
+
+func TestRemoteSizeLimitIndependentOfUploads(t *testing.T) {
+	ctx := test_internals.MakeTestContext(setRemoteLimits)
+	media := bytes.Repeat([]byte("a"), 200) // over the remote cap, but within the local upload cap
+
+	read := func(r io.ReadCloser) ([]byte, error) {
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+
+	// The local upload limit is happy with it
+	b, err := read(upload.LimitStream(ctx, io.NopCloser(bytes.NewReader(media))))
+	assert.NoError(t, err)
+	assert.Equal(t, media, b)
+
+	// ... but the remote limit isn't, whether the origin says how large the media is or not
+	_, err = download.LimitRemoteStream(ctx, "untrusted.example.org", io.NopCloser(bytes.NewReader(media)), int64(len(media)))
+	assert.ErrorIs(t, err, common.ErrMediaTooLarge)
+	r, err := download.LimitRemoteStream(ctx, "untrusted.example.org", io.NopCloser(bytes.NewReader(media)), 0)
+	assert.NoError(t, err)
+	_, err = read(r)
+	assert.ErrorIs(t, err, common.ErrMediaTooLarge)
+
+	// Other origins use the default remote limit, or their own
+	for _, origin := range []string{"example.org", "media.example.net"} {
+		r, err = download.LimitRemoteStream(ctx, origin, io.NopCloser(bytes.NewReader(media)), int64(len(media)))
+		assert.NoError(t, err, origin)
+		b, err = read(r)
+		assert.NoError(t, err, origin)
+		assert.Equal(t, media, b, origin)
+	}
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func setServerNameNormalization(t *testing.T, conf config.ServerNameNormalizationConfig) {
+	test_internals.UseTempConfig(t)
+	original := config.Get().Federation
+	config.Get().Federation.ServerNameNormalization = conf
+	t.Cleanup(func() {
+		config.Get().Federation = original
+	})
+}
+
+func TestNormalizeServerName(t *testing.T) {
+	stripPorts := []int{8448, 443}
+	cases := map[string]string{
+		"example.org":         "example.org",
+		"Example.ORG":         "example.org",
+		"example.org:8448":    "example.org",
+		"EXAMPLE.org:443":     "example.org",
+		"example.org:8008":    "example.org:8008",
+		"1.2.3.4:8448":        "1.2.3.4",
+		"[::1]":               "[::1]",
+		"[::1]:8448":          "[::1]",
+		"[2001:DB8::1]:8008":  "[2001:db8::1]:8008",
+		"localhost:notaport":  "localhost:notaport",
+		"media.Example.org:1": "media.example.org:1",
+	}
+	for serverName, expected := range cases {
+		assert.Equal(t, expected, util.NormalizeServerName(serverName, stripPorts), serverName)
+	}
+
+	// Only the configured ports are removed
+	assert.Equal(t, "example.org:443", util.NormalizeServerName("example.org:443", []int{8448}))
+	assert.Equal(t, "example.org:8448", util.NormalizeServerName("Example.org:8448", nil))
+}
+
+func TestCanonicalServerName(t *testing.T) {
+	setServerNameNormalization(t, config.ServerNameNormalizationConfig{Enabled: false, StripPorts: []int{8448}})
+	assert.Equal(t, "Example.org:8448", util.CanonicalServerName("Example.org:8448"))
+
+	config.Get().Federation.ServerNameNormalization.Enabled = true
+	assert.Equal(t, "example.org", util.CanonicalServerName("Example.org:8448"))
+	assert.Equal(t, "example.org", util.CanonicalServerName("example.org"))
+
+	// Ignored hosts are compared in their canonical form too
+	config.Get().Federation.IgnoredHosts = []string{"Ignored.example.org:8448"}
+	assert.True(t, util.IsHostIgnored("ignored.example.org"))
+	assert.True(t, util.IsHostIgnored("IGNORED.example.org:8448"))
+	assert.False(t, util.IsHostIgnored("ignored.example.org:8008"))
+}
+
+func TestForceSetParam(t *testing.T) {
+	params := httprouter.Params{{Key: "server", Value: "Example.org"}, {Key: "mediaId", Value: "abc"}}
+	r := httptest.NewRequest("GET", "/_matrix/media/v3/download/Example.org/abc", nil)
+	r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, params))
+
+	updated := _routers.ForceSetParam("server", "example.org", r)
+	assert.Equal(t, "example.org", _routers.GetParam("server", updated))
+	assert.Equal(t, "abc", _routers.GetParam("mediaId", updated))
+
+	// The original request is left alone
+	assert.Equal(t, "Example.org", _routers.GetParam("server", r))
+
+	// Params which weren't set are added
+	updated = _routers.ForceSetParam("filename", "file.txt", updated)
+	assert.Equal(t, "file.txt", _routers.GetParam("filename", updated))
+	assert.Equal(t, "example.org", _routers.GetParam("server", updated))
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+func TestServerTimingFormat(t *testing.T) {
+	timings := &u.Timings{}
+	assert.Equal(t, "", timings.ServerTiming())
+
+	// Recorded out of order, and the resize step happens twice
+	timings.Add(u.TimingResize, 1500*time.Microsecond)
+	timings.Add("other", 1*time.Millisecond)
+	timings.Add(u.TimingEncode, 2*time.Millisecond)
+	timings.Add(u.TimingDecode, 12345*time.Microsecond)
+	timings.Add(u.TimingResize, 500*time.Microsecond)
+	assert.Equal(t, "decode;dur=12.345, resize;dur=2.000, encode;dur=2.000, other;dur=1.000", timings.ServerTiming())
+
+	// nil timings are safe to record to
+	var nilTimings *u.Timings
+	nilTimings.Add(u.TimingDecode, time.Second)
+	assert.Equal(t, "", nilTimings.ServerTiming())
+}
+
+func TestServerTimingRecordedByThumbnailer(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	for x := 0; x < 256; x++ {
+		img.Set(x, x, color.NRGBA{R: 0xFF, A: 0xFF})
+	}
+	b := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(b, img))
+
+	timings := &u.Timings{}
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx = u.WithTimings(ctx, timings)
+
+	thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(b.Bytes())), "image/png", 64, 64, "scale", false, ctx)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(thumb.Reader) // encoding happens as the thumbnail is read
+	assert.NoError(t, err)
+
+	assert.Regexp(t, regexp.MustCompile(`^decode;dur=\d+\.\d{3}, resize;dur=\d+\.\d{3}, encode;dur=\d+\.\d{3}$`), timings.ServerTiming())
+	assert.Greater(t, timings.Get(u.TimingResize), time.Duration(0))
+}
+
+// encodingReader records an encode step when it is read to the end, like a thumbnail encoded as it is sent.
+type encodingReader struct {
+	io.Reader
+	timings *u.Timings
+}
+
+func (e *encodingReader) Read(p []byte) (int, error) {
+	n, err := e.Reader.Read(p)
+	if err == io.EOF {
+		e.timings.Add(u.TimingEncode, 5*time.Millisecond)
+	}
+	return n, err
+}
+
+func TestServerTimingSentAfterBody(t *testing.T) {
+	timings := &u.Timings{}
+	timings.Add(u.TimingDecode, 2*time.Millisecond)
+	srv := serveGenerated(func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+		return &_responses.DownloadResponse{
+			ContentType:  "image/png",
+			SizeBytes:    -1,
+			Data:         io.NopCloser(&encodingReader{Reader: bytes.NewReader(make([]byte, 1024)), timings: timings}),
+			ServerTiming: timings.ServerTiming,
+		}
+	})
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "", res.Header.Get("Server-Timing"))
+	_, err = io.ReadAll(res.Body)
+	assert.NoError(t, err)
+
+	// The encode time is only known once the body has been sent
+	assert.Equal(t, "decode;dur=2.000, encode;dur=5.000", res.Trailer.Get("Server-Timing"))
+}
@@ -0,0 +1,182 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/util/stripmeta"
+)
+
+// makeGpsExif builds a little-endian TIFF block with an orientation and a GPS latitude reference.
+func makeGpsExif() []byte {
+	b := []byte("II\x2a\x00")
+	b = binary.LittleEndian.AppendUint32(b, 8) // IFD0 offset
+	b = binary.LittleEndian.AppendUint16(b, 2) // IFD0 entries
+	b = binary.LittleEndian.AppendUint16(b, 0x0112)
+	b = binary.LittleEndian.AppendUint16(b, 3) // SHORT
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, 6) // rotated 90 degrees
+	b = binary.LittleEndian.AppendUint16(b, 0x8825)
+	b = binary.LittleEndian.AppendUint16(b, 4) // LONG
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, 38) // GPS IFD offset
+	b = binary.LittleEndian.AppendUint32(b, 0)  // no next IFD
+	b = binary.LittleEndian.AppendUint16(b, 1)  // GPS IFD entries
+	b = binary.LittleEndian.AppendUint16(b, 0x0001)
+	b = binary.LittleEndian.AppendUint16(b, 2) // ASCII
+	b = binary.LittleEndian.AppendUint32(b, 2)
+	b = append(b, 'N', 0, 0, 0)
+	return binary.LittleEndian.AppendUint32(b, 0) // no next IFD
+}
+
+func exifTagNames(t *testing.T, b []byte) []string {
+	raw, err := exif.SearchAndExtractExif(b)
+	if err == exif.ErrNoExif {
+		return []string{}
+	}
+	assert.NoError(t, err)
+	tags, _, err := exif.GetFlatExifData(raw, nil)
+	assert.NoError(t, err)
+	names := make([]string, 0)
+	for _, tag := range tags {
+		names = append(names, tag.TagName)
+	}
+	return names
+}
+
+func makeGpsJpeg(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, 16, 8)), nil))
+	img := buf.Bytes()
+
+	segment := func(marker byte, payload []byte) []byte {
+		s := []byte{0xFF, marker}
+		s = binary.BigEndian.AppendUint16(s, uint16(len(payload)+2))
+		return append(s, payload...)
+	}
+	out := append([]byte{}, img[0:2]...)
+	out = append(out, segment(0xE1, append([]byte("Exif\x00\x00"), makeGpsExif()...))...)
+	out = append(out, segment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))...)
+	out = append(out, segment(0xFE, []byte("a comment"))...)
+	return append(out, img[2:]...)
+}
+
+func TestStripMetadataJpeg(t *testing.T) {
+	original := makeGpsJpeg(t)
+	assert.Contains(t, exifTagNames(t, original), "GPSLatitudeRef")
+	stored := append([]byte{}, original...)
+
+	stripped, err := stripmeta.Strip("image/jpeg", original)
+	assert.NoError(t, err)
+	assert.Equal(t, stored, original) // the source must not be modified
+	assert.NotContains(t, exifTagNames(t, stripped), "GPSLatitudeRef")
+	assert.Contains(t, exifTagNames(t, stripped), "Orientation")
+	assert.NotContains(t, string(stripped), "xmpmeta")
+	assert.NotContains(t, string(stripped), "a comment")
+
+	img, err := jpeg.Decode(bytes.NewReader(stripped))
+	assert.NoError(t, err)
+	assert.Equal(t, 16, img.Bounds().Dx())
+}
+
+func TestStripMetadataPng(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 16, 8))))
+	img := buf.Bytes()
+
+	chunk := func(chunkType string, data []byte) []byte {
+		c := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		c = append(c, chunkType...)
+		c = append(c, data...)
+		return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+	}
+	ihdrEnd := 8 + 12 + 13
+	original := append([]byte{}, img[0:ihdrEnd]...)
+	original = append(original, chunk("eXIf", makeGpsExif())...)
+	original = append(original, chunk("tEXt", []byte("Comment\x00secret"))...)
+	original = append(original, img[ihdrEnd:]...)
+	assert.Contains(t, exifTagNames(t, original), "GPSLatitudeRef")
+
+	stripped, err := stripmeta.Strip("image/png", original)
+	assert.NoError(t, err)
+	assert.Contains(t, exifTagNames(t, original), "GPSLatitudeRef")
+	assert.NotContains(t, exifTagNames(t, stripped), "GPSLatitudeRef")
+	assert.Contains(t, exifTagNames(t, stripped), "Orientation")
+	assert.NotContains(t, string(stripped), "secret")
+
+	_, err = png.Decode(bytes.NewReader(stripped))
+	assert.NoError(t, err)
+}
+
+func TestStripMetadataWebp(t *testing.T) {
+	chunk := func(fourCC string, data []byte) []byte {
+		c := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+		c = append(c, data...)
+		if len(data)%2 != 0 {
+			c = append(c, 0)
+		}
+		return c
+	}
+	body := []byte("WEBP")
+	body = append(body, chunk("VP8X", []byte{0x0C, 0, 0, 0, 15, 0, 0, 7, 0, 0})...) // EXIF+XMP flags, 16x8
+	body = append(body, chunk("VP8L", []byte{0x2f, 0x0f, 0xc0, 0x01, 0x00})...)
+	body = append(body, chunk("EXIF", makeGpsExif())...)
+	body = append(body, chunk("XMP ", []byte("<x:xmpmeta/>"))...)
+	original := append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+
+	stripped, err := stripmeta.Strip("image/webp", original)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(stripped), "xmpmeta")
+	assert.Equal(t, uint32(len(stripped)-8), binary.LittleEndian.Uint32(stripped[4:8]))
+	assert.Equal(t, byte(0x08), stripped[20]) // only the EXIF flag remains, for the orientation
+	assert.NotContains(t, exifTagNames(t, stripped), "GPSLatitudeRef")
+	assert.Contains(t, exifTagNames(t, stripped), "Orientation")
+}
+
+func TestStripMetadataUnsupported(t *testing.T) {
+	assert.False(t, stripmeta.Supported("image/gif"))
+	_, err := stripmeta.Strip("image/gif", []byte("GIF89a"))
+	assert.ErrorIs(t, err, stripmeta.ErrUnsupported)
+}
+
+func TestStripMetadataStep(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	record := &database.DbMedia{Origin: "example.org", MediaId: "stripme", ContentType: "image/jpeg", Locatable: &database.Locatable{}}
+	original := makeGpsJpeg(t)
+	record.SizeBytes = int64(len(original))
+
+	assert.False(t, download.ShouldStripMetadata(ctx, record))
+	ctx.Config.Downloads.StripMetadata.Enabled = true
+	assert.True(t, download.ShouldStripMetadata(ctx, record))
+	ctx.Config.Downloads.StripMetadata.MaxSizeBytes = record.SizeBytes - 1
+	assert.False(t, download.ShouldStripMetadata(ctx, record))
+
+	r, size, err := download.StripMetadata(ctx, record, io.NopCloser(bytes.NewReader(original)))
+	assert.NoError(t, err)
+	served, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(served)), size)
+	assert.NotContains(t, exifTagNames(t, served), "GPSLatitudeRef")
+	assert.Contains(t, exifTagNames(t, original), "GPSLatitudeRef")
+}
+
+func TestStripMetadataJpegInvalidSegmentLength(t *testing.T) {
+	for _, length := range []byte{0, 1} {
+		b := []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, length, 0x00, 0x00, 0xFF, 0xD9}
+		_, err := stripmeta.Strip("image/jpeg", b)
+		assert.EqualError(t, err, "jpeg: invalid segment length")
+	}
+}
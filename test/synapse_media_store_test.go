@@ -0,0 +1,45 @@
+package test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/homeserver_interop/synapse"
+)
+
+func TestSynapseLocalMediaPath(t *testing.T) {
+	// Build a small media store the same way Synapse lays it out
+	mediaStore := t.TempDir()
+	files := map[string]string{
+		"local_content/Ab/Cd/EfGhIjKlMn":                    "local media",
+		"url_cache/2020-08-17/AbCdEf_GhIj":                  "url preview media",
+		"local_thumbnails/Ab/Cd/EfGhIjKlMn/32-32-image-png": "thumbnail",
+	}
+	for name, contents := range files {
+		p := path.Join(mediaStore, name)
+		assert.NoError(t, os.MkdirAll(path.Dir(p), 0755))
+		assert.NoError(t, os.WriteFile(p, []byte(contents), 0644))
+	}
+
+	p, err := synapse.LocalMediaPath(mediaStore, &synapse.LocalMedia{MediaId: "AbCdEfGhIjKlMn"})
+	assert.NoError(t, err)
+	b, err := os.ReadFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "local media", string(b))
+
+	p, err = synapse.LocalMediaPath(mediaStore, &synapse.LocalMedia{MediaId: "2020-08-17_AbCdEf_GhIj", UrlCache: "https://example.org"})
+	assert.NoError(t, err)
+	b, err = os.ReadFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "url preview media", string(b))
+
+	// Media IDs which would escape the media store are rejected
+	for _, mediaId := range []string{"../../../etc/passwd", "AbCd/../../x", "AbC", "AbCd\\Ef"} {
+		_, err = synapse.LocalMediaPath(mediaStore, &synapse.LocalMedia{MediaId: mediaId})
+		assert.Error(t, err, mediaId)
+	}
+	_, err = synapse.LocalMediaPath(mediaStore, &synapse.LocalMedia{MediaId: "NoDateHere", UrlCache: "https://example.org"})
+	assert.Error(t, err)
+}
@@ -126,6 +126,7 @@ func MakeTestDeps() (*ContainerDeps, error) {
 		RedisAddr:          fmt.Sprintf("%s:%d", redisIp, 6379), // we're behind the network for redis
 		PgConnectionString: pgConnStr,
 		S3Endpoint:         minioDep.Endpoint,
+		SharedSecret:       SharedSecret,
 	}
 	mmrs, err := makeMmrInstances(ctx, 2, depNet, tmplArgs)
 	if err != nil {
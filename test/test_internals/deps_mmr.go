@@ -21,11 +21,15 @@ type mmrHomeserverTmplArgs struct {
 	ClientServerApiUrl string
 }
 
+// SharedSecret is the shared secret auth token for the media repo instances, for calling admin APIs.
+const SharedSecret = "test_shared_secret_1234"
+
 type mmrTmplArgs struct {
 	Homeservers        []mmrHomeserverTmplArgs
 	RedisAddr          string
 	PgConnectionString string
 	S3Endpoint         string
+	SharedSecret       string
 }
 
 type mmrContainer struct {
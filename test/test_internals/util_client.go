@@ -1,11 +1,13 @@
 package test_internals
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 )
@@ -87,3 +89,47 @@ func (c *MatrixClient) DoRaw(method string, endpoint string, qs url.Values, cont
 	log.Printf("[HTTP] [Auth=%s] [Host=%s] %s %s", c.AccessToken, c.ServerName, req.Method, req.URL.String())
 	return http.DefaultClient.Do(req)
 }
+
+// DoRawWithContentLength sends a request with an arbitrary Content-Length header, which may disagree with the
+// body's real length. The standard HTTP client refuses to do this, so the request is written to the connection
+// directly, and the write side is closed after the body.
+func (c *MatrixClient) DoRawWithContentLength(method string, endpoint string, qs url.Values, contentType string, contentLength int64, body []byte) (*http.Response, error) {
+	endpoint, err := url.JoinPath(c.ClientServerUrl, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(endpoint + "?" + qs.Encode())
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if c.ServerName != "" {
+		host = c.ServerName
+	}
+
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[HTTP] [Auth=%s] [Host=%s] [Content-Length=%d] %s %s", c.AccessToken, c.ServerName, contentLength, method, u.String())
+	req := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\nConnection: close\r\n", method, u.RequestURI(), host, contentLength)
+	if contentType != "" {
+		req += "Content-Type: " + contentType + "\r\n"
+	}
+	if c.AccessToken != "" {
+		req += "Authorization: Bearer " + c.AccessToken + "\r\n"
+	}
+	if _, err = conn.Write(append([]byte(req+"\r\n"), body...)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		if err = tcp.CloseWrite(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	return http.ReadResponse(bufio.NewReader(conn), nil)
+}
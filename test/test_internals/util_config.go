@@ -0,0 +1,14 @@
+package test_internals
+
+import (
+	"path"
+	"testing"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+// UseTempConfig points config.Path into a temporary directory, so a test which is the first to load the config
+// doesn't leave a generated config file behind in the test directory.
+func UseTempConfig(t *testing.T) {
+	config.Path = path.Join(t.TempDir(), "media-repo.yaml")
+}
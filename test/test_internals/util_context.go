@@ -0,0 +1,17 @@
+package test_internals
+
+import (
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// MakeTestContext returns a request context using the default domain config, after configure (if not nil) has
+// changed it.
+func MakeTestContext(configure func(c *config.DomainRepoConfig)) rcontext.RequestContext {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	if configure != nil {
+		configure(&ctx.Config)
+	}
+	return ctx
+}
@@ -0,0 +1,77 @@
+package test_internals
+
+/*
+#cgo pkg-config: libheif
+#include <stdlib.h>
+#include <string.h>
+#include <libheif/heif.h>
+
+// mmr_write_heic encodes a solid colour image for each of the count RGB triplets in colours into one HEIC file,
+// returning an error message, or NULL. The first image is the primary one.
+static const char* mmr_write_heic(const char* filename, int width, int height, const unsigned char* colours, int count) {
+	struct heif_context* ctx = heif_context_alloc();
+	struct heif_encoder* encoder = NULL;
+	struct heif_error err = heif_context_get_encoder_for_format(ctx, heif_compression_HEVC, &encoder);
+	if (err.code != heif_error_Ok) {
+		heif_context_free(ctx);
+		return err.message;
+	}
+	heif_encoder_set_lossy_quality(encoder, 90);
+
+	for (int i = 0; i < count && err.code == heif_error_Ok; i++) {
+		struct heif_image* img = NULL;
+		err = heif_image_create(width, height, heif_colorspace_RGB, heif_chroma_interleaved_RGB, &img);
+		if (err.code != heif_error_Ok) {
+			break;
+		}
+		err = heif_image_add_plane(img, heif_channel_interleaved, width, height, 8);
+		if (err.code == heif_error_Ok) {
+			int stride = 0;
+			uint8_t* plane = heif_image_get_plane(img, heif_channel_interleaved, &stride);
+			for (int y = 0; y < height; y++) {
+				for (int x = 0; x < width; x++) {
+					memcpy(plane + y * stride + x * 3, colours + i * 3, 3);
+				}
+			}
+			err = heif_context_encode_image(ctx, img, encoder, NULL, NULL);
+		}
+		heif_image_release(img);
+	}
+	if (err.code == heif_error_Ok) {
+		err = heif_context_write_to_file(ctx, filename);
+	}
+
+	heif_encoder_release(encoder);
+	heif_context_free(ctx);
+	return err.code == heif_error_Ok ? NULL : err.message;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image/color"
+	"os"
+	"path"
+	"unsafe"
+)
+
+// MakeMultiImageHeic encodes a HEIC file holding a solid colour image for each of the colours, in order. The
+// first image is the primary one. An error is returned if HEIC encoding isn't available.
+func MakeMultiImageHeic(dir string, width int, height int, colours ...color.RGBA) ([]byte, error) {
+	if len(colours) == 0 {
+		return nil, errors.New("no images to encode")
+	}
+	rgb := make([]byte, 0, len(colours)*3)
+	for _, c := range colours {
+		rgb = append(rgb, c.R, c.G, c.B)
+	}
+
+	fpath := path.Join(dir, "multi.heic")
+	cpath := C.CString(fpath)
+	defer C.free(unsafe.Pointer(cpath))
+	if msg := C.mmr_write_heic(cpath, C.int(width), C.int(height), (*C.uchar)(unsafe.Pointer(&rgb[0])), C.int(len(colours))); msg != nil {
+		return nil, errors.New("heic: " + C.GoString(msg))
+	}
+	return os.ReadFile(fpath)
+}
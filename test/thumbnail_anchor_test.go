@@ -0,0 +1,104 @@
+package test
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+var anchorTop = color.NRGBA{R: 0xFF, A: 0xFF}
+var anchorMiddle = color.NRGBA{G: 0xFF, A: 0xFF}
+var anchorBottom = color.NRGBA{B: 0xFF, A: 0xFF}
+
+// makeAnchorFixture returns a tall image in three bands, so each vertical anchor keeps a different one.
+func makeAnchorFixture() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 30, 90))
+	for y := 0; y < 90; y++ {
+		c := anchorMiddle
+		if y < 30 {
+			c = anchorTop
+		} else if y >= 60 {
+			c = anchorBottom
+		}
+		for x := 0; x < 30; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func cropWithAnchor(t *testing.T, anchor string) image.Image {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	thumb, err := u.MakeThumbnail(makeAnchorFixture(), u.CropMethod(anchor), 10, 10, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, thumb.Bounds().Dx())
+	assert.Equal(t, 10, thumb.Bounds().Dy())
+	return thumb
+}
+
+// assertCenterColor checks the middle of the image, as resizing blends the bands at their edges.
+func assertCenterColor(t *testing.T, expected color.NRGBA, img image.Image) {
+	center := img.At(img.Bounds().Dx()/2, img.Bounds().Dy()/2)
+	assert.Equal(t, expected, color.NRGBAModel.Convert(center))
+}
+
+func TestThumbnailCropAnchors(t *testing.T) {
+	top := cropWithAnchor(t, "top")
+	bottom := cropWithAnchor(t, "bottom")
+	assert.NotEqual(t, top, bottom)
+	assertCenterColor(t, anchorTop, top)
+	assertCenterColor(t, anchorBottom, bottom)
+
+	// Center is the default, and corners keep their edge too
+	assertCenterColor(t, anchorMiddle, cropWithAnchor(t, "center"))
+	assertCenterColor(t, anchorMiddle, cropWithAnchor(t, ""))
+	assertCenterColor(t, anchorTop, cropWithAnchor(t, "top_left"))
+	assertCenterColor(t, anchorBottom, cropWithAnchor(t, "bottom_right"))
+}
+
+func TestThumbnailCropMethods(t *testing.T) {
+	// Centered crops share their method with crops made before anchors existed
+	assert.Equal(t, "crop", u.CropMethod("center"))
+	assert.Equal(t, "crop:top", u.CropMethod("top"))
+
+	for name := range u.Anchors {
+		base, parsed, err := u.ParseMethod(u.CropMethod(name))
+		assert.NoError(t, err)
+		assert.Equal(t, "crop", base)
+		assert.Equal(t, name, parsed)
+	}
+	base, anchor, err := u.ParseMethod("scale")
+	assert.NoError(t, err)
+	assert.Equal(t, "scale", base)
+	assert.Equal(t, u.DefaultAnchor, anchor)
+
+	for _, method := range []string{"", "fill", "crop:", "crop:middle", "scale:top", "crop:top:left"} {
+		_, _, err = u.ParseMethod(method)
+		assert.Error(t, err, method)
+	}
+}
+
+func TestThumbnailCropAnchorDimensions(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+
+	// Anchored crops are sized the same as centered ones
+	w, h, method, err := thumbnails.PickNewDimensions(ctx, 100, 50, "crop")
+	assert.NoError(t, err)
+	aw, ah, anchoredMethod, err := thumbnails.PickNewDimensions(ctx, 100, 50, "crop:bottom")
+	assert.NoError(t, err)
+	assert.Equal(t, w, aw)
+	assert.Equal(t, h, ah)
+	assert.Equal(t, "crop", method)
+	assert.Equal(t, "crop:bottom", anchoredMethod)
+
+	_, _, _, err = thumbnails.PickNewDimensions(ctx, 100, 50, "scale:bottom")
+	assert.Error(t, err)
+}
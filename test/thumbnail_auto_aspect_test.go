@@ -0,0 +1,105 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+)
+
+func TestScaleToAspect(t *testing.T) {
+	cases := []struct {
+		width, height       int
+		srcWidth, srcHeight int
+		expectedW           int
+		expectedH           int
+	}{
+		{width: 200, height: 0, srcWidth: 400, srcHeight: 300, expectedW: 200, expectedH: 150},
+		{width: 0, height: 60, srcWidth: 400, srcHeight: 300, expectedW: 80, expectedH: 60},
+		{width: 100, height: 0, srcWidth: 3, srcHeight: 1, expectedW: 100, expectedH: 33},
+		{width: 0, height: 100, srcWidth: 1, srcHeight: 1000, expectedW: 1, expectedH: 100},
+
+		// Both set already
+		{width: 32, height: 48, srcWidth: 400, srcHeight: 300, expectedW: 32, expectedH: 48},
+
+		// Unknown source dimensions are treated as square
+		{width: 96, height: 0, expectedW: 96, expectedH: 96},
+		{width: 0, height: 40, srcWidth: 400, expectedW: 40, expectedH: 40},
+	}
+	for _, c := range cases {
+		w, h := thumbnails.ScaleToAspect(c.width, c.height, c.srcWidth, c.srcHeight)
+		assert.Equal(t, c.expectedW, w, c)
+		assert.Equal(t, c.expectedH, h, c)
+	}
+}
+
+func TestThumbnailAutoAspect(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.Thumbnails.DynamicSizing = true
+	ctx.Config.Thumbnails.AutoAspect = true
+
+	b := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(b, image.NewNRGBA(image.Rect(0, 0, 400, 300))))
+	fixture := b.Bytes()
+
+	srcWidth, srcHeight := thumbnails.GetDisplayedDimensions(ctx, bytes.NewReader(fixture), "image/png", nil)
+	assert.Equal(t, 400, srcWidth)
+	assert.Equal(t, 300, srcHeight)
+
+	generate := func(width int, height int, method string) (int, int, image.Rectangle) {
+		w, h := thumbnails.ScaleToAspect(width, height, srcWidth, srcHeight)
+		w, h, method, err := thumbnails.PickNewDimensions(ctx, w, h, method)
+		assert.NoError(t, err)
+		thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(fixture)), "image/png", w, h, method, false, ctx)
+		assert.NoError(t, err)
+		img, _, err := image.Decode(thumb.Reader)
+		assert.NoError(t, err)
+		return w, h, img.Bounds()
+	}
+
+	for _, method := range []string{"scale", "crop"} {
+		// Width only
+		w, h, bounds := generate(200, 0, method)
+		assert.Equal(t, 200, w, method)
+		assert.Equal(t, 150, h, method)
+		assert.Equal(t, 200, bounds.Dx(), method)
+		assert.Equal(t, 150, bounds.Dy(), method)
+
+		// Height only
+		w, h, bounds = generate(0, 60, method)
+		assert.Equal(t, 80, w, method)
+		assert.Equal(t, 60, h, method)
+		assert.Equal(t, 80, bounds.Dx(), method)
+		assert.Equal(t, 60, bounds.Dy(), method)
+	}
+}
+
+func TestThumbnailAutoAspectDisplayedDimensions(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+
+	// Rotated a quarter turn by EXIF, so shown as 20x40
+	rotated := makeOrientedJpegOf(t, 6, image.NewRGBA(image.Rect(0, 0, 40, 20)))
+	w, h := thumbnails.GetDisplayedDimensions(ctx, bytes.NewReader(rotated), "image/jpeg", nil)
+	assert.Equal(t, 20, w)
+	assert.Equal(t, 40, h)
+
+	upright := makeOrientedJpegOf(t, 1, image.NewRGBA(image.Rect(0, 0, 40, 20)))
+	w, h = thumbnails.GetDisplayedDimensions(ctx, bytes.NewReader(upright), "image/jpeg", nil)
+	assert.Equal(t, 40, w)
+	assert.Equal(t, 20, h)
+
+	// Not something which can be thumbnailed
+	w, h = thumbnails.GetDisplayedDimensions(ctx, strings.NewReader("hello world"), "text/plain", nil)
+	assert.Equal(t, 0, w)
+	assert.Equal(t, 0, h)
+}
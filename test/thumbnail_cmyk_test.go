@@ -0,0 +1,172 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"math/bits"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// The standard library can't write CMYK JPEGs, so makeCmykJpeg writes its own: a baseline JPEG with four
+// components, where every 8x8 block is a single color (so only the DC coefficients are needed).
+const (
+	cmykNoAdobeMarker = -1 // plain CMYK, as libjpeg writes it
+	cmykAdobeCmyk     = 0  // inverted CMYK, as Photoshop writes it
+	cmykAdobeYcck     = 2  // inverted CMYK, with the CMY converted to YCbCr as though it were RGB
+)
+
+type jpegBitWriter struct {
+	buf   []byte
+	acc   uint32
+	nbits uint
+}
+
+func (w *jpegBitWriter) write(v uint32, n uint) {
+	w.acc = w.acc<<n | v&(1<<n-1)
+	w.nbits += n
+	for w.nbits >= 8 {
+		b := byte(w.acc >> (w.nbits - 8))
+		w.buf = append(w.buf, b)
+		if b == 0xFF {
+			w.buf = append(w.buf, 0x00)
+		}
+		w.nbits -= 8
+	}
+}
+
+func (w *jpegBitWriter) flush() []byte {
+	if w.nbits > 0 {
+		w.write(1<<(8-w.nbits)-1, 8-w.nbits)
+	}
+	return w.buf
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	b := []byte{0xFF, marker}
+	b = binary.BigEndian.AppendUint16(b, uint16(2+len(payload)))
+	return append(b, payload...)
+}
+
+// makeCmykJpeg returns a CMYK JPEG made of 8x8 blocks, with the ink colors of blocks given left to right, top to bottom.
+func makeCmykJpeg(t *testing.T, transform int, blocksWide int, blocks []color.CMYK) []byte {
+	blocksHigh := len(blocks) / blocksWide
+	out := []byte{0xFF, 0xD8}
+	if transform != cmykNoAdobeMarker {
+		out = append(out, jpegSegment(0xEE, []byte{'A', 'd', 'o', 'b', 'e', 0x00, 0x64, 0, 0, 0, 0, byte(transform)})...)
+	}
+
+	// Every coefficient is quantized by 1, so the DC coefficient is simply 8 times the (level shifted) value
+	out = append(out, jpegSegment(0xDB, append([]byte{0x00}, bytes.Repeat([]byte{1}, 64)...))...)
+	sof := []byte{8}
+	sof = binary.BigEndian.AppendUint16(sof, uint16(blocksHigh*8))
+	sof = binary.BigEndian.AppendUint16(sof, uint16(blocksWide*8))
+	sof = append(sof, 4)
+	for i := byte(1); i <= 4; i++ {
+		sof = append(sof, i, 0x11, 0)
+	}
+	out = append(out, jpegSegment(0xC0, sof)...)
+
+	// DC categories 0 to 11 are each coded with 4 bits (their own value), and the only AC symbol is the end of block
+	dcCounts := make([]byte, 16)
+	dcCounts[3] = 12
+	out = append(out, jpegSegment(0xC4, append(append([]byte{0x00}, dcCounts...), 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11))...)
+	acCounts := make([]byte, 16)
+	acCounts[0] = 1
+	out = append(out, jpegSegment(0xC4, append(append([]byte{0x10}, acCounts...), 0x00))...)
+	out = append(out, jpegSegment(0xDA, []byte{4, 1, 0, 2, 0, 3, 0, 4, 0, 0, 63, 0})...)
+
+	w := &jpegBitWriter{}
+	prev := [4]int{}
+	for _, c := range blocks {
+		stored := [4]uint8{c.C, c.M, c.Y, c.K}
+		switch transform {
+		case cmykAdobeCmyk:
+			stored = [4]uint8{255 - c.C, 255 - c.M, 255 - c.Y, 255 - c.K}
+		case cmykAdobeYcck:
+			y, cb, cr := color.RGBToYCbCr(c.C, c.M, c.Y) // the inversion cancels out when converted back, like libjpeg
+			stored = [4]uint8{y, cb, cr, 255 - c.K}
+		}
+		for i, v := range stored {
+			dc := 8 * (int(v) - 128)
+			diff := dc - prev[i]
+			prev[i] = dc
+			magnitude := diff
+			if diff < 0 {
+				magnitude = -diff
+				diff--
+			}
+			category := uint(bits.Len(uint(magnitude)))
+			w.write(uint32(category), 4)
+			w.write(uint32(diff), category)
+			w.write(0, 1) // end of block
+		}
+	}
+	out = append(out, w.flush()...)
+	return append(out, 0xFF, 0xD9)
+}
+
+func assertColorNear(t *testing.T, expected color.NRGBA, actual color.Color, msg string) {
+	r, g, b, _ := actual.RGBA()
+	for i, pair := range [][2]int{{int(expected.R), int(r >> 8)}, {int(expected.G), int(g >> 8)}, {int(expected.B), int(b >> 8)}} {
+		diff := pair[0] - pair[1]
+		if diff < 0 {
+			diff = -diff
+		}
+		assert.LessOrEqualf(t, diff, 8, "%s: channel %d of %v is %d", msg, i, expected, pair[1])
+	}
+}
+
+func TestDecodeJpegCorruptSegment(t *testing.T) {
+	// A segment length too short to cover the length itself is an error, not a panic
+	for _, length := range []byte{0, 1} {
+		b := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, length, 0x00, 0x00, 0xFF, 0xD9}
+		assert.NotPanics(t, func() {
+			_, err := u.DecodeJpeg(bytes.NewReader(b))
+			assert.Error(t, err)
+		}, "length %d", length)
+	}
+}
+
+func TestThumbnailCmykJpeg(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+
+	red := color.CMYK{C: 0, M: 255, Y: 255, K: 0}
+	gray := color.CMYK{C: 0, M: 0, Y: 0, K: 128}
+	blocks := make([]color.CMYK, 0, 32)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 8; x++ {
+			if x < 4 {
+				blocks = append(blocks, red)
+			} else {
+				blocks = append(blocks, gray)
+			}
+		}
+	}
+
+	for name, transform := range map[string]int{"no marker": cmykNoAdobeMarker, "adobe cmyk": cmykAdobeCmyk, "adobe ycck": cmykAdobeYcck} {
+		thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(makeCmykJpeg(t, transform, 8, blocks))), "image/jpeg", 32, 32, "scale", false, ctx)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		assert.Equal(t, 32, thumb.Width, name)
+		assert.Equal(t, 16, thumb.Height, name)
+		img, _, err := image.Decode(thumb.Reader)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+
+		// The colors are the inks' colors, not inverted
+		assertColorNear(t, color.NRGBA{R: 255, G: 0, B: 0, A: 255}, img.At(4, 8), name)
+		assertColorNear(t, color.NRGBA{R: 127, G: 127, B: 127, A: 255}, img.At(28, 8), name)
+	}
+}
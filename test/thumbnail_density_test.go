@@ -0,0 +1,126 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+func makeDensityThumbnail(t *testing.T, ctx rcontext.RequestContext, contentType string) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for x := 0; x < 200; x++ {
+		for y := 0; y < 100; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 64, A: 255})
+		}
+	}
+	b := &bytes.Buffer{}
+	if contentType == "image/jpeg" {
+		assert.NoError(t, jpeg.Encode(b, img, nil))
+	} else {
+		assert.NoError(t, png.Encode(b, img))
+	}
+
+	thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(b), contentType, 64, 64, "scale", false, ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer thumb.Reader.Close()
+	assert.Equal(t, contentType, thumb.ContentType)
+	out, err := io.ReadAll(thumb.Reader)
+	assert.NoError(t, err)
+	return out
+}
+
+// readPngDensity returns the pHYs chunk's pixels per unit (x, y) and unit, if there is one.
+func readPngDensity(t *testing.T, b []byte) (uint32, uint32, byte, bool) {
+	b = b[8:] // signature
+	for len(b) >= 12 {
+		length := binary.BigEndian.Uint32(b)
+		chunkType := string(b[4:8])
+		if chunkType == "pHYs" {
+			data := b[8 : 8+length]
+			return binary.BigEndian.Uint32(data), binary.BigEndian.Uint32(data[4:]), data[8], true
+		}
+		if chunkType == "IDAT" {
+			break // pHYs must come before the image data
+		}
+		b = b[12+length:]
+	}
+	return 0, 0, 0, false
+}
+
+// readJfifDensity returns the JFIF segment's density (x, y) and unit, if there is one.
+func readJfifDensity(t *testing.T, b []byte) (uint16, uint16, byte, bool) {
+	assert.Equal(t, []byte{0xFF, 0xD8}, b[:2])
+	if b[2] != 0xFF || b[3] != 0xE0 || string(b[6:11]) != "JFIF\x00" {
+		return 0, 0, 0, false
+	}
+	return binary.BigEndian.Uint16(b[14:]), binary.BigEndian.Uint16(b[16:]), b[13], true
+}
+
+func TestThumbnailDensity(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.OutputDpi = 300 })
+
+	out := makeDensityThumbnail(t, ctx, "image/png")
+	x, y, unit, ok := readPngDensity(t, out)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(11811), x) // 300 DPI in pixels per metre
+	assert.Equal(t, uint32(11811), y)
+	assert.Equal(t, byte(1), unit)
+	_, err := png.Decode(bytes.NewReader(out)) // checks the CRCs too
+	assert.NoError(t, err)
+
+	out = makeDensityThumbnail(t, ctx, "image/jpeg")
+	jx, jy, unit, ok := readJfifDensity(t, out)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(300), jx)
+	assert.Equal(t, uint16(300), jy)
+	assert.Equal(t, byte(1), unit) // dots per inch
+	_, err = jpeg.Decode(bytes.NewReader(out))
+	assert.NoError(t, err)
+}
+
+func TestThumbnailDensityDefault(t *testing.T) {
+	ctx := test_internals.MakeTestContext(nil)
+
+	_, _, _, ok := readPngDensity(t, makeDensityThumbnail(t, ctx, "image/png"))
+	assert.False(t, ok)
+	_, _, _, ok = readJfifDensity(t, makeDensityThumbnail(t, ctx, "image/jpeg"))
+	assert.False(t, ok)
+}
+
+func TestThumbnailDensitySmallWrites(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.OutputDpi = 96 })
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	expected := &bytes.Buffer{}
+	assert.NoError(t, u.EncodeAs(ctx, expected, img, imaging.PNG))
+
+	// The density is added in the same place no matter how the encoder splits up its writes
+	plain := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(plain, img))
+	actual := &bytes.Buffer{}
+	w := u.WithDensity(ctx, actual, imaging.PNG)
+	for _, c := range plain.Bytes() {
+		n, err := w.Write([]byte{c})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+	assert.Equal(t, expected.Bytes(), actual.Bytes())
+
+	x, _, _, ok := readPngDensity(t, actual.Bytes())
+	assert.True(t, ok)
+	assert.Equal(t, uint32(3780), x)
+}
@@ -0,0 +1,76 @@
+package test
+
+import (
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/custom"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/i"
+)
+
+func TestThumbnailDiagnostics(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.Thumbnails.DisabledGenerators = []string{"gif"}
+
+	r := httptest.NewRequest("GET", "/_matrix/media/unstable/admin/diagnostics/thumbnails", nil)
+	res := custom.GetThumbnailDiagnostics(r, ctx, _apimeta.UserInfo{})
+	noCache, ok := res.(*_responses.DoNotCacheResponse)
+	if !assert.True(t, ok) {
+		return
+	}
+	diagnostics, ok := noCache.Payload.(*custom.ThumbnailDiagnostics)
+	if !assert.True(t, ok) {
+		return
+	}
+
+	// Every generator is reported, in order
+	names := make([]string, 0)
+	byName := make(map[string]*custom.GeneratorDiagnosis)
+	for _, d := range diagnostics.Generators {
+		names = append(names, d.Name)
+		byName[d.Name] = d
+		assert.Contains(t, []string{custom.GeneratorStatusOk, custom.GeneratorStatusFailed, custom.GeneratorStatusNoFixture}, d.Status, d.Name)
+		if d.Status == custom.GeneratorStatusFailed {
+			assert.NotEmpty(t, d.Error, d.Name)
+		} else {
+			assert.Empty(t, d.Error, d.Name)
+		}
+	}
+	assert.Equal(t, i.GetGeneratorNames(), names)
+
+	// Generators which only need Go code should always work
+	for _, name := range []string{"apng", "bmp", "flac", "gif", "ico", "jpeg", "mp3", "ogg", "png", "tiff", "wav", "webp"} {
+		d := byName[name]
+		if assert.NotNil(t, d, name) {
+			assert.Equal(t, custom.GeneratorStatusOk, d.Status, "%s: %s", name, d.Error)
+			assert.NotEmpty(t, d.ThumbnailContentType, name)
+			assert.Greater(t, d.ThumbnailSizeBytes, int64(0), name)
+		}
+	}
+	assert.Equal(t, 64, byName["png"].Width)
+	assert.Equal(t, 64, byName["png"].Height)
+	assert.Equal(t, "image/png", byName["apng"].FixtureContentType)
+
+	// Disabled generators are still tested, but flagged
+	assert.True(t, byName["gif"].Disabled)
+	assert.False(t, byName["png"].Disabled)
+
+	// Generators relying on external tools are tested too, where the tools are installed
+	for name, tool := range map[string]string{"mp4": "ffmpeg", "jpegxl": "convert"} {
+		d := byName[name]
+		if !assert.NotNil(t, d, name) {
+			continue
+		}
+		assert.NotEqual(t, custom.GeneratorStatusNoFixture, d.Status, name)
+		if _, err := exec.LookPath(tool); err == nil {
+			assert.Equal(t, custom.GeneratorStatusOk, d.Status, "%s: %s", name, d.Error)
+		}
+	}
+}
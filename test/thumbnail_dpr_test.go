@@ -0,0 +1,95 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+)
+
+func setDprSizes(c *config.DomainRepoConfig) {
+	c.Thumbnails.Sizes = []config.ThumbnailSize{
+		{Width: 320, Height: 240},
+		{Width: 800, Height: 600},
+	}
+}
+
+func TestApplyDevicePixelRatio(t *testing.T) {
+	ctx := test_internals.MakeTestContext(setDprSizes)
+
+	cases := []struct {
+		width, height   int
+		dpr             float64
+		expectedW       int
+		expectedH       int
+		expectedFailure bool
+	}{
+		{width: 160, height: 120, dpr: 1, expectedW: 160, expectedH: 120},
+		{width: 160, height: 120, dpr: 2, expectedW: 320, expectedH: 240},
+		{width: 100, height: 100, dpr: 1.5, expectedW: 150, expectedH: 150},
+		{width: 32, height: 32, dpr: 4, expectedW: 128, expectedH: 128},
+
+		// Clamped to the largest size, keeping the aspect ratio
+		{width: 640, height: 480, dpr: 2, expectedW: 800, expectedH: 600},
+		{width: 400, height: 100, dpr: 3, expectedW: 800, expectedH: 200},
+
+		// ... but never below what was asked for
+		{width: 700, height: 700, dpr: 2, expectedW: 700, expectedH: 700},
+
+		// A dimension left for autoAspect to fill in stays zero
+		{width: 160, height: 0, dpr: 2, expectedW: 320, expectedH: 0},
+		{width: 0, height: 400, dpr: 2, expectedW: 0, expectedH: 600},
+
+		{width: 160, height: 120, dpr: 0.5, expectedFailure: true},
+		{width: 160, height: 120, dpr: 4.5, expectedFailure: true},
+		{width: 160, height: 120, dpr: math.NaN(), expectedFailure: true},
+	}
+	for _, c := range cases {
+		w, h, err := thumbnails.ApplyDevicePixelRatio(ctx, c.width, c.height, c.dpr)
+		if c.expectedFailure {
+			assert.Error(t, err, c)
+			continue
+		}
+		assert.NoError(t, err, c)
+		assert.Equal(t, c.expectedW, w, c)
+		assert.Equal(t, c.expectedH, h, c)
+	}
+}
+
+func TestThumbnailDevicePixelRatioOutput(t *testing.T) {
+	ctx := test_internals.MakeTestContext(setDprSizes)
+	ctx.Config.Thumbnails.DynamicSizing = true
+
+	b := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(b, image.NewNRGBA(image.Rect(0, 0, 1000, 800))))
+	fixture := b.Bytes()
+
+	generate := func(dpr float64) (int, int, image.Rectangle) {
+		w, h, err := thumbnails.ApplyDevicePixelRatio(ctx, 160, 120, dpr)
+		assert.NoError(t, err)
+		w, h, method, err := thumbnails.PickNewDimensions(ctx, w, h, "scale")
+		assert.NoError(t, err)
+		thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(fixture)), "image/png", w, h, method, false, ctx)
+		assert.NoError(t, err)
+		img, _, err := image.Decode(thumb.Reader)
+		assert.NoError(t, err)
+		return w, h, img.Bounds()
+	}
+
+	w1, h1, bounds1 := generate(1)
+	w2, h2, bounds2 := generate(2)
+	assert.Equal(t, 160, w1)
+	assert.Equal(t, 120, h1)
+	assert.Equal(t, 320, w2)
+	assert.Equal(t, 240, h2)
+	assert.Equal(t, bounds1.Dx()*2, bounds2.Dx())
+	assert.Equal(t, bounds1.Dy()*2, bounds2.Dy())
+}
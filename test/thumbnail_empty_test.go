@@ -0,0 +1,41 @@
+package test
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+func TestThumbnailEmptyImage(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+
+	for _, src := range []image.Image{
+		image.NewNRGBA(image.Rect(0, 0, 1, 0)),
+		image.NewNRGBA(image.Rect(0, 0, 0, 1)),
+		&image.NRGBA{},
+	} {
+		for _, method := range []string{"scale", "crop", "crop:top_left"} {
+			thumb, err := u.MakeThumbnail(src, method, 64, 64, ctx)
+			assert.ErrorIs(t, err, u.ErrEmptyImage, method)
+			assert.Nil(t, thumb, method)
+		}
+	}
+
+	// Nothing can be made at zero size either
+	src := makeSharpenFixture(32, 32)
+	thumb, err := u.MakeThumbnail(src, "scale", 0, 64, ctx)
+	assert.ErrorIs(t, err, u.ErrEmptyImage)
+	assert.Nil(t, thumb)
+
+	// Very thin images still make a thumbnail
+	thumb, err = u.MakeThumbnail(makeSharpenFixture(1000, 1), "scale", 64, 64, ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, thumb) {
+		assert.Equal(t, image.Pt(64, 1), thumb.Bounds().Size())
+	}
+}
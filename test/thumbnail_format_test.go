@@ -0,0 +1,82 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+func makeFormatFixture(t *testing.T, transparent bool) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 256; y++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 0x80, A: 0xFF})
+		}
+	}
+	if transparent {
+		for x := 0; x < 256; x++ {
+			for y := 0; y < 128; y++ {
+				img.Set(x, y, color.NRGBA{})
+			}
+		}
+	}
+	b := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(b, img))
+	return b.Bytes()
+}
+
+func generateFormatThumbnail(t *testing.T, autoFormat bool, fixture []byte) (string, []byte) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.Thumbnails.AutoFormat = autoFormat
+
+	thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(fixture)), "image/png", 64, 64, "scale", false, ctx)
+	assert.NoError(t, err)
+	b, err := io.ReadAll(thumb.Reader)
+	assert.NoError(t, err)
+	return thumb.ContentType, b
+}
+
+func TestThumbnailAutoFormat(t *testing.T) {
+	opaque := makeFormatFixture(t, false)
+	transparent := makeFormatFixture(t, true)
+
+	contentType, b := generateFormatThumbnail(t, true, opaque)
+	assert.Equal(t, "image/jpeg", contentType)
+	assert.Equal(t, "image/jpeg", http.DetectContentType(b))
+
+	contentType, b = generateFormatThumbnail(t, true, transparent)
+	assert.Equal(t, "image/png", contentType)
+	assert.Equal(t, "image/png", http.DetectContentType(b))
+
+	// Without automatic formats, PNGs always produce PNGs
+	contentType, b = generateFormatThumbnail(t, false, opaque)
+	assert.Equal(t, "image/png", contentType)
+	assert.Equal(t, "image/png", http.DetectContentType(b))
+}
+
+func TestThumbnailHasAlpha(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	assert.True(t, u.HasAlpha(img))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			img.Set(x, y, color.NRGBA{R: 0xFF, A: 0xFF})
+		}
+	}
+	assert.False(t, u.HasAlpha(img))
+	img.Set(3, 3, color.NRGBA{R: 0xFF, A: 0xFE})
+	assert.True(t, u.HasAlpha(img))
+
+	// Images without an alpha channel are always opaque
+	assert.False(t, u.HasAlpha(image.NewGray(image.Rect(0, 0, 4, 4))))
+}
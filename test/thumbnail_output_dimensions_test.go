@@ -0,0 +1,108 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+)
+
+func TestThumbnailOutputDimensions(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.Thumbnails.Types = append(ctx.Config.Thumbnails.Types, "image/heic")
+
+	src := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(src, image.NewRGBA(image.Rect(0, 0, 400, 200))))
+	heic, err := test_internals.MakeMultiImageHeic(t.TempDir(), 400, 200, color.RGBA{R: 0xFF, A: 0xFF})
+	assert.NoError(t, err)
+
+	for _, c := range []struct {
+		contentType string
+		b           []byte
+		w           int
+		h           int
+	}{
+		{"image/png", src.Bytes(), 100, 50},
+		// Rotated by the EXIF orientation after scaling
+		{"image/jpeg", makeOrientedJpegOf(t, 6, image.NewRGBA(image.Rect(0, 0, 400, 200))), 50, 100},
+		{"image/heic", heic, 100, 50},
+	} {
+		thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(c.b)), c.contentType, 100, 100, "scale", false, ctx)
+		if !assert.NoError(t, err, c.contentType) {
+			continue
+		}
+		assert.Equal(t, c.w, thumb.Width, c.contentType)
+		assert.Equal(t, c.h, thumb.Height, c.contentType)
+		b, err := io.ReadAll(thumb.Reader)
+		assert.NoError(t, err, c.contentType)
+
+		srv := serveGenerated(func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+			return &_responses.DownloadResponse{
+				ContentType:           thumb.ContentType,
+				SizeBytes:             int64(len(b)),
+				Data:                  io.NopCloser(bytes.NewReader(b)),
+				ThumbnailWidth:        100,
+				ThumbnailHeight:       100,
+				ThumbnailOutputWidth:  thumb.Width,
+				ThumbnailOutputHeight: thumb.Height,
+			}
+		})
+		res, err := http.Get(srv.URL)
+		if !assert.NoError(t, err, c.contentType) {
+			srv.Close()
+			continue
+		}
+		served, _, err := image.Decode(res.Body)
+		assert.NoError(t, err, c.contentType)
+		_ = res.Body.Close()
+		srv.Close()
+
+		// The requested size is unchanged, and the output size is what was actually served
+		assert.Equal(t, "100", res.Header.Get("X-Thumbnail-Width"), c.contentType)
+		assert.Equal(t, "100", res.Header.Get("X-Thumbnail-Height"), c.contentType)
+		assert.Equal(t, strconv.Itoa(served.Bounds().Dx()), res.Header.Get("X-Thumbnail-Output-Width"), c.contentType)
+		assert.Equal(t, strconv.Itoa(served.Bounds().Dy()), res.Header.Get("X-Thumbnail-Output-Height"), c.contentType)
+		assert.Equal(t, "X-Thumbnail-Width, X-Thumbnail-Height, X-Thumbnail-Output-Width, X-Thumbnail-Output-Height", res.Header.Get("Access-Control-Expose-Headers"), c.contentType)
+	}
+}
+
+func TestThumbnailOutputDimensionsPlaceholder(t *testing.T) {
+	placeholders := writePlaceholders(t)
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.Placeholders = placeholders })
+	thumb, err := thumbnailing.GeneratePlaceholder("video/webm", 64, 64, "scale", ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Read from the encoded placeholder, which is then served whole
+	w, h, r := thumbnailing.OutputDimensions(thumb.Reader)
+	assert.Equal(t, 64, w)
+	assert.Equal(t, 32, h)
+	img, err := png.Decode(r)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Pt(64, 32), img.Bounds().Size())
+	assert.NoError(t, r.Close())
+}
+
+func TestThumbnailOutputDimensionsUnknown(t *testing.T) {
+	// Output which isn't a recognised image has no dimensions, but is still read in full
+	w, h, r := thumbnailing.OutputDimensions(io.NopCloser(strings.NewReader("not an image")))
+	assert.Zero(t, w)
+	assert.Zero(t, h)
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "not an image", string(b))
+}
@@ -0,0 +1,108 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// makeLogoFixture is a few flat shapes, some partly transparent.
+func makeLogoFixture() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: color.NRGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}}, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(40, 40, 200, 260), &image.Uniform{C: color.NRGBA{R: 0x1E, G: 0x88, B: 0xE5, A: 0xFF}}, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(220, 40, 360, 150), &image.Uniform{C: color.NRGBA{R: 0xE5, G: 0x39, B: 0x35, A: 0xFF}}, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(220, 170, 360, 260), &image.Uniform{C: color.NRGBA{R: 0x43, G: 0xA0, B: 0x47, A: 0x80}}, image.Point{}, draw.Src)
+	return img
+}
+
+// makePhotoFixture is a noisy gradient, with far more colours than fit in a palette.
+func makePhotoFixture() image.Image {
+	rng := rand.New(rand.NewSource(42))
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			img.Set(x, y, color.NRGBA{
+				R: uint8(x*200/400 + rng.Intn(56)),
+				G: uint8(y*200/300 + rng.Intn(56)),
+				B: uint8((x+y)*200/700 + rng.Intn(56)),
+				A: 0xFF,
+			})
+		}
+	}
+	return img
+}
+
+// pngColorType returns the colour type from the PNG's header: 3 for a palette, 2 for RGB, or 6 for RGBA.
+func pngColorType(b []byte) byte {
+	return b[8+8+9] // signature, IHDR length and type, then the width, height, and bit depth
+}
+
+func TestThumbnailPngPalette(t *testing.T) {
+	generate := func(fixture image.Image, mode string) []byte {
+		b := &bytes.Buffer{}
+		assert.NoError(t, png.Encode(b, fixture))
+
+		ctx := rcontext.InitialNoConfig()
+		ctx.Config = config.NewDefaultDomainConfig()
+		ctx.Config.Thumbnails.PngPalette.Mode = mode
+		thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(b), "image/png", 320, 240, "scale", false, ctx)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, "image/png", thumb.ContentType)
+		out, err := io.ReadAll(thumb.Reader)
+		assert.NoError(t, err)
+		return out
+	}
+
+	logo := makeLogoFixture()
+	logoOff := generate(logo, u.PaletteOff)
+	logoAuto := generate(logo, u.PaletteAuto)
+	assert.Equal(t, byte(6), pngColorType(logoOff))
+	assert.Equal(t, byte(3), pngColorType(logoAuto))
+	assert.Less(t, len(logoAuto), len(logoOff))
+	t.Logf("Logo: %d bytes as truecolor, %d bytes with a palette", len(logoOff), len(logoAuto))
+
+	// The logo has few enough colours that the palette doesn't lose any
+	offImg, err := png.Decode(bytes.NewReader(logoOff))
+	assert.NoError(t, err)
+	autoImg, err := png.Decode(bytes.NewReader(logoAuto))
+	assert.NoError(t, err)
+	assert.Equal(t, offImg.Bounds(), autoImg.Bounds())
+	for y := 0; y < offImg.Bounds().Dy(); y++ {
+		for x := 0; x < offImg.Bounds().Dx(); x++ {
+			if !assert.Equal(t, color.NRGBAModel.Convert(offImg.At(x, y)), color.NRGBAModel.Convert(autoImg.At(x, y)), "%d,%d", x, y) {
+				return
+			}
+		}
+	}
+
+	// Photos keep their colour unless a palette is forced
+	photo := makePhotoFixture()
+	photoOff := generate(photo, u.PaletteOff)
+	photoAuto := generate(photo, u.PaletteAuto)
+	photoAlways := generate(photo, u.PaletteAlways)
+	assert.Equal(t, photoOff, photoAuto)
+	assert.Equal(t, byte(2), pngColorType(photoAuto))
+	assert.Equal(t, byte(3), pngColorType(photoAlways))
+	assert.Less(t, len(photoAlways), len(photoOff))
+	t.Logf("Photo: %d bytes as truecolor, %d bytes with a forced palette", len(photoOff), len(photoAlways))
+
+	offImg, err = png.Decode(bytes.NewReader(photoOff))
+	assert.NoError(t, err)
+	alwaysImg, err := png.Decode(bytes.NewReader(photoAlways))
+	assert.NoError(t, err)
+	assert.Greater(t, psnr(offImg, alwaysImg), 25.0)
+}
@@ -0,0 +1,86 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"path"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+)
+
+// writePlaceholders writes a red square placeholder for PDFs, and a wide blue one for videos.
+func writePlaceholders(t *testing.T) []config.ThumbnailPlaceholder {
+	dir := t.TempDir()
+	documentIcon := imaging.New(256, 256, color.NRGBA{R: 0xFF, A: 0xFF})
+	videoIcon := imaging.New(256, 128, color.NRGBA{B: 0xFF, A: 0xFF})
+	assert.NoError(t, imaging.Save(documentIcon, path.Join(dir, "document.png")))
+	assert.NoError(t, imaging.Save(videoIcon, path.Join(dir, "video.png")))
+
+	return []config.ThumbnailPlaceholder{
+		{ContentType: "application/pdf", Path: path.Join(dir, "document.png")},
+		{ContentType: "video/*", Path: path.Join(dir, "video.png")},
+	}
+}
+
+func decodePlaceholder(t *testing.T, ctx rcontext.RequestContext, contentType string, width int, height int, method string) image.Image {
+	thumb, err := thumbnailing.GeneratePlaceholder(contentType, width, height, method, ctx)
+	if !assert.NoError(t, err, contentType) {
+		return nil
+	}
+	assert.Equal(t, "image/png", thumb.ContentType)
+	b, err := io.ReadAll(thumb.Reader)
+	assert.NoError(t, err)
+	img, err := imaging.Decode(bytes.NewReader(b))
+	assert.NoError(t, err)
+	return img
+}
+
+func TestThumbnailPlaceholder(t *testing.T) {
+	placeholders := writePlaceholders(t)
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.Placeholders = placeholders })
+
+	img := decodePlaceholder(t, ctx, "application/pdf", 64, 64, "scale")
+	if assert.NotNil(t, img) {
+		assert.Equal(t, image.Pt(64, 64), img.Bounds().Size())
+		r, g, b, _ := img.At(32, 32).RGBA()
+		assert.Equal(t, [3]uint32{0xFFFF, 0, 0}, [3]uint32{r, g, b})
+	}
+
+	// Globs match, and the requested method is used
+	img = decodePlaceholder(t, ctx, "VIDEO/mp4", 64, 64, "crop")
+	if assert.NotNil(t, img) {
+		assert.Equal(t, image.Pt(64, 64), img.Bounds().Size())
+		_, _, b, _ := img.At(32, 32).RGBA()
+		assert.Equal(t, uint32(0xFFFF), b)
+	}
+	img = decodePlaceholder(t, ctx, "video/webm", 64, 64, "scale")
+	if assert.NotNil(t, img) {
+		assert.Equal(t, image.Pt(64, 32), img.Bounds().Size())
+	}
+}
+
+func TestThumbnailPlaceholderUnmatched(t *testing.T) {
+	placeholders := writePlaceholders(t)
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.Placeholders = placeholders })
+	_, err := thumbnailing.GeneratePlaceholder("audio/mpeg", 64, 64, "scale", ctx)
+	assert.ErrorIs(t, err, thumbnailing.ErrUnsupported)
+
+	// None by default
+	ctx.Config = config.NewDefaultDomainConfig()
+	_, err = thumbnailing.GeneratePlaceholder("application/pdf", 64, 64, "scale", ctx)
+	assert.ErrorIs(t, err, thumbnailing.ErrUnsupported)
+
+	// A missing image is an error rather than quietly falling back
+	ctx.Config.Thumbnails.Placeholders = []config.ThumbnailPlaceholder{{ContentType: "*", Path: path.Join(t.TempDir(), "missing.png")}}
+	_, err = thumbnailing.GeneratePlaceholder("application/pdf", 64, 64, "scale", ctx)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, thumbnailing.ErrUnsupported)
+}
@@ -0,0 +1,102 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"io"
+	"testing"
+
+	"github.com/kettek/apng"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+)
+
+const probeFrameCount = 10000
+
+// countingProbeReader counts how much of the image was read.
+type countingProbeReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingProbeReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func makeManyFrameGif(t *testing.T) []byte {
+	g := &gif.GIF{}
+	for i := 0; i < probeFrameCount; i++ {
+		g.Image = append(g.Image, makeGifFrame(image.Rect(0, 0, 40, 30), image.Rect(0, 0, 40, 30), gifTestPalette[1+i%3]))
+		g.Delay = append(g.Delay, 1)
+	}
+	buf := &bytes.Buffer{}
+	assert.NoError(t, gif.EncodeAll(buf, g))
+	return buf.Bytes()
+}
+
+func makeManyFrameApng(t *testing.T) []byte {
+	a := apng.APNG{}
+	for i := 0; i < probeFrameCount; i++ {
+		a.Frames = append(a.Frames, apng.Frame{Image: makeGifFrame(image.Rect(0, 0, 40, 30), image.Rect(0, 0, 40, 30), gifTestPalette[1+i%3])})
+	}
+	buf := &bytes.Buffer{}
+	assert.NoError(t, apng.Encode(buf, a))
+	return buf.Bytes()
+}
+
+// makeManyFrameWebp builds an animated WebP's container. The frames aren't valid images, but only the container is
+// needed to find the size.
+func makeManyFrameWebp() []byte {
+	chunk := func(fourcc string, data []byte) []byte {
+		b := append([]byte(fourcc), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+		b = append(b, data...)
+		if len(data)%2 == 1 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	vp8x := []byte{0x02, 0, 0, 0, 39, 0, 0, 29, 0, 0} // animated, 40x30 (stored minus one)
+	body := append([]byte("WEBP"), chunk("VP8X", vp8x)...)
+	body = append(body, chunk("ANIM", make([]byte, 6))...)
+	for i := 0; i < probeFrameCount; i++ {
+		body = append(body, chunk("ANMF", make([]byte, 33))...)
+	}
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func TestThumbnailProbeDoesNotReadFrames(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.Thumbnails.Types = append(ctx.Config.Thumbnails.Types, "image/apng")
+
+	for _, c := range []struct {
+		contentType string
+		b           []byte
+	}{
+		{"image/gif", makeManyFrameGif(t)},
+		{"image/png", makeManyFrameApng(t)},
+		{"image/webp", makeManyFrameWebp()},
+	} {
+		generator, _, err := thumbnailing.GetGenerator(bytes.NewReader(c.b), c.contentType, true, ctx)
+		if !assert.NoError(t, err, c.contentType) {
+			continue
+		}
+
+		r := &countingProbeReader{r: bytes.NewReader(c.b)}
+		dimensional, w, h, err := generator.GetOriginDimensions(r, c.contentType, ctx)
+		assert.NoError(t, err, c.contentType)
+		assert.True(t, dimensional, c.contentType)
+		assert.Equal(t, 40, w, c.contentType)
+		assert.Equal(t, 30, h, c.contentType)
+
+		// Only the start of the file should be needed, though decoders buffer a few kb at a time
+		assert.Less(t, r.n, 8192, c.contentType)
+		assert.Greater(t, len(c.b), 100000, c.contentType)
+	}
+}
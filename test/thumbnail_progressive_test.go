@@ -0,0 +1,140 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// jpegFrameMarker returns the marker of the JPEG's frame header: 0xC0 for baseline or 0xC2 for progressive.
+func jpegFrameMarker(t *testing.T, b []byte) byte {
+	assert.Equal(t, []byte{0xFF, 0xD8}, b[:2])
+	for i := 2; i+4 <= len(b); {
+		if !assert.Equal(t, byte(0xFF), b[i]) {
+			return 0
+		}
+		marker := b[i+1]
+		if marker >= 0xC0 && marker <= 0xC3 {
+			return marker
+		}
+		i += 2 + int(binary.BigEndian.Uint16(b[i+2:]))
+	}
+	return 0
+}
+
+func makeProgressiveFixture(width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: uint8((x + y) % 64 * 4), A: 0xFF})
+		}
+	}
+	return img
+}
+
+// psnr compares the images, in decibels. Higher is more similar.
+func psnr(a image.Image, b image.Image) float64 {
+	sum := 0.0
+	n := 0
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			ca := color.NRGBAModel.Convert(a.At(x, y)).(color.NRGBA)
+			cb := color.NRGBAModel.Convert(b.At(x, y)).(color.NRGBA)
+			for _, d := range []float64{float64(ca.R) - float64(cb.R), float64(ca.G) - float64(cb.G), float64(ca.B) - float64(cb.B)} {
+				sum += d * d
+				n++
+			}
+		}
+	}
+	if sum == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/(sum/float64(n)))
+}
+
+func TestThumbnailProgressiveJpeg(t *testing.T) {
+	b := &bytes.Buffer{}
+	assert.NoError(t, jpeg.Encode(b, makeProgressiveFixture(400, 300), &jpeg.Options{Quality: 95}))
+	source := b.Bytes()
+
+	generate := func(progressive bool) []byte {
+		ctx := rcontext.InitialNoConfig()
+		ctx.Config = config.NewDefaultDomainConfig()
+		ctx.Config.Thumbnails.ProgressiveJpeg = progressive
+		thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(source)), "image/jpeg", 96, 96, "scale", false, ctx)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer thumb.Reader.Close()
+		assert.Equal(t, "image/jpeg", thumb.ContentType)
+		out, err := io.ReadAll(thumb.Reader)
+		assert.NoError(t, err)
+		return out
+	}
+
+	// Baseline by default
+	baseline := generate(config.NewDefaultDomainConfig().Thumbnails.ProgressiveJpeg)
+	assert.Equal(t, byte(0xC0), jpegFrameMarker(t, baseline))
+
+	progressive := generate(true)
+	assert.Equal(t, byte(0xC2), jpegFrameMarker(t, progressive))
+
+	// Both decode to (nearly) the same thumbnail
+	baselineImg, err := jpeg.Decode(bytes.NewReader(baseline))
+	assert.NoError(t, err)
+	progressiveImg, err := jpeg.Decode(bytes.NewReader(progressive))
+	assert.NoError(t, err)
+	assert.Equal(t, baselineImg.Bounds(), progressiveImg.Bounds())
+	assert.Greater(t, psnr(baselineImg, progressiveImg), 35.0)
+
+	// libjpeg's optimized Huffman tables keep progressive thumbnails no larger than baseline ones
+	assert.LessOrEqual(t, len(progressive), len(baseline))
+}
+
+func TestProgressiveJpegShapes(t *testing.T) {
+	// Sizes which don't fill whole blocks or MCUs, and a greyscale image
+	gray := image.NewGray(image.Rect(0, 0, 21, 13))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+	cases := map[string]image.Image{
+		"tiny":    makeProgressiveFixture(1, 1),
+		"odd":     makeProgressiveFixture(37, 23),
+		"wide":    makeProgressiveFixture(250, 9),
+		"offset":  makeProgressiveFixture(60, 60).SubImage(image.Rect(10, 20, 43, 51)),
+		"gray":    gray,
+		"blocked": makeProgressiveFixture(64, 32),
+	}
+	for name, img := range cases {
+		t.Run(name, func(t *testing.T) {
+			b := &bytes.Buffer{}
+			assert.NoError(t, u.EncodeProgressiveJpeg(b, img, 95))
+			assert.Equal(t, byte(0xC2), jpegFrameMarker(t, b.Bytes()))
+
+			decoded, err := jpeg.Decode(bytes.NewReader(b.Bytes()))
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, img.Bounds().Dx(), decoded.Bounds().Dx())
+			assert.Equal(t, img.Bounds().Dy(), decoded.Bounds().Dy())
+
+			// Compare against what the standard library's (baseline) encoder manages
+			b.Reset()
+			assert.NoError(t, jpeg.Encode(b, img, &jpeg.Options{Quality: 95}))
+			expected, err := jpeg.Decode(b)
+			assert.NoError(t, err)
+			assert.Greater(t, psnr(expected, decoded), 30.0)
+		})
+	}
+}
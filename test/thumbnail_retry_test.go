@@ -0,0 +1,102 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+)
+
+// brokenStream returns the first n bytes of b, then fails like a datastore connection dropping.
+func brokenStream(b []byte, n int) io.ReadCloser {
+	return io.NopCloser(io.MultiReader(bytes.NewReader(b[:n]), &failingReader{}))
+}
+
+func TestThumbnailRetryTransient(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.Retries.BackoffMs = 1 })
+	contentType, img, err := test_internals.MakeTestImage(512, 512)
+	assert.NoError(t, err)
+	b, err := io.ReadAll(img)
+	assert.NoError(t, err)
+
+	// The media failing to be read part way through is worth trying again
+	_, err = thumbnailing.GenerateThumbnail(brokenStream(b, len(b)/2), contentType, 64, 64, "scale", false, ctx)
+	assert.Error(t, err)
+	assert.True(t, thumbnailing.IsTransient(err))
+
+	attempts := 0
+	thumb, err := thumbnailing.WithRetries(ctx, func() (*m.Thumbnail, error) {
+		attempts++
+		stream := io.NopCloser(bytes.NewReader(b))
+		if attempts == 1 {
+			stream = brokenStream(b, len(b)/2)
+		}
+		return thumbnailing.GenerateThumbnail(stream, contentType, 64, 64, "scale", false, ctx)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	if assert.NotNil(t, thumb) {
+		_ = thumb.Reader.Close()
+	}
+}
+
+func TestThumbnailRetryDeterministic(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.Retries.BackoffMs = 1 })
+	contentType, img, err := test_internals.MakeTestImage(512, 512)
+	assert.NoError(t, err)
+	b, err := io.ReadAll(img)
+	assert.NoError(t, err)
+	corrupt := append(bytes.Clone(b[:len(b)/2]), bytes.Repeat([]byte{0xFF}, len(b)/2)...)
+
+	for _, c := range []struct {
+		name        string
+		contentType string
+		data        []byte
+	}{
+		{"corrupt", contentType, corrupt},
+		{"truncated", contentType, b[:len(b)/2]},
+		{"unsupported", "application/zip", b},
+	} {
+		attempts := 0
+		_, err = thumbnailing.WithRetries(ctx, func() (*m.Thumbnail, error) {
+			attempts++
+			return thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(c.data)), c.contentType, 64, 64, "scale", false, ctx)
+		})
+		assert.Error(t, err, c.name)
+		assert.False(t, thumbnailing.IsTransient(err), c.name)
+		assert.Equal(t, 1, attempts, c.name)
+	}
+}
+
+func TestThumbnailRetryLimit(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.Retries.BackoffMs = 1 })
+	transient := fmt.Errorf("%w: still broken", thumbnailing.ErrTransient)
+
+	for _, maxRetries := range []int{0, 1, 3} {
+		ctx.Config.Thumbnails.Retries.MaxRetries = maxRetries
+		attempts := 0
+		_, err := thumbnailing.WithRetries(ctx, func() (*m.Thumbnail, error) {
+			attempts++
+			return nil, transient
+		})
+		assert.ErrorIs(t, err, thumbnailing.ErrTransient)
+		assert.Equal(t, maxRetries+1, attempts)
+	}
+}
+
+func TestThumbnailIsTransient(t *testing.T) {
+	assert.False(t, thumbnailing.IsTransient(nil))
+	assert.True(t, thumbnailing.IsTransient(fmt.Errorf("wrapped: %w", thumbnailing.ErrTransient)))
+	assert.False(t, thumbnailing.IsTransient(thumbnailing.ErrUnsupported))
+	assert.False(t, thumbnailing.IsTransient(common.ErrMediaTooLarge))
+	assert.False(t, thumbnailing.IsTransient(common.ErrMediaDimensionsTooSmall))
+	assert.False(t, thumbnailing.IsTransient(errors.New("png: invalid format")))
+}
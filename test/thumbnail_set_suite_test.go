@@ -0,0 +1,106 @@
+package test
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/t2bot/matrix-media-repo/api/unstable"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type ThumbnailSetTestSuite struct {
+	suite.Suite
+	deps *test_internals.ContainerDeps
+}
+
+func (s *ThumbnailSetTestSuite) SetupSuite() {
+	deps, err := test_internals.MakeTestDeps()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.deps = deps
+}
+
+func (s *ThumbnailSetTestSuite) TearDownSuite() {
+	if s.deps != nil {
+		if s.T().Failed() {
+			s.deps.Debug()
+		}
+		s.deps.Teardown()
+	}
+}
+
+func (s *ThumbnailSetTestSuite) TestThumbnailSet() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+
+	contentType, img, err := test_internals.MakeTestImage(512, 512)
+	assert.NoError(t, err)
+	res, err := client1.Upload("image"+util.ExtensionForContentType(contentType), contentType, img)
+	assert.NoError(t, err)
+	origin, mediaId, err := util.SplitMxc(res.MxcUri)
+	assert.NoError(t, err)
+
+	qs := url.Values{"sizes": []string{"32x32,96x96,320x240"}}
+	endpoint := fmt.Sprintf("/_matrix/media/unstable/thumbnail_set/%s/%s", origin, mediaId)
+	set := new(unstable.ThumbnailSetResponse)
+	err = client1.DoReturnJson("GET", endpoint, qs, "", nil, set)
+	assert.NoError(t, err)
+	assert.Equal(t, res.MxcUri, set.ContentUri)
+	assert.Len(t, set.Thumbnails, 3)
+	assert.NotEmpty(t, set.SrcSet)
+
+	for _, thumb := range set.Thumbnails {
+		assert.Contains(t, set.SrcSet, fmt.Sprintf("%s %dw", thumb.Url, thumb.Width))
+
+		thumbUrl, err := url.Parse(thumb.Url)
+		assert.NoError(t, err)
+		raw, err := client1.DoRaw("GET", thumbUrl.Path, thumbUrl.Query(), "", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, raw.StatusCode)
+		assert.Equal(t, thumb.ContentType, raw.Header.Get("Content-Type"))
+	}
+
+	// All three should now be stored, and a second request should return the same thumbnails
+	thumbs, err := database.GetInstance().Thumbnails.Prepare(rcontext.Initial()).GetForMedia(origin, mediaId)
+	assert.NoError(t, err)
+	assert.Len(t, thumbs, 3)
+
+	again := new(unstable.ThumbnailSetResponse)
+	err = client1.DoReturnJson("GET", endpoint, qs, "", nil, again)
+	assert.NoError(t, err)
+	assert.Equal(t, set, again)
+
+	thumbs, err = database.GetInstance().Thumbnails.Prepare(rcontext.Initial()).GetForMedia(origin, mediaId)
+	assert.NoError(t, err)
+	assert.Len(t, thumbs, 3)
+}
+
+func (s *ThumbnailSetTestSuite) TestThumbnailSetTooManySizes() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+
+	sizes := "32x32"
+	for i := 0; i < unstable.MaxThumbnailSetSizes; i++ {
+		sizes += ",32x32"
+	}
+	errRes, err := client1.DoExpectError("GET", fmt.Sprintf("/_matrix/media/unstable/thumbnail_set/%s/doesnotmatter", client1.ServerName), url.Values{"sizes": []string{sizes}}, "", nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, errRes)
+	assert.Equal(t, "M_UNKNOWN", errRes.Code)
+	assert.Equal(t, http.StatusBadRequest, errRes.InjectedStatusCode)
+}
+
+func TestThumbnailSetTestSuite(t *testing.T) {
+	suite.Run(t, new(ThumbnailSetTestSuite))
+}
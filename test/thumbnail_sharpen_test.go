@@ -0,0 +1,74 @@
+package test
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+func makeSharpenFixture(width int, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			// A checkerboard, so sharpening has edges to work with
+			v := uint8(0x20)
+			if (x/8+y/8)%2 == 0 {
+				v = 0xE0
+			}
+			img.Set(x, y, color.NRGBA{R: v, G: v, B: v, A: 0xFF})
+		}
+	}
+	return img
+}
+
+func TestThumbnailSharpenDownscale(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) {
+		c.Thumbnails.Sharpen = true
+		c.Thumbnails.SharpenAmount = 1.5
+	})
+	src := makeSharpenFixture(256, 256)
+
+	thumb, err := u.MakeThumbnail(src, "scale", 64, 64, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, imaging.Sharpen(imaging.Fit(src, 64, 64, imaging.Linear), 1.5), thumb)
+	assert.NotEqual(t, imaging.Sharpen(imaging.Fit(src, 64, 64, imaging.Linear), 0.5), thumb)
+
+	ctx.Config.Thumbnails.SharpenAmount = 0.75
+	thumb, err = u.MakeThumbnail(src, "crop", 64, 32, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, imaging.Sharpen(imaging.Fill(src, 64, 32, imaging.Center, imaging.Linear), 0.75), thumb)
+
+	// Disabled
+	ctx.Config.Thumbnails.Sharpen = false
+	thumb, err = u.MakeThumbnail(src, "scale", 64, 64, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, imaging.Fit(src, 64, 64, imaging.Linear), thumb)
+}
+
+func TestThumbnailSharpenSkipsUpscale(t *testing.T) {
+	src := makeSharpenFixture(32, 32)
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) {
+		c.Thumbnails.Sharpen = true
+		c.Thumbnails.SharpenAmount = 1.5
+	})
+
+	thumb, err := u.MakeThumbnail(src, "crop", 64, 64, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, imaging.Fill(src, 64, 64, imaging.Center, imaging.Linear), thumb)
+
+	// Cropping one side while scaling the other up is still an upscale
+	thumb, err = u.MakeThumbnail(src, "crop", 16, 64, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, imaging.Fill(src, 16, 64, imaging.Center, imaging.Linear), thumb)
+
+	// Scaling to something larger leaves the image as-is
+	thumb, err = u.MakeThumbnail(src, "scale", 64, 64, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, imaging.Fit(src, 64, 64, imaging.Linear), thumb)
+}
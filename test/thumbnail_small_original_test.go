@@ -0,0 +1,68 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+func TestThumbnailSmallOriginal(t *testing.T) {
+	b := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(b, makeProgressiveFixture(200, 150)))
+	fixture := b.Bytes()
+	fixtureSize := int64(len(fixture))
+
+	generate := func(ctx rcontext.RequestContext, method string) (image.Rectangle, error) {
+		thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(fixture)), "image/png", 512, 512, method, false, ctx)
+		if err != nil {
+			return image.Rectangle{}, err
+		}
+		img, _, err := image.Decode(thumb.Reader)
+		assert.NoError(t, err)
+		return img.Bounds(), nil
+	}
+	makeCtx := func(enabled bool, maxBytes int64) rcontext.RequestContext {
+		ctx := rcontext.InitialNoConfig()
+		ctx.Config = config.NewDefaultDomainConfig()
+		ctx.Config.Thumbnails.SmallOriginals.Enabled = enabled
+		ctx.Config.Thumbnails.SmallOriginals.MaxBytes = maxBytes
+		return ctx
+	}
+
+	for _, method := range []string{"scale", "crop"} {
+		// By default, the original is served instead (signalled by the error)
+		_, err := generate(u.WithSourceSize(makeCtx(true, 0), fixtureSize), method)
+		assert.ErrorIs(t, err, common.ErrMediaDimensionsTooSmall, method)
+		_, err = generate(u.WithSourceSize(makeCtx(true, fixtureSize), fixtureSize), method)
+		assert.ErrorIs(t, err, common.ErrMediaDimensionsTooSmall, method)
+
+		// Disabled, or too many bytes: thumbnailed at its own size rather than upscaled
+		for name, ctx := range map[string]rcontext.RequestContext{
+			"disabled":     u.WithSourceSize(makeCtx(false, 0), fixtureSize),
+			"too large":    u.WithSourceSize(makeCtx(true, fixtureSize-1), fixtureSize),
+			"unknown size": makeCtx(true, fixtureSize),
+		} {
+			bounds, err := generate(ctx, method)
+			assert.NoError(t, err, name)
+			assert.Equal(t, 200, bounds.Dx(), name)
+			assert.Equal(t, 150, bounds.Dy(), name)
+		}
+	}
+
+	// Requests smaller than the original are thumbnailed as normal
+	thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(fixture)), "image/png", 100, 100, "scale", false, makeCtx(true, 0))
+	assert.NoError(t, err)
+	img, _, err := image.Decode(thumb.Reader)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, img.Bounds().Dx())
+	assert.Equal(t, 75, img.Bounds().Dy())
+}
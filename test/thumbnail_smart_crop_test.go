@@ -0,0 +1,117 @@
+package test
+
+import (
+	"image"
+	"image/color"
+	"sync"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+var smartBackground = color.NRGBA{R: 0x80, G: 0x90, B: 0xA0, A: 0xFF}
+var smartSubject = color.NRGBA{R: 0xE0, G: 0xAC, B: 0x8C, A: 0xFF}
+
+// makeSubjectFixture returns a wide image with a face near its right edge, on a plain background.
+func makeSubjectFixture() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 100))
+	for x := 0; x < 300; x++ {
+		for y := 0; y < 100; y++ {
+			c := smartBackground
+			dx := float64(x-240) / 25
+			dy := float64(y-50) / 32
+			if dx*dx+dy*dy <= 1 {
+				c = smartSubject
+				if (x == 232 || x == 248) && y >= 40 && y <= 44 {
+					c = color.NRGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xFF} // eyes
+				}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestThumbnailSmartCropFindsSubject(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.SmartCrop.Enabled = true })
+	src := makeSubjectFixture()
+
+	region, found := u.FindSalientCrop(src, 50, 50)
+	assert.True(t, found)
+	assert.Equal(t, 100, region.Dx())
+	assert.Equal(t, 100, region.Dy())
+	assert.True(t, region.Min.X <= 215 && region.Max.X >= 265, "face is cut off by %v", region)
+
+	smart, err := u.MakeThumbnail(src, u.CropMethod(u.SmartAnchor), 50, 50, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 50, smart.Bounds().Dx())
+	assert.Equal(t, 50, smart.Bounds().Dy())
+	assertCenterColor(t, smartSubject, smart)
+
+	// A centered crop misses the face entirely
+	centered, err := u.MakeThumbnail(src, u.CropMethod(u.DefaultAnchor), 50, 50, ctx)
+	assert.NoError(t, err)
+	assertCenterColor(t, smartBackground, centered)
+}
+
+func TestThumbnailSmartCropFallsBackToCenter(t *testing.T) {
+	centered := func(src image.Image) image.Image {
+		return imaging.Fill(src, 40, 20, imaging.Center, imaging.Linear)
+	}
+
+	// Nothing stands out in an image of one colour
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.SmartCrop.Enabled = true })
+	flat := imaging.New(200, 200, smartBackground)
+	_, found := u.FindSalientCrop(flat, 40, 20)
+	assert.False(t, found)
+	thumb, err := u.MakeThumbnail(flat, u.CropMethod(u.SmartAnchor), 40, 20, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, centered(flat), thumb)
+
+	// ... and smart crops are centered while disabled
+	ctx.Config.Thumbnails.SmartCrop.Enabled = false
+	subject := makeSubjectFixture()
+	thumb, err = u.MakeThumbnail(subject, u.CropMethod(u.SmartAnchor), 40, 20, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, centered(subject), thumb)
+}
+
+func TestThumbnailSmartCropVertical(t *testing.T) {
+	// A detailed patch near the bottom of a tall image is kept
+	img := imaging.New(100, 300, smartBackground)
+	for x := 0; x < 100; x++ {
+		for y := 220; y < 280; y++ {
+			if (x+y)%2 == 0 {
+				img.Set(x, y, color.NRGBA{A: 0xFF})
+			}
+		}
+	}
+	region, found := u.FindSalientCrop(img, 10, 10)
+	assert.True(t, found)
+	assert.Equal(t, 100, region.Dx())
+	assert.True(t, region.Min.Y <= 220 && region.Max.Y >= 280, "detail is cut off by %v", region)
+}
+
+func TestThumbnailSmartCropConcurrency(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.SmartCrop.Enabled = true })
+	ctx.Config.Thumbnails.SmartCrop.MaxConcurrent = 1
+	src := makeSubjectFixture()
+
+	// Crops wait for each other rather than failing
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			thumb, err := u.MakeThumbnail(src, u.CropMethod(u.SmartAnchor), 50, 50, ctx)
+			if assert.NoError(t, err) {
+				assertCenterColor(t, smartSubject, thumb)
+			}
+		}()
+	}
+	wg.Wait()
+}
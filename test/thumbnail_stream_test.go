@@ -0,0 +1,110 @@
+package test
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
+)
+
+// allocatedWhile returns roughly how many bytes were allocated while running fn.
+func allocatedWhile(fn func()) uint64 {
+	before := &runtime.MemStats{}
+	after := &runtime.MemStats{}
+	runtime.GC()
+	runtime.ReadMemStats(before)
+	fn()
+	runtime.ReadMemStats(after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// encoderStandIn produces size bytes without holding them, like a thumbnail encoder writing to a pipe.
+type encoderStandIn struct {
+	remaining int64
+	closed    bool
+}
+
+func (e *encoderStandIn) Read(p []byte) (int, error) {
+	if e.remaining <= 0 {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), e.remaining))
+	for i := range p[:n] {
+		p[i] = byte(e.remaining - int64(i))
+	}
+	e.remaining -= int64(n)
+	return n, nil
+}
+
+func (e *encoderStandIn) Close() error {
+	e.closed = true
+	return nil
+}
+
+func TestThumbnailServedWhileStored(t *testing.T) {
+	const size = 64 * 1024 * 1024
+	encoder := &encoderStandIn{remaining: size}
+
+	stored := int64(0)
+	served := int64(0)
+	allocated := allocatedWhile(func() {
+		r := thumbnails.ServeWhileStoring(encoder, func(r io.Reader) {
+			var err error
+			stored, err = io.Copy(io.Discard, r)
+			assert.NoError(t, err)
+		})
+		var err error
+		served, err = io.Copy(io.Discard, r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+	})
+
+	// Both sides get the whole thumbnail, but it's never held in memory
+	assert.Equal(t, int64(size), served)
+	assert.Equal(t, int64(size), stored)
+	assert.True(t, encoder.closed)
+	t.Logf("%d bytes allocated to serve and store %d bytes", allocated, size)
+	assert.Less(t, allocated, uint64(size/16))
+}
+
+func TestThumbnailStoredAfterRequesterLeaves(t *testing.T) {
+	const size = 4 * 1024 * 1024
+	stored := int64(0)
+	r := thumbnails.ServeWhileStoring(&encoderStandIn{remaining: size}, func(r io.Reader) {
+		stored, _ = io.Copy(io.Discard, r)
+	})
+
+	// The requester only reads the start, then goes away. Closing waits for the rest to be stored.
+	_, err := io.ReadFull(r, make([]byte, 1024))
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, int64(size), stored)
+}
+
+func TestThumbnailServedWhenStoreFails(t *testing.T) {
+	const size = 4 * 1024 * 1024
+	r := thumbnails.ServeWhileStoring(&encoderStandIn{remaining: size}, func(r io.Reader) {
+		// Give up part way through, like a datastore that has run out of space
+		_, _ = io.ReadFull(r, make([]byte, 1024))
+	})
+	served, err := io.Copy(io.Discard, r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(size), served)
+	assert.NoError(t, r.Close())
+}
+
+func TestThumbnailEncoderErrorReachesBothSides(t *testing.T) {
+	encoderErr := errors.New("encoder failed")
+	var storeErr error
+	r := thumbnails.ServeWhileStoring(io.NopCloser(io.MultiReader(&encoderStandIn{remaining: 1024}, iotest.ErrReader(encoderErr))), func(r io.Reader) {
+		_, storeErr = io.Copy(io.Discard, r)
+	})
+	_, err := io.Copy(io.Discard, r)
+	assert.ErrorIs(t, err, encoderErr)
+	assert.NoError(t, r.Close())
+	assert.ErrorIs(t, storeErr, encoderErr, "a partial thumbnail isn't stored")
+}
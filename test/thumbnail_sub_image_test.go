@@ -0,0 +1,203 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+)
+
+type tiffFixturePage struct {
+	width   int
+	height  int
+	colour  color.RGBA
+	reduced bool
+}
+
+// makeTiffFixture writes an uncompressed RGB TIFF with one solid-coloured image per page
+func makeTiffFixture(pages ...tiffFixturePage) []byte {
+	le := binary.LittleEndian
+	b := &bytes.Buffer{}
+	b.Write([]byte{'I', 'I', 42, 0, 0, 0, 0, 0}) // first IFD offset is filled in below
+	nextOffsetAt := 4
+	for _, p := range pages {
+		// Pixel data, then the BitsPerSample values, then the IFD itself
+		pixelsAt := b.Len()
+		for i := 0; i < p.width*p.height; i++ {
+			b.Write([]byte{p.colour.R, p.colour.G, p.colour.B})
+		}
+		bitsAt := b.Len()
+		b.Write([]byte{8, 0, 8, 0, 8, 0})
+		if b.Len()%2 != 0 {
+			b.WriteByte(0)
+		}
+
+		ifdAt := b.Len()
+		data := b.Bytes()
+		le.PutUint32(data[nextOffsetAt:], uint32(ifdAt))
+
+		subfileType := uint32(0)
+		if p.reduced {
+			subfileType = 1
+		}
+		entries := [][3]uint32{ // tag, type, value
+			{254, 4, subfileType},
+			{256, 4, uint32(p.width)},
+			{257, 4, uint32(p.height)},
+			{258, 3, uint32(bitsAt)}, // count 3, so this is an offset
+			{259, 3, 1},
+			{262, 3, 2},
+			{273, 4, uint32(pixelsAt)},
+			{277, 3, 3},
+			{278, 4, uint32(p.height)},
+			{279, 4, uint32(p.width * p.height * 3)},
+		}
+		ifd := make([]byte, 2+len(entries)*12+4)
+		le.PutUint16(ifd[0:], uint16(len(entries)))
+		for i, e := range entries {
+			entry := ifd[2+i*12:]
+			le.PutUint16(entry[0:], uint16(e[0]))
+			le.PutUint16(entry[2:], uint16(e[1]))
+			if e[0] == 258 {
+				le.PutUint32(entry[4:], 3)
+				le.PutUint32(entry[8:], e[2])
+			} else {
+				le.PutUint32(entry[4:], 1)
+				if e[1] == 3 {
+					le.PutUint16(entry[8:], uint16(e[2]))
+				} else {
+					le.PutUint32(entry[8:], e[2])
+				}
+			}
+		}
+		b.Write(ifd)
+		nextOffsetAt = b.Len() - 4
+	}
+	return b.Bytes()
+}
+
+// thumbnailColour returns the colour at the centre of the thumbnail
+func thumbnailColour(t *testing.T, thumb *m.Thumbnail) color.RGBA {
+	if !assert.NotNil(t, thumb) {
+		return color.RGBA{}
+	}
+	defer thumb.Reader.Close()
+	img, _, err := image.Decode(thumb.Reader)
+	assert.NoError(t, err)
+	bounds := img.Bounds()
+	r, g, b, a := img.At(bounds.Dx()/2, bounds.Dy()/2).RGBA()
+	return color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(a >> 8)}
+}
+
+func assertColourNear(t *testing.T, expected color.RGBA, actual color.RGBA) {
+	near := func(a uint8, b uint8) bool {
+		d := int(a) - int(b)
+		return d > -16 && d < 16
+	}
+	assert.True(t, near(expected.R, actual.R) && near(expected.G, actual.G) && near(expected.B, actual.B), "expected %v, got %v", expected, actual)
+}
+
+var (
+	subImageRed   = color.RGBA{R: 255, A: 255}
+	subImageGreen = color.RGBA{G: 255, A: 255}
+	subImageBlue  = color.RGBA{B: 255, A: 255}
+)
+
+func makeMultiPageTiff() []byte {
+	return makeTiffFixture(
+		tiffFixturePage{width: 16, height: 16, colour: subImageRed, reduced: true}, // preview of the next page
+		tiffFixturePage{width: 128, height: 96, colour: subImageBlue},
+		tiffFixturePage{width: 64, height: 64, colour: subImageGreen},
+	)
+}
+
+func TestThumbnailTiffPrimaryImage(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) {
+		c.Thumbnails.Types = append(c.Thumbnails.Types, "image/tiff")
+	})
+	fixture := makeMultiPageTiff()
+
+	// The reduced resolution preview at the start of the file is skipped
+	thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(fixture)), "image/tiff", 64, 64, "scale", false, ctx)
+	assert.NoError(t, err)
+	assertColourNear(t, subImageBlue, thumbnailColour(t, thumb))
+
+	generator, r, err := thumbnailing.GetGenerator(bytes.NewReader(fixture), "image/tiff", false, ctx)
+	assert.NoError(t, err)
+	_, w, h, err := generator.GetOriginDimensions(r, "image/tiff", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 128, w)
+	assert.Equal(t, 96, h)
+
+	// Files without previews use their first page, as before
+	single := makeTiffFixture(tiffFixturePage{width: 64, height: 64, colour: subImageGreen})
+	thumb, err = thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(single)), "image/tiff", 32, 32, "scale", false, ctx)
+	assert.NoError(t, err)
+	assertColourNear(t, subImageGreen, thumbnailColour(t, thumb))
+}
+
+func TestThumbnailTiffSubImage(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) {
+		c.Thumbnails.Types = append(c.Thumbnails.Types, "image/tiff")
+	})
+	fixture := makeMultiPageTiff()
+
+	cases := []struct {
+		index  int
+		colour color.RGBA
+	}{
+		{0, subImageRed},
+		{1, subImageBlue},
+		{2, subImageGreen},
+		{99, subImageGreen}, // clamped to the last page
+	}
+	for _, c := range cases {
+		thumb, err := thumbnailing.GenerateSubImageThumbnail(io.NopCloser(bytes.NewReader(fixture)), "image/tiff", c.index, 32, 32, "scale", ctx)
+		assert.NoError(t, err, c.index)
+		assertColourNear(t, c.colour, thumbnailColour(t, thumb))
+	}
+
+	// Sub-images smaller than the requested size are returned as-is rather than rejected
+	thumb, err := thumbnailing.GenerateSubImageThumbnail(io.NopCloser(bytes.NewReader(fixture)), "image/tiff", 0, 64, 64, "crop", ctx)
+	assert.NoError(t, err)
+	assertColourNear(t, subImageRed, thumbnailColour(t, thumb))
+}
+
+func TestThumbnailHeicSubImage(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) {
+		c.Thumbnails.Types = append(c.Thumbnails.Types, "image/heic")
+	})
+	fixture, err := test_internals.MakeMultiImageHeic(t.TempDir(), 64, 64, subImageRed, subImageBlue)
+	if err != nil {
+		t.Skip("HEIC encoding is not available: ", err)
+	}
+
+	cases := []struct {
+		index  int
+		colour color.RGBA
+	}{
+		{0, subImageRed},
+		{1, subImageBlue},
+		{5, subImageBlue}, // clamped to the last image
+	}
+	for _, c := range cases {
+		thumb, err := thumbnailing.GenerateSubImageThumbnail(io.NopCloser(bytes.NewReader(fixture)), "image/heic", c.index, 32, 32, "scale", ctx)
+		assert.NoError(t, err, c.index)
+		assertColourNear(t, c.colour, thumbnailColour(t, thumb))
+	}
+
+	// Without a sub-image, the primary image is used
+	thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(fixture)), "image/heic", 32, 32, "scale", false, ctx)
+	assert.NoError(t, err)
+	assertColourNear(t, subImageRed, thumbnailColour(t, thumb))
+}
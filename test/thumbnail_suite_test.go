@@ -0,0 +1,85 @@
+package test
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type ThumbnailTestSuite struct {
+	suite.Suite
+	deps *test_internals.ContainerDeps
+}
+
+func (s *ThumbnailTestSuite) SetupSuite() {
+	deps, err := test_internals.MakeTestDeps()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.deps = deps
+}
+
+func (s *ThumbnailTestSuite) TearDownSuite() {
+	if s.deps != nil {
+		if s.T().Failed() {
+			s.deps.Debug()
+		}
+		s.deps.Teardown()
+	}
+}
+
+func (s *ThumbnailTestSuite) TestThumbnailAutoAspect() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+
+	contentType, img, err := test_internals.MakeTestImage(400, 300)
+	assert.NoError(t, err)
+	res, err := client1.Upload("image"+util.ExtensionForContentType(contentType), contentType, img)
+	assert.NoError(t, err)
+	origin, mediaId, err := util.SplitMxc(res.MxcUri)
+	assert.NoError(t, err)
+
+	endpoint := fmt.Sprintf("/_matrix/media/v3/thumbnail/%s/%s", origin, mediaId)
+	thumbnail := func(qs url.Values) image.Rectangle {
+		raw, err := client1.DoRaw("GET", endpoint, qs, "", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, raw.StatusCode)
+		defer raw.Body.Close()
+		thumb, _, err := image.Decode(raw.Body)
+		assert.NoError(t, err)
+		return thumb.Bounds()
+	}
+
+	// Each is requested twice: the second should be the thumbnail stored by the first
+	for i := 0; i < 2; i++ {
+		bounds := thumbnail(url.Values{"width": []string{"200"}, "method": []string{"scale"}})
+		assert.Equal(t, 200, bounds.Dx())
+		assert.Equal(t, 150, bounds.Dy())
+
+		bounds = thumbnail(url.Values{"height": []string{"60"}, "method": []string{"crop"}})
+		assert.Equal(t, 80, bounds.Dx())
+		assert.Equal(t, 60, bounds.Dy())
+	}
+
+	thumbs, err := database.GetInstance().Thumbnails.Prepare(rcontext.Initial()).GetForMedia(origin, mediaId)
+	assert.NoError(t, err)
+	assert.Len(t, thumbs, 2)
+	for _, thumb := range thumbs {
+		assert.Equal(t, thumb.Width*3, thumb.Height*4, "stored under the dimensions it was generated at")
+	}
+}
+
+func TestThumbnailTestSuite(t *testing.T) {
+	suite.Run(t, new(ThumbnailTestSuite))
+}
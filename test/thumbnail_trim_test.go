@@ -0,0 +1,91 @@
+package test
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// makeBorderedFixture draws a blue 40x20 box at (30,10) on a width x height background
+func makeBorderedFixture(width int, height int, background color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, background)
+		}
+	}
+	for x := 30; x < 70; x++ {
+		for y := 10; y < 30; y++ {
+			img.Set(x, y, color.NRGBA{B: 0xFF, A: 0xFF})
+		}
+	}
+	return img
+}
+
+func TestThumbnailTrimBorders(t *testing.T) {
+	white := color.NRGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}
+
+	trimmed := u.TrimBorders(makeBorderedFixture(100, 50, white), 0)
+	assert.Equal(t, 40, trimmed.Bounds().Dx())
+	assert.Equal(t, 20, trimmed.Bounds().Dy())
+
+	// Transparent borders are trimmed too, whatever colour the transparent pixels are
+	transparent := makeBorderedFixture(100, 50, color.NRGBA{})
+	transparent.Set(99, 49, color.NRGBA{R: 0xFF})
+	trimmed = u.TrimBorders(transparent, 0)
+	assert.Equal(t, 40, trimmed.Bounds().Dx())
+	assert.Equal(t, 20, trimmed.Bounds().Dy())
+
+	// Small variations in the border (like compression artifacts) are tolerated
+	noisy := makeBorderedFixture(100, 50, white)
+	noisy.Set(5, 5, color.NRGBA{R: 0xF8, G: 0xFA, B: 0xFF, A: 0xFF})
+	trimmed = u.TrimBorders(noisy, 0)
+	assert.Equal(t, 65, trimmed.Bounds().Dx()) // the noisy pixel is kept, so only part of the border goes
+	trimmed = u.TrimBorders(noisy, 10)
+	assert.Equal(t, 40, trimmed.Bounds().Dx())
+	assert.Equal(t, 20, trimmed.Bounds().Dy())
+}
+
+func TestThumbnailTrimUniform(t *testing.T) {
+	// An image which is all one colour would trim to nothing, so is left alone
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 32))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 32; y++ {
+			img.Set(x, y, color.NRGBA{R: 0x80, A: 0xFF})
+		}
+	}
+	trimmed := u.TrimBorders(img, 10)
+	assert.Equal(t, img.Bounds(), trimmed.Bounds())
+
+	// As is an image without a border
+	noBorder := makeBorderedFixture(40, 20, color.NRGBA{B: 0xFF, A: 0xFF})
+	assert.Equal(t, noBorder.Bounds(), u.TrimBorders(noBorder, 0).Bounds())
+}
+
+func TestThumbnailTrimConfig(t *testing.T) {
+	white := color.NRGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}
+	src := makeBorderedFixture(200, 100, white)
+
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+
+	// Without trimming, the border shrinks along with the rest of the image
+	thumb, err := u.MakeThumbnail(src, "scale", 100, 100, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, thumb.Bounds().Dx())
+	assert.Equal(t, 50, thumb.Bounds().Dy())
+
+	// With trimming, the 40x20 box is all that's left to scale
+	ctx.Config.Thumbnails.Trim = true
+	thumb, err = u.MakeThumbnail(src, "scale", 20, 20, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, thumb.Bounds().Dx())
+	assert.Equal(t, 10, thumb.Bounds().Dy())
+	r, g, b, _ := thumb.At(10, 5).RGBA()
+	assert.Equal(t, [3]uint32{0, 0, 0xFFFF}, [3]uint32{r, g, b})
+}
@@ -0,0 +1,37 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+)
+
+func TestThumbnailStaleness(t *testing.T) {
+	legacy := &database.DbThumbnail{GeneratorVersion: 0} // generated before versions were recorded
+	current := &database.DbThumbnail{GeneratorVersion: thumbnailing.GeneratorVersion}
+
+	// By default, nothing is stale
+	ctx := test_internals.MakeTestContext(nil)
+	assert.False(t, thumbnails.IsStale(ctx, legacy))
+	assert.False(t, thumbnails.IsStale(ctx, current))
+
+	// Requiring the current version makes older thumbnails stale, but not fresh ones
+	ctx = test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.MinGeneratorVersion = thumbnailing.GeneratorVersion })
+	assert.True(t, thumbnails.IsStale(ctx, legacy))
+	assert.False(t, thumbnails.IsStale(ctx, current))
+
+	// Newer thumbnails than the minimum are fine too, such as after a downgrade
+	ctx = test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.MinGeneratorVersion = thumbnailing.GeneratorVersion - 1 })
+	assert.False(t, thumbnails.IsStale(ctx, current))
+
+	// A minimum above what we can generate is limited to the current version, so fresh thumbnails aren't
+	// regenerated forever
+	ctx = test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Thumbnails.MinGeneratorVersion = thumbnailing.GeneratorVersion + 1 })
+	assert.True(t, thumbnails.IsStale(ctx, legacy))
+	assert.False(t, thumbnails.IsStale(ctx, current))
+}
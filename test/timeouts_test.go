@@ -0,0 +1,128 @@
+package test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common"
+)
+
+// slowBody writes chunks to the request body, pausing between each.
+func slowBody(chunks int, pause time.Duration) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < chunks; i++ {
+			time.Sleep(pause)
+			if _, err := pw.Write(make([]byte, 1024)); err != nil {
+				return
+			}
+		}
+		_ = pw.Close()
+	}()
+	return pr
+}
+
+func countingHandler(readErr chan<- error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if readErr != nil {
+			readErr <- err
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusRequestTimeout)
+			return
+		}
+		_, _ = w.Write([]byte(strconv.Itoa(len(b))))
+	})
+}
+
+func TestTimeoutRouterSlowRequest(t *testing.T) {
+	srv := httptest.NewServer(_routers.NewTimeoutRouter(100*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+			_, _ = w.Write([]byte("too late"))
+		}
+	})))
+	defer srv.Close()
+
+	start := time.Now()
+	res, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	errRes := &_responses.ErrorResponse{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(errRes))
+	assert.Equal(t, common.ErrCodeTimedOut, errRes.InternalCode)
+}
+
+func TestTimeoutRouterFastRequest(t *testing.T) {
+	srv := httptest.NewServer(_routers.NewTimeoutRouter(time.Second, countingHandler(nil)))
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL, "application/octet-stream", slowBody(2, 10*time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "2048", string(b))
+}
+
+func TestIdleTimeoutRouterSlowUpload(t *testing.T) {
+	// The upload takes longer than the timeout overall, but never stalls for longer than it
+	srv := httptest.NewServer(_routers.NewIdleTimeoutRouter(250*time.Millisecond, countingHandler(nil)))
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL, "application/octet-stream", slowBody(10, 75*time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "10240", string(b))
+}
+
+func TestIdleTimeoutRouterStalledUpload(t *testing.T) {
+	readErr := make(chan error, 1)
+	srv := httptest.NewServer(_routers.NewIdleTimeoutRouter(100*time.Millisecond, countingHandler(readErr)))
+	defer srv.Close()
+
+	go func() {
+		res, err := http.Post(srv.URL, "application/octet-stream", slowBody(2, 500*time.Millisecond))
+		if err == nil {
+			_ = res.Body.Close()
+		}
+	}()
+	select {
+	case err := <-readErr:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "stalled upload was not timed out")
+	}
+}
+
+func TestIdleTimeoutRouterSlowDownload(t *testing.T) {
+	srv := httptest.NewServer(_routers.NewIdleTimeoutRouter(250*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			time.Sleep(75 * time.Millisecond)
+			_, _ = w.Write(make([]byte, 1024))
+			_ = http.NewResponseController(w).Flush()
+		}
+	})))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Len(t, b, 10240)
+}
@@ -0,0 +1,62 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+func TestUploadFilenameTruncated(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Uploads.MaxFilenameLength = 32 })
+
+	name, err := upload.CheckFileName(ctx, "short.png")
+	assert.NoError(t, err)
+	assert.Equal(t, "short.png", name)
+
+	name, err = upload.CheckFileName(ctx, strings.Repeat("a", 100)+".png")
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a", 28)+".png", name)
+
+	// "€" is 3 bytes, so cutting the name at 28 bytes would split the 10th one
+	ctx33 := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Uploads.MaxFilenameLength = 33 })
+	name, err = upload.CheckFileName(ctx33, strings.Repeat("€", 40)+".jpeg")
+	assert.NoError(t, err)
+	assert.True(t, utf8.ValidString(name))
+	assert.Equal(t, strings.Repeat("€", 9)+".jpeg", name)
+
+	// Extensions which would take up most of the name aren't kept
+	name, err = upload.CheckFileName(ctx, "file."+strings.Repeat("x", 40))
+	assert.NoError(t, err)
+	assert.Equal(t, "file."+strings.Repeat("x", 27), name)
+
+	// Disabled
+	ctx = test_internals.MakeTestContext(func(c *config.DomainRepoConfig) { c.Uploads.MaxFilenameLength = 0 })
+	long := strings.Repeat("b", 1000) + ".txt"
+	name, err = upload.CheckFileName(ctx, long)
+	assert.NoError(t, err)
+	assert.Equal(t, long, name)
+}
+
+func TestUploadFilenameRejected(t *testing.T) {
+	ctx := test_internals.MakeTestContext(func(c *config.DomainRepoConfig) {
+		c.Uploads.MaxFilenameLength = 32
+		c.Uploads.RejectLongFilenames = true
+	})
+
+	name, err := upload.CheckFileName(ctx, "short.png")
+	assert.NoError(t, err)
+	assert.Equal(t, "short.png", name)
+
+	_, err = upload.CheckFileName(ctx, strings.Repeat("a", 100)+".png")
+	assert.ErrorIs(t, err, common.ErrFileNameTooLong)
+
+	// 16 characters, but 48 bytes
+	_, err = upload.CheckFileName(ctx, strings.Repeat("€", 16))
+	assert.ErrorIs(t, err, common.ErrFileNameTooLong)
+}
@@ -0,0 +1,62 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+)
+
+func TestUploadLockWithoutRedis(t *testing.T) {
+	// Redis is disabled by default, so the locks are held within this process
+	test_internals.UseTempConfig(t)
+	ctx := test_internals.MakeTestContext(nil)
+
+	// Only one holder of the lock at a time
+	holders := &atomic.Int32{}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlockFn, err := upload.LockForUpload(ctx, "hash")
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, int32(1), holders.Add(1))
+			time.Sleep(time.Millisecond)
+			holders.Add(-1)
+			assert.NoError(t, unlockFn())
+		}()
+	}
+	wg.Wait()
+
+	// Other hashes aren't blocked
+	unlockFn, err := upload.LockForUpload(ctx, "hash")
+	assert.NoError(t, err)
+	unlockOther, err := upload.LockForUpload(ctx, "other")
+	assert.NoError(t, err)
+	assert.NoError(t, unlockOther())
+
+	// Waiting gives up when the request does
+	cancelled, cancel := context.WithCancel(ctx.Context)
+	cancel()
+	cancelledCtx := ctx
+	cancelledCtx.Context = cancelled
+	_, err = upload.LockForUpload(cancelledCtx, "hash")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Unlocking more than once doesn't release someone else's lock
+	assert.NoError(t, unlockFn())
+	assert.NoError(t, unlockFn())
+	unlockFn, err = upload.LockForUpload(ctx, "hash")
+	assert.NoError(t, err)
+	_, err = upload.LockForUpload(cancelledCtx, "hash")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NoError(t, unlockFn())
+}
@@ -0,0 +1,155 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/notifier"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// collectProgress reads events until the channel is closed
+func collectProgress(ch <-chan notifier.UploadProgress) []notifier.UploadProgress {
+	events := make([]notifier.UploadProgress, 0)
+	for p := range ch {
+		events = append(events, p)
+	}
+	return events
+}
+
+// simulateUpload reports progress the same way the upload pipeline does, reading size bytes in chunks
+func simulateUpload(origin string, mediaId string, size int) {
+	notifier.UploadStarted(origin, mediaId)
+	r := readers.NewProgressReader(io.NopCloser(bytes.NewReader(make([]byte, size))), func(total int64) {
+		notifier.UploadReceived(origin, mediaId, total)
+	})
+	buf := make([]byte, 64*1024)
+	_, _ = io.CopyBuffer(io.Discard, r, buf)
+	notifier.UploadStageChanged(origin, mediaId, notifier.UploadStageProcessing)
+	notifier.UploadStageChanged(origin, mediaId, notifier.UploadStageStoring)
+	notifier.UploadStageChanged(origin, mediaId, notifier.UploadStageDone)
+}
+
+func TestUploadProgressOrder(t *testing.T) {
+	ch, unsubscribe, err := notifier.SubscribeToUploadProgress("example.org", "progress_order", 4)
+	assert.NoError(t, err)
+	defer unsubscribe()
+
+	size := 1024 * 1024
+	go simulateUpload("example.org", "progress_order", size)
+	events := collectProgress(ch)
+
+	expected := []notifier.UploadProgress{
+		{Stage: notifier.UploadStageReceiving, BytesReceived: 0},
+		{Stage: notifier.UploadStageReceiving, BytesReceived: 256 * 1024},
+		{Stage: notifier.UploadStageReceiving, BytesReceived: 512 * 1024},
+		{Stage: notifier.UploadStageReceiving, BytesReceived: 768 * 1024},
+		{Stage: notifier.UploadStageReceiving, BytesReceived: 1024 * 1024},
+		{Stage: notifier.UploadStageProcessing, BytesReceived: int64(size)},
+		{Stage: notifier.UploadStageStoring, BytesReceived: int64(size)},
+		{Stage: notifier.UploadStageDone, BytesReceived: int64(size)},
+	}
+	assert.Equal(t, expected, events)
+}
+
+func TestUploadProgressSlowSubscriber(t *testing.T) {
+	// Nothing reads from the channel until the upload is done, so events have to be dropped
+	ch, unsubscribe, err := notifier.SubscribeToUploadProgress("example.org", "progress_slow", 4)
+	assert.NoError(t, err)
+	defer unsubscribe()
+
+	simulateUpload("example.org", "progress_slow", 64*1024*1024)
+	events := collectProgress(ch)
+	assert.LessOrEqual(t, len(events), 16)
+	if assert.Greater(t, len(events), 3) {
+		// The stage changes still make it through, in order
+		assert.Equal(t, notifier.UploadStageProcessing, events[len(events)-3].Stage)
+		assert.Equal(t, notifier.UploadStageStoring, events[len(events)-2].Stage)
+		assert.Equal(t, notifier.UploadStageDone, events[len(events)-1].Stage)
+	}
+	for i := 1; i < len(events); i++ {
+		assert.GreaterOrEqual(t, events[i].BytesReceived, events[i-1].BytesReceived)
+	}
+}
+
+func TestUploadProgressSubscribers(t *testing.T) {
+	_, unsubscribe1, err := notifier.SubscribeToUploadProgress("example.org", "progress_limit", 2)
+	assert.NoError(t, err)
+	_, unsubscribe2, err := notifier.SubscribeToUploadProgress("example.org", "progress_limit", 2)
+	assert.NoError(t, err)
+	_, _, err = notifier.SubscribeToUploadProgress("example.org", "progress_limit", 2)
+	assert.ErrorIs(t, err, notifier.ErrTooManyProgressSubscribers)
+
+	// Leaving frees up a spot
+	unsubscribe1()
+	unsubscribe1() // and doing so twice is harmless
+	_, unsubscribe3, err := notifier.SubscribeToUploadProgress("example.org", "progress_limit", 2)
+	assert.NoError(t, err)
+
+	// Subscribers joining part way through get the current progress first
+	notifier.UploadStarted("example.org", "progress_limit")
+	notifier.UploadStageChanged("example.org", "progress_limit", notifier.UploadStageProcessing)
+	late, unsubscribe4, err := notifier.SubscribeToUploadProgress("example.org", "progress_limit", 0)
+	assert.NoError(t, err)
+	notifier.UploadStageChanged("example.org", "progress_limit", notifier.UploadStageFailed)
+	events := collectProgress(late)
+	assert.Equal(t, []notifier.UploadProgress{
+		{Stage: notifier.UploadStageProcessing},
+		{Stage: notifier.UploadStageFailed},
+	}, events)
+
+	// Unsubscribing after the upload finished is harmless too
+	unsubscribe2()
+	unsubscribe3()
+	unsubscribe4()
+
+	// And uploads nobody is watching aren't tracked
+	notifier.UploadStageChanged("example.org", "progress_untracked", notifier.UploadStageDone)
+}
+
+func TestUploadProgressEventStream(t *testing.T) {
+	closed := make(chan struct{})
+	srv := serveGenerated(func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+		events := make(chan interface{}, 3)
+		events <- notifier.UploadProgress{Stage: notifier.UploadStageReceiving, BytesReceived: 10}
+		events <- notifier.UploadProgress{Stage: notifier.UploadStageProcessing, BytesReceived: 20}
+		events <- notifier.UploadProgress{Stage: notifier.UploadStageDone, BytesReceived: 20}
+		close(events)
+		return &_responses.EventStreamResponse{Events: events, Close: func() {
+			close(closed)
+		}}
+	})
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	events := make([]notifier.UploadProgress, 0)
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var p notifier.UploadProgress
+		assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &p))
+		events = append(events, p)
+	}
+	assert.Equal(t, []notifier.UploadProgress{
+		{Stage: notifier.UploadStageReceiving, BytesReceived: 10},
+		{Stage: notifier.UploadStageProcessing, BytesReceived: 20},
+		{Stage: notifier.UploadStageDone, BytesReceived: 20},
+	}, events)
+	<-closed
+}
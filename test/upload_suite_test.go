@@ -1,6 +1,11 @@
 package test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,11 +14,14 @@ import (
 	"net/url"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/datastore_op"
 	"github.com/t2bot/matrix-media-repo/test/test_internals"
 	"github.com/t2bot/matrix-media-repo/util"
 )
@@ -342,6 +350,385 @@ func (s *UploadTestSuite) TestUploadAsyncExpiredFlow() {
 	assert.Equal(t, http.StatusNotFound, errRes.InjectedStatusCode)
 }
 
+func (s *UploadTestSuite) TestUploadTooLargeWithoutContentLength() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+
+	// Wrapping the reader hides its length from the HTTP client, forcing a chunked upload. The test
+	// config limits uploads to 10mb, so this should be rejected rather than truncated.
+	body := struct{ io.Reader }{io.LimitReader(rand.New(rand.NewSource(1)), 10485760+1024)}
+	errRes, err := client1.DoExpectError("POST", "/_matrix/media/v3/upload", url.Values{"filename": []string{"large.bin"}}, "application/octet-stream", body)
+	assert.NoError(t, err)
+	assert.NotNil(t, errRes)
+	assert.Equal(t, "M_TOO_LARGE", errRes.Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, errRes.InjectedStatusCode)
+}
+
+func (s *UploadTestSuite) TestUploadUndercountingContentLength() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+	client2 := &test_internals.MatrixClient{
+		ClientServerUrl: s.deps.Machines[0].HttpUrl,
+		ServerName:      s.deps.Homeservers[0].ServerName,
+		AccessToken:     "", // no auth for downloads
+		UserId:          "", // no auth for downloads
+	}
+
+	// Only the declared bytes should be read - the remainder is never part of the upload
+	body := make([]byte, 4096)
+	_, _ = rand.New(rand.NewSource(2)).Read(body)
+	raw, err := client1.DoRawWithContentLength("POST", "/_matrix/media/v3/upload", url.Values{"filename": []string{"under.bin"}}, "application/octet-stream", 1024, body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, raw.StatusCode)
+	res := new(test_internals.MatrixUploadResponse)
+	assert.NoError(t, json.NewDecoder(raw.Body).Decode(res))
+
+	origin, mediaId, err := util.SplitMxc(res.MxcUri)
+	assert.NoError(t, err)
+	raw, err = client2.DoRaw("GET", fmt.Sprintf("/_matrix/media/v3/download/%s/%s", origin, mediaId), nil, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, raw.StatusCode)
+	b, err := io.ReadAll(raw.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body[:1024], b)
+}
+
+func (s *UploadTestSuite) TestUploadOvercountingContentLength() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+
+	// The body ends before the declared length, so the upload should fail rather than be stored short
+	body := make([]byte, 1024)
+	_, _ = rand.New(rand.NewSource(3)).Read(body)
+	raw, err := client1.DoRawWithContentLength("POST", "/_matrix/media/v3/upload", url.Values{"filename": []string{"over.bin"}}, "application/octet-stream", 4096, body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, raw.StatusCode)
+
+	// A declared size over the limit is rejected before any of the body is read
+	raw, err = client1.DoRawWithContentLength("POST", "/_matrix/media/v3/upload", url.Values{"filename": []string{"over.bin"}}, "application/octet-stream", 10485760+1, body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, raw.StatusCode)
+}
+
+func (s *UploadTestSuite) TestUploadTooSmallWithoutContentLength() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+
+	// The default minimum is 100 bytes, and a chunked upload can't be checked before it is read
+	body := struct{ io.Reader }{bytes.NewReader(make([]byte, 10))}
+	errRes, err := client1.DoExpectError("POST", "/_matrix/media/v3/upload", url.Values{"filename": []string{"small.bin"}}, "application/octet-stream", body)
+	assert.NoError(t, err)
+	assert.NotNil(t, errRes)
+	assert.Equal(t, http.StatusBadRequest, errRes.InjectedStatusCode)
+}
+
+func (s *UploadTestSuite) TestUploadReadOnly() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+	admin := &test_internals.MatrixClient{
+		ClientServerUrl: s.deps.Machines[0].HttpUrl, // the read-only override only applies to this machine
+		ServerName:      client1.ServerName,
+		AccessToken:     test_internals.SharedSecret,
+	}
+
+	contentType, img, err := test_internals.MakeTestImage(512, 512)
+	assert.NoError(t, err)
+	res, err := client1.Upload("image"+util.ExtensionForContentType(contentType), contentType, img)
+	assert.NoError(t, err)
+	origin, mediaId, err := util.SplitMxc(res.MxcUri)
+	assert.NoError(t, err)
+
+	setReadOnly := func(readOnly string) {
+		raw, err := admin.DoRaw("PUT", "/_matrix/media/unstable/admin/read_only", nil, "application/json", bytes.NewBufferString(`{"read_only":`+readOnly+`}`))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, raw.StatusCode)
+	}
+	setReadOnly("true")
+	defer setReadOnly("null")
+
+	contentType, img, err = test_internals.MakeTestImage(512, 512)
+	assert.NoError(t, err)
+	raw, err := client1.DoRaw("POST", "/_matrix/media/v3/upload", url.Values{"filename": []string{"image" + util.ExtensionForContentType(contentType)}}, contentType, img)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, raw.StatusCode)
+	assert.Equal(t, "300", raw.Header.Get("Retry-After"))
+	errRes := new(test_internals.MatrixErrorResponse)
+	assert.NoError(t, json.NewDecoder(raw.Body).Decode(errRes))
+	assert.Equal(t, "M_UNAVAILABLE", errRes.Code)
+
+	errRes, err = client1.DoExpectError("POST", "/_matrix/media/v1/create", nil, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "M_UNAVAILABLE", errRes.Code)
+	assert.Equal(t, http.StatusServiceUnavailable, errRes.InjectedStatusCode)
+
+	// Downloads still work
+	raw, err = client1.DoRaw("GET", fmt.Sprintf("/_matrix/media/v3/download/%s/%s", origin, mediaId), nil, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, raw.StatusCode)
+	test_internals.AssertIsTestImage(t, raw.Body)
+}
+
+func (s *UploadTestSuite) TestUploadConcurrentLimit() {
+	t := s.T()
+
+	// Concurrent uploads are counted per process, so only talk to one machine
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+	const perUser = 10 // from the default config
+	body := make([]byte, 128)
+
+	// Start enough uploads to fill the user's slots, but don't finish them
+	writers := make([]*io.PipeWriter, 0)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < perUser; i++ {
+		pr, pw := io.Pipe()
+		writers = append(writers, pw)
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			raw, err := client1.DoRaw("POST", "/_matrix/media/v3/upload", nil, "application/octet-stream", r)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, raw.StatusCode)
+		}(pr)
+		_, err := pw.Write(body)
+		assert.NoError(t, err)
+	}
+
+	// The pending uploads might not have reached the media repo yet, so try a few times
+	var raw *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		raw, err = client1.DoRaw("POST", "/_matrix/media/v3/upload", nil, "application/octet-stream", bytes.NewReader(body))
+		assert.NoError(t, err)
+		if raw.StatusCode != http.StatusOK {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, raw.StatusCode)
+	errRes := new(test_internals.MatrixErrorResponse)
+	assert.NoError(t, json.NewDecoder(raw.Body).Decode(errRes))
+	assert.Equal(t, "M_LIMIT_EXCEEDED", errRes.Code)
+
+	// Finishing the uploads frees the slots
+	for _, pw := range writers {
+		assert.NoError(t, pw.Close())
+	}
+	wg.Wait()
+	res, err := client1.Upload("concurrent.bin", "application/octet-stream", bytes.NewReader(body))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, res.MxcUri)
+}
+
+func (s *UploadTestSuite) TestUploadQuarantinedDuplicate() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+	admin := &test_internals.MatrixClient{
+		ClientServerUrl: s.deps.Machines[0].HttpUrl,
+		ServerName:      client1.ServerName,
+		AccessToken:     test_internals.SharedSecret,
+	}
+
+	// Random content, so quarantining it doesn't affect the other tests
+	body := make([]byte, 1024)
+	_, err := rand.Read(body)
+	assert.NoError(t, err)
+
+	res, err := client1.Upload("malicious.bin", "application/octet-stream", bytes.NewReader(body))
+	assert.NoError(t, err)
+	origin, mediaId, err := util.SplitMxc(res.MxcUri)
+	assert.NoError(t, err)
+
+	raw, err := admin.DoRaw("POST", fmt.Sprintf("/_matrix/media/unstable/admin/quarantine/%s/%s", origin, mediaId), nil, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, raw.StatusCode)
+
+	// Uploading the same content again, even under a different name, must not create a servable copy
+	errRes, err := client1.DoExpectError("POST", "/_matrix/media/v3/upload", url.Values{"filename": []string{"innocent.bin"}}, "application/octet-stream", bytes.NewReader(body))
+	assert.NoError(t, err)
+	assert.Equal(t, "M_MEDIA_MALICIOUS", errRes.Code)
+	assert.Equal(t, http.StatusForbidden, errRes.InjectedStatusCode)
+
+	hash := sha256.Sum256(body)
+	records, err := database.GetInstance().Media.Prepare(rcontext.Initial()).GetByHash(hex.EncodeToString(hash[:]))
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+}
+
+func (s *UploadTestSuite) TestGetByHashes() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+
+	// Two distinct files, the first of which is uploaded twice under different names
+	bodies := make([][]byte, 2)
+	hashes := make([]string, 2)
+	for i := range bodies {
+		bodies[i] = make([]byte, 1024)
+		_, err := rand.Read(bodies[i])
+		assert.NoError(t, err)
+		hash := sha256.Sum256(bodies[i])
+		hashes[i] = hex.EncodeToString(hash[:])
+	}
+	mxcs := make(map[string][]string)
+	for i, body := range [][]byte{bodies[0], bodies[0], bodies[1]} {
+		res, err := client1.Upload(fmt.Sprintf("batch%d.bin", i), "application/octet-stream", bytes.NewReader(body))
+		assert.NoError(t, err)
+		hash := hashes[0]
+		if i == 2 {
+			hash = hashes[1]
+		}
+		mxcs[hash] = append(mxcs[hash], res.MxcUri)
+	}
+
+	missing := hex.EncodeToString(make([]byte, sha256.Size))
+	grouped, err := database.GetInstance().Media.Prepare(rcontext.Initial()).GetByHashes(append(hashes, missing))
+	assert.NoError(t, err)
+	assert.Len(t, grouped, 2) // the missing hash has no entry
+	for hash, expected := range mxcs {
+		found := make([]string, 0)
+		for _, r := range grouped[hash] {
+			assert.Equal(t, hash, r.Sha256Hash)
+			found = append(found, util.MxcUri(r.Origin, r.MediaId))
+		}
+		assert.ElementsMatch(t, expected, found)
+	}
+}
+
+func (s *UploadTestSuite) TestDeleteSharedMedia() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+	ctx := rcontext.Initial()
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+
+	upload := func(name string) *database.DbMedia {
+		contentType, img, err := test_internals.MakeTestImage(384, 384)
+		assert.NoError(t, err)
+		res, err := client1.Upload(name+util.ExtensionForContentType(contentType), contentType, img)
+		assert.NoError(t, err)
+		origin, mediaId, err := util.SplitMxc(res.MxcUri)
+		assert.NoError(t, err)
+		record, err := mediaDb.GetById(origin, mediaId)
+		assert.NoError(t, err)
+		assert.NotNil(t, record)
+		return record
+	}
+	deleteMedia := func(record *database.DbMedia) {
+		res, err := client1.DoRaw("DELETE", fmt.Sprintf("/_matrix/media/unstable/download/%s/%s", record.Origin, record.MediaId), nil, "", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		_ = res.Body.Close()
+	}
+	assertDownloadable := func(record *database.DbMedia) {
+		res, err := client1.DoRaw("GET", fmt.Sprintf("/_matrix/media/v3/download/%s/%s", record.Origin, record.MediaId), nil, "", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		test_internals.AssertIsTestImage(t, res.Body)
+		_ = res.Body.Close()
+	}
+	fileExists := func(record *database.DbMedia) bool {
+		ds, ok := datastores.Get(ctx, record.DatastoreId)
+		assert.True(t, ok)
+		_, err := datastores.StoredSize(ctx, ds, record.Location)
+		if errors.Is(err, datastores.ErrNotExist) {
+			return false
+		}
+		assert.NoError(t, err)
+		return true
+	}
+
+	// Different names give different records which share a file
+	record1 := upload("delete_shared_1")
+	record2 := upload("delete_shared_2")
+	assert.NotEqual(t, record1.MediaId, record2.MediaId)
+	assert.Equal(t, record1.Location, record2.Location)
+
+	// Deleting one of them keeps the file for the other
+	deleteMedia(record1)
+	deleted, err := mediaDb.GetById(record1.Origin, record1.MediaId)
+	assert.NoError(t, err)
+	assert.Nil(t, deleted)
+	assert.True(t, fileExists(record2))
+	assertDownloadable(record2)
+
+	// Uploading another copy while the last record is deleted must leave the new copy with a file, whichever
+	// gets there first
+	var record3 *database.DbMedia
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		deleteMedia(record2)
+	}()
+	go func() {
+		defer wg.Done()
+		record3 = upload("delete_shared_3")
+	}()
+	wg.Wait()
+	assert.True(t, fileExists(record3))
+	assertDownloadable(record3)
+
+	// ... and deleting the last record removes the file
+	deleteMedia(record3)
+	remaining, err := mediaDb.GetByLocation(record3.DatastoreId, record3.Location)
+	assert.NoError(t, err)
+	assert.Empty(t, remaining)
+	assert.False(t, fileExists(record3))
+}
+
+func (s *UploadTestSuite) TestRemoteDownloadDeduplicated() {
+	t := s.T()
+
+	client1 := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+	ctx := rcontext.Initial()
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+
+	// Random content, so the test isn't affected by anything else uploaded
+	body := make([]byte, 1024)
+	_, err := rand.Read(body)
+	assert.NoError(t, err)
+	res, err := client1.Upload("local.bin", "application/octet-stream", bytes.NewReader(body))
+	assert.NoError(t, err)
+	origin, mediaId, err := util.SplitMxc(res.MxcUri)
+	assert.NoError(t, err)
+	local, err := mediaDb.GetById(origin, mediaId)
+	assert.NoError(t, err)
+	assert.NotNil(t, local)
+
+	// The same content arriving from another server reuses the local file, and is still served to the requester
+	remoteMediaId := hex.EncodeToString(body[:16])
+	record, stream, err := datastore_op.PutAndReturnStream(ctx, "remote.example.org", remoteMediaId, io.NopCloser(bytes.NewReader(body)), "application/octet-stream", "remote.bin", datastores.RemoteMediaKind)
+	assert.NoError(t, err)
+	if !assert.NotNil(t, record) {
+		return
+	}
+	b, err := io.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Close())
+	assert.Equal(t, body, b)
+
+	assert.Equal(t, "remote.example.org", record.Origin)
+	assert.Equal(t, remoteMediaId, record.MediaId)
+	assert.Equal(t, local.Sha256Hash, record.Sha256Hash)
+	assert.Equal(t, local.DatastoreId, record.DatastoreId)
+	assert.Equal(t, local.Location, record.Location)
+
+	stored, err := mediaDb.GetById("remote.example.org", remoteMediaId)
+	assert.NoError(t, err)
+	if assert.NotNil(t, stored) {
+		assert.Equal(t, local.Location, stored.Location)
+	}
+	remaining, err := mediaDb.GetByLocation(local.DatastoreId, local.Location)
+	assert.NoError(t, err)
+	assert.Len(t, remaining, 2)
+}
+
 func TestUploadTestSuite(t *testing.T) {
 	suite.Run(t, new(UploadTestSuite))
 }
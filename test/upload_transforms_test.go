@@ -0,0 +1,100 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+)
+
+func makeTransformFixture(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for x := 0; x < 400; x++ {
+		for y := 0; y < 200; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	b := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(b, img))
+	return b.Bytes()
+}
+
+func applyTransforms(t *testing.T, stages []config.UploadTransformConfig, b []byte, contentType string, fileName string) *upload.TransformedMedia {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.Uploads.Transforms = stages
+	assert.True(t, upload.ShouldTransform(ctx))
+
+	res, err := upload.ApplyTransforms(ctx, io.NopCloser(bytes.NewReader(b)), contentType, fileName)
+	assert.NoError(t, err)
+	return res
+}
+
+func TestUploadTransformsApplyInOrder(t *testing.T) {
+	fixture := makeTransformFixture(t)
+	transcode := config.UploadTransformConfig{
+		Name:         upload.TransformTranscode,
+		ContentTypes: []string{"image/png"},
+		TargetType:   "image/jpeg",
+		Quality:      80,
+	}
+	downscale := config.UploadTransformConfig{
+		Name:         upload.TransformDownscale,
+		ContentTypes: []string{"image/jpeg"},
+		MaxWidth:     100,
+		MaxHeight:    100,
+	}
+
+	// Transcoding first means the downscale sees a JPEG, so both apply
+	res := applyTransforms(t, []config.UploadTransformConfig{transcode, downscale}, fixture, "image/png", "photo.png")
+	assert.Equal(t, []string{upload.TransformTranscode, upload.TransformDownscale}, res.Applied)
+	assert.Equal(t, "image/jpeg", res.ContentType)
+	assert.Equal(t, "photo.jpg", res.FileName)
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(res.Data))
+	assert.NoError(t, err)
+	assert.Equal(t, "jpeg", format)
+	assert.Equal(t, 100, cfg.Width)
+	assert.Equal(t, 50, cfg.Height)
+
+	// The other way around, the downscale is skipped because it only applies to JPEGs
+	res = applyTransforms(t, []config.UploadTransformConfig{downscale, transcode}, fixture, "image/png", "photo.png")
+	assert.Equal(t, []string{upload.TransformTranscode}, res.Applied)
+	assert.Equal(t, "image/jpeg", res.ContentType)
+	cfg, format, err = image.DecodeConfig(bytes.NewReader(res.Data))
+	assert.NoError(t, err)
+	assert.Equal(t, "jpeg", format)
+	assert.Equal(t, 400, cfg.Width)
+	assert.Equal(t, 200, cfg.Height)
+}
+
+func TestUploadTransformsSkipStages(t *testing.T) {
+	fixture := makeTransformFixture(t)
+
+	res := applyTransforms(t, []config.UploadTransformConfig{
+		{Name: "doesNotExist"},
+		{Name: upload.TransformTranscode, TargetType: "image/gif", ContentTypes: []string{"image/png"}}, // unsupported target
+		{Name: upload.TransformDownscale, MaxWidth: 1000, MaxHeight: 1000},                              // already small enough
+		{Name: upload.TransformTranscode, TargetType: "image/jpeg"},                                     // PNG isn't a default type
+	}, fixture, "image/png", "photo.png")
+	assert.Empty(t, res.Applied)
+	assert.Equal(t, "image/png", res.ContentType)
+	assert.Equal(t, "photo.png", res.FileName)
+	assert.Equal(t, fixture, res.Data)
+
+	// Stages which can't read the media leave it unchanged, and later stages still run
+	notAnImage := []byte("definitely not a png")
+	res = applyTransforms(t, []config.UploadTransformConfig{
+		{Name: upload.TransformDownscale, MaxWidth: 10},
+		{Name: upload.TransformTranscode, TargetType: "image/jpeg", ContentTypes: []string{"image/png"}},
+	}, notAnImage, "image/png", "")
+	assert.Empty(t, res.Applied)
+	assert.Equal(t, notAnImage, res.Data)
+	assert.Equal(t, "image/png", res.ContentType)
+}
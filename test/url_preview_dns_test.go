@@ -0,0 +1,122 @@
+package test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/url_previewing/u"
+)
+
+const dnsTypeA = 1
+
+// startRebindingDnsServer answers the first A query with safeIp, and every query after that with unsafeIp. All
+// other query types get an empty answer.
+func startRebindingDnsServer(t *testing.T, safeIp net.IP, unsafeIp net.IP) (string, *atomic.Int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	queries := &atomic.Int32{}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if res := answerDnsQuery(buf[:n], queries, safeIp, unsafeIp); res != nil {
+				_, _ = conn.WriteTo(res, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), queries
+}
+
+func answerDnsQuery(query []byte, queries *atomic.Int32, safeIp net.IP, unsafeIp net.IP) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	// Find the end of the (only) question
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5 // null label, type, class
+	if end > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end-4 : end-2])
+
+	res := make([]byte, 0, end+16)
+	res = append(res, query[0], query[1]) // id
+	res = append(res, 0x81, 0x80)         // response, recursion desired + available
+	res = append(res, 0, 1)               // questions
+	if qtype == dnsTypeA {
+		res = append(res, 0, 1) // answers
+	} else {
+		res = append(res, 0, 0)
+	}
+	res = append(res, 0, 0, 0, 0) // authority, additional
+	res = append(res, query[12:end]...)
+	if qtype == dnsTypeA {
+		ip := safeIp
+		if queries.Add(1) > 1 {
+			ip = unsafeIp
+		}
+		res = append(res, 0xC0, 12)   // pointer to the question's name
+		res = append(res, 0, 1, 0, 1) // A, IN
+		res = append(res, 0, 0, 0, 0) // TTL
+		res = append(res, 0, 4)
+		res = append(res, ip.To4()...)
+	}
+	return res
+}
+
+func TestPreviewDnsRebinding(t *testing.T) {
+	hits := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	parsed, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	dnsAddr, queries := startRebindingDnsServer(t, net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2))
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	ctx.Config.UrlPreviews.DisallowedNetworks = []string{"127.0.0.2/32"}
+	ctx.Config.UrlPreviews.DnsServers = []string{dnsAddr}
+	target := "http://rebind.example:" + parsed.Port() + "/"
+
+	// The validated address must be the one we connect to. If the host were resolved again when dialing, we'd
+	// be sent to 127.0.0.2, which isn't listening.
+	r, _, _, err := u.DownloadRawContent(makeUrlPayload(t, target), []string{"text/*"}, "en", ctx)
+	assert.NoError(t, err)
+	if r != nil {
+		b, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+		_ = r.Close()
+	}
+	assert.Equal(t, int32(1), queries.Load())
+	assert.Equal(t, int32(1), hits.Load())
+
+	// Now that the name points somewhere unsafe, it is rejected
+	_, _, _, err = u.DownloadRawContent(makeUrlPayload(t, target), []string{"text/*"}, "en", ctx)
+	assert.ErrorIs(t, err, common.ErrHostNotAllowed)
+	assert.Equal(t, int32(1), hits.Load())
+}
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/url_preview"
+)
+
+func TestPreviewRateLimitPerUser(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.UrlPreviews.RateLimit.PerUser = config.UrlPreviewRate{PerMinute: 1, Burst: 2}
+	ctx.Config.UrlPreviews.RateLimit.PerIp = config.UrlPreviewRate{}
+
+	user := "@" + t.Name() + ":example.org"
+	assert.NoError(t, url_preview.CheckRateLimit(ctx, user, "192.0.2.1"))
+	assert.NoError(t, url_preview.CheckRateLimit(ctx, user, "192.0.2.2"))
+
+	// The burst is used up, so the user has to wait for the next one (a minute, at one per minute)
+	err := url_preview.CheckRateLimit(ctx, user, "192.0.2.3")
+	var limited *common.RateLimitedError
+	if assert.True(t, errors.As(err, &limited)) {
+		assert.Greater(t, limited.RetryAfter, 50*time.Second)
+		assert.LessOrEqual(t, limited.RetryAfter, time.Minute)
+	}
+
+	// Other users aren't affected
+	assert.NoError(t, url_preview.CheckRateLimit(ctx, user+"2", "192.0.2.1"))
+
+	// ... and neither is anyone when the limit is disabled
+	ctx.Config.UrlPreviews.RateLimit.PerUser.PerMinute = 0
+	assert.NoError(t, url_preview.CheckRateLimit(ctx, user, "192.0.2.1"))
+}
+
+func TestPreviewRateLimitPerIp(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config = config.NewDefaultDomainConfig()
+	ctx.Config.UrlPreviews.RateLimit.PerUser = config.UrlPreviewRate{PerMinute: 1, Burst: 1}
+	ctx.Config.UrlPreviews.RateLimit.PerIp = config.UrlPreviewRate{PerMinute: 1, Burst: 2}
+
+	ip := "198.51.100.7"
+	assert.NoError(t, url_preview.CheckRateLimit(ctx, "@a_"+t.Name()+":example.org", ip))
+	assert.NoError(t, url_preview.CheckRateLimit(ctx, "@b_"+t.Name()+":example.org", ip))
+	var limited *common.RateLimitedError
+	assert.ErrorAs(t, url_preview.CheckRateLimit(ctx, "@c_"+t.Name()+":example.org", ip), &limited)
+
+	// Being throttled by the IP address doesn't use up the user's limit
+	assert.NoError(t, url_preview.CheckRateLimit(ctx, "@c_"+t.Name()+":example.org", "198.51.100.8"))
+}
+
+func TestPreviewRateLimitResponse(t *testing.T) {
+	srv := serveGenerated(func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+		return _responses.RateLimitedFor(1500 * time.Millisecond)
+	})
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "2", res.Header.Get("Retry-After"))
+
+	body := make(map[string]interface{})
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal(t, common.ErrCodeRateLimitExceeded, body["errcode"])
+	assert.Equal(t, float64(1500), body["retry_after_ms"])
+}
@@ -0,0 +1,983 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/i"
+	"github.com/t2bot/matrix-media-repo/url_previewing/m"
+	"github.com/t2bot/matrix-media-repo/url_previewing/p"
+	"github.com/t2bot/matrix-media-repo/url_previewing/u"
+)
+
+// allowTestServers lets previews reach httptest servers, which listen on random local ports.
+func allowTestServers(c *config.DomainRepoConfig) {
+	c.UrlPreviews.DisallowedNetworks = []string{}
+	c.UrlPreviews.AllowedPorts = []int{}
+}
+
+func makeUrlPayload(t *testing.T, rawUrl string) *m.UrlPayload {
+	parsed, err := url.Parse(rawUrl)
+	assert.NoError(t, err)
+	return &m.UrlPayload{
+		UrlString: rawUrl,
+		ParsedUrl: parsed,
+	}
+}
+
+func TestPreviewRedirectWithoutLocation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	_, _, _, err := u.DownloadRawContent(makeUrlPayload(t, server.URL), []string{"text/*"}, "en", ctx)
+	assert.ErrorIs(t, err, m.ErrRedirectWithoutLocation)
+
+	_, err = u.DownloadImage(makeUrlPayload(t, server.URL), "en", ctx)
+	assert.ErrorIs(t, err, m.ErrRedirectWithoutLocation)
+}
+
+func TestPreviewCrossSchemeRedirect(t *testing.T) {
+	page := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("hello"))
+	})
+	httpsServer := httptest.NewTLSServer(page)
+	defer httpsServer.Close()
+	httpServer := httptest.NewServer(page)
+	defer httpServer.Close()
+	redirectTo := func(target string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, target, http.StatusFound)
+		}))
+	}
+	upgrade := redirectTo(httpsServer.URL) // http -> https
+	defer upgrade.Close()
+	sameScheme := redirectTo(httpServer.URL) // http -> http
+	defer sameScheme.Close()
+	downgrade := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, httpServer.URL, http.StatusFound) // https -> http
+	}))
+	defer downgrade.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	ctx.Config.UrlPreviews.UnsafeCertificates = true // httptest's certificate isn't trusted
+	assert.True(t, ctx.Config.UrlPreviews.AllowCrossSchemeRedirect)
+
+	for _, server := range []*httptest.Server{upgrade, sameScheme, downgrade} {
+		r, _, _, err := u.DownloadRawContent(makeUrlPayload(t, server.URL), []string{"text/*"}, "en", ctx)
+		assert.NoError(t, err, server.URL)
+		if r != nil {
+			b, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(b))
+			_ = r.Close()
+		}
+	}
+
+	ctx.Config.UrlPreviews.AllowCrossSchemeRedirect = false
+	for _, server := range []*httptest.Server{upgrade, downgrade} {
+		_, _, _, err := u.DownloadRawContent(makeUrlPayload(t, server.URL), []string{"text/*"}, "en", ctx)
+		assert.ErrorIs(t, err, m.ErrCrossSchemeRedirect, server.URL)
+		_, err = u.DownloadImage(makeUrlPayload(t, server.URL), "en", ctx)
+		assert.ErrorIs(t, err, m.ErrCrossSchemeRedirect, server.URL)
+	}
+
+	// Redirects within the same scheme are still followed
+	r, _, _, err := u.DownloadRawContent(makeUrlPayload(t, sameScheme.URL), []string{"text/*"}, "en", ctx)
+	assert.NoError(t, err)
+	if r != nil {
+		_ = r.Close()
+	}
+}
+
+func TestPreviewUnexpectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	_, _, _, err := u.DownloadRawContent(makeUrlPayload(t, server.URL), []string{"text/*"}, "en", ctx)
+	assert.Equal(t, m.ErrUnexpectedStatus{StatusCode: http.StatusTeapot}, err)
+}
+
+func TestPreviewImageResized(t *testing.T) {
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	ctx.Config.UrlPreviews.ImageThumbnailSize = config.ThumbnailSize{Width: 400, Height: 400}
+
+	contentType, img, err := test_internals.MakeTestImage(2000, 1000)
+	assert.NoError(t, err)
+	resized := u.ResizeImage(&m.PreviewImage{
+		ContentType: contentType,
+		Data:        io.NopCloser(img),
+	}, ctx)
+	assert.NotNil(t, resized)
+	defer resized.Data.Close()
+
+	decoded, _, err := image.Decode(resized.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, decoded.Bounds().Dx())
+	assert.Equal(t, 200, decoded.Bounds().Dy()) // aspect ratio preserved
+}
+
+func TestPreviewImageNotEnlarged(t *testing.T) {
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	ctx.Config.UrlPreviews.ImageThumbnailSize = config.ThumbnailSize{Width: 400, Height: 400}
+
+	contentType, img, err := test_internals.MakeTestImage(100, 50)
+	assert.NoError(t, err)
+	resized := u.ResizeImage(&m.PreviewImage{
+		ContentType: contentType,
+		Data:        io.NopCloser(img),
+	}, ctx)
+	assert.NotNil(t, resized)
+	defer resized.Data.Close()
+
+	test_internals.AssertIsTestImage(t, resized.Data)
+}
+
+func makeGalleryServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><head>
+<meta property="og:title" content="Gallery" />
+<meta property="og:image" content="/one.png" />
+<meta property="og:image" content="/two.png" />
+<meta property="og:image" content="/one.png" />
+<meta property="og:image" content="/three.png" />
+</head><body></body></html>`))
+	})
+	for _, n := range []string{"/one.png", "/two.png", "/three.png"} {
+		mux.HandleFunc(n, func(w http.ResponseWriter, r *http.Request) {
+			contentType, img, err := test_internals.MakeTestImage(16, 16)
+			assert.NoError(t, err)
+			w.Header().Set("Content-Type", contentType)
+			_, _ = io.Copy(w, img)
+		})
+	}
+	return httptest.NewServer(mux)
+}
+
+func TestPreviewGalleryDisabled(t *testing.T) {
+	server := makeGalleryServer(t)
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	preview, err := p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL), "en", ctx)
+	assert.NoError(t, err)
+	assert.NotNil(t, preview.Image)
+	assert.Empty(t, preview.ExtraImages)
+	_ = preview.Image.Data.Close()
+}
+
+func TestPreviewGallery(t *testing.T) {
+	server := makeGalleryServer(t)
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	ctx.Config.UrlPreviews.Gallery.Enabled = true
+	ctx.Config.UrlPreviews.Gallery.MaxImages = 4
+	preview, err := p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL), "en", ctx)
+	assert.NoError(t, err)
+	assert.NotNil(t, preview.Image)
+	assert.Len(t, preview.ExtraImages, 2) // duplicates are skipped
+	for _, img := range append(preview.ExtraImages, preview.Image) {
+		test_internals.AssertIsTestImage(t, img.Data)
+		_ = img.Data.Close()
+	}
+
+	ctx.Config.UrlPreviews.Gallery.MaxImages = 2
+	preview, err = p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL), "en", ctx)
+	assert.NoError(t, err)
+	assert.NotNil(t, preview.Image)
+	assert.Len(t, preview.ExtraImages, 1)
+}
+
+func makeImageTypesServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><head>
+<meta property="og:title" content="Image types" />
+<meta property="og:image" content="/huge.tiff" />
+<meta property="og:image" content="/fine.png" />
+</head><body></body></html>`))
+	})
+	mux.HandleFunc("/huge.tiff", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/tiff")
+		_, _ = w.Write(make([]byte, 1024))
+	})
+	mux.HandleFunc("/fine.png", func(w http.ResponseWriter, r *http.Request) {
+		contentType, img, err := test_internals.MakeTestImage(16, 16)
+		assert.NoError(t, err)
+		w.Header().Set("Content-Type", contentType)
+		_, _ = io.Copy(w, img)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestPreviewImageTypeNotAllowed(t *testing.T) {
+	server := makeImageTypesServer(t)
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	_, err := u.DownloadImage(makeUrlPayload(t, server.URL+"/huge.tiff"), "en", ctx)
+	assert.ErrorIs(t, err, m.ErrImageTypeNotAllowed)
+
+	img, err := u.DownloadImage(makeUrlPayload(t, server.URL+"/fine.png"), "en", ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, img) {
+		assert.Equal(t, "image/png", img.ContentType)
+		_ = img.Data.Close()
+	}
+
+	// The disallowed image is skipped in favour of the next one
+	preview, err := p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL), "en", ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, preview.Image) {
+		assert.Equal(t, "image/png", preview.Image.ContentType)
+		_ = preview.Image.Data.Close()
+	}
+
+	// Types can be allowed with wildcards
+	ctx.Config.UrlPreviews.AllowedImageTypes = []string{"image/*"}
+	img, err = u.DownloadImage(makeUrlPayload(t, server.URL+"/huge.tiff"), "en", ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, img) {
+		assert.Equal(t, "image/tiff", img.ContentType)
+		_ = img.Data.Close()
+	}
+}
+
+func TestPreviewSvgImages(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><rect width="10" height="10" fill="red"/></svg>`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><head><title>Vector</title><meta property="og:image" content="/logo.svg" /></head></html>`))
+	})
+	mux.HandleFunc("/logo.svg", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_, _ = w.Write([]byte(svg))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// Skipped by default when they can't be rasterized, even if every image type is allowed, without failing the
+	// preview
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	ctx.Config.Thumbnails.DisabledGenerators = []string{"svg"}
+	ctx.Config.UrlPreviews.ImageThumbnailSize = config.ThumbnailSize{Width: 5, Height: 5}
+	assert.False(t, u.CanRasterizeSvg(ctx))
+	ctx.Config.UrlPreviews.AllowedImageTypes = []string{"image/*"}
+	ctx.Config.UrlPreviews.FilePreviewTypes = []string{"image/*"}
+	assert.Equal(t, u.SvgImagesSkip, ctx.Config.UrlPreviews.SvgImages)
+	preview, err := p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "Vector", preview.Title)
+	assert.Nil(t, preview.Image)
+	assert.Empty(t, preview.Warnings)
+	preview, err = p.GenerateCalculatedPreview(makeUrlPayload(t, server.URL+"/logo.svg"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/svg+xml", preview.FileType)
+	assert.Nil(t, preview.Image)
+
+	// Stored as-is when allowed
+	ctx.Config.UrlPreviews.SvgImages = u.SvgImagesStore
+	ctx.Config.UrlPreviews.AllowedImageTypes = []string{"image/png"}
+	preview, err = p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL), "en", ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, preview.Warnings)
+	if assert.NotNil(t, preview.Image) {
+		assert.Equal(t, "image/svg+xml", preview.Image.ContentType)
+		resized := u.ResizeImage(preview.Image, ctx)
+		if assert.NotNil(t, resized) {
+			b, err := io.ReadAll(resized.Data)
+			assert.NoError(t, err)
+			assert.Equal(t, svg, string(b))
+			assert.Equal(t, "image/svg+xml", resized.ContentType)
+			_ = resized.Data.Close()
+		}
+	}
+	preview, err = p.GenerateCalculatedPreview(makeUrlPayload(t, server.URL+"/logo.svg"), "en", ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, preview.Image) {
+		assert.Equal(t, "image/svg+xml", preview.Image.ContentType)
+		_ = preview.Image.Data.Close()
+	}
+}
+
+func TestPreviewSvgImagesRasterized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_, _ = w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><rect width="10" height="10" fill="red"/></svg>`))
+	}))
+	defer server.Close()
+
+	// Stand in for ImageMagick with a `convert` which always outputs the same PNG
+	dir := t.TempDir()
+	b := &bytes.Buffer{}
+	assert.NoError(t, png.Encode(b, image.NewNRGBA(image.Rect(0, 0, 10, 10))))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "fixture.png"), b.Bytes(), 0600))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "convert"), []byte("#!/bin/sh\ncp \""+path.Join(dir, "fixture.png")+"\" \"$2\"\n"), 0700))
+	t.Cleanup(func() {
+		i.CheckCodecs()
+	})
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	i.CheckCodecs()
+
+	// SVGs are rasterized when the SVG thumbnailer is available, whatever svgImages says
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	allowSvgThumbnails(&ctx.Config)
+	ctx.Config.UrlPreviews.AllowedImageTypes = []string{"image/svg+xml"}
+	ctx.Config.UrlPreviews.FilePreviewTypes = []string{"image/*"}
+	ctx.Config.UrlPreviews.ImageThumbnailSize = config.ThumbnailSize{Width: 5, Height: 5}
+	assert.Equal(t, u.SvgImagesSkip, ctx.Config.UrlPreviews.SvgImages)
+	assert.True(t, u.CanRasterizeSvg(ctx))
+	preview, err := p.GenerateCalculatedPreview(makeUrlPayload(t, server.URL+"/logo.svg"), "en", ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, preview.Image) {
+		resized := u.ResizeImage(preview.Image, ctx)
+		if assert.NotNil(t, resized) {
+			assert.Equal(t, "image/png", resized.ContentType)
+			_ = resized.Data.Close()
+		}
+	}
+}
+
+func makeFileServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/photo.png", func(w http.ResponseWriter, r *http.Request) {
+		contentType, img, err := test_internals.MakeTestImage(16, 16)
+		assert.NoError(t, err)
+		b, err := io.ReadAll(img)
+		assert.NoError(t, err)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		_, _ = w.Write(b)
+	})
+	mux.HandleFunc("/files/report.pdf", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Length", "13")
+		_, _ = w.Write([]byte("%PDF-1.4 test"))
+	})
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf; qs=0.001")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"Quarterly Report.pdf\"")
+		_, _ = w.Write([]byte("%PDF-1.4 test"))
+	})
+	mux.HandleFunc("/releases/v1.2.zip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Length", "22")
+		_, _ = w.Write([]byte("PK\x05\x06" + strings.Repeat("\x00", 18))) // empty archive
+	})
+	mux.HandleFunc("/untyped.zip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil // don't let the server sniff one
+		_, _ = w.Write([]byte("PK\x05\x06" + strings.Repeat("\x00", 18)))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestPreviewDirectImage(t *testing.T) {
+	server := makeFileServer(t)
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	preview, err := p.GenerateCalculatedPreview(makeUrlPayload(t, server.URL+"/photo.png"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "photo.png", preview.Title)
+	assert.Equal(t, "image/png", preview.FileType)
+	assert.Greater(t, preview.FileSize, int64(0))
+	assert.NotNil(t, preview.Image)
+	assert.Equal(t, "image/png", preview.Image.ContentType)
+	assert.Equal(t, "photo.png", preview.Image.Filename)
+	test_internals.AssertIsTestImage(t, preview.Image.Data)
+	_ = preview.Image.Data.Close()
+}
+
+func TestPreviewDirectPdf(t *testing.T) {
+	server := makeFileServer(t)
+	defer server.Close()
+
+	// Not enabled by default
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	_, err := p.GenerateCalculatedPreview(makeUrlPayload(t, server.URL+"/files/report.pdf"), "en", ctx)
+	assert.ErrorIs(t, err, m.ErrPreviewUnsupported)
+
+	ctx.Config.UrlPreviews.FilePreviewTypes = []string{"image/*", "application/pdf"}
+	preview, err := p.GenerateCalculatedPreview(makeUrlPayload(t, server.URL+"/files/report.pdf"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "report.pdf", preview.Title)
+	assert.Equal(t, "application/pdf", preview.FileType)
+	assert.Equal(t, int64(13), preview.FileSize)
+	assert.Nil(t, preview.Image)
+
+	// The filename from Content-Disposition is preferred, and an unknown size is left out
+	preview, err = p.GenerateCalculatedPreview(makeUrlPayload(t, server.URL+"/download"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "Quarterly Report.pdf", preview.Title)
+	assert.Equal(t, "application/pdf", preview.FileType)
+	assert.Nil(t, preview.Image)
+}
+
+func TestPreviewUnsupportedFileLink(t *testing.T) {
+	server := makeFileServer(t)
+	defer server.Close()
+
+	// Not enabled by default
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	_, err := p.GenerateCalculatedPreview(makeUrlPayload(t, server.URL+"/releases/v1.2.zip"), "en", ctx)
+	assert.ErrorIs(t, err, m.ErrPreviewUnsupported)
+
+	ctx.Config.UrlPreviews.UnsupportedFileLinks = true
+	preview, err := p.GenerateCalculatedPreview(makeUrlPayload(t, server.URL+"/releases/v1.2.zip"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.zip", preview.Title)
+	assert.Equal(t, "application/zip", preview.FileType)
+	assert.Equal(t, int64(22), preview.FileSize)
+	assert.Nil(t, preview.Image)
+
+	// Files without a content type still aren't previewed
+	_, err = p.GenerateCalculatedPreview(makeUrlPayload(t, server.URL+"/untyped.zip"), "en", ctx)
+	assert.ErrorIs(t, err, m.ErrPreviewUnsupported)
+
+	// ... and images only get a preview image if they're a file preview type
+	ctx.Config.UrlPreviews.FilePreviewTypes = []string{"application/pdf"}
+	preview, err = p.GenerateCalculatedPreview(makeUrlPayload(t, server.URL+"/photo.png"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "photo.png", preview.Title)
+	assert.Equal(t, "image/png", preview.FileType)
+	assert.Nil(t, preview.Image)
+}
+
+func TestPreviewAllowedPorts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	parsed, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+	port, err := strconv.Atoi(parsed.Port())
+	assert.NoError(t, err)
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	ctx.Config.UrlPreviews.AllowedPorts = []int{80, 443, port}
+	r, _, _, err := u.DownloadRawContent(makeUrlPayload(t, server.URL), []string{"text/*"}, "en", ctx)
+	assert.NoError(t, err)
+	_ = r.Close()
+
+	// The default only allows the standard ports
+	ctx.Config.UrlPreviews.AllowedPorts = config.NewDefaultDomainConfig().UrlPreviews.AllowedPorts
+	_, _, _, err = u.DownloadRawContent(makeUrlPayload(t, server.URL), []string{"text/*"}, "en", ctx)
+	assert.ErrorIs(t, err, common.ErrPortNotAllowed)
+}
+
+func TestPreviewBlockedPorts(t *testing.T) {
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	ctx.Config.UrlPreviews.AllowedPorts = []int{80, 443}
+	for _, target := range []string{"http://127.0.0.1:22/", "http://127.0.0.1:25/", "https://127.0.0.1:8443/"} {
+		_, _, _, err := u.DownloadRawContent(makeUrlPayload(t, target), []string{"text/*"}, "en", ctx)
+		assert.ErrorIs(t, err, common.ErrPortNotAllowed, target)
+	}
+}
+
+func TestPreviewLongTitle(t *testing.T) {
+	title := strings.Repeat("word ", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><head><meta property="og:title" content="` + title + `" /></head><body></body></html>`))
+	}))
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	ctx.Config.UrlPreviews.NumTitleWords = 1000
+	ctx.Config.UrlPreviews.MaxTitleLength = 20
+	preview, err := p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "word word word...", preview.Title)
+}
+
+func TestPreviewSummarize(t *testing.T) {
+	// Short enough already
+	assert.Equal(t, "hello world", u.Summarize("  hello \n  world ", 10, 20))
+
+	// Cut at a word boundary, leaving room for the ellipsis
+	assert.Equal(t, "one two...", u.Summarize("one two three four", 10, 12))
+	assert.Equal(t, "one two", u.Summarize("one two three four", 2, 100))
+
+	// A single long word is cut at a character boundary: each "€" is 3 bytes
+	summary := u.Summarize(strings.Repeat("€", 50), 10, 10)
+	assert.True(t, utf8.ValidString(summary))
+	assert.Equal(t, strings.Repeat("€", 7)+"...", summary)
+	assert.Equal(t, 10, utf8.RuneCountInString(summary))
+
+	summary = u.Summarize("日本語のタイトル "+strings.Repeat("長", 30), 10, 12)
+	assert.Equal(t, "日本語のタイトル...", summary)
+}
+
+func TestPreviewNormalizeText(t *testing.T) {
+	assert.Equal(t, "Tom &amp; Jerry: <Mouse> – 100% 😀", u.NormalizeText("\n\t Tom &amp; Jerry:\u00a0\r\n\r\n<Mouse> –\t100%\x00 😀 \u00a0"))
+	assert.Equal(t, "ab c", u.NormalizeText("a\x07b\tc\x1b"))
+	assert.Equal(t, "", u.NormalizeText(" \n\u00a0\t "))
+
+	// Text which didn't come from an HTML parser has its entities decoded
+	assert.Equal(t, "Tom & Jerry: \"Cat\" <Mouse> – 100% 😀", u.NormalizeEncodedText("\n\t Tom &amp; Jerry:\u00a0&quot;Cat&quot;\r\n\r\n&lt;Mouse&gt; &ndash;\t100%\x00 &#x1F600; \u00a0"))
+
+	// ... but only once
+	assert.Equal(t, "Fish &amp; Chips", u.NormalizeEncodedText("Fish &amp;amp; Chips"))
+
+	// Text which only looks like an entity is left alone
+	assert.Equal(t, "AT&T & co; R&D", u.NormalizeEncodedText("AT&T & co; R&D"))
+
+	// Control characters are removed, even when they come from an entity
+	assert.Equal(t, "ab c", u.NormalizeEncodedText("a\x07b&#9;c\x1b"))
+}
+
+func TestPreviewNormalizedTitle(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("<html><head><title>\n\t\tFish &amp;amp;&nbsp;Chips\n\n\t| The&nbsp;&nbsp;Shop\n</title>" +
+			"<meta property=\"og:description\" content=\"Line one&#10;&#10;line\ttwo &amp;lt;3\" /></head><body></body></html>"))
+	}))
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	preview, err := p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL), "en", ctx)
+	assert.NoError(t, err)
+	// The parser decodes entities once, and the text which was encoded twice stays encoded once
+	assert.Equal(t, "Fish &amp; Chips | The Shop", preview.Title)
+	assert.Equal(t, "Line one line two &lt;3", preview.Description)
+
+	// Only runs of whitespace are collapsed when normalization is disabled
+	ctx.Config.UrlPreviews.NormalizeText = false
+	preview, err = p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "Fish &amp;\u00a0Chips | The Shop", preview.Title)
+	assert.Equal(t, "Line one line\ttwo &lt;3", preview.Description)
+}
+
+func TestPreviewCredentials(t *testing.T) {
+	otherAuth := "unset"
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherAuth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><head><title>Other</title></head></html>"))
+	}))
+	defer other.Close()
+	protected := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "previews" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, other.URL+"/page", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><head><title>Protected</title></head></html>"))
+	}))
+	defer protected.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+
+	// Without credentials, the page can't be previewed
+	_, err := u.DownloadHtmlContent(makeUrlPayload(t, protected.URL), []string{"text/*"}, "en", ctx)
+	assert.Error(t, err)
+
+	// Credentials must match the scheme and port too
+	protectedHost := strings.TrimPrefix(protected.URL, "http://")
+	protectedHostname, _, _ := strings.Cut(protectedHost, ":")
+	ctx.Config.UrlPreviews.Credentials = []config.UrlPreviewCredentials{
+		{Host: protectedHost, Username: "previews", Password: "secret"},
+		{Scheme: "http", Host: protectedHostname, Username: "previews", Password: "secret"},
+	}
+	_, err = u.DownloadHtmlContent(makeUrlPayload(t, protected.URL), []string{"text/*"}, "en", ctx)
+	assert.Error(t, err)
+
+	// With them, it can
+	ctx.Config.UrlPreviews.Credentials = []config.UrlPreviewCredentials{
+		{Scheme: "http", Host: protectedHost, Username: "previews", Password: "secret"},
+	}
+	html, err := u.DownloadHtmlContent(makeUrlPayload(t, protected.URL), []string{"text/*"}, "en", ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, html, "Protected")
+
+	// The credentials aren't sent to other hosts, including on redirect (the servers differ only by port)
+	html, err = u.DownloadHtmlContent(makeUrlPayload(t, protected.URL+"/redirect"), []string{"text/*"}, "en", ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, html, "Other")
+	assert.Equal(t, "", otherAuth)
+
+	otherAuth = "unset"
+	_, err = u.DownloadHtmlContent(makeUrlPayload(t, other.URL), []string{"text/*"}, "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "", otherAuth)
+
+	// Bearer tokens are sent to their host too
+	ctx.Config.UrlPreviews.Credentials = append(ctx.Config.UrlPreviews.Credentials, config.UrlPreviewCredentials{
+		Scheme:      "http",
+		Host:        strings.TrimPrefix(other.URL, "http://"),
+		BearerToken: "token",
+	})
+	_, err = u.DownloadHtmlContent(makeUrlPayload(t, other.URL), []string{"text/*"}, "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer token", otherAuth)
+}
+
+func TestPreviewOriginRateLimited(t *testing.T) {
+	requests := 0
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, limited.URL, http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><head><title>Page</title></head></html>"))
+	}))
+	defer page.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+
+	// The 429 is reported as rate limiting rather than the page not existing
+	_, err := p.GenerateOpenGraphPreview(makeUrlPayload(t, limited.URL), "en", ctx)
+	assert.ErrorIs(t, err, m.ErrOriginRateLimited)
+	assert.Equal(t, 1, requests)
+
+	// While cooling down, the host isn't contacted at all, including through redirects
+	_, err = u.DownloadHtmlContent(makeUrlPayload(t, limited.URL+"/other"), []string{"text/*"}, "en", ctx)
+	assert.ErrorIs(t, err, m.ErrOriginRateLimited)
+	_, err = u.DownloadHtmlContent(makeUrlPayload(t, page.URL+"/redirect"), []string{"text/*"}, "en", ctx)
+	assert.ErrorIs(t, err, m.ErrOriginRateLimited)
+	assert.Equal(t, 1, requests)
+
+	// Other hosts are unaffected
+	html, err := u.DownloadHtmlContent(makeUrlPayload(t, page.URL), []string{"text/*"}, "en", ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, html, "Page")
+}
+
+func TestPreviewOriginRateLimitedDisabled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	ctx.Config.UrlPreviews.RateLimitedOrigins.Enabled = false
+	for i := 0; i < 2; i++ {
+		_, _, _, err := u.DownloadRawContent(makeUrlPayload(t, server.URL), []string{"text/*"}, "en", ctx)
+		assert.Equal(t, m.ErrUnexpectedStatus{StatusCode: http.StatusTooManyRequests}, err)
+	}
+}
+
+func TestPreviewOriginRateLimitedWithoutRetryAfter(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "not a time")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	ctx.Config.UrlPreviews.RateLimitedOrigins.DefaultSeconds = 0 // so the cooldown is over immediately
+	_, err := u.DownloadHtmlContent(makeUrlPayload(t, server.URL), []string{"text/*"}, "en", ctx)
+	assert.ErrorIs(t, err, m.ErrOriginRateLimited)
+
+	html, err := u.DownloadHtmlContent(makeUrlPayload(t, server.URL), []string{"text/*"}, "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", html)
+	assert.Equal(t, 2, requests)
+}
+
+func TestPreviewPartialWithWarnings(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(`<html><head><title>Broken image</title><meta property="og:image" content="/missing.png" /></head></html>`))
+	})
+	mux.HandleFunc("/guessed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><head><title>No charset: caf\xe9 cr\xe8me br\xfbl\xe9e</title></head></html>")) // not UTF-8
+	})
+	mux.HandleFunc("/fine", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(`<html><head><title>Fine</title></head></html>`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+
+	// The image failing doesn't fail the whole preview
+	preview, err := p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL+"/broken"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "Broken image", preview.Title)
+	assert.Nil(t, preview.Image)
+	assert.Equal(t, []string{m.WarningImageFailed}, preview.Warnings)
+
+	preview, err = p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL+"/guessed"), "en", ctx)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(preview.Title, "No charset: "))
+	assert.Equal(t, []string{m.WarningCharsetGuessed}, preview.Warnings)
+
+	preview, err = p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL+"/fine"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "Fine", preview.Title)
+	assert.Empty(t, preview.Warnings)
+}
+
+func TestPreviewAddWarning(t *testing.T) {
+	var warnings []string
+	warnings = m.AddWarning(warnings, m.WarningImageFailed)
+	warnings = m.AddWarning(warnings, m.WarningOEmbedFailed)
+	warnings = m.AddWarning(warnings, m.WarningImageFailed)
+	assert.Equal(t, []string{m.WarningImageFailed, m.WarningOEmbedFailed}, warnings)
+}
+
+func TestPreviewImageWarning(t *testing.T) {
+	assert.Equal(t, m.WarningImageTooLarge, m.ImageWarning(common.ErrMediaTooLarge))
+	assert.Equal(t, m.WarningImageFailed, m.ImageWarning(m.ErrUnexpectedStatus{StatusCode: http.StatusNotFound}))
+}
+
+func TestPreviewExtraHeaders(t *testing.T) {
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><head><title>Headers</title></head></html>"))
+	}))
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	ctx.Config.UrlPreviews.UserAgent = "test-agent"
+	ctx.Config.UrlPreviews.Referer = "https://example.org/"
+	ctx.Config.UrlPreviews.ExtraHeaders = map[string]string{
+		"Sec-CH-UA": "test",
+		"x-custom":  "value",
+		// Headers set by the media repo can't be replaced
+		"User-Agent":    "other-agent",
+		"cookie":        "session=abc",
+		"Authorization": "Bearer token",
+	}
+
+	_, err := u.DownloadHtmlContent(makeUrlPayload(t, server.URL), []string{"text/*"}, "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", headers.Get("Sec-CH-UA"))
+	assert.Equal(t, "value", headers.Get("X-Custom"))
+	assert.Equal(t, "https://example.org/", headers.Get("Referer"))
+	assert.Equal(t, "test-agent", headers.Get("User-Agent"))
+	assert.Equal(t, "en", headers.Get("Accept-Language"))
+	assert.Empty(t, headers.Values("Cookie"))
+	assert.Empty(t, headers.Values("Authorization"))
+
+	// Without a referer configured, none is sent
+	ctx.Config.UrlPreviews.Referer = ""
+	_, err = u.DownloadHtmlContent(makeUrlPayload(t, server.URL), []string{"text/*"}, "en", ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, headers.Values("Referer"))
+}
+
+func TestPreviewTruncatedPage(t *testing.T) {
+	page := `<html><head><title>Cut off</title></head><body>` + strings.Repeat("<p>filler</p>", 1000) + `</body></html>`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before the end means there's no Content-Length, so the page isn't rejected for its size
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(page[:100]))
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte(page[100:]))
+	})
+	mux.HandleFunc("/dropped", func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\n\r\n%s", len(page), page[:200])
+		_ = buf.Flush()
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	ctx.Config.UrlPreviews.MaxPageSizeBytes = 200
+
+	// Reaching the size limit is expected, so the start of the page is previewed
+	html, err := u.DownloadHtmlContent(makeUrlPayload(t, server.URL+"/large"), []string{"text/*"}, "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, page[:200], html)
+	preview, err := p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL+"/large"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "Cut off", preview.Title)
+	assert.Empty(t, preview.Warnings)
+
+	// ... but the connection dropping isn't
+	ctx.Config.UrlPreviews.MaxPageSizeBytes = 0
+	_, err = u.DownloadHtmlContent(makeUrlPayload(t, server.URL+"/dropped"), []string{"text/*"}, "en", ctx)
+	assert.ErrorIs(t, err, m.ErrTransferFailed)
+	_, err = p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL+"/dropped"), "en", ctx)
+	assert.ErrorIs(t, err, m.ErrTransferFailed)
+
+	// ... unless partial pages are allowed
+	ctx.Config.UrlPreviews.AllowPartialPages = true
+	preview, err = p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL+"/dropped"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "Cut off", preview.Title)
+	assert.Equal(t, []string{m.WarningPagePartial}, preview.Warnings)
+}
+
+func TestPreviewSniffedContentType(t *testing.T) {
+	_, img, err := test_internals.MakeTestImage(16, 16)
+	assert.NoError(t, err)
+	imgBytes, err := io.ReadAll(img)
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil // don't let the server sniff one
+		_, _ = w.Write([]byte(`<!DOCTYPE html><html><head><meta property="og:title" content="Untyped" /><meta property="og:image" content="/image" /></head><body></body></html>`))
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil
+		_, _ = w.Write(imgBytes)
+	})
+	mux.HandleFunc("/octet-stream.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(imgBytes)
+	})
+	mux.HandleFunc("/image.bmp", func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil
+		_, _ = w.Write([]byte("BM" + strings.Repeat("\x00", 100))) // sniffed as image/bmp, which isn't allowed
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	preview, err := p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL+"/page"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "Untyped", preview.Title)
+	if assert.NotNil(t, preview.Image) {
+		assert.Equal(t, "image/png", preview.Image.ContentType)
+		_ = preview.Image.Data.Close()
+	}
+
+	// The sniffed bytes are still served
+	preview, err = p.GenerateCalculatedPreview(makeUrlPayload(t, server.URL+"/octet-stream.png"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", preview.FileType)
+	if assert.NotNil(t, preview.Image) {
+		b, err := io.ReadAll(preview.Image.Data)
+		assert.NoError(t, err)
+		assert.Equal(t, imgBytes, b)
+		_ = preview.Image.Data.Close()
+	}
+
+	// Sniffed types still have to be allowed
+	_, err = u.DownloadImage(makeUrlPayload(t, server.URL+"/image.bmp"), "en", ctx)
+	assert.ErrorIs(t, err, m.ErrImageTypeNotAllowed)
+
+	ctx.Config.UrlPreviews.SniffContentType = false
+	_, err = p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL+"/page"), "en", ctx)
+	assert.ErrorIs(t, err, m.ErrPreviewUnsupported)
+	_, err = u.DownloadImage(makeUrlPayload(t, server.URL+"/image"), "en", ctx)
+	assert.ErrorIs(t, err, m.ErrImageTypeNotAllowed)
+}
+
+func TestPreviewPreferAmp(t *testing.T) {
+	ampRequests := &atomic.Int32{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/article", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><head><title>Loading...</title><link rel="amphtml" href="/amp/article" /></head><body><script>render()</script></body></html>`))
+	})
+	mux.HandleFunc("/complete", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><head>
+<meta property="og:title" content="Complete" />
+<meta property="og:description" content="Nothing is missing" />
+<meta property="og:image" content="/amp/image.png" />
+<link rel="amphtml" href="/amp/article" />
+</head><body></body></html>`))
+	})
+	mux.HandleFunc("/amp/article", func(w http.ResponseWriter, r *http.Request) {
+		ampRequests.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html amp><head>
+<meta property="og:title" content="The Real Title" />
+<meta property="og:description" content="Rendered on the server" />
+<meta property="og:image" content="image.png" />
+</head><body></body></html>`))
+	})
+	mux.HandleFunc("/amp/image.png", func(w http.ResponseWriter, r *http.Request) {
+		contentType, img, err := test_internals.MakeTestImage(16, 16)
+		assert.NoError(t, err)
+		w.Header().Set("Content-Type", contentType)
+		_, _ = io.Copy(w, img)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// Not enabled by default
+	ctx := test_internals.MakeTestContext(allowTestServers)
+	preview, err := p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL+"/article"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "Loading...", preview.Title)
+	assert.Nil(t, preview.Image)
+	assert.Equal(t, int32(0), ampRequests.Load())
+
+	// The AMP page's metadata is preferred over guessing, and its images are relative to the AMP page
+	ctx.Config.UrlPreviews.PreferAmp = true
+	preview, err = p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL+"/article"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "The Real Title", preview.Title)
+	assert.Equal(t, "Rendered on the server", preview.Description)
+	if assert.NotNil(t, preview.Image) {
+		test_internals.AssertIsTestImage(t, preview.Image.Data)
+		_ = preview.Image.Data.Close()
+	}
+	assert.Equal(t, int32(1), ampRequests.Load())
+
+	// Pages which have everything already don't need it
+	preview, err = p.GenerateOpenGraphPreview(makeUrlPayload(t, server.URL+"/complete"), "en", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "Complete", preview.Title)
+	assert.Equal(t, int32(1), ampRequests.Load())
+	if preview.Image != nil {
+		_ = preview.Image.Data.Close()
+	}
+}
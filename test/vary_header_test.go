@@ -0,0 +1,71 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+func TestVaryHeaderOnlyWhenNegotiated(t *testing.T) {
+	type payload struct {
+		Value string `json:"value"`
+	}
+	cases := []struct {
+		name string
+		res  interface{}
+		vary []string
+	}{
+		{
+			name: "plain",
+			res:  &payload{Value: "plain"},
+			vary: nil,
+		},
+		{
+			name: "not cached",
+			res:  &_responses.DoNotCacheResponse{Payload: &payload{Value: "plain"}},
+			vary: nil,
+		},
+		{
+			name: "negotiated",
+			res:  &_responses.NegotiatedResponse{Vary: []string{"Accept-Language"}, Payload: &payload{Value: "en"}},
+			vary: []string{"Accept-Language"},
+		},
+		{
+			name: "negotiated error",
+			res:  &_responses.NegotiatedResponse{Vary: []string{"Accept"}, Payload: _responses.NotFoundError()},
+			vary: []string{"Accept"},
+		},
+		{
+			name: "negotiated and not cached",
+			res: &_responses.DoNotCacheResponse{Payload: &_responses.NegotiatedResponse{
+				Vary:    []string{"Accept", "Accept-Language"},
+				Payload: &payload{Value: "en"},
+			}},
+			vary: []string{"Accept, Accept-Language"},
+		},
+		{
+			name: "negotiated download",
+			res: &_responses.NegotiatedResponse{Vary: []string{"Accept"}, Payload: &_responses.DownloadResponse{
+				ContentType: "text/plain",
+				SizeBytes:   -1,
+				Data:        http.NoBody,
+			}},
+			vary: []string{"Accept"},
+		},
+	}
+	for _, c := range cases {
+		srv := serveGenerated(func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+			return c.res
+		})
+		res, err := http.Get(srv.URL)
+		srv.Close()
+		if !assert.NoError(t, err, c.name) {
+			continue
+		}
+		_ = res.Body.Close()
+		assert.Equal(t, c.vary, res.Header.Values("Vary"), c.name)
+	}
+}
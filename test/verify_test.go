@@ -0,0 +1,74 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+func makeVerifyDatastore(t *testing.T, contents []byte) (config.DatastoreConfig, string, string) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(path.Join(dir, "media"), contents, 0644))
+	hash := sha256.Sum256(contents)
+	ds := config.DatastoreConfig{Id: "verify", Type: "file", Options: map[string]string{"path": dir}}
+	return ds, path.Join(dir, "media"), hex.EncodeToString(hash[:])
+}
+
+func TestVerifyIntact(t *testing.T) {
+	ds, _, hash := makeVerifyDatastore(t, bytes.Repeat([]byte("intact"), 500000))
+	ok, err := datastores.Verify(rcontext.InitialNoConfig(), ds, "media", hash, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestVerifyCorrupted(t *testing.T) {
+	ds, fpath, hash := makeVerifyDatastore(t, bytes.Repeat([]byte("corrupt"), 500000))
+
+	// Flip a single bit in the middle of the file
+	f, err := os.OpenFile(fpath, os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, 1750000)
+	assert.NoError(t, err)
+	b[0] ^= 0x01
+	_, err = f.WriteAt(b, 1750000)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	ok, err := datastores.Verify(rcontext.InitialNoConfig(), ds, "media", hash, 0)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestVerifyMissing(t *testing.T) {
+	ds, fpath, hash := makeVerifyDatastore(t, []byte("missing"))
+	assert.NoError(t, os.Remove(fpath))
+
+	ok, err := datastores.Verify(rcontext.InitialNoConfig(), ds, "media", hash, 0)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	start := time.Now()
+	b, err := io.ReadAll(readers.NewRateLimitedReader(bytes.NewReader(make([]byte, 3000)), 10000))
+	assert.NoError(t, err)
+	assert.Len(t, b, 3000)
+	assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+}
+
+func TestRateLimitedReaderUnlimited(t *testing.T) {
+	r := bytes.NewReader(make([]byte, 10))
+	assert.Equal(t, io.Reader(r), readers.NewRateLimitedReader(r, 0))
+}
@@ -0,0 +1,134 @@
+package thumbnailing
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"image/color"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/disintegration/imaging"
+	"github.com/fogleman/gg"
+	"github.com/golang/freetype/truetype"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+	"golang.org/x/image/font/gofont/gobold"
+)
+
+// avatarFonts holds parsed fonts by path, with the built-in font under the empty path
+var avatarFonts = make(map[string]*truetype.Font)
+var avatarFontsLock = new(sync.Mutex)
+
+// GenerateDefaultAvatar draws the initials of name (or of the seed, if there is no name) on a background colour
+// picked from the configured palette by the seed. The same seed, name, and size always produce the same image.
+func GenerateDefaultAvatar(seed string, name string, width int, height int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	palette := ctx.Config.DefaultAvatars.Colors
+	if len(palette) == 0 {
+		return nil, errors.New("no default avatar colours configured")
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(seed))
+	background, err := parseHexColour(palette[h.Sum32()%uint32(len(palette))])
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := avatarFont(ctx.Config.DefaultAvatars.FontPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c := gg.NewContext(width, height)
+	c.SetColor(background)
+	c.Clear()
+
+	// Pick a text colour which stands out against the background
+	luminance := 0.299*float64(background.R) + 0.587*float64(background.G) + 0.114*float64(background.B)
+	if luminance > 160 {
+		c.SetColor(color.Black)
+	} else {
+		c.SetColor(color.White)
+	}
+	c.SetFontFace(truetype.NewFace(f, &truetype.Options{Size: float64(min(width, height)) * 0.4}))
+	c.DrawStringAnchored(AvatarInitials(seed, name), float64(width)/2, float64(height)/2, 0.5, 0.35)
+
+	buf := &bytes.Buffer{}
+	if err = u.EncodeAs(ctx, buf, c.Image(), imaging.PNG); err != nil {
+		return nil, err
+	}
+	return &m.Thumbnail{
+		Animated:    false,
+		ContentType: "image/png",
+		Reader:      io.NopCloser(buf),
+		Width:       width,
+		Height:      height,
+	}, nil
+}
+
+// AvatarInitials returns up to two letters for a default avatar, taken from the start of each word in the name. If
+// the name is empty, the localpart of the seed is used instead (for user IDs and room aliases, for example).
+func AvatarInitials(seed string, name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = strings.TrimLeft(seed, "@#!+")
+		if i := strings.IndexRune(name, ':'); i >= 0 {
+			name = name[:i]
+		}
+	}
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	initials := make([]rune, 0, 2)
+	for _, w := range words {
+		r, _ := utf8.DecodeRuneInString(w)
+		initials = append(initials, unicode.ToUpper(r))
+		if len(initials) == 2 {
+			break
+		}
+	}
+	if len(initials) == 0 {
+		return "?"
+	}
+	return string(initials)
+}
+
+func avatarFont(path string) (*truetype.Font, error) {
+	avatarFontsLock.Lock()
+	defer avatarFontsLock.Unlock()
+
+	if f, ok := avatarFonts[path]; ok {
+		return f, nil
+	}
+	var b []byte
+	var err error
+	if path == "" {
+		b = gobold.TTF
+	} else if b, err = os.ReadFile(path); err != nil {
+		return nil, err
+	}
+	f, err := truetype.Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	avatarFonts[path] = f
+	return f, nil
+}
+
+// parseHexColour parses colours in #rrggbb form.
+func parseHexColour(s string) (color.NRGBA, error) {
+	if len(s) != 7 || s[0] != '#' {
+		return color.NRGBA{}, errors.New("invalid colour: " + s)
+	}
+	v, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return color.NRGBA{}, errors.New("invalid colour: " + s)
+	}
+	return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, nil
+}
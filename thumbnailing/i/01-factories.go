@@ -1,14 +1,19 @@
 package i
 
 import (
+	"fmt"
 	"io"
+	"slices"
+	"sort"
 
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/util"
 	"github.com/t2bot/matrix-media-repo/util/readers"
 )
 
 type Generator interface {
+	Name() string
 	supportedContentTypes() []string
 	supportsAnimation() bool
 	matches(img io.Reader, contentType string) bool
@@ -16,6 +21,20 @@ type Generator interface {
 	GetOriginDimensions(b io.Reader, contentType string, ctx rcontext.RequestContext) (bool, int, int, error)
 }
 
+// SubImageGenerator is a Generator for formats which can hold several images, such as HEIF and multi-page TIFF.
+// GetOriginDimensions and GenerateThumbnail use the primary image: the one image viewers show. The methods here
+// use the image at a given index instead, clamping indexes which are out of range.
+type SubImageGenerator interface {
+	Generator
+	GetSubImageDimensions(b io.Reader, index int, ctx rcontext.RequestContext) (int, int, error)
+	GenerateSubImageThumbnail(b io.Reader, index int, width int, height int, method string, ctx rcontext.RequestContext) (*m.Thumbnail, error)
+}
+
+// clampSubImage limits index to the count images available.
+func clampSubImage(index int, count int) int {
+	return max(0, min(index, count-1))
+}
+
 type AudioGenerator interface {
 	Generator
 	GetAudioData(b io.Reader, nKeys int, ctx rcontext.RequestContext) (*m.AudioInfo, error)
@@ -23,21 +42,107 @@ type AudioGenerator interface {
 
 var generators = make([]Generator, 0)
 
-func GetGenerator(img io.Reader, contentType string, needsAnimation bool) (Generator, io.Reader) {
-	br := readers.NewBufferReadsReader(img)
+// defaultGeneratorOrder is the order generators are tried in, unless overridden by config. More specific
+// generators must come before the generators they would otherwise overlap with (apng before png, for example).
+// Generators not listed here are tried last, in name order.
+var defaultGeneratorOrder = []string{
+	"apng",
+	"bmp",
+	"flac",
+	"gif",
+	"heif",
+	"ico",
+	"jpegxl",
+	"jpeg",
+	"mp3",
+	"mp4",
+	"ogg",
+	"png",
+	"svg",
+	"tiff",
+	"wav",
+	"webp",
+}
+
+// GetGeneratorNames returns the names of all known generators, in default dispatch order.
+func GetGeneratorNames() []string {
+	ordered := orderGenerators(nil, nil)
+	names := make([]string, 0, len(ordered))
+	for _, g := range ordered {
+		names = append(names, g.Name())
+	}
+	return names
+}
+
+// orderGenerators returns the enabled generators in dispatch order. Generators named in order come first,
+// followed by the remaining generators in default order.
+func orderGenerators(order []string, disabled []string) []Generator {
+	rank := func(g Generator) int {
+		if idx := slices.Index(order, g.Name()); idx >= 0 {
+			return idx
+		}
+		if idx := slices.Index(defaultGeneratorOrder, g.Name()); idx >= 0 {
+			return len(order) + idx
+		}
+		return len(order) + len(defaultGeneratorOrder)
+	}
+
+	ordered := make([]Generator, 0, len(generators))
 	for _, g := range generators {
+		if !util.ArrayContains(disabled, g.Name()) {
+			ordered = append(ordered, g)
+		}
+	}
+	sort.SliceStable(ordered, func(i int, j int) bool {
+		ri, rj := rank(ordered[i]), rank(ordered[j])
+		if ri == rj {
+			return ordered[i].Name() < ordered[j].Name()
+		}
+		return ri < rj
+	})
+	return ordered
+}
+
+// GetGenerator returns the first generator which matches the media, or nil if none do. Generators whose codec is
+// unavailable are skipped, and if one of those would have matched (and nothing else did), the error explains why
+// and wraps ErrCodecUnavailable.
+func GetGenerator(img io.Reader, contentType string, needsAnimation bool, ctx rcontext.RequestContext) (Generator, io.Reader, error) {
+	conf := ctx.Config.Thumbnails
+	br := readers.NewBufferReadsReader(img)
+	var unavailable error
+	for _, g := range orderGenerators(conf.GeneratorOrder, conf.DisabledGenerators) {
 		if needsAnimation && !g.supportsAnimation() {
 			continue
 		}
 		if g.matches(br, contentType) {
-			return g, br.GetRewoundReader()
+			if err := codecError(g); err != nil {
+				if unavailable == nil {
+					unavailable = fmt.Errorf("%w: %s generator: %w", ErrCodecUnavailable, g.Name(), err)
+				}
+				continue
+			}
+			return g, br.GetRewoundReader(), nil
 		}
 	}
 	if needsAnimation {
 		// try again, this time without animation
-		return GetGenerator(br.GetRewoundReader(), contentType, false)
+		g, r, err := GetGenerator(br.GetRewoundReader(), contentType, false, ctx)
+		if g == nil && err == nil {
+			err = unavailable
+		}
+		return g, r, err
+	}
+	return nil, br.GetRewoundReader(), unavailable
+}
+
+// IsAvailable returns true if an enabled generator supports the content type, and its codec is working.
+func IsAvailable(contentType string, ctx rcontext.RequestContext) bool {
+	for _, g := range orderGenerators(nil, ctx.Config.Thumbnails.DisabledGenerators) {
+		if util.ArrayContains(g.supportedContentTypes(), contentType) && codecError(g) == nil {
+			return true
+		}
 	}
-	return nil, br.GetRewoundReader()
+	return false
 }
 
 func GetSupportedContentTypes() []string {
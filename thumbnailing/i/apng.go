@@ -6,6 +6,7 @@ import (
 	"image/draw"
 	"io"
 
+	"github.com/disintegration/imaging"
 	"github.com/getsentry/sentry-go"
 	"github.com/kettek/apng"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
@@ -16,6 +17,10 @@ import (
 type apngGenerator struct {
 }
 
+func (d apngGenerator) Name() string {
+	return "apng"
+}
+
 func (d apngGenerator) supportedContentTypes() []string {
 	return []string{"image/png", "image/apng"}
 }
@@ -49,6 +54,11 @@ func (d apngGenerator) GenerateThumbnail(b io.Reader, contentType string, width
 	// prepare a blank frame to use as swap space
 	frameImg := image.NewRGBA(p.Frames[0].Image.Bounds())
 
+	// Trimming depends on each frame's content, but the frames must all stay the same size
+	frameCtx := ctx
+	frameCtx.Config.Thumbnails.Trim = false
+
+	dominantColor := ""
 	for i, frame := range p.Frames {
 		img := frame.Image
 
@@ -68,9 +78,12 @@ func (d apngGenerator) GenerateThumbnail(b io.Reader, contentType string, width
 
 		// Copy the frame to a new image and use that
 		draw.Draw(frameImg, image.Rect(frame.XOffset, frame.YOffset, frameImg.Rect.Max.X, frameImg.Rect.Max.Y), img, image.Point{X: 0, Y: 0}, draw.Src)
+		if i == 0 {
+			dominantColor = u.DominantColor(frameImg)
+		}
 
 		// Do the thumbnailing on the copied frame
-		frameThumb, err := u.MakeThumbnail(frameImg, method, width, height)
+		frameThumb, err := u.MakeThumbnail(frameImg, method, width, height, frameCtx)
 		if err != nil {
 			return nil, errors.New("apng: error generating thumbnail frame: " + err.Error())
 		}
@@ -92,7 +105,7 @@ func (d apngGenerator) GenerateThumbnail(b io.Reader, contentType string, width
 
 	pr, pw := io.Pipe()
 	go func(pw *io.PipeWriter, p apng.APNG) {
-		err = apng.Encode(pw, p)
+		err = apng.Encode(u.WithDensity(ctx, pw, imaging.PNG), p)
 		if err != nil {
 			_ = pw.CloseWithError(errors.New("apng: error encoding final thumbnail: " + err.Error()))
 		} else {
@@ -101,9 +114,12 @@ func (d apngGenerator) GenerateThumbnail(b io.Reader, contentType string, width
 	}(pw, p)
 
 	return &m.Thumbnail{
-		ContentType: "image/png",
-		Animated:    true,
-		Reader:      pr,
+		ContentType:   "image/png",
+		Animated:      true,
+		Reader:        pr,
+		DominantColor: dominantColor,
+		Width:         p.Frames[0].Image.Bounds().Dx(),
+		Height:        p.Frames[0].Image.Bounds().Dy(),
 	}, nil
 }
 
@@ -13,6 +13,10 @@ import (
 type bmpGenerator struct {
 }
 
+func (d bmpGenerator) Name() string {
+	return "bmp"
+}
+
 func (d bmpGenerator) supportedContentTypes() []string {
 	return []string{"image/bmp", "image/x-bmp"}
 }
@@ -0,0 +1,85 @@
+package i
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+)
+
+// ErrCodecUnavailable is returned when media is of a format a generator supports, but the native library or external
+// tool the generator needs isn't working in this build.
+var ErrCodecUnavailable = errors.New("format is supported, but its codec is unavailable on this build")
+
+// codecGenerator is a Generator which relies on a native library or external tool that might be missing or broken
+// in some builds. checkCodec returns why the generator can't be used, or nil if it can.
+type codecGenerator interface {
+	Generator
+	checkCodec() error
+}
+
+var codecErrors = make(map[string]error)
+var codecErrorsLock = &sync.RWMutex{}
+
+// codecError returns why the generator's codec is unavailable, or nil if it is working. Codecs are only checked
+// once, unless CheckCodecs is called again.
+func codecError(g Generator) error {
+	cg, ok := g.(codecGenerator)
+	if !ok {
+		return nil
+	}
+
+	codecErrorsLock.RLock()
+	err, checked := codecErrors[g.Name()]
+	codecErrorsLock.RUnlock()
+	if checked {
+		return err
+	}
+
+	err = checkCodec(cg)
+	codecErrorsLock.Lock()
+	codecErrors[g.Name()] = err
+	codecErrorsLock.Unlock()
+	return err
+}
+
+func checkCodec(g codecGenerator) (err error) {
+	// A broken native library shouldn't take down the whole process
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("codec panicked: %v", r)
+		}
+	}()
+	return g.checkCodec()
+}
+
+// CheckCodecs checks the codec of every generator which relies on one, replacing the results of any earlier checks,
+// and returns why each generator which can't be used is unavailable. Generators are checked on first use otherwise.
+func CheckCodecs() map[string]error {
+	unavailable := make(map[string]error)
+	checked := make(map[string]error)
+	for _, g := range generators {
+		cg, ok := g.(codecGenerator)
+		if !ok {
+			continue
+		}
+		err := checkCodec(cg)
+		checked[g.Name()] = err
+		if err != nil {
+			unavailable[g.Name()] = err
+		}
+	}
+
+	codecErrorsLock.Lock()
+	codecErrors = checked
+	codecErrorsLock.Unlock()
+	return unavailable
+}
+
+// checkCommand returns an error if the external tool isn't installed.
+func checkCommand(name string) error {
+	if _, err := exec.LookPath(name); err != nil {
+		return errors.New(name + " is not installed")
+	}
+	return nil
+}
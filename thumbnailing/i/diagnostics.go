@@ -0,0 +1,131 @@
+package i
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"io"
+	"path"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+//go:embed fixtures
+var fixtures embed.FS
+
+type fixture struct {
+	fileName    string
+	contentType string
+}
+
+// diagnosticFixtures are the files each generator is tested with. Generators without one are reported as such. The
+// Ogg and JPEG XL fixtures are test files from the jfreymuth/oggvorbis and gabriel-vasile/mimetype libraries (both
+// MIT licensed), and the MP4 is a single MJPEG frame.
+var diagnosticFixtures = map[string]fixture{
+	"apng":   {"image.apng", "image/png"},
+	"bmp":    {"image.bmp", "image/bmp"},
+	"flac":   {"audio.flac", "audio/flac"},
+	"gif":    {"image.gif", "image/gif"},
+	"heif":   {"image.heic", "image/heic"},
+	"ico":    {"image.ico", "image/x-icon"},
+	"jpeg":   {"image.jpg", "image/jpeg"},
+	"jpegxl": {"image.jxl", "image/jxl"},
+	"mp3":    {"audio.mp3", "audio/mpeg"},
+	"mp4":    {"video.mp4", "video/mp4"},
+	"ogg":    {"audio.ogg", "audio/ogg"},
+	"png":    {"image.png", "image/png"},
+	"svg":    {"image.svg", "image/svg+xml"},
+	"tiff":   {"image.tiff", "image/tiff"},
+	"wav":    {"audio.wav", "audio/wav"},
+	"webp":   {"image.webp", "image/webp"},
+}
+
+// GeneratorDiagnosis is the result of running a generator against its fixture. Error is set if any step failed,
+// and the fields for the steps after it are left empty.
+type GeneratorDiagnosis struct {
+	Name     string
+	Disabled bool
+
+	// FixtureContentType is empty when there's no fixture for the generator
+	FixtureContentType string
+	Matched            bool
+	Dimensional        bool
+	Width              int
+	Height             int
+
+	ThumbnailContentType string
+	ThumbnailBytes       int64
+
+	Error error
+}
+
+func (d *GeneratorDiagnosis) HasFixture() bool {
+	return d.FixtureContentType != ""
+}
+
+// DiagnoseGenerators thumbnails a fixture with each generator, in default order. This checks that the libraries
+// and tools the generators rely on are actually working. Disabled generators are still tested.
+func DiagnoseGenerators(width int, height int, method string, ctx rcontext.RequestContext) []*GeneratorDiagnosis {
+	results := make([]*GeneratorDiagnosis, 0, len(generators))
+	for _, g := range orderGenerators(nil, nil) {
+		d := &GeneratorDiagnosis{
+			Name:     g.Name(),
+			Disabled: util.ArrayContains(ctx.Config.Thumbnails.DisabledGenerators, g.Name()),
+		}
+		results = append(results, d)
+
+		f, ok := diagnosticFixtures[g.Name()]
+		if !ok {
+			continue
+		}
+		d.FixtureContentType = f.contentType
+		b, err := fixtures.ReadFile(path.Join("fixtures", f.fileName))
+		if err != nil {
+			d.Error = err
+			continue
+		}
+		d.Error = diagnoseGenerator(g, d, b, width, height, method, ctx)
+	}
+	return results
+}
+
+func diagnoseGenerator(g Generator, d *GeneratorDiagnosis, b []byte, width int, height int, method string, ctx rcontext.RequestContext) (err error) {
+	// A broken native library shouldn't take down the whole diagnosis
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("generator panicked")
+			ctx.Log.Warnf("Generator %s panicked during diagnosis: %v", g.Name(), r)
+		}
+	}()
+
+	d.Matched = g.matches(bytes.NewReader(b), d.FixtureContentType)
+	if !d.Matched {
+		return errors.New("generator does not recognize its fixture")
+	}
+
+	d.Dimensional, d.Width, d.Height, err = g.GetOriginDimensions(bytes.NewReader(b), d.FixtureContentType, ctx)
+	if err != nil {
+		return errors.New("error getting dimensions: " + err.Error())
+	}
+
+	thumb, err := g.GenerateThumbnail(bytes.NewReader(b), d.FixtureContentType, width, height, method, false, ctx)
+	if err != nil {
+		return errors.New("error generating thumbnail: " + err.Error())
+	}
+	if thumb == nil || thumb.Reader == nil {
+		return errors.New("generator returned no thumbnail")
+	}
+	defer thumb.Reader.Close()
+
+	// Thumbnails are encoded as they're read, so errors can show up here too
+	d.ThumbnailContentType = thumb.ContentType
+	d.ThumbnailBytes, err = io.Copy(io.Discard, thumb.Reader)
+	if err != nil {
+		return errors.New("error encoding thumbnail: " + err.Error())
+	}
+	if d.ThumbnailBytes == 0 {
+		return errors.New("thumbnail is empty")
+	}
+	return nil
+}
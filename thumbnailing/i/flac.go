@@ -14,6 +14,10 @@ import (
 type flacGenerator struct {
 }
 
+func (d flacGenerator) Name() string {
+	return "flac"
+}
+
 func (d flacGenerator) supportedContentTypes() []string {
 	return []string{"audio/flac"}
 }
@@ -3,6 +3,7 @@ package i
 import (
 	"errors"
 	"image"
+	"image/color"
 	"image/draw"
 	"image/gif"
 	"io"
@@ -16,6 +17,10 @@ import (
 type gifGenerator struct {
 }
 
+func (d gifGenerator) Name() string {
+	return "gif"
+}
+
 func (d gifGenerator) supportedContentTypes() []string {
 	return []string{"image/gif"}
 }
@@ -38,35 +43,64 @@ func (d gifGenerator) GenerateThumbnail(b io.Reader, contentType string, width i
 		return nil, errors.New("gif: error decoding image: " + err.Error())
 	}
 
-	// Prepare a blank frame to use as swap space
-	frameImg := image.NewRGBA(image.Rectangle{Min: image.Point{X: 0, Y: 0}, Max: image.Point{X: g.Config.Width, Y: g.Config.Height}})
+	// The canvas the frames are drawn onto, like a browser would
+	canvas := image.NewRGBA(image.Rectangle{Min: image.Point{X: 0, Y: 0}, Max: image.Point{X: g.Config.Width, Y: g.Config.Height}})
+	background := gifBackground(g)
 
 	targetStaticFrame := int(math.Floor(math.Min(1, math.Max(0, float64(ctx.Config.Thumbnails.StillFrame))) * float64(len(g.Image))))
 
+	// Trimming depends on each frame's content, but the frames must all stay the same size
+	frameCtx := ctx
+	frameCtx.Config.Thumbnails.Trim = false
+
+	if len(g.Disposal) != len(g.Image) {
+		g.Disposal = make([]byte, len(g.Image))
+	}
+
+	dominantColor := ""
 	for i, img := range g.Image {
-		var disposal byte
-		// use disposal method 0 by default
-		if g.Disposal == nil {
-			disposal = 0
+		disposal := g.Disposal[i]
+
+		// Frames which restore the previous canvas need a copy of it from before they were drawn
+		var previous []byte
+		if disposal == gif.DisposalPrevious {
+			previous = append([]byte{}, canvas.Pix...)
+		}
+
+		// Frames can be smaller than the canvas, and are drawn over what's already there
+		draw.Draw(canvas, img.Bounds(), img, img.Bounds().Min, draw.Over)
+
+		frameImg := image.NewRGBA(canvas.Bounds())
+		if ctx.Config.Thumbnails.GifTransparency {
+			draw.Draw(frameImg, frameImg.Bounds(), canvas, image.Point{X: 0, Y: 0}, draw.Src)
 		} else {
-			disposal = g.Disposal[i]
+			draw.Draw(frameImg, frameImg.Bounds(), image.NewUniform(background), image.Point{X: 0, Y: 0}, draw.Src)
+			draw.Draw(frameImg, frameImg.Bounds(), canvas, image.Point{X: 0, Y: 0}, draw.Over)
+		}
+		if i == 0 {
+			dominantColor = u.DominantColor(frameImg)
 		}
 
-		// Copy the frame to a new image and use that
-		draw.Draw(frameImg, frameImg.Bounds(), img, image.Point{X: 0, Y: 0}, draw.Over)
+		// Dispose of the frame before the next one is drawn. Browsers (and the spec's "restore to
+		// background") clear the frame's area to transparent rather than the background colour.
+		// https://www.w3.org/Graphics/GIF/spec-gif89a.txt
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, img.Bounds(), image.Transparent, image.Point{X: 0, Y: 0}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous)
+		}
 
-		// Do the thumbnailing on the copied frame
-		frameThumb, err := u.MakeThumbnail(frameImg, method, width, height)
+		// Do the thumbnailing on the composed frame
+		frameThumb, err := u.MakeThumbnail(frameImg, method, width, height, frameCtx)
 		if err != nil {
 			return nil, errors.New("gif: error generating thumbnail frame: " + err.Error())
 		}
 		if frameThumb == nil {
-			tmpImg := image.NewRGBA(frameImg.Bounds())
-			draw.Draw(tmpImg, tmpImg.Bounds(), frameImg, image.Point{X: 0, Y: 0}, draw.Src)
-			frameThumb = tmpImg
+			frameThumb = frameImg
 		}
 
-		targetImg := image.NewPaletted(frameThumb.Bounds(), img.Palette)
+		targetImg := image.NewPaletted(frameThumb.Bounds(), gifFramePalette(img.Palette, ctx.Config.Thumbnails.GifTransparency))
 		draw.FloydSteinberg.Draw(targetImg, frameThumb.Bounds(), frameThumb, image.Point{X: 0, Y: 0})
 
 		if !animated && i == targetStaticFrame {
@@ -76,9 +110,10 @@ func (d gifGenerator) GenerateThumbnail(b io.Reader, contentType string, width i
 			}
 
 			// The thumbnailer decided that it shouldn't thumbnail, so encode it ourselves
+			format := u.ThumbnailFormat(ctx, targetImg)
 			pr, pw := io.Pipe()
 			go func(pw *io.PipeWriter, p *image.Paletted) {
-				err = u.Encode(ctx, pw, p)
+				err = u.EncodeAs(ctx, pw, p, format)
 				if err != nil {
 					_ = pw.CloseWithError(errors.New("gif: error encoding still frame thumbnail: " + err.Error()))
 				} else {
@@ -86,23 +121,18 @@ func (d gifGenerator) GenerateThumbnail(b io.Reader, contentType string, width i
 				}
 			}(pw, targetImg)
 			return &m.Thumbnail{
-				Animated:    false,
-				ContentType: "image/png",
-				Reader:      pr,
+				Animated:      false,
+				ContentType:   u.FormatContentType(format),
+				Reader:        pr,
+				DominantColor: u.DominantColor(targetImg),
+				Width:         targetImg.Bounds().Dx(),
+				Height:        targetImg.Bounds().Dy(),
 			}, nil
 		}
 
-		// if disposal type is 0 or 1 (preserve previous frame) we can get artifacts from re-scaling.
-		// as such, we re-render those frames to disposal type 1 (do not dispose)
-		// Importantly, we do not clear the previous frame buffer canvas
-		// see https://www.w3.org/Graphics/GIF/spec-gif89a.txt
-		// This also applies to frame disposal type 0, https://legacy.imagemagick.org/Usage/anim_basics/#none
-		if disposal == 1 || disposal == 0 {
-			g.Disposal[i] = 1
-		} else {
-			draw.Draw(frameImg, frameImg.Bounds(), image.Transparent, image.Point{X: 0, Y: 0}, draw.Src)
-		}
-
+		// Each thumbnail frame is the whole composed canvas, so it has to replace the one before it entirely.
+		// Drawing it over the previous frame instead would show that frame through any transparent areas.
+		g.Disposal[i] = gif.DisposalBackground
 		g.Image[i] = targetImg
 	}
 
@@ -121,12 +151,48 @@ func (d gifGenerator) GenerateThumbnail(b io.Reader, contentType string, width i
 	}(pw, g)
 
 	return &m.Thumbnail{
-		ContentType: "image/gif",
-		Animated:    true,
-		Reader:      pr,
+		ContentType:   "image/gif",
+		Animated:      true,
+		Reader:        pr,
+		DominantColor: dominantColor,
+		Width:         g.Config.Width,
+		Height:        g.Config.Height,
 	}, nil
 }
 
+// gifBackground returns the GIF's background colour, made opaque. Browsers don't use this, but it's the colour the
+// GIF was made to be shown on.
+func gifBackground(g *gif.GIF) color.Color {
+	if p, ok := g.Config.ColorModel.(color.Palette); ok && int(g.BackgroundIndex) < len(p) {
+		r, gr, b, _ := p[g.BackgroundIndex].RGBA()
+		return color.RGBA64{R: uint16(r), G: uint16(gr), B: uint16(b), A: 0xffff}
+	}
+	return color.White
+}
+
+// gifFramePalette returns the palette to use for a thumbnail frame. When keeping transparency, a transparent colour
+// is added if there isn't one and there's room for it. Otherwise, every colour is made opaque so flattened frames
+// can't become transparent again.
+func gifFramePalette(p color.Palette, transparency bool) color.Palette {
+	if !transparency {
+		opaque := make(color.Palette, 0, len(p))
+		for _, c := range p {
+			r, g, b, _ := c.RGBA()
+			opaque = append(opaque, color.RGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: 0xffff})
+		}
+		return opaque
+	}
+	if len(p) >= 256 {
+		return p
+	}
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p
+		}
+	}
+	return append(append(color.Palette{}, p...), color.Transparent)
+}
+
 func init() {
 	generators = append(generators, gifGenerator{})
 }
@@ -1,11 +1,11 @@
 package i
 
 import (
+	"bytes"
 	"errors"
-	"image"
 	"io"
 
-	_ "github.com/strukturag/libheif/go/heif"
+	"github.com/strukturag/libheif/go/heif"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
 	"github.com/t2bot/matrix-media-repo/util"
@@ -14,6 +14,10 @@ import (
 type heifGenerator struct {
 }
 
+func (d heifGenerator) Name() string {
+	return "heif"
+}
+
 func (d heifGenerator) supportedContentTypes() []string {
 	return []string{"image/heif", "image/heic"}
 }
@@ -26,16 +30,59 @@ func (d heifGenerator) matches(img io.Reader, contentType string) bool {
 	return util.ArrayContains(d.supportedContentTypes(), contentType)
 }
 
+// openImage returns the top level image at index, or the primary image if index is negative.
+func (d heifGenerator) openImage(b io.Reader, index int) (*heif.ImageHandle, error) {
+	data, err := io.ReadAll(b)
+	if err != nil {
+		return nil, err
+	}
+	hctx, err := heif.NewContext()
+	if err != nil {
+		return nil, err
+	}
+	if err = hctx.ReadFromMemory(data); err != nil {
+		return nil, err
+	}
+	if index < 0 {
+		return hctx.GetPrimaryImageHandle()
+	}
+	ids := hctx.GetListOfTopLevelImageIDs()
+	if len(ids) == 0 {
+		return nil, errors.New("no images in file")
+	}
+	return hctx.GetImageHandle(ids[clampSubImage(index, len(ids))])
+}
+
 func (d heifGenerator) GetOriginDimensions(b io.Reader, contentType string, ctx rcontext.RequestContext) (bool, int, int, error) {
-	cfg, _, err := image.DecodeConfig(b)
+	w, h, err := d.GetSubImageDimensions(b, -1, ctx)
 	if err != nil {
 		return false, 0, 0, err
 	}
-	return true, cfg.Width, cfg.Height, nil
+	return true, w, h, nil
+}
+
+func (d heifGenerator) GetSubImageDimensions(b io.Reader, index int, ctx rcontext.RequestContext) (int, int, error) {
+	handle, err := d.openImage(b, index)
+	if err != nil {
+		return 0, 0, err
+	}
+	return handle.GetWidth(), handle.GetHeight(), nil
 }
 
 func (d heifGenerator) GenerateThumbnail(b io.Reader, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
-	src, _, err := image.Decode(b)
+	return d.GenerateSubImageThumbnail(b, -1, width, height, method, ctx)
+}
+
+func (d heifGenerator) GenerateSubImageThumbnail(b io.Reader, index int, width int, height int, method string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	handle, err := d.openImage(b, index)
+	if err != nil {
+		return nil, errors.New("heif: error decoding thumbnail: " + err.Error())
+	}
+	img, err := handle.DecodeImage(heif.ColorspaceUndefined, heif.ChromaUndefined, nil)
+	if err != nil {
+		return nil, errors.New("heif: error decoding thumbnail: " + err.Error())
+	}
+	src, err := img.GetImage()
 	if err != nil {
 		return nil, errors.New("heif: error decoding thumbnail: " + err.Error())
 	}
@@ -43,6 +90,22 @@ func (d heifGenerator) GenerateThumbnail(b io.Reader, contentType string, width
 	return pngGenerator{}.GenerateThumbnailOf(src, width, height, method, ctx)
 }
 
+// checkCodec decodes the diagnostic fixture, as libheif can be built without the decoders it needs.
+func (d heifGenerator) checkCodec() error {
+	b, err := fixtures.ReadFile("fixtures/" + diagnosticFixtures[d.Name()].fileName)
+	if err != nil {
+		return err
+	}
+	handle, err := d.openImage(bytes.NewReader(b), -1)
+	if err != nil {
+		return errors.New("libheif is unable to read HEIF files: " + err.Error())
+	}
+	if _, err = handle.DecodeImage(heif.ColorspaceUndefined, heif.ChromaUndefined, nil); err != nil {
+		return errors.New("libheif is unable to decode HEIF images: " + err.Error())
+	}
+	return nil
+}
+
 func init() {
 	generators = append(generators, heifGenerator{})
 }
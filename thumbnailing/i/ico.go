@@ -0,0 +1,58 @@
+package i
+
+import (
+	"errors"
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type icoGenerator struct {
+}
+
+func (d icoGenerator) Name() string {
+	return "ico"
+}
+
+func (d icoGenerator) supportedContentTypes() []string {
+	return []string{"image/x-icon", "image/vnd.microsoft.icon"}
+}
+
+func (d icoGenerator) supportsAnimation() bool {
+	return false
+}
+
+func (d icoGenerator) matches(img io.Reader, contentType string) bool {
+	return util.ArrayContains(d.supportedContentTypes(), contentType)
+}
+
+func (d icoGenerator) GetOriginDimensions(b io.Reader, contentType string, ctx rcontext.RequestContext) (bool, int, int, error) {
+	ico, err := u.ReadIco(b)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	largest := ico.Largest()
+	return true, largest.Width, largest.Height, nil
+}
+
+func (d icoGenerator) GenerateThumbnail(b io.Reader, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	ico, err := u.ReadIco(b)
+	if err != nil {
+		return nil, errors.New("ico: error reading icon: " + err.Error())
+	}
+
+	// Start from the embedded image closest to what we're producing to avoid needless resampling
+	src, err := ico.Decode(util.MaxInt(width, height))
+	if err != nil {
+		return nil, errors.New("ico: error decoding thumbnail: " + err.Error())
+	}
+
+	return pngGenerator{}.GenerateThumbnailOf(src, width, height, method, ctx)
+}
+
+func init() {
+	generators = append(generators, icoGenerator{})
+}
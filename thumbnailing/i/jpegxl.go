@@ -1,7 +1,9 @@
 package i
 
 import (
+	"bytes"
 	"errors"
+	"image/png"
 	"io"
 	"os"
 	"os/exec"
@@ -14,6 +16,10 @@ import (
 type jpegxlGenerator struct {
 }
 
+func (d jpegxlGenerator) Name() string {
+	return "jpegxl"
+}
+
 func (d jpegxlGenerator) supportedContentTypes() []string {
 	return []string{"image/jxl"}
 }
@@ -35,19 +41,29 @@ func (d jpegxlGenerator) GenerateThumbnail(b io.Reader, contentType string, widt
 	if err != nil {
 		return nil, errors.New("jpegxl: error creating temporary directory: " + err.Error())
 	}
+	defer os.RemoveAll(dir)
 
+	f, err := d.convert(b, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return pngGenerator{}.GenerateThumbnail(f, "image/png", width, height, method, false, ctx)
+}
+
+// convert converts the image to a PNG in the directory, and opens it.
+func (d jpegxlGenerator) convert(b io.Reader, dir string) (*os.File, error) {
 	tempFile1 := path.Join(dir, "i.jpegxl")
 	tempFile2 := path.Join(dir, "o.png")
 
-	defer os.Remove(tempFile1)
-	defer os.Remove(tempFile2)
-	defer os.Remove(dir)
-
 	f, err := os.OpenFile(tempFile1, os.O_RDWR|os.O_CREATE, 0640)
 	if err != nil {
 		return nil, errors.New("jpegxl: error creating temp jpegxl file: " + err.Error())
 	}
-	if _, err = io.Copy(f, b); err != nil {
+	_, err = io.Copy(f, b)
+	_ = f.Close()
+	if err != nil {
 		return nil, errors.New("jpegxl: error writing temp jpegxl file: " + err.Error())
 	}
 
@@ -60,9 +76,33 @@ func (d jpegxlGenerator) GenerateThumbnail(b io.Reader, contentType string, widt
 	if err != nil {
 		return nil, errors.New("jpegxl: error reading temp png file: " + err.Error())
 	}
-	defer f.Close()
+	return f, nil
+}
 
-	return pngGenerator{}.GenerateThumbnail(f, "image/png", width, height, method, false, ctx)
+// checkCodec converts the diagnostic fixture, as ImageMagick can be built without JPEG XL support.
+func (d jpegxlGenerator) checkCodec() error {
+	if err := checkCommand("convert"); err != nil {
+		return err
+	}
+	b, err := fixtures.ReadFile("fixtures/" + diagnosticFixtures[d.Name()].fileName)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(os.TempDir(), "mmr-jpegxl")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := d.convert(bytes.NewReader(b), dir)
+	if err != nil {
+		return errors.New("convert is unable to read JPEG XL images: " + err.Error())
+	}
+	defer f.Close()
+	if _, err = png.DecodeConfig(f); err != nil {
+		return errors.New("convert is unable to convert JPEG XL images: " + err.Error())
+	}
+	return nil
 }
 
 func init() {
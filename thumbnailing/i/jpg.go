@@ -3,10 +3,8 @@ package i
 import (
 	"errors"
 	"image"
-	_ "image/jpeg"
 	"io"
 
-	"github.com/disintegration/imaging"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
 	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
@@ -17,6 +15,10 @@ import (
 type jpgGenerator struct {
 }
 
+func (d jpgGenerator) Name() string {
+	return "jpeg"
+}
+
 func (d jpgGenerator) supportedContentTypes() []string {
 	return []string{"image/jpeg", "image/jpg"}
 }
@@ -38,21 +40,22 @@ func (d jpgGenerator) GenerateThumbnail(b io.Reader, contentType string, width i
 	orientation := u.ExtractExifOrientation(br)
 	b = br.GetRewoundReader()
 
-	src, err := imaging.Decode(b)
+	src, err := u.DecodeJpeg(b)
 	if err != nil {
 		return nil, errors.New("jpg: error decoding thumbnail: " + err.Error())
 	}
 
-	thumb, err := u.MakeThumbnail(src, method, width, height)
+	thumb, err := u.MakeThumbnail(src, method, width, height, ctx)
 	if err != nil {
 		return nil, errors.New("jpg: error making thumbnail: " + err.Error())
 	}
 
-	thumb = u.ApplyOrientation(thumb, orientation)
+	thumb = u.ApplyOrientation(thumb, u.OrientationFor(ctx, orientation, src.Bounds().Dx(), src.Bounds().Dy()))
 
+	format := u.ThumbnailFormat(ctx, thumb, u.JpegSource)
 	pr, pw := io.Pipe()
 	go func(pw *io.PipeWriter, p image.Image) {
-		err = u.Encode(ctx, pw, p, u.JpegSource)
+		err = u.EncodeAs(ctx, pw, p, format)
 		if err != nil {
 			_ = pw.CloseWithError(errors.New("jpg: error encoding thumbnail: " + err.Error()))
 		} else {
@@ -61,9 +64,12 @@ func (d jpgGenerator) GenerateThumbnail(b io.Reader, contentType string, width i
 	}(pw, thumb)
 
 	return &m.Thumbnail{
-		Animated:    false,
-		ContentType: "image/jpeg",
-		Reader:      pr,
+		Animated:      false,
+		ContentType:   u.FormatContentType(format),
+		Reader:        pr,
+		DominantColor: u.DominantColor(src),
+		Width:         thumb.Bounds().Dx(),
+		Height:        thumb.Bounds().Dy(),
 	}, nil
 }
 
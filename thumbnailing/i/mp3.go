@@ -25,6 +25,10 @@ import (
 type mp3Generator struct {
 }
 
+func (d mp3Generator) Name() string {
+	return "mp3"
+}
+
 func (d mp3Generator) supportedContentTypes() []string {
 	return []string{"audio/mpeg"}
 }
@@ -105,7 +109,7 @@ func (d mp3Generator) GenerateFromStream(audio beep.StreamSeekCloser, format bee
 	if meta != nil && meta.Picture() != nil {
 		artwork, _, _ := image.Decode(bytes.NewBuffer(meta.Picture().Data))
 		if artwork != nil {
-			artworkImg, _ = u.MakeThumbnail(artwork, "crop", sq, sq)
+			artworkImg, _ = u.MakeThumbnail(artwork, "crop", sq, sq, ctx)
 		}
 	}
 
@@ -129,7 +133,7 @@ func (d mp3Generator) GenerateFromStream(audio beep.StreamSeekCloser, format bee
 			defer f.Close()
 			tmp, _, _ := image.Decode(f)
 			if tmp != nil {
-				artworkImg, _ = u.MakeThumbnail(tmp, "crop", ax, ay)
+				artworkImg, _ = u.MakeThumbnail(tmp, "crop", ax, ay, ctx)
 			}
 		}
 		if artworkImg == nil {
@@ -195,10 +199,10 @@ func (d mp3Generator) GenerateFromStream(audio beep.StreamSeekCloser, format bee
 		}
 	}
 
-	// Encode to a png
+	imgFormat := u.ThumbnailFormat(ctx, img)
 	pr, pw := io.Pipe()
 	go func(pw *io.PipeWriter, p image.Image) {
-		err = u.Encode(ctx, pw, p)
+		err = u.EncodeAs(ctx, pw, p, imgFormat)
 		if err != nil {
 			_ = pw.CloseWithError(errors.New("beep-visual: error encoding thumbnail: " + err.Error()))
 		} else {
@@ -208,8 +212,10 @@ func (d mp3Generator) GenerateFromStream(audio beep.StreamSeekCloser, format bee
 
 	return &m.Thumbnail{
 		Animated:    false,
-		ContentType: "image/png",
+		ContentType: u.FormatContentType(imgFormat),
 		Reader:      pr,
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
 	}, nil
 }
 
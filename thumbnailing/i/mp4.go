@@ -15,6 +15,10 @@ import (
 type mp4Generator struct {
 }
 
+func (d mp4Generator) Name() string {
+	return "mp4"
+}
+
 func (d mp4Generator) supportedContentTypes() []string {
 	return []string{"video/mp4"}
 }
@@ -66,6 +70,10 @@ func (d mp4Generator) GenerateThumbnail(b io.Reader, contentType string, width i
 	return pngGenerator{}.GenerateThumbnail(f, "image/png", width, height, method, false, ctx)
 }
 
+func (d mp4Generator) checkCodec() error {
+	return checkCommand("ffmpeg")
+}
+
 func init() {
 	generators = append(generators, mp4Generator{})
 }
@@ -15,6 +15,10 @@ import (
 type oggGenerator struct {
 }
 
+func (d oggGenerator) Name() string {
+	return "ogg"
+}
+
 func (d oggGenerator) supportedContentTypes() []string {
 	return []string{"audio/ogg"}
 }
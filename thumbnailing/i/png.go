@@ -15,6 +15,10 @@ import (
 type pngGenerator struct {
 }
 
+func (d pngGenerator) Name() string {
+	return "png"
+}
+
 func (d pngGenerator) supportedContentTypes() []string {
 	return []string{"image/png"}
 }
@@ -45,14 +49,15 @@ func (d pngGenerator) GenerateThumbnail(b io.Reader, contentType string, width i
 }
 
 func (d pngGenerator) GenerateThumbnailOf(src image.Image, width int, height int, method string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
-	thumb, err := u.MakeThumbnail(src, method, width, height)
+	thumb, err := u.MakeThumbnail(src, method, width, height, ctx)
 	if err != nil || thumb == nil {
 		return nil, err
 	}
 
+	format := u.ThumbnailFormat(ctx, thumb)
 	pr, pw := io.Pipe()
 	go func(pw *io.PipeWriter, p image.Image) {
-		err = u.Encode(ctx, pw, p)
+		err = u.EncodeAs(ctx, pw, p, format)
 		if err != nil {
 			_ = pw.CloseWithError(errors.New("png: error encoding thumbnail: " + err.Error()))
 		} else {
@@ -61,9 +66,12 @@ func (d pngGenerator) GenerateThumbnailOf(src image.Image, width int, height int
 	}(pw, thumb)
 
 	return &m.Thumbnail{
-		Animated:    false,
-		ContentType: "image/png",
-		Reader:      pr,
+		Animated:      false,
+		ContentType:   u.FormatContentType(format),
+		Reader:        pr,
+		DominantColor: u.DominantColor(src),
+		Width:         thumb.Bounds().Dx(),
+		Height:        thumb.Bounds().Dy(),
 	}, nil
 }
 
@@ -14,6 +14,10 @@ import (
 type svgGenerator struct {
 }
 
+func (d svgGenerator) Name() string {
+	return "svg"
+}
+
 func (d svgGenerator) supportedContentTypes() []string {
 	return []string{"image/svg+xml"}
 }
@@ -65,6 +69,10 @@ func (d svgGenerator) GenerateThumbnail(b io.Reader, contentType string, width i
 	return pngGenerator{}.GenerateThumbnail(f, "image/png", width, height, method, false, ctx)
 }
 
+func (d svgGenerator) checkCodec() error {
+	return checkCommand("convert")
+}
+
 func init() {
 	generators = append(generators, svgGenerator{})
 }
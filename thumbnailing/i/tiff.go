@@ -1,7 +1,10 @@
 package i
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"image"
 	"io"
 
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
@@ -9,9 +12,24 @@ import (
 	"golang.org/x/image/tiff"
 )
 
+// maxTiffPages limits how many images (IFDs) are read from a TIFF file
+const maxTiffPages = 1000
+
+const tiffTagNewSubfileType = 254
+const tiffSubfileReducedResolution = 1
+
 type tiffGenerator struct {
 }
 
+type tiffPage struct {
+	offset  uint32
+	reduced bool // a smaller preview of another page
+}
+
+func (d tiffGenerator) Name() string {
+	return "tiff"
+}
+
 func (d tiffGenerator) supportedContentTypes() []string {
 	return []string{"image/tiff"}
 }
@@ -24,16 +42,124 @@ func (d tiffGenerator) matches(img io.Reader, contentType string) bool {
 	return contentType == "image/tiff"
 }
 
+// readPages returns the images (IFDs) in the file, in order.
+func (d tiffGenerator) readPages(data []byte) ([]tiffPage, error) {
+	if len(data) < 8 {
+		return nil, errors.New("tiff: file too short")
+	}
+	var order binary.ByteOrder
+	switch string(data[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("tiff: invalid byte order")
+	}
+
+	pages := make([]tiffPage, 0)
+	seen := make(map[uint32]bool)
+	offset := order.Uint32(data[4:8])
+	for offset != 0 && len(pages) < maxTiffPages {
+		if seen[offset] || int64(offset)+2 > int64(len(data)) {
+			break // loop or truncated file: use what we have so far
+		}
+		seen[offset] = true
+
+		count := int64(order.Uint16(data[offset:]))
+		end := int64(offset) + 2 + count*12
+		if end+4 > int64(len(data)) {
+			break
+		}
+		page := tiffPage{offset: offset}
+		for i := int64(0); i < count; i++ {
+			entry := data[int64(offset)+2+i*12:]
+			if order.Uint16(entry[0:2]) != tiffTagNewSubfileType {
+				continue
+			}
+			val := order.Uint32(entry[8:12])
+			if order.Uint16(entry[2:4]) == 3 { // SHORT, stored in the first half of the value
+				val = uint32(order.Uint16(entry[8:10]))
+			}
+			page.reduced = val&tiffSubfileReducedResolution != 0
+		}
+		pages = append(pages, page)
+		offset = order.Uint32(data[end:])
+	}
+	if len(pages) == 0 {
+		return nil, errors.New("tiff: no images in file")
+	}
+	return pages, nil
+}
+
+// openPage returns the file rewritten so the page at index is read first, or the primary page (the first which
+// isn't a reduced resolution preview) if index is negative.
+func (d tiffGenerator) openPage(b io.Reader, index int) (io.Reader, error) {
+	data, err := io.ReadAll(b)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := d.readPages(data)
+	if err != nil {
+		return nil, err
+	}
+
+	page := pages[0]
+	if index >= 0 {
+		page = pages[clampSubImage(index, len(pages))]
+	} else {
+		for _, p := range pages {
+			if !p.reduced {
+				page = p
+				break
+			}
+		}
+	}
+	if page.offset == pages[0].offset {
+		return bytes.NewReader(data), nil
+	}
+
+	// The decoder only reads the first page, so point the header at the one we want instead
+	patched := make([]byte, len(data))
+	copy(patched, data)
+	if string(data[0:2]) == "II" {
+		binary.LittleEndian.PutUint32(patched[4:8], page.offset)
+	} else {
+		binary.BigEndian.PutUint32(patched[4:8], page.offset)
+	}
+	return bytes.NewReader(patched), nil
+}
+
 func (d tiffGenerator) GetOriginDimensions(b io.Reader, contentType string, ctx rcontext.RequestContext) (bool, int, int, error) {
-	i, err := tiff.DecodeConfig(b)
+	w, h, err := d.GetSubImageDimensions(b, -1, ctx)
 	if err != nil {
 		return false, 0, 0, err
 	}
-	return true, i.Width, i.Height, nil
+	return true, w, h, nil
+}
+
+func (d tiffGenerator) GetSubImageDimensions(b io.Reader, index int, ctx rcontext.RequestContext) (int, int, error) {
+	r, err := d.openPage(b, index)
+	if err != nil {
+		return 0, 0, err
+	}
+	i, err := tiff.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	return i.Width, i.Height, nil
 }
 
 func (d tiffGenerator) GenerateThumbnail(b io.Reader, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
-	src, err := tiff.Decode(b)
+	return d.GenerateSubImageThumbnail(b, -1, width, height, method, ctx)
+}
+
+func (d tiffGenerator) GenerateSubImageThumbnail(b io.Reader, index int, width int, height int, method string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	var src image.Image
+	r, err := d.openPage(b, index)
+	if err == nil {
+		src, err = tiff.Decode(r)
+	}
 	if err != nil {
 		return nil, errors.New("tiff: error decoding thumbnail: " + err.Error())
 	}
@@ -14,6 +14,10 @@ import (
 type wavGenerator struct {
 }
 
+func (d wavGenerator) Name() string {
+	return "wav"
+}
+
 func (d wavGenerator) supportedContentTypes() []string {
 	return []string{"audio/wav"}
 }
@@ -12,6 +12,10 @@ import (
 type webpGenerator struct {
 }
 
+func (d webpGenerator) Name() string {
+	return "webp"
+}
+
 func (d webpGenerator) supportedContentTypes() []string {
 	return []string{"image/webp"}
 }
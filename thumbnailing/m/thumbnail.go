@@ -5,7 +5,10 @@ import (
 )
 
 type Thumbnail struct {
-	Animated    bool
-	ContentType string
-	Reader      io.ReadCloser
+	Animated      bool
+	ContentType   string
+	Reader        io.ReadCloser
+	DominantColor string // of the source image, as #rrggbb. Empty if unknown.
+	Width         int    // of the thumbnail itself, after any scaling, cropping, or rotation. Zero if unknown.
+	Height        int
 }
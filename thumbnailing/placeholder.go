@@ -0,0 +1,49 @@
+package thumbnailing
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/ryanuber/go-glob"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// GeneratePlaceholder resizes the first image in thumbnails.placeholders which matches the content type, for media
+// which can't be thumbnailed itself. ErrUnsupported is returned if there isn't one for the content type.
+func GeneratePlaceholder(contentType string, width int, height int, method string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	path := ""
+	for _, p := range ctx.Config.Thumbnails.Placeholders {
+		if glob.Glob(strings.ToLower(p.ContentType), strings.ToLower(contentType)) {
+			path = p.Path
+			break
+		}
+	}
+	if path == "" {
+		return nil, ErrUnsupported
+	}
+
+	src, err := imaging.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := u.MakeThumbnail(src, method, width, height, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if err = u.EncodeAs(ctx, buf, img, imaging.PNG); err != nil {
+		return nil, err
+	}
+	return &m.Thumbnail{
+		Animated:    false,
+		ContentType: "image/png",
+		Reader:      io.NopCloser(buf),
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+	}, nil
+}
@@ -0,0 +1,73 @@
+package thumbnailing
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+)
+
+// ErrTransient is wrapped around thumbnailing errors which may not happen if the thumbnail is tried again, such as
+// the media failing to be read part way through. See IsTransient.
+var ErrTransient = errors.New("transient thumbnail error")
+
+// IsTransient returns true if the error from GenerateThumbnail (or similar) could go away by trying again. Errors
+// caused by the media itself, such as it being corrupt or unsupported, are never transient.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrTransient) || errors.Is(err, syscall.ENOMEM) || errors.Is(err, syscall.EAGAIN) {
+		return true
+	}
+
+	// External tools (like ffmpeg) which are killed, such as by the OOM killer, may work next time
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return true
+		}
+	}
+	return false
+}
+
+// WithRetries calls generate until it succeeds or returns an error which isn't transient (see IsTransient), up to
+// thumbnails.retries.maxRetries more times. The wait between attempts starts at thumbnails.retries.backoffMs and
+// doubles each time.
+func WithRetries(ctx rcontext.RequestContext, generate func() (*m.Thumbnail, error)) (*m.Thumbnail, error) {
+	conf := ctx.Config.Thumbnails.Retries
+	backoff := time.Duration(conf.BackoffMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		thumb, err := generate()
+		if err == nil || attempt >= conf.MaxRetries || !IsTransient(err) {
+			return thumb, err
+		}
+
+		ctx.Log.Warnf("Transient error generating thumbnail (attempt %d of %d), trying again in %s: %v", attempt+1, conf.MaxRetries+1, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Context.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// sourceReader remembers the first error while reading the media being thumbnailed, as generators don't keep the
+// original error when they fail because of it.
+type sourceReader struct {
+	io.ReadCloser
+	err error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
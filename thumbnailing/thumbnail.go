@@ -2,8 +2,10 @@ package thumbnailing
 
 import (
 	"errors"
+	"fmt"
+	"image"
 	"io"
-	"reflect"
+	"time"
 
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
@@ -16,11 +18,73 @@ import (
 
 var ErrUnsupported = errors.New("unsupported thumbnail type")
 
+// ErrCodecUnavailable is returned for media which a generator supports, but can't thumbnail in this build, when
+// thumbnails.unavailableCodecs is "error". Otherwise, the media is treated as unsupported.
+var ErrCodecUnavailable = i.ErrCodecUnavailable
+
+// Values for `thumbnails.unavailableCodecs`.
+const (
+	UnavailableCodecsPlaceholder = "placeholder"
+	UnavailableCodecsError       = "error"
+)
+
 func IsSupported(contentType string) bool {
 	return util.ArrayContains(i.GetSupportedContentTypes(), contentType)
 }
 
+// IsAvailable returns true if media of the content type can be thumbnailed under the current config: thumbnails of
+// the type are allowed, and a generator for it is enabled and working.
+func IsAvailable(contentType string, ctx rcontext.RequestContext) bool {
+	return util.ArrayContains(ctx.Config.Thumbnails.Types, contentType) && i.IsAvailable(contentType, ctx)
+}
+
 func GenerateThumbnail(imgStream io.ReadCloser, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	return generateThumbnail(imgStream, contentType, width, height, method, animated, -1, ctx)
+}
+
+// GenerateSubImageThumbnail is the same as GenerateThumbnail, but thumbnails the image at index in formats which
+// hold several (see i.SubImageGenerator). Other formats are thumbnailed as normal. The thumbnail is not animated,
+// and images smaller than the requested size are thumbnailed at their own size rather than being rejected.
+func GenerateSubImageThumbnail(imgStream io.ReadCloser, contentType string, index int, width int, height int, method string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	return generateThumbnail(imgStream, contentType, width, height, method, false, max(0, index), ctx)
+}
+
+func generateThumbnail(imgStream io.ReadCloser, contentType string, width int, height int, method string, animated bool, subImage int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	source := &sourceReader{ReadCloser: imgStream}
+	thumb, err := generateFromSource(source, contentType, width, height, method, animated, subImage, ctx)
+	if err != nil && source.err != nil {
+		// The generator failed because the media couldn't be read, which might work next time
+		return nil, fmt.Errorf("%w: error reading media: %w", ErrTransient, source.err)
+	}
+	if err != nil || thumb == nil || thumb.Reader == nil {
+		return thumb, err
+	}
+
+	// Whatever the generator did to the image, the encoded thumbnail is what gets served
+	w, h, r := OutputDimensions(thumb.Reader)
+	thumb.Reader = r
+	if w > 0 && h > 0 {
+		thumb.Width, thumb.Height = w, h
+	}
+	return thumb, nil
+}
+
+// OutputDimensions reads the dimensions of an encoded thumbnail from its header, returning zeros if they can't be
+// found. The returned reader reads the whole thumbnail, header included, in place of r.
+func OutputDimensions(r io.ReadCloser) (int, int, io.ReadCloser) {
+	buffered := readers.NewBufferReadsReader(r)
+	cfg, _, err := image.DecodeConfig(buffered)
+	rewound := struct {
+		io.Reader
+		io.Closer
+	}{buffered.GetRewoundReader(), r}
+	if err != nil {
+		return 0, 0, rewound
+	}
+	return cfg.Width, cfg.Height, rewound
+}
+
+func generateFromSource(imgStream io.ReadCloser, contentType string, width int, height int, method string, animated bool, subImage int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	defer imgStream.Close()
 	if !IsSupported(contentType) {
 		ctx.Log.Debugf("Unsupported content type '%s'", contentType)
@@ -31,19 +95,44 @@ func GenerateThumbnail(imgStream io.ReadCloser, contentType string, width int, h
 		return nil, ErrUnsupported
 	}
 
-	generator, reconstructed := i.GetGenerator(imgStream, contentType, animated)
+	generator, reconstructed, err := i.GetGenerator(imgStream, contentType, animated, ctx)
+	if err != nil {
+		ctx.Log.Warnf("Unable to thumbnail '%s': %v", contentType, err)
+		if ctx.Config.Thumbnails.UnavailableCodecs == UnavailableCodecsError {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %w", ErrUnsupported, err)
+	}
 	if generator == nil {
 		ctx.Log.Debugf("Unsupported thumbnail type at generator for '%s'", contentType)
 		return nil, ErrUnsupported
 	}
-	ctx.Log.Debug("Using generator: ", reflect.TypeOf(generator).Name())
+	ctx.Log.Debug("Using generator: ", generator.Name())
+
+	// Everything up until the generator returns, besides resizing, is counted as decoding. Encoding happens
+	// later, as the thumbnail is read.
+	timings := u.GetTimings(ctx)
+	startTime := time.Now()
+	resizeBefore := timings.Get(u.TimingResize)
+	defer func() {
+		timings.Add(u.TimingDecode, time.Since(startTime)-(timings.Get(u.TimingResize)-resizeBefore))
+	}()
 
 	// Validate maximum megapixel values to avoid memory issues
 	// https://github.com/t2bot/matrix-media-repo/security/advisories/GHSA-j889-h476-hh9h
 	buffered := readers.NewBufferReadsReader(reconstructed)
-	dimensional, w, h, err := generator.GetOriginDimensions(buffered, contentType, ctx)
+	subGenerator, hasSubImages := generator.(i.SubImageGenerator)
+	hasSubImages = hasSubImages && subImage >= 0
+	var dimensional bool
+	var w, h int
+	if hasSubImages {
+		dimensional = true
+		w, h, err = subGenerator.GetSubImageDimensions(buffered, subImage, ctx)
+	} else {
+		dimensional, w, h, err = generator.GetOriginDimensions(buffered, contentType, ctx)
+	}
 	if err != nil {
-		return nil, errors.New("error getting dimensions: " + err.Error())
+		return nil, fmt.Errorf("error getting dimensions: %w", err)
 	}
 	if dimensional {
 		if (w * h) >= ctx.Config.Thumbnails.MaxPixels {
@@ -55,15 +144,26 @@ func GenerateThumbnail(imgStream io.ReadCloser, contentType string, width int, h
 		shouldThumbnail := true
 		shouldThumbnail, width, height, method = u.AdjustProperties(w, h, width, height, animated, method)
 		if !shouldThumbnail {
-			return nil, common.ErrMediaDimensionsTooSmall
+			if subImage < 0 && u.ServesOriginal(ctx) {
+				return nil, common.ErrMediaDimensionsTooSmall
+			}
+			// Either the original isn't wanted or there's no file to fall back to for just one of the images, so
+			// use the image's own size
+			width, height, method = w, h, "scale"
 		}
 	}
 
+	if hasSubImages {
+		return subGenerator.GenerateSubImageThumbnail(buffered.GetRewoundReader(), subImage, width, height, method, ctx)
+	}
 	return generator.GenerateThumbnail(buffered.GetRewoundReader(), contentType, width, height, method, animated, ctx)
 }
 
-func GetGenerator(imgStream io.Reader, contentType string, animated bool) (i.Generator, io.Reader, error) {
-	generator, reconstructed := i.GetGenerator(imgStream, contentType, animated)
+func GetGenerator(imgStream io.Reader, contentType string, animated bool, ctx rcontext.RequestContext) (i.Generator, io.Reader, error) {
+	generator, reconstructed, err := i.GetGenerator(imgStream, contentType, animated, ctx)
+	if err != nil {
+		return nil, reconstructed, fmt.Errorf("%w: %w", ErrUnsupported, err)
+	}
 	if generator == nil {
 		return nil, reconstructed, ErrUnsupported
 	}
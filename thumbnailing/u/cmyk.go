@@ -0,0 +1,88 @@
+package u
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// CMYK and YCCK JPEGs usually come from print workflows. The standard library undoes Adobe's inverted ink values
+// when the image has an APP14 (Adobe) marker, but refuses to decode 4-component images without one. libjpeg reads
+// those as plain, uninverted CMYK, so they're read the same way here by adding the marker and inverting the result.
+
+// adobeSegment is an APP14 marker with an "unknown" transform, meaning the image is (inverted) CMYK.
+var adobeSegment = []byte{0xFF, 0xEE, 0x00, 0x0E, 'A', 'd', 'o', 'b', 'e', 0x00, 0x64, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+// DecodeJpeg decodes a JPEG, converting CMYK and YCCK images to RGB so they are resized (and encoded) with the right
+// colors rather than as ink values.
+func DecodeJpeg(r io.Reader) (image.Image, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	components, hasAdobe := jpegColorInfo(b)
+	uninverted := components == 4 && !hasAdobe
+	if uninverted {
+		b = append(append(append([]byte{}, b[:2]...), adobeSegment...), b[2:]...)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if cmyk, ok := img.(*image.CMYK); ok {
+		if uninverted {
+			for i := range cmyk.Pix {
+				cmyk.Pix[i] = 255 - cmyk.Pix[i]
+			}
+		}
+		return imaging.Clone(cmyk), nil
+	}
+	return img, nil
+}
+
+// jpegColorInfo returns the number of components in the JPEG's frame, and whether it has an APP14 (Adobe) marker.
+// The number of components is zero if the frame header couldn't be found.
+func jpegColorInfo(b []byte) (int, bool) {
+	if len(b) < 2 || b[0] != 0xFF || b[1] != 0xD8 {
+		return 0, false
+	}
+	components := 0
+	hasAdobe := false
+	for pos := 2; pos+4 <= len(b); {
+		if b[pos] != 0xFF {
+			break
+		}
+		marker := b[pos+1]
+		if marker == 0xFF { // fill byte
+			pos++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 { // start of scan, end of image
+			break
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) { // no length
+			pos += 2
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(b[pos+2:]))
+		if length < 2 { // the length includes itself, so anything shorter is corrupt
+			break
+		}
+		segment := b[pos+4 : min(pos+2+length, len(b))]
+		if marker == 0xEE && bytes.HasPrefix(segment, []byte("Adobe")) {
+			hasAdobe = true
+		}
+		isFrame := marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC
+		if isFrame && len(segment) >= 6 {
+			components = int(segment[5])
+		}
+		pos += 2 + length
+	}
+	return components, hasAdobe
+}
@@ -0,0 +1,44 @@
+package u
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+const colorSampleSize = 256
+
+// DominantColor returns the average colour of the image as a hex string (#rrggbb), ignoring fully transparent
+// pixels. Large images are sampled on an evenly spaced grid, so the result is deterministic. Returns an empty
+// string if there are no visible pixels.
+func DominantColor(img image.Image) string {
+	bounds := img.Bounds()
+	stepX := (bounds.Dx() + colorSampleSize - 1) / colorSampleSize
+	stepY := (bounds.Dy() + colorSampleSize - 1) / colorSampleSize
+	if stepX < 1 {
+		stepX = 1
+	}
+	if stepY < 1 {
+		stepY = 1
+	}
+
+	var r, g, b, n uint64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				continue
+			}
+			r += uint64(c.R)
+			g += uint64(c.G)
+			b += uint64(c.B)
+			n++
+		}
+	}
+	if n == 0 {
+		return ""
+	}
+
+	// Round to the nearest value rather than truncating
+	return fmt.Sprintf("#%02x%02x%02x", (r+n/2)/n, (g+n/2)/n, (b+n/2)/n)
+}
@@ -0,0 +1,86 @@
+package u
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/disintegration/imaging"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// The encoders don't write density information, so it is added to their output at a fixed point: right after the
+// IHDR chunk for PNGs, and right after the start of image marker for JPEGs.
+const (
+	pngHeaderLength  = 8 + 4 + 4 + 13 + 4 // signature, then IHDR's length, type, data, and CRC
+	jpegHeaderLength = 2                  // SOI
+)
+
+// WithDensity returns a writer which records the configured output DPI in PNG (pHYs) and JPEG (JFIF) images
+// written to w. When no DPI is configured, or the format can't hold one, w is returned as-is.
+func WithDensity(ctx rcontext.RequestContext, w io.Writer, format imaging.Format) io.Writer {
+	dpi := ctx.Config.Thumbnails.OutputDpi
+	if dpi <= 0 {
+		return w
+	}
+	switch format {
+	case imaging.PNG:
+		return &densityWriter{w: w, after: pngHeaderLength, insert: pngDensityChunk(dpi)}
+	case imaging.JPEG:
+		return &densityWriter{w: w, after: jpegHeaderLength, insert: jfifSegment(dpi)}
+	default:
+		return w
+	}
+}
+
+// densityWriter passes writes through to w, adding insert once the first after bytes have been written.
+type densityWriter struct {
+	w       io.Writer
+	after   int
+	insert  []byte
+	written int
+}
+
+func (d *densityWriter) Write(p []byte) (int, error) {
+	n := 0
+	if d.insert != nil {
+		head := min(d.after-d.written, len(p))
+		c, err := d.w.Write(p[:head])
+		n += c
+		d.written += c
+		if err != nil {
+			return n, err
+		}
+		p = p[head:]
+		if d.written < d.after {
+			return n, nil
+		}
+		if _, err = d.w.Write(d.insert); err != nil {
+			return n, err
+		}
+		d.insert = nil
+	}
+
+	c, err := d.w.Write(p)
+	return n + c, err
+}
+
+func pngDensityChunk(dpi int) []byte {
+	ppm := uint32(math.Round(float64(dpi) / 0.0254)) // pixels per metre, the only real unit PNG has
+	chunk := make([]byte, 0, 4+4+9+4)
+	chunk = binary.BigEndian.AppendUint32(chunk, 9)
+	chunk = append(chunk, "pHYs"...)
+	chunk = binary.BigEndian.AppendUint32(chunk, ppm)
+	chunk = binary.BigEndian.AppendUint32(chunk, ppm)
+	chunk = append(chunk, 1) // unit: metre
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func jfifSegment(dpi int) []byte {
+	density := uint16(min(dpi, math.MaxUint16))
+	segment := []byte{0xFF, 0xE0, 0x00, 0x10, 'J', 'F', 'I', 'F', 0x00, 0x01, 0x01, 0x01} // APP0, JFIF 1.01, unit: DPI
+	segment = binary.BigEndian.AppendUint16(segment, density)
+	segment = binary.BigEndian.AppendUint16(segment, density)
+	return append(segment, 0x00, 0x00) // no embedded thumbnail
+}
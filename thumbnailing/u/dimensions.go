@@ -1,5 +1,33 @@
 package u
 
+import (
+	"context"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// WithSourceSize attaches the size of the media being thumbnailed, in bytes, to the context for ServesOriginal.
+func WithSourceSize(ctx rcontext.RequestContext, sizeBytes int64) rcontext.RequestContext {
+	ctx.Context = context.WithValue(ctx.Context, common.ContextThumbnailSourceSize, sizeBytes)
+	return ctx
+}
+
+// ServesOriginal returns whether media which is no larger than the requested thumbnail should be served in place
+// of one, per the thumbnails.serveSmallOriginals options. Media of unknown size (see WithSourceSize) is only
+// served when there's no limit on its size.
+func ServesOriginal(ctx rcontext.RequestContext) bool {
+	conf := ctx.Config.Thumbnails.SmallOriginals
+	if !conf.Enabled {
+		return false
+	}
+	if conf.MaxBytes <= 0 {
+		return true
+	}
+	sizeBytes, ok := ctx.Context.Value(common.ContextThumbnailSourceSize).(int64)
+	return ok && sizeBytes <= conf.MaxBytes
+}
+
 func AdjustProperties(srcWidth int, srcHeight int, desiredWidth int, desiredHeight int, wantAnimated bool, method string) (bool, int, int, string) {
 	aspectRatio := float32(srcHeight) / float32(srcWidth)
 	targetAspectRatio := float32(desiredHeight) / float32(desiredWidth)
@@ -3,6 +3,7 @@ package u
 import (
 	"image"
 	"io"
+	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
@@ -16,17 +17,73 @@ const (
 )
 
 func Encode(ctx rcontext.RequestContext, w io.Writer, img image.Image, sourceFlags ...EncodeSource) error {
-	// This function is broken out for later trials around encoding formats (webp, jpg, etc)
-
-	if len(sourceFlags) > 0 {
-		for _, f := range sourceFlags {
-			if f == JpegSource {
-				// Encode JPEG source with JPEG thumbnails to avoid returning larger thumbnails
-				// than what we started with
-				return imaging.Encode(w, img, imaging.JPEG)
+	return EncodeAs(ctx, w, img, sourceFormat(sourceFlags...))
+}
+
+func EncodeAs(ctx rcontext.RequestContext, w io.Writer, img image.Image, format imaging.Format) error {
+	defer GetTimings(ctx).Since(TimingEncode, time.Now())
+	if format == imaging.JPEG && ctx.Config.Thumbnails.ProgressiveJpeg {
+		return EncodeProgressiveJpeg(WithDensity(ctx, w, format), img, progressiveQuality)
+	}
+	if format == imaging.PNG {
+		if paletted := ToPalette(ctx, img); paletted != nil {
+			img = paletted
+		}
+	}
+	return imaging.Encode(WithDensity(ctx, w, format), img, format)
+}
+
+// ThumbnailFormat picks the format a thumbnail should be encoded as. When automatic formats are enabled, opaque
+// thumbnails become JPEGs and anything with transparency is a PNG.
+func ThumbnailFormat(ctx rcontext.RequestContext, img image.Image, sourceFlags ...EncodeSource) imaging.Format {
+	if !ctx.Config.Thumbnails.AutoFormat {
+		return sourceFormat(sourceFlags...)
+	}
+	if HasAlpha(img) {
+		return imaging.PNG
+	}
+	return imaging.JPEG
+}
+
+func FormatContentType(format imaging.Format) string {
+	switch format {
+	case imaging.JPEG:
+		return "image/jpeg"
+	case imaging.GIF:
+		return "image/gif"
+	case imaging.BMP:
+		return "image/bmp"
+	case imaging.TIFF:
+		return "image/tiff"
+	default:
+		return "image/png"
+	}
+}
+
+// HasAlpha returns true if any pixel in the image is not fully opaque.
+func HasAlpha(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
 			}
 		}
 	}
+	return false
+}
 
-	return imaging.Encode(w, img, imaging.PNG)
+func sourceFormat(sourceFlags ...EncodeSource) imaging.Format {
+	for _, f := range sourceFlags {
+		if f == JpegSource {
+			// Encode JPEG source with JPEG thumbnails to avoid returning larger thumbnails
+			// than what we started with
+			return imaging.JPEG
+		}
+	}
+	return imaging.PNG
 }
@@ -4,14 +4,20 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
 )
 
 type ExifOrientation struct {
 	RotateDegrees  int // should be 0, 90, 180, or 270
 	FlipVertical   bool
 	FlipHorizontal bool
+
+	// The dimensions of the image when the EXIF data was written, if recorded. Zero if unknown.
+	PixelWidth  int
+	PixelHeight int
 }
 
 func GetExifOrientation(img io.Reader) (*ExifOrientation, error) {
@@ -29,10 +35,18 @@ func GetExifOrientation(img io.Reader) (*ExifOrientation, error) {
 	}
 
 	var tag exif.ExifTag
+	pixelWidth := 0
+	pixelHeight := 0
 	for _, t := range tags {
-		if t.TagName == "Orientation" {
-			tag = t
-			break
+		switch t.TagName {
+		case "Orientation":
+			if tag.TagName == "" {
+				tag = t
+			}
+		case "PixelXDimension":
+			pixelWidth = exifInt(t.Value)
+		case "PixelYDimension":
+			pixelHeight = exifInt(t.Value)
 		}
 	}
 	if tag.TagName != "Orientation" {
@@ -59,8 +73,10 @@ func GetExifOrientation(img io.Reader) (*ExifOrientation, error) {
 		return nil, fmt.Errorf("orientation out of range: %d", orientation)
 	}
 
-	flipHorizontal := orientation < 5 && (orientation%2) == 0
-	flipVertical := orientation > 4 && (orientation%2) != 0
+	// Orientations 5 and 7 are a transpose and transverse: a flip along a diagonal. That's the same as rotating
+	// and then flipping horizontally, like the other mirrored orientations (2 and 4).
+	flipHorizontal := (orientation < 5 && (orientation%2) == 0) || (orientation > 4 && (orientation%2) != 0)
+	flipVertical := false
 	degrees := 0
 
 	// TODO: There's probably a better way to represent this
@@ -74,5 +90,143 @@ func GetExifOrientation(img io.Reader) (*ExifOrientation, error) {
 		degrees = 90
 	}
 
-	return &ExifOrientation{degrees, flipVertical, flipHorizontal}, nil
+	return &ExifOrientation{
+		RotateDegrees:  degrees,
+		FlipVertical:   flipVertical,
+		FlipHorizontal: flipHorizontal,
+		PixelWidth:     pixelWidth,
+		PixelHeight:    pixelHeight,
+	}, nil
+}
+
+// IsStale returns true if the image (with the given dimensions, as stored) looks like it was already rotated after
+// the orientation was written: the dimensions recorded alongside the orientation are the other way around.
+func (o *ExifOrientation) IsStale(width int, height int) bool {
+	if o.RotateDegrees != 90 && o.RotateDegrees != 270 {
+		return false
+	}
+	if o.PixelWidth <= 0 || o.PixelHeight <= 0 || o.PixelWidth == o.PixelHeight {
+		return false
+	}
+	return width == o.PixelHeight && height == o.PixelWidth
+}
+
+// ExifCaptureMetadata describes how a photo was taken. It deliberately only covers the camera settings: location,
+// serial numbers, and owner details are never read.
+type ExifCaptureMetadata struct {
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	FocalLength  float64 // millimetres
+	ExposureTime string  // seconds, such as "1/125"
+	FNumber      float64
+	Iso          int
+	DateTaken    string // as recorded by the camera, such as "2006:01:02 15:04:05"
+}
+
+// exifCaptureTags are the only tags GetExifCaptureMetadata reads, by IFD path
+var exifCaptureTags = map[string][]string{
+	"IFD":      {"Make", "Model"},
+	"IFD/Exif": {"LensModel", "FocalLength", "ExposureTime", "FNumber", "ISOSpeedRatings", "DateTimeOriginal"},
+}
+
+// GetExifCaptureMetadata reads the camera settings from the image's EXIF data. Returns nil if there is no EXIF data,
+// or it doesn't have any of the settings.
+func GetExifCaptureMetadata(img io.Reader) (*ExifCaptureMetadata, error) {
+	rawExif, err := exif.SearchAndExtractExifWithReader(img)
+	if err != nil {
+		if errors.Is(err, exif.ErrNoExif) {
+			return nil, nil
+		}
+		return nil, errors.New("exif: error reading possible exif data: " + err.Error())
+	}
+
+	tags, _, err := exif.GetFlatExifData(rawExif, nil)
+	if err != nil {
+		return nil, errors.New("exif: error parsing exif data: " + err.Error())
+	}
+
+	found := false
+	meta := &ExifCaptureMetadata{}
+	for _, t := range tags {
+		allowed := false
+		for _, name := range exifCaptureTags[t.IfdPath] {
+			if name == t.TagName {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			continue
+		}
+		found = true
+
+		switch t.TagName {
+		case "Make":
+			meta.CameraMake = exifString(t.Value)
+		case "Model":
+			meta.CameraModel = exifString(t.Value)
+		case "LensModel":
+			meta.LensModel = exifString(t.Value)
+		case "DateTimeOriginal":
+			meta.DateTaken = exifString(t.Value)
+		case "FocalLength":
+			if n, d, ok := exifRational(t.Value); ok && d != 0 {
+				meta.FocalLength = float64(n) / float64(d)
+			}
+		case "FNumber":
+			if n, d, ok := exifRational(t.Value); ok && d != 0 {
+				meta.FNumber = float64(n) / float64(d)
+			}
+		case "ExposureTime":
+			if n, d, ok := exifRational(t.Value); ok && d != 0 {
+				if n > 0 && n < d && d%n == 0 {
+					meta.ExposureTime = fmt.Sprintf("1/%d", d/n)
+				} else {
+					meta.ExposureTime = strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%.4f", float64(n)/float64(d)), "0"), ".")
+				}
+			}
+		case "ISOSpeedRatings":
+			if vals, ok := t.Value.([]uint16); ok && len(vals) > 0 {
+				meta.Iso = int(vals[0])
+			}
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return meta, nil
+}
+
+func exifInt(val interface{}) int {
+	switch v := val.(type) {
+	case []uint16:
+		if len(v) > 0 {
+			return int(v[0])
+		}
+	case []uint32:
+		if len(v) > 0 {
+			return int(v[0])
+		}
+	}
+	return 0
+}
+
+func exifString(val interface{}) string {
+	s, _ := val.(string)
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func exifRational(val interface{}) (int64, int64, bool) {
+	switch v := val.(type) {
+	case []exifcommon.Rational:
+		if len(v) > 0 {
+			return int64(v[0].Numerator), int64(v[0].Denominator), true
+		}
+	case []exifcommon.SignedRational:
+		if len(v) > 0 {
+			return int64(v[0].Numerator), int64(v[0].Denominator), true
+		}
+	}
+	return 0, 0, false
 }
@@ -2,26 +2,110 @@ package u
 
 import (
 	"errors"
+	"fmt"
 	"image"
 	"io"
+	"strings"
+	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/getsentry/sentry-go"
 	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
 )
 
-func MakeThumbnail(src image.Image, method string, width int, height int) (image.Image, error) {
+// ErrEmptyImage is returned by MakeThumbnail when the image, or the thumbnail made from it, has no pixels. Encoders
+// can't handle empty images, so it's better to fail clearly than to produce a broken thumbnail.
+var ErrEmptyImage = errors.New("image has no pixels")
+
+// DefaultAnchor is the part of the image kept by crops which don't ask for anything else.
+const DefaultAnchor = "center"
+
+// Anchors are the names clients can use to pick which part of the image is kept when cropping.
+var Anchors = map[string]imaging.Anchor{
+	"center":       imaging.Center,
+	"top":          imaging.Top,
+	"bottom":       imaging.Bottom,
+	"left":         imaging.Left,
+	"right":        imaging.Right,
+	"top_left":     imaging.TopLeft,
+	"top_right":    imaging.TopRight,
+	"bottom_left":  imaging.BottomLeft,
+	"bottom_right": imaging.BottomRight,
+}
+
+// CropMethod returns the method for a crop which keeps the named anchor. Centered crops are plain "crop", so they
+// share the thumbnails made before anchors could be picked.
+func CropMethod(anchor string) string {
+	if anchor == "" || anchor == DefaultAnchor {
+		return "crop"
+	}
+	return "crop:" + anchor
+}
+
+// ParseMethod splits a method into "crop" or "scale", and the name of the anchor to crop around. The anchor is
+// one of Anchors or SmartAnchor.
+func ParseMethod(method string) (string, string, error) {
+	base, anchor, hasAnchor := strings.Cut(method, ":")
+	if base != "crop" && base != "scale" {
+		return "", "", errors.New("unrecognized method: " + method)
+	}
+	if !hasAnchor {
+		return base, DefaultAnchor, nil
+	}
+	_, ok := Anchors[anchor]
+	if base != "crop" || (!ok && anchor != SmartAnchor) {
+		return "", "", errors.New("unrecognized method: " + method)
+	}
+	return base, anchor, nil
+}
+
+func MakeThumbnail(src image.Image, method string, width int, height int, ctx rcontext.RequestContext) (image.Image, error) {
+	defer GetTimings(ctx).Since(TimingResize, time.Now())
 	var result image.Image
+	downscaled := false
+	method, anchor, err := ParseMethod(method)
+	if err != nil {
+		return nil, err
+	}
+	if isEmpty(src) {
+		return nil, fmt.Errorf("%w: source is %dx%d", ErrEmptyImage, src.Bounds().Dx(), src.Bounds().Dy())
+	}
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("%w: requested %dx%d", ErrEmptyImage, width, height)
+	}
+	if ctx.Config.Thumbnails.Trim {
+		src = TrimBorders(src, ctx.Config.Thumbnails.TrimTolerance)
+	}
+	srcWidth := src.Bounds().Dx()
+	srcHeight := src.Bounds().Dy()
 	if method == "scale" {
 		result = imaging.Fit(src, width, height, imaging.Linear)
+		downscaled = width < srcWidth || height < srcHeight // Fit never scales up
 	} else if method == "crop" {
-		result = imaging.Fill(src, width, height, imaging.Center, imaging.Linear)
-	} else {
-		return nil, errors.New("unrecognized method: " + method)
+		if anchor == SmartAnchor {
+			if result, err = smartFill(src, width, height, ctx); err != nil {
+				return nil, err
+			}
+		} else {
+			result = imaging.Fill(src, width, height, Anchors[anchor], imaging.Linear)
+		}
+		downscaled = width < srcWidth && height < srcHeight // Fill scales by the larger ratio
+	}
+	if downscaled && ctx.Config.Thumbnails.Sharpen && ctx.Config.Thumbnails.SharpenAmount > 0 {
+		result = imaging.Sharpen(result, ctx.Config.Thumbnails.SharpenAmount)
+	}
+	if isEmpty(result) {
+		// Not expected after the checks above, but just in case
+		return nil, fmt.Errorf("%w: %dx%d image resized to %dx%d", ErrEmptyImage, srcWidth, srcHeight, result.Bounds().Dx(), result.Bounds().Dy())
 	}
 	return result, nil
 }
 
+func isEmpty(img image.Image) bool {
+	return img == nil || img.Bounds().Empty()
+}
+
 func ExtractExifOrientation(r io.Reader) *ExifOrientation {
 	orientation, err := GetExifOrientation(r)
 	if err != nil {
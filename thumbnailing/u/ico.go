@@ -0,0 +1,206 @@
+package u
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"sort"
+
+	"github.com/t2bot/matrix-media-repo/util"
+	"golang.org/x/image/bmp"
+)
+
+// maxIcoDimension is the largest width or height the icon directory can describe.
+const maxIcoDimension = 256
+
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+type IcoEntry struct {
+	Width    int
+	Height   int
+	BitCount int
+	offset   uint32
+	size     uint32
+}
+
+type Ico struct {
+	Entries []IcoEntry
+	raw     []byte
+}
+
+func ReadIco(r io.Reader) (*Ico, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < 6 || binary.LittleEndian.Uint16(b[0:2]) != 0 || binary.LittleEndian.Uint16(b[2:4]) != 1 {
+		return nil, errors.New("ico: not an icon file")
+	}
+	count := int(binary.LittleEndian.Uint16(b[4:6]))
+	if count == 0 || len(b) < 6+(count*16) {
+		return nil, errors.New("ico: truncated directory")
+	}
+
+	ico := &Ico{Entries: make([]IcoEntry, 0, count), raw: b}
+	for i := 0; i < count; i++ {
+		d := b[6+(i*16) : 6+((i+1)*16)]
+		e := IcoEntry{
+			Width:    int(d[0]),
+			Height:   int(d[1]),
+			BitCount: int(binary.LittleEndian.Uint16(d[6:8])),
+			size:     binary.LittleEndian.Uint32(d[8:12]),
+			offset:   binary.LittleEndian.Uint32(d[12:16]),
+		}
+		// A zero dimension means 256 pixels
+		if e.Width == 0 {
+			e.Width = 256
+		}
+		if e.Height == 0 {
+			e.Height = 256
+		}
+		if uint64(e.offset)+uint64(e.size) > uint64(len(b)) {
+			continue // skip entries pointing outside the file
+		}
+		ico.Entries = append(ico.Entries, e)
+	}
+	if len(ico.Entries) == 0 {
+		return nil, errors.New("ico: no usable images")
+	}
+
+	return ico, nil
+}
+
+// Largest returns the entry with the most pixels.
+func (c *Ico) Largest() IcoEntry {
+	return c.ordered(0)[0]
+}
+
+// Decode decodes the embedded image closest to preferredSize (in pixels, along the longest side). When
+// preferredSize is zero or less, the largest image is used. If the chosen image cannot be decoded, the
+// remaining images are tried from largest to smallest.
+func (c *Ico) Decode(preferredSize int) (image.Image, error) {
+	var lastErr error
+	for _, e := range c.ordered(preferredSize) {
+		img, err := c.decodeEntry(e)
+		if err == nil {
+			return img, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (c *Ico) ordered(preferredSize int) []IcoEntry {
+	entries := make([]IcoEntry, len(c.Entries))
+	copy(entries, c.Entries)
+	sort.SliceStable(entries, func(i int, j int) bool {
+		return entries[i].Width*entries[i].Height > entries[j].Width*entries[j].Height
+	})
+	if preferredSize > 0 {
+		best := 0
+		for i, e := range entries {
+			// Ties go to the larger image, which is first due to the sort
+			if util.AbsInt(util.MaxInt(e.Width, e.Height)-preferredSize) < util.AbsInt(util.MaxInt(entries[best].Width, entries[best].Height)-preferredSize) {
+				best = i
+			}
+		}
+		entries = append([]IcoEntry{entries[best]}, append(entries[:best:best], entries[best+1:]...)...)
+	}
+	return entries
+}
+
+// decodeEntry decodes the entry's image. Only the directory's dimensions are checked against the pixel limits, so
+// images claiming to be a different size are rejected before anything is allocated for them.
+func (c *Ico) decodeEntry(e IcoEntry) (image.Image, error) {
+	b := c.raw[e.offset : e.offset+e.size]
+	if bytes.HasPrefix(b, pngSignature) {
+		cfg, err := png.DecodeConfig(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		if err = checkIcoDimensions(e, cfg.Width, cfg.Height); err != nil {
+			return nil, err
+		}
+		return png.Decode(bytes.NewReader(b))
+	}
+	return decodeIcoBitmap(b, e)
+}
+
+func checkIcoDimensions(e IcoEntry, width int, height int) error {
+	if width != e.Width || height != e.Height || width > maxIcoDimension || height > maxIcoDimension {
+		return fmt.Errorf("ico: image is %dx%d but the directory says %dx%d", width, height, e.Width, e.Height)
+	}
+	return nil
+}
+
+// decodeIcoBitmap decodes a headerless BMP as found in icon files. The height in the info header covers both
+// the colour data and the AND mask which follows it, so is double the real height.
+func decodeIcoBitmap(b []byte, e IcoEntry) (image.Image, error) {
+	if len(b) < 40 {
+		return nil, errors.New("ico: truncated bitmap header")
+	}
+	headerLen := binary.LittleEndian.Uint32(b[0:4])
+	width := int(int32(binary.LittleEndian.Uint32(b[4:8])))
+	height := int(int32(binary.LittleEndian.Uint32(b[8:12]))) / 2
+	bpp := binary.LittleEndian.Uint16(b[14:16])
+	compression := binary.LittleEndian.Uint32(b[16:20])
+	colorsUsed := binary.LittleEndian.Uint32(b[32:36])
+	if width <= 0 || height <= 0 || headerLen < 40 || uint32(len(b)) < headerLen {
+		return nil, errors.New("ico: invalid bitmap header")
+	}
+	if err := checkIcoDimensions(e, width, height); err != nil {
+		return nil, err
+	}
+
+	if bpp == 32 && compression == 0 {
+		// The bmp package ignores alpha for plain info headers, but icons rely on it
+		stride := width * 4
+		pixels := b[headerLen:]
+		if int64(len(pixels)) < int64(stride)*int64(height) {
+			return nil, errors.New("ico: truncated bitmap data")
+		}
+		img := image.NewNRGBA(image.Rect(0, 0, width, height))
+		hasAlpha := false
+		for y := 0; y < height; y++ {
+			row := pixels[(height-1-y)*stride : (height-y)*stride]
+			p := img.Pix[y*img.Stride : y*img.Stride+stride]
+			for i := 0; i < stride; i += 4 {
+				p[i+0] = row[i+2]
+				p[i+1] = row[i+1]
+				p[i+2] = row[i+0]
+				p[i+3] = row[i+3]
+				hasAlpha = hasAlpha || row[i+3] != 0
+			}
+		}
+		if !hasAlpha {
+			for i := 3; i < len(img.Pix); i += 4 {
+				img.Pix[i] = 0xFF
+			}
+		}
+		return img, nil
+	}
+
+	// Otherwise rebuild a regular BMP file and let the bmp package handle it
+	paletteLen := uint32(0)
+	if bpp <= 8 {
+		paletteLen = colorsUsed
+		if paletteLen == 0 {
+			paletteLen = 1 << bpp
+		}
+		paletteLen *= 4
+	}
+	fileHeader := make([]byte, 14)
+	fileHeader[0] = 'B'
+	fileHeader[1] = 'M'
+	binary.LittleEndian.PutUint32(fileHeader[2:6], uint32(14+len(b)))
+	binary.LittleEndian.PutUint32(fileHeader[10:14], 14+headerLen+paletteLen)
+	info := make([]byte, len(b))
+	copy(info, b)
+	binary.LittleEndian.PutUint32(info[8:12], uint32(int32(height)))
+	return bmp.Decode(io.MultiReader(bytes.NewReader(fileHeader), bytes.NewReader(info)))
+}
@@ -37,7 +37,7 @@ func GetID3Tags(b io.Reader) (tag.Metadata, io.ReadSeekCloser, error) {
 		tryCleanup()
 		return nil, nil, err
 	}
-	if f, err = os.OpenFile(f.Name(), os.O_WRONLY, 0644); err != nil {
+	if f, err = os.Open(f.Name()); err != nil {
 		tryCleanup()
 		return nil, nil, err
 	}
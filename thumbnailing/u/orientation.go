@@ -0,0 +1,38 @@
+package u
+
+import (
+	"context"
+	"strings"
+
+	"github.com/ryanuber/go-glob"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// WithSourceOrigin attaches the origin of the media being thumbnailed to the context, for OrientationFor.
+func WithSourceOrigin(ctx rcontext.RequestContext, origin string) rcontext.RequestContext {
+	ctx.Context = context.WithValue(ctx.Context, common.ContextThumbnailOrigin, origin)
+	return ctx
+}
+
+// OrientationFor returns the orientation to apply to an image with the given dimensions (as stored), per the
+// thumbnails.exifOrientation options. Returns nil if the orientation shouldn't be applied, or there isn't one.
+func OrientationFor(ctx rcontext.RequestContext, orientation *ExifOrientation, width int, height int) *ExifOrientation {
+	conf := ctx.Config.Thumbnails.ExifOrientation
+	if orientation == nil || !conf.Enabled {
+		return nil
+	}
+	if origin, ok := ctx.Context.Value(common.ContextThumbnailOrigin).(string); ok && origin != "" {
+		origin = strings.ToLower(origin) // the patterns are lowercased when the config is loaded
+		for _, pattern := range conf.DisabledOrigins {
+			if glob.Glob(pattern, origin) {
+				return nil
+			}
+		}
+	}
+	if conf.IgnoreStale && orientation.IsStale(width, height) {
+		ctx.Log.Debugf("Ignoring stale EXIF orientation: image is %dx%d, but was %dx%d when the orientation was set", width, height, orientation.PixelWidth, orientation.PixelHeight)
+		return nil
+	}
+	return orientation
+}
@@ -0,0 +1,168 @@
+package u
+
+import (
+	"image"
+	"image/color"
+	"slices"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// Modes for thumbnails.pngPalette.mode
+const (
+	PaletteOff    = "off"
+	PaletteAuto   = "auto"
+	PaletteAlways = "always"
+)
+
+const maxPaletteColors = 256
+
+// paletteEntry is a colour in the image, and how many pixels are that colour.
+type paletteEntry struct {
+	c     color.NRGBA
+	count int
+}
+
+// ToPalette converts the image to one with a palette of up to 256 colours for encoding as a PNG, if the
+// thumbnails.pngPalette options allow it. Images with more colours than fit in the palette are reduced with a
+// median cut. In the "auto" mode, images with more than the configured number of colours (such as photos) are
+// left alone, and nil is returned.
+func ToPalette(ctx rcontext.RequestContext, img image.Image) *image.Paletted {
+	conf := ctx.Config.Thumbnails.PngPalette
+	maxColors := -1 // no limit
+	switch conf.Mode {
+	case PaletteAlways:
+	case PaletteAuto:
+		maxColors = max(maxPaletteColors, conf.MaxAutoColors)
+	default:
+		return nil
+	}
+
+	b := img.Bounds()
+	counts := make(map[color.NRGBA]int)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			counts[color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)]++
+		}
+		if maxColors >= 0 && len(counts) > maxColors {
+			return nil
+		}
+	}
+
+	entries := make([]paletteEntry, 0, len(counts))
+	for c, count := range counts {
+		entries = append(entries, paletteEntry{c, count})
+	}
+	slices.SortFunc(entries, func(a paletteEntry, b paletteEntry) int {
+		return compareNRGBA(a.c, b.c) // so the palette doesn't depend on map order
+	})
+
+	palette, index := medianCut(entries)
+	paletted := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), palette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			paletted.SetColorIndex(x-b.Min.X, y-b.Min.Y, index[color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)])
+		}
+	}
+	return paletted
+}
+
+// medianCut splits the colours into up to 256 boxes, repeatedly halving (by pixel count) the box which spans the
+// widest range of a channel. Each box becomes the average of its colours. The index of each colour's box is
+// returned alongside the palette.
+func medianCut(entries []paletteEntry) (color.Palette, map[color.NRGBA]uint8) {
+	boxes := []paletteBox{newPaletteBox(entries)}
+	for len(boxes) < maxPaletteColors {
+		widest := -1
+		for i, box := range boxes {
+			if box.spread > 0 && (widest < 0 || box.spread > boxes[widest].spread) {
+				widest = i
+			}
+		}
+		if widest < 0 {
+			break // every box is a single colour
+		}
+
+		box := boxes[widest]
+		slices.SortStableFunc(box.entries, func(a paletteEntry, b paletteEntry) int {
+			return int(channelOf(a.c, box.channel)) - int(channelOf(b.c, box.channel))
+		})
+		total := 0
+		for _, e := range box.entries {
+			total += e.count
+		}
+		split := 1
+		for seen := box.entries[0].count; split < len(box.entries)-1 && seen*2 < total; split++ {
+			seen += box.entries[split].count
+		}
+		boxes[widest] = newPaletteBox(box.entries[:split])
+		boxes = append(boxes, newPaletteBox(box.entries[split:]))
+	}
+
+	palette := make(color.Palette, len(boxes))
+	index := make(map[color.NRGBA]uint8)
+	for i, box := range boxes {
+		var r, g, b, a, total int
+		for _, e := range box.entries {
+			r += int(e.c.R) * e.count
+			g += int(e.c.G) * e.count
+			b += int(e.c.B) * e.count
+			a += int(e.c.A) * e.count
+			total += e.count
+			index[e.c] = uint8(i)
+		}
+		palette[i] = color.NRGBA{
+			R: uint8((r + total/2) / total),
+			G: uint8((g + total/2) / total),
+			B: uint8((b + total/2) / total),
+			A: uint8((a + total/2) / total),
+		}
+	}
+	return palette, index
+}
+
+// paletteBox is a group of colours for medianCut, along with the channel they vary the most in.
+type paletteBox struct {
+	entries []paletteEntry
+	channel int
+	spread  int
+}
+
+func newPaletteBox(entries []paletteEntry) paletteBox {
+	box := paletteBox{entries: entries, spread: -1}
+	for channel := 0; channel < 4; channel++ {
+		lo := 255
+		hi := 0
+		for _, e := range entries {
+			v := int(channelOf(e.c, channel))
+			lo = min(lo, v)
+			hi = max(hi, v)
+		}
+		if hi-lo > box.spread {
+			box.channel, box.spread = channel, hi-lo
+		}
+	}
+	return box
+}
+
+func channelOf(c color.NRGBA, channel int) uint8 {
+	switch channel {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	case 2:
+		return c.B
+	default:
+		return c.A
+	}
+}
+
+func compareNRGBA(a color.NRGBA, b color.NRGBA) int {
+	for channel := 0; channel < 4; channel++ {
+		if d := int(channelOf(a, channel)) - int(channelOf(b, channel)); d != 0 {
+			return d
+		}
+	}
+	return 0
+}
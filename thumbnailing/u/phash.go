@@ -0,0 +1,81 @@
+package u
+
+import (
+	"image"
+	"math"
+	"math/bits"
+	"slices"
+
+	"github.com/disintegration/imaging"
+)
+
+// phashSampleSize is the size the image is reduced to before the DCT, and phashBlockSize is how many of the
+// lowest frequencies (in each direction) make up the hash.
+const phashSampleSize = 32
+const phashBlockSize = 8
+
+var phashCosines = func() [phashSampleSize][phashSampleSize]float64 {
+	var table [phashSampleSize][phashSampleSize]float64
+	for k := 0; k < phashSampleSize; k++ {
+		for n := 0; n < phashSampleSize; n++ {
+			table[k][n] = math.Cos(math.Pi / phashSampleSize * (float64(n) + 0.5) * float64(k))
+		}
+	}
+	return table
+}()
+
+// PerceptualHash returns a 64-bit hash of the image's overall structure, using the low frequencies of a discrete
+// cosine transform. Images which look alike have hashes which differ in few bits, even if they were scaled,
+// recompressed, or slightly edited. Use HammingDistance to compare hashes.
+func PerceptualHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, phashSampleSize, phashSampleSize, imaging.Lanczos))
+
+	var pixels [phashSampleSize][phashSampleSize]float64
+	for y := 0; y < phashSampleSize; y++ {
+		for x := 0; x < phashSampleSize; x++ {
+			// Grayscale, so the red channel has the luminance
+			pixels[y][x] = float64(small.Pix[y*small.Stride+x*4])
+		}
+	}
+
+	// The DCT is separable, so transform the rows and then the columns. Only the low frequencies are needed.
+	// The first row and column are skipped as they're dominated by the overall brightness.
+	var rows [phashSampleSize][phashBlockSize]float64
+	for y := 0; y < phashSampleSize; y++ {
+		for k := 0; k < phashBlockSize; k++ {
+			sum := 0.0
+			for x := 0; x < phashSampleSize; x++ {
+				sum += pixels[y][x] * phashCosines[k+1][x]
+			}
+			rows[y][k] = sum
+		}
+	}
+	coefficients := make([]float64, 0, phashBlockSize*phashBlockSize)
+	for k := 0; k < phashBlockSize; k++ {
+		for j := 0; j < phashBlockSize; j++ {
+			sum := 0.0
+			for y := 0; y < phashSampleSize; y++ {
+				sum += rows[y][j] * phashCosines[k+1][y]
+			}
+			coefficients = append(coefficients, sum)
+		}
+	}
+
+	sorted := slices.Clone(coefficients)
+	slices.Sort(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	hash := uint64(0)
+	for i, c := range coefficients {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// HammingDistance returns the number of bits which differ between two perceptual hashes. Zero means the images
+// look the same, and around half of the bits (32) means they're unrelated.
+func HammingDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
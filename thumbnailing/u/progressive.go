@@ -0,0 +1,110 @@
+package u
+
+/*
+#cgo pkg-config: libjpeg
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <setjmp.h>
+#include <jpeglib.h>
+
+struct mmr_jpeg_error {
+	struct jpeg_error_mgr pub;
+	jmp_buf jmp;
+	char msg[JMSG_LENGTH_MAX];
+};
+
+static void mmr_jpeg_error_exit(j_common_ptr cinfo) {
+	struct mmr_jpeg_error *err = (struct mmr_jpeg_error *)cinfo->err;
+	(*cinfo->err->format_message)(cinfo, err->msg);
+	longjmp(err->jmp, 1);
+}
+
+// mmr_encode_progressive compresses packed 8-bit samples to a progressive JPEG in memory. The output buffer is
+// allocated by libjpeg and must be freed by the caller, even on failure.
+static int mmr_encode_progressive(unsigned char *pixels, int width, int height, int components, int quality, unsigned char **out, unsigned long *out_size, char *msg) {
+	struct jpeg_compress_struct cinfo;
+	struct mmr_jpeg_error jerr;
+
+	cinfo.err = jpeg_std_error(&jerr.pub);
+	jerr.pub.error_exit = mmr_jpeg_error_exit;
+	if (setjmp(jerr.jmp)) {
+		memcpy(msg, jerr.msg, JMSG_LENGTH_MAX);
+		jpeg_destroy_compress(&cinfo);
+		return 0;
+	}
+
+	jpeg_create_compress(&cinfo);
+	jpeg_mem_dest(&cinfo, out, out_size);
+	cinfo.image_width = width;
+	cinfo.image_height = height;
+	cinfo.input_components = components;
+	cinfo.in_color_space = components == 1 ? JCS_GRAYSCALE : JCS_RGB;
+	jpeg_set_defaults(&cinfo);
+	jpeg_set_quality(&cinfo, quality, TRUE);
+	jpeg_simple_progression(&cinfo);
+	cinfo.write_JFIF_header = FALSE; // the density is written by WithDensity, like for baseline JPEGs
+
+	jpeg_start_compress(&cinfo, TRUE);
+	while (cinfo.next_scanline < cinfo.image_height) {
+		JSAMPROW row = pixels + (size_t)cinfo.next_scanline * width * components;
+		jpeg_write_scanlines(&cinfo, &row, 1);
+	}
+	jpeg_finish_compress(&cinfo);
+	jpeg_destroy_compress(&cinfo);
+	return 1;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"unsafe"
+)
+
+// The standard library can only write baseline JPEGs, so progressive thumbnails are written by libjpeg(-turbo)
+// instead, with its default scan script and 4:2:0 chroma subsampling.
+
+// progressiveQuality matches what imaging uses for baseline JPEG thumbnails.
+const progressiveQuality = 95
+
+// EncodeProgressiveJpeg writes the image as a progressive JPEG. Grayscale images are stored with a single component.
+func EncodeProgressiveJpeg(w io.Writer, img image.Image, quality int) error {
+	b := img.Bounds()
+	if b.Dx() <= 0 || b.Dy() <= 0 || b.Dx() > 0xFFFF || b.Dy() > 0xFFFF {
+		return errors.New("jpeg: image is too large or empty")
+	}
+	quality = min(max(quality, 1), 100)
+
+	components := 3
+	if _, gray := img.(*image.Gray); gray {
+		components = 1
+	}
+	pixels := make([]byte, 0, b.Dx()*b.Dy()*components)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if components == 1 {
+				pixels = append(pixels, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			} else {
+				c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+				pixels = append(pixels, c.R, c.G, c.B)
+			}
+		}
+	}
+
+	var out *C.uchar
+	var outSize C.ulong
+	var msg [C.JMSG_LENGTH_MAX]C.char
+	ok := C.mmr_encode_progressive((*C.uchar)(unsafe.Pointer(&pixels[0])), C.int(b.Dx()), C.int(b.Dy()), C.int(components), C.int(quality), &out, &outSize, &msg[0])
+	if out != nil {
+		defer C.free(unsafe.Pointer(out))
+	}
+	if ok == 0 {
+		return errors.New("jpeg: " + C.GoString(&msg[0]))
+	}
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(out), C.int(outSize)))
+	return err
+}
@@ -0,0 +1,172 @@
+package u
+
+import (
+	"image"
+	"math"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// SmartAnchor crops around the most detailed part of the image, when enabled.
+const SmartAnchor = "smart"
+
+// smartAnalysisSize is the size the image is scaled down to before looking for detail, which keeps the cost
+// roughly the same for every image.
+const smartAnalysisSize = 128
+
+// minEdge is the smallest change in brightness counted as detail, so compression artifacts and gentle gradients
+// don't count.
+const minEdge = 8
+
+// The limit is per-process: when running multiple media repo processes, each enforces it separately.
+var smartLock = new(sync.Mutex)
+var smartInFlight = 0
+var smartReleased = make(chan struct{}) // closed (and replaced) whenever a slot is released
+
+// acquireSmartCropSlot waits for one of the configured number of smart crops to finish, if that many are running.
+func acquireSmartCropSlot(ctx rcontext.RequestContext) (func(), error) {
+	limit := ctx.Config.Thumbnails.SmartCrop.MaxConcurrent
+	for {
+		smartLock.Lock()
+		if limit <= 0 || smartInFlight < limit {
+			smartInFlight++
+			smartLock.Unlock()
+			break
+		}
+		released := smartReleased
+		smartLock.Unlock()
+
+		select {
+		case <-released:
+			continue
+		case <-ctx.Context.Done():
+			return nil, ctx.Context.Err()
+		}
+	}
+
+	once := new(sync.Once)
+	return func() {
+		once.Do(func() {
+			smartLock.Lock()
+			defer smartLock.Unlock()
+			smartInFlight--
+			close(smartReleased)
+			smartReleased = make(chan struct{})
+		})
+	}, nil
+}
+
+// smartFill is imaging.Fill, but centered on the region FindSalientCrop picks. If smart crops are disabled or
+// nothing stands out in the image, the crop is centered instead.
+func smartFill(src image.Image, width int, height int, ctx rcontext.RequestContext) (image.Image, error) {
+	if !ctx.Config.Thumbnails.SmartCrop.Enabled {
+		return imaging.Fill(src, width, height, imaging.Center, imaging.Linear), nil
+	}
+
+	release, err := acquireSmartCropSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	region, found := FindSalientCrop(src, width, height)
+	if !found {
+		ctx.Log.Debug("Nothing stands out in the image - cropping around the center")
+		return imaging.Fill(src, width, height, imaging.Center, imaging.Linear), nil
+	}
+	return imaging.Resize(imaging.Crop(src, region), width, height, imaging.Linear), nil
+}
+
+// FindSalientCrop returns the largest region of src with the aspect ratio of width by height, centered as close
+// as possible to the most detailed part of the image, which is usually the subject of a photo. The second return
+// value is false if nothing stands out, in which case the region should be centered.
+func FindSalientCrop(src image.Image, width int, height int) (image.Rectangle, bool) {
+	bounds := src.Bounds()
+	srcWidth := bounds.Dx()
+	srcHeight := bounds.Dy()
+	if srcWidth <= 0 || srcHeight <= 0 || width <= 0 || height <= 0 {
+		return bounds, false
+	}
+
+	// Fill keeps one dimension whole, so the crop only moves along the other
+	ratio := float64(width) / float64(height)
+	cropWidth := srcWidth
+	cropHeight := srcHeight
+	horizontal := float64(srcWidth)/float64(srcHeight) > ratio
+	if horizontal {
+		cropWidth = max(1, int(math.Round(float64(srcHeight)*ratio)))
+	} else {
+		cropHeight = max(1, int(math.Round(float64(srcWidth)/ratio)))
+	}
+	if cropWidth >= srcWidth && cropHeight >= srcHeight {
+		return bounds, false // nothing to crop
+	}
+
+	analysis := imaging.Fit(src, smartAnalysisSize, smartAnalysisSize, imaging.Box)
+	profile := detailProfile(analysis, horizontal)
+	total := sum(profile)
+	if total <= 0 {
+		return bounds, false
+	}
+	centroid := 0.0
+	for i, v := range profile {
+		centroid += (float64(i) + 0.5) * v
+	}
+	centroid /= total * float64(len(profile)) // as a fraction of the image
+
+	if horizontal {
+		x := clampCrop(centroid*float64(srcWidth)-float64(cropWidth)/2, srcWidth-cropWidth)
+		return image.Rect(bounds.Min.X+x, bounds.Min.Y, bounds.Min.X+x+cropWidth, bounds.Max.Y), true
+	}
+	y := clampCrop(centroid*float64(srcHeight)-float64(cropHeight)/2, srcHeight-cropHeight)
+	return image.Rect(bounds.Min.X, bounds.Min.Y+y, bounds.Max.X, bounds.Min.Y+y+cropHeight), true
+}
+
+// detailProfile adds up how much detail is in each column (or row, if not horizontal) of the image.
+func detailProfile(img *image.NRGBA, horizontal bool) []float64 {
+	w := img.Bounds().Dx()
+	h := img.Bounds().Dy()
+	size := h
+	if horizontal {
+		size = w
+	}
+	detail := make([]float64, size)
+
+	luma := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := img.PixOffset(x, y)
+			r, g, b := float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2])
+			luma[y*w+x] = 0.299*r + 0.587*g + 0.114*b
+		}
+	}
+
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			bucket := y
+			if horizontal {
+				bucket = x
+			}
+			l := luma[y*w+x]
+			edge := math.Abs(4*l - luma[y*w+x-1] - luma[y*w+x+1] - luma[(y-1)*w+x] - luma[(y+1)*w+x])
+			if edge > minEdge {
+				detail[bucket] += math.Min(edge/255, 1)
+			}
+		}
+	}
+	return detail
+}
+
+func clampCrop(offset float64, maxOffset int) int {
+	return min(max(0, int(math.Round(offset))), maxOffset)
+}
+
+func sum(values []float64) float64 {
+	total := 0.0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
@@ -0,0 +1,92 @@
+package u
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const (
+	TimingDecode = "decode"
+	TimingResize = "resize"
+	TimingEncode = "encode"
+)
+
+// Timings collects how long each step of generating a thumbnail took, for the Server-Timing header. Steps which
+// happen more than once (such as resizing each frame of an animation) are summed. A nil *Timings ignores
+// everything recorded to it.
+type Timings struct {
+	mu        sync.Mutex
+	names     []string
+	durations map[string]time.Duration
+}
+
+// WithTimings attaches the Timings to the context so the thumbnailers can record to it.
+func WithTimings(ctx rcontext.RequestContext, t *Timings) rcontext.RequestContext {
+	ctx.Context = context.WithValue(ctx.Context, common.ContextThumbnailTimings, t)
+	return ctx
+}
+
+// GetTimings returns the Timings attached to the context, or nil if there are none.
+func GetTimings(ctx context.Context) *Timings {
+	t, _ := ctx.Value(common.ContextThumbnailTimings).(*Timings)
+	return t
+}
+
+func (t *Timings) Add(name string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.durations == nil {
+		t.durations = make(map[string]time.Duration)
+	}
+	if _, ok := t.durations[name]; !ok {
+		t.names = append(t.names, name)
+	}
+	t.durations[name] += d
+}
+
+func (t *Timings) Since(name string, start time.Time) {
+	t.Add(name, time.Since(start))
+}
+
+func (t *Timings) Get(name string) time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.durations[name]
+}
+
+// ServerTiming formats the recorded steps as a Server-Timing header value. The decode, resize, and encode steps
+// come first, followed by anything else in the order it was recorded. Durations are in milliseconds. An empty
+// string is returned if nothing was recorded.
+func (t *Timings) ServerTiming() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := []string{TimingDecode, TimingResize, TimingEncode}
+	for _, name := range t.names {
+		if !util.ArrayContains(names, name) {
+			names = append(names, name)
+		}
+	}
+	metrics := make([]string, 0, len(names))
+	for _, name := range names {
+		if d, ok := t.durations[name]; ok {
+			metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", name, float64(d.Microseconds())/1000))
+		}
+	}
+	return strings.Join(metrics, ", ")
+}
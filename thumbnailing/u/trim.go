@@ -0,0 +1,75 @@
+package u
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/disintegration/imaging"
+)
+
+// TrimBorders crops away borders which are the same colour as the top left pixel, allowing each channel to differ
+// by up to tolerance. Fully transparent pixels match each other regardless of their colour. The image is returned
+// as-is if it has no border, or if it's entirely one colour (which would otherwise trim down to nothing).
+func TrimBorders(src image.Image, tolerance int) image.Image {
+	bounds := src.Bounds()
+	if bounds.Empty() {
+		return src
+	}
+	border := color.NRGBAModel.Convert(src.At(bounds.Min.X, bounds.Min.Y)).(color.NRGBA)
+	matches := func(x int, y int) bool {
+		c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+		if c.A == 0 && border.A == 0 {
+			return true
+		}
+		return withinTolerance(c.R, border.R, tolerance) && withinTolerance(c.G, border.G, tolerance) &&
+			withinTolerance(c.B, border.B, tolerance) && withinTolerance(c.A, border.A, tolerance)
+	}
+	rowMatches := func(y int) bool {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if !matches(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	top := bounds.Min.Y
+	for top < bounds.Max.Y && rowMatches(top) {
+		top++
+	}
+	if top == bounds.Max.Y {
+		return src // all one colour
+	}
+	bottom := bounds.Max.Y
+	for bottom > top && rowMatches(bottom-1) {
+		bottom--
+	}
+
+	colMatches := func(x int) bool {
+		for y := top; y < bottom; y++ {
+			if !matches(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	left := bounds.Min.X
+	for left < bounds.Max.X && colMatches(left) {
+		left++
+	}
+	right := bounds.Max.X
+	for right > left && colMatches(right-1) {
+		right--
+	}
+
+	trimmed := image.Rect(left, top, right, bottom)
+	if trimmed.Eq(bounds) {
+		return src
+	}
+	return imaging.Crop(src, trimmed)
+}
+
+func withinTolerance(a uint8, b uint8, tolerance int) bool {
+	d := int(a) - int(b)
+	return d <= tolerance && d >= -tolerance
+}
@@ -0,0 +1,5 @@
+package thumbnailing
+
+// GeneratorVersion is recorded with each stored thumbnail. Increase it when a change to the generators makes
+// noticeably better thumbnails, so operators can regenerate older ones with `thumbnails.minGeneratorVersion`.
+const GeneratorVersion = 3
@@ -1,5 +1,29 @@
 package m
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var ErrPreviewUnsupported = errors.New("preview not supported by this previewer")
+var ErrRedirectWithoutLocation = errors.New("redirect without a usable Location header")
+var ErrCrossSchemeRedirect = errors.New("redirect to a different scheme is not allowed")
+var ErrImageTypeNotAllowed = errors.New("image type not allowed for previews")
+
+// ErrUnexpectedStatus is returned when the remote server responds with a status code the previewer
+// cannot handle.
+type ErrUnexpectedStatus struct {
+	StatusCode int
+}
+
+func (e ErrUnexpectedStatus) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+}
+
+// ErrOriginRateLimited is returned when the remote server has rate limited the previewer, either on this request
+// or recently enough that its host is still being left alone.
+var ErrOriginRateLimited = errors.New("remote server is rate limiting previews, try again later")
+
+// ErrTransferFailed is returned when the page stopped downloading part way through for a reason other than
+// reaching the size limit, like the connection dropping.
+var ErrTransferFailed = errors.New("transfer of the page failed")
@@ -1,6 +1,11 @@
 package m
 
-import "io"
+import (
+	"errors"
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common"
+)
 
 type PreviewResult struct {
 	Url         string
@@ -9,6 +14,42 @@ type PreviewResult struct {
 	Description string
 	Title       string
 	Image       *PreviewImage
+	ExtraImages []*PreviewImage
+
+	// Only populated when the URL points directly at a file
+	FileType string
+	FileSize int64
+
+	// Problems which didn't stop the preview from being generated, but may have left parts out. See AddWarning.
+	Warnings []string
+}
+
+// Warnings for PreviewResult. These are deliberately vague as they are shown to users, and the underlying errors
+// can reveal details about the network the media repo is in.
+const (
+	WarningImageFailed    = "image_failed"
+	WarningImageTooLarge  = "image_too_large"
+	WarningOEmbedFailed   = "oembed_failed"
+	WarningCharsetGuessed = "charset_guessed"
+	WarningPagePartial    = "page_partial"
+)
+
+// AddWarning appends the warning if it isn't already in the list.
+func AddWarning(warnings []string, warning string) []string {
+	for _, w := range warnings {
+		if w == warning {
+			return warnings
+		}
+	}
+	return append(warnings, warning)
+}
+
+// ImageWarning is the warning for an image which couldn't be downloaded or stored because of the error.
+func ImageWarning(err error) string {
+	if errors.Is(err, common.ErrMediaTooLarge) {
+		return WarningImageTooLarge
+	}
+	return WarningImageFailed
 }
 
 type PreviewImage struct {
@@ -16,3 +57,10 @@ type PreviewImage struct {
 	Data        io.ReadCloser
 	Filename    string
 }
+
+type PreviewFile struct {
+	ContentType string
+	Data        io.ReadCloser
+	Filename    string
+	SizeBytes   int64
+}
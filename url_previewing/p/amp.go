@@ -0,0 +1,106 @@
+package p
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/dyatlov/go-opengraph/opengraph"
+	ogimage "github.com/dyatlov/go-opengraph/opengraph/types/image"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/url_previewing/m"
+	"github.com/t2bot/matrix-media-repo/url_previewing/u"
+)
+
+// isMetadataPoor returns true if the page is missing some of what a preview is made from, as often happens with
+// pages which render their metadata with JavaScript.
+func isMetadataPoor(og *opengraph.OpenGraph) bool {
+	return og.Title == "" || og.Description == "" || len(og.Images) == 0
+}
+
+// findAmpUrl returns the URL of the page's AMP version, if it links to one which isn't itself.
+func findAmpUrl(html string, pageUrl *url.URL) *url.URL {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		return nil
+	}
+
+	var ampUrl *url.URL
+	doc.Find("link[rel]").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		rel, _ := s.Attr("rel")
+		href, exists := s.Attr("href")
+		if !exists || href == "" {
+			return true
+		}
+		for _, r := range strings.Fields(strings.ToLower(rel)) {
+			if r == "amphtml" {
+				if parsed, err := url.Parse(strings.TrimSpace(href)); err == nil {
+					ampUrl = pageUrl.ResolveReference(parsed)
+				}
+				return false
+			}
+		}
+		return true
+	})
+	if ampUrl == nil || (ampUrl.Scheme != "http" && ampUrl.Scheme != "https") || ampUrl.String() == pageUrl.String() {
+		return nil
+	}
+	return ampUrl
+}
+
+// downloadAmpPage fetches the page's AMP version, returning its HTML and OpenGraph metadata. Image URLs are made
+// absolute, as they're relative to the AMP page rather than the page being previewed. Failures are logged and
+// otherwise ignored, as the page can still be previewed without it.
+func downloadAmpPage(ampUrl *url.URL, languageHeader string, ctx rcontext.RequestContext) (string, *opengraph.OpenGraph) {
+	ctx.Log.Debug("Fetching AMP version of page: ", ampUrl.String())
+	// The AMP page is fetched like any other, so is subject to the same network restrictions and size limits
+	html, _, err := u.DownloadHtmlContentWithWarnings(&m.UrlPayload{
+		UrlString: ampUrl.String(),
+		ParsedUrl: ampUrl,
+	}, ogSupportedTypes, languageHeader, ctx)
+	if err != nil {
+		ctx.Log.Debug("Non-fatal error fetching AMP page: ", err)
+		return "", nil
+	}
+	og := opengraph.NewOpenGraph()
+	if err = og.ProcessHTML(strings.NewReader(html)); err != nil {
+		ctx.Log.Debug("Non-fatal error getting OpenGraph from AMP page: ", err)
+		return "", nil
+	}
+	og.Images = absoluteImages(og.Images, ampUrl)
+	return html, og
+}
+
+func absoluteImages(images []*ogimage.Image, base *url.URL) []*ogimage.Image {
+	for _, img := range images {
+		if img == nil {
+			continue
+		}
+		if parsed, err := url.Parse(img.URL); err == nil {
+			img.URL = base.ResolveReference(parsed).String()
+		}
+	}
+	return images
+}
+
+// mergeOpenGraph fills in whatever the page is missing from its AMP version.
+func mergeOpenGraph(og *opengraph.OpenGraph, amp *opengraph.OpenGraph) {
+	if og.Title == "" {
+		og.Title = amp.Title
+	}
+	if og.Description == "" {
+		og.Description = amp.Description
+	}
+	if og.SiteName == "" {
+		og.SiteName = amp.SiteName
+	}
+	if og.Type == "" {
+		og.Type = amp.Type
+	}
+	if og.URL == "" {
+		og.URL = amp.URL
+	}
+	if len(og.Images) == 0 {
+		og.Images = amp.Images
+	}
+}
@@ -2,6 +2,9 @@ package p
 
 import (
 	"errors"
+	"mime"
+	"path"
+	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/t2bot/matrix-media-repo/common"
@@ -12,8 +15,17 @@ import (
 	"github.com/t2bot/matrix-media-repo/url_previewing/u"
 )
 
+// anyFileType matches every file which has a content type, but not a missing one.
+var anyFileType = []string{"*/*"}
+
+// GenerateCalculatedPreview describes a URL which points directly at a file, such as an image or PDF. When
+// unsupported file links are enabled, files of any other type are described too, but never get an image.
 func GenerateCalculatedPreview(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (m.PreviewResult, error) {
-	r, filename, contentType, err := u.DownloadRawContent(urlPayload, ctx.Config.UrlPreviews.FilePreviewTypes, languageHeader, ctx)
+	supportedTypes := ctx.Config.UrlPreviews.FilePreviewTypes
+	if ctx.Config.UrlPreviews.UnsupportedFileLinks {
+		supportedTypes = anyFileType
+	}
+	file, err := u.DownloadFile(urlPayload, supportedTypes, languageHeader, ctx)
 	if err != nil {
 		ctx.Log.Warn("Error downloading content: ", err)
 
@@ -22,20 +34,29 @@ func GenerateCalculatedPreview(urlPayload *m.UrlPayload, languageHeader string,
 			return m.PreviewResult{}, m.ErrPreviewUnsupported
 		}
 
+		// ... and rate limiting, so it isn't cached as a missing page
+		if errors.Is(err, m.ErrOriginRateLimited) {
+			return m.PreviewResult{}, err
+		}
+
 		// We'll consider it not found for the sake of processing
 		return m.PreviewResult{}, common.ErrMediaNotFound
 	}
 
-	img := &m.PreviewImage{
-		Data:        r,
-		ContentType: contentType,
-		Filename:    filename,
+	contentType := file.ContentType
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+
+	name := file.Filename
+	if name == "" {
+		name = filenameFromUrl(urlPayload)
 	}
 
 	description := ""
-	filename = urlPayload.ParsedUrl.String()
-	if img != nil && img.Filename != "" {
-		filename = img.Filename
+	filename := urlPayload.ParsedUrl.String()
+	if name != "" {
+		filename = name
 	} else {
 		description = urlPayload.ParsedUrl.String()
 	}
@@ -51,14 +72,34 @@ func GenerateCalculatedPreview(urlPayload *m.UrlPayload, languageHeader string,
 		Title:       u.Summarize(filename, ctx.Config.UrlPreviews.NumTitleWords, ctx.Config.UrlPreviews.MaxTitleLength),
 		Description: u.Summarize(description, ctx.Config.UrlPreviews.NumWords, ctx.Config.UrlPreviews.MaxLength),
 		SiteName:    "", // intentionally empty
+		FileType:    contentType,
+		FileSize:    file.SizeBytes,
+	}
+	if result.FileSize < 0 {
+		result.FileSize = 0 // unknown
 	}
 
-	if thumbnailing.IsSupported(img.ContentType) {
-		result.Image = img
+	// Only images are used as the preview's image. Other files, like videos, would otherwise be stored whole.
+	tooLarge := ctx.Config.UrlPreviews.MaxPageSizeBytes > 0 && file.SizeBytes > ctx.Config.UrlPreviews.MaxPageSizeBytes
+	previewable := u.MatchesAnyType(ctx.Config.UrlPreviews.FilePreviewTypes, contentType)
+	if previewable && strings.HasPrefix(contentType, "image/") && thumbnailing.IsSupported(contentType) && !u.IsSkippedSvg(contentType, ctx) && !tooLarge {
+		result.Image = &m.PreviewImage{
+			Data:        file.Data,
+			ContentType: contentType,
+			Filename:    name,
+		}
 	} else {
-		defer img.Data.Close()
+		defer file.Data.Close()
 	}
 
 	metrics.UrlPreviewsGenerated.With(prometheus.Labels{"type": "calculated"}).Inc()
 	return *result, nil
 }
+
+func filenameFromUrl(urlPayload *m.UrlPayload) string {
+	name := path.Base(urlPayload.ParsedUrl.Path)
+	if name == "/" || name == "." || path.Ext(name) == "" {
+		return ""
+	}
+	return name
+}
@@ -2,6 +2,7 @@ package p
 
 import (
 	"bytes"
+	"errors"
 	"net/url"
 	"os"
 	"path"
@@ -68,11 +69,21 @@ func GenerateOEmbedPreview(urlPayload *m.UrlPayload, languageHeader string, ctx
 		info.ThumbnailURL = info.URL
 	}
 
+	if ctx.Config.UrlPreviews.NormalizeText {
+		info.Title = u.NormalizeEncodedText(info.Title)
+		if info.Type == "rich" {
+			info.Description = u.NormalizeText(info.Description) // already decoded while converting the HTML
+		} else {
+			info.Description = u.NormalizeEncodedText(info.Description)
+		}
+		info.ProviderName = u.NormalizeEncodedText(info.ProviderName)
+	}
+
 	graph := &m.PreviewResult{
 		Type:        info.Type,
 		Url:         info.URL,
-		Title:       info.Title,
-		Description: info.Description,
+		Title:       u.Summarize(info.Title, ctx.Config.UrlPreviews.NumTitleWords, ctx.Config.UrlPreviews.MaxTitleLength),
+		Description: u.Summarize(info.Description, ctx.Config.UrlPreviews.NumWords, ctx.Config.UrlPreviews.MaxLength),
 		SiteName:    info.ProviderName,
 	}
 
@@ -91,9 +102,14 @@ func GenerateOEmbedPreview(urlPayload *m.UrlPayload, languageHeader string, ctx
 		}
 
 		img, err := u.DownloadImage(imgUrlPayload, languageHeader, ctx)
+		if errors.Is(err, m.ErrImageTypeNotAllowed) {
+			ctx.Log.Debug("Skipping image: ", err)
+			return *graph, nil
+		}
 		if err != nil {
 			ctx.Log.Error("Non-fatal error getting thumbnail (downloading image): ", err)
 			sentry.CaptureException(err)
+			graph.Warnings = m.AddWarning(graph.Warnings, m.ImageWarning(err))
 			return *graph, nil
 		}
 
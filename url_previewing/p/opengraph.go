@@ -22,7 +22,7 @@ import (
 var ogSupportedTypes = []string{"text/*"}
 
 func GenerateOpenGraphPreview(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (m.PreviewResult, error) {
-	html, err := u.DownloadHtmlContent(urlPayload, ogSupportedTypes, languageHeader, ctx)
+	html, warnings, err := u.DownloadHtmlContentWithWarnings(urlPayload, ogSupportedTypes, languageHeader, ctx)
 	if err != nil {
 		ctx.Log.Error("Error downloading content: ", err)
 
@@ -31,6 +31,11 @@ func GenerateOpenGraphPreview(urlPayload *m.UrlPayload, languageHeader string, c
 			return m.PreviewResult{}, m.ErrPreviewUnsupported
 		}
 
+		// ... and rate limiting or failed transfers, so they aren't cached as a missing page
+		if errors.Is(err, m.ErrOriginRateLimited) || errors.Is(err, m.ErrTransferFailed) {
+			return m.PreviewResult{}, err
+		}
+
 		// We'll consider it not found for the sake of processing
 		return m.PreviewResult{}, common.ErrMediaNotFound
 	}
@@ -42,15 +47,46 @@ func GenerateOpenGraphPreview(urlPayload *m.UrlPayload, languageHeader string, c
 		return m.PreviewResult{}, err
 	}
 
+	// Pages which are missing metadata might have it in their AMP version, which is preferred over guessing it
+	ampHtml := ""
+	var ampUrl *url.URL
+	if ctx.Config.UrlPreviews.PreferAmp && isMetadataPoor(og) {
+		if ampUrl = findAmpUrl(html, urlPayload.ParsedUrl); ampUrl != nil {
+			var ampOg *opengraph.OpenGraph
+			ampHtml, ampOg = downloadAmpPage(ampUrl, languageHeader, ctx)
+			if ampOg != nil {
+				mergeOpenGraph(og, ampOg)
+			}
+		}
+	}
+
 	if og.Title == "" {
 		og.Title = calcTitle(html)
 	}
+	if og.Title == "" && ampHtml != "" {
+		og.Title = calcTitle(ampHtml)
+	}
 	if og.Description == "" {
 		og.Description = calcDescription(html)
 	}
+	if og.Description == "" && ampHtml != "" {
+		og.Description = calcDescription(ampHtml)
+	}
 	if len(og.Images) == 0 {
 		og.Images = calcImages(html)
 	}
+	if len(og.Images) == 0 && ampHtml != "" {
+		og.Images = absoluteImages(calcImages(ampHtml), ampUrl)
+	}
+	if len(og.Images) == 0 && ctx.Config.UrlPreviews.FaviconFallback {
+		og.Images = calcFavicon(html)
+	}
+
+	if ctx.Config.UrlPreviews.NormalizeText {
+		og.Title = u.NormalizeText(og.Title)
+		og.Description = u.NormalizeText(og.Description)
+		og.SiteName = u.NormalizeText(og.SiteName)
+	}
 
 	// Be sure to trim the title and description
 	og.Title = u.Summarize(og.Title, ctx.Config.UrlPreviews.NumTitleWords, ctx.Config.UrlPreviews.MaxTitleLength)
@@ -62,30 +98,64 @@ func GenerateOpenGraphPreview(urlPayload *m.UrlPayload, languageHeader string, c
 		Title:       og.Title,
 		Description: og.Description,
 		SiteName:    og.SiteName,
+		Warnings:    warnings,
 	}
 
 	if og.Images != nil && len(og.Images) > 0 {
-		imgUrl, err := url.Parse(og.Images[0].URL)
-		if err != nil {
-			ctx.Log.Error("Non-fatal error getting thumbnail (parsing image url): ", err)
-			sentry.CaptureException(err)
-			return *graph, nil
+		// Only the first image is used unless a gallery was requested. Images of types which aren't allowed are
+		// skipped without counting towards this, as we don't download them.
+		maxAttempts := 1
+		maxImages := 1
+		if ctx.Config.UrlPreviews.Gallery.Enabled && ctx.Config.UrlPreviews.Gallery.MaxImages > 1 {
+			maxAttempts = len(og.Images)
+			maxImages = ctx.Config.UrlPreviews.Gallery.MaxImages
 		}
 
-		imgAbsUrl := urlPayload.ParsedUrl.ResolveReference(imgUrl)
-		imgUrlPayload := &m.UrlPayload{
-			UrlString: imgAbsUrl.String(),
-			ParsedUrl: imgAbsUrl,
+		images := make([]*m.PreviewImage, 0)
+		seen := make(map[string]bool)
+		attempts := 0
+		for _, candidate := range og.Images {
+			if len(images) >= maxImages || attempts >= maxAttempts {
+				break
+			}
+			if candidate == nil || seen[candidate.URL] {
+				continue
+			}
+			seen[candidate.URL] = true
+
+			imgUrl, err := url.Parse(candidate.URL)
+			if err != nil {
+				ctx.Log.Error("Non-fatal error getting thumbnail (parsing image url): ", err)
+				sentry.CaptureException(err)
+				continue
+			}
+
+			imgAbsUrl := urlPayload.ParsedUrl.ResolveReference(imgUrl)
+			imgUrlPayload := &m.UrlPayload{
+				UrlString: imgAbsUrl.String(),
+				ParsedUrl: imgAbsUrl,
+			}
+
+			img, err := u.DownloadImage(imgUrlPayload, languageHeader, ctx)
+			if errors.Is(err, m.ErrImageTypeNotAllowed) {
+				ctx.Log.Debug("Skipping image: ", err)
+				continue
+			}
+			attempts++
+			if err != nil {
+				ctx.Log.Error("Non-fatal error getting thumbnail (downloading image): ", err)
+				sentry.CaptureException(err)
+				graph.Warnings = m.AddWarning(graph.Warnings, m.ImageWarning(err))
+				continue
+			}
+
+			images = append(images, img)
 		}
 
-		img, err := u.DownloadImage(imgUrlPayload, languageHeader, ctx)
-		if err != nil {
-			ctx.Log.Error("Non-fatal error getting thumbnail (downloading image): ", err)
-			sentry.CaptureException(err)
-			return *graph, nil
+		if len(images) > 0 {
+			graph.Image = images[0]
+			graph.ExtraImages = images[1:]
 		}
-
-		graph.Image = img
 	}
 
 	metrics.UrlPreviewsGenerated.With(prometheus.Labels{"type": "opengraph"}).Inc()
@@ -188,3 +258,30 @@ func calcImages(html string) []*ogimage.Image {
 	img := ogimage.Image{URL: imageSrc}
 	return []*ogimage.Image{&img}
 }
+
+func calcFavicon(html string) []*ogimage.Image {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		return []*ogimage.Image{}
+	}
+
+	// Browsers fall back to /favicon.ico when the page doesn't declare an icon, so we do too
+	iconSrc := "/favicon.ico"
+	doc.Find("link[rel]").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		rel, _ := s.Attr("rel")
+		href, exists := s.Attr("href")
+		if !exists || href == "" {
+			return true
+		}
+		for _, r := range strings.Fields(strings.ToLower(rel)) {
+			if r == "icon" {
+				iconSrc = href
+				return false
+			}
+		}
+		return true
+	})
+
+	img := ogimage.Image{URL: iconSrc}
+	return []*ogimage.Image{&img}
+}
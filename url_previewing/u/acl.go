@@ -2,6 +2,8 @@ package u
 
 import (
 	"net"
+	"slices"
+	"strconv"
 
 	"github.com/getsentry/sentry-go"
 
@@ -18,9 +20,14 @@ func getSafeAddress(addr string, ctx rcontext.RequestContext) (net.IP, string, e
 		realHost = addr
 	}
 
+	if !isPortAllowed(p, ctx.Config.UrlPreviews.AllowedPorts) {
+		ctx.Log.Debug("Port not allowed: ", p)
+		return nil, "", common.ErrPortNotAllowed
+	}
+
 	ipAddr := net.IPv4(127, 0, 0, 1)
 	if realHost != "localhost" {
-		addrs, err := net.LookupIP(realHost)
+		addrs, err := getResolver(ctx).LookupIP(ctx, "ip", realHost)
 		if err != nil {
 			ctx.Log.Debug("Error looking up DNS record for preview - assuming invalid host:", err)
 			return nil, "", common.ErrInvalidHost
@@ -50,6 +57,17 @@ func getSafeAddress(addr string, ctx rcontext.RequestContext) (net.IP, string, e
 	return ipAddr, p, nil
 }
 
+func isPortAllowed(port string, allowed []int) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(allowed, n)
+}
+
 func isAllowed(ip net.IP, allowed []string, disallowed []string, ctx rcontext.RequestContext) bool {
 	ctx.Log.Debug("Validating host")
 
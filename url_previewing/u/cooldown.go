@@ -0,0 +1,104 @@
+package u
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/url_previewing/m"
+)
+
+// hostCooldowns tracks when each rate limited host may be contacted again. It is shared by all domains, as they
+// all preview from the same address.
+var hostCooldowns = &cooldowns{until: make(map[string]time.Time)}
+
+type cooldowns struct {
+	lock  sync.Mutex
+	until map[string]time.Time
+}
+
+// remaining returns how long the host is still cooling down for, or zero if it isn't.
+func (c *cooldowns) remaining(host string, now time.Time) time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	until, ok := c.until[host]
+	if !ok {
+		return 0
+	}
+	if !now.Before(until) {
+		delete(c.until, host)
+		return 0
+	}
+	return until.Sub(now)
+}
+
+func (c *cooldowns) set(host string, until time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if existing, ok := c.until[host]; !ok || until.After(existing) {
+		c.until[host] = until
+	}
+}
+
+// cooldownTransport stops requests to hosts which have recently responded with 429 Too Many Requests, and starts
+// the cooldown when they do. Like credentialsTransport, this applies to each request including redirects.
+type cooldownTransport struct {
+	next http.RoundTripper
+	conf config.UrlPreviewBackoffConfig
+}
+
+func withCooldowns(next http.RoundTripper, conf config.UrlPreviewBackoffConfig) http.RoundTripper {
+	if !conf.Enabled {
+		return next
+	}
+	return &cooldownTransport{next: next, conf: conf}
+}
+
+func (t *cooldownTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	if wait := hostCooldowns.remaining(host, time.Now()); wait > 0 {
+		return nil, fmt.Errorf("%w (%s for another %s)", m.ErrOriginRateLimited, host, wait.Round(time.Second))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	_ = resp.Body.Close()
+
+	now := time.Now()
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		wait = time.Duration(t.conf.DefaultSeconds) * time.Second
+	}
+	if maxWait := time.Duration(t.conf.MaxSeconds) * time.Second; t.conf.MaxSeconds > 0 && wait > maxWait {
+		wait = maxWait
+	}
+	hostCooldowns.set(host, now.Add(wait))
+	return nil, fmt.Errorf("%w (%s asked to wait %s)", m.ErrOriginRateLimited, host, wait.Round(time.Second))
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(val string, now time.Time) (time.Duration, bool) {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(val); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(val); err == nil {
+		if !at.After(now) {
+			return 0, true
+		}
+		return at.Sub(now), true
+	}
+	return 0, false
+}
@@ -0,0 +1,71 @@
+package u
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+// credentialsTransport adds the configured credentials to requests for matching hosts. This happens for each
+// request the client makes, including redirects, so credentials for one host are never sent to another.
+type credentialsTransport struct {
+	next        http.RoundTripper
+	credentials []config.UrlPreviewCredentials
+}
+
+func withCredentials(next http.RoundTripper, credentials []config.UrlPreviewCredentials) http.RoundTripper {
+	if len(credentials) == 0 {
+		return next
+	}
+	return &credentialsTransport{next: next, credentials: credentials}
+}
+
+func (t *credentialsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds := findCredentials(req.URL, t.credentials)
+
+	// The client copies headers from the original request to redirects, so make sure nothing leaks through
+	// that way either.
+	req = req.Clone(req.Context())
+	req.Header.Del("Authorization")
+	if creds != nil {
+		if creds.BearerToken != "" {
+			req.Header.Set("Authorization", "Bearer "+creds.BearerToken)
+		} else {
+			req.SetBasicAuth(creds.Username, creds.Password)
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// findCredentials returns the credentials configured for the URL's origin, if any. The scheme, host, and port must
+// all match exactly. Credentials without a scheme are for https, and hosts without a port are on the scheme's
+// default port.
+func findCredentials(u *url.URL, credentials []config.UrlPreviewCredentials) *config.UrlPreviewCredentials {
+	scheme := strings.ToLower(u.Scheme)
+	host := withDefaultPort(u.Host, scheme)
+	for i, c := range credentials {
+		credScheme := strings.ToLower(c.Scheme)
+		if credScheme == "" {
+			credScheme = "https"
+		}
+		if credScheme == scheme && strings.EqualFold(withDefaultPort(c.Host, credScheme), host) {
+			return &credentials[i]
+		}
+	}
+	return nil
+}
+
+// withDefaultPort returns the host as host:port, using the scheme's default port if the host doesn't have one.
+func withDefaultPort(host string, scheme string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "443"
+	if scheme == "http" {
+		port = "80"
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
@@ -0,0 +1,49 @@
+package u
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	thumbu "github.com/t2bot/matrix-media-repo/thumbnailing/u"
+	"github.com/t2bot/matrix-media-repo/url_previewing/m"
+	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+var icoContentTypes = []string{"image/x-icon", "image/vnd.microsoft.icon"}
+
+func isIco(contentType string) bool {
+	return util.ArrayContains(icoContentTypes, util.FixContentType(contentType))
+}
+
+// convertIco picks the embedded image from a (potentially multi-resolution) icon which best matches the
+// configured favicon size, and returns it as a PNG.
+func convertIco(image *m.PreviewImage, ctx rcontext.RequestContext) (*m.PreviewImage, error) {
+	defer image.Data.Close()
+
+	var r io.Reader = image.Data
+	if ctx.Config.UrlPreviews.MaxPageSizeBytes > 0 {
+		r = readers.LimitReaderWithOverrunError(image.Data, ctx.Config.UrlPreviews.MaxPageSizeBytes)
+	}
+	ico, err := thumbu.ReadIco(r)
+	if err != nil {
+		return nil, err
+	}
+	img, err := ico.Decode(ctx.Config.UrlPreviews.PreferredFaviconSize)
+	if err != nil {
+		return nil, errors.New("error decoding icon: " + err.Error())
+	}
+
+	b := &bytes.Buffer{}
+	if err = thumbu.Encode(ctx, b, img); err != nil {
+		return nil, errors.New("error encoding icon: " + err.Error())
+	}
+
+	return &m.PreviewImage{
+		ContentType: "image/png",
+		Data:        io.NopCloser(b),
+		Filename:    image.Filename,
+	}, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"mime"
 	"net"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/ryanuber/go-glob"
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/url_previewing/m"
 	"github.com/t2bot/matrix-media-repo/util"
@@ -37,6 +39,8 @@ func doHttpGet(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext.Req
 			return nil, err
 		}
 
+		// Dial the address we just checked rather than the hostname, otherwise the host could resolve to
+		// somewhere else by the time we connect (DNS rebinding).
 		return dialer.DialContext(ctx2, network, net.JoinHostPort(safeIp.String(), safePort))
 	}
 
@@ -48,7 +52,7 @@ func doHttpGet(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext.Req
 			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
 			// Based on https://github.com/matrix-org/gomatrixserverlib/blob/51152a681e69a832efcd934b60080b92bc98b286/client.go#L74-L90
 			DialTLSContext: func(ctx2 context.Context, network, addr string) (net.Conn, error) {
-				rawconn, err := net.Dial(network, addr)
+				rawconn, err := dialContext(ctx2, network, addr)
 				if err != nil {
 					return nil, err
 				}
@@ -77,45 +81,112 @@ func doHttpGet(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext.Req
 		}
 	}
 
+	if !ctx.Config.UrlPreviews.AllowCrossSchemeRedirect {
+		client.CheckRedirect = checkSameSchemeRedirect
+	}
+	client.Transport = withCredentials(client.Transport, ctx.Config.UrlPreviews.Credentials)
+	client.Transport = withCooldowns(client.Transport, ctx.Config.UrlPreviews.RateLimitedOrigins)
+
 	req, err := http.NewRequest("GET", urlPayload.ParsedUrl.String(), nil)
 	if err != nil {
 		return nil, err
 	}
+	for name, value := range ctx.Config.UrlPreviews.ExtraHeaders {
+		if config.IsProtectedPreviewHeader(name) {
+			continue // already warned about when the config was loaded
+		}
+		req.Header.Set(name, value)
+	}
+	if ctx.Config.UrlPreviews.Referer != "" {
+		req.Header.Set("Referer", ctx.Config.UrlPreviews.Referer)
+	}
 	req.Header.Set("User-Agent", ctx.Config.UrlPreviews.UserAgent)
 	req.Header.Set("Accept-Language", languageHeader)
-	return client.Do(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client hands back redirects it can't follow as-is, so we treat them as a terminal failure
+	if isRedirect(resp.StatusCode) && resp.Header.Get("Location") == "" {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w (status %d)", m.ErrRedirectWithoutLocation, resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
+// checkSameSchemeRedirect follows redirects like the default policy, except for those which switch between http
+// and https.
+func checkSameSchemeRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	prev := via[len(via)-1]
+	if req.URL.Scheme != prev.URL.Scheme {
+		return fmt.Errorf("%w (%s to %s)", m.ErrCrossSchemeRedirect, prev.URL.Redacted(), req.URL.Redacted())
+	}
+	return nil
+}
+
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
 }
 
 func DownloadRawContent(urlPayload *m.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) (io.ReadCloser, string, string, error) {
+	file, err := DownloadFile(urlPayload, supportedTypes, languageHeader, ctx)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if ctx.Config.UrlPreviews.MaxPageSizeBytes > 0 && file.SizeBytes > ctx.Config.UrlPreviews.MaxPageSizeBytes {
+		_ = file.Data.Close()
+		return nil, "", "", common.ErrMediaTooLarge
+	}
+
+	return file.Data, file.Filename, file.ContentType, nil
+}
+
+// DownloadFile fetches the URL without rejecting it for being too large. The returned data is limited to the
+// maximum page size, and SizeBytes is -1 if the remote server didn't say how large the file is.
+func DownloadFile(urlPayload *m.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) (*m.PreviewFile, error) {
 	ctx.Log.Info("Fetching remote content...")
 	resp, err := doHttpGet(urlPayload, languageHeader, ctx)
 	if err != nil {
-		return nil, "", "", err
+		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
 		ctx.Log.Warn("Received status code " + strconv.Itoa(resp.StatusCode))
-		return nil, "", "", errors.New("error during transfer")
+		_ = resp.Body.Close()
+		return nil, m.ErrUnexpectedStatus{StatusCode: resp.StatusCode}
 	}
 
-	if ctx.Config.UrlPreviews.MaxPageSizeBytes > 0 && resp.ContentLength >= 0 && resp.ContentLength > ctx.Config.UrlPreviews.MaxPageSizeBytes {
-		return nil, "", "", common.ErrMediaTooLarge
+	contentType, body, err := sniffContentType(resp.Header.Get("Content-Type"), resp.Body, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", m.ErrTransferFailed, err)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	if !MatchesAnyType(supportedTypes, mediaType) {
+		_ = body.Close()
+		return nil, m.ErrPreviewUnsupported
 	}
 
-	var reader io.ReadCloser
+	var reader io.ReadCloser = body
 	if ctx.Config.UrlPreviews.MaxPageSizeBytes > 0 {
-		lr := io.LimitReader(resp.Body, ctx.Config.UrlPreviews.MaxPageSizeBytes)
+		lr := io.LimitReader(body, ctx.Config.UrlPreviews.MaxPageSizeBytes)
 		reader = readers.NewCancelCloser(io.NopCloser(lr), func() {
-			resp.Body.Close()
+			body.Close()
 		})
 	}
 
-	contentType := resp.Header.Get("Content-Type")
-	for _, supportedType := range supportedTypes {
-		if !glob.Glob(supportedType, contentType) {
-			return nil, "", "", m.ErrPreviewUnsupported
-		}
-	}
-
 	disposition := resp.Header.Get("Content-Disposition")
 	_, params, _ := mime.ParseMediaType(disposition)
 	filename := ""
@@ -123,21 +194,45 @@ func DownloadRawContent(urlPayload *m.UrlPayload, supportedTypes []string, langu
 		filename = params["filename"]
 	}
 
-	return reader, filename, contentType, nil
+	return &m.PreviewFile{
+		Data:        reader,
+		ContentType: contentType,
+		Filename:    filename,
+		SizeBytes:   resp.ContentLength,
+	}, nil
 }
 
 func DownloadHtmlContent(urlPayload *m.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) (string, error) {
+	html, _, err := DownloadHtmlContentWithWarnings(urlPayload, supportedTypes, languageHeader, ctx)
+	return html, err
+}
+
+// DownloadHtmlContentWithWarnings is DownloadHtmlContent, but also returns warnings about the page itself, like
+// its character set having to be guessed.
+func DownloadHtmlContentWithWarnings(urlPayload *m.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) (string, []string, error) {
 	r, _, contentType, err := DownloadRawContent(urlPayload, supportedTypes, languageHeader, ctx)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-	html := ""
 	defer r.Close()
-	raw, _ := io.ReadAll(r)
-	if raw != nil {
-		html = util.ToUtf8(string(raw), contentType)
+
+	var warnings []string
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		// Pages cut off at maxPageSizeBytes end cleanly, so this is the transfer failing part way through. What
+		// we have might be missing everything the preview would be made from.
+		if !ctx.Config.UrlPreviews.AllowPartialPages || len(raw) == 0 {
+			return "", nil, fmt.Errorf("%w: %w", m.ErrTransferFailed, err)
+		}
+		ctx.Log.Warn("Previewing partial page after the transfer failed: ", err)
+		warnings = m.AddWarning(warnings, m.WarningPagePartial)
 	}
-	return html, nil
+
+	html, guessed := util.ToUtf8WithGuess(string(raw), contentType)
+	if guessed {
+		warnings = m.AddWarning(warnings, m.WarningCharsetGuessed)
+	}
+	return html, warnings, nil
 }
 
 func DownloadImage(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (*m.PreviewImage, error) {
@@ -148,12 +243,25 @@ func DownloadImage(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext
 	}
 	if resp.StatusCode != http.StatusOK {
 		ctx.Log.Warn("Received status code " + strconv.Itoa(resp.StatusCode))
-		return nil, errors.New("error during transfer")
+		_ = resp.Body.Close()
+		return nil, m.ErrUnexpectedStatus{StatusCode: resp.StatusCode}
+	}
+
+	// Check the type before reading any more than needed to sniff it, so we don't spend resources on images we
+	// can't use
+	contentType, body, err := sniffContentType(resp.Header.Get("Content-Type"), resp.Body, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", m.ErrTransferFailed, err)
+	}
+	if !isAllowedImageType(contentType, ctx) {
+		ctx.Log.Debug("Image type not allowed: ", contentType)
+		_ = body.Close()
+		return nil, m.ErrImageTypeNotAllowed
 	}
 
 	image := &m.PreviewImage{
-		ContentType: resp.Header.Get("Content-Type"),
-		Data:        resp.Body,
+		ContentType: contentType,
+		Data:        body,
 	}
 
 	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
@@ -161,5 +269,37 @@ func DownloadImage(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext
 		image.Filename = params["filename"]
 	}
 
+	if isIco(image.ContentType) {
+		return convertIco(image, ctx)
+	}
+
 	return image, nil
 }
+
+// isAllowedImageType returns true if the content type matches one of the configured image types. Icons are also
+// allowed while favicons are used as a fallback, as they're converted to PNG anyway. SVGs which can't be rasterized
+// are allowed only by `svgImages`.
+func isAllowedImageType(contentType string, ctx rcontext.RequestContext) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	if IsSvg(mediaType) && !CanRasterizeSvg(ctx) {
+		return !IsSkippedSvg(mediaType, ctx)
+	}
+	if ctx.Config.UrlPreviews.FaviconFallback && isIco(mediaType) {
+		return true
+	}
+	return MatchesAnyType(ctx.Config.UrlPreviews.AllowedImageTypes, mediaType)
+}
+
+// MatchesAnyType returns true if the media type (without parameters) matches one of the patterns, which may
+// contain wildcards like "image/*".
+func MatchesAnyType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		if glob.Glob(pattern, mediaType) {
+			return true
+		}
+	}
+	return false
+}
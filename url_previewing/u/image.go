@@ -0,0 +1,63 @@
+package u
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/url_previewing/m"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// ResizeImage scales the preview image down to fit within the configured preview image size, preserving
+// the aspect ratio. If the image can't or shouldn't be resized, an image with the original contents is
+// returned. The supplied image should not be used after calling this.
+func ResizeImage(image *m.PreviewImage, ctx rcontext.RequestContext) *m.PreviewImage {
+	size := ctx.Config.UrlPreviews.ImageThumbnailSize
+	if size.Width <= 0 || size.Height <= 0 || !thumbnailing.IsSupported(image.ContentType) || (IsSvg(image.ContentType) && !CanRasterizeSvg(ctx)) {
+		return image
+	}
+
+	// Buffer up to the thumbnailer's limit so we can fall back to the original if needed
+	var r io.Reader = image.Data
+	if ctx.Config.Thumbnails.MaxSourceBytes > 0 {
+		r = io.LimitReader(image.Data, ctx.Config.Thumbnails.MaxSourceBytes+1)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error reading URL preview image for resizing: ", err)
+		sentry.CaptureException(err)
+		_ = image.Data.Close()
+		return nil
+	}
+	original := &m.PreviewImage{
+		ContentType: image.ContentType,
+		Filename:    image.Filename,
+		Data: readers.NewCancelCloser(io.NopCloser(io.MultiReader(bytes.NewReader(b), image.Data)), func() {
+			_ = image.Data.Close()
+		}),
+	}
+	if ctx.Config.Thumbnails.MaxSourceBytes > 0 && int64(len(b)) > ctx.Config.Thumbnails.MaxSourceBytes {
+		return original
+	}
+
+	thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(b)), image.ContentType, size.Width, size.Height, "scale", false, ctx)
+	if err != nil {
+		if !errors.Is(err, common.ErrMediaDimensionsTooSmall) && !errors.Is(err, thumbnailing.ErrUnsupported) {
+			ctx.Log.Warn("Non-fatal error resizing URL preview image: ", err)
+			sentry.CaptureException(err)
+		}
+		return original
+	}
+	_ = image.Data.Close()
+
+	return &m.PreviewImage{
+		ContentType: thumb.ContentType,
+		Filename:    image.Filename,
+		Data:        thumb.Reader,
+	}
+}
@@ -0,0 +1,40 @@
+package u
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// NormalizeText cleans up text taken from a page so it can be shown on a single line. Control characters are
+// removed, and runs of whitespace (including newlines and non-breaking spaces) become a single space. Entities
+// are left alone: the HTML parser has already decoded them once, and anything left was encoded twice on purpose.
+func NormalizeText(text string) string {
+	var sb strings.Builder
+	sb.Grow(len(text))
+	space := false
+	for _, r := range text {
+		if unicode.IsSpace(r) {
+			space = sb.Len() > 0
+			continue
+		}
+		if unicode.IsControl(r) {
+			continue
+		}
+		if space {
+			sb.WriteRune(' ')
+			space = false
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// NormalizeEncodedText is NormalizeText for text which hasn't been through an HTML parser, like oEmbed responses,
+// where HTML entities are decoded first.
+func NormalizeEncodedText(text string) string {
+	if strings.ContainsRune(text, '&') {
+		text = html.UnescapeString(text)
+	}
+	return NormalizeText(text)
+}
@@ -0,0 +1,39 @@
+package u
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+const dnsPort = "53"
+
+func getResolver(ctx rcontext.RequestContext) *net.Resolver {
+	servers := ctx.Config.UrlPreviews.DnsServers
+	if len(servers) == 0 {
+		return net.DefaultResolver
+	}
+
+	dialer := &net.Dialer{
+		Timeout: time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx2 context.Context, network, address string) (net.Conn, error) {
+			// Ignore the system's nameserver, and use the first of ours which we can reach
+			var err error
+			for _, server := range servers {
+				if _, _, splitErr := net.SplitHostPort(server); splitErr != nil {
+					server = net.JoinHostPort(server, dnsPort)
+				}
+				var conn net.Conn
+				if conn, err = dialer.DialContext(ctx2, network, server); err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+}
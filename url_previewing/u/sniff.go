@@ -0,0 +1,52 @@
+package u
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// sniffLength is how much of a response is used to detect its type, per the MIME Sniffing standard.
+const sniffLength = 512
+
+// sniffContentType works out the type of a response which didn't say what it is, or only said it's
+// application/octet-stream, from its first bytes. Only HTML and images are detected, as those are what can be
+// previewed. The returned body reads the whole response, including the bytes which were sniffed.
+func sniffContentType(contentType string, body io.ReadCloser, ctx rcontext.RequestContext) (string, io.ReadCloser, error) {
+	if !ctx.Config.UrlPreviews.SniffContentType {
+		return contentType, body, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	if mediaType != "" && mediaType != "application/octet-stream" {
+		return contentType, body, nil
+	}
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(body, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		_ = body.Close()
+		return "", nil, err
+	}
+	head = head[:n]
+	original := body
+	body = readers.NewCancelCloser(io.NopCloser(io.MultiReader(bytes.NewReader(head), original)), func() {
+		_ = original.Close()
+	})
+
+	// The detected charset is a guess, so it's left for the page's own declarations (or our guessing) to decide
+	sniffed, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil || (sniffed != "text/html" && !strings.HasPrefix(sniffed, "image/")) {
+		return contentType, body, nil
+	}
+	ctx.Log.Debugf("Sniffed %s from response with content type '%s'", sniffed, contentType)
+	return sniffed, body, nil
+}
@@ -3,12 +3,17 @@ package u
 import (
 	"regexp"
 	"strings"
+	"unicode/utf8"
 )
 
 var surroundingWhitespace = regexp.MustCompile(`^[\s\p{Zs}]+|[\s\p{Zs}]+$`)
 var interiorWhitespace = regexp.MustCompile(`[\s\p{Zs}]{2,}`)
 var newlines = regexp.MustCompile(`[\r\n]`)
 
+const ellipsis = "..."
+
+// Summarize limits the text to maxWords words, then to maxLength characters. Text which is too long is cut at a
+// word boundary if possible, and ends with an ellipsis which counts towards the length.
 func Summarize(text string, maxWords int, maxLength int) string {
 	// Normalize the whitespace to be something useful (crush it to one giant line)
 	text = surroundingWhitespace.ReplaceAllString(text, "")
@@ -21,22 +26,28 @@ func Summarize(text string, maxWords int, maxLength int) string {
 		result = strings.Join(words[:maxWords], " ")
 	}
 
-	if len(result) > maxLength {
-		// First try trimming off the last word
+	if utf8.RuneCountInString(result) > maxLength {
+		limit := max(maxLength-len(ellipsis), 0)
+
+		// First try trimming off the last words
 		words = strings.Split(result, " ")
 		newResult := ""
 		for _, word := range words {
-			if len(newResult+" "+word) > maxLength {
+			candidate := word
+			if newResult != "" {
+				candidate = newResult + " " + word
+			}
+			if utf8.RuneCountInString(candidate) > limit {
 				break
 			}
-			newResult = newResult + " " + word
+			newResult = candidate
 		}
-		result = newResult
-	}
 
-	if len(result) > maxLength {
-		// It's still too long, just trim the thing and add an ellipsis
-		result = result[:maxLength] + "..."
+		if newResult == "" {
+			// The first word is too long by itself, so just trim the thing (without splitting a character)
+			newResult = string([]rune(result)[:limit])
+		}
+		result = newResult + ellipsis
 	}
 
 	return result
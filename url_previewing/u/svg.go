@@ -0,0 +1,37 @@
+package u
+
+import (
+	"mime"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+)
+
+// Values for `urlPreviews.svgImages`, which decides what happens to SVG preview images that can't be rasterized
+// (see CanRasterizeSvg). Rasterized SVGs are treated like any other image.
+const (
+	SvgImagesSkip  = "skip"  // the image is left out of the preview, without downloading it
+	SvgImagesStore = "store" // the image is stored as it is, for clients to render themselves
+)
+
+// IsSvg returns true if the content type is an SVG image.
+func IsSvg(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	return mediaType == "image/svg+xml"
+}
+
+// CanRasterizeSvg returns true if ResizeImage turns SVG preview images into PNGs, which needs a preview image size
+// and the SVG thumbnailer to be available.
+func CanRasterizeSvg(ctx rcontext.RequestContext) bool {
+	size := ctx.Config.UrlPreviews.ImageThumbnailSize
+	return size.Width > 0 && size.Height > 0 && thumbnailing.IsAvailable("image/svg+xml", ctx)
+}
+
+// IsSkippedSvg returns true if the content type is an SVG image which can't be rasterized, and shouldn't be stored
+// as it is either.
+func IsSkippedSvg(contentType string, ctx rcontext.RequestContext) bool {
+	return IsSvg(contentType) && !CanRasterizeSvg(ctx) && ctx.Config.UrlPreviews.SvgImages != SvgImagesStore
+}
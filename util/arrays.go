@@ -9,3 +9,17 @@ func ArrayContains(a []string, v string) bool {
 
 	return false
 }
+
+// Chunk splits a into slices of at most size elements. The slices share a's backing array.
+func Chunk[T any](a []T, size int) [][]T {
+	if size <= 0 {
+		size = len(a)
+	}
+	chunks := make([][]T, 0)
+	for len(a) > 0 {
+		n := min(size, len(a))
+		chunks = append(chunks, a[:n:n])
+		a = a[n:]
+	}
+	return chunks
+}
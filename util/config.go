@@ -7,7 +7,7 @@ import (
 )
 
 func IsServerOurs(server string) bool {
-	hs := config.GetDomain(server)
+	hs := GetDomainConfig(server)
 	return hs != nil
 }
 
@@ -22,9 +22,9 @@ func IsGlobalAdmin(userId string) bool {
 }
 
 func IsHostIgnored(serverName string) bool {
-	serverName = strings.ToLower(serverName)
+	serverName = strings.ToLower(CanonicalServerName(serverName))
 	for _, host := range config.Get().Federation.IgnoredHosts {
-		if strings.ToLower(host) == serverName {
+		if strings.ToLower(CanonicalServerName(host)) == serverName {
 			return true
 		}
 	}
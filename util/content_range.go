@@ -0,0 +1,62 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidContentRange = errors.New("invalid content range")
+
+// ContentRange is a single byte range as described by a Content-Range header. End is inclusive, and Size
+// is -1 when the complete length is unknown (`*`).
+type ContentRange struct {
+	Start int64
+	End   int64
+	Size  int64
+}
+
+func (r ContentRange) Length() int64 {
+	return r.End - r.Start + 1
+}
+
+func (r ContentRange) String() string {
+	size := "*"
+	if r.Size >= 0 {
+		size = strconv.FormatInt(r.Size, 10)
+	}
+	return fmt.Sprintf("bytes %d-%d/%s", r.Start, r.End, size)
+}
+
+// ParseContentRange parses a `bytes` Content-Range header as per RFC 9110 section 14.4. Unsatisfied ranges
+// (`bytes */1234`) are not accepted, as they do not describe any content.
+func ParseContentRange(s string) (*ContentRange, error) {
+	const b = "bytes "
+	if !strings.HasPrefix(s, b) {
+		return nil, ErrInvalidContentRange
+	}
+	rangeStr, sizeStr, ok := strings.Cut(strings.TrimSpace(s[len(b):]), "/")
+	if !ok {
+		return nil, ErrInvalidContentRange
+	}
+	startStr, endStr, ok := strings.Cut(rangeStr, "-")
+	if !ok {
+		return nil, ErrInvalidContentRange
+	}
+
+	r := &ContentRange{Size: -1}
+	var err error
+	if r.Start, err = strconv.ParseInt(startStr, 10, 64); err != nil || r.Start < 0 {
+		return nil, ErrInvalidContentRange
+	}
+	if r.End, err = strconv.ParseInt(endStr, 10, 64); err != nil || r.End < r.Start {
+		return nil, ErrInvalidContentRange
+	}
+	if sizeStr != "*" {
+		if r.Size, err = strconv.ParseInt(sizeStr, 10, 64); err != nil || r.Size <= r.End {
+			return nil, ErrInvalidContentRange
+		}
+	}
+	return r, nil
+}
@@ -10,11 +10,19 @@ import (
 )
 
 func ToUtf8(text string, possibleContentType string) string {
+	converted, _ := ToUtf8WithGuess(text, possibleContentType)
+	return converted
+}
+
+// ToUtf8WithGuess is ToUtf8, but also returns true if the text's character set had to be guessed from its
+// contents, meaning the conversion may be wrong.
+func ToUtf8WithGuess(text string, possibleContentType string) (string, bool) {
 	if utf8.ValidString(text) {
-		return text
+		return text, false
 	}
 
 	textCharset := ""
+	guessed := false
 
 	if possibleContentType != "" {
 		_, name, ok := charset.DetermineEncoding([]byte(text), possibleContentType)
@@ -27,20 +35,21 @@ func ToUtf8(text string, possibleContentType string) string {
 		detector := chardet.NewTextDetector()
 		cs, err := detector.DetectBest([]byte(text))
 		if err != nil {
-			return text // best we can do
+			return text, true // best we can do
 		}
 		textCharset = cs.Charset
+		guessed = true
 	}
 
 	r, err := charset.NewReader(strings.NewReader(text), textCharset)
 	if err != nil {
-		return text // best we can do
+		return text, true // best we can do
 	}
 
 	converted, err := io.ReadAll(r)
 	if err != nil {
-		return text // best we can do
+		return text, true // best we can do
 	}
 
-	return string(converted)
+	return string(converted), guessed
 }
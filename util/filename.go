@@ -0,0 +1,51 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alioygur/is"
+)
+
+// PickFilename returns the first of the given names which isn't blank, or an empty string if they all are.
+func PickFilename(names ...string) string {
+	for _, name := range names {
+		if strings.TrimSpace(name) != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// ContentDispositionFilename formats fname as a filename parameter for a Content-Disposition header. ASCII
+// names are sent as a quoted string, and anything else is percent-encoded as described by RFC 5987.
+func ContentDispositionFilename(fname string) string {
+	if is.ASCII(fname) {
+		quoted := strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f {
+				return -1 // control characters can't be sent in a header
+			}
+			return r
+		}, fname)
+		quoted = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(quoted)
+		return "filename=\"" + quoted + "\""
+	}
+
+	sb := strings.Builder{}
+	for _, b := range []byte(fname) {
+		if isAttrChar(b) {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+	return "filename*=utf-8''" + sb.String()
+}
+
+// isAttrChar is the attr-char set from RFC 5987 section 3.2.1
+func isAttrChar(b byte) bool {
+	if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') {
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
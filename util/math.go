@@ -20,3 +20,10 @@ func MinFloat32(a float32, b float32) float32 {
 	}
 	return b
 }
+
+func AbsInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
@@ -6,6 +6,9 @@ import (
 	"github.com/t2bot/matrix-media-repo/common"
 )
 
+// LimitReaderWithOverrunError returns a reader which reads at most n bytes from r. Unlike io.LimitReader,
+// the returned reader looks one byte past the limit and returns common.ErrMediaTooLarge if more data
+// is available, rather than silently truncating the stream.
 func LimitReaderWithOverrunError(r io.ReadCloser, n int64) io.ReadCloser {
 	return &limitedReader{r: r, n: n}
 }
@@ -16,22 +19,31 @@ type limitedReader struct {
 }
 
 func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
 	if r.n <= 0 {
 		// See if we can read one more byte, indicating the stream is too big
 		b := make([]byte, 1)
-		n, err := r.r.Read(b)
-		p[0] = b[0]
-		if err != nil {
-			// ignore - we're at the end anyways
-			return n, io.EOF
-		}
-		if n > 0 {
-			return n, common.ErrMediaTooLarge
+		for {
+			n, err := r.r.Read(b)
+			if n > 0 {
+				return 0, common.ErrMediaTooLarge
+			}
+			if err != nil {
+				if err == io.EOF {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
 		}
-
-		return n, io.EOF
 	}
 
+	// Never hand the caller more than the remaining allowance
+	if int64(len(p)) > r.n {
+		p = p[0:r.n]
+	}
 	n, err := r.r.Read(p)
 	r.n -= int64(n)
 	return n, err
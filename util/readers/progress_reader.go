@@ -0,0 +1,26 @@
+package readers
+
+import "io"
+
+// ProgressReader calls a function with the total number of bytes read so far after each read.
+type ProgressReader struct {
+	io.ReadCloser
+	total    int64
+	progress func(total int64)
+}
+
+func NewProgressReader(r io.ReadCloser, progress func(total int64)) *ProgressReader {
+	return &ProgressReader{
+		ReadCloser: r,
+		progress:   progress,
+	}
+}
+
+func (r *ProgressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.total += int64(n)
+		r.progress(r.total)
+	}
+	return n, err
+}
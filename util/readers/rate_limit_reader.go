@@ -0,0 +1,41 @@
+package readers
+
+import (
+	"io"
+	"time"
+)
+
+// NewRateLimitedReader returns a reader which reads from r no faster than bytesPerSecond, on average. Reads
+// are capped to one second's worth of data so the limit applies smoothly to large buffers. A bytesPerSecond
+// of zero or less disables the limit.
+func NewRateLimitedReader(r io.Reader, bytesPerSecond int64) io.Reader {
+	if bytesPerSecond <= 0 {
+		return r
+	}
+	return &rateLimitedReader{r: r, bytesPerSecond: bytesPerSecond}
+}
+
+type rateLimitedReader struct {
+	r              io.Reader
+	bytesPerSecond int64
+	start          time.Time
+	read           int64
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	if int64(len(p)) > r.bytesPerSecond {
+		p = p[0:r.bytesPerSecond]
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+
+	// Sleep until we're back within the allowance
+	expected := time.Duration(float64(r.read) / float64(r.bytesPerSecond) * float64(time.Second))
+	if wait := expected - time.Since(r.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
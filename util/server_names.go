@@ -0,0 +1,71 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+)
+
+// NormalizeServerName lowercases the server name's host, and removes its port if it is one of stripPorts.
+// IPv6 literals keep their brackets.
+func NormalizeServerName(serverName string, stripPorts []int) string {
+	host, port := splitServerName(serverName)
+	host = strings.ToLower(host)
+	if port == "" {
+		return host
+	}
+	if p, err := strconv.Atoi(port); err == nil {
+		for _, strip := range stripPorts {
+			if p == strip {
+				return host
+			}
+		}
+	}
+	return host + ":" + port
+}
+
+// CanonicalServerName returns the form of the server name which should be stored and compared. This is the
+// server name as given, unless normalization is enabled in the config.
+func CanonicalServerName(serverName string) string {
+	conf := config.Get().Federation.ServerNameNormalization
+	if !conf.Enabled {
+		return serverName
+	}
+	return NormalizeServerName(serverName, conf.StripPorts)
+}
+
+// GetDomainConfig returns the configuration for one of our server names, or nil if it isn't ours. When
+// normalization is enabled, the configured names are normalized before comparing them too.
+func GetDomainConfig(serverName string) *config.DomainRepoConfig {
+	if hs := config.GetDomain(serverName); hs != nil {
+		return hs
+	}
+
+	conf := config.Get().Federation.ServerNameNormalization
+	if !conf.Enabled {
+		return nil
+	}
+	serverName = NormalizeServerName(serverName, conf.StripPorts)
+	for _, hs := range config.AllDomains() {
+		if NormalizeServerName(hs.Name, conf.StripPorts) == serverName {
+			return hs
+		}
+	}
+	return nil
+}
+
+func splitServerName(serverName string) (string, string) {
+	// IPv6 literals are the only server names which contain colons outside the port
+	if strings.HasPrefix(serverName, "[") {
+		if end := strings.Index(serverName, "]"); end > 0 {
+			host := serverName[:end+1]
+			return host, strings.TrimPrefix(serverName[end+1:], ":")
+		}
+		return serverName, ""
+	}
+	if i := strings.LastIndex(serverName, ":"); i >= 0 {
+		return serverName[:i], serverName[i+1:]
+	}
+	return serverName, ""
+}
@@ -0,0 +1,60 @@
+package stripmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+const orientationTag = 0x0112
+
+// readOrientation finds the orientation in a TIFF-formatted EXIF block, returning zero if there is none.
+func readOrientation(tiff []byte) uint16 {
+	tiff = bytes.TrimPrefix(tiff, exifHeader)
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	if bytes.HasPrefix(tiff, []byte("II")) {
+		order = binary.LittleEndian
+	} else if bytes.HasPrefix(tiff, []byte("MM")) {
+		order = binary.BigEndian
+	} else {
+		return 0
+	}
+
+	ifd := order.Uint32(tiff[4:8])
+	if uint64(ifd)+2 > uint64(len(tiff)) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < count; i++ {
+		entry := int(ifd) + 2 + (i * 12)
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:entry+2]) == orientationTag && order.Uint16(tiff[entry+2:entry+4]) == 3 {
+			orientation := order.Uint16(tiff[entry+8 : entry+10])
+			if orientation > 8 {
+				return 0
+			}
+			return orientation
+		}
+	}
+	return 0
+}
+
+// makeOrientationExif builds a TIFF-formatted EXIF block which contains only the given orientation.
+func makeOrientationExif(orientation uint16) []byte {
+	b := make([]byte, 26)
+	copy(b[0:4], "MM\x00\x2a")
+	binary.BigEndian.PutUint32(b[4:8], 8)                // offset to IFD0
+	binary.BigEndian.PutUint16(b[8:10], 1)               // 1 entry
+	binary.BigEndian.PutUint16(b[10:12], orientationTag) // tag
+	binary.BigEndian.PutUint16(b[12:14], 3)              // type: SHORT
+	binary.BigEndian.PutUint32(b[14:18], 1)              // count
+	binary.BigEndian.PutUint16(b[18:20], orientation)    // value (padded to 4 bytes)
+	// b[22:26] is the zero offset to the next IFD
+	return b
+}
@@ -0,0 +1,86 @@
+package stripmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var xmpHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+var extendedXmpHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+
+const (
+	jpegSOI  = 0xD8
+	jpegSOS  = 0xDA
+	jpegEOI  = 0xD9
+	jpegAPP1 = 0xE1
+	jpegAPPD = 0xED // Photoshop/IPTC
+	jpegCOM  = 0xFE
+)
+
+func stripJpeg(b []byte) ([]byte, error) {
+	if len(b) < 2 || b[0] != 0xFF || b[1] != jpegSOI {
+		return nil, errors.New("jpeg: missing start of image")
+	}
+
+	kept := make([]byte, 0, len(b))
+	orientation := uint16(0)
+	i := 2
+	for {
+		if i+2 > len(b) || b[i] != 0xFF {
+			return nil, errors.New("jpeg: invalid segment marker")
+		}
+		marker := b[i+1]
+		if marker == 0xFF {
+			i++ // fill byte
+			continue
+		}
+		if marker == jpegEOI || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 {
+			kept = append(kept, b[i:i+2]...) // markers without a length
+			i += 2
+			if marker == jpegEOI {
+				break
+			}
+			continue
+		}
+		if i+4 > len(b) {
+			return nil, errors.New("jpeg: truncated segment")
+		}
+		length := int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+		if length < 2 {
+			return nil, errors.New("jpeg: invalid segment length")
+		}
+		end := i + 2 + length
+		if end > len(b) {
+			return nil, errors.New("jpeg: truncated segment")
+		}
+		if marker == jpegSOS {
+			// The rest is image data, which we don't touch
+			kept = append(kept, b[i:]...)
+			break
+		}
+
+		payload := b[i+4 : end]
+		switch {
+		case marker == jpegAPP1 && bytes.HasPrefix(payload, exifHeader):
+			if o := readOrientation(payload); o > 1 {
+				orientation = o
+			}
+		case marker == jpegAPP1 && (bytes.HasPrefix(payload, xmpHeader) || bytes.HasPrefix(payload, extendedXmpHeader)):
+		case marker == jpegAPPD || marker == jpegCOM:
+		default:
+			kept = append(kept, b[i:end]...)
+		}
+		i = end
+	}
+
+	out := make([]byte, 0, len(kept)+64)
+	out = append(out, 0xFF, jpegSOI)
+	if orientation > 1 {
+		exif := append(append([]byte{}, exifHeader...), makeOrientationExif(orientation)...)
+		out = append(out, 0xFF, jpegAPP1)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(exif)+2))
+		out = append(out, exif...)
+	}
+	return append(out, kept...), nil
+}
@@ -0,0 +1,54 @@
+package stripmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+var pngMetadataChunks = []string{"eXIf", "tEXt", "zTXt", "iTXt", "tIME"}
+
+func stripPng(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, pngSignature) {
+		return nil, errors.New("png: missing signature")
+	}
+
+	out := make([]byte, 0, len(b))
+	out = append(out, pngSignature...)
+	i := len(pngSignature)
+	for i < len(b) {
+		if i+12 > len(b) {
+			return nil, errors.New("png: truncated chunk")
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(b[i:i+4]))
+		if end > len(b) || end < i {
+			return nil, errors.New("png: truncated chunk")
+		}
+		chunkType := string(b[i+4 : i+8])
+		if chunkType == "eXIf" {
+			if o := readOrientation(b[i+8 : end-4]); o > 1 {
+				out = appendPngChunk(out, "eXIf", makeOrientationExif(o))
+			}
+		} else if !util.ArrayContains(pngMetadataChunks, chunkType) {
+			out = append(out, b[i:end]...)
+		}
+		i = end
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return out, nil
+}
+
+func appendPngChunk(out []byte, chunkType string, data []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+	start := len(out)
+	out = append(out, chunkType...)
+	out = append(out, data...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+}
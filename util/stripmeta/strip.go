@@ -0,0 +1,31 @@
+package stripmeta
+
+import (
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+var ErrUnsupported = errors.New("stripmeta: unsupported content type")
+
+var supportedContentTypes = []string{"image/jpeg", "image/jpg", "image/png", "image/webp"}
+
+// Supported returns true if metadata can be stripped from media of the given content type.
+func Supported(contentType string) bool {
+	return util.ArrayContains(supportedContentTypes, contentType)
+}
+
+// Strip removes EXIF, XMP, and textual metadata from the image, without re-encoding the image data itself.
+// Colour profiles are kept, as is the EXIF orientation (if set) so images still display the right way up.
+func Strip(contentType string, b []byte) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg", "image/jpg":
+		return stripJpeg(b)
+	case "image/png":
+		return stripPng(b)
+	case "image/webp":
+		return stripWebp(b)
+	default:
+		return nil, ErrUnsupported
+	}
+}
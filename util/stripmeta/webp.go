@@ -0,0 +1,62 @@
+package stripmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	webpFlagXmp  = 0x04
+	webpFlagExif = 0x08
+)
+
+func stripWebp(b []byte) ([]byte, error) {
+	if len(b) < 12 || !bytes.Equal(b[0:4], []byte("RIFF")) || !bytes.Equal(b[8:12], []byte("WEBP")) {
+		return nil, errors.New("webp: missing RIFF header")
+	}
+
+	out := make([]byte, 12, len(b))
+	copy(out, b[0:12])
+	vp8x := -1
+	orientation := uint16(0)
+	i := 12
+	for i+8 <= len(b) {
+		size := int(binary.LittleEndian.Uint32(b[i+4 : i+8]))
+		end := i + 8 + size + (size % 2) // chunks are padded to an even length
+		if end > len(b) || end < i {
+			if i+8+size == len(b) {
+				end = len(b) // tolerate a missing final pad byte
+			} else {
+				return nil, errors.New("webp: truncated chunk")
+			}
+		}
+		switch string(b[i : i+4]) {
+		case "EXIF":
+			if o := readOrientation(b[i+8 : i+8+size]); o > 1 {
+				orientation = o
+			}
+		case "XMP ":
+		case "VP8X":
+			vp8x = len(out)
+			out = append(out, b[i:end]...)
+		default:
+			out = append(out, b[i:end]...)
+		}
+		i = end
+	}
+
+	if vp8x >= 0 && vp8x+8 < len(out) {
+		out[vp8x+8] &^= webpFlagXmp | webpFlagExif
+		if orientation > 1 {
+			// EXIF is only allowed in the extended format, and goes at the end
+			out[vp8x+8] |= webpFlagExif
+			exif := makeOrientationExif(orientation)
+			out = append(out, "EXIF"...)
+			out = binary.LittleEndian.AppendUint32(out, uint32(len(exif)))
+			out = append(out, exif...)
+		}
+	}
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out, nil
+}